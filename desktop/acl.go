@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACL rules filter the tunneled IPv4 packets in both directions:
+//
+//	acl allow|deny <proto|any> <src-cidr|any> <dst-cidr|any> [port[-port]]
+//	acl default deny
+//
+// The port is the destination port. Rules are evaluated in order and the
+// first match wins, the default is allow. The flows of allowed packets are
+// tracked, so their replies pass without a rule of their own.
+const (
+	flowTimeout = 2 * time.Minute
+	flowMax     = 8192
+)
+
+type aclRule struct {
+	allow  bool
+	proto  int
+	src    *net.IPNet
+	dst    *net.IPNet
+	portLo int
+	portHi int
+}
+
+type aclFlow struct {
+	proto    byte
+	src, dst [4]byte
+	sport    uint16
+	dport    uint16
+}
+
+type aclFilter struct {
+	sync.Mutex
+	rules   []aclRule
+	deny    bool
+	flows   map[aclFlow]time.Time
+	allowed uint64
+	denied  uint64
+}
+
+var acl = &aclFilter{flows: make(map[aclFlow]time.Time)}
+
+// ACLStatus reports the rules in effect and the packets they filtered
+type ACLStatus struct {
+	Rules   int    `json:"rules"`
+	Default string `json:"default"`
+	Flows   int    `json:"flows"`
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+}
+
+// parseACL parses the value of an `acl` directive other than `default`
+func parseACL(val string) (aclRule, error) {
+	var r aclRule
+	vals := strings.Fields(val)
+	if len(vals) < 4 || len(vals) > 5 {
+		return r, fmt.Errorf("expected allow|deny proto src dst [port]")
+	}
+	switch vals[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("invalid action %s", vals[0])
+	}
+	switch vals[1] {
+	case "any":
+		r.proto = -1
+	case "icmp":
+		r.proto = 1
+	case "tcp":
+		r.proto = 6
+	case "udp":
+		r.proto = 17
+	default:
+		v, err := strconv.Atoi(vals[1])
+		if err != nil || v < 0 || v > 255 {
+			return r, fmt.Errorf("invalid protocol %s", vals[1])
+		}
+		r.proto = v
+	}
+	var err error
+	if r.src, err = parseACLNet(vals[2]); err != nil {
+		return r, err
+	}
+	if r.dst, err = parseACLNet(vals[3]); err != nil {
+		return r, err
+	}
+	if len(vals) == 5 {
+		ports := strings.SplitN(vals[4], "-", 2)
+		if r.portLo, err = strconv.Atoi(ports[0]); err != nil || r.portLo <= 0 || r.portLo > 65535 {
+			return r, fmt.Errorf("invalid port %s", vals[4])
+		}
+		r.portHi = r.portLo
+		if len(ports) == 2 {
+			if r.portHi, err = strconv.Atoi(ports[1]); err != nil || r.portHi < r.portLo || r.portHi > 65535 {
+				return r, fmt.Errorf("invalid port range %s", vals[4])
+			}
+		}
+	}
+	return r, nil
+}
+
+func parseACLNet(val string) (*net.IPNet, error) {
+	if val == "any" {
+		return nil, nil
+	}
+	if !strings.Contains(val, "/") {
+		val += "/32"
+	}
+	_, ipnet, err := net.ParseCIDR(val)
+	return ipnet, err
+}
+
+// aclKey returns the flow of an IPv4 packet, a later fragment having the
+// ports of its first one
+func aclKey(packet []byte) aclFlow {
+	key := aclFlow{proto: packet[9]}
+	copy(key.src[:], packet[12:16])
+	copy(key.dst[:], packet[16:20])
+	key.sport, key.dport, _ = l4Ports(packet)
+	return key
+}
+
+// String formats a rule as its directive
+func (r *aclRule) String() string {
+	action := "deny"
+	if r.allow {
+		action = "allow"
+	}
+	proto := "any"
+	if r.proto >= 0 {
+		proto = protoName(byte(r.proto))
+	}
+	nets := [2]string{"any", "any"}
+	for i, n := range []*net.IPNet{r.src, r.dst} {
+		if n != nil {
+			nets[i] = n.String()
+		}
+	}
+	s := fmt.Sprintf("%s %s %s %s", action, proto, nets[0], nets[1])
+	if r.portLo > 0 {
+		s += fmt.Sprintf(" %d", r.portLo)
+		if r.portHi != r.portLo {
+			s += fmt.Sprintf("-%d", r.portHi)
+		}
+	}
+	return s
+}
+
+func (r *aclRule) match(key *aclFlow) bool {
+	if r.proto >= 0 && byte(r.proto) != key.proto {
+		return false
+	}
+	if r.src != nil && !r.src.Contains(net.IP(key.src[:])) {
+		return false
+	}
+	if r.dst != nil && !r.dst.Contains(net.IP(key.dst[:])) {
+		return false
+	}
+	if r.portLo > 0 && (int(key.dport) < r.portLo || int(key.dport) > r.portHi) {
+		return false
+	}
+	return true
+}
+
+// Set replaces the rules, keeping the tracked flows
+func (f *aclFilter) Set(rules []aclRule, deny bool) {
+	f.Lock()
+	defer f.Unlock()
+	if len(rules) != len(f.rules) || deny != f.deny {
+		logTransport.Infof("[ACL] %d rules, default %s", len(rules), map[bool]string{true: "deny", false: "allow"}[deny])
+	}
+	f.rules = rules
+	f.deny = deny
+}
+
+// Allow returns whether the packet passes the rules, or belongs to a flow
+// whose packets in the other direction did.
+func (f *aclFilter) Allow(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return true
+	}
+	key := aclKey(packet)
+	f.Lock()
+	defer f.Unlock()
+	if len(f.rules) == 0 && !f.deny {
+		return true
+	}
+	now := time.Now()
+	reverse := aclFlow{proto: key.proto, src: key.dst, dst: key.src, sport: key.dport, dport: key.sport}
+	if seen, ok := f.flows[reverse]; ok && now.Sub(seen) < flowTimeout {
+		f.flows[reverse] = now
+		f.allowed++
+		return true
+	}
+	allow := !f.deny
+	for i := range f.rules {
+		if f.rules[i].match(&key) {
+			allow = f.rules[i].allow
+			break
+		}
+	}
+	if !allow {
+		f.denied++
+		return false
+	}
+	f.allowed++
+	if len(f.flows) >= flowMax {
+		for k, seen := range f.flows {
+			if now.Sub(seen) >= flowTimeout {
+				delete(f.flows, k)
+			}
+		}
+		if len(f.flows) >= flowMax {
+			f.flows = make(map[aclFlow]time.Time)
+		}
+	}
+	f.flows[key] = now
+	return true
+}
+
+// Explain tells what decides on a packet, a tracked flow, a rule or the
+// default, without tracking nor counting it. It is empty without rules.
+func (f *aclFilter) Explain(packet []byte) string {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return ""
+	}
+	key := aclKey(packet)
+	f.Lock()
+	defer f.Unlock()
+	if len(f.rules) == 0 && !f.deny {
+		return ""
+	}
+	reverse := aclFlow{proto: key.proto, src: key.dst, dst: key.src, sport: key.dport, dport: key.sport}
+	if seen, ok := f.flows[reverse]; ok && time.Since(seen) < flowTimeout {
+		return "allow, reply of a tracked flow"
+	}
+	for i := range f.rules {
+		if f.rules[i].match(&key) {
+			return fmt.Sprintf("rule %d: acl %s", i+1, f.rules[i].String())
+		}
+	}
+	if f.deny {
+		return "default deny"
+	}
+	return "default allow"
+}
+
+func (f *aclFilter) Status() *ACLStatus {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.rules) == 0 && !f.deny {
+		return nil
+	}
+	s := &ACLStatus{Rules: len(f.rules), Default: "allow", Flows: len(f.flows), Allowed: f.allowed, Denied: f.denied}
+	if f.deny {
+		s.Default = "deny"
+	}
+	return s
+}
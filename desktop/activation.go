@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An `expose` line with `activate` keeps its listeners closed until it is
+// activated for a window and the sources of a CIDR, then closes them again
+// once no window is left, the datagrams of the other sources being dropped
+// meanwhile. `expose-activation <port> <secret> [max window]` listens for the
+// signed activations of the LAN:
+//
+//	timestamp(8) | seconds(4) | ip(4) | bits(1) | hmac-sha256(secret, all before)
+//
+// sent by `docker-connector activate -knock <host:port> -secret <secret>`,
+// the seconds bounded by the window of the config, 10 minutes by default, and
+// the CIDR 0.0.0.0/0 standing for the sender only. `docker-connector activate`
+// without `-knock` goes through the admin API of the desktop instead.
+const (
+	activationLen     = 8 + 4 + 4 + 1 + 32
+	activationDefault = 10 * time.Minute
+)
+
+// ActivationStatus is a window of the activated listeners
+type ActivationStatus struct {
+	From  string `json:"from"`
+	Until string `json:"until"`
+	By    string `json:"by"`
+}
+
+type activation struct {
+	from  *net.IPNet
+	until time.Time
+	by    string
+}
+
+type activationTable struct {
+	sync.Mutex
+	port    int
+	secret  string
+	window  time.Duration
+	conn    *net.UDPConn
+	windows []activation
+	last    map[string]int64
+	started bool
+}
+
+var activations = &activationTable{window: activationDefault, last: make(map[string]int64)}
+
+// parseActivation parses `expose-activation <port> <secret> [window]`
+func parseActivation(val string, init bool) (int, string, time.Duration, error) {
+	vals := strings.Fields(val)
+	if len(vals) < 2 || len(vals) > 3 {
+		return 0, "", 0, fmt.Errorf("expected <port> <secret> [window]")
+	}
+	var port int
+	if _, err := fmt.Sscanf(vals[0], "%d", &port); err != nil || port < 0 || port > 65535 {
+		return 0, "", 0, fmt.Errorf("invalid port %s", vals[0])
+	}
+	var secret string
+	setSecret("expose-activation secret", &secret, vals[1], init)
+	window := activationDefault
+	if len(vals) == 3 {
+		d, err := time.ParseDuration(vals[2])
+		if err != nil || d <= 0 {
+			return 0, "", 0, fmt.Errorf("invalid window %s", vals[2])
+		}
+		window = d
+	}
+	return port, secret, window, nil
+}
+
+// Set applies `expose-activation`, a port 0 listening for none
+func (t *activationTable) Set(port int, secret string, window time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	if !t.started {
+		t.started = true
+		go t.expire()
+	}
+	t.secret, t.window = secret, window
+	if port == t.port && (t.conn != nil) == (port > 0 && secret != "") {
+		return
+	}
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	t.port = port
+	if port <= 0 || secret == "" {
+		return
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		logExpose.Warningf("[ACTIVATE] Failed to listen on %d: %v", port, err)
+		return
+	}
+	t.conn = conn
+	logExpose.Infof("[ACTIVATE] Listening for activations on %v, up to %v each", conn.LocalAddr(), window)
+	go t.serve(conn)
+}
+
+func (t *activationTable) serve(conn *net.UDPConn) {
+	buf := make([]byte, 128)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return
+			}
+			continue
+		}
+		if !peersAllow.Allowed(addr.IP) || n != activationLen {
+			continue
+		}
+		t.Lock()
+		secret := t.secret
+		t.Unlock()
+		signed := n - 32
+		if !hmac.Equal(buf[signed:n], knockMAC(secret, buf[:signed])) {
+			logExpose.Warningf("[ACTIVATE] Invalid signature from %v", addr)
+			continue
+		}
+		ts := int64(binary.BigEndian.Uint64(buf[:8]))
+		if d := time.Since(time.Unix(0, ts)); d > knockSkew || d < -knockSkew {
+			logExpose.Warningf("[ACTIVATE] Stale activation from %v, skew %v", addr, d)
+			continue
+		}
+		t.Lock()
+		replayed := ts <= t.last[addr.IP.String()]
+		if !replayed {
+			t.last[addr.IP.String()] = ts
+		}
+		t.Unlock()
+		if replayed {
+			logExpose.Warningf("[ACTIVATE] Replayed activation from %v", addr)
+			continue
+		}
+		if buf[16] > 32 {
+			continue
+		}
+		from := &net.IPNet{IP: net.IP(buf[12:16]).Mask(net.CIDRMask(int(buf[16]), 32)), Mask: net.CIDRMask(int(buf[16]), 32)}
+		if buf[16] == 0 {
+			from = &net.IPNet{IP: addr.IP.To4(), Mask: net.CIDRMask(32, 32)}
+		}
+		t.Activate(from, time.Duration(binary.BigEndian.Uint32(buf[8:12]))*time.Second, addr.IP.String())
+	}
+}
+
+// Activate opens the `activate` listeners to a CIDR for a duration, bounded
+// by the window of the config
+func (t *activationTable) Activate(from *net.IPNet, d time.Duration, by string) time.Time {
+	t.Lock()
+	if d <= 0 || d > t.window {
+		d = t.window
+	}
+	until := time.Now().Add(d)
+	first := len(t.windows) == 0
+	t.windows = append(t.windows, activation{from: from, until: until, by: by})
+	t.Unlock()
+	logExpose.Infof("[ACTIVATE] Listeners open to %s for %v by %s", from, d.Round(time.Second), by)
+	events.Add("activate", "%s for %v by %s", from, d.Round(time.Second), by)
+	if first {
+		exposes.Reapply()
+	}
+	return until
+}
+
+// Active tells whether a window is open
+func (t *activationTable) Active() bool {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.windows) > 0
+}
+
+// Allowed tells whether a source is in an open window
+func (t *activationTable) Allowed(ip net.IP) bool {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for _, w := range t.windows {
+		if now.Before(w.until) && w.from.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire closes the windows past their time, and the listeners once none is
+// left
+func (t *activationTable) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.Lock()
+		had := len(t.windows) > 0
+		now := time.Now()
+		kept := t.windows[:0]
+		for _, w := range t.windows {
+			if now.Before(w.until) {
+				kept = append(kept, w)
+			} else {
+				logExpose.Infof("[ACTIVATE] Window of %s closed", w.from)
+			}
+		}
+		t.windows = kept
+		closed := had && len(kept) == 0
+		t.Unlock()
+		if closed {
+			logExpose.Infof("[ACTIVATE] No window left, closing the listeners")
+			exposes.Reapply()
+		}
+	}
+}
+
+// Status lists the open windows
+func (t *activationTable) Status() []ActivationStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.windows) == 0 {
+		return nil
+	}
+	list := make([]ActivationStatus, 0, len(t.windows))
+	for _, w := range t.windows {
+		list = append(list, ActivationStatus{From: w.from.String(), Until: w.until.Format(time.RFC3339), By: w.by})
+	}
+	return list
+}
+
+// Close stops listening for activations
+func (t *activationTable) Close() {
+	t.Lock()
+	defer t.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// serveActivate opens a window with POST `?for=<duration>&from=<cidr>`, the
+// CIDR defaulting to all, and lists the windows
+func serveActivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		from := &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+		if v := r.URL.Query().Get("from"); v != "" {
+			_, ipnet, err := net.ParseCIDR(v)
+			if err != nil || ipnet.IP.To4() == nil {
+				http.Error(w, "invalid from "+v, http.StatusBadRequest)
+				return
+			}
+			from = ipnet
+		}
+		var d time.Duration
+		if v := r.URL.Query().Get("for"); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil {
+				http.Error(w, "invalid for "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		activations.Activate(from, d, "admin")
+	}
+	list := activations.Status()
+	if list == nil {
+		list = []ActivationStatus{}
+	}
+	writeJSON(w, list)
+}
+
+// activationPacket signs an activation for a CIDR and a duration
+func activationPacket(secret string, from *net.IPNet, d time.Duration) []byte {
+	packet := make([]byte, 17, activationLen)
+	binary.BigEndian.PutUint64(packet, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(packet[8:], uint32(d/time.Second))
+	if from != nil {
+		copy(packet[12:16], from.IP.To4())
+		ones, _ := from.Mask.Size()
+		packet[16] = byte(ones)
+	}
+	return append(packet, knockMAC(secret, packet)...)
+}
+
+// runActivateCommand implements `activate [-for d] [-from cidr]`, through the
+// admin API or with `-knock` the signed datagram
+func runActivateCommand() {
+	fs := flag.NewFlagSet("activate", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	d := fs.Duration("for", 0, "window of the activation, 0 for the one of the config")
+	from := fs.String("from", "", "CIDR of the sources allowed, the sender only with -knock, all without")
+	knock := fs.String("knock", "", "host:port of expose-activation to send a signed activation to")
+	secret := fs.String("secret", "", "secret of expose-activation")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s activate [-admin addr | -knock host:port -secret s] [-for 10m] [-from cidr]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	var ipnet *net.IPNet
+	if *from != "" {
+		var err error
+		if _, ipnet, err = net.ParseCIDR(*from); err != nil || ipnet.IP.To4() == nil {
+			fmt.Fprintf(os.Stderr, "invalid -from %s\n", *from)
+			os.Exit(2)
+		}
+	}
+	if *knock != "" {
+		conn, err := net.Dial("udp", *knock)
+		if err == nil {
+			_, err = conn.Write(activationPacket(*secret, ipnet, *d))
+			conn.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to activate %s => %v\n", *knock, err)
+			os.Exit(1)
+		}
+		return
+	}
+	query := url.Values{}
+	if *d > 0 {
+		query.Set("for", d.String())
+	}
+	if ipnet != nil {
+		query.Set("from", ipnet.String())
+	}
+	body, err := adminPost("/expose/activate?"+query.Encode(), "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var list []ActivationStatus
+	if err := json.Unmarshal(body, &list); err != nil {
+		os.Stdout.Write(body)
+		return
+	}
+	for _, a := range list {
+		fmt.Printf("%-18s until %s by %s\n", a.From, a.Until, a.By)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	adminServer *http.Server
+	startTime   = time.Now()
+)
+
+// Status is the snapshot served by the admin API and printed by `status`
+type Status struct {
+	Instance  string               `json:"instance,omitempty"`
+	Uptime    string               `json:"uptime"`
+	Idle      bool                 `json:"idle,omitempty"`
+	Interface string               `json:"interface,omitempty"`
+	Requested string               `json:"interface_requested,omitempty"`
+	Listen    string               `json:"listen,omitempty"`
+	Control   string               `json:"control,omitempty"`
+	Controls  *ControlsStatus      `json:"controls,omitempty"`
+	Metrics   *MetricsStatus       `json:"metrics,omitempty"`
+	Session   *ClientSessionStatus `json:"session,omitempty"`
+	Pins      *PinsStatus          `json:"pins,omitempty"`
+	Profile   *ProfileStatus       `json:"profile,omitempty"`
+	Failover  *FailoverStatus      `json:"failover,omitempty"`
+	Keepalive *KeepaliveStatus     `json:"nat_keepalive,omitempty"`
+	Path      *PathStatus          `json:"path,omitempty"`
+	Peers     *PeersStatus         `json:"peers,omitempty"`
+	Schedule  *ScheduleStatus      `json:"schedule,omitempty"`
+	Client    string               `json:"client,omitempty"`
+	LastSeen  string               `json:"last_seen,omitempty"`
+	LocalIP   string               `json:"local_ip"`
+	PeerIP    string               `json:"peer_ip,omitempty"`
+	Routes    map[string]bool      `json:"routes"`
+	RouteOpts map[string]string    `json:"route_options,omitempty"`
+	// RouteProtos are the routes restricting the protocols
+	RouteProtos map[string]RouteProtoStatus `json:"route_protocols,omitempty"`
+	RouteTUNs   []RouteTUNStatus            `json:"route_tuns,omitempty"`
+	RouteErrs   map[string]RouteError       `json:"route_errors,omitempty"`
+	RouteFix    *RouteRepairStatus          `json:"route_repairs,omitempty"`
+	Clock       *ClockStatus                `json:"clock,omitempty"`
+	NoClient    string                      `json:"no_client"`
+	Queued      int                         `json:"queued"`
+	QueueDrop   uint64                      `json:"queue_dropped"`
+	Truncated   uint64                      `json:"truncated_reads"`
+	Rejected    uint64                      `json:"rejected_packets"`
+	Traffic     map[string]SubnetTraffic    `json:"traffic"`
+	Diag        *DiagStatus                 `json:"diag,omitempty"`
+	Knocks      map[string]string           `json:"knocks,omitempty"`
+	Compress    *CompressStatus             `json:"compress"`
+	FEC         *FECStatus                  `json:"fec,omitempty"`
+	Dedup       *DedupStatus                `json:"dedup,omitempty"`
+	ACL         *ACLStatus                  `json:"acl,omitempty"`
+	HostSvc     *HostServicesStatus         `json:"host_services,omitempty"`
+	NAT         []string                    `json:"nat,omitempty"`
+	LimitUp     *LimitStatus                `json:"limitUp,omitempty"`
+	LimitDown   *LimitStatus                `json:"limitDown,omitempty"`
+	Netem       *NetemStatus                `json:"netem,omitempty"`
+	Crashes     map[string]CrashStatus      `json:"crashes,omitempty"`
+	Sessions    []SessionStatus             `json:"sessions,omitempty"`
+	Tap         *TapStatus                  `json:"tap,omitempty"`
+	Release     *ReleaseStatus              `json:"release,omitempty"`
+	Summaries   []PeerSummary               `json:"disconnects,omitempty"`
+	TCPExpose   []TCPExposeStatus           `json:"expose_tcp,omitempty"`
+	Loopback    *LoopbackStatus             `json:"loopback"`
+	Forwards    []ForwardStatus             `json:"forwards,omitempty"`
+	Exposes     []ExposeStatus              `json:"exposes,omitempty"`
+	WireGuard   *WireGuardStatus            `json:"wireguard,omitempty"`
+	Encap       *EncapStatus                `json:"encap,omitempty"`
+	Docker      *DockerStatus               `json:"docker,omitempty"`
+	Degraded    *DegradedStatus             `json:"degraded,omitempty"`
+	Alarms      []AlarmStatus               `json:"alarms,omitempty"`
+	ConfigApply *ConfigApplyStatus          `json:"config_apply,omitempty"`
+	Socks       *SocksStatus                `json:"socks,omitempty"`
+	Conflicts   map[string]RouteConflict    `json:"conflicts,omitempty"`
+	Conntrack   *ConntrackStatus            `json:"conntrack,omitempty"`
+	MDNS        []MDNSStatus                `json:"mdns,omitempty"`
+	PortMaps    []PortMapStatus             `json:"port_mappings,omitempty"`
+	Mirrors     []MirrorStatus              `json:"mirrors,omitempty"`
+	Published   []PublishStatus             `json:"published,omitempty"`
+	Activated   []ActivationStatus          `json:"expose_activations,omitempty"`
+}
+
+func collectStatus(c *Connector) *Status {
+	st := &Status{
+		Instance:    instanceName,
+		Uptime:      time.Since(startTime).Round(time.Second).String(),
+		Idle:        isIdle(),
+		LocalIP:     localIP.String(),
+		Control:     controlStatus(),
+		Controls:    ctlVersions.Status(),
+		Metrics:     metrics.Status(),
+		Session:     sessionStatus(),
+		Pins:        pins.Status(),
+		Profile:     profiles.Status(),
+		Failover:    failover.Status(),
+		Keepalive:   keepaliveStatus(),
+		Path:        paths.Status(),
+		Peers:       peersAllow.Status(),
+		Schedule:    schedules.Status(),
+		Routes:      shared.Routes(),
+		RouteOpts:   routeOptionsStatus(),
+		RouteProtos: routeProtos.Status(),
+		RouteTUNs:   routeTUNs.Status(),
+		RouteErrs:   routeErrors.Status(),
+		RouteFix:    routeRepairs.Status(),
+		Clock:       clock.Status(),
+		NoClient:    noClient,
+		Traffic:     traffic.Snapshot(),
+		Diag:        diag.Status(),
+		Knocks:      knocks.Status(),
+		Compress:    compressStatus(),
+		FEC:         fecStatus(),
+		Dedup:       dedupStatus(),
+		ACL:         acl.Status(),
+		HostSvc:     hostSvc.Status(),
+		NAT:         natSubnets,
+		LimitUp:     upLimit.Status(),
+		LimitDown:   downLimit.Status(),
+		Netem:       netem.Status(),
+		Crashes:     crashStatus(),
+		Sessions:    sessions.Status(),
+		Release:     releaseStatus(),
+		Summaries:   peerStats.History(),
+		TCPExpose:   tcpExposes.Status(),
+		Loopback:    loopbacks.Status(),
+		Forwards:    forwards.Status(),
+		Exposes:     exposes.Status(),
+		WireGuard:   wireGuardStatus(),
+		Encap:       encapStatus(),
+		Docker:      dockerStatus(),
+		Degraded:    degraded,
+		Alarms:      alarms.Status(),
+		ConfigApply: configApply.Status(),
+		Socks:       socks.Status(),
+		Conflicts:   conflicts.Status(),
+		Conntrack:   conntrack.Status(),
+		MDNS:        mdnsAds.Status(),
+		PortMaps:    portMaps.Status(),
+		Mirrors:     mirrors.Status(),
+		Published:   publishes.Status(),
+		Activated:   activations.Status(),
+	}
+	if tapMode && c != nil {
+		st.Tap = tapStatus(c.iface)
+	}
+	st.Queued, st.QueueDrop = pendingQueue.Stats()
+	st.Truncated = atomic.LoadUint64(&truncatedReads)
+	st.Rejected = atomic.LoadUint64(&rejectedPackets)
+	if c != nil && c.iface != nil {
+		st.Interface = c.iface.Name()
+		st.Requested = ifName
+	}
+	if conn != nil {
+		st.Listen = conn.LocalAddr().String()
+	}
+	if cli := shared.Client(); cli != nil {
+		st.Client = cli.String()
+	}
+	if seen := atomic.LoadInt64(&lastSeen); seen != 0 {
+		st.LastSeen = time.Unix(0, seen).Format(time.RFC3339)
+	}
+	if peer != nil {
+		st.PeerIP = peer.String()
+	}
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// startAdmin serves the admin API on the loopback address `adminAddr`
+func startAdmin(c *Connector) {
+	if adminAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", localOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, collectStatus(c))
+	}))
+	mux.HandleFunc("/healthz", serveHealth(c))
+	mux.HandleFunc("/doctor", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, runDoctor(c))
+	})
+	if webUI {
+		mux.HandleFunc("/", localOnly(serveUI))
+	}
+	mux.HandleFunc("/routes", localOnly(serveRoutes))
+	mux.HandleFunc("/route", localWrite(serveRoute))
+	mux.HandleFunc("/hosts", localOnly(serveHosts))
+	mux.HandleFunc("/logs", localOnly(serveLogs))
+	mux.HandleFunc("/events", localOnly(serveEvents))
+	mux.HandleFunc("/audit", localOnly(serveAudit))
+	mux.HandleFunc("/inject", localOnly(serveInject(c)))
+	mux.HandleFunc("/loglevel", localWrite(serveLogLevel))
+	mux.HandleFunc("/learn", localWrite(serveLearn))
+	mux.HandleFunc("/flows", localOnly(serveFlows))
+	mux.HandleFunc("/dns", localOnly(serveDNS))
+	mux.HandleFunc("/profile", localWrite(serveProfile))
+	mux.HandleFunc("/pins", localWrite(servePins))
+	mux.HandleFunc("/expose/activate", localWrite(serveActivate))
+	mux.HandleFunc("/probe", localWrite(serveProbe))
+	mux.HandleFunc("/bench", localWrite(serveBench))
+	mux.HandleFunc("/batch", localOnly(serveBatch))
+	mux.HandleFunc("/diag", localWrite(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := sendDiag(strings.TrimSpace(string(body))); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, map[string]string{"sent": string(body)})
+	}))
+	ln, err := listenAdmin()
+	if err != nil {
+		logger.Warningf("[ADMIN] failed to listen %s => %v", adminAddr, err)
+		return
+	}
+	adminServer = &http.Server{Handler: auditAdmin(mux)}
+	logger.Infof("[ADMIN] listening on %v", ln.Addr())
+	go adminServer.Serve(ln)
+}
+
+func stopAdmin() {
+	if adminServer != nil {
+		adminServer.Close()
+		adminServer = nil
+	}
+}
+
+// adminGet requests the admin API of the running service
+func adminGet(path string) ([]byte, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	rsp, err := client.Get(fmt.Sprintf("http://%s%s", adminAddr, path))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rsp.Status, body)
+	}
+	return body, nil
+}
+
+// adminPost sends `body` to the admin API of the running service
+func adminPost(path, body string) ([]byte, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", adminAddr, path), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set(adminHeader, "1")
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rsp.Status, data)
+	}
+	return data, nil
+}
+
+func printStatus() {
+	body, err := adminGet("/status")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
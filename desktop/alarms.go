@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Alarms tell the user the tunnel is struggling before they debug their
+// application for an hour:
+//
+//	alarm loss 20%      heartbeats of the docker side missing over a minute
+//	alarm rtt 150ms     round trip of the last heartbeat
+//	alarm drops 100     packets dropped per minute, by the ACLs, the limits, the errors...
+//	alarm notify desktop
+//	alarm notify https://hooks.example.com/connector
+//
+// The thresholds are checked every alarmPeriod while a docker side is
+// connected. An alarm is raised once over its threshold and cleared once back
+// under it, each time logged, kept in the events and notified: `desktop` shows
+// a notification of macOS, a toast of Windows or notify-send elsewhere, and a
+// URL gets an AlarmNotice POSTed as JSON, its `text` shown by Slack like
+// webhooks. The alarms are listed in `alarms` of `status`.
+const (
+	alarmPeriod      = time.Minute
+	alarmPostTimeout = 10 * time.Second
+)
+
+// heartbeatCount counts the heartbeats of the docker side
+var heartbeatCount uint64
+
+// AlarmStatus describes an alarm of the config
+type AlarmStatus struct {
+	Name      string  `json:"name"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"`
+	Raised    bool    `json:"raised"`
+	Since     string  `json:"since,omitempty"`
+}
+
+// AlarmNotice is POSTed to the webhooks when an alarm is raised or cleared
+type AlarmNotice struct {
+	Alarm     string  `json:"alarm"`
+	State     string  `json:"state"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Client    string  `json:"client,omitempty"`
+	Time      string  `json:"time"`
+	Text      string  `json:"text"`
+}
+
+type alarmState struct {
+	raised bool
+	since  time.Time
+	value  float64
+}
+
+type alarmTable struct {
+	sync.Mutex
+	// thresholds are the loss in %, the rtt in ms and the drops per minute
+	thresholds map[string]float64
+	targets    []string
+	states     map[string]*alarmState
+	// client, beats and drops are the counters of the last check
+	client string
+	beats  uint64
+	drops  uint64
+}
+
+var alarms = &alarmTable{states: make(map[string]*alarmState)}
+
+// alarmUnits formats the value of an alarm
+var alarmUnits = map[string]string{"loss": "%.0f%%", "rtt": "%.0fms", "drops": "%.0f/min"}
+
+// parseAlarm parses an `alarm` threshold, e.g. loss 20%
+func parseAlarm(vals []string) (float64, error) {
+	switch vals[0] {
+	case "loss":
+		v, err := strconv.ParseFloat(strings.TrimSuffix(vals[1], "%"), 64)
+		if err != nil || v <= 0 || v > 100 {
+			return 0, fmt.Errorf("expected a loss within 0-100%%")
+		}
+		return v, nil
+	case "rtt":
+		d, err := time.ParseDuration(vals[1])
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("expected a duration, e.g. 150ms")
+		}
+		return float64(d) / float64(time.Millisecond), nil
+	case "drops":
+		v, err := strconv.ParseFloat(strings.TrimSuffix(vals[1], "/min"), 64)
+		if err != nil || v <= 0 {
+			return 0, fmt.Errorf("expected the drops per minute")
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected loss, rtt, drops or notify")
+}
+
+// Set replaces the thresholds and the notified targets, keeping the state of
+// the alarms still configured
+func (a *alarmTable) Set(thresholds map[string]float64, targets []string) {
+	a.Lock()
+	defer a.Unlock()
+	a.thresholds, a.targets = thresholds, targets
+	for name := range a.states {
+		if _, ok := thresholds[name]; !ok {
+			delete(a.states, name)
+		}
+	}
+}
+
+// check measures the tunnel and raises or clears the alarms
+func (a *alarmTable) check() {
+	beats, drops := atomic.LoadUint64(&heartbeatCount), peerStats.Dropped()
+	cli := shared.Client()
+	a.Lock()
+	client := ""
+	if cli != nil {
+		client = cli.String()
+	}
+	same := client != "" && client == a.client
+	values := make(map[string]float64)
+	if same && !isIdle() {
+		if heartbeat > 0 {
+			expected := float64(alarmPeriod) / float64(time.Duration(heartbeat)*time.Millisecond)
+			loss := 100 * (1 - float64(beats-a.beats)/expected)
+			if loss < 0 {
+				loss = 0
+			}
+			values["loss"] = loss
+		}
+		if drops >= a.drops {
+			values["drops"] = float64(drops - a.drops)
+		} else {
+			values["drops"] = float64(drops)
+		}
+	}
+	if st := clock.Status(); client != "" && st != nil {
+		values["rtt"] = st.RttMs
+	}
+	a.client, a.beats, a.drops = client, beats, drops
+	var notices []AlarmNotice
+	for name, threshold := range a.thresholds {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		s := a.states[name]
+		if s == nil {
+			s = &alarmState{}
+			a.states[name] = s
+		}
+		s.value = value
+		if over := value > threshold; over != s.raised {
+			s.raised, s.since = over, time.Now()
+			notices = append(notices, newAlarmNotice(name, over, value, threshold, client))
+		}
+	}
+	targets := a.targets
+	a.Unlock()
+	for _, n := range notices {
+		if n.State == "raised" {
+			logHealth.Warningf("[ALARM] %s", n.Text)
+		} else {
+			logHealth.Infof("[ALARM] %s", n.Text)
+		}
+		events.Add("alarm", "%s", n.Text)
+		for _, target := range targets {
+			if target == "desktop" {
+				go notifyDesktop("docker-connector", n.Text)
+			} else {
+				go postAlarm(target, n)
+			}
+		}
+	}
+}
+
+func newAlarmNotice(name string, raised bool, value, threshold float64, client string) AlarmNotice {
+	n := AlarmNotice{Alarm: name, State: "cleared", Value: value, Threshold: threshold, Client: client, Time: time.Now().Format(time.RFC3339)}
+	unit := alarmUnits[name]
+	n.Text = fmt.Sprintf("tunnel %s back to "+unit+", under "+unit, name, value, threshold)
+	if raised {
+		n.State = "raised"
+		n.Text = fmt.Sprintf("tunnel %s at "+unit+", over "+unit, name, value, threshold)
+	}
+	return n
+}
+
+// notifyDesktop shows a notification to the user of the desktop
+func notifyDesktop(title, text string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", text, title))
+	case "windows":
+		quote := func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" }
+		script := `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode(` + quote(title) + `)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode(` + quote(text) + `)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(` + quote(title) + `).Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		cmd = exec.Command("notify-send", title, text)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logHealth.Warningf("[ALARM] Failed to notify the desktop: %v %s", err, strings.TrimSpace(string(out)))
+	}
+}
+
+// postAlarm posts a notice to a webhook
+func postAlarm(url string, n AlarmNotice) {
+	body, _ := json.Marshal(n)
+	client := &http.Client{Timeout: alarmPostTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logHealth.Warningf("[ALARM] Failed to post to %s: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logHealth.Warningf("[ALARM] Webhook %s answered %s", url, resp.Status)
+	}
+}
+
+// watchAlarms checks the alarms every alarmPeriod
+func (c *Connector) watchAlarms() {
+	ticker := time.NewTicker(alarmPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			alarms.check()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Status reports the alarms of the config, nil without any
+func (a *alarmTable) Status() []AlarmStatus {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.thresholds) == 0 {
+		return nil
+	}
+	var list []AlarmStatus
+	for name, threshold := range a.thresholds {
+		st := AlarmStatus{Name: name, Threshold: threshold}
+		if s := a.states[name]; s != nil {
+			st.Value, st.Raised = s.value, s.raised
+			if !s.since.IsZero() {
+				st.Since = s.since.Format(time.RFC3339)
+			}
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each change applied to the connector is appended to the audit log of the
+// state directory, one JSON line with the time, the origin and the change:
+//
+//	config <file>     the lines added (+) and removed (-) by a load or reload
+//	peer <ip:port>    the lines of a control pushed by the docker side
+//	admin <ip:port>   a request other than GET to the admin API and its status
+//
+// so a route changed on a shared machine can be traced to the edit, the
+// docker side or the client of the API which made it. The secrets of the
+// lines are masked. The log is only appended to, never rotated by the
+// connector, and its last entries are served by `/audit` and printed by
+// `docker-connector audit`.
+const (
+	auditFileName = "desktop-docker-connector.audit"
+	auditBodyMax  = 1024
+	auditTail     = 100
+)
+
+// AuditFile is the audit log
+var AuditFile = ""
+
+// AuditEntry is a change of the audit log
+type AuditEntry struct {
+	Time   string   `json:"time"`
+	Origin string   `json:"origin"`
+	Action string   `json:"action"`
+	Lines  []string `json:"lines,omitempty"`
+	Status int      `json:"status,omitempty"`
+}
+
+// auditSecrets are the fields of the directives holding a secret
+var auditSecrets = map[string]int{
+	"wireguard":         1,
+	"control-secret":    1,
+	"knock":             2,
+	"expose-activation": 2,
+	"token":             2,
+}
+
+type auditLog struct {
+	sync.Mutex
+	// config are the lines of the last load of the config
+	config map[string]int
+}
+
+var audits = &auditLog{}
+
+// Record appends an entry to the audit log
+func (a *auditLog) Record(e AuditEntry) {
+	if AuditFile == "" {
+		return
+	}
+	e.Time = time.Now().Format(time.RFC3339)
+	for i, line := range e.Lines {
+		e.Lines[i] = maskSecret(line)
+	}
+	data, _ := json.Marshal(e)
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.OpenFile(AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Warningf("[AUDIT] Failed to open %s: %v", AuditFile, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logger.Warningf("[AUDIT] Failed to write %s: %v", AuditFile, err)
+	}
+}
+
+// maskSecret masks the secret of a config line, the references to a file or
+// the keychain kept
+func maskSecret(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return line
+	}
+	word := strings.TrimLeft(fields[0], "+-")
+	i, ok := auditSecrets[word]
+	if !ok || i >= len(fields) || strings.HasPrefix(fields[i], "file:") || strings.HasPrefix(fields[i], "keychain:") {
+		return line
+	}
+	fields[i] = "***"
+	return strings.Join(fields, " ")
+}
+
+// Config records the lines changed since the last load of the config
+func (a *auditLog) Config(lines []string, init bool) {
+	next := make(map[string]int)
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && line[0] != '#' {
+			next[line]++
+		}
+	}
+	a.Lock()
+	prev := a.config
+	a.config = next
+	a.Unlock()
+	var changes []string
+	for line, n := range next {
+		for i := prev[line]; i < n; i++ {
+			changes = append(changes, "+"+line)
+		}
+	}
+	for line, n := range prev {
+		for i := next[line]; i < n; i++ {
+			changes = append(changes, "-"+line)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i][1:] < changes[j][1:] })
+	action := "reload"
+	if init {
+		action = "load"
+	}
+	a.Record(AuditEntry{Origin: "config " + configFile, Action: action, Lines: changes})
+}
+
+// Control records the lines of a control pushed by the docker side
+func (a *auditLog) Control(data []byte, from string) {
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > 0 {
+		a.Record(AuditEntry{Origin: "peer " + from, Action: "control", Lines: lines})
+	}
+}
+
+// auditStatus keeps the status of the response
+type auditStatus struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditStatus) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditAdmin records the requests of the admin API other than GET
+func auditAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rec := &auditStatus{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if len(body) > auditBodyMax {
+			body = append(body[:auditBodyMax:auditBodyMax], "..."...)
+		}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		a := r.URL.Path
+		if r.URL.RawQuery != "" {
+			a += "?" + r.URL.RawQuery
+		}
+		audits.Record(AuditEntry{Origin: "admin " + r.RemoteAddr, Action: r.Method + " " + a, Lines: lines, Status: rec.status})
+	})
+}
+
+// readAudit returns the last n entries of the audit log
+func readAudit(n int) ([]AuditEntry, error) {
+	f, err := os.Open(AuditFile)
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if list = append(list, e); len(list) > n {
+			list = list[1:]
+		}
+	}
+	return list, scanner.Err()
+}
+
+// serveAudit serves the last entries of the audit log, `n` of them
+func serveAudit(w http.ResponseWriter, r *http.Request) {
+	n := auditTail
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 {
+		n = v
+	}
+	list, err := readAudit(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// runAudit implements `audit [-n 100]`
+func runAudit() {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	n := fs.Int("n", auditTail, "number of entries")
+	fs.Parse(os.Args[2:])
+	body, err := adminGet(fmt.Sprintf("/audit?n=%d", *n))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var list []AuditEntry
+	if err := json.Unmarshal(body, &list); err != nil {
+		os.Stdout.Write(body)
+		os.Exit(1)
+	}
+	for _, e := range list {
+		status := ""
+		if e.Status != 0 {
+			status = fmt.Sprintf(" => %d", e.Status)
+		}
+		fmt.Printf("%s %s %s%s\n", e.Time, e.Origin, e.Action, status)
+		for _, line := range e.Lines {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// The docker side started with `-push-routes` sends `connect <subnet>` and
+// `disconnect <subnet>` as its docker networks come and go. The route is
+// installed or removed right away, and enabled or commented out in the config
+// file so it survives a restart, without duplicates. The subnets overlapping
+// an `exclude` of the config are ignored.
+
+// routeExcludes are the excludes of the config
+var routeExcludes []*net.IPNet
+
+// pushedRoute handles a pushed route line, it returns false for the other
+// lines of the config
+func pushedRoute(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || (fields[0] != "connect" && fields[0] != "disconnect") {
+		return false
+	}
+	_, ipnet, err := net.ParseCIDR(fields[1])
+	if err != nil {
+		logRoutes.Warningf("[ROUTE PUSH] Invalid subnet => %s", line)
+		return true
+	}
+	pushRoute(ipnet.String(), fields[0] == "connect")
+	return true
+}
+
+// pushRoute installs or removes a route pushed by the docker side
+func pushRoute(key string, enabled bool) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	if enabled == shared.HasRoute(key) {
+		return
+	}
+	if ex := excluded(key, routeExcludes); enabled && ex != nil {
+		logRoutes.Debugf("[ROUTE PUSH] Route %s overlaps exclude %s", key, ex)
+		return
+	}
+	if enabled && schedules.Disabled(key) {
+		logRoutes.Debugf("[ROUTE PUSH] Route %s disabled by schedule", key)
+		return
+	}
+	if err := setConfigRoute(key, enabled); err != nil {
+		logRoutes.Warningf("[ROUTE PUSH] Failed to record %s in %s: %v", key, configFile, err)
+	}
+	if enabled && bind && !conflicts.Allow(scanConflicts(), key) {
+		return
+	}
+	if enabled {
+		logRoutes.Infof("[ROUTE PUSH] Adding route %s", key)
+	} else {
+		logRoutes.Infof("[ROUTE PUSH] Removing route %s", key)
+	}
+	installRoute(key, false, enabled)
+}
+
+// installRoute installs or removes a route right away, with configLock held
+func installRoute(key string, expose, enabled bool) {
+	if enabled {
+		shared.SetRoute(key, expose)
+		if bind {
+			delRoute(key)
+			addRoute(key, peer)
+		}
+	} else {
+		shared.DeleteRoute(key)
+		if bind {
+			delRoute(key)
+		}
+	}
+	routes := shared.Routes()
+	traffic.Update(routes)
+	hooks.Routes(routes)
+}
+
+// takePushedRoutes applies the pushed routes of data and returns its other
+// lines
+func takePushedRoutes(data []byte) []byte {
+	var rest [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if !pushedRoute(string(line)) && !pushedDNS(string(line)) && !pushedMDNS(string(line)) && !pushedPublish(string(line)) && !pushedDNSLog(string(line)) {
+			rest = append(rest, line)
+		}
+	}
+	return bytes.TrimSpace(bytes.Join(rest, []byte("\n")))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// batch is the max number of datagrams read from or written to the docker
+// side per syscall (recvmmsg/sendmmsg), only linux batches them.
+var batch = 32
+
+// batchSize returns the size of the batches, 1 without batching
+func batchSize() int {
+	if !batchSupported || batch < 2 {
+		return 1
+	}
+	return batch
+}
+
+// batchReader reads a batch of datagrams per syscall and hands them out one by
+// one, like ReadFromUDP
+type batchReader struct {
+	conn  *net.UDPConn
+	msgs  *mmsgs
+	bufs  [][]byte
+	sizes []int
+	addrs []*net.UDPAddr
+	count int
+	next  int
+}
+
+func newBatchReader(conn *net.UDPConn, size int) *batchReader {
+	r := &batchReader{conn: conn}
+	if n := batchSize(); n > 1 {
+		r.msgs = newMmsgs(conn, n)
+		r.bufs = make([][]byte, n)
+		for i := range r.bufs {
+			r.bufs[i] = make([]byte, size)
+		}
+		r.sizes = make([]int, n)
+		r.addrs = make([]*net.UDPAddr, n)
+	}
+	return r
+}
+
+// Grow enlarges the buffers to size once the read ones are handed out
+func (r *batchReader) Grow(size int) {
+	if r.next < r.count {
+		return
+	}
+	for i := range r.bufs {
+		if len(r.bufs[i]) < size {
+			r.bufs[i] = make([]byte, size)
+		}
+	}
+}
+
+func (r *batchReader) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	if r.msgs == nil {
+		return r.conn.ReadFromUDP(b)
+	}
+	if r.next >= r.count {
+		n, err := r.msgs.recv(r.conn, r.bufs, r.sizes, r.addrs)
+		if err != nil {
+			return 0, nil, err
+		}
+		r.count, r.next = n, 0
+	}
+	i := r.next
+	r.next++
+	return copy(b, r.bufs[i][:r.sizes[i]]), r.addrs[i], nil
+}
+
+// datagram is a copy of a datagram waiting to be written
+type datagram struct {
+	buf  *[]byte
+	addr *net.UDPAddr
+}
+
+// batchWriter queues the datagrams to the docker side and writes the queued
+// ones per syscall from its own goroutine
+type batchWriter struct {
+	conn  *net.UDPConn
+	msgs  *mmsgs
+	queue chan datagram
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+var (
+	// writer is nil without batching, the datagrams are then written right away
+	writer *batchWriter
+
+	errWriterClosed = errors.New("batch writer closed")
+)
+
+// startWriter returns nil without batching
+func startWriter(conn *net.UDPConn) *batchWriter {
+	n := batchSize()
+	if n < 2 {
+		return nil
+	}
+	w := &batchWriter{
+		conn:  conn,
+		msgs:  newMmsgs(conn, n),
+		queue: make(chan datagram, n*4),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		supervise(context.Background(), "batch writer", func() { w.run(n) })
+	}()
+	logControl.Infof("[BATCH] Exchanging up to %d datagrams per syscall", n)
+	return w
+}
+
+// WriteToUDP queues a copy of the datagram, it only blocks while the queue is
+// full
+func (w *batchWriter) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if w == nil {
+		return conn.WriteToUDP(b, addr)
+	}
+	d := datagram{buf: getBuffer(len(b)), addr: addr}
+	copy(*d.buf, b)
+	select {
+	case w.queue <- d:
+		return len(b), nil
+	case <-w.stop:
+		putBuffer(d.buf)
+		return 0, errWriterClosed
+	}
+}
+
+func (w *batchWriter) run(n int) {
+	held := make([]*[]byte, 0, n)
+	bufs := make([][]byte, 0, n)
+	addrs := make([]*net.UDPAddr, 0, n)
+	for {
+		select {
+		case d := <-w.queue:
+			held, bufs, addrs = append(held, d.buf), append(bufs, *d.buf), append(addrs, d.addr)
+		case <-w.stop:
+			return
+		}
+	collect:
+		for len(bufs) < n {
+			select {
+			case d := <-w.queue:
+				held, bufs, addrs = append(held, d.buf), append(bufs, *d.buf), append(addrs, d.addr)
+			default:
+				break collect
+			}
+		}
+		if err := w.msgs.send(w.conn, bufs, addrs); err != nil {
+			logControl.Warningf("[BATCH] Failed to write %d datagrams: %v", len(bufs), err)
+		}
+		for _, b := range held {
+			putBuffer(b)
+		}
+		held, bufs, addrs = held[:0], bufs[:0], addrs[:0]
+	}
+}
+
+// Close stops the writer, dropping the datagrams still queued
+func (w *batchWriter) Close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// batchSupported tells whether several datagrams are exchanged per syscall
+const batchSupported = true
+
+// mmsghdr is the struct mmsghdr of recvmmsg(2) and sendmmsg(2)
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgs holds the headers of a batch of datagrams of a socket
+type mmsgs struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6
+	inet6 bool
+}
+
+func newMmsgs(conn *net.UDPConn, n int) *mmsgs {
+	m := &mmsgs{
+		hdrs:  make([]mmsghdr, n),
+		iovs:  make([]syscall.Iovec, n),
+		names: make([]syscall.RawSockaddrInet6, n),
+	}
+	// a socket listening on all the addresses is an AF_INET6 one
+	if raw, err := conn.SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) {
+			if sa, err := syscall.Getsockname(int(fd)); err == nil {
+				_, m.inet6 = sa.(*syscall.SockaddrInet6)
+			}
+		})
+	}
+	return m
+}
+
+// prepare points the headers to the buffers, and to the names if named
+func (m *mmsgs) prepare(bufs [][]byte, named bool) {
+	for i, b := range bufs {
+		m.iovs[i].Base = &b[0]
+		m.iovs[i].SetLen(len(b))
+		m.hdrs[i] = mmsghdr{}
+		h := &m.hdrs[i].hdr
+		h.Iov = &m.iovs[i]
+		h.Iovlen = 1
+		if named {
+			h.Name = (*byte)(unsafe.Pointer(&m.names[i]))
+			h.Namelen = uint32(unsafe.Sizeof(m.names[i]))
+		}
+	}
+}
+
+// recv reads up to len(bufs) datagrams with a single recvmmsg, blocking
+// until at least one is available. The sizes and the sources are set for
+// each datagram read, the sources only if addrs isn't nil.
+func (m *mmsgs) recv(conn *net.UDPConn, bufs [][]byte, sizes []int, addrs []*net.UDPAddr) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	m.prepare(bufs, addrs != nil)
+	var n int
+	var errno syscall.Errno
+	if err := raw.Read(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&m.hdrs[0])),
+				uintptr(len(bufs)), syscall.MSG_DONTWAIT, 0, 0)
+			if e == syscall.EINTR {
+				continue
+			}
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	}); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", errno)
+	}
+	for i := 0; i < n; i++ {
+		sizes[i] = int(m.hdrs[i].len)
+		if addrs != nil {
+			addrs[i] = m.addr(i)
+		}
+	}
+	return n, nil
+}
+
+// send writes the datagrams with as few sendmmsg as possible, to the
+// addresses if addrs isn't nil. A datagram failing is skipped, the error of
+// the last one failing is returned.
+func (m *mmsgs) send(conn *net.UDPConn, bufs [][]byte, addrs []*net.UDPAddr) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	for i := range addrs {
+		m.setAddr(i, addrs[i])
+	}
+	m.prepare(bufs, addrs != nil)
+	var errno syscall.Errno
+	sent := 0
+	if err := raw.Write(func(fd uintptr) bool {
+		for sent < len(bufs) {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&m.hdrs[sent])),
+				uintptr(len(bufs)-sent), syscall.MSG_DONTWAIT, 0, 0)
+			switch e {
+			case 0:
+				sent += int(r)
+			case syscall.EINTR:
+			case syscall.EAGAIN:
+				return false
+			default:
+				errno = e
+				sent++
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return os.NewSyscallError("sendmmsg", errno)
+	}
+	return nil
+}
+
+func (m *mmsgs) addr(i int) *net.UDPAddr {
+	sa := &m.names[i]
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	addr := &net.UDPAddr{Port: int(port[0])<<8 | int(port[1])}
+	switch sa.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		addr.IP = net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3])
+	case syscall.AF_INET6:
+		addr.IP = make(net.IP, net.IPv6len)
+		copy(addr.IP, sa.Addr[:])
+	}
+	return addr
+}
+
+func (m *mmsgs) setAddr(i int, addr *net.UDPAddr) {
+	sa := &m.names[i]
+	*sa = syscall.RawSockaddrInet6{}
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+	if ip := addr.IP.To4(); ip != nil && !m.inet6 {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = syscall.AF_INET
+		copy(sa4.Addr[:], ip)
+		return
+	}
+	// IPv4 addresses are mapped on AF_INET6 sockets
+	sa.Family = syscall.AF_INET6
+	copy(sa.Addr[:], addr.IP.To16())
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// `bench` measures the tunnel with the docker side, the datagrams of the
+// benchmark being
+//
+//	14 | op | run(4) | op specific
+//
+// `ping` ones carrying seq(4) and the time they were sent(8) are echoed as
+// `pong` to measure the latency. The `up` ones are counted by the docker side
+// until `up end`, answered with `report` giving packets(8), bytes(8) and the
+// time between the first and the last one(8). `down` asks the docker side to
+// send `data` of size(4) for duration(4) milliseconds, followed by `down end`
+// giving the packets(8) and bytes(8) sent. The datagrams skip the compression,
+// the limits and the emulation of the tunnel.
+const (
+	benchType    = connector.Bench
+	benchPing    = 1
+	benchPong    = 2
+	benchUp      = 3
+	benchUpEnd   = 4
+	benchReport  = 5
+	benchDown    = 6
+	benchData    = 7
+	benchDownEnd = 8
+	benchHeader  = 6
+	benchPings   = 10
+	benchWait    = 2 * time.Second
+)
+
+// BenchLatency is the round trip time of the pings
+type BenchLatency struct {
+	Sent     int    `json:"sent"`
+	Received int    `json:"received"`
+	Min      string `json:"min,omitempty"`
+	Avg      string `json:"avg,omitempty"`
+	Max      string `json:"max,omitempty"`
+}
+
+// BenchThroughput is the outcome of a direction
+type BenchThroughput struct {
+	Sent     uint64  `json:"sent"`
+	Received uint64  `json:"received"`
+	Bytes    uint64  `json:"bytes"`
+	Mbps     float64 `json:"mbps"`
+	Loss     float64 `json:"loss"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// BenchResult is the outcome of a benchmark
+type BenchResult struct {
+	Via      string           `json:"via,omitempty"`
+	Size     int              `json:"size"`
+	Duration string           `json:"duration"`
+	Latency  *BenchLatency    `json:"latency,omitempty"`
+	Up       *BenchThroughput `json:"up,omitempty"`
+	Down     *BenchThroughput `json:"down,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+type benchRunner struct {
+	sync.Mutex
+	run     uint32
+	pongs   chan time.Duration
+	reports chan []byte
+	ends    chan []byte
+	packets uint64
+	bytes   uint64
+	first   time.Time
+	last    time.Time
+}
+
+var (
+	benchLock sync.Mutex
+	bench     = &benchRunner{}
+)
+
+// Receive takes a datagram of the benchmark from the docker side
+func (b *benchRunner) Receive(data []byte) {
+	if len(data) < benchHeader {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if binary.BigEndian.Uint32(data[2:]) != b.run || b.run == 0 {
+		return
+	}
+	switch data[1] {
+	case benchPong:
+		if len(data) >= benchHeader+12 {
+			sent := int64(binary.BigEndian.Uint64(data[benchHeader+4:]))
+			select {
+			case b.pongs <- time.Duration(time.Now().UnixNano() - sent):
+			default:
+			}
+		}
+	case benchReport:
+		select {
+		case b.reports <- append([]byte(nil), data...):
+		default:
+		}
+	case benchData:
+		now := time.Now()
+		if b.packets == 0 {
+			b.first = now
+		}
+		b.last = now
+		b.packets++
+		b.bytes += uint64(len(data))
+	case benchDownEnd:
+		select {
+		case b.ends <- append([]byte(nil), data...):
+		default:
+		}
+	}
+}
+
+// benchPacket returns a datagram of the benchmark of size bytes at least
+func benchPacket(op byte, run uint32, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = benchType
+	packet[1] = op
+	binary.BigEndian.PutUint32(packet[2:], run)
+	return packet
+}
+
+// mbps is the throughput of bytes over d
+func mbps(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
+
+// runBench measures the latency, then the throughput up and down, with
+// datagrams of size bytes for d in each direction
+func runBench(d time.Duration, size int) *BenchResult {
+	res := &BenchResult{Size: size, Duration: d.String()}
+	peer := shared.Client()
+	if peer == nil || writer == nil {
+		res.Error = "no client connected"
+		return res
+	}
+	if size < benchHeader+12 || size > 65000 {
+		res.Error = fmt.Sprintf("invalid size %d", size)
+		return res
+	}
+	benchLock.Lock()
+	defer benchLock.Unlock()
+	res.Via = peer.String()
+	bench.Lock()
+	bench.run = uint32(time.Now().UnixNano()) | 1
+	bench.pongs = make(chan time.Duration, benchPings)
+	bench.reports = make(chan []byte, 1)
+	bench.ends = make(chan []byte, 1)
+	bench.packets, bench.bytes = 0, 0
+	run := bench.run
+	bench.Unlock()
+	defer func() {
+		bench.Lock()
+		bench.run = 0
+		bench.Unlock()
+	}()
+	logger.Infof("[BENCH] Benchmarking %v, %d bytes for %v", peer, size, d)
+
+	// latency
+	lat := &BenchLatency{Sent: benchPings}
+	var total, lo, hi time.Duration
+	ping := benchPacket(benchPing, run, benchHeader+12)
+	for i := 0; i < benchPings; i++ {
+		binary.BigEndian.PutUint32(ping[benchHeader:], uint32(i))
+		binary.BigEndian.PutUint64(ping[benchHeader+4:], uint64(time.Now().UnixNano()))
+		if _, err := writer.WriteToUDP(ping, peer); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		select {
+		case rtt := <-bench.pongs:
+			lat.Received++
+			total += rtt
+			if lo == 0 || rtt < lo {
+				lo = rtt
+			}
+			if rtt > hi {
+				hi = rtt
+			}
+		case <-time.After(time.Second):
+		}
+	}
+	if lat.Received > 0 {
+		lat.Min, lat.Avg, lat.Max = lo.String(), (total / time.Duration(lat.Received)).String(), hi.String()
+	}
+	res.Latency = lat
+	if lat.Received == 0 {
+		res.Error = "no reply from the docker side"
+		return res
+	}
+
+	// up
+	up := &BenchThroughput{}
+	packet := benchPacket(benchUp, run, size)
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		binary.BigEndian.PutUint32(packet[benchHeader:], uint32(up.Sent))
+		if _, err := writer.WriteToUDP(packet, peer); err != nil {
+			up.Error = err.Error()
+			break
+		}
+		up.Sent++
+	}
+	time.Sleep(100 * time.Millisecond)
+	end := benchPacket(benchUpEnd, run, benchHeader)
+	var report []byte
+	for i := 0; i < 3 && report == nil; i++ {
+		writer.WriteToUDP(end, peer)
+		select {
+		case report = <-bench.reports:
+		case <-time.After(benchWait / 2):
+		}
+	}
+	if len(report) >= benchHeader+24 {
+		up.Received = binary.BigEndian.Uint64(report[benchHeader:])
+		up.Bytes = binary.BigEndian.Uint64(report[benchHeader+8:])
+		up.Mbps = mbps(up.Bytes, time.Duration(binary.BigEndian.Uint64(report[benchHeader+16:])))
+	} else if up.Error == "" {
+		up.Error = "no report from the docker side"
+	}
+	if up.Sent > 0 {
+		up.Loss = 100 * float64(up.Sent-min64(up.Received, up.Sent)) / float64(up.Sent)
+	}
+	res.Up = up
+
+	// down
+	down := &BenchThroughput{}
+	request := benchPacket(benchDown, run, benchHeader+8)
+	binary.BigEndian.PutUint32(request[benchHeader:], uint32(d/time.Millisecond))
+	binary.BigEndian.PutUint32(request[benchHeader+4:], uint32(size))
+	writer.WriteToUDP(request, peer)
+	var ended []byte
+	select {
+	case ended = <-bench.ends:
+	case <-time.After(d + 2*benchWait):
+	}
+	time.Sleep(100 * time.Millisecond)
+	bench.Lock()
+	down.Received, down.Bytes = bench.packets, bench.bytes
+	down.Mbps = mbps(bench.bytes, bench.last.Sub(bench.first))
+	bench.Unlock()
+	if len(ended) >= benchHeader+16 {
+		down.Sent = binary.BigEndian.Uint64(ended[benchHeader:])
+		if down.Sent > 0 {
+			down.Loss = 100 * float64(down.Sent-min64(down.Received, down.Sent)) / float64(down.Sent)
+		}
+	} else {
+		down.Error = "no end from the docker side"
+	}
+	res.Down = down
+	logger.Infof("[BENCH] Latency %s, up %.1f Mbit/s, down %.1f Mbit/s", lat.Avg, up.Mbps, down.Mbps)
+	return res
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// serveBench runs `POST /bench?duration=5s&size=1400`
+func serveBench(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || d <= 0 || d > time.Minute {
+		http.Error(w, "invalid duration", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runBench(d, size))
+}
+
+// runBenchCommand implements `bench`
+func runBenchCommand() {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	d := fs.Duration("duration", 5*time.Second, "duration of each direction, at most 1m")
+	size := fs.Int("size", 1400, "size of the datagrams")
+	raw := fs.Bool("json", false, "print the result as json")
+	fs.Parse(os.Args[2:])
+	client := &http.Client{Timeout: 2*(*d) + benchPings*time.Second + 4*benchWait + 5*time.Second}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/bench?duration=%s&size=%d", adminAddr, url.QueryEscape(d.String()), *size), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid admin address => %v\n", err)
+		os.Exit(2)
+	}
+	req.Header.Set(adminHeader, "1")
+	rsp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	body, _ := ioutil.ReadAll(rsp.Body)
+	var res BenchResult
+	if rsp.StatusCode != http.StatusOK || json.Unmarshal(body, &res) != nil {
+		fmt.Fprintf(os.Stderr, "bench failed => %s\n", body)
+		os.Exit(1)
+	}
+	if *raw {
+		os.Stdout.Write(body)
+	} else {
+		printBench(&res)
+	}
+	if res.Error != "" {
+		os.Exit(1)
+	}
+}
+
+// printBench prints the report of a benchmark
+func printBench(res *BenchResult) {
+	fmt.Printf("bench via %s, %d bytes datagrams for %s each way\n", res.Via, res.Size, res.Duration)
+	if l := res.Latency; l != nil {
+		fmt.Printf("latency   min %s avg %s max %s, %d/%d replies\n", l.Min, l.Avg, l.Max, l.Received, l.Sent)
+	}
+	for _, dir := range []struct {
+		name string
+		t    *BenchThroughput
+	}{{"upload", res.Up}, {"download", res.Down}} {
+		if dir.t == nil {
+			continue
+		}
+		fmt.Printf("%-9s %.1f Mbit/s, %d/%d datagrams received (%.1f%% lost)", dir.name, dir.t.Mbps, dir.t.Received, dir.t.Sent, dir.t.Loss)
+		if dir.t.Error != "" {
+			fmt.Printf(", %s", dir.t.Error)
+		}
+		fmt.Println()
+	}
+	if res.Error != "" {
+		fmt.Printf("error     %s\n", res.Error)
+	}
+}
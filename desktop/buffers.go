@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// packetBuffers recycles the packet buffers of the data path, so forwarding
+// doesn't allocate for every packet
+var packetBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// getBuffer returns a pooled buffer of the size, to give back with putBuffer
+func getBuffer(size int) *[]byte {
+	b := packetBuffers.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size, max(size, bufferSize()))
+	}
+	*b = (*b)[:size]
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	packetBuffers.Put(b)
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// debugEnabled returns whether the debug messages of the transport are
+// logged, to skip building them for every packet otherwise
+func debugEnabled() bool {
+	if leveledBackend != nil {
+		return leveledBackend.IsEnabledFor(logging.DEBUG, logTransport.Module)
+	}
+	return logTransport.IsEnabledFor(logging.DEBUG)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"docker-connector/pkg/connector"
+	"github.com/pierrec/lz4/v4"
+)
+
+// When both sides enable it, packets are sent as datagrams of
+//
+//	7 | lz4 block
+//
+// unless they don't shrink. The desktop offers `compress lz4` in the
+// controls, and the docker side accepts by appending a features byte to its
+// heartbeats, so peers without compression keep exchanging plain packets.
+// Decompression is always supported.
+const (
+	compressType = connector.Compressed
+	featureLZ4   = connector.FeatureLZ4
+)
+
+var (
+	compress     = false
+	peerFeatures int32
+	compressIn   uint64
+	compressOut  uint64
+	compressors  = sync.Pool{New: func() interface{} { return new(lz4.Compressor) }}
+)
+
+// CompressStatus reports the negotiated compression and its ratio
+type CompressStatus struct {
+	Enabled bool    `json:"enabled"`
+	Peer    bool    `json:"peer"`
+	In      uint64  `json:"in"`
+	Out     uint64  `json:"out"`
+	Ratio   float64 `json:"ratio"`
+}
+
+func compressStatus() *CompressStatus {
+	s := &CompressStatus{
+		Enabled: compress,
+		Peer:    atomic.LoadInt32(&peerFeatures)&featureLZ4 != 0,
+		In:      atomic.LoadUint64(&compressIn),
+		Out:     atomic.LoadUint64(&compressOut),
+	}
+	if s.In > 0 {
+		s.Ratio = float64(s.Out) / float64(s.In)
+	}
+	return s
+}
+
+// setPeerFeatures records the features advertised by a heartbeat
+func setPeerFeatures(heartbeat []byte) {
+	var features int32
+	if len(heartbeat) > heartbeatLen {
+		features = int32(heartbeat[heartbeatLen])
+	}
+	if old := atomic.SwapInt32(&peerFeatures, features); old != features {
+		logTransport.Infof("[COMPRESS] Peer features => %d, lz4 %v, fec %v", features, compress && features&featureLZ4 != 0, fecCount > 0 && features&featureFEC != 0)
+	}
+}
+
+// compressPacket returns the compressed datagram of the packet if the peer
+// accepts it and it is smaller, or the packet itself. The pooled buffer of
+// a compressed datagram is returned too, to give back once it was sent.
+func compressPacket(packet []byte) ([]byte, *[]byte) {
+	if !compress || atomic.LoadInt32(&peerFeatures)&featureLZ4 == 0 {
+		return packet, nil
+	}
+	b := getBuffer(1 + lz4.CompressBlockBound(len(packet)))
+	buf := *b
+	c := compressors.Get().(*lz4.Compressor)
+	n, err := c.CompressBlock(packet, buf[1:])
+	compressors.Put(c)
+	if err != nil || n == 0 || n+1 >= len(packet) {
+		putBuffer(b)
+		return packet, nil
+	}
+	buf[0] = compressType
+	atomic.AddUint64(&compressIn, uint64(len(packet)))
+	atomic.AddUint64(&compressOut, uint64(n+1))
+	return buf[:n+1], b
+}
+
+// decompressPacket expands a compressed datagram into buf
+func decompressPacket(data, buf []byte) (int, error) {
+	return lz4.UncompressBlock(data[1:], buf)
+}
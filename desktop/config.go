@@ -6,16 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
-
-	"github.com/op/go-logging"
-	"github.com/songgao/water"
+	"sync"
+	"time"
 )
 
+// configLock serializes the reloads of the watcher and the scheduler
+var configLock sync.Mutex
+
 func normalizeAddr(addr string) string {
 	if strings.Index(addr, "[::]") == 0 {
 		return strings.Replace(addr, "[::]", "0.0.0.0", 1)
@@ -23,173 +26,777 @@ func normalizeAddr(addr string) string {
 	return addr
 }
 
-func isSameAddr(addr0, addr1 string) bool {
-	if addr0 == addr1 {
-		return true
+// interfaceIP returns the first IPv4 address of the named interface
+func interfaceIP(name string) net.IP {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
 	}
-	return normalizeAddr(addr0) == normalizeAddr(addr1)
+	return nil
 }
 
-func loadConfig(iface *water.Interface, init bool) *water.Interface {
-	fi, err := os.Open(configFile)
+func loadConfig(iface tunDevice, init bool) tunDevice {
+	lines, err := readConfigLines()
 	if err != nil {
 		logger.Error("load config failed", err)
 		return iface
 	}
-	defer fi.Close()
-	re := regexp.MustCompile(`^\s*(\w+\S+)(?:\s+(.*))?$`)
-	news := make(map[string]bool)
-	news1 := make(map[string]string)
-	iptables1 := make(map[string]bool)
-	if proxyServer != nil {
-		proxyServer.StartClear()
+	audits.Config(lines, init)
+	var rejected *configRejection
+	if init {
+		rejected = configApply.Rejected(lines)
 	}
-	br := bufio.NewReader(fi)
-	for {
-		a, _, c := br.ReadLine()
-		if c == io.EOF {
-			break
-		}
-		s := strings.TrimSpace(string(a))
-		match := re.FindStringSubmatch(s)
-		if match != nil {
-			val := match[2]
-			switch match[1] {
+	d := parseConfig(lines, init)
+	if rejected != nil {
+		logger.Warningf("[CONFIG] %s was %s by the last run, starting with the last config applied", configFile, rejected.Result)
+		d = parseConfig(rejected.Good, init)
+	}
+	prev := configApply.Good()
+	if len(d.problems) > 0 && !init && prev != nil {
+		logger.Errorf("[CONFIG] Reload rejected, keeping the running config: %s", strings.Join(d.problems, "; "))
+		configApply.Reject(d, "rejected", d.problems)
+		return iface
+	}
+	for _, p := range d.problems {
+		logger.Warningf("%s\n", p)
+	}
+	if init {
+		prev = nil
+	}
+	iface, failed := applyConfig(iface, d, init, prev)
+	if len(failed) > 0 && prev != nil {
+		logger.Errorf("[CONFIG] Reload rolled back to the previous config: %s", strings.Join(failed, "; "))
+		configApply.Reject(d, "rolled back", failed)
+		return iface
+	}
+	if rejected != nil {
+		configApply.SetGood(d)
+		configApply.Record(rejected.Result, rejected.Problems)
+		return iface
+	}
+	configApply.Applied(d, append(d.problems, failed...))
+	return iface
+}
+
+// parseConfig parses the lines of the config into the state they ask for,
+// the invalid lines being skipped with their problems
+func parseConfig(lines []string, init bool) *configState {
+	d := newConfigState(lines)
+	hostServicesVal := ""
+	vars := configVars(lines)
+	for _, a := range lines {
+		s := strings.TrimSpace(expandConfig(a, vars))
+		match := configDirective.FindStringSubmatch(s)
+		if match != nil && configPinned(match[1]) {
+			logger.Debugf("config %s overridden by %s\n", match[1], pinned[configKey(match[1])])
+		} else if match != nil {
+			key, val := match[1], match[2]
+			vals := strings.Fields(val)
+			switch key {
 			case "loglevel":
-				if level, err := logging.LogLevel(val); err == nil {
-					logging.SetLevel(level, "vpn")
-					if leveledBackend != nil {
-						leveledBackend.SetLevel(level, "vpn")
-					}
+				if _, _, err := parseLogLevels(val); err != nil {
+					d.invalid(key, val, err)
+					break
 				}
+				d.set(func() func() {
+					old := configLogLevel
+					setConfigLogLevel(val)
+					return func() {
+						if old != "" {
+							setConfigLogLevel(old)
+						}
+					}
+				})
 			case "route":
-				vals := strings.Split(val, " ")
-				if len(vals) > 1 {
-					news[vals[0]] = vals[1] == "expose"
-				} else {
-					news[vals[0]] = false
+				// route <subnet> [expose] [metric <n>] [table <id>] [proto <list>]
+				if len(vals) == 0 {
+					d.invalid(key, val, fmt.Errorf("expected a subnet"))
+					break
+				}
+				if _, _, err := net.ParseCIDR(vals[0]); err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				opt, ps, expose, ok := parseRouteOptions(vals[1:])
+				if !ok {
+					d.invalid(key, val, fmt.Errorf("invalid options"))
+					break
+				}
+				d.routes[vals[0]] = expose
+				if opt != (routeOption{}) {
+					d.opts[vals[0]] = opt
+				}
+				if !ps.Empty() {
+					d.protos[vals[0]] = ps
 				}
 			case "host":
-				host = val
+				d.set(setString(&host, val))
 			case "addr":
-				addr = val
+				if ip, _, err := net.ParseCIDR(val); err != nil || ip.To4() == nil {
+					d.invalid(key, val, fmt.Errorf("expected an IPv4 CIDR"))
+					break
+				}
+				d.addr = val
+				d.set(setString(&addr, val))
 			case "port":
-				if v, err := strconv.Atoi(val); err == nil {
-					port = v
+				// the bound port may be an alternate one, a reload rebinds
+				// when the configured one changes
+				v, err := configInt(val, 1, 65535)
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				d.cfgPort = v
+				if init {
+					d.set(setInt(&port, v))
+				}
+			case "bind-interface":
+				// bind-interface en0, the sockets are bound once
+				if init {
+					d.set(setString(&bindIface, val))
+				}
+			case "alt-ports":
+				// alt-ports 2521,2531, tried when the port is in use
+				if init {
+					d.set(setString(&altPorts, val))
 				}
 			case "mtu":
-				if v, err := strconv.Atoi(val); err == nil {
-					MTU = v
+				if v, err := configInt(val, 576, 65535); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.set(setInt(&MTU, v))
+				}
+			case "on-demand":
+				// on-demand 10m, idle after this long without the docker side, off to disable
+				if val == "off" {
+					d.set(setDuration(&onDemand, 0))
+				} else if v, err := time.ParseDuration(val); err == nil && v >= 0 {
+					d.set(setDuration(&onDemand, v))
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected a duration or off"))
+				}
+			case "session-idle":
+				// session-idle 10m, the idle time expiring the expose sessions
+				if v, err := time.ParseDuration(val); err == nil && v > 0 {
+					d.set(setDuration(&sessionIdle, v))
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected a duration"))
+				}
+			case "session-max":
+				if v, err := configInt(val, 1, math.MaxInt32); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.set(setInt(&sessionMax, v))
+				}
+			case "expose-tcp":
+				// expose-tcp <listen> <container ip:port> [portmap] [limit=<rate>] [max-conns=<n>]
+				if listen, rule, portmap, err := parseTCPExpose(val); err == nil {
+					d.tcpRules[listen] = rule
+					if portmap {
+						d.portMapTCP = append(d.portMapTCP, listen)
+					}
+				} else {
+					d.invalid(key, val, err)
+				}
+			case "socks":
+				// socks <listen>, only read at startup
+				if init {
+					d.set(setString(&socksAddr, val))
+				}
+			case "tun-per-route":
+				// tun-per-route on|off, a TUN of its own for each route added from now on
+				d.set(setBool(&tunPerRoute, val == "on" || val == "true"))
+			case "tun-mtu":
+				// tun-mtu <subnet> <mtu>, the MTU of the TUN of a route
+				if subnet, mtu, ok := parseTunMTU(vals); ok {
+					d.mtus[subnet] = mtu
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected <subnet> <mtu>"))
+				}
+			case "conflict":
+				// conflict warn|refuse|off, the routes overlapping the host networks
+				if validConflictMode(val) {
+					d.set(setString(&conflictMode, val))
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected warn, refuse or off"))
+				}
+			case "expose-activation":
+				// expose-activation <port> <secret> [window]
+				if p, s, w, err := parseActivation(val, init); err == nil {
+					d.activationPort, d.activationSecret, d.activationWindow = p, s, w
+				} else {
+					d.problems = append(d.problems, fmt.Sprintf("invalid %s: %v", key, err))
+				}
+			case "forward":
+				// forward <tcp|udp> <listen> <container ip:port> [proxy-protocol]
+				if r, ok := parseForward(val); ok {
+					d.forwards = append(d.forwards, r)
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected <tcp|udp> <listen> <container ip:port>"))
+				}
+			case "interface":
+				// interface <name>, e.g. utun7, only read at startup
+				if init {
+					d.set(setString(&ifName, val))
+				}
+			case "tap":
+				// tap on|off, only read at startup
+				if init {
+					d.set(setBool(&tapMode, val == "on" || val == "true"))
 				}
 			case "pong":
-				pong = val == "on" || val == "true"
-			case "expose":
-				restart := strings.Contains(val, "restart")
-				val = strings.Fields(val)[0]
-				if udpAddr, err := net.ResolveUDPAddr("udp", val); err == nil {
-					if expose != nil && (restart || !isSameAddr(expose.LocalAddr().String(), val)) {
-						logger.Infof("expose changed: %s => %s\n", expose.LocalAddr().String(), val)
-						expose.Close()
-						expose = nil
+				d.set(setBool(&pong, val == "on" || val == "true"))
+			case "control-port":
+				if v, err := configInt(val, 0, 65535); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.set(setInt(&controlPort, v))
+				}
+			case "exclude":
+				// exclude <cidr>, e.g. the ranges of a mesh VPN
+				_, ipnet, err := net.ParseCIDR(strings.Fields(val + " ")[0])
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				d.excludes = append(d.excludes, ipnet)
+			case "schedule":
+				entry, err := parseSchedule(val)
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				d.schedules = append(d.schedules, entry)
+			case "peers-allow":
+				nets, err := parsePeers(val)
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				d.peerNets = append(d.peerNets, nets...)
+			case "host-services":
+				hostServicesVal = val
+			case "nat":
+				d.nat = append(d.nat, val)
+			case "up-script":
+				d.up = val
+			case "down-script":
+				d.down = val
+			case hookClientConnect, hookClientDisconnect, hookRouteChange, hookRouteError, hookDailySummary:
+				d.hooks[key] = val
+			case "var":
+				// collected by configVars
+			case "acl":
+				if len(vals) == 2 && vals[0] == "default" {
+					d.aclDeny = vals[1] == "deny"
+					break
+				}
+				rule, err := parseACL(val)
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				d.aclRules = append(d.aclRules, rule)
+			case "alarm":
+				// alarm loss|rtt|drops <threshold>, alarm notify desktop|<webhook url>
+				if len(vals) != 2 {
+					d.invalid(key, val, fmt.Errorf("expected <name> <value>"))
+					break
+				}
+				if vals[0] == "notify" {
+					d.alarmTargets = append(d.alarmTargets, vals[1])
+					break
+				}
+				v, err := parseAlarm(vals)
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				d.alarmThresholds[vals[0]] = v
+			case "limit":
+				// limit up|down <rate>
+				if len(vals) != 2 || (vals[0] != "up" && vals[0] != "down") {
+					d.invalid(key, val, fmt.Errorf("expected up|down <rate>"))
+					break
+				}
+				rate, err := parseRate(vals[1])
+				if err != nil {
+					d.invalid(key, val, err)
+					break
+				}
+				if vals[0] == "up" {
+					d.upRate = rate
+				} else {
+					d.downRate = rate
+				}
+			case "compress":
+				// compress lz4|off
+				d.set(setBool(&compress, val == "lz4"))
+			case "dscp":
+				// dscp <value|class|inherit|off>
+				d.set(setString(&dscpSpec, val))
+			case "dedup":
+				// dedup on|off
+				d.set(setBool(&dedup, val == "on"))
+			case "fec":
+				// fec <datagrams per parity>|off
+				if val == "off" {
+					d.set(setInt(&fecCount, 0))
+				} else if v, err := configInt(val, 1, fecMax); err == nil {
+					d.set(setInt(&fecCount, v))
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected 1-%d or off", fecMax))
+				}
+			case "knock":
+				// knock <port> <secret> [ttl]
+				if len(vals) < 2 || len(vals) > 3 {
+					d.problems = append(d.problems, "invalid knock: expected <port> <secret> [ttl]")
+					break
+				}
+				p, err := configInt(vals[0], 0, 65535)
+				if err != nil {
+					d.invalid(key, vals[0], err)
+					break
+				}
+				ttl := knockTTL
+				if len(vals) > 2 {
+					if ttl, err = configInt(vals[2], 1, math.MaxInt32); err != nil {
+						d.invalid(key, vals[2], err)
+						break
 					}
-					if expose == nil {
-						if expose, err = net.ListenUDP("udp", udpAddr); err != nil {
-							logger.Warningf("failed to listen => %s\n", val)
-						} else {
-							go handleExpose()
-						}
+				}
+				if s, ok := d.secret("knock secret", vals[1], init); ok {
+					d.set(setInt(&knockPort, p))
+					d.set(setString(&knockSecret, s))
+					d.set(setInt(&knockTTL, ttl))
+				}
+			case "wireguard":
+				// wireguard <private key>, only read at startup
+				if init {
+					if s, ok := d.secret("wireguard", val, init); ok {
+						d.set(setString(&wgKey, s))
 					}
+				}
+			case "encap":
+				// encap vxlan|gre [id <n>] [remote <host[:port]>], only read at startup
+				mode, id, remote, err := parseEncap(val)
+				if err != nil {
+					d.invalid(key, val, err)
+				} else if init {
+					d.set(setString(&encapMode, mode))
+					d.set(setInt(&encapID, id))
+					d.set(setString(&encapRemote, remote))
+				}
+			case "wireguard-peer":
+				// wireguard-peer <public key> [endpoint]
+				if len(vals) != 1 && len(vals) != 2 {
+					d.invalid(key, val, fmt.Errorf("expected <public key> [endpoint]"))
+					break
+				}
+				d.set(setString(&wgPeer, vals[0]))
+				d.set(setString(&wgEndpoint, strings.Join(vals[1:], "")))
+			case "unreachable":
+				// unreachable on|off, the ICMP errors of the dropped packets
+				d.set(setBool(&unreachable, val == "on" || val == "true"))
+			case "control-secret":
+				// control-secret <secret>, the controls pushed unsigned are rejected
+				if s, ok := d.secret("control-secret", val, init); ok {
+					d.set(setString(&controlSecret, s))
+				}
+			case "fragment":
+				if v, err := configInt(val, 0, 65535); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.set(setInt(&fragSize, v))
+				}
+			case "heartbeat":
+				if v, err := configInt(val, 0, math.MaxInt32); err != nil {
+					d.invalid(key, val, err)
 				} else {
-					logger.Warningf("invalid address => %s\n", val)
+					d.set(setInt(&heartbeat, v))
+				}
+			case "dead-after":
+				if v, err := configInt(val, 0, math.MaxInt32); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.set(setInt(&deadAfter, v))
+				}
+			case "push-heartbeat":
+				// push-heartbeat on|off, heartbeat and dead-after pushed to the docker side
+				d.set(setBool(&pushHeartbeat, val == "on" || val == "true"))
+			case "nat-keepalive":
+				// nat-keepalive <interval>|off, a keepalive on each idle path of the tunnel
+				if v, err := parseNATKeepalive(val); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.set(setDuration(&natKeepalive, v))
+				}
+			case "conntrack":
+				// conntrack on|off, the flows through the tunnel
+				d.conntrack = val == "on" || val == "true"
+			case "flow-log":
+				// flow-log <file>|- [interval], the flows as JSON lines
+				d.flowLog = val
+			case "mdns":
+				// mdns on|off, the services pushed by the docker side advertised on the LAN
+				d.mdns = val == "on" || val == "true"
+			case "publish":
+				// publish <subnet>|off, the ports pushed by the docker side on loopback addresses named in the hosts file
+				if subnet, err := parsePublish(val); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.publish = subnet
+				}
+			case "failover":
+				// failover <primary> <standby>, the docker sides by address
+				d.failover = val
+			case "pin-peers":
+				// pin-peers tofu|off, the key of the docker side pinned on first use
+				d.pinTOFU = val == "tofu"
+			case "pin-peer":
+				// pin-peer <key> [name], a key of the docker side to accept
+				if p, err := parsePinnedPeer(val); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.pinnedPeers = append(d.pinnedPeers, p)
+				}
+			case "persist-peer":
+				// persist-peer on|off, the address of the client saved across restarts
+				d.set(setBool(&persistPeer, val != "off" && val != "false"))
+			case "loopback":
+				// loopback reply|drop|respond, the packets to the TUN address
+				if validLoopbackMode(val) {
+					d.set(setString(&loopback, val))
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected reply, drop or respond"))
+				}
+			case "ping-responder":
+				// ping-responder on|off, the pings of the docker side to the TUN address answered in the loop
+				d.ping = val == "on" || val == "true"
+			case "no-client":
+				// no-client queue|drop [size] [max-age], the outbound packets without client
+				if len(vals) == 0 || len(vals) > 3 || (vals[0] != "drop" && vals[0] != "queue") {
+					d.invalid(key, val, fmt.Errorf("expected queue|drop [size] [max-age]"))
+					break
+				}
+				size, age := queueSize, queueAge
+				var err error
+				if len(vals) > 1 {
+					if size, err = configInt(vals[1], 0, math.MaxInt32); err != nil {
+						d.invalid(key, val, fmt.Errorf("invalid size %s", vals[1]))
+						break
+					}
+				}
+				if len(vals) > 2 {
+					if age, err = time.ParseDuration(vals[2]); err != nil || age < 0 {
+						d.invalid(key, val, fmt.Errorf("invalid max-age %s", vals[2]))
+						break
+					}
+				}
+				d.set(setString(&noClient, vals[0]))
+				d.set(setInt(&queueSize, size))
+				d.set(setDuration(&queueAge, age))
+			case "expose":
+				// expose [udp] <bind>:<port>[-<last>] [subnet,...] [restart] [portmap] [off]
+				if r, ok := parseExposeRule(val); ok {
+					d.exposes = append(d.exposes, r)
+				} else {
+					d.invalid(key, val, fmt.Errorf("expected [udp] <bind>:<port>[-<last>] [subnet,...]"))
 				}
 			case "token":
-				vals := strings.Split(val, " ")
-				news1[vals[0]] = vals[1]
+				if len(vals) != 2 {
+					d.invalid(key, val, fmt.Errorf("expected <token> <ip>"))
+					break
+				}
+				d.tokens[vals[0]] = vals[1]
 			case "iptables":
-				vals := strings.Split(val, "+")
+				// iptables <a>+<b> joins the networks, <a>-<b> parts them
+				sides := strings.Split(val, "+")
 				join := true
-				if len(vals) == 1 {
-					vals = strings.Split(val, "-")
+				if len(sides) == 1 {
+					sides = strings.Split(val, "-")
 					join = false
 				}
-				val = fmt.Sprintf("%s %s", vals[0], vals[1])
-				if vals[0] > vals[1] {
-					val = fmt.Sprintf("%s %s", vals[1], vals[0])
+				if len(sides) != 2 {
+					d.invalid(key, val, fmt.Errorf("expected <a>+<b> or <a>-<b>"))
+					break
 				}
-				iptables1[val] = join
+				rule := fmt.Sprintf("%s %s", sides[0], sides[1])
+				if sides[0] > sides[1] {
+					rule = fmt.Sprintf("%s %s", sides[1], sides[0])
+				}
+				d.iptables[rule] = join
 			case "hosts":
-				hosts = val
+				d.set(func() func() {
+					old := shared.Hosts()
+					shared.SetHosts(val)
+					return func() { shared.SetHosts(old) }
+				})
+			case "hosts-template":
+				// hosts-template {{.Name}}.docker, resolved by the docker side
+				// for each running container
+				if strings.Contains(val, ",") {
+					d.invalid(key, val, fmt.Errorf("no comma allowed"))
+				} else {
+					d.templates = append(d.templates, val)
+				}
+			case "resolver":
+				// resolver <domain> [server], the docker side by default
+				if domain, server, err := parseResolver(val); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.resolvers[domain] = server
+				}
+			case "dns":
+				// dns log on|off, dns route <*.domain|name> tunnel|system
+				if err := parseDNS(val, &d.dnsLog, &d.dnsRoutes); err != nil {
+					d.invalid(key, val, err)
+				}
+			case "mirror":
+				// mirror <host:port> [filter], a copy of the packets as TZSP
+				if m, err := parseMirror(val); err != nil {
+					d.invalid(key, val, err)
+				} else {
+					d.mirrors = append(d.mirrors, m)
+				}
 			case "proxy":
-				GetProxyServer().Add(val)
+				d.proxies = append(d.proxies, val)
+			case "include":
+				// expanded by readConfigLines
+			case "profile":
+				// profile <name>, the default profile, read by selectProfile
 			default:
-				logger.Warningf("unknown action => %s\n", match[1])
+				d.problems = append(d.problems, fmt.Sprintf("unknown action => %s", key))
 			}
 		} else if s != "" && !strings.HasPrefix(s, "#") {
-			logger.Warningf("invalid config => %s\n", s)
+			d.problems = append(d.problems, fmt.Sprintf("invalid config => %s", s))
 		}
 	}
+	if hostServicesVal != "" {
+		// `auto` is in the virtual network of the config
+		_, sn, err := net.ParseCIDR(d.addr)
+		if err != nil {
+			sn = subnet
+		}
+		if ip, ports, err := parseHostServices(hostServicesVal, sn); err != nil {
+			d.invalid("host-services", hostServicesVal, err)
+		} else {
+			d.hostIP, d.hostPorts = ip, ports
+		}
+	}
+	return d
+}
+
+// applyConfig applies a parsed config, returning the routes the system
+// refused to add. The routes come first, and with the config applied before,
+// prev, refused ones roll them and the settings back, nothing else applied.
+func applyConfig(iface tunDevice, d *configState, init bool, prev *configState) (tunDevice, []string) {
+	oldHost, oldAddr := host, addr
+	mtu := MTU
+	undo := make([]func(), 0, len(d.settings))
+	for _, set := range d.settings {
+		undo = append(undo, set())
+	}
 	if init {
+		var err error
 		if peer, subnet, err = net.ParseCIDR(addr); err != nil {
 			logger.Fatal(err)
 		}
 		copy([]byte(localIP), []byte(peer.To4()))
 		localIP[3]++
 		if bind {
-			iface = setup(localIP, peer, subnet)
+			iface = setupTUN(localIP, peer, subnet)
 		}
-		for k, v := range iptables1 {
-			iptables[k] = v
+	}
+	if iface != nil {
+		tunIfName = iface.Name()
+	}
+	oldRoutes := shared.Routes()
+	oldOptions := routeOptions
+	schedules.Set(d.schedules)
+	routeExcludes = d.excludes
+	news := make(map[string]bool, len(d.routes))
+	for key, expose := range d.routes {
+		news[key] = expose
+	}
+	opts := make(map[string]routeOption, len(d.opts))
+	for key, opt := range d.opts {
+		opts[key] = opt
+	}
+	parts := make(map[string]bool)
+	for key, expose := range news {
+		if schedules.Disabled(key) {
+			logger.Infof("[SCHEDULE] Route %s disabled by schedule\n", key)
+			delete(news, key)
+		} else if ex := excluded(key, d.excludes); ex != nil {
+			delete(news, key)
+			split := splitRoute(key, d.excludes)
+			if len(split) == 0 {
+				logger.Warningf("route %s inside exclude %s, skipped\n", key, ex)
+				continue
+			}
+			logger.Infof("route %s overlaps exclude %s, split into %s\n", key, ex, strings.Join(split, " "))
+			for _, part := range split {
+				parts[part] = expose
+				if opt, ok := opts[key]; ok {
+					opts[part] = opt
+				}
+			}
 		}
 	}
-	if proxyServer != nil {
-		proxyServer.EndClear()
-		proxyServer.Start(localIP)
+	for part, expose := range parts {
+		news[part] = news[part] || expose
 	}
-	logger.Debugf("routes %s => %s\n", map2json(routes), map2json(news))
-	for key := range routes {
+	logger.Debugf("routes %s => %s\n", map2json(oldRoutes), map2json(news))
+	routeOptions = opts
+	routeProtos.Set(d.protos)
+	tunMTUs = d.mtus
+	routeTUNs.Refresh()
+	var added, removed []string
+	for key := range oldRoutes {
 		if val, ok := news[key]; ok {
-			routes[key] = val
+			shared.SetRoute(key, val)
 			delete(news, key)
-		} else if bind {
-			delRoute(key)
+			if bind && installedOptions[key] != routeOptions[key] {
+				logger.Infof("route %s options =>%s\n", key, routeOptions[key])
+				delRoute(key)
+				addRoute(key, peer)
+				added = append(added, key)
+			}
+		} else {
+			shared.DeleteRoute(key)
+			if bind {
+				delRoute(key)
+				removed = append(removed, key)
+			}
+		}
+	}
+	checked := make(map[string]bool)
+	if bind && len(news) > 0 {
+		scan := scanConflicts()
+		for key := range news {
+			checked[key] = true
+			if !conflicts.Allow(scan, key) {
+				delete(news, key)
+			}
 		}
 	}
 	for key := range news {
-		routes[key] = news[key]
+		shared.SetRoute(key, news[key])
 		if bind {
 			delRoute(key)
 			addRoute(key, peer)
+			added = append(added, key)
 		}
 	}
-	for key := range tokens {
-		if v, ok := news1[key]; ok {
-			tokens[key] = v
-		} else {
-			delete(tokens, key)
+	conflicts.Prune(checked)
+	failed := routeErrors.Failed(added)
+	if len(failed) > 0 && prev != nil {
+		// the routes of the previous config, then its settings
+		schedules.Set(prev.schedules)
+		routeExcludes = prev.excludes
+		routeOptions = oldOptions
+		routeProtos.Set(prev.protos)
+		tunMTUs = prev.mtus
+		routeTUNs.Refresh()
+		for _, key := range added {
+			delRoute(key)
+		}
+		shared.SetRoutes(oldRoutes)
+		for _, key := range append(removed, added...) {
+			if _, ok := oldRoutes[key]; ok {
+				addRoute(key, peer)
+			}
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
 		}
+		return iface, failed
 	}
-	for key := range news1 {
-		tokens[key] = news1[key]
+	if !init && mtu != MTU && iface != nil {
+		applyMTU(iface.Name(), MTU)
 	}
-	for key := range iptables {
-		if v, ok := iptables1[key]; ok {
-			if iptables[key] == v {
-				delete(iptables1, key)
-			} else {
-				iptables[key] = v
+	if !init {
+		events.Add("config", "reloaded %s", configFile)
+		if d.cfgPort != 0 && d.cfgPort != portSetting {
+			portSetting = d.cfgPort
+			reloadListener(oldHost, d.cfgPort)
+		} else if host != oldHost {
+			reloadListener(oldHost, port)
+		}
+		if addr != oldAddr {
+			reloadAddr(iface, oldAddr)
+		}
+	}
+	hostSvc.Set(d.hostIP, d.hostPorts)
+	hostsTemplates = d.templates
+	dnsLog, dnsRoutes = d.dnsLog, d.dnsRoutes
+	applyNAT(d.nat)
+	setDSCP(dscpSpec)
+	if bind {
+		resolvers := make(map[string]string, len(d.resolvers))
+		for domain, server := range d.resolvers {
+			resolvers[domain] = server
+		}
+		tunnelResolvers(resolvers, d.dnsRoutes)
+		for domain, server := range resolvers {
+			if server == "" {
+				resolvers[domain] = peer.String()
 			}
-		} else {
-			delete(iptables, key)
-			iptables1[key] = false
 		}
+		setResolvers(resolvers)
 	}
-	if cli != nil {
-		sendControls(cli, iptables1, hosts)
+	upLimit.SetRate(d.upRate)
+	downLimit.SetRate(d.downRate)
+	acl.Set(d.aclRules, d.aclDeny)
+	alarms.Set(d.alarmThresholds, d.alarmTargets)
+	peersAllow.Set(d.peerNets)
+	if proxyServer != nil {
+		proxyServer.StartClear()
 	}
-	news = nil
-	news1 = nil
-	iptables1 = nil
-	return iface
+	for _, p := range d.proxies {
+		GetProxyServer().Add(p)
+	}
+	if proxyServer != nil {
+		proxyServer.EndClear()
+		proxyServer.Start(localIP)
+	}
+	routes := shared.Routes()
+	traffic.Update(routes)
+	hooks.Set(d.hooks)
+	upScript, downScript = d.up, d.down
+	hooks.Routes(routes)
+	tcpExposes.Set(d.tcpRules)
+	pingResponder = d.ping
+	forwards.Set(d.forwards, peer)
+	activations.Set(d.activationPort, d.activationSecret, d.activationWindow)
+	exposes.Set(d.exposes)
+	portMaps.Set(portMapRequests(d.exposes, d.portMapTCP))
+	failover.Set(d.failover)
+	pins.Set(d.pinTOFU, d.pinnedPeers)
+	conntrack.Set(d.conntrack, d.flowLog)
+	mdnsAds.Set(d.mdns)
+	publishes.Set(d.publish)
+	mirrors.Set(d.mirrors)
+	updateWireGuard()
+	shared.SetTokens(d.tokens)
+	changes := shared.UpdateIPTables(d.iptables)
+	if cli := shared.Client(); cli != nil && takesDeltas() {
+		refreshControls(cli)
+	} else if cli != nil {
+		// only the changed rules, the removed ones disconnected
+		sendControls(cli, changes, shared.Hosts(), true)
+	}
+	return iface, failed
 }
 
 func map2json(m interface{}) string {
@@ -199,14 +806,56 @@ func map2json(m interface{}) string {
 	return ""
 }
 
+// appendConfig records the lines sent by `docker-connector config` in the
+// config, other than the pushed routes. A line already there is not added
+// again, and one starting with `-` removes the same lines, e.g. `-route
+// 172.18.0.0/16` withdraws a route sent before.
 func appendConfig(data []byte) {
-	fd, err := os.OpenFile(configFile, os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
+	if data = takePushedRoutes(data); len(data) == 0 {
 		return
 	}
-	fd.WriteString("\n")
-	fd.Write(data)
-	fd.Close()
+	path := mainConfigFile()
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		logControl.Warningf("[CONFIG] Failed to read %s: %v", path, err)
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(old), "\r\n"), "\n")
+	if len(old) == 0 {
+		lines = nil
+	}
+	find := func(line string) int {
+		for i, l := range lines {
+			if strings.TrimSpace(l) == line {
+				return i
+			}
+		}
+		return -1
+	}
+	changed := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line == "-":
+		case line[0] == '-':
+			line = strings.TrimSpace(line[1:])
+			for i := find(line); i >= 0; i = find(line) {
+				lines = append(lines[:i], lines[i+1:]...)
+				changed = true
+				logControl.Infof("[CONFIG] Removed %s", line)
+			}
+		case find(line) < 0:
+			lines = append(lines, line)
+			changed = true
+			logControl.Infof("[CONFIG] Added %s", line)
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		logControl.Warningf("[CONFIG] Failed to write %s: %v", path, err)
+	}
 }
 
 func sendConfig() {
@@ -243,8 +892,104 @@ func sendConfig() {
 	}
 }
 
+// ConfigRoute is a `route` line of the config file, disabled when commented
+type ConfigRoute struct {
+	Route   string `json:"route"`
+	Expose  bool   `json:"expose"`
+	Enabled bool   `json:"enabled"`
+}
+
+var routeLine = regexp.MustCompile(`^\s*(#\s*)?route\s+(\S+)(?:\s+(expose))?((?:\s+(?:(?:metric|table)\s+\d+|proto\s+[\w,]+))*)\s*$`)
+
+// readConfigLines returns the lines of the config, the includes expanded
+func readConfigLines() ([]string, error) {
+	if configFile == "" {
+		return nil, fmt.Errorf("no config file")
+	}
+	srcs, err := readConfigSources()
+	if err != nil {
+		return nil, err
+	}
+	return selectProfile(mergeConfigSources(srcs)), nil
+}
+
+// configRoutes lists the enabled and commented out routes of the config file
+func configRoutes() ([]ConfigRoute, error) {
+	lines, err := readConfigLines()
+	if err != nil {
+		return nil, err
+	}
+	var list []ConfigRoute
+	seen := make(map[string]int)
+	vars := configVars(lines)
+	for _, line := range lines {
+		match := routeLine.FindStringSubmatch(expandConfig(line, vars))
+		if match == nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(match[2]); err != nil {
+			continue
+		}
+		r := ConfigRoute{Route: match[2], Expose: match[3] != "", Enabled: match[1] == ""}
+		if i, ok := seen[r.Route]; ok {
+			list[i].Enabled = list[i].Enabled || r.Enabled
+			continue
+		}
+		seen[r.Route] = len(list)
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// setConfigRoute enables (uncomments or appends) or disables (comments out)
+// a route in the files of the config, the watcher then reloads it.
+func setConfigRoute(route string, enabled bool) error {
+	if _, _, err := net.ParseCIDR(route); err != nil {
+		return err
+	}
+	srcs, err := readConfigSources()
+	if err != nil {
+		return err
+	}
+	changed := make(map[*configSource][]string)
+	vars := configVars(mergeConfigSources(srcs))
+	for _, src := range srcs {
+		var lines []string
+		for i, line := range src.lines {
+			match := routeLine.FindStringSubmatch(expandConfig(line, vars))
+			if match == nil || match[2] != route {
+				continue
+			}
+			if lines == nil {
+				lines = append([]string(nil), src.lines...)
+			}
+			text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), match[1]))
+			if enabled {
+				lines[i] = text
+			} else {
+				lines[i] = "# " + text
+			}
+		}
+		if lines != nil {
+			changed[src] = lines
+		}
+	}
+	if len(changed) == 0 {
+		if !enabled {
+			return nil
+		}
+		main := mainConfigSource(srcs)
+		changed[main] = append(append([]string(nil), main.lines...), "route "+route)
+	}
+	return writeConfigSources(srcs, changed)
+}
+
+// clearRoutes removes the installed routes, holding the config lock since a
+// reload may be changing them while stopping
 func clearRoutes() {
-	for key := range routes {
+	configLock.Lock()
+	defer configLock.Unlock()
+	for key := range shared.Routes() {
 		delRoute(key)
 	}
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A reload applies the whole config or nothing. The lines are parsed once
+// into a configState, the state they ask for, by the parsers of their
+// directives, and a reload with an invalid line, e.g. a bad CIDR or a port
+// out of range, is rejected before anything changes, the running config
+// kept. The same state is then applied, the routes first: a route the system
+// refuses to install rolls the reload back, the routes it added being
+// removed, those it removed or changed installed again and the settings it
+// changed restored, before anything else of it is applied. The outcome,
+// applied, rejected or rolled back, is logged with the problems, kept in the
+// events and listed in `config_apply` of `status`. A config rejected or
+// rolled back is recorded in the state dir with the last one applied, so a
+// restart on the same file starts with the last one applied rather than with
+// the valid lines of the rejected one. On start the valid lines are applied
+// and the invalid ones skipped, there being no previous config to keep.
+const configRejectedFileName = "desktop-docker-connector.rejected"
+
+// ConfigRejectedFile records the config rejected by the running connector
+var ConfigRejectedFile = ""
+
+// configDirective splits a line of the config into its directive and value
+var configDirective = regexp.MustCompile(`^\s*(\w+\S+)(?:\s+(.*))?$`)
+
+// ConfigApplyStatus describes the last load of the config
+type ConfigApplyStatus struct {
+	Result   string   `json:"result"`
+	Time     string   `json:"time"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// configRejection is the record of a rejected config, by the hash of its
+// lines, with the lines of the last config applied
+type configRejection struct {
+	Hash     string   `json:"hash"`
+	Result   string   `json:"result"`
+	Problems []string `json:"problems,omitempty"`
+	Good     []string `json:"good"`
+}
+
+type configApplyState struct {
+	sync.Mutex
+	last *ConfigApplyStatus
+	// good is the last config applied in full
+	good *configState
+}
+
+var configApply = &configApplyState{}
+
+// Record records the outcome of a load
+func (s *configApplyState) Record(result string, problems []string) {
+	s.Lock()
+	s.last = &ConfigApplyStatus{Result: result, Time: time.Now().Format(time.RFC3339), Problems: problems}
+	s.Unlock()
+	if result != "applied" {
+		events.Add("config", "%s: %s", result, strings.Join(problems, "; "))
+	}
+}
+
+// Good returns the last config applied in full, nil before any
+func (s *configApplyState) Good() *configState {
+	s.Lock()
+	defer s.Unlock()
+	return s.good
+}
+
+// SetGood keeps a config applied in full
+func (s *configApplyState) SetGood(d *configState) {
+	s.Lock()
+	s.good = d
+	s.Unlock()
+}
+
+// Applied keeps a config applied in full and forgets the rejected one
+func (s *configApplyState) Applied(d *configState, problems []string) {
+	s.SetGood(d)
+	s.Record("applied", problems)
+	if err := os.Remove(ConfigRejectedFile); err != nil && !os.IsNotExist(err) {
+		logger.Warningf("[CONFIG] Failed to remove %s: %v", ConfigRejectedFile, err)
+	}
+}
+
+// Reject records a config rejected or rolled back, with the last one applied
+func (s *configApplyState) Reject(d *configState, result string, problems []string) {
+	s.Record(result, problems)
+	good := s.Good()
+	if good == nil {
+		return
+	}
+	data, err := json.Marshal(&configRejection{Hash: configHash(d.lines), Result: result, Problems: problems, Good: good.lines})
+	if err == nil {
+		// the config may hold secrets
+		err = ioutil.WriteFile(ConfigRejectedFile, data, 0600)
+	}
+	if err != nil {
+		logger.Warningf("[CONFIG] Failed to record the rejected config in %s: %v", ConfigRejectedFile, err)
+	}
+}
+
+// Rejected returns the record of the lines when rejected by the last run, nil
+// otherwise
+func (s *configApplyState) Rejected(lines []string) *configRejection {
+	data, err := ioutil.ReadFile(ConfigRejectedFile)
+	if err != nil {
+		return nil
+	}
+	var r configRejection
+	if json.Unmarshal(data, &r) != nil || r.Hash != configHash(lines) || r.Good == nil {
+		return nil
+	}
+	return &r
+}
+
+func (s *configApplyState) Status() *ConfigApplyStatus {
+	s.Lock()
+	defer s.Unlock()
+	return s.last
+}
+
+func configHash(lines []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// configState is the state a config asks for, parsed by parseConfig and
+// applied by applyConfig
+type configState struct {
+	lines []string
+	// problems are the invalid lines, skipped
+	problems []string
+	// settings assign the globals of the directives, in order
+	settings []configSetting
+	// addr is the virtual network asked for, of `auto` of host-services
+	addr             string
+	cfgPort          int
+	routes           map[string]bool
+	opts             map[string]routeOption
+	protos           map[string]protoSet
+	mtus             map[string]int
+	excludes         []*net.IPNet
+	schedules        []scheduleEntry
+	tokens           map[string]string
+	iptables         map[string]bool
+	upRate, downRate float64
+	aclRules         []aclRule
+	aclDeny          bool
+	peerNets         []*net.IPNet
+	tcpRules         map[string]tcpExposeRule
+	portMapTCP       []string
+	forwards         []forwardRule
+	exposes          []exposeRule
+	ping             bool
+	hooks            map[string]string
+	alarmThresholds  map[string]float64
+	alarmTargets     []string
+	up, down         string
+	hostIP           net.IP
+	hostPorts        []hostPortRange
+	failover         string
+	pinTOFU          bool
+	pinnedPeers      []PinnedPeer
+	conntrack        bool
+	flowLog          string
+	mdns             bool
+	publish          *net.IPNet
+	nat              []string
+	resolvers        map[string]string
+	dnsLog           bool
+	dnsRoutes        []dnsRoute
+	mirrors          []*mirrorTarget
+	activationPort   int
+	activationSecret string
+	activationWindow time.Duration
+	templates        []string
+	proxies          []string
+}
+
+func newConfigState(lines []string) *configState {
+	return &configState{
+		lines:            lines,
+		addr:             addr,
+		routes:           make(map[string]bool),
+		opts:             make(map[string]routeOption),
+		protos:           make(map[string]protoSet),
+		mtus:             make(map[string]int),
+		tokens:           make(map[string]string),
+		iptables:         make(map[string]bool),
+		tcpRules:         make(map[string]tcpExposeRule),
+		ping:             true,
+		hooks:            make(map[string]string),
+		alarmThresholds:  make(map[string]float64),
+		resolvers:        make(map[string]string),
+		activationWindow: activationDefault,
+	}
+}
+
+// invalid records the problem of a line, skipped
+func (d *configState) invalid(key, val string, err error) {
+	d.problems = append(d.problems, fmt.Sprintf("invalid %s => %s: %v", key, val, err))
+}
+
+// secret reads a secret of the config, fatal at start as those of the flags,
+// the problem leaving the value out
+func (d *configState) secret(name, val string, init bool) (string, bool) {
+	s, err := resolveSecret(val)
+	if err == nil {
+		return s, true
+	}
+	if init {
+		logger.Fatalf("failed to read %s => %v", name, err)
+	}
+	d.problems = append(d.problems, fmt.Sprintf("failed to read %s => %v", name, err))
+	return "", false
+}
+
+func (d *configState) set(s configSetting) {
+	d.settings = append(d.settings, s)
+}
+
+// configSetting assigns a global of the config and returns how to restore it
+type configSetting func() (undo func())
+
+func setString(p *string, v string) configSetting {
+	return func() func() {
+		old := *p
+		*p = v
+		return func() { *p = old }
+	}
+}
+
+func setInt(p *int, v int) configSetting {
+	return func() func() {
+		old := *p
+		*p = v
+		return func() { *p = old }
+	}
+}
+
+func setBool(p *bool, v bool) configSetting {
+	return func() func() {
+		old := *p
+		*p = v
+		return func() { *p = old }
+	}
+}
+
+func setDuration(p *time.Duration, v time.Duration) configSetting {
+	return func() func() {
+		old := *p
+		*p = v
+		return func() { *p = old }
+	}
+}
+
+// configInt parses a number of the config from min to max
+func configInt(val string, min, max int) (int, error) {
+	v, err := strconv.Atoi(val)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("expected a number from %d to %d", min, max)
+	}
+	return v, nil
+}
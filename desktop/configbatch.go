@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// `POST /batch` applies a list of changes to the config file at once:
+//
+//	{"ops": [
+//	  {"op": "add_route", "route": "172.18.0.0/16"},
+//	  {"op": "add_route", "route": "172.19.0.0/16", "expose": true},
+//	  {"op": "disable_route", "route": "172.20.0.0/16"},
+//	  {"op": "remove_route", "route": "172.21.0.0/16"},
+//	  {"op": "set_hosts", "hosts": "/etc/hosts .local"}
+//	]}
+//
+// The changes are checked and applied in order on the lines of the config
+// files, in the file holding the line or the main file for new lines. The
+// files are only written when all of them succeed and restored when a write
+// fails. The watcher then reloads it once, with a single push of the
+// controls to the docker side. Adding a route of the config keeps its
+// options. The batch is only taken from loopback clients as
+// `application/json`, which another site can't post.
+type BatchOp struct {
+	Op     string `json:"op"`
+	Route  string `json:"route,omitempty"`
+	Expose bool   `json:"expose,omitempty"`
+	Hosts  string `json:"hosts,omitempty"`
+}
+
+// BatchRequest is the body of `POST /batch`
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// BatchResult is the outcome of a batch, the routes of the config after it
+// when applied
+type BatchResult struct {
+	Applied bool          `json:"applied"`
+	Failed  int           `json:"failed_op,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Routes  []ConfigRoute `json:"routes,omitempty"`
+	Hosts   string        `json:"hosts,omitempty"`
+}
+
+var (
+	hostsLine = regexp.MustCompile(`^\s*hosts(?:\s+(.*))?$`)
+	hostsSpec = regexp.MustCompile(`^\s*(".*"|\S*)\s+((?:[\w.+-]+\s*){1,})$`)
+)
+
+// applyOp applies a change to the lines of a file of the config, telling
+// whether the route or hosts was found in it. A found `hosts` is only set in
+// the first file holding it, `placed` once it is.
+func applyOp(lines []string, op BatchOp, vars map[string]string, placed bool) ([]string, bool, error) {
+	switch op.Op {
+	case "add_route", "disable_route", "remove_route":
+		if _, _, err := net.ParseCIDR(op.Route); err != nil {
+			return nil, false, err
+		}
+		found := false
+		kept := lines[:0:0]
+		for _, line := range lines {
+			match := routeLine.FindStringSubmatch(expandConfig(line, vars))
+			if match == nil || match[2] != op.Route {
+				kept = append(kept, line)
+				continue
+			}
+			found = true
+			switch op.Op {
+			case "add_route":
+				// the metric, table and proto of the route are kept
+				kept = append(kept, strings.Join(append([]string{routeText(op)}, strings.Fields(match[4])...), " "))
+			case "disable_route":
+				kept = append(kept, "# "+strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), match[1])))
+			}
+		}
+		return kept, found, nil
+	case "set_hosts":
+		if op.Hosts != "" {
+			match := hostsSpec.FindStringSubmatch(op.Hosts)
+			if match == nil {
+				return nil, false, fmt.Errorf("invalid hosts %q", op.Hosts)
+			}
+			if _, err := os.Stat(strings.Trim(match[1], `"`)); err != nil {
+				return nil, false, err
+			}
+		}
+		found := false
+		kept := lines[:0:0]
+		for _, line := range lines {
+			if !hostsLine.MatchString(line) {
+				kept = append(kept, line)
+				continue
+			}
+			if !found && !placed && op.Hosts != "" {
+				kept = append(kept, "hosts "+op.Hosts)
+			}
+			found = true
+		}
+		return kept, found, nil
+	}
+	return nil, false, fmt.Errorf("unknown op %q", op.Op)
+}
+
+func routeText(op BatchOp) string {
+	if op.Expose {
+		return "route " + op.Route + " expose"
+	}
+	return "route " + op.Route
+}
+
+// applyBatch applies the changes to the files of the config, all or none
+func applyBatch(ops []BatchOp) *BatchResult {
+	configLock.Lock()
+	defer configLock.Unlock()
+	res := &BatchResult{}
+	srcs, err := readConfigSources()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	main := mainConfigSource(srcs)
+	changed := make(map[*configSource][]string, len(srcs))
+	for _, src := range srcs {
+		changed[src] = src.lines
+	}
+	for i, op := range ops {
+		var all []string
+		for _, src := range srcs {
+			all = append(all, changed[src]...)
+		}
+		vars := configVars(all)
+		found := false
+		for _, src := range srcs {
+			lines, ok, err := applyOp(changed[src], op, vars, found)
+			if err != nil {
+				res.Failed, res.Error = i+1, err.Error()
+				logger.Warningf("[ADMIN] Batch rejected at op %d %s: %v", i+1, op.Op, err)
+				return res
+			}
+			changed[src], found = lines, found || ok
+		}
+		if found {
+			continue
+		}
+		switch {
+		case op.Op == "add_route":
+			changed[main] = append(changed[main], routeText(op))
+		case op.Op == "set_hosts" && op.Hosts != "":
+			changed[main] = append(changed[main], "hosts "+op.Hosts)
+		case op.Op != "set_hosts":
+			res.Failed, res.Error = i+1, fmt.Sprintf("route %s not in config", op.Route)
+			logger.Warningf("[ADMIN] Batch rejected at op %d %s: %s", i+1, op.Op, res.Error)
+			return res
+		}
+	}
+	writes := make(map[*configSource][]string)
+	for _, src := range srcs {
+		if strings.Join(changed[src], "\n") != strings.Join(src.lines, "\n") {
+			writes[src] = changed[src]
+		}
+	}
+	if err := writeConfigSources(srcs, writes); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	logger.Infof("[ADMIN] Batch of %d ops applied to %s", len(ops), configFile)
+	res.Applied = true
+	for _, src := range srcs {
+		for _, line := range changed[src] {
+			if match := hostsLine.FindStringSubmatch(line); match != nil {
+				res.Hosts = match[1]
+			}
+		}
+	}
+	return res
+}
+
+// serveBatch runs `POST /batch`
+func serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// a form of another site can't post JSON
+	if !jsonRequest(r) {
+		http.Error(w, "expected application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := applyBatch(req.Ops)
+	if res.Applied {
+		res.Routes, _ = configRoutes()
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// `conflict warn|refuse|off`: before a route is installed, it is checked
+// against the networks of the interfaces, the routes of the system and the
+// address of the docker side. A route overlapping them, e.g. the Wi-Fi LAN or
+// a corporate VPN, would blackhole their traffic into the tunnel, so it is
+// logged loudly, or not installed with `refuse`.
+const (
+	conflictWarn   = "warn"
+	conflictRefuse = "refuse"
+	conflictOff    = "off"
+)
+
+var (
+	conflictMode = conflictWarn
+	conflicts    = &conflictTable{entries: make(map[string]RouteConflict)}
+	// tunIfName is the name of the TUN, whose networks are ours
+	tunIfName = ""
+)
+
+// systemRoute is a route of the system and its device
+type systemRoute struct {
+	net *net.IPNet
+	dev string
+}
+
+// RouteConflict is a route overlapping a network of the host
+type RouteConflict struct {
+	Reason  string `json:"reason"`
+	Refused bool   `json:"refused"`
+}
+
+type conflictTable struct {
+	sync.Mutex
+	entries map[string]RouteConflict
+}
+
+// conflictScan is a snapshot of the networks of the host
+type conflictScan struct {
+	nets []systemRoute
+}
+
+// validConflictMode tells whether the mode is known
+func validConflictMode(mode string) bool {
+	return mode == conflictWarn || mode == conflictRefuse || mode == conflictOff
+}
+
+// scanConflicts takes a snapshot of the networks of the host but those of the
+// TUN
+func scanConflicts() *conflictScan {
+	own := tunIfName
+	scan := &conflictScan{}
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Name == own || routeTUNs.Owns(ifi.Name) || ifi.Flags&net.FlagLoopback != 0 || ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				network := &net.IPNet{IP: ipnet.IP.To4().Mask(ipnet.Mask), Mask: ipnet.Mask}
+				scan.nets = append(scan.nets, systemRoute{net: network, dev: ifi.Name})
+			}
+		}
+	}
+	for _, r := range systemRoutes() {
+		if r.dev == own || r.dev == localIP.String() || r.net.IP.IsLoopback() || r.net.IP.IsMulticast() ||
+			r.net.IP.Equal(net.IPv4bcast) || r.net.IP.Equal(localIP) || r.net.IP.Equal(peer) {
+			continue
+		}
+		if shared.HasRoute(r.net.String()) {
+			continue
+		}
+		scan.nets = append(scan.nets, r)
+	}
+	return scan
+}
+
+// Check returns why the route conflicts with the host, empty if it doesn't
+func (s *conflictScan) Check(key string) string {
+	_, ipnet, err := net.ParseCIDR(key)
+	if err != nil {
+		return ""
+	}
+	if client := shared.Client(); client != nil && ipnet.Contains(client.IP) {
+		return fmt.Sprintf("contains the docker side %v", client.IP)
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && ipnet.Contains(ip) {
+		return fmt.Sprintf("contains the listen address %v", ip)
+	}
+	for _, n := range s.nets {
+		if overlaps(ipnet, n.net) {
+			return fmt.Sprintf("overlaps %v of %s", n.net, n.dev)
+		}
+	}
+	return ""
+}
+
+// Allow checks the route before it is installed, it returns false when the
+// route is refused
+func (t *conflictTable) Allow(scan *conflictScan, key string) bool {
+	if conflictMode == conflictOff {
+		return true
+	}
+	reason := scan.Check(key)
+	t.Lock()
+	defer t.Unlock()
+	if reason == "" {
+		delete(t.entries, key)
+		return true
+	}
+	refused := conflictMode == conflictRefuse
+	t.entries[key] = RouteConflict{Reason: reason, Refused: refused}
+	if refused {
+		logRoutes.Errorf("[CONFLICT] Route %s %s, refused", key, reason)
+		return false
+	}
+	logRoutes.Warningf("[CONFLICT] !!! Route %s %s, its traffic now goes into the tunnel, use `exclude` or `conflict refuse`", key, reason)
+	return true
+}
+
+// Prune forgets the conflicts of the routes neither installed nor checked
+// again
+func (t *conflictTable) Prune(checked map[string]bool) {
+	t.Lock()
+	defer t.Unlock()
+	for key := range t.entries {
+		if !shared.HasRoute(key) && !checked[key] {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Status returns the conflicts by route
+func (t *conflictTable) Status() map[string]RouteConflict {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.entries) == 0 {
+		return nil
+	}
+	m := make(map[string]RouteConflict, len(t.entries))
+	for k, v := range t.entries {
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// With `conntrack on` the IPv4 packets through the tunnel are tracked by
+// connection, the 5-tuple as seen by the first packet, with the state and the
+// packets and bytes of each way, so `flows` answers what is talking through
+// the tunnel without capturing. The busiest ones are in `status`. TCP flows
+// end with their FIN or RST, the others once silent for a while.
+//
+// `flow-log <file> [interval]` writes the flows as JSON lines, those with
+// traffic every interval and each one once ended, `-` for the log.
+//
+//	conntrack on
+//	flow-log /var/log/docker-connector-flows.log 1m
+const (
+	conntrackMax = 65536
+	// conntrackTop is the number of flows in the status
+	conntrackTop = 20
+	// the idle timeouts of the flows by state
+	tcpEstablishedTimeout = 5 * time.Minute
+	tcpTransientTimeout   = 30 * time.Second
+	tcpClosedTimeout      = 10 * time.Second
+	udpTimeout            = time.Minute
+	otherTimeout          = 30 * time.Second
+	conntrackSweep        = 10 * time.Second
+	flowLogEvery          = time.Minute
+)
+
+// Flow is a tracked connection, out is the way of its first packet
+type Flow struct {
+	Proto      string `json:"proto"`
+	Src        string `json:"src"`
+	Dst        string `json:"dst"`
+	Direction  string `json:"direction"`
+	State      string `json:"state"`
+	PacketsOut uint64 `json:"packets_out"`
+	BytesOut   uint64 `json:"bytes_out"`
+	PacketsIn  uint64 `json:"packets_in"`
+	BytesIn    uint64 `json:"bytes_in"`
+	Start      string `json:"start"`
+	Last       string `json:"last"`
+	Event      string `json:"event,omitempty"`
+}
+
+type ctKey struct {
+	proto        byte
+	src, dst     [4]byte
+	sport, dport uint16
+}
+
+func (k ctKey) reverse() ctKey {
+	return ctKey{proto: k.proto, src: k.dst, dst: k.src, sport: k.dport, dport: k.sport}
+}
+
+type ctEntry struct {
+	key   ctKey
+	dir   connector.Direction
+	state string
+	// fin tells which ways sent a FIN
+	finOut, finIn        bool
+	packetsOut, bytesOut uint64
+	packetsIn, bytesIn   uint64
+	start, last, logged  time.Time
+}
+
+// ConntrackStatus is the connection tracking in the status
+type ConntrackStatus struct {
+	Flows     int    `json:"flows"`
+	Untracked uint64 `json:"untracked"`
+	Ended     uint64 `json:"ended"`
+	Top       []Flow `json:"top,omitempty"`
+}
+
+type conntrackTable struct {
+	sync.Mutex
+	enabled   bool
+	flows     map[ctKey]*ctEntry
+	untracked uint64
+	ended     uint64
+	logPath   string
+	logEvery  time.Duration
+	logFile   *os.File
+	logged    time.Time
+}
+
+var conntrack = &conntrackTable{flows: make(map[ctKey]*ctEntry)}
+
+// Set applies `conntrack` and `flow-log`, the table starting empty once
+// enabled
+func (t *conntrackTable) Set(enabled bool, logVal string) {
+	fields := strings.Fields(logVal)
+	path, every := "", flowLogEvery
+	if len(fields) > 0 {
+		path = fields[0]
+	}
+	if len(fields) > 1 {
+		if d, err := time.ParseDuration(fields[1]); err == nil && d > 0 {
+			every = d
+		} else {
+			logger.Warningf("invalid flow-log interval => %s\n", fields[1])
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	if enabled != t.enabled {
+		logger.Infof("[CONNTRACK] Connection tracking %s", map[bool]string{true: "on", false: "off"}[enabled])
+		t.flows = make(map[ctKey]*ctEntry)
+	}
+	t.enabled = enabled
+	t.logEvery = every
+	if path == t.logPath {
+		return
+	}
+	if t.logFile != nil {
+		t.logFile.Close()
+		t.logFile = nil
+	}
+	t.logPath = path
+	if path != "" && path != "-" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Warningf("[CONNTRACK] Failed to open the flow log %s: %v", path, err)
+			t.logPath = ""
+			return
+		}
+		t.logFile = f
+	}
+	if path != "" {
+		logger.Infof("[CONNTRACK] Flow log => %s every %v", path, every)
+	}
+}
+
+func (t *conntrackTable) Enabled() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.enabled
+}
+
+// parseFlow returns the key of an IPv4 packet, false for other packets and
+// the fragments after the first one
+func parseFlow(pkt []byte) (ctKey, bool) {
+	var k ctKey
+	if len(pkt) < 20 || pkt[0]>>4 != 4 || binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+		return k, false
+	}
+	k.proto = pkt[9]
+	copy(k.src[:], pkt[12:16])
+	copy(k.dst[:], pkt[16:20])
+	ihl := int(pkt[0]&0x0f) * 4
+	switch k.proto {
+	case 6, 17:
+		if len(pkt) < ihl+4 {
+			return k, false
+		}
+		k.sport = binary.BigEndian.Uint16(pkt[ihl:])
+		k.dport = binary.BigEndian.Uint16(pkt[ihl+2:])
+	case 1:
+		// echo request and reply by identifier
+		if len(pkt) >= ihl+8 && (pkt[ihl] == 8 || pkt[ihl] == 0) {
+			k.sport = binary.BigEndian.Uint16(pkt[ihl+4:])
+			k.dport = k.sport
+		}
+	}
+	return k, true
+}
+
+// Track counts a packet of a way to its flow, creating it if new
+func (t *conntrackTable) Track(pkt []byte, dir connector.Direction) {
+	k, ok := parseFlow(pkt)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	if !t.enabled {
+		return
+	}
+	e, out := t.flows[k], true
+	if e == nil {
+		if e = t.flows[k.reverse()]; e != nil {
+			out = false
+		}
+	}
+	if e == nil {
+		if len(t.flows) >= conntrackMax {
+			t.untracked++
+			return
+		}
+		e = &ctEntry{key: k, dir: dir, state: "new", start: now}
+		t.flows[k] = e
+	}
+	e.last = now
+	if out {
+		e.packetsOut++
+		e.bytesOut += uint64(len(pkt))
+	} else {
+		e.packetsIn++
+		e.bytesIn += uint64(len(pkt))
+	}
+	if k.proto != 6 {
+		if !out && e.state == "new" {
+			e.state = "established"
+		}
+		return
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if len(pkt) < ihl+14 {
+		return
+	}
+	flags := pkt[ihl+13]
+	switch {
+	case flags&0x04 != 0:
+		e.state = "closed"
+	case flags&0x01 != 0:
+		if out {
+			e.finOut = true
+		} else {
+			e.finIn = true
+		}
+		e.state = "closing"
+		if e.finOut && e.finIn {
+			e.state = "closed"
+		}
+	case e.state == "new" && !out && flags&0x12 == 0x12:
+		e.state = "established"
+	case e.state == "new" && out && flags&0x10 != 0 && e.packetsIn > 0:
+		e.state = "established"
+	}
+}
+
+func ctProto(p byte) string {
+	switch p {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	}
+	return strconv.Itoa(int(p))
+}
+
+func ctAddr(ip [4]byte, port uint16, proto byte) string {
+	if proto == 6 || proto == 17 {
+		return net.JoinHostPort(net.IP(ip[:]).String(), strconv.Itoa(int(port)))
+	}
+	return net.IP(ip[:]).String()
+}
+
+func (e *ctEntry) flow(event string) Flow {
+	return Flow{
+		Proto:      ctProto(e.key.proto),
+		Src:        ctAddr(e.key.src, e.key.sport, e.key.proto),
+		Dst:        ctAddr(e.key.dst, e.key.dport, e.key.proto),
+		Direction:  e.dir.String(),
+		State:      e.state,
+		PacketsOut: e.packetsOut,
+		BytesOut:   e.bytesOut,
+		PacketsIn:  e.packetsIn,
+		BytesIn:    e.bytesIn,
+		Start:      e.start.Format(time.RFC3339),
+		Last:       e.last.Format(time.RFC3339),
+		Event:      event,
+	}
+}
+
+// timeout is how long the flow lives without packets
+func (e *ctEntry) timeout() time.Duration {
+	switch {
+	case e.key.proto == 6 && e.state == "closed":
+		return tcpClosedTimeout
+	case e.key.proto == 6 && e.state == "established":
+		return tcpEstablishedTimeout
+	case e.key.proto == 6:
+		return tcpTransientTimeout
+	case e.key.proto == 17:
+		return udpTimeout
+	}
+	return otherTimeout
+}
+
+// writeFlows writes flow log lines, the lock held
+func (t *conntrackTable) writeFlows(flows []Flow) {
+	if t.logPath == "" || len(flows) == 0 {
+		return
+	}
+	var b strings.Builder
+	for _, f := range flows {
+		line, _ := json.Marshal(f)
+		if t.logFile == nil {
+			logger.Infof("[FLOW] %s", line)
+			continue
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	if t.logFile != nil {
+		if _, err := t.logFile.WriteString(b.String()); err != nil {
+			logger.Warningf("[CONNTRACK] Failed to write the flow log: %v", err)
+		}
+	}
+}
+
+// sweep ends the flows timed out and logs those with traffic when due
+func (t *conntrackTable) sweep(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	var lines []Flow
+	for k, e := range t.flows {
+		if now.Sub(e.last) >= e.timeout() {
+			delete(t.flows, k)
+			t.ended++
+			lines = append(lines, e.flow("end"))
+		}
+	}
+	if t.logPath != "" && now.Sub(t.logged) >= t.logEvery {
+		t.logged = now
+		for _, e := range t.flows {
+			if e.last.After(e.logged) {
+				e.logged = now
+				lines = append(lines, e.flow("update"))
+			}
+		}
+	}
+	t.writeFlows(lines)
+}
+
+// watchConntrack expires the flows and writes the flow log
+func (c *Connector) watchConntrack() {
+	ticker := time.NewTicker(conntrackSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			conntrack.sweep(now)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Flows returns the flows by bytes, the busiest first
+func (t *conntrackTable) Flows() []Flow {
+	t.Lock()
+	entries := make([]*ctEntry, 0, len(t.flows))
+	for _, e := range t.flows {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].bytesOut+entries[i].bytesIn > entries[j].bytesOut+entries[j].bytesIn
+	})
+	flows := make([]Flow, len(entries))
+	for i, e := range entries {
+		flows[i] = e.flow("")
+	}
+	t.Unlock()
+	return flows
+}
+
+func (t *conntrackTable) Status() *ConntrackStatus {
+	if !t.Enabled() {
+		return nil
+	}
+	flows := t.Flows()
+	t.Lock()
+	st := &ConntrackStatus{Flows: len(flows), Untracked: t.untracked, Ended: t.ended}
+	t.Unlock()
+	if len(flows) > conntrackTop {
+		flows = flows[:conntrackTop]
+	}
+	st.Top = flows
+	return st
+}
+
+func conntrackMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	conntrack.Track(pkt, dir)
+	return pkt, false
+}
+
+func serveFlows(w http.ResponseWriter, r *http.Request) {
+	if !conntrack.Enabled() {
+		http.Error(w, "conntrack is off", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conntrack.Flows())
+}
+
+// runFlows implements `flows`, printing the flows through the tunnel
+func runFlows() {
+	fs := flag.NewFlagSet("flows", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	body, err := adminGet("/flows")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var flows []Flow
+	if err := json.Unmarshal(body, &flows); err != nil {
+		os.Stdout.Write(body)
+		os.Exit(1)
+	}
+	fmt.Printf("%-5s %-21s %-21s %-11s %10s %10s %s\n", "PROTO", "SRC", "DST", "STATE", "OUT", "IN", "LAST")
+	for _, f := range flows {
+		fmt.Printf("%-5s %-21s %-21s %-11s %10d %10d %s\n", f.Proto, f.Src, f.Dst, f.State, f.BytesOut, f.BytesIn, f.Last)
+	}
+}
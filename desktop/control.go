@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With `control-port`, the heartbeats, controls, resync requests and diag
+// results of a docker side started with `-control-port` use a second socket
+// marked with DSCP CS6, so they stay responsive while the data socket is
+// saturated. Other docker sides keep using the data socket for everything.
+const controlTOS = 0xc0
+
+var (
+	controlPort = 0
+	ctlConn     *net.UDPConn
+	ctlLock     sync.Mutex
+	ctlCli      *net.UDPAddr
+)
+
+func startControl(c *Connector) {
+	if controlPort <= 0 {
+		return
+	}
+	var err error
+	ctlConn, err = listenUDP(&net.UDPAddr{IP: net.ParseIP(host), Port: controlPort})
+	if err != nil {
+		logControl.Warningf("[CONTROL] Failed to listen on control port %d: %v", controlPort, err)
+		return
+	}
+	if err := setTOS(ctlConn, controlTOS); err != nil {
+		logControl.Warningf("[CONTROL] Failed to set DSCP of the control socket: %v", err)
+	}
+	logControl.Infof("[CONTROL] Listening for control traffic on %v", ctlConn.LocalAddr())
+	c.wg.Add(1)
+	go c.serveControl()
+}
+
+func stopControl() {
+	if ctlConn != nil {
+		ctlConn.Close()
+	}
+}
+
+// controlTarget returns the socket and address the control traffic for the
+// client goes to, the control socket if the client has one.
+func controlTarget(addr *net.UDPAddr) (*net.UDPConn, *net.UDPAddr) {
+	ctlLock.Lock()
+	defer ctlLock.Unlock()
+	if ctlCli != nil && (addr == nil || addr.IP.Equal(ctlCli.IP)) {
+		return ctlConn, ctlCli
+	}
+	return conn, addr
+}
+
+func (c *Connector) serveControl() {
+	defer c.wg.Done()
+	data := make([]byte, bufferSize())
+	supervise(c.ctx, "control", func() {
+		for {
+			n, from, err := ctlConn.ReadFromUDP(data)
+			if err != nil {
+				if c.ctx.Err() != nil {
+					return
+				}
+				logControl.Warningf("[CONTROL] Read error: %v", err)
+				continue
+			}
+			if n == 0 || n == 1 && data[0] == keepaliveType || !peersAllow.Allowed(from.IP) || !knocks.Allowed(from.IP) || !failover.Admit(from, data[0] == 0, ctlConn) {
+				continue
+			}
+			if data[0] == 0 && n >= heartbeatLen {
+				if !pins.Admit(ctlConn, ctlSession.name, data[:n], from) {
+					continue
+				}
+				if ok, _ := ctlSession.Heartbeat(heartbeatSession(data[:n]), from, atomic.LoadInt32(&c.peerDead) == 0); !ok {
+					ctlSession.Request(ctlConn, from)
+					continue
+				}
+			} else if !ctlSession.Data(from) {
+				ctlSession.Request(ctlConn, from)
+				continue
+			}
+			touchPeer()
+			renew := atomic.CompareAndSwapInt32(&c.peerDead, 1, 0)
+			switch {
+			case data[0] == 0 && n >= heartbeatLen:
+				setPeerFeatures(data[:n])
+				if reply := clock.handleHeartbeat(data[:n], time.Now().UnixNano()); reply != nil {
+					if _, err := ctlConn.WriteToUDP(reply, from); err != nil {
+						logHealth.Warningf("[HEARTBEAT] Failed to reply to %v: %v", from, err)
+					}
+				}
+				ctlLock.Lock()
+				changed := ctlCli == nil || ctlCli.String() != from.String()
+				ctlCli = from
+				ctlLock.Unlock()
+				if changed || renew {
+					logControl.Infof("[CONTROL] Control client => %v", from)
+					refreshControls(from)
+				}
+			case data[0] == resyncRequest && n == 1:
+				logTransport.Infof("[CLIENT] Resync requested by %v", from)
+				resendControls(from)
+			case data[0] == controlsAck:
+				ctlVersions.Ack(data[:n], from)
+			case data[0] == pathReport && n > 1:
+				paths.Report(data[1:n], from)
+			case data[0] == diagResult && n > 1:
+				diag.Add(data[:n])
+			case data[0] == 1 && n > 1:
+				logControl.Debugf("[CONTROL] Received control packet from %v, size: %d", from, n-1)
+				if line := verifyControl(data[1:n], from); line != nil {
+					audits.Control(line, from.String())
+					appendConfig(line)
+				}
+			default:
+				logControl.Debugf("[CONTROL] Unexpected %d bytes of type %s from %v", n, messageType(data[:n]), from)
+			}
+		}
+	})
+}
+
+// controlStatus describes the control socket and its client
+func controlStatus() string {
+	ctlLock.Lock()
+	defer ctlLock.Unlock()
+	if ctlConn == nil {
+		return ""
+	}
+	if ctlCli == nil {
+		return fmt.Sprintf("%v", ctlConn.LocalAddr())
+	}
+	return fmt.Sprintf("%v <= %v", ctlConn.LocalAddr(), ctlCli)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+
+	"docker-connector/pkg/connector"
+)
+
+// With `control-secret <secret>`, or `-control-secret`, the controls pushed
+// by the docker side, the routes and the domains, are only applied when
+// signed with the same secret given to the agent, see connector.SignControl,
+// so a host of the path or of the LAN can neither forge nor replay them.
+// Without a secret they are applied unsigned as before.
+var (
+	controlSecret = ""
+
+	controlVerifier connector.Verifier
+)
+
+// verifyControl returns the line of a pushed control, nil if not authentic
+func verifyControl(data []byte, from *net.UDPAddr) []byte {
+	if controlSecret == "" {
+		return data
+	}
+	line, err := controlVerifier.Verify(controlSecret, data)
+	if err != nil {
+		logControl.Warningf("[CONTROL] Control from %v rejected: %v", from, err)
+		return nil
+	}
+	return line
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// A docker side advertising the deltas gets versioned controls, the first
+// item of the payload telling
+//
+//	version <v>,<item>,...
+//	delta <base> <v>,+<item>,-<item>,=<item>,...
+//
+// the full state, or the changes from the state of version base, `=`
+// replacing the items of the same first word. The reloads and the changes of
+// client address only send the delta of the items, nothing when they are the
+// same, the removed `connect` rules being disconnected by the docker side. It
+// acknowledges each applied version, and asks a resync for a delta on another
+// base, e.g. once restarted, so the full state only goes to a docker side out
+// of step. A version not acknowledged within controlAckTimeout is sent again
+// in full, at most controlAckRetries times in a row. The versions start at
+// the clock of the start, so those of a restarted desktop are not mistaken
+// for the ones of the previous run.
+const (
+	featureDeltas     = connector.FeatureDeltas
+	controlsAck       = connector.ControlsAck
+	controlAckTimeout = 3 * time.Second
+	controlAckRetries = 3
+)
+
+// ControlsStatus describes the versions of the controls
+type ControlsStatus struct {
+	Version uint64 `json:"version"`
+	Acked   uint64 `json:"acked"`
+	Fulls   uint64 `json:"fulls"`
+	Deltas  uint64 `json:"deltas"`
+}
+
+type controlVersions struct {
+	sync.Mutex
+	version uint64
+	// items is the state of version, nil before the first full one
+	items []string
+	acked uint64
+	// pending counts the versions sent since the last acknowledgement
+	pending       int
+	fulls, deltas uint64
+}
+
+var ctlVersions = &controlVersions{version: uint64(time.Now().UnixNano())}
+
+// Next returns the payload of the controls items to a docker side taking
+// versions, the full state or the delta of the last one, nil without change
+func (v *controlVersions) Next(to *net.UDPAddr, items []string, full bool) []string {
+	v.Lock()
+	defer v.Unlock()
+	var payload []string
+	if full || v.items == nil {
+		v.version++
+		v.fulls++
+		payload = append([]string{fmt.Sprintf("version %d", v.version)}, items...)
+	} else {
+		ops := diffControls(v.items, items)
+		if len(ops) == 0 {
+			return nil
+		}
+		v.version++
+		v.deltas++
+		payload = append([]string{fmt.Sprintf("delta %d %d", v.version-1, v.version)}, ops...)
+	}
+	v.items = items
+	if v.pending++; v.pending <= controlAckRetries {
+		version := v.version
+		time.AfterFunc(controlAckTimeout, func() { v.check(to, version) })
+	}
+	return payload
+}
+
+// check sends the controls again in full when a version is still not
+// acknowledged
+func (v *controlVersions) check(to *net.UDPAddr, version uint64) {
+	v.Lock()
+	missing := v.version == version && v.acked != version
+	v.Unlock()
+	if missing && shared.Client() != nil {
+		logControl.Warningf("[CONTROL] Version %d not acknowledged by %v, sending the controls again", version, to)
+		resendControls(shared.Client())
+	}
+}
+
+// Ack records a version applied by the docker side
+func (v *controlVersions) Ack(data []byte, from *net.UDPAddr) {
+	if len(data) != 9 {
+		return
+	}
+	version := binary.BigEndian.Uint64(data[1:])
+	v.Lock()
+	defer v.Unlock()
+	if version == v.version {
+		v.acked, v.pending = version, 0
+		logControl.Debugf("[CONTROL] Version %d applied by %v", version, from)
+	}
+}
+
+// Status reports the versions, nil before the first versioned controls
+func (v *controlVersions) Status() *ControlsStatus {
+	v.Lock()
+	defer v.Unlock()
+	if v.fulls == 0 {
+		return nil
+	}
+	return &ControlsStatus{Version: v.version, Acked: v.acked, Fulls: v.fulls, Deltas: v.deltas}
+}
+
+// diffControls returns the operations turning the items old into next, the
+// items of a first word alone in both replaced, the others added or removed
+func diffControls(old, next []string) []string {
+	count := func(items []string) (map[string]int, map[string]bool) {
+		words, set := make(map[string]int), make(map[string]bool)
+		for _, item := range items {
+			words[strings.SplitN(item, " ", 2)[0]]++
+			set[item] = true
+		}
+		return words, set
+	}
+	oldWords, oldSet := count(old)
+	nextWords, nextSet := count(next)
+	var ops []string
+	for _, item := range old {
+		word := strings.SplitN(item, " ", 2)[0]
+		if !nextSet[item] && (oldWords[word] != 1 || nextWords[word] != 1) {
+			ops = append(ops, "-"+item)
+		}
+	}
+	for _, item := range next {
+		if oldSet[item] {
+			continue
+		}
+		if word := strings.SplitN(item, " ", 2)[0]; oldWords[word] == 1 && nextWords[word] == 1 {
+			ops = append(ops, "="+item)
+		} else {
+			ops = append(ops, "+"+item)
+		}
+	}
+	return ops
+}
+
+// takesDeltas tells whether the docker side takes versioned controls
+func takesDeltas() bool {
+	return atomic.LoadInt32(&peerFeatures)&featureDeltas != 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"docker-connector/pkg/connector"
+)
+
+// Some NAT and VPN middleboxes duplicate UDP datagrams, which would reach
+// the TUN twice. With `dedup` the datagrams of the tunneled packets are
+// framed with a sequence number
+//
+//	16 | seq(4) | datagram
+//
+// and the receiving side drops those already seen in a sliding window of
+// dedupWindow sequence numbers. The desktop offers `dedup` in the controls and
+// the docker side accepts with a feature bit of its heartbeats, then frames its
+// datagrams the same way. A sequence far behind the window is taken for a
+// restart of the peer. Unframing is always supported.
+const (
+	seqType      = connector.Sequenced
+	seqHeader    = 5
+	featureDedup = connector.FeatureDedup
+	dedupWindow  = 1024
+)
+
+var (
+	dedup = false
+	// seqOut is the sequence number of the last datagram sent
+	seqOut = rand.Uint32()
+)
+
+// seqWindow is the window of the sequence numbers received
+type seqWindow struct {
+	sync.Mutex
+	started    bool
+	top        uint32
+	seen       [dedupWindow / 64]uint64
+	duplicates uint64
+}
+
+var seqIn = &seqWindow{}
+
+// DedupStatus reports the suppression of the duplicated datagrams
+type DedupStatus struct {
+	Enabled    bool   `json:"enabled"`
+	Peer       bool   `json:"peer"`
+	Duplicates uint64 `json:"duplicates"`
+}
+
+func dedupStatus() *DedupStatus {
+	seqIn.Lock()
+	defer seqIn.Unlock()
+	if !dedup && seqIn.duplicates == 0 {
+		return nil
+	}
+	return &DedupStatus{
+		Enabled:    dedup,
+		Peer:       atomic.LoadInt32(&peerFeatures)&featureDedup != 0,
+		Duplicates: seqIn.duplicates,
+	}
+}
+
+// writeDatagram writes a datagram to the client, framed with its sequence
+// number if negotiated
+func writeDatagram(datagram []byte, addr *net.UDPAddr) error {
+	atomic.AddUint64(&dataWrites, 1)
+	if !dedup || atomic.LoadInt32(&peerFeatures)&featureDedup == 0 {
+		_, err := writer.WriteToUDP(datagram, addr)
+		return err
+	}
+	b := getBuffer(seqHeader + len(datagram))
+	defer putBuffer(b)
+	buf := *b
+	buf[0] = seqType
+	binary.BigEndian.PutUint32(buf[1:], atomic.AddUint32(&seqOut, 1))
+	copy(buf[seqHeader:], datagram)
+	_, err := writer.WriteToUDP(buf, addr)
+	return err
+}
+
+func (w *seqWindow) bit(seq uint32) (*uint64, uint64) {
+	i := seq % dedupWindow
+	return &w.seen[i/64], 1 << (i % 64)
+}
+
+// Accept tells whether a sequence number is new, recording it
+func (w *seqWindow) Accept(seq uint32) bool {
+	w.Lock()
+	defer w.Unlock()
+	ahead := int32(seq - w.top)
+	switch {
+	case !w.started || ahead <= -dedupWindow*4 || ahead >= dedupWindow:
+		// first datagram, restart of the peer or a jump, the window restarts
+		w.started, w.top = true, seq
+		w.seen = [dedupWindow / 64]uint64{}
+	case ahead > 0:
+		// clear the numbers the window slides over
+		for s := w.top + 1; s != seq; s++ {
+			word, mask := w.bit(s)
+			*word &^= mask
+		}
+		w.top = seq
+	case ahead <= -dedupWindow:
+		// too old to tell
+		return true
+	default:
+		if word, mask := w.bit(seq); *word&mask != 0 {
+			w.duplicates++
+			return false
+		}
+	}
+	word, mask := w.bit(seq)
+	*word |= mask
+	return true
+}
+
+// unframe returns the datagram of a framed one, nil for a duplicate
+func unframe(data []byte) []byte {
+	if len(data) <= seqHeader {
+		return nil
+	}
+	if !seqIn.Accept(binary.BigEndian.Uint32(data[1:])) {
+		return nil
+	}
+	return data[seqHeader:]
+}
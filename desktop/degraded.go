@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Without the privileges to create the TUN or give it its address, e.g. a
+// locked-down Mac where the service can't run as root, the connector starts
+// degraded rather than exiting: it goes on with the userspace stack, the UDP
+// listener, the controls, the expose listeners, the forwards and the SOCKS5
+// server running, without TUN nor routes. The reason is logged, kept in the
+// events and listed in `degraded` of `status`. `-soft-fail=false` exits as
+// before, and the other failures of the TUN stay fatal.
+var softFail = true
+
+// DegradedStatus describes why the connector runs without TUN
+type DegradedStatus struct {
+	Reason  string   `json:"reason"`
+	Since   string   `json:"since"`
+	Missing []string `json:"missing"`
+}
+
+var degraded *DegradedStatus
+
+// setupTUN creates the TUN, degrading to the userspace stack when lacking the
+// privileges
+func setupTUN(local, peer net.IP, subnet *net.IPNet) tunDevice {
+	if handedTUN != nil {
+		iface := handedTUN
+		handedTUN = nil
+		logger.Infof("interface => %s, taken over\n", iface.Name())
+		return iface
+	}
+	iface, err := setup(local, peer, subnet)
+	if err == nil {
+		return iface
+	}
+	if !softFail || !permissionError(err) {
+		logger.Fatal(err)
+	}
+	bind, stack = false, stackUserspace
+	degraded = &DegradedStatus{Reason: err.Error(), Since: time.Now().Format(time.RFC3339), Missing: []string{"tun", "routes"}}
+	logger.Warningf("[DEGRADED] No privileges for the TUN, running without TUN nor routes on the userspace stack: %v", err)
+	return nil
+}
+
+// permissionError tells whether an error comes from missing privileges
+func permissionError(err error) bool {
+	if errors.Is(err, os.ErrPermission) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"permission denied", "operation not permitted", "access is denied", "not privileged"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// Diagnostic commands are sent to the docker side as `4 | command`, results
+// come back in chunks of `3 | kind | index(2) | count(2) | data`.
+const (
+	diagCommand = connector.DiagCommand
+	diagResult  = connector.DiagResult
+	diagText    = 1
+	diagPcap    = 2
+)
+
+type diagCollector struct {
+	sync.Mutex
+	kind    byte
+	chunks  [][]byte
+	missing int
+	last    string
+	capture string
+}
+
+var diag = &diagCollector{}
+
+// sendDiag asks the docker side to run a diagnostic command, such as
+// `loglevel debug` or `capture 10 1000`
+func sendDiag(cmd string) error {
+	cli := shared.Client()
+	if cli == nil || conn == nil {
+		return fmt.Errorf("no client connected")
+	}
+	ctl, to := controlTarget(cli)
+	logControl.Infof("[DIAG] Sending diag command to %v => %s", to, cmd)
+	_, err := ctl.WriteToUDP(append([]byte{diagCommand}, cmd...), to)
+	return err
+}
+
+// Add collects a result chunk from the docker side
+func (d *diagCollector) Add(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	kind := data[1]
+	index := int(binary.BigEndian.Uint16(data[2:]))
+	count := int(binary.BigEndian.Uint16(data[4:]))
+	if count == 0 || index >= count {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if index == 0 || d.chunks == nil || len(d.chunks) != count || d.kind != kind {
+		if d.missing > 0 {
+			logControl.Warningf("[DIAG] Incomplete result discarded, %d chunks missing", d.missing)
+		}
+		d.kind = kind
+		d.chunks = make([][]byte, count)
+		d.missing = count
+	}
+	if d.chunks[index] == nil {
+		d.chunks[index] = append([]byte(nil), data[6:]...)
+		d.missing--
+	}
+	if d.missing > 0 {
+		return
+	}
+	var total []byte
+	for _, chunk := range d.chunks {
+		total = append(total, chunk...)
+	}
+	d.chunks = nil
+	switch kind {
+	case diagText:
+		d.last = string(total)
+		logControl.Infof("[DIAG] Docker side => %s", d.last)
+	case diagPcap:
+		name := filepath.Join(os.TempDir(), fmt.Sprintf("docker-capture-%s.pcap", time.Now().Format("20060102-150405")))
+		if err := ioutil.WriteFile(name, total, 0644); err != nil {
+			logControl.Warningf("[DIAG] Failed to save capture: %v", err)
+			return
+		}
+		d.capture = name
+		logControl.Infof("[DIAG] Docker side capture saved => %s (%d bytes)", name, len(total))
+	}
+}
+
+// DiagStatus is the latest diagnostic result received from the docker side
+type DiagStatus struct {
+	Last    string `json:"last,omitempty"`
+	Capture string `json:"capture,omitempty"`
+}
+
+func (d *diagCollector) Status() *DiagStatus {
+	d.Lock()
+	defer d.Unlock()
+	if d.last == "" && d.capture == "" {
+		return nil
+	}
+	return &DiagStatus{Last: d.last, Capture: d.capture}
+}
+
+func runDiag() {
+	cmd := strings.Join(os.Args[2:], " ")
+	body, err := adminPost("/diag", cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send diag => %v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dns server of the docker side, the one answering the `hosts` entries
+// and the split DNS domains, resolves a name through the tunnel, from the
+// entries pushed by the desktop, or forwards it to its system resolver.
+// `dns log on` has it report each query, the path taken, the answer and the
+// latency, logged here and listed by `docker-connector dns`. `dns route
+// <pattern> tunnel|system` overrides the path of the names of a pattern,
+// `*.<domain>` for the names under the domain or a name, the longest pattern
+// winning:
+//
+//	dns log on
+//	dns route *.internal tunnel
+//	dns route api.corp.example system
+//
+// tunnel answers from the entries only, a name without one being NXDOMAIN
+// instead of leaking to the system resolver, and resolves the domain
+// system-wide through the tunnel like `resolver`. system asks the system
+// resolver even when an entry, e.g. a wildcard, would answer.
+const dnsQueriesMax = 200
+
+type dnsRoute struct {
+	pattern, path string
+}
+
+// DNSQuery is a query reported by the docker side
+type DNSQuery struct {
+	Time    string `json:"time"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	Answer  string `json:"answer"`
+	Latency string `json:"latency"`
+}
+
+type dnsQueryLog struct {
+	sync.Mutex
+	queries []DNSQuery
+}
+
+var (
+	// dnsLog asks the docker side for the queries
+	dnsLog     bool
+	dnsRoutes  []dnsRoute
+	dnsQueries = &dnsQueryLog{}
+)
+
+// parseDNS parses the value of `dns`, log setting on or off and route adding
+// to routes
+func parseDNS(val string, log *bool, routes *[]dnsRoute) error {
+	vals := strings.Fields(val)
+	switch {
+	case len(vals) == 2 && vals[0] == "log" && (vals[1] == "on" || vals[1] == "off"):
+		*log = vals[1] == "on"
+	case len(vals) == 3 && vals[0] == "route":
+		pattern := strings.Trim(strings.ToLower(vals[1]), ".")
+		if !domainName.MatchString(strings.TrimPrefix(pattern, "*.")) {
+			return fmt.Errorf("invalid pattern %s", vals[1])
+		}
+		if vals[2] != "tunnel" && vals[2] != "system" {
+			return fmt.Errorf("expected tunnel or system, got %s", vals[2])
+		}
+		*routes = append(*routes, dnsRoute{pattern: pattern, path: vals[2]})
+	default:
+		return fmt.Errorf("expected log on|off or route <pattern> tunnel|system")
+	}
+	return nil
+}
+
+// tunnelResolvers adds the domains of the tunnel routes to the configured
+// ones, resolved by the docker side
+func tunnelResolvers(resolvers map[string]string, routes []dnsRoute) {
+	for _, r := range routes {
+		domain := strings.TrimPrefix(r.pattern, "*.")
+		if _, ok := resolvers[domain]; !ok && r.path == "tunnel" {
+			resolvers[domain] = ""
+		}
+	}
+}
+
+// dnsControls returns the dns controls of the docker side
+func dnsControls() string {
+	var buf strings.Builder
+	if dnsLog {
+		buf.WriteString(",dns-log")
+	}
+	for _, r := range dnsRoutes {
+		buf.WriteString(",dns-route " + r.pattern + " " + r.path)
+	}
+	return buf.String()
+}
+
+// pushedDNSLog handles a query reported by the docker side, it returns false
+// for the other lines
+func pushedDNSLog(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[0] != "dnslog" {
+		return false
+	}
+	if !dnsLog {
+		return true
+	}
+	q := DNSQuery{
+		Time:    time.Now().Format(time.RFC3339),
+		Name:    fields[1],
+		Type:    fields[2],
+		Path:    fields[3],
+		Latency: fields[4],
+		Answer:  strings.Join(fields[5:], " "),
+	}
+	logDNS.Infof("[DNS LOG] %s %s via %s => %s in %s", q.Name, q.Type, q.Path, q.Answer, q.Latency)
+	dnsQueries.Add(q)
+	return true
+}
+
+func (l *dnsQueryLog) Add(q DNSQuery) {
+	l.Lock()
+	defer l.Unlock()
+	l.queries = append(l.queries, q)
+	if len(l.queries) > dnsQueriesMax {
+		l.queries = l.queries[len(l.queries)-dnsQueriesMax:]
+	}
+}
+
+// List returns the last queries, the oldest first
+func (l *dnsQueryLog) List() []DNSQuery {
+	l.Lock()
+	defer l.Unlock()
+	return append([]DNSQuery{}, l.queries...)
+}
+
+func serveDNS(w http.ResponseWriter, r *http.Request) {
+	if !dnsLog {
+		http.Error(w, "dns log is off", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, dnsQueries.List())
+}
+
+// runDNS implements `dns`, printing the last queries
+func runDNS() {
+	fs := flag.NewFlagSet("dns", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	body, err := adminGet("/dns")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var queries []DNSQuery
+	if err := json.Unmarshal(body, &queries); err != nil {
+		os.Stdout.Write(body)
+		os.Exit(1)
+	}
+	fmt.Printf("%-25s %-5s %-6s %10s %s\n", "TIME", "TYPE", "PATH", "LATENCY", "NAME => ANSWER")
+	for _, q := range queries {
+		fmt.Printf("%-25s %-5s %-6s %10s %s => %s\n", q.Time, q.Type, q.Path, q.Latency, q.Name, q.Answer)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// At boot the connector may start before Docker Desktop, installing routes
+// towards a VM which isn't there yet. With `-wait-docker 2m` it first waits,
+// with backoff and at most that long, for the engine to answer `/_ping` on
+// DOCKER_HOST, /var/run/docker.sock or the socket of Docker Desktop in the
+// home, else `docker version` for the named pipe of Windows, before loading
+// the config, installing the routes and reusing the saved peer. Past the
+// timeout it goes on with a warning. The engine is then checked every
+// dockerCheckPeriod, and once back after a restart the config is applied
+// again and the controls resent, the routes and the rules of the docker side
+// following the new VM. The state is listed in `docker` of `status`.
+const (
+	dockerCheckPeriod = 15 * time.Second
+	dockerBackoffMax  = 10 * time.Second
+	dockerPingTimeout = 3 * time.Second
+)
+
+var waitDocker time.Duration
+
+// DockerStatus describes the readiness of the docker engine
+type DockerStatus struct {
+	Ready    bool   `json:"ready"`
+	Endpoint string `json:"endpoint"`
+	Since    string `json:"since,omitempty"`
+	Restarts uint64 `json:"restarts"`
+	Error    string `json:"error,omitempty"`
+}
+
+type dockerState struct {
+	sync.Mutex
+	checked  bool
+	ready    bool
+	since    time.Time
+	restarts uint64
+	err      string
+}
+
+var docker = &dockerState{}
+
+// dockerEndpoint returns the address of the engine, a unix socket, a tcp
+// address or "" for the CLI
+func dockerEndpoint() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		if strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "tcp://") {
+			return host
+		}
+		return ""
+	}
+	paths := []string{"/var/run/docker.sock"}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".docker", "run", "docker.sock"))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return "unix://" + path
+		}
+	}
+	return ""
+}
+
+// pingDocker asks the engine whether it runs
+func pingDocker(endpoint string) error {
+	if endpoint == "" {
+		_, err := cliOutput("docker", "version", "--format", "{{.Server.Version}}")
+		return err
+	}
+	resp, err := dockerClient(endpoint).Get("http://docker/_ping")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping answered %s", resp.Status)
+	}
+	return nil
+}
+
+// dockerClient returns a client of the API of the engine at an endpoint of
+// dockerEndpoint, the host of the URLs ignored
+func dockerClient(endpoint string) *http.Client {
+	network, address := "tcp", strings.TrimPrefix(endpoint, "tcp://")
+	if strings.HasPrefix(endpoint, "unix://") {
+		network, address = "unix", strings.TrimPrefix(endpoint, "unix://")
+	}
+	return &http.Client{
+		Timeout: dockerPingTimeout,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}},
+	}
+}
+
+// check pings the engine and records the state, telling whether it came
+// back after being down
+func (d *dockerState) check() (ready, back bool) {
+	err := pingDocker(dockerEndpoint())
+	d.Lock()
+	defer d.Unlock()
+	ready = err == nil
+	back = ready && d.checked && !d.ready
+	if ready != d.ready || !d.checked {
+		d.since = time.Now()
+	}
+	if back {
+		d.restarts++
+	}
+	d.checked, d.ready, d.err = true, ready, ""
+	if err != nil {
+		d.err = err.Error()
+	}
+	return ready, back
+}
+
+// waitForDocker waits for the engine up to `-wait-docker`, false when
+// stopped meanwhile
+func waitForDocker(ctx context.Context) bool {
+	if waitDocker <= 0 {
+		return true
+	}
+	start := time.Now()
+	backoff := time.Second
+	for i := 0; ; i++ {
+		if ready, _ := docker.check(); ready {
+			if i > 0 {
+				logger.Infof("[DOCKER] Engine ready after %v", time.Since(start).Round(time.Second))
+			}
+			return true
+		}
+		if i == 0 {
+			logger.Warningf("[DOCKER] Engine not ready at %s, waiting up to %v", docker.Status().Endpoint, waitDocker)
+		}
+		left := waitDocker - time.Since(start)
+		if left <= 0 {
+			logger.Warningf("[DOCKER] Engine still not ready after %v, going on: %s", waitDocker, docker.Status().Error)
+			return true
+		}
+		if backoff > left {
+			backoff = left
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > dockerBackoffMax {
+			backoff = dockerBackoffMax
+		}
+	}
+}
+
+// watchDocker applies the config and the controls again once the engine is
+// back after a restart
+func (c *Connector) watchDocker() {
+	if waitDocker <= 0 {
+		return
+	}
+	ticker := time.NewTicker(dockerCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			was := docker.Status().Ready
+			ready, back := docker.check()
+			switch {
+			case back:
+				logger.Infof("[DOCKER] Engine back, applying the config and the controls again")
+				events.Add("docker", "engine back")
+				if reloadConfig != nil {
+					reloadConfig()
+				} else if tunIfName != "" {
+					verifyRoutes(tunIfName)
+				}
+				if cli := shared.Client(); cli != nil {
+					resendControls(cli)
+				}
+			case was && !ready:
+				logger.Warningf("[DOCKER] Engine down: %s", docker.Status().Error)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Status reports the engine, the endpoint known before the first check
+func (d *dockerState) Status() *DockerStatus {
+	st := &DockerStatus{Endpoint: dockerEndpoint()}
+	if st.Endpoint == "" {
+		st.Endpoint = "docker cli"
+	}
+	d.Lock()
+	defer d.Unlock()
+	st.Ready, st.Restarts, st.Error = d.ready, d.restarts, d.err
+	if d.checked {
+		st.Since = d.since.Format(time.RFC3339)
+	}
+	return st
+}
+
+// dockerStatus reports the engine, nil without `-wait-docker`
+func dockerStatus() *DockerStatus {
+	if waitDocker <= 0 {
+		return nil
+	}
+	return docker.Status()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// `doctor` checks whether the tunnel actually works, asking the running
+// service through `/doctor` of the admin API: the TUN was created, the UDP
+// socket is bound and the docker side heard from, the routes are installed,
+// the docker side answers a ping through the tunnel and the MTU fits. Without
+// the service it checks what it can by itself. Each failure comes with a
+// hint to fix it.
+const (
+	doctorPass = "pass"
+	doctorFail = "fail"
+	doctorWarn = "warn"
+	doctorSkip = "skip"
+	// tunnelOverhead is the IP and UDP headers and the type byte around a
+	// tunneled packet
+	tunnelOverhead = 20 + 8 + 1
+)
+
+// DoctorCheck is the outcome of a check of `doctor`
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// runDoctor runs the checks in the service
+func runDoctor(c *Connector) []DoctorCheck {
+	var checks []DoctorCheck
+	ifname := ""
+	if c != nil && c.iface != nil {
+		ifname = c.iface.Name()
+	}
+	switch {
+	case !bind:
+		checks = append(checks, DoctorCheck{Name: "tun", Result: doctorSkip, Detail: "not bound to an interface (-bind=false)"})
+	case ifname == "":
+		checks = append(checks, DoctorCheck{Name: "tun", Result: doctorFail, Detail: "no interface",
+			Hint: "run the connector as root (sudo) or administrator, on windows install the wintun or TAP-Windows driver"})
+	default:
+		checks = append(checks, DoctorCheck{Name: "tun", Result: doctorPass, Detail: ifname})
+	}
+	checks = append(checks, doctorPeer())
+	checks = append(checks, doctorRoutes(ifname))
+	checks = append(checks, doctorPing())
+	checks = append(checks, doctorMTU(ifname))
+	return checks
+}
+
+func doctorPeer() DoctorCheck {
+	check := DoctorCheck{Name: "peer"}
+	if conn == nil {
+		check.Result, check.Detail = doctorFail, fmt.Sprintf("udp %s:%d not bound", host, port)
+		check.Hint = "another process may hold the port, change `port` on both sides"
+		return check
+	}
+	seen := atomic.LoadInt64(&lastSeen)
+	client := shared.Client()
+	if client == nil || seen == 0 {
+		check.Result, check.Detail = doctorFail, fmt.Sprintf("nothing received on %v", conn.LocalAddr())
+		check.Hint = fmt.Sprintf("start the docker side with `-port %d`, and `host 0.0.0.0` if it connects from another machine", port)
+		if st := paths.Status(); st != nil && len(st.Hints) > 0 {
+			check.Hint = strings.Join(st.Hints, "; ")
+		}
+		return check
+	}
+	silent := time.Since(time.Unix(0, seen))
+	check.Detail = fmt.Sprintf("%v on %v, last seen %v ago", client, conn.LocalAddr(), silent.Round(time.Second))
+	check.Result = doctorPass
+	if limit := time.Duration(heartbeat*deadAfter) * time.Millisecond; limit > 0 && silent > limit {
+		check.Result = doctorFail
+		check.Hint = "the docker side stopped or its packets are dropped, check `docker logs desktop-connector`"
+	}
+	return check
+}
+
+func doctorRoutes(ifname string) DoctorCheck {
+	check := DoctorCheck{Name: "routes"}
+	routes := shared.Routes()
+	if len(routes) == 0 {
+		check.Result, check.Detail = doctorWarn, "no route configured"
+		check.Hint = "add `route <subnet of a docker network>` to the config, see `docker network inspect`"
+		return check
+	}
+	if !bind || ifname == "" {
+		check.Result, check.Detail = doctorSkip, "no interface"
+		return check
+	}
+	installed := make(map[string]bool)
+	for _, r := range systemRoutes() {
+		if ownRoute(r, ifname) {
+			installed[r.net.String()] = true
+		}
+	}
+	var missing []string
+	for key := range routes {
+		if _, ipnet, err := net.ParseCIDR(key); err == nil && !installed[ipnet.String()] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		check.Result, check.Detail = doctorFail, "missing "+strings.Join(missing, ", ")
+		check.Hint = "a VPN or network change may have removed them, the health check installs them again within 30s, see `route_repairs` of `status`"
+		return check
+	}
+	check.Result, check.Detail = doctorPass, fmt.Sprintf("%d routes via %s", len(routes), ifname)
+	return check
+}
+
+func doctorPing() DoctorCheck {
+	check := DoctorCheck{Name: "ping"}
+	if peer == nil || shared.Client() == nil {
+		check.Result, check.Detail = doctorSkip, "no docker side"
+		return check
+	}
+	if err := pingPeer(peer); err != nil {
+		check.Result, check.Detail = doctorFail, fmt.Sprintf("%v: %v", peer, err)
+		check.Hint = "the tunnel doesn't carry packets, check `addr` is the same on both sides and the firewall of the host"
+		return check
+	}
+	check.Result, check.Detail = doctorPass, peer.String()
+	return check
+}
+
+func doctorMTU(ifname string) DoctorCheck {
+	check := DoctorCheck{Name: "mtu"}
+	if ifname != "" {
+		if ifi, err := net.InterfaceByName(ifname); err == nil && ifi.MTU != MTU {
+			check.Result, check.Detail = doctorWarn, fmt.Sprintf("%s has mtu %d, configured %d", ifname, ifi.MTU, MTU)
+			check.Hint = "set it again with `mtu` in the config"
+			return check
+		}
+	}
+	outer := outerMTU()
+	if outer == 0 {
+		check.Result, check.Detail = doctorSkip, "no docker side"
+		return check
+	}
+	if MTU+tunnelOverhead > outer && fragSize == 0 {
+		check.Result = doctorWarn
+		check.Detail = fmt.Sprintf("mtu %d with the tunnel headers exceeds %d of the path to the docker side", MTU, outer)
+		check.Hint = fmt.Sprintf("set `mtu %d`, or `-fragment %d`", outer-tunnelOverhead, outer-tunnelOverhead)
+		return check
+	}
+	check.Result, check.Detail = doctorPass, fmt.Sprintf("mtu %d, path %d", MTU, outer)
+	return check
+}
+
+// outerMTU returns the MTU of the interface towards the docker side
+func outerMTU() int {
+	client := shared.Client()
+	if client == nil {
+		return 0
+	}
+	c, err := net.DialUDP("udp", nil, client)
+	if err != nil {
+		return 0
+	}
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return ifi.MTU
+			}
+		}
+	}
+	return 0
+}
+
+// doctorLocal checks what it can without the service
+func doctorLocal(err error) []DoctorCheck {
+	checks := []DoctorCheck{{Name: "service", Result: doctorFail,
+		Detail: fmt.Sprintf("admin api %s: %v", adminAddr, err),
+		Hint:   "start it with `docker-connector start`, or pass its `-admin` address"}}
+	if uid := os.Geteuid(); uid < 0 {
+		checks = append(checks, DoctorCheck{Name: "tun", Result: doctorSkip, Detail: "run as administrator to create the interface"})
+	} else if uid != 0 {
+		checks = append(checks, DoctorCheck{Name: "tun", Result: doctorFail, Detail: "not root",
+			Hint: "creating the interface needs root, run with sudo or install the service"})
+	} else {
+		checks = append(checks, DoctorCheck{Name: "tun", Result: doctorPass, Detail: "root"})
+	}
+	listen := fmt.Sprintf("%s:%d", host, port)
+	if udpAddr, err := net.ResolveUDPAddr("udp", listen); err == nil {
+		if c, err := net.ListenUDP("udp", udpAddr); err != nil {
+			checks = append(checks, DoctorCheck{Name: "port", Result: doctorFail, Detail: fmt.Sprintf("%s: %v", listen, err),
+				Hint: "a stale connector or another tool holds the port, stop it or change `port` on both sides"})
+		} else {
+			c.Close()
+			checks = append(checks, DoctorCheck{Name: "port", Result: doctorPass, Detail: listen + " free"})
+		}
+	}
+	return checks
+}
+
+// runDoctorCommand implements `doctor`, exiting 1 when a check fails
+func runDoctorCommand() {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.StringVar(&host, "host", host, "udp listen host")
+	fs.IntVar(&port, "port", port, "udp listen port")
+	asJSON := fs.Bool("json", false, "print the checks as JSON")
+	fs.Parse(os.Args[2:])
+	var checks []DoctorCheck
+	body, err := adminGet("/doctor")
+	if err == nil {
+		err = json.Unmarshal(body, &checks)
+	}
+	if err != nil {
+		checks = doctorLocal(err)
+	}
+	failed := false
+	for _, check := range checks {
+		failed = failed || check.Result == doctorFail
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(checks, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, check := range checks {
+			fmt.Printf("[%s] %-8s %s\n", strings.ToUpper(check.Result), check.Name, check.Detail)
+			if check.Hint != "" {
+				fmt.Printf("       hint => %s\n", check.Hint)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
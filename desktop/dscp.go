@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// `dscp` marks the datagrams of the tunnel socket so the QoS policies of home
+// and office networks can prioritize or deprioritize the tunnel:
+//
+//	dscp ef
+//	dscp af41
+//	dscp cs1
+//	dscp 10
+//	dscp inherit
+//
+// `inherit` copies the DSCP of each tunneled IPv4 packet to its datagram,
+// changing the mark of the socket when the class changes, so with batched
+// I/O a change may apply to the datagrams of the batch queued before it. The
+// control socket keeps CS6.
+var dscpSpec = ""
+
+var (
+	// dscpInherit is set with `dscp inherit`
+	dscpInherit int32
+	// dscpTOS is the type of service of the tunnel socket, -1 unmarked
+	dscpTOS int32 = -1
+)
+
+// parseDSCP parses a DSCP value, a number from 0 to 63 or a class name as ef,
+// af11 to af43, cs0 to cs7 or le
+func parseDSCP(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case s == "ef":
+		return 46, nil
+	case s == "le":
+		return 1, nil
+	case len(s) == 3 && strings.HasPrefix(s, "cs") && s[2] >= '0' && s[2] <= '7':
+		return int(s[2]-'0') * 8, nil
+	case len(s) == 4 && strings.HasPrefix(s, "af") && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return int(s[2]-'0')*8 + int(s[3]-'0')*2, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("invalid dscp %q", s)
+	}
+	return v, nil
+}
+
+// setDSCP applies `dscp` to the tunnel socket
+func setDSCP(spec string) {
+	tos := -1
+	inherit := int32(0)
+	switch spec {
+	case "", "off":
+	case "inherit":
+		inherit = 1
+	default:
+		v, err := parseDSCP(spec)
+		if err != nil {
+			logTransport.Warningf("[DSCP] %v", err)
+			return
+		}
+		tos = v << 2
+	}
+	if atomic.SwapInt32(&dscpInherit, inherit) != inherit && inherit == 1 {
+		logTransport.Infof("[DSCP] Tunnel datagrams inherit the DSCP of the packets")
+	}
+	if inherit == 1 {
+		return
+	}
+	current := atomic.LoadInt32(&dscpTOS)
+	if tos < 0 && current < 0 || int32(tos) == current {
+		return
+	}
+	if tos < 0 {
+		// back to unmarked
+		tos = 0
+	}
+	if conn != nil {
+		markSocket(conn, tos)
+		logTransport.Infof("[DSCP] Tunnel datagrams marked with DSCP %d", tos>>2)
+	}
+}
+
+// markSocket sets the type of service of the tunnel socket
+func markSocket(c *net.UDPConn, tos int) {
+	if err := setTOS(c, tos); err != nil {
+		logTransport.Warningf("[DSCP] Failed to mark %v: %v", c.LocalAddr(), err)
+		return
+	}
+	atomic.StoreInt32(&dscpTOS, int32(tos))
+}
+
+// inheritDSCP marks the tunnel socket with the DSCP of an IPv4 packet about
+// to be sent, with `dscp inherit`
+func inheritDSCP(packet []byte) {
+	if atomic.LoadInt32(&dscpInherit) == 0 || len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	tos := int32(packet[1] &^ 3)
+	if atomic.LoadInt32(&dscpTOS) == tos || conn == nil {
+		return
+	}
+	markSocket(conn, int(tos))
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"docker-connector/pkg/connector"
+)
+
+// With `encap vxlan|gre` the desktop carries the packets of the TUN in a
+// standard encapsulation on `port` instead of the protocol of the agent, so
+// the docker side may be stock Linux tooling or hardware speaking it:
+//
+//	encap vxlan [id <vni>] [remote <host[:port]>]
+//	encap gre [id <key>] [remote <host[:port]>]
+//
+// vxlan is RFC 7348, the packets in ethernet frames between the MAC of the
+// gateway of `tap` and the learned one of the docker side, whose ARP requests
+// are answered with it for any address but its own. gre is GRE-in-UDP, RFC
+// 8086, the packets right after the GRE header, with the key of id if any.
+// The packets go to remote, else to the address of the last received one, on
+// `port` unless given since the stock devices listen on the port they send
+// to. The TUN, the routes, the hosts and the middlewares of the desktop keep
+// working, the controls, the pushed routes and the expose sessions need the
+// agent.
+const (
+	encapVXLAN  = "vxlan"
+	encapGRE    = "gre"
+	vxlanHeader = 8
+	greHeader   = 4
+)
+
+var (
+	encapMode   = ""
+	encapID     = 0
+	encapRemote = ""
+)
+
+// EncapStatus describes the standard encapsulation of the data plane
+type EncapStatus struct {
+	Mode      string `json:"mode"`
+	ID        int    `json:"id,omitempty"`
+	Listen    int    `json:"listen"`
+	Remote    string `json:"remote,omitempty"`
+	PeerMAC   string `json:"peer_mac,omitempty"`
+	TxPackets uint64 `json:"tx_packets"`
+	RxPackets uint64 `json:"rx_packets"`
+	Invalid   uint64 `json:"invalid"`
+	ARPs      uint64 `json:"arp_replies,omitempty"`
+}
+
+type encapTunnel struct {
+	sync.Mutex
+	conn  *net.UDPConn
+	iface tunDevice
+	// remote is where the packets go, nil until configured or learned
+	remote *net.UDPAddr
+	// fixed is set when remote comes from the config
+	fixed   bool
+	peerMAC net.HardwareAddr
+	// arped is set once the MAC of the docker side was asked
+	arped                    bool
+	tx, rx, invalid, replies uint64
+}
+
+var (
+	encap        *encapTunnel
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// parseEncap parses the value of `encap`
+func parseEncap(val string) (mode string, id int, remote string, err error) {
+	vals := strings.Fields(val)
+	if len(vals) == 0 || vals[0] != encapVXLAN && vals[0] != encapGRE {
+		return "", 0, "", fmt.Errorf("expected vxlan or gre")
+	}
+	mode = vals[0]
+	if mode == encapVXLAN {
+		id = 1
+	}
+	for i := 1; i < len(vals); i += 2 {
+		if i+1 >= len(vals) {
+			return "", 0, "", fmt.Errorf("missing value of %s", vals[i])
+		}
+		switch vals[i] {
+		case "id":
+			v, err := strconv.Atoi(vals[i+1])
+			if err != nil || v < 0 || mode == encapVXLAN && v >= 1<<24 {
+				return "", 0, "", fmt.Errorf("invalid id %s", vals[i+1])
+			}
+			id = v
+		case "remote":
+			remote = vals[i+1]
+		default:
+			return "", 0, "", fmt.Errorf("unknown option %s", vals[i])
+		}
+	}
+	return mode, id, remote, nil
+}
+
+// encapAddr resolves the remote of the config, on port without one
+func encapAddr(remote string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(remote); err != nil {
+		remote = net.JoinHostPort(remote, strconv.Itoa(port))
+	}
+	return net.ResolveUDPAddr("udp4", remote)
+}
+
+// runEncap runs the tunnel in the standard encapsulation until stopped
+func (c *Connector) runEncap(iface tunDevice) {
+	if iface == nil {
+		logger.Fatalf("[ENCAP] The encapsulation needs the TUN, drop -bind=false")
+	}
+	t := &encapTunnel{iface: iface}
+	if encapRemote != "" {
+		addr, err := encapAddr(encapRemote)
+		if err != nil {
+			logger.Fatalf("[ENCAP] Invalid remote %s: %v", encapRemote, err)
+		}
+		t.remote, t.fixed = addr, true
+	}
+	var err error
+	if conn, port, err = listenTunnel(c.ctx, host, port); err != nil {
+		if c.ctx.Err() != nil {
+			return
+		}
+		logger.Fatalf("failed to listen %s:%d => %s", host, port, err.Error())
+	}
+	t.conn = conn
+	encap = t
+	logTransport.Infof("[ENCAP] Carrying the packets in %s (id %d) on %v, remote %s", encapMode, encapID, conn.LocalAddr(), t.remoteName())
+	writePidFile()
+	defer removePidFile()
+	startAdmin(c)
+	go c.watchStatusFile()
+	unreachableTUN = iface
+	buildChains(t.send, func(p []byte) { writeTUN(iface, p) })
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		t.readTUN(c, iface)
+	}()
+	sdNotify("READY=1")
+	b := getBuffer(bufferSize())
+	defer putBuffer(b)
+	buf := *b
+	supervise(c.ctx, "ENCAP->TUN", func() {
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if c.ctx.Err() != nil {
+					return
+				}
+				logTransport.Warningf("[ENCAP] Read error: %v", err)
+				continue
+			}
+			t.receive(buf[:n], from)
+		}
+	})
+}
+
+// readTUN sends the packets of the TUN through the outbound chain
+func (t *encapTunnel) readTUN(c *Connector, iface tunDevice) {
+	b := getBuffer(bufferSize())
+	defer putBuffer(b)
+	buf := *b
+	supervise(c.ctx, "TUN->ENCAP", func() {
+		for {
+			n, err := iface.Read(buf)
+			if err != nil {
+				if c.ctx.Err() != nil {
+					return
+				}
+				logger.Warningf("tap read error: %v\n", err)
+				continue
+			}
+			if n < 20 || buf[0]>>4 != 4 || handleLoopback(iface, buf[:n]) {
+				continue
+			}
+			if packet, drop := outboundChain.Run(buf[:n], connector.Outbound); !drop {
+				t.send(packet)
+			}
+		}
+	})
+}
+
+func (t *encapTunnel) remoteName() string {
+	t.Lock()
+	defer t.Unlock()
+	if t.remote == nil {
+		return "learned"
+	}
+	return t.remote.String()
+}
+
+// send encapsulates a packet to the docker side
+func (t *encapTunnel) send(packet []byte) {
+	t.Lock()
+	to, dst := t.remote, t.peerMAC
+	ask := encapMode == encapVXLAN && dst == nil && to != nil && !t.arped
+	t.arped = t.arped || ask
+	t.Unlock()
+	if to == nil {
+		peerStats.Drop("no_client")
+		sendUnreachable(packet, icmpHostUnreach)
+		return
+	}
+	if ask {
+		t.askPeerMAC(to)
+	}
+	b := getBuffer(len(packet) + vxlanHeader + etherHeader)
+	defer putBuffer(b)
+	out := *b
+	switch encapMode {
+	case encapVXLAN:
+		if dst == nil {
+			dst = broadcastMAC
+		}
+		out = vxlanFrame(out, dst, etherIPv4, packet)
+	default:
+		out = greFrame(out, packet)
+	}
+	if _, err := t.conn.WriteToUDP(out, to); err != nil {
+		logTransport.Warningf("[ENCAP] Write error to %v: %v", to, err)
+		peerStats.Drop("udp_error")
+		return
+	}
+	atomic.AddUint64(&t.tx, 1)
+}
+
+// vxlanFrame writes the VXLAN header and an ethernet frame of the payload
+func vxlanFrame(out []byte, dst net.HardwareAddr, etherType uint16, payload []byte) []byte {
+	out = out[:vxlanHeader+etherHeader+len(payload)]
+	binary.BigEndian.PutUint32(out, 0x08000000)
+	binary.BigEndian.PutUint32(out[4:], uint32(encapID)<<8)
+	copy(out[8:], dst)
+	copy(out[14:], gatewayMAC)
+	binary.BigEndian.PutUint16(out[20:], etherType)
+	copy(out[vxlanHeader+etherHeader:], payload)
+	return out
+}
+
+// greFrame writes the GRE header, with the key of id if any, and the packet
+func greFrame(out, packet []byte) []byte {
+	h := greHeader
+	if encapID > 0 {
+		h += 4
+	}
+	out = out[:h+len(packet)]
+	binary.BigEndian.PutUint16(out, 0)
+	binary.BigEndian.PutUint16(out[2:], etherIPv4)
+	if encapID > 0 {
+		out[0] = 0x20
+		binary.BigEndian.PutUint32(out[4:], uint32(encapID))
+	}
+	copy(out[h:], packet)
+	return out
+}
+
+// receive decapsulates a datagram of the docker side to the inbound chain
+func (t *encapTunnel) receive(data []byte, from *net.UDPAddr) {
+	var packet []byte
+	if encapMode == encapVXLAN {
+		packet = t.fromVXLAN(data, from)
+	} else {
+		packet = fromGRE(data)
+	}
+	if packet == nil {
+		if encapMode == encapGRE {
+			atomic.AddUint64(&t.invalid, 1)
+		}
+		return
+	}
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		atomic.AddUint64(&t.invalid, 1)
+		return
+	}
+	t.Lock()
+	if !t.fixed && (t.remote == nil || !t.remote.IP.Equal(from.IP)) {
+		t.remote, t.arped = &net.UDPAddr{IP: from.IP, Port: port}, false
+		logTransport.Infof("[ENCAP] Remote => %v", t.remote)
+	}
+	t.Unlock()
+	atomic.AddUint64(&t.rx, 1)
+	if deliverProbe(packet) {
+		return
+	}
+	if p, drop := inboundChain.Run(packet, connector.Inbound); !drop {
+		writeTUN(t.iface, p)
+	}
+}
+
+// fromVXLAN returns the IP packet of a VXLAN frame, learning the MAC of the
+// docker side and answering its ARP requests
+func (t *encapTunnel) fromVXLAN(data []byte, from *net.UDPAddr) []byte {
+	if len(data) < vxlanHeader+etherHeader || data[0]&0x08 == 0 || int(binary.BigEndian.Uint32(data[4:])>>8) != encapID {
+		atomic.AddUint64(&t.invalid, 1)
+		return nil
+	}
+	frame := data[vxlanHeader:]
+	src := net.HardwareAddr(append([]byte(nil), frame[6:12]...))
+	t.Lock()
+	if t.peerMAC.String() != src.String() {
+		t.peerMAC = src
+		logTransport.Infof("[ENCAP] Docker side MAC => %s", src)
+	}
+	t.Unlock()
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherIPv4:
+		return frame[etherHeader:]
+	case etherARP:
+		if reply := arpReply(frame); reply != nil {
+			t.sendFrame(src, etherARP, reply[etherHeader:], from)
+			atomic.AddUint64(&t.replies, 1)
+		}
+	}
+	return nil
+}
+
+// fromGRE returns the IP packet of a GRE header, skipping the checksum and
+// the sequence number, nil for another key than id
+func fromGRE(data []byte) []byte {
+	if len(data) < greHeader || data[1]&0x07 != 0 || binary.BigEndian.Uint16(data[2:]) != etherIPv4 {
+		return nil
+	}
+	h, key := greHeader, 0
+	if data[0]&0x80 != 0 {
+		h += 4
+	}
+	if data[0]&0x20 != 0 {
+		if len(data) < h+4 {
+			return nil
+		}
+		key = int(binary.BigEndian.Uint32(data[h:]))
+		h += 4
+	}
+	if data[0]&0x10 != 0 {
+		h += 4
+	}
+	if len(data) < h || key != encapID {
+		return nil
+	}
+	return data[h:]
+}
+
+// askPeerMAC sends an ARP request for the address of the docker side
+func (t *encapTunnel) askPeerMAC(to *net.UDPAddr) {
+	if peer == nil {
+		return
+	}
+	req := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(req, 1)
+	binary.BigEndian.PutUint16(req[2:], etherIPv4)
+	req[4], req[5] = 6, 4
+	binary.BigEndian.PutUint16(req[6:], 1)
+	copy(req[8:], gatewayMAC)
+	copy(req[14:], localIP.To4())
+	copy(req[24:], peer.To4())
+	t.sendFrame(broadcastMAC, etherARP, req, to)
+}
+
+// sendFrame sends an ethernet frame to the port of the docker side, at the
+// remote of the config if any
+func (t *encapTunnel) sendFrame(dst net.HardwareAddr, etherType uint16, payload []byte, to *net.UDPAddr) {
+	out := vxlanFrame(make([]byte, vxlanHeader+etherHeader+len(payload)), dst, etherType, payload)
+	to = &net.UDPAddr{IP: to.IP, Port: port}
+	if t.fixed {
+		to = t.remote
+	}
+	if _, err := t.conn.WriteToUDP(out, to); err != nil {
+		logTransport.Warningf("[ENCAP] Write error to %v: %v", to, err)
+	}
+}
+
+// encapStatus describes the encapsulation, nil without
+func encapStatus() *EncapStatus {
+	t := encap
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	st := &EncapStatus{Mode: encapMode, ID: encapID, Listen: port}
+	if t.remote != nil {
+		st.Remote = t.remote.String()
+	}
+	if t.peerMAC != nil {
+		st.PeerMAC = t.peerMAC.String()
+	}
+	st.TxPackets, st.RxPackets = atomic.LoadUint64(&t.tx), atomic.LoadUint64(&t.rx)
+	st.Invalid, st.ARPs = atomic.LoadUint64(&t.invalid), atomic.LoadUint64(&t.replies)
+	return st
+}
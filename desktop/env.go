@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+// Every flag can be given as a `DDC_` environment variable, e.g. `DDC_HOST`,
+// `DDC_PORT` or `DDC_LOG_LEVEL` for `-log-level`. The value of a setting comes
+// from, in order of precedence: the command line, the environment, the config
+// file, the default. The config file doesn't override the flags given on the
+// command line or in the environment, and reloads keep them.
+const envPrefix = "DDC_"
+
+// pinned tells where the flags overriding the config file come from, `flag`
+// or `env`
+var pinned = make(map[string]string)
+
+// envName returns the environment variable of a flag
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnv sets the flags not given on the command line from the environment
+func applyEnv(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		if pinned[f.Name] == "" {
+			pinned[f.Name] = "flag"
+		}
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		if pinned[f.Name] != "" {
+			return
+		}
+		val, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, val); err != nil {
+			logger.Warningf("invalid %s => %v\n", envName(f.Name), err)
+			return
+		}
+		pinned[f.Name] = "env"
+	})
+}
+
+// configPinned tells whether a directive of the config file is overridden by
+// a flag or the environment
+func configPinned(directive string) bool {
+	return pinned[configKey(directive)] != ""
+}
+
+// configKey returns the flag of a directive
+func configKey(directive string) string {
+	if directive == "loglevel" {
+		return "log-level"
+	}
+	return directive
+}
+
+// envArguments returns the flags taken from the environment, baked into the
+// service on install since it doesn't inherit the environment
+func envArguments(fs *flag.FlagSet) []string {
+	var args []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if pinned[f.Name] == "env" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
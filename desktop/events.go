@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// The last `eventRing` events of the tunnel are kept in memory whatever the
+// log level, for a post-mortem without debug logs enabled beforehand: the
+// changes of the client, the controls sent, the routes installed or removed,
+// the reloads of the config, the pushed domains and the warnings and errors
+// logged. An event repeating the previous one is counted on it. They are
+// served by `/events` of the admin API and printed by `status --events`.
+const eventRing = 500
+
+// Event is an event of the tunnel
+type Event struct {
+	Time   string `json:"time"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Count  int    `json:"count,omitempty"`
+}
+
+type eventLog struct {
+	sync.Mutex
+	ring []Event
+	next int
+	last int
+}
+
+var events = &eventLog{last: -1}
+
+// Add records an event
+func (l *eventLog) Add(kind, format string, args ...interface{}) {
+	detail := fmt.Sprintf(format, args...)
+	l.Lock()
+	defer l.Unlock()
+	if l.last >= 0 && l.ring[l.last].Kind == kind && l.ring[l.last].Detail == detail {
+		e := &l.ring[l.last]
+		e.Time = time.Now().Format(time.RFC3339)
+		if e.Count == 0 {
+			e.Count = 1
+		}
+		e.Count++
+		return
+	}
+	e := Event{Time: time.Now().Format(time.RFC3339), Kind: kind, Detail: detail}
+	if len(l.ring) < eventRing {
+		l.ring = append(l.ring, e)
+		l.last = len(l.ring) - 1
+		return
+	}
+	l.ring[l.next] = e
+	l.last = l.next
+	l.next = (l.next + 1) % eventRing
+}
+
+// Recent returns the kept events from the oldest to the newest
+func (l *eventLog) Recent() []Event {
+	l.Lock()
+	defer l.Unlock()
+	recent := make([]Event, 0, len(l.ring))
+	recent = append(recent, l.ring[l.next:]...)
+	return append(recent, l.ring[:l.next]...)
+}
+
+// logEvent records the warnings and errors of the log
+func logEvent(level logging.Level, message string) {
+	if level <= logging.WARNING {
+		events.Add(strings.ToLower(level.String()), "%s", message)
+	}
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, events.Recent())
+}
+
+// printEvents implements `status --events`
+func printEvents() {
+	body, err := adminGet("/events")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
@@ -2,113 +2,375 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// `expose [udp] <bind>:<port>[-<last>] [subnet,...] [restart] [portmap] [activate] [off]`
+// is a listener of the accessors, several lines making several listeners, e.g.
+// a range of ports on the LAN address giving one subnet only:
+//
+//	expose 0.0.0.0:2512
+//	expose udp 192.168.1.10:30000-30100 172.18.0.0/24
+//
+// A listener with subnets gives them to its accessors instead of the routes
+// marked `expose`, and drops their packets to other destinations. `off`
+// keeps the mapping in the config without listening, `restart` rebinds the
+// sockets on every reload, `portmap` asks the router for the ports,
+// `activate` only listens while activated, see activation.go. The listeners
+// follow the config as it is reloaded.
+const exposePortMax = 1024
+
+// ExposeStatus describes an expose mapping
+type ExposeStatus struct {
+	Listen   string   `json:"listen"`
+	Subnets  []string `json:"subnets,omitempty"`
+	Enabled  bool     `json:"enabled"`
+	Activate bool     `json:"activate,omitempty"`
+	Sockets  int      `json:"sockets"`
+	Sessions int      `json:"sessions"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// exposeRule is an `expose` line of the config
+type exposeRule struct {
+	host        string
+	first, last int
+	subnets     []*net.IPNet
+	restart     bool
+	enabled     bool
+	// portmap asks the router for the ports
+	portmap bool
+	// activate only listens while activated
+	activate bool
+}
+
+func (r exposeRule) String() string {
+	listen := net.JoinHostPort(r.host, strconv.Itoa(r.first))
+	if r.last != r.first {
+		listen += "-" + strconv.Itoa(r.last)
+	}
+	return listen
+}
+
+// parseExposeRule parses the value of an `expose` line
+func parseExposeRule(val string) (exposeRule, bool) {
+	fields := strings.Fields(val)
+	if len(fields) > 0 && fields[0] == "udp" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return exposeRule{}, false
+	}
+	host, ports, err := net.SplitHostPort(fields[0])
+	if err != nil || host != "" && net.ParseIP(host) == nil {
+		return exposeRule{}, false
+	}
+	r := exposeRule{host: host, enabled: true}
+	bounds := strings.SplitN(ports, "-", 2)
+	if r.first, err = strconv.Atoi(bounds[0]); err != nil {
+		return exposeRule{}, false
+	}
+	r.last = r.first
+	if len(bounds) == 2 {
+		if r.last, err = strconv.Atoi(bounds[1]); err != nil {
+			return exposeRule{}, false
+		}
+	}
+	if r.first < 1 || r.last > 65535 || r.last < r.first || r.last-r.first >= exposePortMax {
+		return exposeRule{}, false
+	}
+	for _, field := range fields[1:] {
+		switch field {
+		case "restart":
+			r.restart = true
+		case "portmap":
+			r.portmap = true
+		case "activate":
+			r.activate = true
+		case "off", "disabled":
+			r.enabled = false
+		case "on", "enabled":
+			r.enabled = true
+		default:
+			for _, cidr := range strings.Split(field, ",") {
+				_, ipnet, err := net.ParseCIDR(cidr)
+				if err != nil || ipnet.IP.To4() == nil {
+					return exposeRule{}, false
+				}
+				r.subnets = append(r.subnets, ipnet)
+			}
+		}
+	}
+	return r, true
+}
+
+// exposeListener is a socket of an expose mapping
+type exposeListener struct {
+	conn *net.UDPConn
+	// activate drops the sources out of the activations
+	activate bool
+	sync.Mutex
+	subnets []*net.IPNet
+}
+
+// allowed tells if the listener gives access to the IP
+func (l *exposeListener) allowed(ip net.IP) bool {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.subnets) == 0 {
+		return true
+	}
+	for _, ipnet := range l.subnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// routes returns the routes given to the accessors of the listener
+func (l *exposeListener) routes() []string {
+	l.Lock()
+	defer l.Unlock()
+	var list []string
+	if len(l.subnets) > 0 {
+		for _, ipnet := range l.subnets {
+			list = append(list, ipnet.String())
+		}
+		return list
+	}
+	for k, v := range shared.Routes() {
+		if v {
+			list = append(list, k)
+		}
+	}
+	return list
+}
+
+type exposeTable struct {
+	sync.Mutex
+	rules   []exposeRule
+	entries map[string]*exposeListener
+	errs    map[string]string
+}
+
+var exposes = &exposeTable{entries: make(map[string]*exposeListener), errs: make(map[string]string)}
+
+// Set binds the sockets of the enabled mappings and closes the others
+func (t *exposeTable) Set(rules []exposeRule) {
+	t.Lock()
+	defer t.Unlock()
+	t.rules = rules
+	wanted := make(map[string]exposeRule)
+	active := activations.Active()
+	for _, r := range rules {
+		if !r.enabled || r.activate && !active {
+			continue
+		}
+		for _, ipnet := range r.subnets {
+			if !routed(ipnet.IP) {
+				logExpose.Warningf("expose %s gives %s, which is not routed\n", r, ipnet)
+			}
+		}
+		for port := r.first; port <= r.last; port++ {
+			addr := normalizeAddr(net.JoinHostPort(r.host, strconv.Itoa(port)))
+			if _, ok := wanted[addr]; ok {
+				logExpose.Warningf("expose %s listed twice, keeping the first one\n", addr)
+				continue
+			}
+			wanted[addr] = r
+		}
+	}
+	for addr, l := range t.entries {
+		if r, ok := wanted[addr]; !ok || r.restart || r.activate != l.activate {
+			logExpose.Infof("expose closed: %s\n", addr)
+			l.conn.Close()
+			sessions.Drop(l)
+			delete(t.entries, addr)
+		}
+	}
+	t.errs = make(map[string]string)
+	for addr, r := range wanted {
+		if l, ok := t.entries[addr]; ok {
+			l.Lock()
+			l.subnets = r.subnets
+			l.Unlock()
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.errs[r.String()] = err.Error()
+			continue
+		}
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			logExpose.Warningf("failed to listen => %s\n", addr)
+			t.errs[r.String()] = err.Error()
+			continue
+		}
+		logExpose.Infof("expose listening: %s\n", addr)
+		l := &exposeListener{conn: conn, activate: r.activate, subnets: r.subnets}
+		t.entries[addr] = l
+		go handleExpose(l)
+	}
+}
+
+// Status lists the mappings in the order of the config
+func (t *exposeTable) Status() []ExposeStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.rules) == 0 {
+		return nil
+	}
+	counts := sessions.Counts()
+	list := make([]ExposeStatus, 0, len(t.rules))
+	for _, r := range t.rules {
+		st := ExposeStatus{Listen: r.String(), Enabled: r.enabled, Activate: r.activate, Error: t.errs[r.String()]}
+		for _, ipnet := range r.subnets {
+			st.Subnets = append(st.Subnets, ipnet.String())
+		}
+		if r.enabled {
+			for port := r.first; port <= r.last; port++ {
+				if l, ok := t.entries[normalizeAddr(net.JoinHostPort(r.host, strconv.Itoa(port)))]; ok {
+					st.Sockets++
+					st.Sessions += counts[l]
+				}
+			}
+		}
+		list = append(list, st)
+	}
+	return list
+}
+
+// Reapply binds or closes the listeners of `activate` as the activations
+// open and close, holding the config lock like a reload
+func (t *exposeTable) Reapply() {
+	configLock.Lock()
+	defer configLock.Unlock()
+	t.Lock()
+	rules := t.rules
+	t.Unlock()
+	t.Set(rules)
+}
+
+// Close closes the listeners, holding the config lock like clearRoutes
+func (t *exposeTable) Close() {
+	configLock.Lock()
+	defer configLock.Unlock()
+	t.Set(nil)
+}
+
 func packetIP(data []byte) net.IP {
 	return net.IPv4(data[16], data[17], data[18], data[19])
 }
 
-func handleExpose() {
-	defer expose.Close()
-	data := make([]byte, 2000)
-	users := make(map[string]bool)
+func handleExpose(l *exposeListener) {
+	ex := l.conn
+	defer ex.Close()
+	b := getBuffer(bufferSize())
+	defer putBuffer(b)
+	data := *b
 	for {
-		n, addr, err := expose.ReadFromUDP(data)
+		n, addr, err := ex.ReadFromUDP(data)
 		if err != nil {
 			if strings.Contains(err.Error(), "closed") {
-				logger.Info("expose server closed.")
+				logExpose.Info("expose server closed.")
 				return
 			}
-			logger.Warningf("failed read udp msg, error: %v\n", err)
+			logExpose.Warningf("failed read udp msg, error: %v\n", err)
 			continue
 		}
-		if users[addr.String()] {
+		if l.activate && !activations.Allowed(addr.IP) {
+			logExpose.Debugf("[ACTIVATE] Dropped %d bytes from %v out of the activations", n, addr)
+			continue
+		}
+		if data[0] == 1 {
+			token := string(data[1:n])
+			clientIP := addr.String()
+			logExpose.Debugf("client token => %s %s\n", clientIP, token)
+			if ip, ok := shared.Tokens()[token]; ok && net.ParseIP(ip).To4() != nil {
+				sess := sessions.Login(token, addr, net.ParseIP(ip).To4(), l)
+				if sess == nil {
+					logTransport.Warningf("[SESSION] No session left for %s with token %s", clientIP, token)
+					continue
+				}
+				if !sess.ip.Equal(net.ParseIP(ip)) {
+					logTransport.Infof("[SESSION] %s of token %s is in use, %s gets %s", ip, token, clientIP, sess.ip)
+				}
+				ip = sess.ip.String()
+				logExpose.Infof("client session => %s %s\n", clientIP, ip)
+				var reply bytes.Buffer
+				reply.WriteByte(1)
+				// 验证成功返回IP
+				ones, _ := subnet.Mask.Size()
+				reply.WriteString(fmt.Sprintf("addr %s/%d", ip, ones))
+				reply.WriteString(fmt.Sprintf(",peer %s", localIP.String()))
+				reply.WriteString(fmt.Sprintf(",mtu %d", MTU))
+				list := l.routes()
+				sort.Strings(list)
+				for _, k := range list {
+					reply.WriteString(",route ")
+					reply.WriteString(k)
+				}
+				logExpose.Infof("reply client => %s %d %s %s\n", clientIP, reply.Len(), reply.String(), addr)
+				ex.WriteToUDP(reply.Bytes(), addr)
+			} else {
+				logExpose.Infof("invalid token => %s %s\n", clientIP, token)
+			}
+		} else if sess := sessions.Peer(addr); sess != nil {
+			packet := validPacket(data[:n], addr)
+			if packet == nil {
+				continue
+			}
+			if data[0]>>4 != 4 || !net.IP(data[12:16]).Equal(sess.ip) {
+				logTransport.Debugf("[SESSION] Dropped %d bytes from %v not sourced from its session IP %v", n, addr, sess.ip)
+				continue
+			}
+			if !l.allowed(net.IP(packet[16:20])) {
+				logTransport.Debugf("[SESSION] Dropped %d bytes from %v to %v not given by %v", n, addr, packetIP(packet), ex.LocalAddr())
+				continue
+			}
+			n = len(packet)
+			atomic.AddUint64(&sess.rxBytes, uint64(n))
 			if pong {
 				if data[0]&0xf0 == 0x40 { // IPv4
-					total := 256*uint64(data[2]) + uint64(data[3]) // 总长度
-					packet := data[:total]
-					if packet[9] == 0x01 { // ICMPv4
-						if packet[20] == 0x08 { // IPv4 echo request
+					ihl := int(packet[0]&0x0f) * 4
+					if packet[9] == 0x01 && len(packet) >= ihl+8 && !isFragment(packet) { // ICMPv4
+						if packet[ihl] == 0x08 { // IPv4 echo request
 							var echoReply bytes.Buffer
 							echoReply.Write(packet[:12])
 							echoReply.Write(packet[16:20])
 							echoReply.Write(packet[12:16])
+							echoReply.Write(packet[20:ihl])
 							echoReply.WriteByte(0x00)
-							echoReply.Write(packet[21:])
+							echoReply.Write(packet[ihl+1:])
 							reply := echoReply.Bytes()
-							reply[22] = 0x00
-							reply[23] = 0x00
-							crc := checkSum(reply[20:])
-							reply[22] = byte((crc & 0x00ff) >> 0)
-							reply[23] = byte((crc & 0xff00) >> 8)
-							logger.Debugf("Send IPv4 echo reply => %v %v\n", addr.String(), packetIP(packet))
-							expose.WriteToUDP(reply, addr)
+							reply[ihl+2] = 0x00
+							reply[ihl+3] = 0x00
+							binary.BigEndian.PutUint16(reply[ihl+2:], ^ipSum(reply[ihl:], 0))
+							logExpose.Debugf("Send IPv4 echo reply => %v %v\n", addr.String(), packetIP(packet))
+							ex.WriteToUDP(reply, addr)
 							continue
-						} else if packet[20] == 0x00 {
-							logger.Debugf("Received IPv4 echo reply => %v %v\n", addr.String(), packetIP(packet))
+						} else if packet[ihl] == 0x00 {
+							logExpose.Debugf("Received IPv4 echo reply => %v %v\n", addr.String(), packetIP(packet))
 						}
 					}
 				} else if data[0]&0xf0 == 0x60 { // IPv6
-					logger.Debugf("not supported")
+					logExpose.Debugf("not supported")
 				}
 			}
-			if _, err := conn.WriteToUDP(data[:n], cli); err != nil {
-				logger.Warningf("udp write error: %v\n", err)
-			}
-		} else if data[0] == 1 {
-			token := string(data[1:n])
-			clientIP := addr.String()
-			logger.Debugf("client token => %s %s\n", clientIP, token)
-			if ip, ok := tokens[token]; ok {
-				users[clientIP] = true
-				intIP := toIntIP(net.ParseIP(ip).To4(), 0, 1, 2, 3)
-				logger.Infof("client session => %s %s %v\n", clientIP, ip, intIP)
-				sessions[intIP] = addr
-				var reply bytes.Buffer
-				reply.WriteByte(1)
-				// 验证成功返回IP
-				ones, _ := subnet.Mask.Size()
-				reply.WriteString(fmt.Sprintf("addr %s/%d", ip, ones))
-				reply.WriteString(fmt.Sprintf(",peer %s", localIP.String()))
-				reply.WriteString(fmt.Sprintf(",mtu %d", MTU))
-				for k, v := range routes {
-					if v {
-						reply.WriteString(",route ")
-						reply.WriteString(k)
-					}
-				}
-				logger.Infof("reply client => %s %d %s %s\n", clientIP, reply.Len(), reply.String(), addr)
-				expose.WriteToUDP(reply.Bytes(), addr)
-			} else {
-				logger.Infof("invalid token => %s %s\n", clientIP, token)
+			if err := writePacket(data[:n], shared.Client()); err != nil {
+				logExpose.Warningf("udp write error: %v\n", err)
 			}
 		} else {
-			expose.WriteToUDP([]byte{2}, addr)
+			ex.WriteToUDP([]byte{2}, addr)
 		}
 	}
 }
-
-func checkSum(data []byte) uint16 {
-	var (
-		sum    uint32
-		length = len(data)
-		index  int
-	)
-	//以每16位为单位进行求和，直到所有的字节全部求完或者只剩下一个8位字节（如果剩余一个8位字节说明字节数为奇数个）
-	for length > 1 {
-		sum += uint32(data[index]) + uint32(data[index+1])<<8
-		index += 2
-		length -= 2
-	}
-	//如果字节数为奇数个，要加上最后剩下的那个8位字节
-	if length > 0 {
-		sum += uint32(data[index])
-	}
-	//加上高16位进位的部分
-	sum += (sum >> 16)
-	//别忘了返回的时候先求反
-	return uint16(^sum)
-}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With `failover <primary> <standby>` two docker sides with the same networks,
+// e.g. Docker Desktop and a remote docker host, are known by their address
+// (an ip, or ip:port to tell apart two on the same host) and only one of them
+// is the client at a time:
+//
+//	failover 192.168.65.3 10.0.0.20
+//
+// The primary is the client while alive. Once it missed `dead-after`
+// heartbeats, the next heartbeat of the standby makes the standby the client,
+// the controls being sent to it, and once the primary has been back for two
+// heartbeat intervals it is the client again. The heartbeats of the other one
+// are answered, so it stays connected, and its other datagrams dropped.
+// Other addresses are ignored. `status` reports the active peer.
+type failoverPeer struct {
+	addr string
+	ip   net.IP
+	port int
+	// seen is the last datagram, since the start of the current streak
+	seen, since time.Time
+}
+
+type failoverTable struct {
+	sync.Mutex
+	peers    []*failoverPeer
+	active   int
+	switches uint64
+	switched time.Time
+}
+
+var failover = &failoverTable{active: -1}
+
+// FailoverStatus is the failover in the status
+type FailoverStatus struct {
+	Primary      string `json:"primary"`
+	Standby      string `json:"standby"`
+	Active       string `json:"active,omitempty"`
+	PrimaryAlive bool   `json:"primary_alive"`
+	StandbyAlive bool   `json:"standby_alive"`
+	Switches     uint64 `json:"switches"`
+	Switched     string `json:"switched,omitempty"`
+}
+
+var failoverRoles = []string{"primary", "standby"}
+
+// parseFailoverPeer parses an ip or ip:port
+func parseFailoverPeer(addr string) (*failoverPeer, bool) {
+	p := &failoverPeer{addr: addr}
+	host := addr
+	if h, port, err := net.SplitHostPort(addr); err == nil {
+		v, err := strconv.Atoi(port)
+		if err != nil || v <= 0 || v > 65535 {
+			return nil, false
+		}
+		host, p.port = h, v
+	}
+	if p.ip = net.ParseIP(host); p.ip == nil {
+		return nil, false
+	}
+	return p, true
+}
+
+// Set replaces the peers of `failover <primary> <standby>`, none to disable,
+// keeping the state of the unchanged ones
+func (f *failoverTable) Set(val string) {
+	fields := strings.Fields(val)
+	var peers []*failoverPeer
+	if len(fields) == 2 {
+		for _, addr := range fields {
+			p, ok := parseFailoverPeer(addr)
+			if !ok {
+				logger.Warningf("invalid failover peer => %s\n", addr)
+				return
+			}
+			peers = append(peers, p)
+		}
+	} else if val != "" {
+		logger.Warningf("invalid failover => %s\n", val)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	active := -1
+	for i, p := range peers {
+		if i < len(f.peers) && f.peers[i].addr == p.addr {
+			peers[i] = f.peers[i]
+			if f.active == i {
+				active = i
+			}
+		}
+	}
+	if len(peers) > 0 && len(f.peers) == 0 {
+		logger.Infof("[FAILOVER] Primary %s, standby %s", peers[0].addr, peers[1].addr)
+	}
+	f.peers, f.active = peers, active
+}
+
+// role returns the index of the peer of an address, -1 for none
+func (f *failoverTable) role(from *net.UDPAddr) int {
+	for i, p := range f.peers {
+		if p.ip.Equal(from.IP) && (p.port == 0 || p.port == from.Port) {
+			return i
+		}
+	}
+	return -1
+}
+
+func failoverDead() time.Duration {
+	return time.Duration(heartbeat*deadAfter) * time.Millisecond
+}
+
+func (f *failoverTable) alive(i int, now time.Time) bool {
+	return !f.peers[i].seen.IsZero() && now.Sub(f.peers[i].seen) < failoverDead()
+}
+
+// activate makes a peer the client, the sessions of the other one ending
+func (f *failoverTable) activate(i int, reason string) {
+	from := "none"
+	if f.active >= 0 {
+		from = failoverRoles[f.active]
+	}
+	f.active = i
+	f.switches++
+	f.switched = time.Now()
+	logger.Infof("[FAILOVER] Active %s => %s %s (%s)", from, failoverRoles[i], f.peers[i].addr, reason)
+	events.Add("failover", "%s => %s (%s)", from, failoverRoles[i], reason)
+	dataSession.End()
+	ctlSession.End()
+}
+
+// Admit tells whether a datagram is from the active peer, making another one
+// active when due. The heartbeats of the inactive peer are answered on conn.
+func (f *failoverTable) Admit(from *net.UDPAddr, beat bool, conn *net.UDPConn) bool {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.peers) == 0 {
+		return true
+	}
+	i := f.role(from)
+	if i < 0 {
+		peerStats.Drop("failover")
+		return false
+	}
+	now := time.Now()
+	p := f.peers[i]
+	if !f.alive(i, now) {
+		p.since = now
+	}
+	p.seen = now
+	switch {
+	case i == f.active:
+		return true
+	case !beat:
+	case f.active < 0:
+		f.activate(i, "first seen")
+		return true
+	case i == 0 && now.Sub(p.since) >= 2*time.Duration(heartbeat)*time.Millisecond:
+		f.activate(i, "primary back")
+		return true
+	case i == 1 && !f.alive(0, now):
+		f.activate(i, "primary dead")
+		return true
+	}
+	if beat {
+		// keep the standby connected
+		conn.WriteToUDP([]byte{0}, from)
+	} else {
+		peerStats.Drop("failover")
+	}
+	return false
+}
+
+func (f *failoverTable) Status() *FailoverStatus {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.peers) == 0 {
+		return nil
+	}
+	now := time.Now()
+	st := &FailoverStatus{
+		Primary:      f.peers[0].addr,
+		Standby:      f.peers[1].addr,
+		PrimaryAlive: f.alive(0, now),
+		StandbyAlive: f.alive(1, now),
+		Switches:     f.switches,
+	}
+	if f.active >= 0 {
+		st.Active = failoverRoles[f.active]
+	}
+	if !f.switched.IsZero() {
+		st.Switched = f.switched.Format(time.RFC3339)
+	}
+	return st
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// For lossy links the datagrams of the tunneled packets may be protected by
+// forward error correction: they are sent in groups as
+//
+//	15 | group(2) | index | datagram
+//
+// each group closed by a parity datagram
+//
+//	15 | group(2) | 0x80 + count | length xor(2) | xor of the datagrams
+//
+// so a single datagram lost in a group is rebuilt from the others without
+// waiting for TCP to retransmit it. A group is closed after `fec` datagrams,
+// or after fecFlush for the sparse interactive traffic. The desktop offers
+// `fec <count>` in the controls and the docker side accepts with a feature
+// bit of its heartbeats, then protects its datagrams the same way. Decoding is
+// always supported.
+const (
+	fecType    = connector.FEC
+	fecHeader  = 4
+	fecParity  = 0x80
+	featureFEC = connector.FeatureFEC
+	fecMax     = 64
+	fecFlush   = 5 * time.Millisecond
+	fecGroups  = 256
+	fecTimeout = time.Second
+)
+
+var fecCount = 0
+
+type fecEncoder struct {
+	sync.Mutex
+	group  uint16
+	count  int
+	parity []byte
+	length uint16
+	timer  *time.Timer
+	// send writes to the peer of the open group
+	send func([]byte) error
+	sent uint64
+}
+
+type fecGroup struct {
+	data    [][]byte
+	created time.Time
+}
+
+type fecDecoder struct {
+	sync.Mutex
+	groups    map[uint16]*fecGroup
+	recovered uint64
+	// unrecovered counts the groups missing several datagrams
+	unrecovered uint64
+}
+
+var (
+	fecOut = &fecEncoder{}
+	fecIn  = &fecDecoder{groups: make(map[uint16]*fecGroup)}
+)
+
+// FECStatus reports the forward error correction
+type FECStatus struct {
+	Count       int    `json:"count"`
+	Peer        bool   `json:"peer"`
+	Parity      uint64 `json:"parity"`
+	Recovered   uint64 `json:"recovered"`
+	Unrecovered uint64 `json:"unrecovered"`
+}
+
+func fecStatus() *FECStatus {
+	fecIn.Lock()
+	defer fecIn.Unlock()
+	if fecCount <= 0 && fecIn.recovered == 0 && fecIn.unrecovered == 0 {
+		return nil
+	}
+	return &FECStatus{
+		Count:       fecCount,
+		Peer:        atomic.LoadInt32(&peerFeatures)&featureFEC != 0,
+		Parity:      atomic.LoadUint64(&fecOut.sent),
+		Recovered:   fecIn.recovered,
+		Unrecovered: fecIn.unrecovered,
+	}
+}
+
+// fecEnabled tells whether the datagrams to the peer are protected
+func fecEnabled() bool {
+	return fecCount > 0 && atomic.LoadInt32(&peerFeatures)&featureFEC != 0
+}
+
+// Send writes a datagram in the open group with send, closing the group
+// when full
+func (e *fecEncoder) Send(datagram []byte, send func([]byte) error) error {
+	count := fecCount
+	if count > fecMax {
+		count = fecMax
+	}
+	b := getBuffer(fecHeader + len(datagram))
+	defer putBuffer(b)
+	buf := *b
+	e.Lock()
+	defer e.Unlock()
+	if e.count == 0 {
+		e.open()
+	}
+	buf[0] = fecType
+	binary.BigEndian.PutUint16(buf[1:], e.group)
+	buf[3] = byte(e.count)
+	copy(buf[fecHeader:], datagram)
+	err := send(buf)
+	if len(datagram) > len(e.parity) {
+		e.parity = append(e.parity, make([]byte, len(datagram)-len(e.parity))...)
+	}
+	for i, c := range datagram {
+		e.parity[i] ^= c
+	}
+	e.length ^= uint16(len(datagram))
+	e.count++
+	e.send = send
+	if e.count >= count {
+		e.close()
+	} else if e.count == 1 {
+		group := e.group
+		e.timer = time.AfterFunc(fecFlush, func() {
+			e.Lock()
+			defer e.Unlock()
+			if e.group == group && e.count > 0 {
+				e.close()
+			}
+		})
+	}
+	return err
+}
+
+// open starts a new group
+func (e *fecEncoder) open() {
+	e.group++
+	e.parity = e.parity[:0]
+	e.length = 0
+}
+
+// close sends the parity of the open group
+func (e *fecEncoder) close() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	parity := make([]byte, fecHeader+2+len(e.parity))
+	parity[0] = fecType
+	binary.BigEndian.PutUint16(parity[1:], e.group)
+	parity[3] = fecParity | byte(e.count)
+	binary.BigEndian.PutUint16(parity[fecHeader:], e.length)
+	copy(parity[fecHeader+2:], e.parity)
+	e.count = 0
+	if err := e.send(parity); err != nil {
+		logTransport.Debugf("[FEC] Failed to send the parity of group %d: %v", e.group, err)
+		return
+	}
+	atomic.AddUint64(&e.sent, 1)
+}
+
+// Receive returns the datagram carried by a protected one, or the datagram
+// rebuilt from a parity, nil if none
+func (d *fecDecoder) Receive(data []byte) []byte {
+	if len(data) < fecHeader {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(data[1:])
+	index := data[3]
+	d.Lock()
+	defer d.Unlock()
+	g := d.groups[id]
+	if index&fecParity == 0 {
+		if int(index) >= fecMax {
+			return nil
+		}
+		if g == nil {
+			now := time.Now()
+			if len(d.groups) >= fecGroups {
+				for k, v := range d.groups {
+					if now.Sub(v.created) > fecTimeout || len(d.groups) >= fecGroups {
+						delete(d.groups, k)
+					}
+				}
+			}
+			g = &fecGroup{data: make([][]byte, fecMax), created: now}
+			d.groups[id] = g
+		}
+		g.data[index] = append([]byte(nil), data[fecHeader:]...)
+		return data[fecHeader:]
+	}
+	delete(d.groups, id)
+	count := int(index &^ fecParity)
+	if len(data) < fecHeader+2 || count > fecMax {
+		return nil
+	}
+	missing := -1
+	for i := 0; i < count; i++ {
+		if g != nil && g.data[i] != nil {
+			continue
+		}
+		if missing >= 0 {
+			// more than one lost, nothing to rebuild
+			d.unrecovered++
+			return nil
+		}
+		missing = i
+	}
+	if missing < 0 {
+		return nil
+	}
+	length := binary.BigEndian.Uint16(data[fecHeader:])
+	rebuilt := append([]byte(nil), data[fecHeader+2:]...)
+	for i := 0; i < count; i++ {
+		if i == missing {
+			continue
+		}
+		length ^= uint16(len(g.data[i]))
+		for j, c := range g.data[i] {
+			rebuilt[j] ^= c
+		}
+	}
+	if int(length) > len(rebuilt) {
+		d.unrecovered++
+		return nil
+	}
+	d.recovered++
+	logTransport.Debugf("[FEC] Rebuilt datagram %d of group %d, %d bytes", missing, id, length)
+	return rebuilt[:length]
+}
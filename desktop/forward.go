@@ -0,0 +1,315 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `forward <tcp|udp> <listen> <container ip:port>` publishes a single
+// container service on the host, e.g. on localhost:
+//
+//	forward tcp 127.0.0.1:15432 172.18.0.5:5432
+//
+// A container outside of the routes gets a host route of its own through the
+// tunnel, so no whole subnet needs to be routed. The mappings follow the
+// config file as it is reloaded. The container sees the connections and the
+// datagrams coming from the TUN address, with `proxy-protocol` after the
+// target they start with a PROXY protocol v2 header giving the address of the
+// client, each datagram for udp, e.g. for the logs of nginx or haproxy:
+//
+//	forward udp 0.0.0.0:5353 172.18.0.7:53 proxy-protocol
+const forwardUDPIdle = 2 * time.Minute
+
+// ForwardStatus describes a port forward
+type ForwardStatus struct {
+	Proto   string `json:"proto"`
+	Listen  string `json:"listen"`
+	Target  string `json:"target"`
+	Route   string `json:"route,omitempty"`
+	Proxy   bool   `json:"proxy_protocol,omitempty"`
+	Active  int64  `json:"active"`
+	Total   uint64 `json:"total"`
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBytes uint64 `json:"rx_bytes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// forwardRule is a `forward` line of the config
+type forwardRule struct {
+	proto, listen, target string
+	// proxy prefixes the PROXY protocol v2 header
+	proxy bool
+}
+
+func (r forwardRule) key() string {
+	return r.proto + " " + r.listen
+}
+
+// parseForward parses the value of a `forward` line
+func parseForward(val string) (forwardRule, bool) {
+	fields := strings.Fields(val)
+	proxy := len(fields) == 4 && fields[3] == "proxy-protocol"
+	if len(fields) != 3 && !proxy || (fields[0] != "tcp" && fields[0] != "udp") {
+		return forwardRule{}, false
+	}
+	host, _, err := net.SplitHostPort(fields[2])
+	if err != nil || net.ParseIP(host).To4() == nil {
+		return forwardRule{}, false
+	}
+	if _, _, err := net.SplitHostPort(fields[1]); err != nil {
+		return forwardRule{}, false
+	}
+	return forwardRule{proto: fields[0], listen: fields[1], target: fields[2], proxy: proxy}, true
+}
+
+// udpFlow is the socket to the container of a UDP client
+type udpFlow struct {
+	conn     *net.UDPConn
+	lastSeen int64
+}
+
+type portForward struct {
+	// first for 64-bit alignment of the atomic counters
+	total, tx, rx uint64
+	active        int64
+	forwardRule
+	// tcp serves the TCP forwards
+	tcp *tcpExpose
+	pc  net.PacketConn
+	sync.Mutex
+	flows map[string]*udpFlow
+	err   string
+}
+
+type forwardTable struct {
+	sync.Mutex
+	entries map[string]*portForward
+	// routes are the host routes installed for the targets
+	routes map[string]bool
+}
+
+var forwards = &forwardTable{entries: make(map[string]*portForward), routes: make(map[string]bool)}
+
+// Set starts the forwards of the config and closes the removed ones, then
+// routes the targets outside of the routes through the tunnel
+func (t *forwardTable) Set(rules []forwardRule, peer net.IP) {
+	t.Lock()
+	defer t.Unlock()
+	wanted := make(map[string]forwardRule)
+	for _, r := range rules {
+		wanted[r.key()] = r
+	}
+	for key, f := range t.entries {
+		if r, ok := wanted[key]; !ok || r != f.forwardRule {
+			logExpose.Infof("[FORWARD] Closing %s %s => %s", f.proto, f.listen, f.target)
+			f.close()
+			delete(t.entries, key)
+		}
+	}
+	hosts := make(map[string]bool)
+	for key, r := range wanted {
+		if ip := net.ParseIP(strings.Split(r.target, ":")[0]); !routed(ip) {
+			hosts[ip.String()+"/32"] = true
+		}
+		if _, ok := t.entries[key]; ok {
+			continue
+		}
+		f := &portForward{forwardRule: r}
+		t.entries[key] = f
+		if r.proto == "udp" && stack == stackUserspace {
+			logExpose.Warningf("[FORWARD] udp %s needs the tun stack", r.listen)
+			f.err = "needs the tun stack"
+			continue
+		}
+		if err := f.open(); err != nil {
+			logExpose.Warningf("[FORWARD] Failed to listen on %s %s: %v", r.proto, r.listen, err)
+			f.err = err.Error()
+			continue
+		}
+		logExpose.Infof("[FORWARD] Listening on %s %s => %s", r.proto, r.listen, r.target)
+	}
+	if !bind {
+		return
+	}
+	for key := range t.routes {
+		if !hosts[key] {
+			logExpose.Infof("[FORWARD] Removing host route %s", key)
+			delRoute(key)
+			delete(t.routes, key)
+		}
+	}
+	for key := range hosts {
+		if !t.routes[key] {
+			logExpose.Infof("[FORWARD] Adding host route %s", key)
+			delRoute(key)
+			addRoute(key, peer)
+			t.routes[key] = true
+		}
+	}
+}
+
+func (f *portForward) open() error {
+	if f.proto == "tcp" {
+		ln, err := net.Listen("tcp", f.listen)
+		if err != nil {
+			return err
+		}
+		f.tcp = &tcpExpose{tag: "[FORWARD]", listen: f.listen, target: f.target, proxy: f.proxy, ln: ln}
+		go f.tcp.accept()
+		return nil
+	}
+	pc, err := net.ListenPacket("udp", f.listen)
+	if err != nil {
+		return err
+	}
+	f.pc = pc
+	f.flows = make(map[string]*udpFlow)
+	go f.serveUDP()
+	return nil
+}
+
+func (f *portForward) close() {
+	if f.tcp != nil {
+		f.tcp.ln.Close()
+	}
+	if f.pc != nil {
+		f.pc.Close()
+		f.Lock()
+		for _, flow := range f.flows {
+			flow.conn.Close()
+		}
+		f.Unlock()
+	}
+}
+
+func (f *portForward) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return
+			}
+			logExpose.Warningf("[FORWARD] Read error on udp %s: %v", f.listen, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		flow := f.flow(from)
+		if flow == nil {
+			continue
+		}
+		data := buf[:n]
+		if f.proxy {
+			data = append(proxyHeader("udp", from, f.pc.LocalAddr()), data...)
+		}
+		if _, err := flow.conn.Write(data); err == nil {
+			atomic.AddUint64(&f.tx, uint64(n))
+		}
+	}
+}
+
+// flow returns the socket to the container of the client, dialing it for a
+// new client
+func (f *portForward) flow(from net.Addr) *udpFlow {
+	f.Lock()
+	defer f.Unlock()
+	if flow, ok := f.flows[from.String()]; ok {
+		atomic.StoreInt64(&flow.lastSeen, time.Now().UnixNano())
+		return flow
+	}
+	raddr, err := net.ResolveUDPAddr("udp", f.target)
+	if err != nil {
+		return nil
+	}
+	var laddr *net.UDPAddr
+	if bind {
+		laddr = &net.UDPAddr{IP: localIP}
+	}
+	conn, err := net.DialUDP("udp", laddr, raddr)
+	if err != nil {
+		logExpose.Warningf("[FORWARD] %v => %s: %v", from, f.target, err)
+		return nil
+	}
+	flow := &udpFlow{conn: conn, lastSeen: time.Now().UnixNano()}
+	f.flows[from.String()] = flow
+	atomic.AddUint64(&f.total, 1)
+	atomic.AddInt64(&f.active, 1)
+	logExpose.Debugf("[FORWARD] %v => %s connected", from, f.target)
+	go f.replies(from, flow)
+	return flow
+}
+
+// replies sends the datagrams of the container back to the client until the
+// flow is idle for forwardUDPIdle
+func (f *portForward) replies(from net.Addr, flow *udpFlow) {
+	defer func() {
+		f.Lock()
+		delete(f.flows, from.String())
+		f.Unlock()
+		flow.conn.Close()
+		atomic.AddInt64(&f.active, -1)
+	}()
+	buf := make([]byte, 65535)
+	for {
+		flow.conn.SetReadDeadline(time.Now().Add(forwardUDPIdle))
+		n, err := flow.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&flow.lastSeen))) < forwardUDPIdle {
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&flow.lastSeen, time.Now().UnixNano())
+		if _, err := f.pc.WriteTo(buf[:n], from); err == nil {
+			atomic.AddUint64(&f.rx, uint64(n))
+		}
+	}
+}
+
+// Status lists the forwards by protocol and listen address
+func (t *forwardTable) Status() []ForwardStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.entries) == 0 {
+		return nil
+	}
+	list := make([]ForwardStatus, 0, len(t.entries))
+	for _, f := range t.entries {
+		st := ForwardStatus{
+			Proto:   f.proto,
+			Proxy:   f.proxy,
+			Listen:  f.listen,
+			Target:  f.target,
+			Active:  atomic.LoadInt64(&f.active),
+			Total:   atomic.LoadUint64(&f.total),
+			TxBytes: atomic.LoadUint64(&f.tx),
+			RxBytes: atomic.LoadUint64(&f.rx),
+			Error:   f.err,
+		}
+		if f.tcp != nil {
+			st.Active = atomic.LoadInt64(&f.tcp.active)
+			st.Total = atomic.LoadUint64(&f.tcp.total)
+			st.TxBytes = atomic.LoadUint64(&f.tcp.tx)
+			st.RxBytes = atomic.LoadUint64(&f.tcp.rx)
+		}
+		if host := strings.Split(f.target, ":")[0] + "/32"; t.routes[host] {
+			st.Route = host
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Proto+list[i].Listen < list[j].Proto+list[j].Listen })
+	return list
+}
+
+// Close stops the forwards and removes their host routes, holding the config
+// lock like clearRoutes
+func (t *forwardTable) Close() {
+	configLock.Lock()
+	defer configLock.Unlock()
+	t.Set(nil, nil)
+}
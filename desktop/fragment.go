@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// Packets larger than `fragSize` are split into datagrams of
+//
+//	6 | id(2) | index | count | data
+//
+// and reassembled by the receiving side, so jumbo frames can cross a path
+// with a smaller MTU. Reassembly is always supported.
+const (
+	fragType    = connector.Fragment
+	fragHeader  = 5
+	fragTimeout = 5 * time.Second
+	fragMax     = 64
+)
+
+var (
+	fragID  uint32
+	fragIDs sync.Mutex
+)
+
+// writePacket sends a packet to the client, fragmented if it is too large
+func writePacket(packet []byte, addr *net.UDPAddr) error {
+	inheritDSCP(packet)
+	packet, b := compressPacket(packet)
+	if b != nil {
+		defer putBuffer(b)
+	}
+	if fragSize <= fragHeader || len(packet) <= fragSize {
+		return sendDatagram(packet, addr)
+	}
+	size := fragSize - fragHeader
+	count := (len(packet) + size - 1) / size
+	if count > 255 {
+		return sendDatagram(packet, addr)
+	}
+	fragIDs.Lock()
+	fragID++
+	id := uint16(fragID)
+	fragIDs.Unlock()
+	cb := getBuffer(fragSize)
+	defer putBuffer(cb)
+	chunk := *cb
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(packet) {
+			end = len(packet)
+		}
+		chunk[0] = fragType
+		binary.BigEndian.PutUint16(chunk[1:], id)
+		chunk[3] = byte(i)
+		chunk[4] = byte(count)
+		l := copy(chunk[fragHeader:], packet[i*size:end])
+		if err := sendDatagram(chunk[:fragHeader+l], addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendDatagram writes a datagram to the client, protected by the forward
+// error correction if negotiated
+func sendDatagram(datagram []byte, addr *net.UDPAddr) error {
+	if fecEnabled() {
+		return fecOut.Send(datagram, func(b []byte) error {
+			return writeDatagram(b, addr)
+		})
+	}
+	return writeDatagram(datagram, addr)
+}
+
+type fragEntry struct {
+	chunks  [][]byte
+	missing int
+	created time.Time
+}
+
+type reassembler struct {
+	sync.Mutex
+	entries map[uint16]*fragEntry
+	expired uint64
+}
+
+var fragments = &reassembler{entries: make(map[uint16]*fragEntry)}
+
+// Add collects a fragment and returns the packet once all fragments arrived
+func (r *reassembler) Add(data []byte) []byte {
+	if len(data) <= fragHeader {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(data[1:])
+	index, count := int(data[3]), int(data[4])
+	if count == 0 || index >= count {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	e, ok := r.entries[id]
+	if !ok || len(e.chunks) != count {
+		if len(r.entries) >= fragMax {
+			r.expire(now)
+		}
+		e = &fragEntry{chunks: make([][]byte, count), missing: count, created: now}
+		r.entries[id] = e
+	}
+	if e.chunks[index] == nil {
+		e.chunks[index] = append([]byte(nil), data[fragHeader:]...)
+		e.missing--
+	}
+	if e.missing > 0 {
+		return nil
+	}
+	delete(r.entries, id)
+	var packet []byte
+	for _, chunk := range e.chunks {
+		packet = append(packet, chunk...)
+	}
+	return packet
+}
+
+// expire drops incomplete packets older than fragTimeout, or the oldest one
+// if none is old enough
+func (r *reassembler) expire(now time.Time) {
+	var oldest uint16
+	var oldestTime time.Time
+	for id, e := range r.entries {
+		if now.Sub(e.created) > fragTimeout {
+			delete(r.entries, id)
+			r.expired++
+		} else if oldestTime.IsZero() || e.created.Before(oldestTime) {
+			oldest, oldestTime = id, e.created
+		}
+	}
+	if len(r.entries) >= fragMax {
+		delete(r.entries, oldest)
+		r.expired++
+	}
+}
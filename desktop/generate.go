@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// `generate -network <name>` writes the config of a docker network from its
+// inspection, through the API of the engine found by dockerEndpoint or else
+// `docker network inspect`: the routes of its IPv4 subnets, an `expose`
+// listener giving them to others with `-expose`, the `hosts-template` naming
+// its containers under `-domain`, and the containers with their addresses as
+// comments, to paste in the hosts file. The lines are printed, or appended to
+// the `-config` with `-append`, skipping the ones already there, the running
+// connector applying them on save.
+
+// dockerNetwork is the part of the inspection of a network generated from
+type dockerNetwork struct {
+	Name   string `json:"Name"`
+	Driver string `json:"Driver"`
+	IPAM   struct {
+		Config []struct {
+			Subnet  string `json:"Subnet"`
+			Gateway string `json:"Gateway"`
+		} `json:"Config"`
+	} `json:"IPAM"`
+	Containers map[string]struct {
+		Name        string `json:"Name"`
+		IPv4Address string `json:"IPv4Address"`
+	} `json:"Containers"`
+}
+
+// inspectNetwork inspects a network of the engine
+func inspectNetwork(name string) (*dockerNetwork, error) {
+	var n dockerNetwork
+	endpoint := dockerEndpoint()
+	if endpoint == "" {
+		out, err := cliOutput("docker", "network", "inspect", name)
+		if err != nil {
+			return nil, fmt.Errorf("docker network inspect %s: %v", name, err)
+		}
+		var list []dockerNetwork
+		if err := json.Unmarshal([]byte(out), &list); err != nil || len(list) == 0 {
+			return nil, fmt.Errorf("invalid inspection of %s", name)
+		}
+		return &list[0], nil
+	}
+	resp, err := dockerClient(endpoint).Get("http://docker/networks/" + url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("network %s not found", name)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inspection of %s answered %s", name, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// networkConfig returns the config lines of a network
+func networkConfig(n *dockerNetwork, expose, domain string) []string {
+	lines := []string{fmt.Sprintf("# network %s (%s)", n.Name, n.Driver)}
+	var subnets []string
+	for _, c := range n.IPAM.Config {
+		_, ipnet, err := net.ParseCIDR(c.Subnet)
+		if err != nil || ipnet.IP.To4() == nil {
+			lines = append(lines, fmt.Sprintf("# subnet %s not routed, IPv4 only", c.Subnet))
+			continue
+		}
+		subnets = append(subnets, ipnet.String())
+		lines = append(lines, "route "+ipnet.String())
+	}
+	if expose != "" && len(subnets) > 0 {
+		lines = append(lines, fmt.Sprintf("expose %s %s", expose, strings.Join(subnets, ",")))
+	}
+	if domain != "" {
+		lines = append(lines, fmt.Sprintf("hosts-template {{.Name}}.%s", domain))
+	}
+	var names []string
+	addrs := make(map[string]string)
+	for _, c := range n.Containers {
+		if ip, _, err := net.ParseCIDR(c.IPv4Address); err == nil && c.Name != "" {
+			names = append(names, c.Name)
+			addrs[c.Name] = ip.String()
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		host := name
+		if domain != "" {
+			host += "." + domain
+		}
+		lines = append(lines, fmt.Sprintf("# %s %s", addrs[name], host))
+	}
+	return lines
+}
+
+// appendLines appends the lines missing from the config file, returning them
+func appendLines(path string, lines []string) ([]string, error) {
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	have := make(map[string]bool)
+	for _, line := range strings.Split(string(old), "\n") {
+		have[strings.TrimSpace(line)] = true
+	}
+	var added []string
+	for _, line := range lines {
+		if !have[line] {
+			added = append(added, line)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	text := strings.Join(added, "\n") + "\n"
+	if len(old) > 0 && old[len(old)-1] != '\n' {
+		text = "\n" + text
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(text)
+	return added, err
+}
+
+// runGenerate implements `generate -network <name>`
+func runGenerate() {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", configFile, "config file appended to")
+	network := fs.String("network", "", "docker network to generate the config of")
+	expose := fs.String("expose", "", "expose listener giving the network to others, e.g. 0.0.0.0:2512")
+	domain := fs.String("domain", "docker", "domain naming the containers, empty for none")
+	appendTo := fs.Bool("append", false, "append the lines missing from the config instead of printing them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s generate -network <name> [-expose addr:port] [-domain docker] [-append -config file]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	if *network == "" {
+		*network = fs.Arg(0)
+	}
+	if *network == "" || (*appendTo && configFile == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	n, err := inspectNetwork(*network)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to inspect %s => %v\n", *network, err)
+		os.Exit(1)
+	}
+	lines := networkConfig(n, *expose, strings.TrimPrefix(*domain, "."))
+	if !*appendTo {
+		fmt.Println(strings.Join(lines, "\n"))
+		return
+	}
+	added, err := appendLines(configFile, lines)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to append to %s => %v\n", configFile, err)
+		os.Exit(1)
+	}
+	if len(added) == 0 {
+		fmt.Printf("%s => up to date\n", configFile)
+		return
+	}
+	fmt.Printf("%s => appended\n", configFile)
+	for _, line := range added {
+		fmt.Printf("    %s\n", line)
+	}
+}
@@ -6,6 +6,9 @@ require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/kardianos/service v1.2.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
-	golang.org/x/sys v0.0.0-20210611083646-a4fc73990273 // indirect
+	golang.org/x/crypto v0.18.0
+	golang.org/x/net v0.20.0
+	golang.zx2c4.com/wireguard v0.0.20200121
 )
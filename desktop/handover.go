@@ -0,0 +1,492 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// `upgrade [<release binary>]` replaces the binary, like `update`, and has
+// the running connector start it with `-takeover` instead of restarting: the
+// new connector asks the old one for its UDP socket and TUN on the handover
+// socket of the state dir, the descriptors being passed over it, the old one
+// then stops without removing the TUN, its routes nor its DNS, and the new
+// one goes on with them, re-reading the saved peer, the journal of the routes
+// and the pins from the state dir, so the sessions of the containers aren't
+// dropped. The running connector only ever starts the binary it was started
+// from, which `upgrade` replaced after checking the release, whatever asks
+// for the upgrade. The new connector failing to take over within handoverTimeout is
+// killed and the old one keeps running. Under systemd the old connector hands
+// the main pid to the new one, under launchd the daemon started with
+// `-takeover` takes over from the upgraded one when relaunched. The TUNs of
+// the routes, WireGuard, the encapsulations and the ssh transport aren't
+// handed over, nor is anything on windows.
+const (
+	handoverFileName = "desktop-docker-connector.sock"
+	handoverTimeout  = 30 * time.Second
+)
+
+var (
+	// takeover takes over from the running connector
+	takeover = false
+	// handingOver stops leaving the TUN, the routes and the DNS up
+	handingOver = false
+	// HandoverFile is the socket handing over the running connector
+	HandoverFile = ""
+	// startedExe is the binary the connector was started from, started again
+	// by an upgrade once replaced
+	startedExe = ""
+	// handedUDP and handedTUN are the socket and TUN taken over, used once
+	handedUDP    *net.UDPConn
+	handedTUN    tunDevice
+	handedClient *net.UDPAddr
+)
+
+// handoverRequest is sent to the running connector, to upgrade it or to take
+// over from it
+type handoverRequest struct {
+	Upgrade bool `json:"upgrade,omitempty"`
+	Pid     int  `json:"pid,omitempty"`
+}
+
+// handoverReply describes the descriptors passed with it, or the pid that
+// took over
+type handoverReply struct {
+	Error  string `json:"error,omitempty"`
+	Pid    int    `json:"pid,omitempty"`
+	UDP    bool   `json:"udp,omitempty"`
+	TUN    string `json:"tun,omitempty"`
+	UTUN   bool   `json:"utun,omitempty"`
+	TAP    bool   `json:"tap,omitempty"`
+	Client string `json:"client,omitempty"`
+}
+
+type handoverState struct {
+	sync.Mutex
+	ln net.Listener
+	// upgrading is the pid started by an upgrade, told when it took over
+	upgrading int
+	tookOver  chan struct{}
+}
+
+var handover = &handoverState{}
+
+// writeHandover sends a message and the descriptors of files
+func writeHandover(c *net.UnixConn, v interface{}, files ...*os.File) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i] = int(f.Fd())
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	_, _, err = c.WriteMsgUnix(data, oob, nil)
+	return err
+}
+
+// readHandover receives a message and the descriptors passed with it
+func readHandover(c *net.UnixConn, v interface{}) ([]*os.File, error) {
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handover"))
+		}
+	}
+	return files, json.Unmarshal(buf[:n], v)
+}
+
+// tunFile returns the file of a TUN, the utun of macOS being opened by the
+// connector and the TUN of linux and the tap of tuntaposx by water
+func tunFile(dev tunDevice) (*os.File, bool, error) {
+	if t, ok := dev.(*tapDevice); ok {
+		dev = t.dev
+	}
+	switch d := dev.(type) {
+	case *fileTUN:
+		return d.File, d.utun, nil
+	case *water.Interface:
+		if f, ok := d.ReadWriteCloser.(*os.File); ok {
+			return f, false, nil
+		}
+	}
+	return nil, false, fmt.Errorf("the TUN %s can't be handed over", dev.Name())
+}
+
+// fileTUN is a TUN kept as its file, opened by the connector or taken over
+type fileTUN struct {
+	*os.File
+	name string
+	// utun reads and writes the header of the address family
+	utun bool
+	rbuf []byte
+	wbuf []byte
+	rmu  sync.Mutex
+	wmu  sync.Mutex
+}
+
+func (d *fileTUN) Name() string {
+	return d.name
+}
+
+func (d *fileTUN) Read(p []byte) (int, error) {
+	if !d.utun {
+		return d.File.Read(p)
+	}
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+	if cap(d.rbuf) < len(p)+4 {
+		d.rbuf = make([]byte, len(p)+4)
+	}
+	n, err := d.File.Read(d.rbuf[:len(p)+4])
+	if n < 4 {
+		return 0, err
+	}
+	return copy(p, d.rbuf[4:n]), err
+}
+
+func (d *fileTUN) Write(p []byte) (int, error) {
+	if !d.utun {
+		return d.File.Write(p)
+	}
+	if len(p) == 0 {
+		return 0, syscall.EIO
+	}
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if cap(d.wbuf) < len(p)+4 {
+		d.wbuf = make([]byte, len(p)+4)
+	}
+	d.wbuf = d.wbuf[:len(p)+4]
+	d.wbuf[0], d.wbuf[1], d.wbuf[2], d.wbuf[3] = 0, 0, 0, syscall.AF_INET
+	if p[0]>>4 == 6 {
+		d.wbuf[3] = syscall.AF_INET6
+	}
+	copy(d.wbuf[4:], p)
+	n, err := d.File.Write(d.wbuf)
+	if n < 4 {
+		return 0, err
+	}
+	return n - 4, err
+}
+
+// listenHandover creates the handover socket in a directory of root only,
+// chmodded to root before it is moved in place, so no one else connects to it
+// meanwhile
+func listenHandover() (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(HandoverFile), ".handover")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, handoverFileName)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// stopHandover removes the socket by the name it is moved to
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(path, 0600); err == nil {
+		err = os.Rename(path, HandoverFile)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// startHandover serves the handover socket of the running connector
+func startHandover(c *Connector) {
+	if exe, err := os.Executable(); err == nil {
+		startedExe = exe
+	}
+	os.Remove(HandoverFile)
+	ln, err := listenHandover()
+	if err != nil {
+		logger.Warningf("[HANDOVER] failed to listen %s => %v", HandoverFile, err)
+		return
+	}
+	handover.Lock()
+	handover.ln = ln
+	handover.Unlock()
+	go func() {
+		for {
+			uc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go c.serveHandover(uc.(*net.UnixConn))
+		}
+	}()
+}
+
+func stopHandover() {
+	handover.Lock()
+	defer handover.Unlock()
+	if handover.ln != nil {
+		handover.ln.Close()
+		handover.ln = nil
+		os.Remove(HandoverFile)
+	}
+}
+
+// serveHandover answers an upgrade or hands over to a new connector
+func (c *Connector) serveHandover(uc *net.UnixConn) {
+	defer uc.Close()
+	var req handoverRequest
+	if _, err := readHandover(uc, &req); err != nil {
+		logger.Warningf("[HANDOVER] Invalid request: %v", err)
+		return
+	}
+	if req.Upgrade {
+		writeHandover(uc, c.upgrade())
+		return
+	}
+	if req.Pid == 0 {
+		return
+	}
+	if err := c.handOver(uc, req.Pid); err != nil {
+		logger.Warningf("[HANDOVER] Not handed over to pid %d: %v", req.Pid, err)
+		writeHandover(uc, &handoverReply{Error: err.Error()})
+		return
+	}
+	handover.Lock()
+	defer handover.Unlock()
+	if handover.upgrading == req.Pid {
+		// the upgrade answers before exiting
+		close(handover.tookOver)
+		return
+	}
+	os.Exit(0)
+}
+
+// handOver passes the socket and the TUN to the connector of pid, then stops
+// leaving them up
+func (c *Connector) handOver(uc *net.UnixConn, pid int) error {
+	switch {
+	case conn == nil:
+		return fmt.Errorf("no UDP socket")
+	case transport != transportUDP:
+		return fmt.Errorf("the %s transport can't be handed over", transport)
+	case len(routeTUNs.Status()) > 0:
+		return fmt.Errorf("the TUNs of the routes can't be handed over")
+	}
+	rep := &handoverReply{Pid: os.Getpid(), UDP: true, TAP: tapMode}
+	udp, err := conn.File()
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+	files := []*os.File{udp}
+	if c.iface != nil {
+		f, utun, err := tunFile(c.iface)
+		if err != nil {
+			return err
+		}
+		rep.TUN, rep.UTUN = c.iface.Name(), utun
+		files = append(files, f)
+	}
+	if cli := shared.Client(); cli != nil {
+		rep.Client = cli.String()
+	}
+	if err := writeHandover(uc, rep, files...); err != nil {
+		return err
+	}
+	logger.Infof("[HANDOVER] Handing over %v and %s to pid %d", conn.LocalAddr(), rep.TUN, pid)
+	handingOver = true
+	c.Stop(nil)
+	// the new connector is the main process of the service
+	sdNotify(fmt.Sprintf("MAINPID=%d", pid))
+	writeHandover(uc, &handoverReply{Pid: pid})
+	events.Add("handover", "handed over to pid %d", pid)
+	logger.Infof("[HANDOVER] Handed over to pid %d", pid)
+	return nil
+}
+
+// upgrade starts the binary of this connector, replaced by `upgrade`, taking
+// over from it, and answers once done
+func (c *Connector) upgrade() *handoverReply {
+	exe := startedExe
+	if exe == "" {
+		return &handoverReply{Error: "the binary of the connector is unknown"}
+	}
+	args := []string{"-takeover"}
+	for _, arg := range os.Args[1:] {
+		if name := strings.TrimLeft(arg, "-"); name != "takeover" && !strings.HasPrefix(name, "takeover=") {
+			args = append(args, arg)
+		}
+	}
+	cmd := exec.Command(exe, instanceArguments(args)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// not stopped with the process group of the old connector
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	handover.Lock()
+	if handover.upgrading != 0 {
+		handover.Unlock()
+		return &handoverReply{Error: fmt.Sprintf("upgrade to pid %d in progress", handover.upgrading)}
+	}
+	if err := cmd.Start(); err != nil {
+		handover.Unlock()
+		return &handoverReply{Error: err.Error()}
+	}
+	pid := cmd.Process.Pid
+	handover.upgrading, handover.tookOver = pid, make(chan struct{})
+	tookOver := handover.tookOver
+	handover.Unlock()
+	logger.Infof("[HANDOVER] Upgrading to %s, pid %d", exe, pid)
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	var err error
+	select {
+	case <-tookOver:
+		go func() {
+			// let the answer go out
+			time.Sleep(100 * time.Millisecond)
+			os.Exit(0)
+		}()
+		return &handoverReply{Pid: pid}
+	case err = <-exited:
+		err = fmt.Errorf("pid %d exited: %v", pid, err)
+	case <-time.After(handoverTimeout):
+		cmd.Process.Kill()
+		err = fmt.Errorf("pid %d didn't take over within %v", pid, handoverTimeout)
+	}
+	handover.Lock()
+	handover.upgrading = 0
+	handover.Unlock()
+	logger.Warningf("[HANDOVER] Upgrade failed, still running: %v", err)
+	return &handoverReply{Error: err.Error()}
+}
+
+// takeOver receives the socket and the TUN of the running connector of
+// `-takeover`, starting from scratch without one
+func takeOver() {
+	if !takeover {
+		return
+	}
+	c, err := net.Dial("unix", HandoverFile)
+	if err != nil {
+		logger.Infof("[HANDOVER] No connector to take over: %v", err)
+		return
+	}
+	uc := c.(*net.UnixConn)
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(handoverTimeout))
+	if err := writeHandover(uc, &handoverRequest{Pid: os.Getpid()}); err != nil {
+		logger.Fatalf("[HANDOVER] %v", err)
+	}
+	var rep handoverReply
+	files, err := readHandover(uc, &rep)
+	if err == nil && rep.Error != "" {
+		err = fmt.Errorf("%s", rep.Error)
+	}
+	want := 1
+	if rep.TUN != "" {
+		want++
+	}
+	if err == nil && len(files) != want {
+		err = fmt.Errorf("%d descriptors passed, %d expected", len(files), want)
+	}
+	if err != nil {
+		// the old connector keeps the port and the TUN
+		logger.Fatalf("[HANDOVER] Failed to take over from %s => %v", HandoverFile, err)
+	}
+	pc, err := net.FilePacketConn(files[0])
+	files[0].Close()
+	if err != nil {
+		logger.Fatalf("[HANDOVER] Passed socket unusable: %v", err)
+	}
+	handedUDP = pc.(*net.UDPConn)
+	if rep.TUN != "" {
+		handedTUN = &fileTUN{File: files[1], name: rep.TUN, utun: rep.UTUN}
+		if rep.TAP {
+			handedTUN = newTAP(handedTUN)
+		}
+	}
+	if rep.Client != "" {
+		handedClient, _ = net.ResolveUDPAddr("udp", rep.Client)
+	}
+	var done handoverReply
+	if _, err := readHandover(uc, &done); err != nil || done.Pid != os.Getpid() {
+		logger.Fatalf("[HANDOVER] Pid %d didn't release => %v", rep.Pid, err)
+	}
+	logger.Infof("[HANDOVER] Took over %v and %s from pid %d", handedUDP.LocalAddr(), rep.TUN, rep.Pid)
+}
+
+// runUpgrade implements `upgrade`
+func runUpgrade() {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	fs.BoolVar(&allowUnsigned, "allow-unsigned", allowUnsigned, "upgrade without a valid signed manifest")
+	fs.StringVar(&stateDir, "state-dir", stateDir, "directory of the state of the running connector")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s upgrade [-allow-unsigned] [<extracted release binary>]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	statePaths()
+	old := runningPid()
+	if old == 0 {
+		fmt.Fprintf(os.Stderr, "no running connector to upgrade, use update\n")
+		os.Exit(1)
+	}
+	c, err := net.Dial("unix", HandoverFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reach pid %d => %v\n", old, err)
+		os.Exit(1)
+	}
+	uc := c.(*net.UnixConn)
+	defer uc.Close()
+	if fs.NArg() == 1 {
+		installRelease(fs.Arg(0))
+	}
+	uc.SetDeadline(time.Now().Add(handoverTimeout + 10*time.Second))
+	var rep handoverReply
+	if err := writeHandover(uc, &handoverRequest{Upgrade: true}); err == nil {
+		_, err = readHandover(uc, &rep)
+		if err == nil && rep.Error != "" {
+			err = fmt.Errorf("%s", rep.Error)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to upgrade pid %d => %v\n", old, err)
+		os.Exit(1)
+	}
+	fmt.Printf("upgraded => pid %d took over from pid %d\n", rep.Pid, old)
+}
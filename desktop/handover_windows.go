@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// The descriptors of the socket and the wintun adapter can't be passed to
+// another process, `upgrade` and `-takeover` are unavailable on windows.
+const handoverFileName = "desktop-docker-connector.sock"
+
+var (
+	takeover     = false
+	handingOver  = false
+	HandoverFile = ""
+	handedUDP    *net.UDPConn
+	handedTUN    tunDevice
+	handedClient *net.UDPAddr
+)
+
+func startHandover(c *Connector) {}
+
+func stopHandover() {}
+
+func takeOver() {
+	if takeover {
+		logger.Warningf("[HANDOVER] -takeover is unavailable on windows, starting")
+	}
+}
+
+func runUpgrade() {
+	fmt.Fprintf(os.Stderr, "upgrade is unavailable on windows, use update\n")
+	os.Exit(1)
+}
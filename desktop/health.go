@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// `/healthz` of the admin API answers 200 when the connector works and 503
+// otherwise: the TUN exists (unless `-bind=false`), the UDP socket is bound
+// and a packet of the docker side was seen within `-health-within`, counted
+// from the start until the first one. `healthcheck` queries it for scripts,
+// and `-exit-unhealthy` exits once unhealthy for that long, so launchd or
+// systemd restart a wedged connector.
+var (
+	healthWithin  = time.Minute
+	exitUnhealthy time.Duration
+)
+
+// Health is the answer of `/healthz`
+type Health struct {
+	Healthy   bool     `json:"healthy"`
+	Interface bool     `json:"interface"`
+	Socket    bool     `json:"socket"`
+	LastSeen  string   `json:"last_seen,omitempty"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+func checkHealth(c *Connector) *Health {
+	h := &Health{Socket: conn != nil}
+	if c != nil && c.iface != nil {
+		h.Interface = true
+	}
+	if bind && !h.Interface {
+		h.Problems = append(h.Problems, "no interface")
+	}
+	if !h.Socket {
+		h.Problems = append(h.Problems, "udp socket not bound")
+	}
+	since := startTime
+	if seen := atomic.LoadInt64(&lastSeen); seen != 0 {
+		since = time.Unix(0, seen)
+		h.LastSeen = since.Format(time.RFC3339)
+	}
+	if healthWithin > 0 && time.Since(since) > healthWithin {
+		h.Problems = append(h.Problems, fmt.Sprintf("docker side silent for %v", time.Since(since).Round(time.Second)))
+	}
+	h.Healthy = len(h.Problems) == 0
+	return h
+}
+
+func serveHealth(c *Connector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := checkHealth(c)
+		if !h.Healthy {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, h)
+	}
+}
+
+// watchHealth exits once unhealthy for `exitUnhealthy`
+func (c *Connector) watchHealth() {
+	if exitUnhealthy <= 0 {
+		return
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var since time.Time
+	for {
+		select {
+		case <-ticker.C:
+			h := checkHealth(c)
+			if h.Healthy || isIdle() {
+				since = time.Time{}
+				continue
+			}
+			if since.IsZero() {
+				since = time.Now()
+				logHealth.Warningf("[HEALTH] Unhealthy: %v", h.Problems)
+			}
+			if time.Since(since) >= exitUnhealthy {
+				logHealth.Errorf("[HEALTH] Unhealthy for %v, exiting: %v", exitUnhealthy, h.Problems)
+				os.Exit(1)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// runHealthcheck implements `healthcheck`, exiting 1 when unhealthy
+func runHealthcheck() {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	client := &http.Client{Timeout: 5 * time.Second}
+	rsp, err := client.Get(fmt.Sprintf("http://%s/healthz", adminAddr))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	body, _ := ioutil.ReadAll(rsp.Body)
+	os.Stdout.Write(body)
+	if rsp.StatusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
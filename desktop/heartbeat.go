@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// Heartbeats from the docker side are either a single zero byte (legacy) or
+//
+//	0 | t1 | echoT1 | t4
+//
+// where t1 is the send time of this heartbeat and echoT1/t4 report when the
+// reply to a previous heartbeat was received. The desktop replies with
+//
+//	0 | t1 | t2 | t3 | flags
+//
+// so that after one round trip all four NTP style timestamps are known here,
+// the flags telling the docker side the desktop knows the sessions.
+const (
+	heartbeatLen = 1 + 8*3
+	clockWindow  = 32
+	// resyncRequest is sent by a reconnected docker side to get the controls
+	resyncRequest = connector.ResyncRequest
+)
+
+type clockSample struct {
+	rtt    int64
+	offset int64
+	up     int64 // t2 - t1, docker => desktop including clock offset
+	down   int64 // t4 - t3, desktop => docker including clock offset
+}
+
+// ClockStatus is the estimated clock skew and one-way delays between peers
+type ClockStatus struct {
+	Samples         int     `json:"samples"`
+	RttMs           float64 `json:"rtt_ms"`
+	MinRttMs        float64 `json:"min_rtt_ms"`
+	SkewMs          float64 `json:"skew_ms"`
+	DockerToDesktop float64 `json:"docker_to_desktop_ms"`
+	DesktopToDocker float64 `json:"desktop_to_docker_ms"`
+}
+
+type clockEstimator struct {
+	sync.Mutex
+	pending map[int64][2]int64
+	samples []clockSample
+}
+
+var clock = &clockEstimator{pending: make(map[int64][2]int64)}
+
+func readStamp(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func putStamp(b []byte, v int64) {
+	binary.BigEndian.PutUint64(b, uint64(v))
+}
+
+// handleHeartbeat records the timestamps of a heartbeat and returns the reply,
+// or nil for legacy heartbeats without timestamps.
+func (e *clockEstimator) handleHeartbeat(data []byte, t2 int64) []byte {
+	atomic.AddUint64(&heartbeatCount, 1)
+	if len(data) < heartbeatLen {
+		return nil
+	}
+	t1 := readStamp(data[1:])
+	echoT1 := readStamp(data[9:])
+	t4 := readStamp(data[17:])
+	e.Lock()
+	if times, ok := e.pending[echoT1]; ok && t4 != 0 {
+		e.add(echoT1, times[0], times[1], t4)
+	}
+	if len(e.pending) >= clockWindow {
+		e.pending = make(map[int64][2]int64)
+	}
+	t3 := time.Now().UnixNano()
+	e.pending[t1] = [2]int64{t2, t3}
+	e.Unlock()
+	reply := make([]byte, heartbeatLen+1)
+	reply[heartbeatLen] = desktopSessions | desktopIdentity
+	putStamp(reply[1:], t1)
+	putStamp(reply[9:], t2)
+	putStamp(reply[17:], t3)
+	return reply
+}
+
+func (e *clockEstimator) add(t1, t2, t3, t4 int64) {
+	s := clockSample{
+		rtt:    (t4 - t1) - (t3 - t2),
+		offset: ((t2 - t1) + (t3 - t4)) / 2,
+		up:     t2 - t1,
+		down:   t4 - t3,
+	}
+	if s.rtt < 0 {
+		return
+	}
+	e.samples = append(e.samples, s)
+	if len(e.samples) > clockWindow {
+		e.samples = e.samples[1:]
+	}
+	logHealth.Debugf("[HEARTBEAT] rtt => %v, offset => %v", time.Duration(s.rtt), time.Duration(s.offset))
+}
+
+// Status estimates the skew from the sample with the lowest round trip, which
+// is the least affected by queuing, and applies it to the latest sample so
+// that a stalled direction shows up as an asymmetric one-way delay.
+func (e *clockEstimator) Status() *ClockStatus {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.samples) == 0 {
+		return nil
+	}
+	best := e.samples[0]
+	for _, s := range e.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	last := e.samples[len(e.samples)-1]
+	return &ClockStatus{
+		Samples:         len(e.samples),
+		RttMs:           millis(last.rtt),
+		MinRttMs:        millis(best.rtt),
+		SkewMs:          millis(best.offset),
+		DockerToDesktop: millis(last.up - best.offset),
+		DesktopToDocker: millis(last.down + best.offset),
+	}
+}
+
+func (e *clockEstimator) Reset() {
+	e.Lock()
+	e.pending = make(map[int64][2]int64)
+	e.samples = nil
+	e.Unlock()
+}
+
+func millis(ns int64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
+
+// lastSeen is the time in unix nanoseconds of the last packet from the client
+var lastSeen int64
+
+func touchPeer() {
+	atomic.StoreInt64(&lastSeen, time.Now().UnixNano())
+	wakeIdle()
+}
+
+// watchPeer declares the client dead after `deadAfter` heartbeat intervals
+// without any packet from it, so TUN traffic is no longer sent into the void.
+// A reload changing `heartbeat` takes effect at the next tick.
+func (c *Connector) watchPeer() {
+	interval := time.Duration(heartbeat) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-ticker.C:
+			if d := time.Duration(heartbeat) * time.Millisecond; d > 0 && d != interval {
+				interval = d
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+			seen := atomic.LoadInt64(&lastSeen)
+			cli := shared.Client()
+			if isIdle() || heartbeat <= 0 || deadAfter <= 0 || cli == nil || seen == 0 {
+				continue
+			}
+			silent := time.Since(time.Unix(0, seen))
+			if silent < interval*time.Duration(deadAfter) {
+				continue
+			}
+			if cliAddr != "" {
+				logTransport.Warningf("[CLIENT] Configured client %v silent for %v", cli, silent.Round(time.Second))
+				resolveSoon()
+				continue
+			}
+			logTransport.Warningf("[CLIENT] Client %v dead, no heartbeat for %v", cli, silent.Round(time.Second))
+			hooks.Fire(hookClientDisconnect, "CONNECTOR_CLIENT="+cli.String(), "CONNECTOR_REASON=dead")
+			shared.ClearClient(cli)
+			atomic.StoreInt32(&c.peerDead, 1)
+			dataSession.End()
+			ctlSession.End()
+			peerStats.End("dead")
+			clock.Reset()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
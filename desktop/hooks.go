@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hooks run a command of the user on the events of the tunnel, e.g. to send
+// a notification, mount a share or restart a service once the docker side is
+// up:
+//
+//	on-client-connect osascript -e 'display notification "docker up"'
+//	on-client-disconnect /usr/local/bin/umount-shares
+//	on-route-change /usr/local/bin/routes-changed
+//	on-route-error /usr/local/bin/route-failed
+//	on-daily-summary /usr/local/bin/report-traffic
+//
+// The command runs through the shell, `sh -c` or `cmd /C` on windows, in the
+// background and for at most `hookTimeout`, with the event described by
+//
+//	CONNECTOR_EVENT         client-connect, client-disconnect, route-change, route-error or daily-summary
+//	CONNECTOR_CLIENT        the address of the docker side
+//	CONNECTOR_PREVIOUS      the previous address on a change of the docker side
+//	CONNECTOR_REASON        dead or changed on a disconnect
+//	CONNECTOR_ROUTE         the route on a route-change
+//	CONNECTOR_ROUTE_ACTION  add or del
+//	CONNECTOR_ERROR         permission, conflict, not-found or error on a route-error
+//	CONNECTOR_ERROR_DETAIL  the error of the system
+//	CONNECTOR_ROUTES        the installed routes, separated by spaces
+//	CONNECTOR_INTERFACE     the TUN
+//
+// and the variables of the day described by metrics.go on a daily-summary.
+const (
+	hookClientConnect    = "on-client-connect"
+	hookClientDisconnect = "on-client-disconnect"
+	hookRouteChange      = "on-route-change"
+	hookRouteError       = "on-route-error"
+	hookTimeout          = time.Minute
+)
+
+// Like the up and down scripts of OpenVPN, `up-script` runs once the TUN is
+// configured and its routes installed, and `down-script` when stopping,
+// before the routes are removed, e.g. to load pf rules or set a DNS tied to
+// the tunnel. Both are waited for, at most `hookTimeout`, and get
+//
+//	<script> up|down <interface> <local ip> <peer ip> <subnet>...
+//
+// with CONNECTOR_EVENT, CONNECTOR_INTERFACE, CONNECTOR_LOCAL, CONNECTOR_PEER
+// and CONNECTOR_ROUTES set alike.
+var (
+	upScript   = ""
+	downScript = ""
+)
+
+type hookRunner struct {
+	sync.Mutex
+	commands map[string]string
+	// installed are the routes last reported to on-route-change
+	installed map[string]bool
+}
+
+var hooks = &hookRunner{installed: make(map[string]bool)}
+
+// Set replaces the commands of the config
+func (h *hookRunner) Set(commands map[string]string) {
+	h.Lock()
+	h.commands = commands
+	h.Unlock()
+}
+
+// Fire runs the command of an event, if any, with its variables
+func (h *hookRunner) Fire(event string, env ...string) {
+	var detail []string
+	for _, v := range env {
+		if !strings.HasPrefix(v, "CONNECTOR_ROUTES=") && !strings.HasPrefix(v, "CONNECTOR_SUMMARY=") {
+			detail = append(detail, strings.TrimPrefix(v, "CONNECTOR_"))
+		}
+	}
+	events.Add(strings.TrimPrefix(event, "on-"), "%s", strings.Join(detail, " "))
+	h.Lock()
+	command := h.commands[event]
+	h.Unlock()
+	if command == "" {
+		return
+	}
+	env = append(env, "CONNECTOR_EVENT="+strings.TrimPrefix(event, "on-"), "CONNECTOR_INTERFACE="+tunIfName)
+	go runHook(event, command, env)
+}
+
+// Routes fires on-route-change for each route installed or removed since the
+// last call, with configLock held
+func (h *hookRunner) Routes(current map[string]bool) {
+	var keys []string
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	all := "CONNECTOR_ROUTES=" + strings.Join(keys, " ")
+	h.Lock()
+	var added, removed []string
+	for _, key := range keys {
+		if !h.installed[key] {
+			added = append(added, key)
+		}
+	}
+	for key := range h.installed {
+		if _, ok := current[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	h.installed = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		h.installed[key] = true
+	}
+	h.Unlock()
+	sort.Strings(removed)
+	for _, key := range removed {
+		h.Fire(hookRouteChange, "CONNECTOR_ROUTE="+key, "CONNECTOR_ROUTE_ACTION=del", all)
+	}
+	for _, key := range added {
+		h.Fire(hookRouteChange, "CONNECTOR_ROUTE="+key, "CONNECTOR_ROUTE_ACTION=add", all)
+	}
+}
+
+// runHook runs a command of the user, logging its output
+func runHook(event, command string, env []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if text := strings.TrimSpace(string(out)); text != "" {
+		logger.Infof("[HOOK] %s => %s", event, text)
+	}
+	if err != nil {
+		logger.Warningf("[HOOK] %s failed => %s: %v", event, command, err)
+		return
+	}
+	logger.Debugf("[HOOK] %s done => %s", event, command)
+}
+
+// runScript runs `up-script` or `down-script` and waits for it
+func runScript(script, event, ifname string) {
+	if script == "" || ifname == "" {
+		return
+	}
+	var keys []string
+	for key := range shared.Routes() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	argv := strings.Fields(script)
+	args := append([]string{event, ifname, localIP.String(), peer.String()}, keys...)
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], append(argv[1:], args...)...)
+	cmd.Env = append(os.Environ(), "CONNECTOR_EVENT="+event, "CONNECTOR_INTERFACE="+ifname,
+		"CONNECTOR_LOCAL="+localIP.String(), "CONNECTOR_PEER="+peer.String(), "CONNECTOR_ROUTES="+strings.Join(keys, " "))
+	logger.Infof("[SCRIPT] %s => %s %s", event, script, strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	if text := strings.TrimSpace(string(out)); text != "" {
+		logger.Infof("[SCRIPT] %s => %s", event, text)
+	}
+	if err != nil {
+		logger.Warningf("[SCRIPT] %s failed => %s: %v", event, script, err)
+	}
+}
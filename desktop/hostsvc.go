@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `host-services` gives the services listening on the desktop a stable
+// address in the virtual network, like host.docker.internal but through the
+// tunnel, whatever `addr`:
+//
+//	host-services auto 3000,8080-8090
+//	host-services 192.168.251.200
+//
+// `auto` is the last address of the virtual network. The packets of the
+// containers to it are written to the TUN for the local IP and the replies
+// get it back as source, the flows being tracked like those of the ACL.
+// With ports only TCP and UDP to them and ICMP pass. The address is pushed to
+// the docker side as `host.desktop.internal`, answered by its dns server.
+const hostServicesName = "host.desktop.internal"
+
+type hostPortRange struct {
+	lo, hi int
+}
+
+// hostFlow is a flow of a container to a host service, proto, container
+// address and port and host port
+type hostFlow struct {
+	proto byte
+	ip    [4]byte
+	port  uint16
+	host  uint16
+}
+
+type hostServices struct {
+	sync.Mutex
+	ip     net.IP
+	ports  []hostPortRange
+	flows  map[hostFlow]time.Time
+	denied uint64
+}
+
+var hostSvc = &hostServices{flows: make(map[hostFlow]time.Time)}
+
+// HostServicesStatus reports the address of the host services and their use
+type HostServicesStatus struct {
+	IP     string `json:"ip"`
+	Ports  string `json:"ports,omitempty"`
+	Flows  int    `json:"flows"`
+	Denied uint64 `json:"denied"`
+}
+
+// parseHostServices parses the value of `host-services`
+func parseHostServices(val string, subnet *net.IPNet) (net.IP, []hostPortRange, error) {
+	vals := strings.Fields(val)
+	if len(vals) == 0 || len(vals) > 2 {
+		return nil, nil, fmt.Errorf("expected <ip|auto> [ports]")
+	}
+	var ip net.IP
+	if vals[0] == "auto" {
+		if subnet == nil || subnet.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("no virtual network")
+		}
+		ip = make(net.IP, 4)
+		for i := range ip {
+			ip[i] = subnet.IP.To4()[i] | ^subnet.Mask[i]
+		}
+		ip[3]--
+	} else if ip = net.ParseIP(vals[0]).To4(); ip == nil {
+		return nil, nil, fmt.Errorf("invalid address %s", vals[0])
+	}
+	if subnet != nil && !subnet.Contains(ip) {
+		return nil, nil, fmt.Errorf("%s is out of %s", ip, subnet)
+	}
+	var ports []hostPortRange
+	if len(vals) == 2 {
+		for _, s := range strings.Split(vals[1], ",") {
+			bounds := strings.SplitN(s, "-", 2)
+			lo, err := strconv.Atoi(bounds[0])
+			hi := lo
+			if err == nil && len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil || lo <= 0 || hi < lo || hi > 65535 {
+				return nil, nil, fmt.Errorf("invalid ports %s", s)
+			}
+			ports = append(ports, hostPortRange{lo, hi})
+		}
+	}
+	return ip, ports, nil
+}
+
+// Set replaces the address and the ports, nil to disable
+func (h *hostServices) Set(ip net.IP, ports []hostPortRange) {
+	h.Lock()
+	defer h.Unlock()
+	if !ip.Equal(h.ip) {
+		if ip != nil {
+			logExpose.Infof("[HOST SERVICES] Desktop services at %s", ip)
+		}
+		h.flows = make(map[hostFlow]time.Time)
+	}
+	h.ip, h.ports = ip, ports
+}
+
+// IP returns the address, nil when disabled
+func (h *hostServices) IP() net.IP {
+	h.Lock()
+	defer h.Unlock()
+	return h.ip
+}
+
+func (h *hostServices) allowed(port int) bool {
+	if len(h.ports) == 0 {
+		return true
+	}
+	for _, r := range h.ports {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// hostFlowPorts returns the source and destination ports of a TCP or UDP
+// packet, of its first fragment for a later one, the id of an ICMP echo as
+// both
+func hostFlowPorts(packet []byte) (uint16, uint16, bool) {
+	ihl := int(packet[0]&0x0f) * 4
+	switch packet[9] {
+	case 6, 17:
+		return l4Ports(packet)
+	case 1:
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return 0, 0, false
+		}
+		if len(packet) >= ihl+8 {
+			id := binary.BigEndian.Uint16(packet[ihl+4:])
+			return id, id, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Inbound rewrites a packet of a container to the host services for the
+// local IP, it returns false when the port isn't allowed
+func (h *hostServices) Inbound(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return true
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.ip == nil || !h.ip.Equal(packet[16:20]) {
+		return true
+	}
+	sport, dport, ok := hostFlowPorts(packet)
+	if !ok || packet[9] != 1 && !h.allowed(int(dport)) {
+		h.denied++
+		return false
+	}
+	key := hostFlow{proto: packet[9], port: sport, host: dport}
+	copy(key.ip[:], packet[12:16])
+	now := time.Now()
+	if _, seen := h.flows[key]; !seen && len(h.flows) >= flowMax {
+		for k, at := range h.flows {
+			if now.Sub(at) >= flowTimeout {
+				delete(h.flows, k)
+			}
+		}
+	}
+	h.flows[key] = now
+	rewriteAddr(packet, 16, localIP)
+	return true
+}
+
+// Outbound gives the replies of the host services their address as source
+func (h *hostServices) Outbound(packet []byte) {
+	if len(packet) < 20 || packet[0]>>4 != 4 || !localIP.Equal(packet[12:16]) {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.ip == nil {
+		return
+	}
+	sport, dport, ok := hostFlowPorts(packet)
+	if !ok {
+		return
+	}
+	key := hostFlow{proto: packet[9], port: dport, host: sport}
+	copy(key.ip[:], packet[16:20])
+	if at, seen := h.flows[key]; !seen || time.Since(at) >= flowTimeout {
+		return
+	}
+	h.flows[key] = time.Now()
+	rewriteAddr(packet, 12, h.ip)
+}
+
+// Status reports the host services, nil when disabled
+func (h *hostServices) Status() *HostServicesStatus {
+	h.Lock()
+	defer h.Unlock()
+	if h.ip == nil {
+		return nil
+	}
+	var ports []string
+	for _, r := range h.ports {
+		if r.lo == r.hi {
+			ports = append(ports, strconv.Itoa(r.lo))
+		} else {
+			ports = append(ports, fmt.Sprintf("%d-%d", r.lo, r.hi))
+		}
+	}
+	return &HostServicesStatus{IP: h.ip.String(), Ports: strings.Join(ports, ","), Flows: len(h.flows), Denied: h.denied}
+}
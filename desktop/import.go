@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// tailscaleRange is the CGNAT range of the tailscale addresses
+const tailscaleRange = "100.64.0.0/10"
+
+// overlaps returns whether the networks share addresses
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// excluded returns the exclude overlapping the route, or nil
+func excluded(route string, excludes []*net.IPNet) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(route)
+	if err != nil {
+		return nil
+	}
+	for _, ex := range excludes {
+		if overlaps(ipnet, ex) {
+			return ex
+		}
+	}
+	return nil
+}
+
+// splitRoute returns the parts of the route outside of the excludes, halving
+// it until each part is either clear of them or inside one, so the excludes
+// hold on every platform without routes of their own
+func splitRoute(route string, excludes []*net.IPNet) []string {
+	_, ipnet, err := net.ParseCIDR(route)
+	if err != nil {
+		return nil
+	}
+	var parts []string
+	var split func(n *net.IPNet)
+	split = func(n *net.IPNet) {
+		ones, bits := n.Mask.Size()
+		for _, ex := range excludes {
+			if !overlaps(n, ex) {
+				continue
+			}
+			if exOnes, _ := ex.Mask.Size(); exOnes <= ones {
+				return
+			}
+			mask := net.CIDRMask(ones+1, bits)
+			lo := &net.IPNet{IP: n.IP.Mask(mask), Mask: mask}
+			hi := &net.IPNet{IP: append(net.IP(nil), lo.IP...), Mask: mask}
+			hi.IP[ones/8] |= 0x80 >> uint(ones%8)
+			split(lo)
+			split(hi)
+			return
+		}
+		parts = append(parts, n.String())
+	}
+	split(ipnet)
+	return parts
+}
+
+// parseAllowedIPs collects the IPv4 CIDRs of comma or space separated lists
+func parseAllowedIPs(list string, nets map[string]bool) {
+	for _, s := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if _, ipnet, err := net.ParseCIDR(s); err == nil && ipnet.IP.To4() != nil {
+			nets[ipnet.String()] = true
+		}
+	}
+}
+
+// wireguardNets reads the AllowedIPs of a wireguard config, or of the running
+// interfaces with `wg show all allowed-ips` without a file
+func wireguardNets(file string) (map[string]bool, error) {
+	nets := make(map[string]bool)
+	if file == "" {
+		out, err := exec.Command("wg", "show", "all", "allowed-ips").Output()
+		if err != nil {
+			return nil, fmt.Errorf("wg show => %v", err)
+		}
+		// <interface> <public key> <cidr> <cidr>...
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) > 2 {
+				parseAllowedIPs(strings.Join(fields[2:], " "), nets)
+			}
+		}
+		return nets, nil
+	}
+	fi, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '='); i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "AllowedIPs") {
+			parseAllowedIPs(line[i+1:], nets)
+		}
+	}
+	return nets, scanner.Err()
+}
+
+// tailscaleNets reads the tailnet range and the subnets routed by the peers
+// from `tailscale status --json`
+func tailscaleNets() (map[string]bool, error) {
+	out, err := exec.Command("tailscale", "status", "--json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("tailscale status => %v", err)
+	}
+	var st struct {
+		Peer map[string]struct {
+			AllowedIPs    []string
+			PrimaryRoutes []string
+		}
+	}
+	if err := json.Unmarshal(out, &st); err != nil {
+		return nil, err
+	}
+	nets := map[string]bool{tailscaleRange: true}
+	for _, p := range st.Peer {
+		parseAllowedIPs(strings.Join(p.AllowedIPs, ","), nets)
+		parseAllowedIPs(strings.Join(p.PrimaryRoutes, ","), nets)
+	}
+	return nets, nil
+}
+
+// runImport prints `exclude` lines for the ranges of a wireguard or tailscale
+// setup, and the configured routes fighting with them.
+func runImport() {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", configFile, "config file to check the routes of")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s import [-config file] wireguard [wg.conf] | tailscale\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	var nets map[string]bool
+	var err error
+	source := fs.Arg(0)
+	switch source {
+	case "wireguard", "wg":
+		source = "wireguard"
+		nets, err = wireguardNets(fs.Arg(1))
+	case "tailscale":
+		nets, err = tailscaleNets()
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s => %v\n", source, err)
+		os.Exit(1)
+	}
+	var excludes []*net.IPNet
+	for key := range nets {
+		_, ipnet, _ := net.ParseCIDR(key)
+		excludes = append(excludes, ipnet)
+	}
+	// drop the networks covered by a larger one
+	sort.Slice(excludes, func(i, j int) bool {
+		oi, _ := excludes[i].Mask.Size()
+		oj, _ := excludes[j].Mask.Size()
+		return oi < oj
+	})
+	var kept []*net.IPNet
+	for _, ex := range excludes {
+		if excluded(ex.String(), kept) == nil {
+			kept = append(kept, ex)
+		}
+	}
+	fmt.Printf("# %s\n", source)
+	for _, ex := range kept {
+		fmt.Printf("exclude %s\n", ex)
+	}
+	if list, err := configRoutes(); err == nil {
+		for _, r := range list {
+			if ex := excluded(r.Route, kept); ex != nil && r.Enabled {
+				if parts := splitRoute(r.Route, kept); len(parts) == 0 {
+					fmt.Printf("# route %s is inside %s of %s and will be skipped\n", r.Route, ex, source)
+				} else {
+					fmt.Printf("# route %s overlaps %s of %s and will be split into %s\n", r.Route, ex, source, strings.Join(parts, " "))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// `-config` may be a directory, its `*.conf` files are then merged in lexical
+// order, and any file may `include conf.d/*.conf`, merging the matches in
+// lexical order right after the including file, relative to it. Teams drop their
+// route files in and out without editing a shared config; the changes made by
+// the connector (admin, pushed routes, config from the docker side) edit the
+// file holding the line, new lines go to the main file.
+const (
+	configExt = ".conf"
+	// mainConfigName is the main file of a config directory
+	mainConfigName = "connector" + configExt
+	includeDepth   = 8
+)
+
+var includeLine = regexp.MustCompile(`^\s*include\s+(.+?)\s*$`)
+
+// configSource is a file of the config and its lines
+type configSource struct {
+	file  string
+	lines []string
+	// exists is false for the main file of a directory not created yet
+	exists bool
+}
+
+// isConfigDir tells whether the config is a directory
+func isConfigDir() bool {
+	fi, err := os.Stat(configFile)
+	return err == nil && fi.IsDir()
+}
+
+// mainConfigFile returns the file where new lines go
+func mainConfigFile() string {
+	if isConfigDir() {
+		return filepath.Join(configFile, mainConfigName)
+	}
+	return configFile
+}
+
+// dirConfigFiles lists the `*.conf` files of a directory in lexical order
+func dirConfigFiles(dir string) []string {
+	infos, _ := ioutil.ReadDir(dir)
+	var files []string
+	for _, fi := range infos {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), configExt) && !strings.HasPrefix(fi.Name(), ".") {
+			files = append(files, filepath.Join(dir, fi.Name()))
+		}
+	}
+	return files
+}
+
+// readConfigSources reads the files of the config in the order they are
+// merged, the lines of an included file follow the file including it
+func readConfigSources() ([]*configSource, error) {
+	if configFile == "" {
+		return nil, os.ErrNotExist
+	}
+	var srcs []*configSource
+	seen := make(map[string]bool)
+	if isConfigDir() {
+		files := dirConfigFiles(configFile)
+		main, _ := filepath.Abs(mainConfigFile())
+		found := false
+		for _, file := range files {
+			if abs, _ := filepath.Abs(file); abs == main {
+				found = true
+			}
+		}
+		if !found {
+			srcs = append(srcs, &configSource{file: main})
+			seen[main] = true
+		}
+		for _, file := range files {
+			if err := readConfigSource(file, seen, 0, &srcs); err != nil {
+				return nil, err
+			}
+		}
+		return srcs, nil
+	}
+	if err := readConfigSource(configFile, seen, 0, &srcs); err != nil {
+		return nil, err
+	}
+	return srcs, nil
+}
+
+func readConfigSource(file string, seen map[string]bool, depth int, srcs *[]*configSource) error {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	if seen[file] {
+		return nil
+	}
+	seen[file] = true
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	src := &configSource{file: file, exists: true}
+	if text := strings.TrimRight(string(data), "\n"); text != "" {
+		src.lines = strings.Split(text, "\n")
+	}
+	*srcs = append(*srcs, src)
+	if depth >= includeDepth {
+		return nil
+	}
+	for _, line := range src.lines {
+		match := includeLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		pattern := match[1]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			logger.Warningf("invalid include => %s\n", match[1])
+			continue
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if err := readConfigSource(m, seen, depth+1, srcs); err != nil {
+				logger.Warningf("include %s error => %v\n", m, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mainConfigSource returns the source of the main file
+func mainConfigSource(srcs []*configSource) *configSource {
+	main, _ := filepath.Abs(mainConfigFile())
+	for _, src := range srcs {
+		if src.file == main {
+			return src
+		}
+	}
+	return srcs[0]
+}
+
+// mergeConfigSources returns the lines of the config, the includes expanded
+func mergeConfigSources(srcs []*configSource) []string {
+	var lines []string
+	for _, src := range srcs {
+		lines = append(lines, src.lines...)
+	}
+	return lines
+}
+
+// writeConfigSources writes the changed files, restoring them all when one
+// fails
+func writeConfigSources(srcs []*configSource, changed map[*configSource][]string) error {
+	var written []*configSource
+	for _, src := range srcs {
+		lines, ok := changed[src]
+		if !ok {
+			continue
+		}
+		if err := ioutil.WriteFile(src.file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			for _, w := range written {
+				var rerr error
+				if w.exists {
+					rerr = ioutil.WriteFile(w.file, []byte(strings.Join(w.lines, "\n")+"\n"), 0644)
+				} else {
+					rerr = os.Remove(w.file)
+				}
+				if rerr != nil {
+					logger.Errorf("Failed to restore %s: %v", w.file, rerr)
+				}
+			}
+			return err
+		}
+		written = append(written, src)
+	}
+	return nil
+}
+
+// configWatchPaths lists what the watcher follows: the config file or
+// directory, and the directories of the included files
+func configWatchPaths() []string {
+	paths := []string{configFile}
+	seen := map[string]bool{configFile: true}
+	srcs, _ := readConfigSources()
+	for _, src := range srcs {
+		for _, line := range src.lines {
+			match := includeLine.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			pattern := match[1]
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(src.file), pattern)
+			}
+			dir := filepath.Dir(pattern)
+			if !seen[dir] {
+				seen[dir] = true
+				paths = append(paths, dir)
+			}
+		}
+	}
+	return paths
+}
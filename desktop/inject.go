@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"docker-connector/pkg/connector"
+)
+
+// With `-dev-api` the admin API takes `POST /inject`, a packet crafted from a
+// JSON description, or given in hex, injected into a direction of the
+// pipeline as if read from the TUN (`out`) or received from the docker side
+// (`in`). The answer tells the middlewares it went through and where it
+// ended: `client`, `tun`, `session`, `loopback`, `ping`, `probe`, `netem`
+// (handed to the emulation) or `dropped`, with the middleware dropping it and
+// the ACL rule deciding. So the routing and the ACLs can be tested end to end
+// without real traffic, `docker-connector inject` being the client:
+//
+//	docker-connector inject -proto tcp -dst 172.18.0.5 -dport 22
+//
+// The packets are really sent, counted and tracked like the others.
+var devAPI = false
+
+// InjectRequest describes the packet to inject
+type InjectRequest struct {
+	Direction string `json:"direction"`
+	Proto     string `json:"proto,omitempty"`
+	Src       string `json:"src,omitempty"`
+	Dst       string `json:"dst,omitempty"`
+	Sport     int    `json:"sport,omitempty"`
+	Dport     int    `json:"dport,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+	// Hex is a whole IPv4 packet, the other fields but the direction ignored
+	Hex string `json:"hex,omitempty"`
+}
+
+// InjectResult tells the way of an injected packet
+type InjectResult struct {
+	Direction   string   `json:"direction"`
+	Packet      string   `json:"packet"`
+	Middlewares []string `json:"middlewares"`
+	Result      string   `json:"result"`
+	DroppedBy   string   `json:"dropped_by,omitempty"`
+	ACL         string   `json:"acl,omitempty"`
+	Detail      string   `json:"detail,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// buildInjectPacket crafts the IPv4 packet of a request, a TCP SYN, a UDP
+// datagram or an ICMP echo request
+func buildInjectPacket(req *InjectRequest) ([]byte, error) {
+	if req.Hex != "" {
+		packet, err := hex.DecodeString(strings.Join(strings.Fields(req.Hex), ""))
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) < 20 || packet[0]>>4 != 4 {
+			return nil, fmt.Errorf("not an IPv4 packet")
+		}
+		return packet, nil
+	}
+	local := localIP.String()
+	if req.Direction == "out" && req.Src == "" {
+		req.Src = local
+	}
+	if req.Direction == "in" && req.Dst == "" {
+		req.Dst = local
+	}
+	src, dst := net.ParseIP(req.Src).To4(), net.ParseIP(req.Dst).To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("expected the IPv4 addresses src and dst")
+	}
+	proto := req.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	var l4 []byte
+	payload := []byte(req.Payload)
+	switch proto {
+	case "tcp":
+		l4 = make([]byte, 20, 20+len(payload))
+		binary.BigEndian.PutUint32(l4[4:], rand.Uint32())
+		l4[12] = 5 << 4
+		l4[13] = tcpSYN
+		binary.BigEndian.PutUint16(l4[14:], probeWindow)
+	case "udp":
+		l4 = make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(l4[4:], uint16(8+len(payload)))
+	case "icmp":
+		l4 = make([]byte, 8, 8+len(payload))
+		l4[0] = 8
+		binary.BigEndian.PutUint16(l4[4:], uint16(rand.Intn(65536)))
+		binary.BigEndian.PutUint16(l4[6:], 1)
+	default:
+		return nil, fmt.Errorf("invalid proto %s, tcp, udp or icmp", proto)
+	}
+	if proto != "icmp" {
+		sport := req.Sport
+		if sport == 0 {
+			sport = 40000 + rand.Intn(20000)
+		}
+		if req.Dport <= 0 || req.Dport > 65535 || sport <= 0 || sport > 65535 {
+			return nil, fmt.Errorf("expected the ports of %s", proto)
+		}
+		binary.BigEndian.PutUint16(l4, uint16(sport))
+		binary.BigEndian.PutUint16(l4[2:], uint16(req.Dport))
+	}
+	l4 = append(l4, payload...)
+	packet := make([]byte, 20+len(l4))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:], uint16(rand.Intn(65536)))
+	packet[8] = 64
+	packet[9] = map[string]byte{"tcp": protoTCP, "udp": protoUDP, "icmp": protoICMP}[proto]
+	copy(packet[12:], src)
+	copy(packet[16:], dst)
+	copy(packet[20:], l4)
+	fixChecksums(packet)
+	return packet, nil
+}
+
+// describePacket summarizes a packet, e.g. tcp 192.168.251.2:40001 > 172.18.0.5:22
+func describePacket(packet []byte) string {
+	src, dst := net.IP(packet[12:16]).String(), net.IP(packet[16:20]).String()
+	ihl := int(packet[0]&0x0f) * 4
+	if (packet[9] == protoTCP || packet[9] == protoUDP) && len(packet) >= ihl+4 {
+		src += fmt.Sprintf(":%d", binary.BigEndian.Uint16(packet[ihl:]))
+		dst += fmt.Sprintf(":%d", binary.BigEndian.Uint16(packet[ihl+2:]))
+	}
+	return fmt.Sprintf("%s %s > %s", protoName(packet[9]), src, dst)
+}
+
+// middlewareName names a middleware after its function, e.g. acl
+func middlewareName(m connector.Middleware) string {
+	name := runtime.FuncForPC(reflect.ValueOf(m).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, "Middleware")
+}
+
+// runChain runs a chain, recording the middlewares passed and the one
+// dropping the packet
+func runChain(chain connector.Chain, packet []byte, dir connector.Direction, res *InjectResult) ([]byte, bool) {
+	for _, m := range chain {
+		name := middlewareName(m)
+		res.Middlewares = append(res.Middlewares, name)
+		var drop bool
+		if packet, drop = m(packet, dir); drop {
+			res.Result, res.DroppedBy = "dropped", name
+			if name == "netem" {
+				res.Result, res.DroppedBy = "netem", ""
+			}
+			return nil, true
+		}
+	}
+	return packet, false
+}
+
+// inject sends a packet down a direction of the pipeline
+func inject(c *Connector, packet []byte, direction string) *InjectResult {
+	res := &InjectResult{Direction: direction, Packet: describePacket(packet), Middlewares: []string{}}
+	res.ACL = acl.Explain(packet)
+	switch direction {
+	case "out":
+		if toLocalIP(packet) {
+			res.Result, res.Detail = "loopback", "loopback "+loopback
+			return res
+		}
+		hostSvc.Outbound(packet)
+		cli := shared.Client()
+		if cli == nil {
+			res.Result, res.DroppedBy = "dropped", "no_client"
+			return res
+		}
+		if packet, drop := runChain(outboundChain, packet, connector.Outbound, res); !drop {
+			sendClient(packet, cli)
+			res.Result, res.Detail = "client", cli.String()
+		}
+	case "in":
+		if deliverProbe(packet) {
+			res.Result = "probe"
+			return res
+		}
+		if answerPing(packet) {
+			res.Result = "ping"
+			return res
+		}
+		if sess := sessions.Lookup(toIntIP(packet, 16, 17, 18, 19)); sess != nil {
+			if _, err := sess.listener.conn.WriteToUDP(packet, sess.peer); err == nil {
+				atomic.AddUint64(&sess.txBytes, uint64(len(packet)))
+			}
+			res.Result, res.Detail = "session", sess.peer.String()
+			return res
+		}
+		if !bind || c.iface == nil {
+			res.Result, res.DroppedBy = "dropped", "no_tun"
+			return res
+		}
+		if packet, drop := runChain(inboundChain, packet, connector.Inbound, res); !drop {
+			dev := routeTUNs.For(packet, c.iface)
+			writeTUN(dev, packet)
+			res.Result, res.Detail = "tun", dev.Name()
+		}
+	default:
+		res.Error = "direction is out or in"
+	}
+	return res
+}
+
+// serveInject runs `POST /inject` with `-dev-api`
+func serveInject(c *Connector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !devAPI {
+			http.Error(w, "start with -dev-api to inject packets", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req InjectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packet, err := buildInjectPacket(&req)
+		if err != nil {
+			writeJSON(w, &InjectResult{Direction: req.Direction, Error: err.Error()})
+			return
+		}
+		writeJSON(w, inject(c, packet, req.Direction))
+	}
+}
+
+// runInjectCommand implements `inject`
+func runInjectCommand() {
+	fs := flag.NewFlagSet("inject", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	var req InjectRequest
+	fs.StringVar(&req.Direction, "dir", "out", "direction: out as read from the TUN, in as received from the docker side")
+	fs.StringVar(&req.Proto, "proto", "tcp", "protocol: tcp (a SYN), udp or icmp (an echo request)")
+	fs.StringVar(&req.Src, "src", "", "source address, the TUN address by default going out")
+	fs.StringVar(&req.Dst, "dst", "", "destination address, the TUN address by default coming in")
+	fs.IntVar(&req.Sport, "sport", 0, "source port, random by default")
+	fs.IntVar(&req.Dport, "dport", 0, "destination port")
+	fs.StringVar(&req.Payload, "payload", "", "payload of the packet")
+	fs.StringVar(&req.Hex, "hex", "", "whole IPv4 packet in hex instead")
+	fs.Parse(os.Args[2:])
+	body, _ := json.Marshal(req)
+	out, err := adminPost("/inject", string(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var res InjectResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		os.Stdout.Write(out)
+		os.Exit(1)
+	}
+	if res.Error != "" {
+		fmt.Fprintf(os.Stderr, "invalid packet => %s\n", res.Error)
+		os.Exit(1)
+	}
+	fmt.Printf("packet      => %s (%s)\n", res.Packet, res.Direction)
+	fmt.Printf("middlewares => %s\n", strings.Join(res.Middlewares, " "))
+	if res.ACL != "" {
+		fmt.Printf("acl         => %s\n", res.ACL)
+	}
+	result := res.Result
+	if res.DroppedBy != "" {
+		result += " by " + res.DroppedBy
+	}
+	if res.Detail != "" {
+		result += " (" + res.Detail + ")"
+	}
+	fmt.Printf("result      => %s\n", result)
+	if res.Result == "dropped" {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// `-instance <name>`, or `DDC_INSTANCE`, runs one of several connectors of
+// the desktop, e.g. one per docker environment, each with its own config and
+// so its own port, addr and TUN. Its state goes to the
+// `desktop-docker-connector-<name>` directory of the state dir, its admin API
+// listens on a free port of the loopback unless `-admin` is given, the port
+// being recorded in its state so `docker-connector -instance <name> <command>`
+// reaches it, its logs are prefixed by `[<name>]`, and `install` registers it
+// as the service `DesktopDockerConnector-<name>`. The flag is taken wherever
+// it is on the command line, so every subcommand selects an instance, and
+// `instances` lists the instances of the state dir.
+const (
+	instanceDirPrefix = "desktop-docker-connector-"
+	adminFileName     = "desktop-docker-connector.admin"
+)
+
+var instanceName = ""
+
+// AdminFile records the admin address of an instance
+var AdminFile = ""
+
+var validInstance = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// takeInstanceArg removes `-instance <name>` from the arguments, setting the
+// instance, before the subcommand parses them
+func takeInstanceArg() {
+	if name, ok := os.LookupEnv(envName("instance")); ok {
+		instanceName = name
+	}
+	args := []string{os.Args[0]}
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case arg == "--" || !strings.HasPrefix(arg, "-"):
+			args = append(args, arg)
+		case name == "instance" && i+1 < len(os.Args):
+			instanceName = os.Args[i+1]
+			i++
+		case strings.HasPrefix(name, "instance="):
+			instanceName = strings.TrimPrefix(name, "instance=")
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+	if instanceName != "" && !validInstance.MatchString(instanceName) {
+		fmt.Fprintf(os.Stderr, "invalid instance => %s: expected letters, digits, '.', '_' or '-'\n", instanceName)
+		os.Exit(2)
+	}
+}
+
+// instanceDir returns the state directory of the instance in dir
+func instanceDir(dir string) string {
+	if instanceName == "" {
+		return dir
+	}
+	return filepath.Join(dir, instanceDirPrefix+instanceName)
+}
+
+// selectInstance places the state of the instance and points the admin
+// address to it, unless given with `-admin`
+func selectInstance() {
+	if instanceName == "" {
+		return
+	}
+	// the subcommands parse `-state-dir` after the admin address is chosen
+	if dir, ok := os.LookupEnv(envName("state-dir")); ok {
+		stateDir = dir
+	}
+	for i := 1; i < len(os.Args); i++ {
+		name := strings.TrimLeft(os.Args[i], "-")
+		if name == "state-dir" && i+1 < len(os.Args) {
+			stateDir = os.Args[i+1]
+		} else if strings.HasPrefix(name, "state-dir=") {
+			stateDir = strings.TrimPrefix(name, "state-dir=")
+		}
+	}
+	statePaths()
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == "admin"
+	})
+	if given {
+		return
+	}
+	adminAddr = "127.0.0.1:0"
+	if data, err := ioutil.ReadFile(AdminFile); err == nil && strings.TrimSpace(string(data)) != "" {
+		adminAddr = strings.TrimSpace(string(data))
+	}
+}
+
+// listenAdmin listens on the admin address, on a free port for an instance
+// whose recorded one is taken, and records it
+func listenAdmin() (net.Listener, error) {
+	ln, err := net.Listen("tcp", adminAddr)
+	if err != nil && instanceName != "" && pinned["admin"] == "" {
+		logger.Warningf("[ADMIN] failed to listen %s => %v, using a free port", adminAddr, err)
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil || instanceName == "" {
+		return ln, err
+	}
+	adminAddr = ln.Addr().String()
+	if err := ioutil.WriteFile(AdminFile, []byte(adminAddr+"\n"), 0644); err != nil {
+		logger.Warningf("[ADMIN] Failed to write %s: %v", AdminFile, err)
+	}
+	return ln, nil
+}
+
+// instanceService names the service of the instance and passes it the
+// instance
+func instanceService(name, display string, args []string) (string, string, []string) {
+	if instanceName == "" {
+		return name, display, args
+	}
+	return name + "-" + instanceName, fmt.Sprintf("%s (%s)", display, instanceName), instanceArguments(args)
+}
+
+// instanceArguments prepends the instance to the arguments of a service
+func instanceArguments(args []string) []string {
+	if instanceName == "" {
+		return args
+	}
+	return append([]string{"-instance", instanceName}, args...)
+}
+
+// instanceLabel suffixes a name, e.g. of a launchd daemon, with the instance
+func instanceLabel(name, sep string) string {
+	if instanceName == "" {
+		return name
+	}
+	return name + sep + instanceName
+}
+
+// runInstances implements `instances`, listing the instances of the state
+// dir with their admin address and pid
+func runInstances() {
+	fs := flag.NewFlagSet("instances", flag.ExitOnError)
+	fs.StringVar(&stateDir, "state-dir", stateDir, "directory of the state of the instances, the temporary directory by default")
+	fs.Parse(os.Args[2:])
+	dir := stateDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s => %v\n", dir, err)
+		os.Exit(1)
+	}
+	found := false
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), instanceDirPrefix) {
+			continue
+		}
+		instanceName = strings.TrimPrefix(e.Name(), instanceDirPrefix)
+		statePaths()
+		admin := "-"
+		if data, err := ioutil.ReadFile(AdminFile); err == nil {
+			admin = strings.TrimSpace(string(data))
+		}
+		state := "stopped"
+		if pid := runningPid(); pid != 0 {
+			state = fmt.Sprintf("running (pid %d)", pid)
+		}
+		fmt.Printf("%-20s %-22s %s\n", instanceName, admin, state)
+		found = true
+	}
+	if !found {
+		fmt.Printf("no instance in %s\n", dir)
+	}
+}
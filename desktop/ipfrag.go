@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Only the first fragment of an IPv4 datagram carries the TCP or UDP header,
+// its ports are remembered by the addresses, protocol and identification of
+// the datagram, so the later fragments are matched by the ACLs and the host
+// services like the first one instead of by the bytes of their payload. A
+// later fragment arriving before its first one has no ports.
+const (
+	fragPortsTimeout = 30 * time.Second
+	fragPortsMax     = 4096
+)
+
+type fragPortsKey struct {
+	proto    byte
+	src, dst [4]byte
+	id       uint16
+}
+
+type fragPortsEntry struct {
+	sport, dport uint16
+	seen         time.Time
+}
+
+type fragPortsTable struct {
+	sync.Mutex
+	ports map[fragPortsKey]fragPortsEntry
+}
+
+var fragPorts = &fragPortsTable{ports: make(map[fragPortsKey]fragPortsEntry)}
+
+// isFragment returns whether an IPv4 packet is a fragment, the first one
+// included
+func isFragment(packet []byte) bool {
+	return binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0
+}
+
+// l4Ports returns the ports of a TCP or UDP IPv4 packet, of its first
+// fragment for a later one, honoring the options of the header
+func l4Ports(packet []byte) (sport, dport uint16, ok bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 || (packet[9] != protoTCP && packet[9] != protoUDP) {
+		return 0, 0, false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < 20 {
+		return 0, 0, false
+	}
+	frag := binary.BigEndian.Uint16(packet[6:8])
+	if frag&0x1fff == 0 {
+		if len(packet) < ihl+4 {
+			return 0, 0, false
+		}
+		sport, dport = binary.BigEndian.Uint16(packet[ihl:]), binary.BigEndian.Uint16(packet[ihl+2:])
+		if frag&0x2000 != 0 {
+			fragPorts.Add(packet, sport, dport)
+		}
+		return sport, dport, true
+	}
+	return fragPorts.Lookup(packet)
+}
+
+func fragKeyOf(packet []byte) fragPortsKey {
+	k := fragPortsKey{proto: packet[9], id: binary.BigEndian.Uint16(packet[4:6])}
+	copy(k.src[:], packet[12:16])
+	copy(k.dst[:], packet[16:20])
+	return k
+}
+
+// Add remembers the ports of a first fragment
+func (t *fragPortsTable) Add(packet []byte, sport, dport uint16) {
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	if len(t.ports) >= fragPortsMax {
+		for k, e := range t.ports {
+			if now.Sub(e.seen) >= fragPortsTimeout {
+				delete(t.ports, k)
+			}
+		}
+		if len(t.ports) >= fragPortsMax {
+			t.ports = make(map[fragPortsKey]fragPortsEntry)
+		}
+	}
+	t.ports[fragKeyOf(packet)] = fragPortsEntry{sport: sport, dport: dport, seen: now}
+}
+
+// Lookup returns the ports of the first fragment of a later one
+func (t *fragPortsTable) Lookup(packet []byte) (uint16, uint16, bool) {
+	t.Lock()
+	defer t.Unlock()
+	e, ok := t.ports[fragKeyOf(packet)]
+	if !ok || time.Since(e.seen) >= fragPortsTimeout {
+		return 0, 0, false
+	}
+	return e.sport, e.dport, true
+}
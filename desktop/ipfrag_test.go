@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+)
+
+// A TCP segment sent with a router alert, IHL 6, and its two fragments, the
+// first one carrying 24 bytes of TCP.
+const (
+	capturedOptionsWhole = "4600004c7777000040060673c0a8fb01ac11000294040000c8281f90010203040a0b0c0d501801f63d0b00006162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f80"
+	capturedOptionsFirst = "46000030777720004006e68ec0a8fb01ac11000294040000c8281f90010203040a0b0c0d501801f63d0b000061626364"
+	capturedOptionsLater = "460000347777000340060688c0a8fb01ac1100029404000065666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f80"
+)
+
+func resetFragPorts() {
+	fragPorts = &fragPortsTable{ports: make(map[fragPortsKey]fragPortsEntry)}
+}
+
+func TestL4Ports(t *testing.T) {
+	resetFragPorts()
+	tests := []struct {
+		name         string
+		pkt          string
+		sport, dport uint16
+		ok           bool
+	}{
+		{"tcp", capturedSYN, 51234, 80, true},
+		{"udp", capturedDNS, 40123, 53, true},
+		{"ihl 6", capturedSYNOptions, 51236, 443, true},
+		{"icmp", capturedEcho, 0, 0, false},
+		{"later fragment first", capturedLaterFragment, 0, 0, false},
+		{"first fragment", capturedFirstFragment, 40125, 5353, true},
+		{"later fragment", capturedLaterFragment, 40125, 5353, true},
+		{"later fragment ihl 6 first", capturedOptionsLater, 0, 0, false},
+		{"first fragment ihl 6", capturedOptionsFirst, 51240, 8080, true},
+		{"later fragment ihl 6", capturedOptionsLater, 51240, 8080, true},
+		{"whole ihl 6", capturedOptionsWhole, 51240, 8080, true},
+		{"cut", capturedSYN[:46], 0, 0, false},
+		{"ipv6", "6000000000140640" + capturedSYN[16:], 0, 0, false},
+	}
+	for _, tt := range tests {
+		sport, dport, ok := l4Ports(hexPacket(t, tt.pkt))
+		if sport != tt.sport || dport != tt.dport || ok != tt.ok {
+			t.Errorf("%s: l4Ports = %d, %d, %v, expected %d, %d, %v", tt.name, sport, dport, ok, tt.sport, tt.dport, tt.ok)
+		}
+	}
+	// another datagram of the same flow isn't matched by the identification
+	resetFragPorts()
+	l4Ports(hexPacket(t, capturedFirstFragment))
+	p := hexPacket(t, capturedLaterFragment)
+	p[5]++
+	if _, _, ok := l4Ports(p); ok {
+		t.Errorf("l4Ports matched the fragment of another datagram")
+	}
+}
+
+func TestACLKey(t *testing.T) {
+	resetFragPorts()
+	tests := []struct {
+		name string
+		pkt  string
+		want aclFlow
+	}{
+		{"tcp", capturedSYN, aclFlow{proto: protoTCP, src: [4]byte{192, 168, 251, 1}, dst: [4]byte{172, 17, 0, 2}, sport: 51234, dport: 80}},
+		{"icmp", capturedEcho, aclFlow{proto: protoICMP, src: [4]byte{192, 168, 251, 1}, dst: [4]byte{172, 17, 0, 2}}},
+		{"later fragment first", capturedOptionsLater, aclFlow{proto: protoTCP, src: [4]byte{192, 168, 251, 1}, dst: [4]byte{172, 17, 0, 2}}},
+		{"first fragment", capturedOptionsFirst, aclFlow{proto: protoTCP, src: [4]byte{192, 168, 251, 1}, dst: [4]byte{172, 17, 0, 2}, sport: 51240, dport: 8080}},
+		{"later fragment", capturedOptionsLater, aclFlow{proto: protoTCP, src: [4]byte{192, 168, 251, 1}, dst: [4]byte{172, 17, 0, 2}, sport: 51240, dport: 8080}},
+	}
+	for _, tt := range tests {
+		if key := aclKey(hexPacket(t, tt.pkt)); key != tt.want {
+			t.Errorf("%s: aclKey = %+v, expected %+v", tt.name, key, tt.want)
+		}
+	}
+}
+
+func TestHostFlowPorts(t *testing.T) {
+	resetFragPorts()
+	tests := []struct {
+		name         string
+		pkt          string
+		sport, dport uint16
+		ok           bool
+	}{
+		{"tcp", capturedSYN, 51234, 80, true},
+		{"udp", capturedDNS, 40123, 53, true},
+		{"icmp echo id", capturedEcho, 0x1234, 0x1234, true},
+		{"later fragment first", capturedLaterFragment, 0, 0, false},
+		{"first fragment", capturedFirstFragment, 40125, 5353, true},
+		{"later fragment", capturedLaterFragment, 40125, 5353, true},
+		{"later fragment ihl 6", capturedOptionsLater, 0, 0, false},
+	}
+	for _, tt := range tests {
+		sport, dport, ok := hostFlowPorts(hexPacket(t, tt.pkt))
+		if sport != tt.sport || dport != tt.dport || ok != tt.ok {
+			t.Errorf("%s: hostFlowPorts = %d, %d, %v, expected %d, %d, %v", tt.name, sport, dport, ok, tt.sport, tt.dport, tt.ok)
+		}
+	}
+	// a later fragment of an echo has no identifier
+	p := hexPacket(t, capturedEcho)
+	p[6], p[7] = 0, 3
+	if _, _, ok := hostFlowPorts(p); ok {
+		t.Errorf("hostFlowPorts read the identifier of a later ICMP fragment")
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	resetFragPorts()
+	tests := []struct {
+		name string
+		pkts []string
+	}{
+		{"udp", []string{capturedWhole, capturedLaterFragment, capturedFirstFragment, capturedDNS}},
+		{"tcp", []string{capturedOptionsWhole, capturedOptionsLater, capturedOptionsFirst, capturedSYN, capturedSYNOptions, capturedTCP}},
+	}
+	for _, tt := range tests {
+		want := flowHash(hexPacket(t, tt.pkts[0]))
+		for _, s := range tt.pkts[1:] {
+			p := hexPacket(t, s)
+			if h := flowHash(p); h != want {
+				t.Errorf("%s: flowHash(%x) = %08x, expected the %08x of its flow", tt.name, p[:20], h, want)
+			}
+		}
+	}
+	if flowHash(hexPacket(t, capturedSYN)) == flowHash(hexPacket(t, capturedEcho)) {
+		t.Errorf("flowHash ignored the protocol")
+	}
+}
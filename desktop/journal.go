@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The routes installed through the TUN are written to a journal in the state
+// directory, one `<subnet> <gateway>` per line, and removed from it with
+// their route. A connector killed without cleanup leaves them in the journal,
+// so the next start removes the stale ones, with their gateway not to touch a
+// route of another tool, before installing its own.
+const routesFileName = "desktop-docker-connector.routes"
+
+// RoutesFile is the journal of the installed routes
+var RoutesFile = ""
+
+type routeJournal struct {
+	sync.Mutex
+	routes map[string]string
+}
+
+var journal = &routeJournal{routes: make(map[string]string)}
+
+// Add records an installed route
+func (j *routeJournal) Add(key string, gw net.IP) {
+	j.Lock()
+	defer j.Unlock()
+	j.routes[key] = gw.String()
+	j.save()
+}
+
+// Remove forgets a removed route
+func (j *routeJournal) Remove(key string) {
+	j.Lock()
+	defer j.Unlock()
+	if _, ok := j.routes[key]; !ok {
+		return
+	}
+	delete(j.routes, key)
+	j.save()
+}
+
+func (j *routeJournal) save() {
+	if len(j.routes) == 0 {
+		os.Remove(RoutesFile)
+		return
+	}
+	lines := make([]string, 0, len(j.routes))
+	for key, gw := range j.routes {
+		lines = append(lines, fmt.Sprintf("%s %s\n", key, gw))
+	}
+	sort.Strings(lines)
+	tmp := RoutesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "")), 0644); err != nil {
+		logRoutes.Debugf("[ROUTE] Failed to write %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, RoutesFile); err != nil {
+		logRoutes.Debugf("[ROUTE] Failed to write %s: %v", RoutesFile, err)
+	}
+}
+
+// cleanStaleRoutes removes the routes left in the journal by a previous
+// connector which didn't stop cleanly
+func cleanStaleRoutes() {
+	data, err := ioutil.ReadFile(RoutesFile)
+	if err != nil {
+		return
+	}
+	if pid := runningPid(); pid != 0 {
+		logRoutes.Warningf("[ROUTE] Connector %d still running, its routes are kept", pid)
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		gw := net.ParseIP(fields[1])
+		if _, _, err := net.ParseCIDR(fields[0]); err != nil || gw == nil {
+			continue
+		}
+		logRoutes.Infof("[ROUTE] Removing stale route %s via %s", fields[0], gw)
+		delRouteVia(fields[0], gw)
+	}
+	os.Remove(RoutesFile)
+}
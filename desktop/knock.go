@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A knock is a datagram `timestamp(8) | hmac-sha256(secret, timestamp)` sent
+// to the knock port, which opens the main UDP port for its source for
+// `knockTTL` seconds. The docker side knocks again before the window closes.
+// A knock is accepted once, from whatever source, so a sniffed one replayed
+// from another address within the skew doesn't open the port.
+const (
+	knockLen  = 8 + sha256.Size
+	knockSkew = 60 * time.Second
+)
+
+type knockGate struct {
+	sync.Mutex
+	conn    *net.UDPConn
+	allowed map[string]time.Time
+	// seen are the timestamps of the knocks accepted within the skew
+	seen map[int64]bool
+}
+
+var knocks *knockGate
+
+// knockMAC signs the timestamp of a knock with the shared secret
+func knockMAC(secret string, ts []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(ts)
+	return mac.Sum(nil)
+}
+
+func startKnock() {
+	if knockPort <= 0 || knockSecret == "" {
+		return
+	}
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: knockPort})
+	if err != nil {
+		logger.Warningf("[KNOCK] Failed to listen on knock port %d: %v", knockPort, err)
+		return
+	}
+	knocks = &knockGate{
+		conn:    ln,
+		allowed: make(map[string]time.Time),
+		seen:    make(map[int64]bool),
+	}
+	if err := firewallInit(port); err != nil {
+		logger.Warningf("[KNOCK] Failed to close port %d in the firewall: %v", port, err)
+	}
+	logger.Infof("[KNOCK] Listening for knocks on %v, port %d opened for %ds per knock", ln.LocalAddr(), port, knockTTL)
+	go knocks.serve()
+	go knocks.expire()
+}
+
+func (k *knockGate) serve() {
+	buf := make([]byte, 128)
+	for {
+		n, addr, err := k.conn.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return
+			}
+			continue
+		}
+		if !peersAllow.Allowed(addr.IP) {
+			continue
+		}
+		if n != knockLen {
+			logger.Debugf("[KNOCK] Invalid knock size %d from %v", n, addr)
+			continue
+		}
+		ts := int64(binary.BigEndian.Uint64(buf[:8]))
+		if !hmac.Equal(buf[8:n], knockMAC(knockSecret, buf[:8])) {
+			logger.Warningf("[KNOCK] Invalid knock signature from %v", addr)
+			continue
+		}
+		if d := time.Since(time.Unix(0, ts)); d > knockSkew || d < -knockSkew {
+			logger.Warningf("[KNOCK] Stale knock from %v, skew %v", addr, d)
+			continue
+		}
+		ip := addr.IP.String()
+		k.Lock()
+		if k.seen[ts] {
+			k.Unlock()
+			logger.Warningf("[KNOCK] Replayed knock from %v", addr)
+			continue
+		}
+		k.seen[ts] = true
+		_, open := k.allowed[ip]
+		k.allowed[ip] = time.Now().Add(time.Duration(knockTTL) * time.Second)
+		k.Unlock()
+		if !open {
+			logger.Infof("[KNOCK] Port %d opened for %s", port, ip)
+			if err := firewallAllow(addr.IP, port); err != nil {
+				logger.Warningf("[KNOCK] Failed to open port %d for %s: %v", port, ip, err)
+			}
+		}
+	}
+}
+
+func (k *knockGate) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		k.Lock()
+		if k.conn == nil {
+			k.Unlock()
+			return
+		}
+		now := time.Now()
+		// older knocks are refused as stale
+		for ts := range k.seen {
+			if now.Sub(time.Unix(0, ts)) > knockSkew {
+				delete(k.seen, ts)
+			}
+		}
+		for ip, until := range k.allowed {
+			if now.After(until) {
+				delete(k.allowed, ip)
+				logger.Infof("[KNOCK] Port %d closed for %s", port, ip)
+				firewallRevoke(net.ParseIP(ip), port)
+			}
+		}
+		k.Unlock()
+	}
+}
+
+// Allowed returns whether datagrams from the ip are accepted, always true
+// when knocking is disabled
+func (k *knockGate) Allowed(ip net.IP) bool {
+	if k == nil || ip.IsLoopback() {
+		return true
+	}
+	k.Lock()
+	defer k.Unlock()
+	until, ok := k.allowed[ip.String()]
+	return ok && time.Now().Before(until)
+}
+
+// Close revokes all knocks and reopens the port in the firewall
+func (k *knockGate) Close() {
+	if k == nil {
+		return
+	}
+	k.Lock()
+	defer k.Unlock()
+	if k.conn == nil {
+		return
+	}
+	k.conn.Close()
+	k.conn = nil
+	for ip := range k.allowed {
+		firewallRevoke(net.ParseIP(ip), port)
+	}
+	k.allowed = nil
+	firewallReset(port)
+}
+
+// KnockStatus lists the sources the port is currently opened for
+func (k *knockGate) Status() map[string]string {
+	if k == nil {
+		return nil
+	}
+	k.Lock()
+	defer k.Unlock()
+	m := make(map[string]string, len(k.allowed))
+	for ip, until := range k.allowed {
+		m[ip] = fmt.Sprintf("%ds", int(time.Until(until).Seconds()))
+	}
+	return m
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// `generate-launchd` writes the plist of a launchd daemon running the current
+// binary, for the installs without brew:
+//
+//	sudo docker-connector generate-launchd -config ./options.conf -o /Library/LaunchDaemons/docker-connector.plist
+//	sudo launchctl load -w /Library/LaunchDaemons/docker-connector.plist
+//
+// The config path is made absolute, looked up in the current directory then
+// next to the binary as the connector does, since launchd doesn't start it in
+// the directory the plist was made from. The arguments after the flags are
+// passed to the connector.
+const launchdLabel = "com.github.docker-connector"
+
+// launchdPlist returns the plist running the binary with the arguments
+func launchdPlist(label, exe string, args []string, logPath string) []byte {
+	var buf bytes.Buffer
+	str := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return "<string>" + b.String() + "</string>"
+	}
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	buf.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	buf.WriteString("\t<key>Label</key>\n\t" + str(label) + "\n")
+	buf.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{exe}, args...) {
+		buf.WriteString("\t\t" + str(arg) + "\n")
+	}
+	buf.WriteString("\t</array>\n")
+	buf.WriteString("\t<key>WorkingDirectory</key>\n\t" + str(filepath.Dir(exe)) + "\n")
+	buf.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	buf.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	buf.WriteString("\t<key>StandardOutPath</key>\n\t" + str(logPath) + "\n")
+	buf.WriteString("\t<key>StandardErrorPath</key>\n\t" + str(logPath) + "\n")
+	buf.WriteString("</dict>\n</plist>\n")
+	return buf.Bytes()
+}
+
+// launchdConfig returns the absolute path of the config, the one of the
+// current directory or else the one next to the binary
+func launchdConfig(path, exe string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			return abs
+		}
+	}
+	return filepath.Join(filepath.Dir(exe), path)
+}
+
+// runGenerateLaunchd implements `generate-launchd`
+func runGenerateLaunchd() {
+	fs := flag.NewFlagSet("generate-launchd", flag.ExitOnError)
+	label := fs.String("label", instanceLabel(launchdLabel, "."), "label of the daemon")
+	config := fs.String("config", "options.conf", "config file of the connector")
+	logPath := fs.String("log", instanceLabel("/var/log/docker-connector", "-")+".log", "file of the standard output and error")
+	out := fs.String("o", "", "file to write, the standard output by default")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s generate-launchd [-label label] [-config file] [-log file] [-o plist] [connector flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to find the binary => %v\n", err)
+		os.Exit(1)
+	}
+	if abs, err := filepath.Abs(exe); err == nil {
+		exe = abs
+	}
+	cfg := launchdConfig(*config, exe)
+	if _, err := os.Stat(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s doesn't exist yet\n", cfg)
+	}
+	args := instanceArguments(append([]string{"-config", cfg}, serviceArguments(fs.Args())...))
+	plist := launchdPlist(*label, exe, args, *logPath)
+	if *out == "" {
+		os.Stdout.Write(plist)
+		return
+	}
+	if err := ioutil.WriteFile(*out, plist, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write %s => %v\n", *out, err)
+		os.Exit(1)
+	}
+	fmt.Printf("plist => %s\nload it with: sudo launchctl load -w %s\n", *out, *out)
+}
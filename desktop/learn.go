@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flowKey is a destination observed in learning mode, port is zero for
+// protocols without ports
+type flowKey struct {
+	dst   [4]byte
+	proto byte
+	port  uint16
+}
+
+// learner observes the destinations actually used through the tunnel and
+// generates a minimized config of routes and ACLs from them.
+type learner struct {
+	sync.Mutex
+	active int32
+	since  time.Time
+	until  time.Time
+	flows  map[flowKey]uint64
+}
+
+var learning = &learner{}
+
+func (l *learner) Start(d time.Duration) {
+	l.Lock()
+	l.since = time.Now()
+	l.until = l.since.Add(d)
+	l.flows = make(map[flowKey]uint64)
+	l.Unlock()
+	atomic.StoreInt32(&l.active, 1)
+	logger.Infof("[LEARN] Learning destinations for %v", d)
+	time.AfterFunc(d, func() {
+		l.Lock()
+		done := !time.Now().Before(l.until)
+		l.Unlock()
+		if done && atomic.CompareAndSwapInt32(&l.active, 1, 0) {
+			logger.Infof("[LEARN] Learning finished, see `learn` for the generated config")
+		}
+	})
+}
+
+// Observe records the destination of an outbound packet, for TCP only the
+// connection attempts (SYN without ACK) are recorded so that replies to
+// connections initiated by containers are not mistaken for services.
+func (l *learner) Observe(packet []byte) {
+	if atomic.LoadInt32(&l.active) == 0 || len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	key := flowKey{proto: packet[9]}
+	copy(key.dst[:], packet[16:20])
+	ihl := int(packet[0]&0x0f) * 4
+	fragment := binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0
+	switch key.proto {
+	case 6:
+		if fragment || len(packet) < ihl+14 || packet[ihl+13]&0x12 != 0x02 {
+			return
+		}
+		key.port = binary.BigEndian.Uint16(packet[ihl+2:])
+	case 17:
+		if fragment || len(packet) < ihl+4 {
+			return
+		}
+		key.port = binary.BigEndian.Uint16(packet[ihl+2:])
+	}
+	l.Lock()
+	if l.flows != nil {
+		l.flows[key]++
+	}
+	l.Unlock()
+}
+
+func protoName(proto byte) string {
+	switch proto {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	}
+	return fmt.Sprintf("%d", proto)
+}
+
+// Report generates the routes covering the observed destinations (narrowed to
+// /24 within the configured routes) and ACLs allowing only what was used.
+func (l *learner) Report() string {
+	l.Lock()
+	flows := make(map[flowKey]uint64, len(l.flows))
+	for k, v := range l.flows {
+		flows[k] = v
+	}
+	since, until := l.since, l.until
+	l.Unlock()
+	var buf bytes.Buffer
+	if since.IsZero() {
+		buf.WriteString("# learning not started\n")
+		return buf.String()
+	}
+	fmt.Fprintf(&buf, "# learned %s - %s, %d flows\n", since.Format(time.RFC3339), until.Format(time.RFC3339), len(flows))
+	nets := make(map[string]bool)
+	type rule struct {
+		proto byte
+		port  uint16
+	}
+	hosts := make(map[rule]map[string][]string)
+	for k := range flows {
+		ip := net.IP(k.dst[:])
+		if !routed(ip) {
+			continue
+		}
+		sub := net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		nets[sub.String()] = true
+		r := rule{k.proto, k.port}
+		if hosts[r] == nil {
+			hosts[r] = make(map[string][]string)
+		}
+		hosts[r][sub.String()] = append(hosts[r][sub.String()], ip.String())
+	}
+	var lines []string
+	for k := range nets {
+		lines = append(lines, "route "+k)
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	lines = lines[:0]
+	for r, subs := range hosts {
+		for sub, ips := range subs {
+			dsts := []string{sub}
+			if len(ips) == 1 {
+				dsts = []string{ips[0] + "/32"}
+			}
+			for _, dst := range dsts {
+				line := fmt.Sprintf("acl allow %s any %s", protoName(r.proto), dst)
+				if r.port != 0 {
+					line += fmt.Sprintf(" %d", r.port)
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	if len(lines) > 0 {
+		buf.WriteString("acl default deny\n")
+	}
+	return buf.String()
+}
+
+// routed returns whether the ip is covered by a configured route
+func routed(ip net.IP) bool {
+	for key := range shared.Routes() {
+		if _, ipnet, err := net.ParseCIDR(key); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLearn prints the generated config, `POST /learn?duration=10m` starts
+// learning again
+func serveLearn(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		learning.Start(d)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(learning.Report()))
+}
+
+// runLearn implements `learn [-duration 10m]`
+func runLearn() {
+	fs := flag.NewFlagSet("learn", flag.ExitOnError)
+	duration := fs.Duration("duration", 0, "start learning for the duration")
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	var body []byte
+	var err error
+	if *duration > 0 {
+		body, err = adminPost("/learn?duration="+duration.String(), "")
+	} else {
+		body, err = adminGet("/learn")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
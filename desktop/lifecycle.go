@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// pathFlags are the flags holding paths, made absolute for the service which
+// doesn't start in the current directory. A relative config file missing from
+// the current directory is kept, it is then looked up next to the binary.
+var pathFlags = map[string]bool{"config": true, "log-file": true, "state-dir": true}
+
+// With `install` on windows the service is restarted after a crash, after each
+// delay of `-restart-delays` in turn, the count of failures being reset after
+// `-restart-reset` without one, and `-delayed-start` starts it a little after
+// the boot. launchd and systemd restart the service already.
+var (
+	restartDelays = "5s,10s,1m"
+	restartReset  = 24 * time.Hour
+	delayedStart  = false
+	// installFlags are the flags of `install` not baked into the service
+	installFlags = map[string]bool{"restart-delays": true, "restart-reset": true, "delayed-start": true}
+)
+
+// parseRestartDelays parses `-restart-delays`, none for `off`
+func parseRestartDelays(list string) ([]time.Duration, error) {
+	if list == "off" || list == "" {
+		return nil, nil
+	}
+	var delays []time.Duration
+	for _, s := range strings.Split(list, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid delay %q", s)
+		}
+		delays = append(delays, d)
+	}
+	return delays, nil
+}
+
+// withoutInstallFlags drops the flags of `install` from the arguments
+func withoutInstallFlags(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if !strings.HasPrefix(args[i], "-") || !installFlags[strings.SplitN(name, "=", 2)[0]] {
+			out = append(out, args[i])
+			continue
+		}
+		if !strings.Contains(name, "=") && name != "delayed-start" && i+1 < len(args) {
+			i++
+		}
+	}
+	return out
+}
+
+// serviceArguments returns the flags of `install` baked into the service
+func serviceArguments(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := strings.TrimLeft(arg, "-")
+		if !strings.HasPrefix(arg, "-") || name == "" {
+			out = append(out, arg)
+			continue
+		}
+		if j := strings.Index(name, "="); j > 0 {
+			if pathFlags[name[:j]] {
+				arg = arg[:len(arg)-len(name)] + name[:j+1] + absPath(name[:j], name[j+1:])
+			}
+			out = append(out, arg)
+			continue
+		}
+		out = append(out, arg)
+		if pathFlags[name] && i+1 < len(args) {
+			i++
+			out = append(out, absPath(name, args[i]))
+		}
+	}
+	return out
+}
+
+func absPath(name, path string) string {
+	if name == "config" {
+		if _, err := os.Stat(path); err != nil {
+			return path
+		}
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// runInstall registers the service with the flags of the command line,
+// replacing an installed one and restarting it if it was running
+func runInstall(s service.Service, cfg *service.Config) {
+	flag.CommandLine.Parse(os.Args[2:])
+	applyEnv(flag.CommandLine)
+	cfg.Arguments = withoutInstallFlags(append(cfg.Arguments, serviceArguments(envArguments(flag.CommandLine))...))
+	delays, err := parseRestartDelays(restartDelays)
+	if err != nil {
+		logger.Fatalf("invalid restart-delays => %v", err)
+	}
+	if cfg.Option == nil {
+		cfg.Option = service.KeyValue{}
+	}
+	cfg.Option["DelayedAutoStart"] = delayedStart
+	if exe, err := os.Executable(); err == nil {
+		requireRelease(exe)
+	}
+	status, err := s.Status()
+	running := err == nil && status == service.StatusRunning
+	if err != service.ErrNotInstalled {
+		logger.Infof("Replacing the installed service")
+		s.Stop()
+		if err := s.Uninstall(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if err := s.Install(); err != nil {
+		logger.Fatal(err)
+	}
+	if err := setRecovery(cfg.Name, delays, restartReset); err != nil {
+		logger.Warningf("Failed to set the recovery of the service: %v", err)
+	}
+	logger.Infof("Install Service Success! arguments => %s", strings.Join(cfg.Arguments, " "))
+	if running {
+		if err := s.Start(); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("Restart Service Success!")
+	}
+}
+
+// runUninstall stops and removes the service and its saved peer
+func runUninstall(s service.Service) {
+	flag.CommandLine.Parse(os.Args[2:])
+	applyEnv(flag.CommandLine)
+	statePaths()
+	s.Stop()
+	if err := s.Uninstall(); err != nil {
+		logger.Fatal(err)
+	}
+	if err := os.Remove(TmpPeer); err == nil {
+		logger.Infof("Removed %s", TmpPeer)
+	}
+	logger.Info("Uninstall Service Success!")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitDelay is the longest a packet waits for tokens before it is dropped
+const limitDelay = 50 * time.Millisecond
+
+// tokenBucket limits the bytes per second of one direction, a zero rate
+// means unlimited.
+type tokenBucket struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	delayed uint64
+	dropped uint64
+}
+
+var (
+	// upLimit applies to TUN->UDP, downLimit to UDP->TUN
+	upLimit   = &tokenBucket{}
+	downLimit = &tokenBucket{}
+)
+
+// LimitStatus reports the rate of a direction in bits per second
+type LimitStatus struct {
+	Rate    uint64 `json:"rate"`
+	Delayed uint64 `json:"delayed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// SetRate changes the rate in bytes per second, the burst allows 50ms at
+// full rate but at least a few large packets.
+func (b *tokenBucket) SetRate(rate float64) {
+	b.Lock()
+	defer b.Unlock()
+	if rate == b.rate {
+		return
+	}
+	b.rate = rate
+	b.burst = rate / 20
+	if b.burst < 64*1024 {
+		b.burst = 64 * 1024
+	}
+	b.tokens = b.burst
+	b.last = time.Now()
+}
+
+// Wait takes the tokens of a packet of n bytes, sleeping until they are
+// available, and returns false if the packet should be dropped instead.
+func (b *tokenBucket) Wait(n int) bool {
+	b.Lock()
+	if b.rate <= 0 {
+		b.Unlock()
+		return true
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		b.Unlock()
+		return true
+	}
+	wait := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+	if wait > limitDelay {
+		b.dropped++
+		b.Unlock()
+		return false
+	}
+	b.tokens -= float64(n)
+	b.delayed++
+	b.Unlock()
+	time.Sleep(wait)
+	return true
+}
+
+// Throttle takes the tokens of n bytes of a stream, sleeping as long as it
+// takes since nothing is dropped.
+func (b *tokenBucket) Throttle(n int) {
+	b.Lock()
+	if b.rate <= 0 {
+		b.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.delayed++
+	}
+	b.Unlock()
+	time.Sleep(wait)
+}
+
+// throttledReader reads a stream at the rate of a bucket
+type throttledReader struct {
+	r io.Reader
+	b *tokenBucket
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := t.r.Read(p)
+	t.b.Throttle(n)
+	return n, err
+}
+
+func (b *tokenBucket) Status() *LimitStatus {
+	b.Lock()
+	defer b.Unlock()
+	if b.rate <= 0 {
+		return nil
+	}
+	return &LimitStatus{Rate: uint64(b.rate * 8), Delayed: b.delayed, Dropped: b.dropped}
+}
+
+// parseRate parses a tc style rate, `bit`, `kbit`, `mbit` and `gbit` are bits
+// per second, `bps`, `kbps`, `mbps` and `gbps` bytes per second, and returns
+// bytes per second, 0 for `off`.
+func parseRate(val string) (float64, error) {
+	val = strings.ToLower(strings.TrimSpace(val))
+	if val == "off" || val == "0" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"kbit", 1e3 / 8}, {"mbit", 1e6 / 8}, {"gbit", 1e9 / 8}, {"bit", 1.0 / 8},
+		{"kbps", 1e3}, {"mbps", 1e6}, {"gbps", 1e9}, {"bps", 1},
+	}
+	scale := 1.0 / 8
+	for _, u := range units {
+		if strings.HasSuffix(val, u.suffix) {
+			val = strings.TrimSuffix(val, u.suffix)
+			scale = u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(val, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", val)
+	}
+	return v * scale, nil
+}
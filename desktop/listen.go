@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When the UDP port is taken, by a stale connector or another tool, binding
+// is retried `-listen-retries` times with a doubling backoff, then the ports
+// of `-alt-ports` are tried in order; the docker side must then be started
+// with the port bound. With `-bind-interface en0` the sockets send through the
+// interface (SO_BINDTODEVICE, IP_BOUND_IF or IP_UNICAST_IF) whatever the
+// default route. The pid of the connector is kept next to TmpPeer, so a
+// stale one holding the port is named with how to stop it.
+const listenBackoffMax = 30 * time.Second
+
+var (
+	listenRetries = 5
+	listenBackoff = time.Second
+	altPorts      = ""
+	// bindIface is the interface the tunnel sockets send through, whatever
+	// the routes, e.g. en0 past a full-tunnel VPN
+	bindIface = ""
+	// PidFile is the pid of the running connector
+	PidFile = ""
+)
+
+// parsePorts parses a list of ports separated by commas
+func parsePorts(list string) ([]int, error) {
+	var ports []int
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := strconv.Atoi(s)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+func addrInUse(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "address already in use") ||
+		strings.Contains(err.Error(), "Only one usage of each socket address"))
+}
+
+// listenUDP binds a socket of the tunnel, sending through `bindIface` if set
+func listenUDP(udpAddr *net.UDPAddr) (*net.UDPConn, error) {
+	c, err := net.ListenUDP("udp", udpAddr)
+	if err != nil || bindIface == "" {
+		return c, err
+	}
+	ifi, err := net.InterfaceByName(bindIface)
+	if err == nil {
+		err = bindDevice(c, ifi)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("bind to interface %s: %v", bindIface, err)
+	}
+	return c, nil
+}
+
+// listenTunnel binds the UDP socket of the tunnel, retrying and falling back
+// to the alternate ports while the port is in use, it returns the port bound
+func listenTunnel(ctx context.Context, host string, port int) (*net.UDPConn, int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return nil, port, err
+	}
+	c, err := listenUDP(udpAddr)
+	backoff := listenBackoff
+	for i := 0; addrInUse(err) && i < listenRetries; i++ {
+		logTransport.Warningf("[UDP LISTENER] Port %d in use, retry %d/%d in %v", port, i+1, listenRetries, backoff)
+		if i == 0 {
+			logTransport.Warningf("[UDP LISTENER] %s", staleHint(port))
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, port, ctx.Err()
+		}
+		if backoff *= 2; backoff > listenBackoffMax {
+			backoff = listenBackoffMax
+		}
+		c, err = listenUDP(udpAddr)
+	}
+	if !addrInUse(err) {
+		return c, port, err
+	}
+	alts, perr := parsePorts(altPorts)
+	if perr != nil {
+		logTransport.Warningf("[UDP LISTENER] Ignoring alt-ports: %v", perr)
+	}
+	for _, alt := range alts {
+		if c, aerr := listenUDP(&net.UDPAddr{IP: udpAddr.IP, Port: alt, Zone: udpAddr.Zone}); aerr == nil {
+			logTransport.Warningf("[UDP LISTENER] !!! Port %d in use, listening on %d instead, start the docker side with -port %d", port, alt, alt)
+			return c, alt, nil
+		}
+	}
+	return nil, port, fmt.Errorf("%v, %s", err, staleHint(port))
+}
+
+// staleHint tells who may hold the port
+func staleHint(port int) string {
+	if _, err := os.Stat(PidFile); err != nil {
+		return fmt.Sprintf("stop the tool holding udp port %d or change `port` on both sides", port)
+	}
+	pid := runningPid()
+	if pid == 0 {
+		return fmt.Sprintf("no connector running (stale %s), stop the tool holding udp port %d", PidFile, port)
+	}
+	since := ""
+	if info, err := os.Stat(TmpPeer); err == nil {
+		since = fmt.Sprintf(", last peer saved %s", info.ModTime().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("a connector is already running as pid %d%s, stop it with `docker-connector stop` or kill %d", pid, since, pid)
+}
+
+// runningPid returns the pid of another running connector, 0 if none
+func runningPid() int {
+	data, err := ioutil.ReadFile(PidFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid == os.Getpid() || !processAlive(pid) {
+		return 0
+	}
+	return pid
+}
+
+// writePidFile records the pid of the connector holding the port
+func writePidFile() {
+	if err := ioutil.WriteFile(PidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		logTransport.Debugf("[UDP LISTENER] Failed to write %s: %v", PidFile, err)
+	}
+}
+
+// removePidFile removes the pid file if it is ours
+func removePidFile() {
+	if data, err := ioutil.ReadFile(PidFile); err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(PidFile)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// `-log-format json` writes a JSON object per log record instead of text, so
+// the logs are ingested into Loki or Elasticsearch and queried: the time,
+// level, module, `[TAG]` and message, and for the packets the direction,
+// source, destination, protocol and bytes.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logFormat = logFormatText
+
+// packetInfo is the header of a logged packet, printed as text and expanded
+// into fields in JSON
+type packetInfo struct {
+	Direction string `json:"direction"`
+	Version   int    `json:"version"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	Proto     string `json:"proto"`
+	Bytes     int    `json:"bytes"`
+	ID        int    `json:"id"`
+	TTL       int    `json:"ttl"`
+}
+
+func (p *packetInfo) String() string {
+	return fmt.Sprintf("IP v%d, Len:%d, ID:%d, TTL:%d, Proto:%s, %s->%s",
+		p.Version, p.Bytes, p.ID, p.TTL, p.Proto, p.Src, p.Dst)
+}
+
+// jsonRecord is a log record in JSON
+type jsonRecord struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Module   string `json:"module"`
+	Tag      string `json:"tag,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Message  string `json:"msg"`
+	*packetInfo
+}
+
+// jsonBackend writes the records as JSON lines
+type jsonBackend struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	e := logEntry{Time: rec.Time, Level: level, Module: rec.Module, Message: strings.TrimRight(rec.Message(), "\n")}
+	r := jsonRecord{
+		Time:     rec.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Level:    level.String(),
+		Module:   rec.Module,
+		Tag:      e.tag(),
+		Instance: instanceName,
+		Message:  e.Message,
+	}
+	for _, arg := range rec.Args {
+		if p, ok := arg.(*packetInfo); ok {
+			r.packetInfo = p
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// keep `TUN->UDP` readable
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&r); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	_, err := b.w.Write(buf.Bytes())
+	return err
+}
+
+// newLogBackend returns the backend writing to w in the log format
+func newLogBackend(w io.Writer) logging.Backend {
+	if logFormat == logFormatJSON {
+		return &jsonBackend{w: w}
+	}
+	prefix := ""
+	if instanceName != "" {
+		prefix = "[" + instanceName + "] "
+	}
+	return logging.NewLogBackend(w, prefix, log.LstdFlags)
+}
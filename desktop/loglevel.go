@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+// The log level of the running service changes without a restart with
+// `loglevel <level>` (the admin API `/loglevel`), SIGUSR1 / SIGUSR2 raising or
+// lowering the verbosity by one level, or the `loglevel` directive of the
+// config file, applied when it changes, so a reload doesn't undo the others.
+//
+// The transport, control, routes, dns, expose and health parts log to
+// modules of their own, whose level is set apart with `<module>=<level>`,
+// e.g. `-log-level info,transport=debug` to trace the packets without the
+// heartbeats and the controls. The modules not named follow the level of the
+// others, which the signals and the on-demand idling change.
+var (
+	levelLock sync.Mutex
+	// configLogLevel is the last `loglevel` of the config file
+	configLogLevel = ""
+	// moduleLevels are the levels set apart by module
+	moduleLevels = make(map[string]logging.Level)
+
+	logTransport = logging.MustGetLogger("transport")
+	logControl   = logging.MustGetLogger("control")
+	logRoutes    = logging.MustGetLogger("routes")
+	logDNS       = logging.MustGetLogger("dns")
+	logExpose    = logging.MustGetLogger("expose")
+	logHealth    = logging.MustGetLogger("health")
+	logModules   = []*logging.Logger{logTransport, logControl, logRoutes, logDNS, logExpose, logHealth}
+)
+
+// setLogBackend makes the loggers of all the modules write to the backend
+func setLogBackend(backend logging.LeveledBackend) {
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	leveledBackend = backend
+	logger.SetBackend(backend)
+	for _, l := range logModules {
+		l.SetBackend(backend)
+	}
+	applyLogLevels(logging.GetLevel("vpn"))
+}
+
+// applyLogLevels sets the level of the modules not set apart, under levelLock
+func applyLogLevels(level logging.Level) {
+	logging.SetLevel(level, "vpn")
+	if leveledBackend != nil {
+		leveledBackend.SetLevel(level, "vpn")
+	}
+	spec := []string{level.String()}
+	for _, l := range logModules {
+		lvl, ok := moduleLevels[l.Module]
+		if ok {
+			spec = append(spec, l.Module+"="+lvl.String())
+		} else {
+			lvl = level
+		}
+		logging.SetLevel(lvl, l.Module)
+		if leveledBackend != nil {
+			leveledBackend.SetLevel(lvl, l.Module)
+		}
+	}
+	logLevel = strings.Join(spec, ",")
+}
+
+// setLogLevel changes the level of the logger and its backends
+func setLogLevel(level logging.Level, by string) {
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	old := logging.GetLevel("vpn")
+	applyLogLevels(level)
+	if old != level {
+		logger.Noticef("[LOG] Level %s => %s by %s", old, level, by)
+	}
+}
+
+// parseLogLevels parses `<level>`, `<module>=<level>` or both separated by
+// commas, the level nil when not given
+func parseLogLevels(val string) (*logging.Level, map[string]logging.Level, error) {
+	var base *logging.Level
+	modules := make(map[string]logging.Level)
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		name := ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, part = strings.ToLower(strings.TrimSpace(part[:i])), strings.TrimSpace(part[i+1:])
+		}
+		level, err := logging.LogLevel(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == "" {
+			base = &level
+			continue
+		}
+		known := false
+		for _, l := range logModules {
+			known = known || l.Module == name
+		}
+		if !known {
+			return nil, nil, fmt.Errorf("unknown log module %s, one of transport, control, routes, dns, expose and health", name)
+		}
+		modules[name] = level
+	}
+	return base, modules, nil
+}
+
+// setLogLevels applies a value of parseLogLevels, replacing the levels set
+// apart or adding to them, quietly without by
+func setLogLevels(val, by string, replace bool) error {
+	base, modules, err := parseLogLevels(val)
+	if err != nil {
+		return err
+	}
+	levelLock.Lock()
+	defer levelLock.Unlock()
+	old := logLevel
+	if replace {
+		moduleLevels = make(map[string]logging.Level)
+	}
+	for name, level := range modules {
+		moduleLevels[name] = level
+	}
+	level := logging.GetLevel("vpn")
+	if base != nil {
+		level = *base
+	}
+	applyLogLevels(level)
+	if old != logLevel && by != "" {
+		logger.Noticef("[LOG] Level %s => %s by %s", old, logLevel, by)
+	}
+	return nil
+}
+
+// setConfigLogLevel applies the `loglevel` of the config file when it changed
+func setConfigLogLevel(val string) {
+	if val == configLogLevel {
+		return
+	}
+	if err := setLogLevels(val, "config", true); err != nil {
+		logger.Warningf("invalid loglevel => %s: %v\n", val, err)
+		return
+	}
+	configLogLevel = val
+}
+
+// stepLogLevel raises (positive) or lowers the verbosity
+func stepLogLevel(step int, by string) {
+	level := int(logging.GetLevel("vpn")) + step
+	if level < int(logging.CRITICAL) {
+		level = int(logging.CRITICAL)
+	} else if level > int(logging.DEBUG) {
+		level = int(logging.DEBUG)
+	}
+	setLogLevel(logging.Level(level), by)
+}
+
+// serveLogLevel runs `GET /loglevel` and `POST /loglevel` with the level as
+// body
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := setLogLevels(strings.TrimSpace(string(body)), "admin", false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	levels := map[string]string{"level": logging.GetLevel("vpn").String()}
+	for _, l := range logModules {
+		levels[l.Module] = logging.GetLevel(l.Module).String()
+	}
+	writeJSON(w, levels)
+}
+
+// printLogLevel implements `loglevel [level]`
+func printLogLevel() {
+	fs := flag.NewFlagSet("loglevel", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	url := fmt.Sprintf("http://%s/loglevel", adminAddr)
+	var rsp *http.Response
+	var err error
+	if level := fs.Arg(0); level != "" {
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, url, strings.NewReader(level)); err == nil {
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set(adminHeader, "1")
+			rsp, err = http.DefaultClient.Do(req)
+		}
+	} else {
+		rsp, err = http.Get(url)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	body, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "failed to set log level => %s", body)
+		os.Exit(1)
+	}
+	os.Stdout.Write(body)
+}
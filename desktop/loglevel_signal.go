@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogSignals raises the verbosity on SIGUSR1 and lowers it on SIGUSR2
+func watchLogSignals(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case sig := <-ch:
+			if sig == syscall.SIGUSR1 {
+				stepLogLevel(1, "SIGUSR1")
+			} else {
+				stepLogLevel(-1, "SIGUSR2")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+import "context"
+
+// watchLogSignals does nothing, windows has no SIGUSR1
+func watchLogSignals(ctx context.Context) {}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log file is rotated once larger than `-log-max-size` MB: it is renamed
+// with the time, e.g. `connector-20240102T150405.log`, gzipped with
+// `-log-compress`, and the backups beyond `-log-max-backups` or older than
+// `-log-max-age` are removed. The file is appended to on start.
+var (
+	logMaxSize    = 10
+	logMaxBackups = 5
+	logMaxAge     time.Duration
+	logCompress   = false
+)
+
+const backupTime = "20060102T150405"
+
+// rotatingFile is a log file rotated by size
+type rotatingFile struct {
+	sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f := &rotatingFile{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if logMaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > int64(logMaxSize)<<20 {
+		if err := f.rotate(); err != nil {
+			// keep writing to the full file rather than losing logs
+			os.Stderr.WriteString("rotate log file error => " + err.Error() + "\n")
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to a backup and opens a new one
+func (f *rotatingFile) rotate() error {
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format(backupTime)
+	backup := base + ext
+	for i := 1; fileExists(backup) || fileExists(backup+".gz"); i++ {
+		backup = base + "-" + strconv.Itoa(i) + ext
+	}
+	f.file.Close()
+	if err := os.Rename(f.path, backup); err != nil {
+		if oerr := f.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go func() {
+		if logCompress {
+			compressBackup(backup)
+		}
+		pruneBackups(f.path)
+	}()
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compressBackup gzips a backup, removing it once compressed
+func compressBackup(path string) {
+	in, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+	os.Remove(path)
+}
+
+// pruneBackups removes the backups beyond the count or the age
+func pruneBackups(path string) {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(filepath.Base(path), ext) + "-"
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(path), prefix+"*"+ext+"*"))
+	if err != nil {
+		return
+	}
+	var backups []os.FileInfo
+	for _, name := range names {
+		stamp := strings.TrimPrefix(filepath.Base(name), prefix)
+		if len(stamp) < len(backupTime) {
+			continue
+		}
+		if _, err := time.Parse(backupTime, stamp[:len(backupTime)]); err != nil {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			backups = append(backups, info)
+		}
+	}
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ModTime().After(backups[j].ModTime())
+	})
+	for i, info := range backups {
+		if (logMaxBackups > 0 && i >= logMaxBackups) || (logMaxAge > 0 && time.Since(info.ModTime()) > logMaxAge) {
+			os.Remove(filepath.Join(filepath.Dir(path), info.Name()))
+		}
+	}
+}
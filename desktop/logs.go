@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// logRing is the number of recent log lines kept for `logs`
+const logRing = 1000
+
+type logEntry struct {
+	Time    time.Time
+	Level   logging.Level
+	Module  string
+	Message string
+}
+
+func (e *logEntry) String() string {
+	return fmt.Sprintf("%s %-8s %s: %s", e.Time.Format("2006/01/02 15:04:05"), e.Level, e.Module, e.Message)
+}
+
+// tag is the `[TAG]` prefix of the message, such as `PACKET TUN->UDP`
+func (e *logEntry) tag() string {
+	if strings.HasPrefix(e.Message, "[") {
+		if i := strings.Index(e.Message, "]"); i > 0 {
+			return e.Message[1:i]
+		}
+	}
+	return ""
+}
+
+// logFilter selects log entries by level and module, the module matches the
+// logging module or the `[TAG]` prefix of the message, ignoring case and a
+// trailing `s`, so `packets` matches `[PACKET UDP->TUN]`.
+type logFilter struct {
+	level  logging.Level
+	module string
+}
+
+func (f *logFilter) match(e *logEntry) bool {
+	if e.Level > f.level {
+		return false
+	}
+	if f.module == "" {
+		return true
+	}
+	module := strings.TrimSuffix(strings.ToLower(f.module), "s")
+	return strings.HasPrefix(strings.ToLower(e.Module), module) ||
+		strings.HasPrefix(strings.ToLower(e.tag()), module)
+}
+
+// logHub is a logging backend keeping recent entries and fanning them out to
+// the followers of the admin API.
+type logHub struct {
+	sync.Mutex
+	ring []logEntry
+	next int
+	subs map[chan *logEntry]bool
+}
+
+var logs = &logHub{subs: make(map[chan *logEntry]bool)}
+
+func (h *logHub) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	e := &logEntry{Time: rec.Time, Level: level, Module: rec.Module, Message: strings.TrimRight(rec.Message(), "\n")}
+	logEvent(level, e.Message)
+	h.Lock()
+	defer h.Unlock()
+	if len(h.ring) < logRing {
+		h.ring = append(h.ring, *e)
+	} else {
+		h.ring[h.next] = *e
+		h.next = (h.next + 1) % logRing
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	return nil
+}
+
+// Recent returns the kept entries from the oldest to the newest
+func (h *logHub) Recent() []logEntry {
+	h.Lock()
+	defer h.Unlock()
+	entries := make([]logEntry, 0, len(h.ring))
+	entries = append(entries, h.ring[h.next:]...)
+	return append(entries, h.ring[:h.next]...)
+}
+
+func (h *logHub) Subscribe() chan *logEntry {
+	ch := make(chan *logEntry, 256)
+	h.Lock()
+	h.subs[ch] = true
+	h.Unlock()
+	return ch
+}
+
+func (h *logHub) Unsubscribe(ch chan *logEntry) {
+	h.Lock()
+	delete(h.subs, ch)
+	h.Unlock()
+}
+
+// parseLevel accepts the level names of go-logging and their prefixes, such
+// as `warn` for `WARNING`
+func parseLevel(s string) (logging.Level, error) {
+	if level, err := logging.LogLevel(s); err == nil {
+		return level, nil
+	}
+	for level := logging.CRITICAL; level <= logging.DEBUG; level++ {
+		if s != "" && strings.HasPrefix(level.String(), strings.ToUpper(s)) {
+			return level, nil
+		}
+	}
+	return logging.ERROR, logging.ErrInvalidLogLevel
+}
+
+func serveLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := &logFilter{level: logging.DEBUG, module: query.Get("module")}
+	if query.Get("level") != "" {
+		level, err := parseLevel(query.Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.level = level
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var ch chan *logEntry
+	if query.Get("follow") != "" {
+		ch = logs.Subscribe()
+		defer logs.Unsubscribe(ch)
+	}
+	for _, e := range logs.Recent() {
+		if filter.match(&e) {
+			fmt.Fprintln(w, e.String())
+		}
+	}
+	if ch == nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case e := <-ch:
+			if filter.match(e) {
+				fmt.Fprintln(w, e.String())
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// printLogs implements `logs [-f] [--level warn] [--module packets]`
+func printLogs() {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("f", false, "follow the logs")
+	level := fs.String("level", "", "minimum log level")
+	module := fs.String("module", "", "module or message tag")
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	query := url.Values{}
+	if *follow {
+		query.Set("follow", "1")
+	}
+	if *level != "" {
+		query.Set("level", *level)
+	}
+	if *module != "" {
+		query.Set("module", *module)
+	}
+	rsp, err := http.Get(fmt.Sprintf("http://%s/logs?%s", adminAddr, query.Encode()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "failed to query logs => %s\n", rsp.Status)
+		os.Exit(1)
+	}
+	io.Copy(os.Stdout, rsp.Body)
+}
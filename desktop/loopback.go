@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `loopback reply|drop|respond` handles the packets to the TUN address read
+// from the TUN, which the OS only sends there when a route or a bound socket
+// misdirects them:
+//
+//	reply    writes them back to the TUN, as before
+//	drop     drops them
+//	respond  answers pings and rejects the rest with an ICMP unreachable
+//
+// They are counted whatever the mode, and logged at most once a minute
+// since they hide misrouted traffic.
+//
+// The pings of the docker side to the TUN address are answered right in the
+// forwarding loop, not written to the TUN, so a ping checks the tunnel even
+// when the firewall of the OS filters the traffic of the utun. `ping-responder
+// off` leaves them to the OS stack.
+const (
+	loopbackReply   = "reply"
+	loopbackDrop    = "drop"
+	loopbackRespond = "respond"
+	loopbackWarn    = time.Minute
+)
+
+var (
+	loopback      = loopbackReply
+	pingResponder = true
+)
+
+// LoopbackStatus counts the packets to the TUN address
+type LoopbackStatus struct {
+	Mode      string `json:"mode"`
+	Packets   uint64 `json:"packets"`
+	Replied   uint64 `json:"replied"`
+	Responded uint64 `json:"responded"`
+	Dropped   uint64 `json:"dropped"`
+	// Pings are the pings of the docker side answered
+	Pings      uint64 `json:"pings"`
+	LastSource string `json:"last_source,omitempty"`
+	Last       string `json:"last,omitempty"`
+}
+
+type loopbackCounter struct {
+	// first for 64-bit alignment of the atomic counters
+	packets, replied, responded, dropped, pings uint64
+	sync.Mutex
+	lastSource string
+	last       time.Time
+	warned     time.Time
+	warnedAt   uint64
+}
+
+var loopbacks = &loopbackCounter{}
+
+// validLoopbackMode tells whether the mode is known
+func validLoopbackMode(mode string) bool {
+	return mode == loopbackReply || mode == loopbackDrop || mode == loopbackRespond
+}
+
+// toLocalIP tells whether the packet is an IPv4 packet to the TUN address
+func toLocalIP(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return false
+	}
+	if ihl := int(packet[0]&0x0f) * 4; ihl < 20 || len(packet) < ihl {
+		return false
+	}
+	return net.IP(packet[16:20]).Equal(localIP)
+}
+
+// handleLoopback handles a packet read from the TUN, it returns false when
+// the packet is not to the TUN address
+func handleLoopback(dev tunDevice, packet []byte) bool {
+	if !toLocalIP(packet) {
+		return false
+	}
+	loopbacks.record(packet)
+	switch loopback {
+	case loopbackReply:
+		if _, err := dev.Write(packet); err != nil {
+			logger.Warningf("local write error: %v\n", err)
+			atomic.AddUint64(&loopbacks.dropped, 1)
+			return true
+		}
+		atomic.AddUint64(&loopbacks.replied, 1)
+	case loopbackRespond:
+		reply := loopbackResponse(packet)
+		if reply == nil {
+			atomic.AddUint64(&loopbacks.dropped, 1)
+			return true
+		}
+		if _, err := dev.Write(reply); err != nil {
+			logger.Warningf("local write error: %v\n", err)
+			atomic.AddUint64(&loopbacks.dropped, 1)
+			return true
+		}
+		atomic.AddUint64(&loopbacks.responded, 1)
+	default:
+		atomic.AddUint64(&loopbacks.dropped, 1)
+	}
+	return true
+}
+
+// answerPing answers a ping of the docker side to the TUN address, it returns
+// false for the other packets, written to the TUN
+func answerPing(packet []byte) bool {
+	if !pingResponder || !toLocalIP(packet) || packet[9] != 1 {
+		return false
+	}
+	if ihl := int(packet[0]&0x0f) * 4; len(packet) < ihl+8 || packet[ihl] != 8 {
+		return false
+	}
+	cli := shared.Client()
+	reply := loopbackResponse(packet)
+	if cli == nil || reply == nil {
+		return false
+	}
+	atomic.AddUint64(&loopbacks.pings, 1)
+	sendClient(reply, cli)
+	return true
+}
+
+// record counts the packet and warns about them once in a while
+func (l *loopbackCounter) record(packet []byte) {
+	n := atomic.AddUint64(&l.packets, 1)
+	src := net.IP(packet[12:16]).String()
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	l.lastSource, l.last = src, now
+	if now.Sub(l.warned) < loopbackWarn {
+		return
+	}
+	logTransport.Warningf("[LOCAL LOOPBACK] %d packets to the local IP %v read from the TUN, the last from %s protocol %d; a route or bound socket misdirects them, handled with `loopback %s`",
+		n-l.warnedAt, localIP, src, packet[9], loopback)
+	l.warned, l.warnedAt = now, n
+}
+
+// Status returns the counters
+func (l *loopbackCounter) Status() *LoopbackStatus {
+	st := &LoopbackStatus{
+		Mode:      loopback,
+		Packets:   atomic.LoadUint64(&l.packets),
+		Replied:   atomic.LoadUint64(&l.replied),
+		Responded: atomic.LoadUint64(&l.responded),
+		Dropped:   atomic.LoadUint64(&l.dropped),
+		Pings:     atomic.LoadUint64(&l.pings),
+	}
+	l.Lock()
+	defer l.Unlock()
+	if !l.last.IsZero() {
+		st.LastSource = l.lastSource
+		st.Last = l.last.Format(time.RFC3339)
+	}
+	return st
+}
+
+// loopbackResponse builds the answer of the internal responder: an echo
+// reply to a ping, nothing to other ICMP messages, else an ICMP protocol or
+// port unreachable
+func loopbackResponse(packet []byte) []byte {
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if total > len(packet) || total < ihl {
+		return nil
+	}
+	// fragments but the first can't be answered
+	if binary.BigEndian.Uint16(packet[6:])&0x1fff != 0 {
+		return nil
+	}
+	var body []byte
+	switch proto := packet[9]; {
+	case proto == 1:
+		if total < ihl+8 || packet[ihl] != 8 {
+			return nil
+		}
+		body = append([]byte(nil), packet[ihl:total]...)
+		body[0] = 0
+	default:
+		code := byte(2)
+		if proto == 6 || proto == 17 {
+			code = 3
+		}
+		quoted := packet[:total]
+		if len(quoted) > ihl+8 {
+			quoted = quoted[:ihl+8]
+		}
+		body = make([]byte, 8+len(quoted))
+		body[0] = 3
+		body[1] = code
+		copy(body[8:], quoted)
+	}
+	body[2], body[3] = 0, 0
+	binary.BigEndian.PutUint16(body[2:], ^ipSum(body, 0))
+	reply := make([]byte, 20+len(body))
+	ip := reply[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(reply)))
+	ip[8] = 64
+	ip[9] = 1
+	copy(ip[12:16], packet[16:20])
+	copy(ip[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(ip[10:], ^ipSum(ip, 0))
+	copy(reply[20:], body)
+	return reply
+}
@@ -6,8 +6,8 @@ import (
 	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/kardianos/service"
 	"github.com/op/go-logging"
@@ -16,9 +16,7 @@ import (
 var (
 	logger *logging.Logger
 	conn   *net.UDPConn
-	cli    *net.UDPAddr
 	peer   net.IP
-	expose *net.UDPConn
 	subnet *net.IPNet
 	// TmpPeer peer tmp file
 	TmpPeer = ""
@@ -29,35 +27,120 @@ var (
 	addr           = "192.168.251.1/24"
 	configFile     = ""
 	watch          = true
-	routes         = make(map[string]bool)
-	tokens         = make(map[string]string)
-	iptables       = make(map[string]bool)
 	logLevel       = "INFO"
-	sessions       = make(map[uint64]*net.UDPAddr)
 	localIP        = net.IP(make([]byte, 4))
 	pong           = false
 	cliAddr        = ""
 	bind           = true
 	logfile        = ""
 	leveledBackend logging.LeveledBackend
-	hosts      	   = ""
+	// hostsTemplates name the containers on the docker side
+	hostsTemplates []string
+	stopTimeout    = 10
+	adminAddr      = "127.0.0.1:2513"
+	noClient       = "queue"
+	queueSize      = 64
+	heartbeat      = 5000
+	deadAfter      = 3
+	learnFor       time.Duration
+	fragSize       = 0
+	knockPort      = 0
+	workers        = 1
+	knockSecret    = ""
+	knockTTL       = 120
+	tunDriver      = "wintun"
+	ifName         = ""
+	// pushHeartbeat pushes heartbeat and deadAfter to the docker side
+	pushHeartbeat = false
+	// persistPeer keeps the address of the client in TmpPeer across restarts
+	persistPeer = true
 )
 
 func init() {
-	TmpPeer = filepath.Join(os.TempDir(), "desktop-docker-connector.peer")
-	logging.SetLevel(logging.INFO, "vpn")
+	statePaths()
 	logger = logging.MustGetLogger("vpn")
+	applyLogLevels(logging.INFO)
 	flag.IntVar(&MTU, "mtu", MTU, "mtu")
 	flag.StringVar(&host, "host", host, "udp listen host")
 	flag.IntVar(&port, "port", port, "udp listen port")
+	flag.StringVar(&altPorts, "alt-ports", altPorts, "udp ports tried in order when the port stays in use, e.g. 2521,2531")
+	flag.IntVar(&listenRetries, "listen-retries", listenRetries, "retries while the udp port is in use")
+	flag.StringVar(&bindIface, "bind-interface", bindIface, "network interface the tunnel sockets send through, e.g. en0")
+	flag.DurationVar(&listenBackoff, "listen-backoff", listenBackoff, "first wait between the retries, doubling up to 30s")
+	flag.StringVar(&rendezvous, "rendezvous", rendezvous, "rendezvous server introducing the sides behind NATs, e.g. vps.example.com:2520")
+	flag.StringVar(&rendezvousSession, "rendezvous-session", rendezvousSession, "session name shared with the docker side on the rendezvous server")
+	flag.BoolVar(&relayOnly, "relay-only", relayOnly, "skip the punch, the rendezvous server relays the tunnel")
+	flag.StringVar(&relaySecret, "relay-secret", relaySecret, "shared secret signing the registrations to the rendezvous server")
+	flag.StringVar(&runMode, "mode", runMode, "connector, or relay to run the rendezvous server relaying the tunnels on -host and -port")
+	flag.StringVar(&transport, "transport", transport, "tunnel over \"ssh user@host\" to a remote docker host instead of udp")
+	flag.StringVar(&sshCommand, "ssh-command", sshCommand, "remote command of the ssh transport bridging to the docker side")
 	flag.StringVar(&addr, "addr", addr, "virtual network address")
 	flag.StringVar(&configFile, "config", configFile, "config file")
 	flag.BoolVar(&watch, "watch", watch, "watch config file")
-	flag.StringVar(&logLevel, "log-level", logLevel, "log level")
+	flag.StringVar(&logLevel, "log-level", logLevel, "log level, and of the modules as <module>=<level>, e.g. info,transport=debug")
 	flag.BoolVar(&pong, "pong", pong, "pong")
-	flag.StringVar(&cliAddr, "cli", cliAddr, "udp client address")
+	flag.StringVar(&cliAddr, "cli", cliAddr, "udp client address, a name being resolved again")
+	flag.DurationVar(&resolveEvery, "resolve-every", resolveEvery, "interval resolving again the name of -cli, 0 to only resolve on failures")
 	flag.BoolVar(&bind, "bind", bind, "bind to interface")
+	flag.StringVar(&stack, "stack", stack, "data plane: tun, or userspace without TUN, routes nor root")
 	flag.StringVar(&logfile, "log-file", logfile, "log file")
+	flag.IntVar(&logMaxSize, "log-max-size", logMaxSize, "size in MB rotating the log file, 0 to disable")
+	flag.IntVar(&logMaxBackups, "log-max-backups", logMaxBackups, "rotated log files kept, 0 to keep all")
+	flag.DurationVar(&logMaxAge, "log-max-age", logMaxAge, "age removing the rotated log files, 0 to keep them")
+	flag.BoolVar(&logCompress, "log-compress", logCompress, "gzip the rotated log files")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log format: text or json")
+	flag.StringVar(&runtimeName, "runtime", runtimeName, "container runtime routed without config file: auto, docker-desktop, colima, rancher-desktop or podman")
+	flag.StringVar(&restartDelays, "restart-delays", restartDelays, "install: delays restarting the windows service after a crash, or off")
+	flag.DurationVar(&restartReset, "restart-reset", restartReset, "install: time without crash resetting the restart delays of the windows service")
+	flag.BoolVar(&delayedStart, "delayed-start", delayedStart, "install: start the windows service a little after the boot")
+	flag.StringVar(&stateDir, "state-dir", stateDir, "directory of the saved peer and the pid file, the temporary directory by default")
+	flag.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	flag.BoolVar(&takeover, "takeover", takeover, "take over the udp socket and the TUN of the running connector")
+	flag.StringVar(&statusFile, "status-file", statusFile, "file the status is written to periodically as JSON")
+	flag.DurationVar(&statusInterval, "status-interval", statusInterval, "interval writing -status-file")
+	flag.BoolVar(&webUI, "web-ui", webUI, "serve the web dashboard on the admin address to local clients")
+	flag.StringVar(&noClient, "no-client", noClient, "outbound packets without client: drop or queue")
+	flag.StringVar(&socksAddr, "socks", socksAddr, "SOCKS5 listen address dialing through the docker side, e.g. 127.0.0.1:1080")
+	flag.StringVar(&conflictMode, "conflict", conflictMode, "routes overlapping the host networks: warn, refuse or off")
+	flag.StringVar(&loopback, "loopback", loopback, "packets to the local IP: reply, drop or respond")
+	flag.IntVar(&queueSize, "queue-size", queueSize, "max packets queued without client")
+	flag.DurationVar(&queueAge, "queue-max-age", queueAge, "max time a packet is queued without client, 0 for no limit")
+	flag.IntVar(&heartbeat, "heartbeat", heartbeat, "expected heartbeat interval of the client in milliseconds")
+	flag.IntVar(&deadAfter, "dead-after", deadAfter, "missed heartbeats before the client is declared dead")
+	flag.BoolVar(&pushHeartbeat, "push-heartbeat", pushHeartbeat, "push -heartbeat and -dead-after to the docker side with the controls")
+	flag.DurationVar(&natKeepalive, "nat-keepalive", natKeepalive, "interval of the keepalives on each idle path of the tunnel, kept below 30s for the NATs, 0 to disable")
+	flag.BoolVar(&persistPeer, "persist-peer", persistPeer, "save the address of the client and reuse it after a restart")
+	flag.DurationVar(&healthWithin, "health-within", healthWithin, "max silence of the docker side before unhealthy, 0 to ignore")
+	flag.DurationVar(&exitUnhealthy, "exit-unhealthy", exitUnhealthy, "exit once unhealthy for the duration, 0 to disable")
+	flag.DurationVar(&learnFor, "learn", learnFor, "learn the used destinations for the duration")
+	flag.IntVar(&fragSize, "fragment", fragSize, "fragment tunneled packets larger than this size, 0 to disable")
+	flag.IntVar(&workers, "workers", workers, "goroutines forwarding the packets from the docker side, keeping the order of each flow")
+	flag.IntVar(&batch, "batch", batch, "max datagrams read or written per syscall on linux, 1 to disable")
+	flag.IntVar(&controlPort, "control-port", controlPort, "udp port of the control traffic, 0 to share the data port")
+	flag.BoolVar(&compress, "compress", compress, "compress tunneled packets with lz4 if the docker side accepts")
+	flag.StringVar(&dscpSpec, "dscp", dscpSpec, "DSCP of the tunnel datagrams, e.g. ef, af41, cs1, 10 or inherit")
+	flag.BoolVar(&dedup, "dedup", dedup, "drop the datagrams duplicated on the way if the docker side accepts")
+	flag.IntVar(&fecCount, "fec", fecCount, "datagrams per parity of the forward error correction if the docker side accepts, 0 to disable")
+	flag.IntVar(&knockPort, "knock-port", knockPort, "udp port accepting knocks, 0 to disable")
+	flag.StringVar(&knockSecret, "knock-secret", knockSecret, "shared secret of the knocks")
+	flag.IntVar(&knockTTL, "knock-ttl", knockTTL, "seconds the port stays open after a knock")
+	flag.StringVar(&controlSecret, "control-secret", controlSecret, "shared secret the controls pushed by the docker side must be signed with")
+	flag.BoolVar(&tapMode, "tap", tapMode, "create a tap device and carry ethernet frames if the docker side accepts")
+	flag.StringVar(&ifName, "interface", ifName, "name of the interface, e.g. utun7 to pin the unit on macOS")
+	flag.DurationVar(&onDemand, "on-demand", onDemand, "idle after this long without the docker side, resuming on its next datagram, 0 to disable")
+	flag.DurationVar(&sessionIdle, "session-idle", sessionIdle, "idle time expiring the expose sessions")
+	flag.IntVar(&sessionMax, "session-max", sessionMax, "max expose sessions")
+	flag.StringVar(&tunDriver, "tun-driver", tunDriver, "tun driver on windows: wintun, or tap for TAP-Windows")
+	flag.BoolVar(&allowUnsigned, "allow-unsigned", allowUnsigned, "install without a valid signed release manifest")
+	flag.IntVar(&stopTimeout, "stop-timeout", stopTimeout, "seconds to wait for a graceful stop")
+	flag.StringVar(&traceExpr, "trace", traceExpr, "log only the packets matching a filter, e.g. \"host 172.18.0.5 and tcp port 443\"")
+	flag.IntVar(&traceHex, "trace-hex", traceHex, "bytes of the traced packets dumped in hex")
+	flag.BoolVar(&selftest, "selftest", selftest, "check the TUN with an emulated docker side, exiting 1 on failure")
+	flag.StringVar(&netemSpec, "netem", netemSpec, "emulate a bad network on the tunnel for testing, e.g. \"delay 50ms 10ms loss 1%\"")
+	flag.IntVar(&bufferLen, "buffer-size", bufferLen, "bytes of the packet buffers up to 65535, 0 to follow the MTU")
+	flag.BoolVar(&softFail, "soft-fail", softFail, "run degraded on the userspace stack without the privileges for the TUN, instead of exiting")
+	flag.BoolVar(&devAPI, "dev-api", devAPI, "serve the developer endpoints of the admin api, /inject injecting crafted packets")
+	flag.DurationVar(&waitDocker, "wait-docker", waitDocker, "wait up to this long for the docker engine before installing the routes, and follow its restarts, 0 to disable")
 }
 
 func runCmd(format string, a ...interface{}) error {
@@ -82,15 +165,18 @@ func runOutCmd(format string, a ...interface{}) (string, error) {
 }
 
 func main() {
+	takeInstanceArg()
 	flag.Parse()
+	selectInstance()
 	cfg := &service.Config{
 		Name:        "DesktopDockerConnector",
 		DisplayName: "Desktop Docker Connector",
 		Description: "Connect Desktop and Docker",
 	}
 	if len(os.Args) > 1 {
-		cfg.Arguments = os.Args[2:]
+		cfg.Arguments = serviceArguments(os.Args[2:])
 	}
+	cfg.Name, cfg.DisplayName, cfg.Arguments = instanceService(cfg.Name, cfg.DisplayName, cfg.Arguments)
 	s, err := service.New(&Connector{}, cfg)
 	if err != nil {
 		logger.Fatal(err)
@@ -98,17 +184,10 @@ func main() {
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "install":
-			if err := s.Install(); err != nil {
-				logger.Fatal(err)
-			}
-			logger.Info("Install Service Success!")
+			runInstall(s, cfg)
 			return
 		case "uninstall":
-			s.Stop()
-			if err := s.Uninstall(); err != nil {
-				logger.Fatal(err)
-			}
-			logger.Info("Uninstall Service Success!")
+			runUninstall(s)
 			return
 		case "start":
 			if err := s.Start(); err != nil {
@@ -123,15 +202,107 @@ func main() {
 			logger.Info("Stop Service Success!")
 			return
 		case "restart":
-			s.Stop()
-			if err := s.Start(); err != nil {
+			if err := s.Restart(); err != nil {
 				logger.Fatal(err)
 			}
 			logger.Info("Restart Service Success!")
 			return
+		case "update":
+			runUpdate(s)
+			return
+		case "upgrade":
+			runUpgrade()
+			return
 		case "config":
 			sendConfig()
 			return
+		case "diag":
+			runDiag()
+			return
+		case "import":
+			runImport()
+			return
+		case "generate":
+			runGenerate()
+			return
+		case "learn":
+			runLearn()
+			return
+		case "flows":
+			runFlows()
+			return
+		case "profile":
+			runProfileCommand()
+			return
+		case "pins":
+			runPinsCommand()
+			return
+		case "activate":
+			runActivateCommand()
+			return
+		case "dns":
+			runDNS()
+			return
+		case "probe":
+			runProbeCommand()
+			return
+		case "inject":
+			runInjectCommand()
+			return
+		case "bench":
+			runBenchCommand()
+			return
+		case "route":
+			runRouteCommand()
+			return
+		case "runtime":
+			runRuntimeCommand()
+			return
+		case "rendezvous":
+			runRendezvous()
+			return
+		case "logs":
+			printLogs()
+			return
+		case "audit":
+			runAudit()
+			return
+		case "loglevel":
+			printLogLevel()
+			return
+		case "healthcheck":
+			runHealthcheck()
+			return
+		case "doctor":
+			runDoctorCommand()
+			return
+		case "generate-launchd":
+			runGenerateLaunchd()
+			return
+		case "instances":
+			runInstances()
+			return
+		case "wg-keys":
+			runWgKeys()
+			return
+		case "status":
+			var args []string
+			showEvents := false
+			for _, arg := range os.Args[2:] {
+				if arg == "-events" || arg == "--events" {
+					showEvents = true
+				} else {
+					args = append(args, arg)
+				}
+			}
+			flag.CommandLine.Parse(args)
+			applyEnv(flag.CommandLine)
+			if showEvents {
+				printEvents()
+			} else {
+				printStatus()
+			}
+			return
 		}
 	}
 	if err := s.Run(); err != nil {
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// The packets rewritten on their way, for the host services, the MSS
+// clamping or the replies made up locally, keep valid checksums with these
+// helpers. A field changed in place updates the checksums incrementally with
+// updateChecksum, a packet built or changed wholesale recomputes them with
+// fixChecksums. Only IPv4 is handled, and the TCP, UDP and ICMP headers of a
+// first fragment.
+const (
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+)
+
+// ipSum is the ones' complement sum of the data, added to sum
+func ipSum(data []byte, sum uint16) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+// updateChecksum adjusts a checksum for a 16-bit field changing from old to
+// new, see RFC 1624
+func updateChecksum(sum, old, new uint16) uint16 {
+	v := uint32(^sum) + uint32(^old) + uint32(new)
+	v = (v & 0xffff) + (v >> 16)
+	v = (v & 0xffff) + (v >> 16)
+	return ^uint16(v)
+}
+
+// l4Offset returns the offset of the checksum of the TCP, UDP or ICMP header
+// of an IPv4 packet, -1 for another protocol, a later fragment or a cut header
+func l4Offset(packet []byte) int {
+	ihl := int(packet[0]&0x0f) * 4
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return -1
+	}
+	switch packet[9] {
+	case protoTCP:
+		if len(packet) >= ihl+18 {
+			return ihl + 16
+		}
+	case protoUDP:
+		if len(packet) >= ihl+8 {
+			return ihl + 6
+		}
+	case protoICMP:
+		if len(packet) >= ihl+4 {
+			return ihl + 2
+		}
+	}
+	return -1
+}
+
+// fixChecksums recomputes the checksums of the header and of TCP, UDP or
+// ICMP of a whole IPv4 packet, a fragmented one only getting its header's
+func fixChecksums(packet []byte) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:4]))
+	if ihl < 20 || total < ihl || total > len(packet) {
+		return
+	}
+	packet = packet[:total]
+	packet[10], packet[11] = 0, 0
+	binary.BigEndian.PutUint16(packet[10:], ^ipSum(packet[:ihl], 0))
+	if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+		return
+	}
+	off := l4Offset(packet)
+	if off < 0 {
+		return
+	}
+	l4 := packet[ihl:]
+	packet[off], packet[off+1] = 0, 0
+	if packet[9] == protoICMP {
+		binary.BigEndian.PutUint16(packet[off:], ^ipSum(l4, 0))
+		return
+	}
+	var pseudo [12]byte
+	copy(pseudo[0:8], packet[12:20])
+	pseudo[9] = packet[9]
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(l4)))
+	sum := ^ipSum(l4, ipSum(pseudo[:], 0))
+	if sum == 0 && packet[9] == protoUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(packet[off:], sum)
+}
+
+// decrementTTL lowers the TTL of an IPv4 packet by one as a router does,
+// updating the header checksum, it returns false when the packet expires
+func decrementTTL(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return true
+	}
+	if packet[8] <= 1 {
+		return false
+	}
+	old := binary.BigEndian.Uint16(packet[8:10])
+	packet[8]--
+	binary.BigEndian.PutUint16(packet[10:], updateChecksum(binary.BigEndian.Uint16(packet[10:]), old, binary.BigEndian.Uint16(packet[8:10])))
+	return true
+}
+
+// rewriteAddr replaces the source (12) or destination (16) address of an IPv4
+// packet, updating the checksums of the header and of TCP or UDP
+func rewriteAddr(packet []byte, off int, ip net.IP) {
+	ip = ip.To4()
+	ihl := int(packet[0]&0x0f) * 4
+	l4 := -1
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+		switch packet[9] {
+		case 6:
+			if len(packet) >= ihl+18 {
+				l4 = ihl + 16
+			}
+		case 17:
+			if len(packet) >= ihl+8 && binary.BigEndian.Uint16(packet[ihl+6:]) != 0 {
+				l4 = ihl + 6
+			}
+		}
+	}
+	for i := 0; i < 4; i += 2 {
+		old := binary.BigEndian.Uint16(packet[off+i:])
+		new := binary.BigEndian.Uint16(ip[i:])
+		binary.BigEndian.PutUint16(packet[10:], updateChecksum(binary.BigEndian.Uint16(packet[10:]), old, new))
+		if l4 >= 0 {
+			sum := updateChecksum(binary.BigEndian.Uint16(packet[l4:]), old, new)
+			if sum == 0 && packet[9] == 17 {
+				sum = 0xffff
+			}
+			binary.BigEndian.PutUint16(packet[l4:], sum)
+		}
+		binary.BigEndian.PutUint16(packet[off+i:], new)
+	}
+}
+
+// clampMSS lowers the MSS option of an IPv4 TCP SYN to fit into `mtu` and
+// updates the TCP checksum incrementally, it returns whether it was clamped.
+func clampMSS(packet []byte, mtu int) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 6 {
+		return false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	// only the first fragment carries the TCP header
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) < ihl+20 {
+		return false
+	}
+	tcp := packet[ihl:]
+	if tcp[13]&0x02 == 0 { // SYN
+		return false
+	}
+	doff := int(tcp[12]>>4) * 4
+	if doff < 20 || len(tcp) < doff {
+		return false
+	}
+	max := uint16(mtu - 40)
+	for i := 20; i < doff; {
+		switch tcp[i] {
+		case 0: // end of options
+			return false
+		case 1: // nop
+			i++
+			continue
+		}
+		if i+1 >= doff || tcp[i+1] < 2 {
+			return false
+		}
+		if tcp[i] == 2 && tcp[i+1] == 4 && i+4 <= doff {
+			mss := binary.BigEndian.Uint16(tcp[i+2:])
+			if mss <= max {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:], max)
+			sum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], updateChecksum(sum, mss, max))
+			logTransport.Debugf("[MTU] Clamped MSS %d => %d", mss, max)
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
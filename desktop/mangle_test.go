@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// Packets as seen on the TUN, between the desktop (192.168.251.1) and a
+// container (172.17.0.2), with valid checksums.
+const (
+	// SYN with the MSS, SACK, timestamps and window scale of linux
+	capturedSYN = "4500003c1c4640004006b6b8c0a8fb01ac110002c82200506b8b456700000000a002faf0a1930000020405b40402080a9e1b2c3d0000000001030307"
+	// PSH|ACK carrying a request
+	capturedTCP = "450000581c4740004006b69bc0a8fb01ac110002c82200506b8b45683c1d9a02801801f62e6700000101080a9e1b2c5a0023f1a9474554202f20485454502f312e310d0a486f73743a203137322e31372e302e320d0a0d0a"
+	// SYN whose IP header carries a router alert, IHL 6
+	capturedSYNOptions = "460000381c504000400621aec0a8fb01ac11000294040000c82401bb12345678000000008002721062b70000020405b40101040201030307"
+	// DNS query for example.com
+	capturedDNS = "450000398f3e0000401183b8ac110002c0a8fb019cbb0035002589d5a1b201000001000000000000076578616d706c6503636f6d0000010001"
+	// datagram sent without a checksum
+	capturedNoSum = "4500002c8f3f0000401183c4ac110002c0a8fb019cbc270f0018000068656c6c6f20636f6e6e6563746f720a"
+	// echo request of ping
+	capturedEcho = "45000054beef4000400113fcc0a8fb01ac110002080033e0123400016554a0d200000000101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+	// capturedWhole split at 32 bytes of UDP
+	capturedWhole         = "45000044424200004011d0a9ac110002c0a8fb019cbd14e900306393404142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f6061626364656667"
+	capturedFirstFragment = "45000034424220004011b0b9ac110002c0a8fb019cbd14e900306393404142434445464748494a4b4c4d4e4f5051525354555657"
+	capturedLaterFragment = "45000024424200044011d0c5ac110002c0a8fb0158595a5b5c5d5e5f6061626364656667"
+)
+
+func hexPacket(t *testing.T, s string) []byte {
+	t.Helper()
+	p, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// fold is the ones' complement sum of data, computed apart from ipSum
+func fold(data []byte) uint16 {
+	var s uint64
+	for i := 0; i < len(data); i++ {
+		if i%2 == 0 {
+			s += uint64(data[i]) << 8
+		} else {
+			s += uint64(data[i])
+		}
+	}
+	for s > 0xffff {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+// checkSums fails unless the header and, of a whole packet, the TCP, UDP or
+// ICMP checksum are valid
+func checkSums(t *testing.T, p []byte) {
+	t.Helper()
+	ihl := int(p[0]&0x0f) * 4
+	if fold(p[:ihl]) != 0xffff {
+		t.Errorf("invalid header checksum %04x", binary.BigEndian.Uint16(p[10:]))
+	}
+	if binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+		return
+	}
+	l4 := p[ihl:]
+	var sum uint16
+	switch p[9] {
+	case protoICMP:
+		sum = fold(l4)
+	case protoUDP:
+		if binary.BigEndian.Uint16(l4[6:]) == 0 {
+			return
+		}
+		fallthrough
+	case protoTCP:
+		pseudo := append(append([]byte{}, p[12:20]...), 0, p[9], byte(len(l4)>>8), byte(len(l4)))
+		sum = fold(append(pseudo, l4...))
+	}
+	if sum != 0xffff {
+		t.Errorf("invalid checksum of protocol %d", p[9])
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	// the example of RFC 1624
+	if sum := updateChecksum(0xdd2f, 0x5555, 0x3285); sum != 0x0000 {
+		t.Errorf("updateChecksum(0xdd2f, 0x5555, 0x3285) = %04x, expected 0000", sum)
+	}
+	for _, s := range []string{capturedSYN, capturedSYNOptions, capturedDNS, capturedEcho, capturedLaterFragment} {
+		p := hexPacket(t, s)
+		// change the identification and compare with a full recompute
+		old := binary.BigEndian.Uint16(p[4:6])
+		binary.BigEndian.PutUint16(p[4:6], old^0xa5a5)
+		sum := updateChecksum(binary.BigEndian.Uint16(p[10:]), old, old^0xa5a5)
+		p[10], p[11] = 0, 0
+		ihl := int(p[0]&0x0f) * 4
+		if want := ^ipSum(p[:ihl], 0); sum != want {
+			t.Errorf("%x: updateChecksum = %04x, recomputed %04x", p[:ihl], sum, want)
+		}
+	}
+}
+
+func TestFixChecksums(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  string
+		// l4 is the offset of the TCP, UDP or ICMP checksum fixed, 0 if left
+		l4 int
+	}{
+		{"tcp syn", capturedSYN, 36},
+		{"tcp data", capturedTCP, 36},
+		{"ip options", capturedSYNOptions, 40},
+		{"udp", capturedDNS, 26},
+		{"icmp", capturedEcho, 22},
+		{"first fragment", capturedFirstFragment, 0},
+		{"later fragment", capturedLaterFragment, 0},
+	}
+	for _, tt := range tests {
+		want := hexPacket(t, tt.pkt)
+		p := hexPacket(t, tt.pkt)
+		p[10], p[11] = 0xde, 0xad
+		if tt.l4 > 0 {
+			p[tt.l4], p[tt.l4+1] = 0xbe, 0xef
+		}
+		fixChecksums(p)
+		if !bytes.Equal(p, want) {
+			t.Errorf("%s: fixChecksums =\n%x, expected\n%x", tt.name, p, want)
+		}
+	}
+	// trailing bytes past the total length are left out of the sums
+	p := append(hexPacket(t, capturedDNS), 0xff, 0xff, 0xff)
+	p[26], p[27] = 0, 1
+	fixChecksums(p)
+	checkSums(t, p[:len(p)-3])
+	// a UDP sum of 0 is sent as 0xffff
+	p = hexPacket(t, capturedNoSum)
+	fixChecksums(p)
+	checkSums(t, p)
+	if sum := binary.BigEndian.Uint16(p[26:]); sum == 0 {
+		t.Errorf("fixChecksums left the UDP checksum empty")
+	}
+	// neither a cut packet nor IPv6 is touched
+	for _, p := range [][]byte{hexPacket(t, capturedSYN)[:19], {0x60, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		q := append([]byte{}, p...)
+		fixChecksums(q)
+		if !bytes.Equal(p, q) {
+			t.Errorf("fixChecksums changed %x", p)
+		}
+	}
+}
+
+func TestDecrementTTL(t *testing.T) {
+	for _, s := range []string{capturedSYN, capturedSYNOptions, capturedDNS, capturedEcho, capturedFirstFragment, capturedLaterFragment} {
+		p := hexPacket(t, s)
+		if !decrementTTL(p) {
+			t.Fatalf("%s: expired with a TTL of 64", s)
+		}
+		if p[8] != 63 {
+			t.Errorf("%s: TTL %d, expected 63", s, p[8])
+		}
+		checkSums(t, p)
+	}
+	p := hexPacket(t, capturedEcho)
+	p[8] = 1
+	if decrementTTL(p) {
+		t.Errorf("a TTL of 1 didn't expire")
+	}
+	// the checksum stays valid down every TTL
+	p = hexPacket(t, capturedSYNOptions)
+	p[8] = 255
+	fixChecksums(p)
+	for p[8] > 1 {
+		decrementTTL(p)
+		checkSums(t, p)
+	}
+}
+
+func TestRewriteAddr(t *testing.T) {
+	to := net.ParseIP("10.11.12.13")
+	for _, s := range []string{capturedSYN, capturedTCP, capturedSYNOptions, capturedDNS, capturedNoSum, capturedEcho, capturedLaterFragment} {
+		for _, off := range []int{12, 16} {
+			p := hexPacket(t, s)
+			rewriteAddr(p, off, to)
+			if !net.IP(p[off : off+4]).Equal(to) {
+				t.Errorf("%s: address at %d is %v", s, off, net.IP(p[off:off+4]))
+			}
+			checkSums(t, p)
+		}
+	}
+	// a datagram sent without a checksum stays without
+	p := hexPacket(t, capturedNoSum)
+	rewriteAddr(p, 12, to)
+	if sum := binary.BigEndian.Uint16(p[26:]); sum != 0 {
+		t.Errorf("rewriteAddr set the checksum %04x of a datagram without", sum)
+	}
+	// the first fragment carries the checksum of the whole datagram, which
+	// stays valid reassembled
+	first, later, whole := hexPacket(t, capturedFirstFragment), hexPacket(t, capturedLaterFragment), hexPacket(t, capturedWhole)
+	rewriteAddr(first, 16, to)
+	rewriteAddr(later, 16, to)
+	rewriteAddr(whole, 16, to)
+	checkSums(t, first)
+	checkSums(t, later)
+	reassembled := append(append([]byte{}, whole[:20]...), first[20:]...)
+	reassembled = append(reassembled, later[20:]...)
+	checkSums(t, reassembled)
+	if !bytes.Equal(reassembled[20:], whole[20:]) {
+		t.Errorf("reassembled =\n%x, expected\n%x", reassembled[20:], whole[20:])
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  string
+		mtu  int
+		// mss is the one expected at the offset, 0 when not clamped
+		off, mss int
+	}{
+		{"syn", capturedSYN, 1400, 42, 1360},
+		{"syn fitting", capturedSYN, 1500, 42, 0},
+		{"syn with nops and ip options", capturedSYNOptions, 1280, 46, 1240},
+		{"not a syn", capturedTCP, 1280, 0, 0},
+		{"udp", capturedDNS, 1280, 0, 0},
+	}
+	for _, tt := range tests {
+		p := hexPacket(t, tt.pkt)
+		clamped := clampMSS(p, tt.mtu)
+		if clamped != (tt.mss != 0) {
+			t.Errorf("%s: clampMSS = %v", tt.name, clamped)
+			continue
+		}
+		if clamped {
+			if mss := binary.BigEndian.Uint16(p[tt.off:]); int(mss) != tt.mss {
+				t.Errorf("%s: MSS %d, expected %d", tt.name, mss, tt.mss)
+			}
+			checkSums(t, p)
+		} else if !bytes.Equal(p, hexPacket(t, tt.pkt)) {
+			t.Errorf("%s: changed without clamping", tt.name)
+		}
+	}
+	// a later fragment has no TCP header to clamp
+	p := hexPacket(t, capturedSYN)
+	binary.BigEndian.PutUint16(p[6:8], 0x0003)
+	if clampMSS(p, 576) {
+		t.Errorf("clamped a later fragment")
+	}
+	// options ending before the MSS, or with a bogus length, are left alone
+	for _, opts := range []string{"00000000", "01010100", "02010000"} {
+		p := hexPacket(t, capturedSYN)
+		copy(p[40:], hexPacket(t, opts))
+		if clampMSS(p, 576) {
+			t.Errorf("clamped the options %s", opts)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The docker side started with `-mdns` pushes `mdns <type> <ip:port> <name>`
+// for the services of the containers labeled `desktop-connector.mdns`, e.g.
+// `mdns _http._tcp 172.18.0.5:8080 My App`, and `mdns <type> <ip:port>` once
+// they are gone. With `mdns on` each one is published on the LAN: a port
+// forward of the host, on the port of the container when free, advertised as
+// the name with Bonjour, by dns-sd on macOS and windows and avahi-publish on
+// linux, so the phones and tablets of the LAN find the dev services and reach
+// them through the connector. The services aren't written to the config, they
+// are pushed again periodically and withdrawn on stop.
+var mdnsType = regexp.MustCompile(`^_[a-z0-9-]+\._(tcp|udp)$`)
+
+// MDNSStatus describes an advertised service
+type MDNSStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Target     string `json:"target"`
+	Listen     string `json:"listen,omitempty"`
+	Advertised bool   `json:"advertised"`
+	Error      string `json:"error,omitempty"`
+}
+
+type mdnsService struct {
+	name, typ, target string
+	fwd               *portForward
+	cmd               *exec.Cmd
+	err               string
+}
+
+type mdnsTable struct {
+	sync.Mutex
+	enabled  bool
+	services map[string]*mdnsService
+}
+
+var mdnsAds = &mdnsTable{services: make(map[string]*mdnsService)}
+
+// pushedMDNS handles a pushed mdns line, it returns false for the other lines
+func pushedMDNS(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "mdns" {
+		return false
+	}
+	typ := strings.ToLower(fields[1])
+	host, _, err := net.SplitHostPort(fields[2])
+	if !mdnsType.MatchString(typ) || err != nil || net.ParseIP(host).To4() == nil {
+		logDNS.Warningf("[MDNS] Invalid service => %s", line)
+		return true
+	}
+	mdnsAds.Push(typ, fields[2], strings.Join(fields[3:], " "))
+	return true
+}
+
+// Push records a service of the docker side, withdrawn without name
+func (t *mdnsTable) Push(typ, target, name string) {
+	t.Lock()
+	defer t.Unlock()
+	key := typ + " " + target
+	s := t.services[key]
+	if s != nil && s.name == name {
+		return
+	}
+	if s != nil {
+		t.withdraw(s)
+		delete(t.services, key)
+		if name == "" {
+			logDNS.Infof("[MDNS] Withdrawn %s %s", typ, s.name)
+			events.Add("mdns", "withdrawn %s %s", typ, s.name)
+		}
+	}
+	if name == "" {
+		return
+	}
+	s = &mdnsService{name: name, typ: typ, target: target}
+	t.services[key] = s
+	if t.enabled {
+		t.publish(s)
+	}
+}
+
+// Set applies `mdns on|off`, publishing or withdrawing the services
+func (t *mdnsTable) Set(enabled bool) {
+	t.Lock()
+	defer t.Unlock()
+	if enabled == t.enabled {
+		return
+	}
+	t.enabled = enabled
+	for _, s := range t.services {
+		if enabled {
+			t.publish(s)
+		} else {
+			t.withdraw(s)
+		}
+	}
+}
+
+// publish forwards a port of the host to the service and advertises it
+func (t *mdnsTable) publish(s *mdnsService) {
+	proto := "tcp"
+	if strings.HasSuffix(s.typ, "._udp") {
+		proto = "udp"
+	}
+	if proto == "udp" && stack == stackUserspace {
+		logDNS.Warningf("[MDNS] %s %s needs the tun stack", s.typ, s.name)
+		s.err = "needs the tun stack"
+		return
+	}
+	_, port, _ := net.SplitHostPort(s.target)
+	f := &portForward{forwardRule: forwardRule{proto: proto, listen: "0.0.0.0:" + port, target: s.target}}
+	if err := f.open(); err != nil {
+		// the port of the container is taken on the host, any will do
+		f.listen = "0.0.0.0:0"
+		if err := f.open(); err != nil {
+			logDNS.Warningf("[MDNS] Failed to listen for %s %s: %v", s.typ, s.name, err)
+			s.err = err.Error()
+			return
+		}
+	}
+	var addr net.Addr
+	if f.tcp != nil {
+		addr = f.tcp.ln.Addr()
+	} else {
+		addr = f.pc.LocalAddr()
+	}
+	f.listen = addr.String()
+	_, port, _ = net.SplitHostPort(f.listen)
+	s.fwd, s.err = f, ""
+	p, _ := strconv.Atoi(port)
+	cmd := mdnsCommand(s.name, s.typ, p)
+	if err := cmd.Start(); err != nil {
+		logDNS.Warningf("[MDNS] Failed to advertise %s %s: %v", s.typ, s.name, err)
+		s.err = err.Error()
+		return
+	}
+	go cmd.Wait()
+	s.cmd = cmd
+	logDNS.Infof("[MDNS] Advertising %s %s on port %s => %s", s.typ, s.name, port, s.target)
+	events.Add("mdns", "advertising %s %s on port %s", s.typ, s.name, port)
+}
+
+func (t *mdnsTable) withdraw(s *mdnsService) {
+	if s.cmd != nil {
+		s.cmd.Process.Kill()
+		s.cmd = nil
+	}
+	if s.fwd != nil {
+		s.fwd.close()
+		s.fwd = nil
+	}
+	s.err = ""
+}
+
+// Close withdraws the services, pushed again once running
+func (t *mdnsTable) Close() {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.services {
+		t.withdraw(s)
+	}
+	t.services = make(map[string]*mdnsService)
+}
+
+// Status lists the services by name
+func (t *mdnsTable) Status() []MDNSStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.services) == 0 {
+		return nil
+	}
+	list := make([]MDNSStatus, 0, len(t.services))
+	for _, s := range t.services {
+		st := MDNSStatus{Name: s.name, Type: s.typ, Target: s.target, Advertised: s.cmd != nil, Error: s.err}
+		if s.fwd != nil {
+			st.Listen = s.fwd.listen
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name+list[i].Type < list[j].Name+list[j].Type })
+	return list
+}
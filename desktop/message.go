@@ -0,0 +1,38 @@
+package main
+
+import (
+	"docker-connector/pkg/connector"
+)
+
+// The datagrams and the framing of the controls are those of
+// connector, shared with the tools embedding the protocol.
+const (
+	controlsType   = connector.Controls
+	controlsHeader = connector.ControlsHeader
+	// controlsMax bounds the payload a header may announce
+	controlsMax = connector.ControlsMax
+
+	controlChunk       = connector.ControlChunk
+	controlChunkHeader = connector.ControlChunkHeader
+	featureChunks      = connector.FeatureChunks
+	featureControls    = connector.FeatureControls
+)
+
+// controlChunks splits a payload in chunks of at most size bytes
+func controlChunks(payload []byte, size int) [][]byte {
+	return connector.ControlChunks(payload, size)
+}
+
+// messageType names the type of a datagram
+func messageType(data []byte) string {
+	return connector.MessageType(data)
+}
+
+// controlHeader returns the header of a controls payload of l bytes, the
+// legacy one unless the docker side advertised featureControls
+func controlHeader(l int, features int32) []byte {
+	if features&featureControls == 0 {
+		return connector.LegacyControlHeader(l)
+	}
+	return connector.ControlHeader(l)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The traffic of the routed subnets, the uptime and the reconnects of the
+// docker side are added up in the metrics file of the state directory, saved
+// every metricsSave and on stop, so the counters survive the restarts. The
+// first sample of a new day sums up the previous one, bytes per subnet, peak
+// throughput over a sample, uptime and reconnects, in a `[METRICS]` line, and
+// fires `on-daily-summary`, an event and the hook of the config if any, with
+//
+//	CONNECTOR_DATE        the day, e.g. 2024-05-01
+//	CONNECTOR_TX_BYTES    desktop to docker
+//	CONNECTOR_RX_BYTES    docker to desktop
+//	CONNECTOR_PEAK_BPS    the peak throughput in bits per second
+//	CONNECTOR_UPTIME      the seconds the connector ran that day
+//	CONNECTOR_RECONNECTS  the connections of the docker side after the first
+//	CONNECTOR_SUMMARY     the day as JSON, with the bytes per subnet
+//
+// The last metricsDays days are kept with the totals in `metrics` of `status`.
+const (
+	metricsFileName  = "desktop-docker-connector.metrics"
+	metricsSample    = 10 * time.Second
+	metricsSave      = time.Minute
+	metricsDays      = 30
+	hookDailySummary = "on-daily-summary"
+)
+
+// MetricsFile keeps the counters across the restarts
+var MetricsFile = ""
+
+// DailyMetrics sums up the traffic of a day
+type DailyMetrics struct {
+	Date    string                   `json:"date"`
+	Subnets map[string]SubnetTraffic `json:"subnets"`
+	TxBytes uint64                   `json:"tx_bytes"`
+	RxBytes uint64                   `json:"rx_bytes"`
+	// PeakBps is the highest throughput of both directions over a sample
+	PeakBps    uint64 `json:"peak_bps"`
+	Uptime     int64  `json:"uptime_seconds"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// MetricsStatus is the content of the metrics file
+type MetricsStatus struct {
+	Since      string                   `json:"since"`
+	Total      map[string]SubnetTraffic `json:"total"`
+	Uptime     int64                    `json:"uptime_seconds"`
+	Reconnects uint64                   `json:"reconnects"`
+	Today      DailyMetrics             `json:"today"`
+	Days       []DailyMetrics           `json:"days,omitempty"`
+}
+
+type metricsStore struct {
+	sync.Mutex
+	st MetricsStatus
+	// last is the snapshot of the counters at lastAt
+	last   map[string]SubnetTraffic
+	lastAt time.Time
+	// connected is set once the first docker side of the run connected
+	connected bool
+	loaded    bool
+}
+
+var metrics = &metricsStore{}
+
+// load reads the metrics file, once
+func (m *metricsStore) load(now time.Time) {
+	if m.loaded {
+		return
+	}
+	m.loaded = true
+	if MetricsFile != "" {
+		if data, err := ioutil.ReadFile(MetricsFile); err == nil {
+			if err := json.Unmarshal(data, &m.st); err != nil {
+				logHealth.Warningf("[METRICS] Invalid %s: %v", MetricsFile, err)
+				m.st = MetricsStatus{}
+			}
+		} else if !os.IsNotExist(err) {
+			logHealth.Warningf("[METRICS] Failed to read %s: %v", MetricsFile, err)
+		}
+	}
+	if m.st.Since == "" {
+		m.st.Since = now.Format(time.RFC3339)
+	}
+	if m.st.Total == nil {
+		m.st.Total = make(map[string]SubnetTraffic)
+	}
+	if m.st.Today.Date == "" {
+		m.st.Today = DailyMetrics{Date: now.Format("2006-01-02")}
+	}
+	if m.st.Today.Subnets == nil {
+		m.st.Today.Subnets = make(map[string]SubnetTraffic)
+	}
+	m.last, m.lastAt = traffic.Snapshot(), now
+}
+
+// Connected counts a connection of the docker side, the first of the run
+// being no reconnect
+func (m *metricsStore) Connected() {
+	m.Lock()
+	defer m.Unlock()
+	m.load(time.Now())
+	if !m.connected {
+		m.connected = true
+		return
+	}
+	m.st.Reconnects++
+	m.st.Today.Reconnects++
+}
+
+// Sample adds the traffic since the previous sample, summing up the previous
+// day first on a new one
+func (m *metricsStore) Sample(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.load(now)
+	if date := now.Format("2006-01-02"); date != m.st.Today.Date {
+		m.summarize()
+		m.st.Today = DailyMetrics{Date: date, Subnets: make(map[string]SubnetTraffic)}
+	}
+	snap := traffic.Snapshot()
+	var bytes uint64
+	for key, cur := range snap {
+		d := trafficDelta(cur, m.last[key])
+		if d == (SubnetTraffic{}) {
+			continue
+		}
+		m.st.Total[key] = addTraffic(m.st.Total[key], d)
+		m.st.Today.Subnets[key] = addTraffic(m.st.Today.Subnets[key], d)
+		m.st.Today.TxBytes += d.TxBytes
+		m.st.Today.RxBytes += d.RxBytes
+		bytes += d.TxBytes + d.RxBytes
+	}
+	if secs := now.Sub(m.lastAt).Seconds(); secs >= 1 {
+		if bps := uint64(float64(bytes*8) / secs); bps > m.st.Today.PeakBps {
+			m.st.Today.PeakBps = bps
+		}
+		m.st.Uptime += int64(secs)
+		m.st.Today.Uptime += int64(secs)
+	}
+	m.last, m.lastAt = snap, now
+}
+
+// trafficDelta returns the traffic between two snapshots of a subnet, its
+// counters starting over when it was routed again
+func trafficDelta(cur, last SubnetTraffic) SubnetTraffic {
+	if cur.TxBytes < last.TxBytes || cur.RxBytes < last.RxBytes || cur.TxPackets < last.TxPackets || cur.RxPackets < last.RxPackets {
+		return cur
+	}
+	return SubnetTraffic{
+		TxBytes:   cur.TxBytes - last.TxBytes,
+		TxPackets: cur.TxPackets - last.TxPackets,
+		RxBytes:   cur.RxBytes - last.RxBytes,
+		RxPackets: cur.RxPackets - last.RxPackets,
+	}
+}
+
+func addTraffic(a, b SubnetTraffic) SubnetTraffic {
+	return SubnetTraffic{
+		TxBytes:   a.TxBytes + b.TxBytes,
+		TxPackets: a.TxPackets + b.TxPackets,
+		RxBytes:   a.RxBytes + b.RxBytes,
+		RxPackets: a.RxPackets + b.RxPackets,
+	}
+}
+
+// summarize logs the summary of today, runs the hook and keeps the day
+func (m *metricsStore) summarize() {
+	day := m.st.Today
+	var subnets []string
+	for key, t := range day.Subnets {
+		subnets = append(subnets, fmt.Sprintf("%s %d/%d", key, t.TxBytes, t.RxBytes))
+	}
+	sort.Strings(subnets)
+	logHealth.Infof("[METRICS] Daily summary %s: tx %d bytes, rx %d bytes, peak %.1f Mbit/s, uptime %v, %d reconnects, subnets [%s]",
+		day.Date, day.TxBytes, day.RxBytes, float64(day.PeakBps)/1e6, time.Duration(day.Uptime)*time.Second, day.Reconnects, strings.Join(subnets, ", "))
+	hooks.Fire(hookDailySummary,
+		"CONNECTOR_DATE="+day.Date,
+		fmt.Sprintf("CONNECTOR_TX_BYTES=%d", day.TxBytes),
+		fmt.Sprintf("CONNECTOR_RX_BYTES=%d", day.RxBytes),
+		fmt.Sprintf("CONNECTOR_PEAK_BPS=%d", day.PeakBps),
+		fmt.Sprintf("CONNECTOR_UPTIME=%d", day.Uptime),
+		fmt.Sprintf("CONNECTOR_RECONNECTS=%d", day.Reconnects),
+		"CONNECTOR_SUMMARY="+map2json(day))
+	m.st.Days = append(m.st.Days, day)
+	if len(m.st.Days) > metricsDays {
+		m.st.Days = m.st.Days[len(m.st.Days)-metricsDays:]
+	}
+}
+
+// Save writes the metrics file
+func (m *metricsStore) Save() {
+	m.Lock()
+	defer m.Unlock()
+	if MetricsFile == "" || !m.loaded {
+		return
+	}
+	data, _ := json.MarshalIndent(m.st, "", "  ")
+	if err := ioutil.WriteFile(MetricsFile, data, 0644); err != nil {
+		logHealth.Warningf("[METRICS] Failed to save %s: %v", MetricsFile, err)
+	}
+}
+
+// Close adds the last traffic and saves the metrics on stop
+func (m *metricsStore) Close() {
+	m.Sample(time.Now())
+	m.Save()
+}
+
+// Status returns a copy of the metrics, nil before the first sample
+func (m *metricsStore) Status() *MetricsStatus {
+	m.Lock()
+	defer m.Unlock()
+	if !m.loaded {
+		return nil
+	}
+	var st MetricsStatus
+	data, _ := json.Marshal(m.st)
+	json.Unmarshal(data, &st)
+	return &st
+}
+
+// watchMetrics samples the traffic and saves the metrics
+func (c *Connector) watchMetrics() {
+	ticker := time.NewTicker(metricsSample)
+	defer ticker.Stop()
+	metrics.Sample(time.Now())
+	saved := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			metrics.Sample(now)
+			if now.Sub(saved) >= metricsSave {
+				metrics.Save()
+				saved = now
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
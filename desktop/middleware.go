@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+
+	"docker-connector/pkg/connector"
+)
+
+// The packets between the TUN and the docker side go through a chain of
+// middlewares in each direction: the pause of the schedules, the ACL, the
+// protocols of the routes, the bandwidth limit, the MSS clamp, the learning
+// mode, the middlewares registered with connector.Use, the connection
+// tracking, the mirrors, the stats, then the network emulation which sends
+// them now, later or never. The host services filter the inbound ones first.
+// The NAT of the LAN is made by the firewall of the system, outside of the
+// chains.
+var outboundChain, inboundChain connector.Chain
+
+// buildChains makes the chains, send writes the packets to their way
+func buildChains(sendOut, sendIn func([]byte)) {
+	custom := connector.Registered()
+	outboundChain = append(connector.Chain{pauseMiddleware, aclMiddleware, protoMiddleware, limitMiddleware, mssMiddleware, learnMiddleware},
+		append(custom, conntrackMiddleware, mirrorMiddleware, statsMiddleware, netemMiddleware(sendOut))...)
+	inboundChain = append(connector.Chain{hostSvcMiddleware, pauseMiddleware, aclMiddleware, protoMiddleware, limitMiddleware, mssMiddleware},
+		append(custom, conntrackMiddleware, mirrorMiddleware, statsMiddleware, netemMiddleware(sendIn))...)
+	if len(custom) > 0 {
+		logTransport.Infof("[MIDDLEWARE] %d registered middlewares", len(custom))
+	}
+}
+
+// endpoint returns the address of the host side of a packet, nil when it
+// isn't IPv4
+func endpoint(pkt []byte, dir connector.Direction) net.IP {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return nil
+	}
+	if dir == connector.Inbound {
+		return net.IP(pkt[12:16])
+	}
+	return net.IP(pkt[16:20])
+}
+
+func hostSvcMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	if !hostSvc.Inbound(pkt) {
+		logExpose.Debugf("[HOST SERVICES] Denied %d bytes from %v", len(pkt), endpoint(pkt, dir))
+		peerStats.Drop("host_services")
+		return nil, true
+	}
+	return pkt, false
+}
+
+func pauseMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	if schedules.Paused() {
+		logger.Debugf("[SCHEDULE] Tunnel paused, dropping %s packet of %v", dir, endpoint(pkt, dir))
+		peerStats.Drop("paused")
+		if dir == connector.Outbound {
+			sendUnreachable(pkt, icmpAdminProhibits)
+		}
+		return nil, true
+	}
+	return pkt, false
+}
+
+func aclMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	if !acl.Allow(pkt) {
+		if debugEnabled() {
+			logTransport.Debugf("[ACL] Denied %d %s bytes of %v", len(pkt), dir, endpoint(pkt, dir))
+		}
+		peerStats.Drop("acl")
+		if dir == connector.Outbound {
+			sendUnreachable(pkt, icmpAdminProhibits)
+		}
+		return nil, true
+	}
+	return pkt, false
+}
+
+func protoMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	ip := endpoint(pkt, dir)
+	if ip == nil {
+		return pkt, false
+	}
+	if !routeProtos.Allow(ip, pkt[9]) {
+		if debugEnabled() {
+			logTransport.Debugf("[PROTO] Denied %d %s bytes of protocol %s of %v", len(pkt), dir, protoName(pkt[9]), ip)
+		}
+		peerStats.Drop("proto")
+		if dir == connector.Outbound {
+			sendUnreachable(pkt, icmpAdminProhibits)
+		}
+		return nil, true
+	}
+	return pkt, false
+}
+
+func limitMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	limit, reason := upLimit, "limit_up"
+	if dir == connector.Inbound {
+		limit, reason = downLimit, "limit_down"
+	}
+	if !limit.Wait(len(pkt)) {
+		if debugEnabled() {
+			logTransport.Debugf("[LIMIT] Dropped %d %s bytes of %v over the limit", len(pkt), dir, endpoint(pkt, dir))
+		}
+		peerStats.Drop(reason)
+		return nil, true
+	}
+	return pkt, false
+}
+
+func mssMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	clampMSS(pkt, MTU)
+	return pkt, false
+}
+
+func learnMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	learning.Observe(pkt)
+	return pkt, false
+}
+
+func statsMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	traffic.Count(endpoint(pkt, dir), len(pkt), dir == connector.Outbound)
+	if dir == connector.Inbound {
+		peerStats.Received(len(pkt))
+	} else {
+		peerStats.Sent(pkt)
+	}
+	return pkt, false
+}
+
+// netemMiddleware hands the packets to the network emulation when active
+func netemMiddleware(send func([]byte)) connector.Middleware {
+	return func(pkt []byte, dir connector.Direction) ([]byte, bool) {
+		if !netem.Active() {
+			return pkt, false
+		}
+		netem.Send(pkt, send)
+		return nil, true
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"docker-connector/pkg/connector"
+)
+
+// `mirror <host:port> [filter]` sends a copy of the tunneled packets to a UDP
+// endpoint, those matching the filter of `-trace` when given, so an IDS or
+// the Wireshark of a colleague observes the containers live from another
+// machine:
+//
+//	mirror 192.168.1.20:37008
+//	mirror 10.0.0.5:37008 net 172.18.0.0/16 and tcp port 443
+//
+// The packets are sent as TZSP, the sniffer protocol of MikroTik, which
+// Wireshark decodes on port 37008 and tzsp2pcap turns into a pcap, with an
+// Ethernet header whose MAC addresses tell the way: 02:00:00:00:00:01 for the
+// desktop, 02:00:00:00:00:02 for the docker side. The packets are mirrored as
+// they cross the tunnel, after the ACL and the limits.
+const (
+	// tzspHeader is the version 1, the received type, the Ethernet
+	// encapsulation and the end tag
+	tzspHeader = "\x01\x00\x00\x01\x01"
+	mirrorHead = len(tzspHeader) + 14
+)
+
+var (
+	mirrorDesktop = []byte{2, 0, 0, 0, 0, 1}
+	mirrorDocker  = []byte{2, 0, 0, 0, 0, 2}
+)
+
+// MirrorStatus describes a mirror target
+type MirrorStatus struct {
+	Target  string `json:"target"`
+	Filter  string `json:"filter,omitempty"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	Errors  uint64 `json:"errors,omitempty"`
+}
+
+type mirrorTarget struct {
+	// first for their alignment on 32 bits
+	packets, bytes, errors uint64
+	target, filter         string
+	match                  traceMatch
+	conn                   *net.UDPConn
+}
+
+type mirrorTable struct {
+	sync.RWMutex
+	targets []*mirrorTarget
+}
+
+var mirrors = &mirrorTable{}
+
+// parseMirror parses the value of `mirror`
+func parseMirror(val string) (*mirrorTarget, error) {
+	fields := strings.Fields(val)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("expected <host:port> [filter]")
+	}
+	if _, err := net.ResolveUDPAddr("udp", fields[0]); err != nil {
+		return nil, err
+	}
+	m := &mirrorTarget{target: fields[0], filter: strings.Join(fields[1:], " ")}
+	if m.filter != "" {
+		match, err := parseTrace(m.filter)
+		if err != nil {
+			return nil, err
+		}
+		m.match = match
+	}
+	return m, nil
+}
+
+// Set applies the targets of the config, keeping the sockets and counters of
+// the unchanged ones
+func (t *mirrorTable) Set(targets []*mirrorTarget) {
+	t.Lock()
+	defer t.Unlock()
+	old := make(map[string]*mirrorTarget)
+	for _, m := range t.targets {
+		old[m.target+" "+m.filter] = m
+	}
+	var list []*mirrorTarget
+	for _, m := range targets {
+		key := m.target + " " + m.filter
+		if o, ok := old[key]; ok {
+			delete(old, key)
+			list = append(list, o)
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", m.target)
+		if err == nil {
+			m.conn, err = net.DialUDP("udp", nil, addr)
+		}
+		if err != nil {
+			logger.Warningf("[MIRROR] Failed to open %s: %v", m.target, err)
+			continue
+		}
+		logger.Infof("[MIRROR] Mirroring %s to %s", map[bool]string{true: m.filter, false: "all packets"}[m.filter != ""], m.target)
+		events.Add("mirror", "to %s", m.target)
+		list = append(list, m)
+	}
+	for _, o := range old {
+		logger.Infof("[MIRROR] Stopped mirroring to %s", o.target)
+		o.conn.Close()
+	}
+	t.targets = list
+}
+
+// Close stops the mirrors
+func (t *mirrorTable) Close() {
+	t.Set(nil)
+}
+
+// Mirror sends a copy of a packet to the matching targets
+func (t *mirrorTable) Mirror(pkt []byte, dir connector.Direction) {
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.targets) == 0 || len(pkt) < 20 {
+		return
+	}
+	var buf *[]byte
+	for _, m := range t.targets {
+		if m.match != nil && (pkt[0]>>4 != 4 || !m.match(pkt)) {
+			continue
+		}
+		if buf == nil {
+			buf = getBuffer(mirrorHead + len(pkt))
+			defer putBuffer(buf)
+			b := *buf
+			copy(b, tzspHeader)
+			eth := b[len(tzspHeader):mirrorHead]
+			src, dst := mirrorDesktop, mirrorDocker
+			if dir == connector.Inbound {
+				src, dst = mirrorDocker, mirrorDesktop
+			}
+			copy(eth[0:6], dst)
+			copy(eth[6:12], src)
+			eth[12], eth[13] = 0x08, 0x00
+			if pkt[0]>>4 == 6 {
+				eth[12], eth[13] = 0x86, 0xDD
+			}
+			copy(b[mirrorHead:], pkt)
+		}
+		if _, err := m.conn.Write(*buf); err != nil {
+			atomic.AddUint64(&m.errors, 1)
+			continue
+		}
+		atomic.AddUint64(&m.packets, 1)
+		atomic.AddUint64(&m.bytes, uint64(len(pkt)))
+	}
+}
+
+// Status lists the targets
+func (t *mirrorTable) Status() []MirrorStatus {
+	t.RLock()
+	defer t.RUnlock()
+	var list []MirrorStatus
+	for _, m := range t.targets {
+		list = append(list, MirrorStatus{
+			Target:  m.target,
+			Filter:  m.filter,
+			Packets: atomic.LoadUint64(&m.packets),
+			Bytes:   atomic.LoadUint64(&m.bytes),
+			Errors:  atomic.LoadUint64(&m.errors),
+		})
+	}
+	return list
+}
+
+func mirrorMiddleware(pkt []byte, dir connector.Direction) ([]byte, bool) {
+	mirrors.Mirror(pkt, dir)
+	return pkt, false
+}
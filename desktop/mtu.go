@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The packet buffers follow the MTU, growing when a reload raises it, or are
+// `-buffer-size` bytes for jumbo packets of docker networks beyond it. A packet
+// filling a buffer may have been cut, it is dropped and counted in
+// `truncated_reads` of the status rather than forwarded corrupted.
+const maxBufferSize = 65535
+
+var (
+	// bufferLen is `-buffer-size`, 0 to follow the MTU
+	bufferLen      = 0
+	truncatedReads uint64
+	truncatedAt    int64
+)
+
+// bufferSize is the size of the packet buffers, large enough for the MTU
+func bufferSize() int {
+	if bufferLen > 0 {
+		if bufferLen > maxBufferSize {
+			return maxBufferSize
+		}
+		return bufferLen
+	}
+	if MTU+100 > 2000 {
+		return MTU + 100
+	}
+	return 2000
+}
+
+// grownBuffer returns buf, or a larger one once the MTU was raised
+func grownBuffer(buf []byte) []byte {
+	if size := bufferSize(); size > len(buf) {
+		return make([]byte, size)
+	}
+	return buf
+}
+
+// truncated tells whether a read of n bytes filled its buffer, counting it
+// and warning at most once a minute
+func truncated(n, size int, where string) bool {
+	if n < size {
+		return false
+	}
+	count := atomic.AddUint64(&truncatedReads, 1)
+	now := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&truncatedAt); now-last > int64(time.Minute) && atomic.CompareAndSwapInt64(&truncatedAt, last, now) {
+		logTransport.Warningf("[MTU] %s read of %d bytes fills the buffer, dropped, %d so far, raise `mtu` or -buffer-size", where, n, count)
+	}
+	return true
+}
+
+// applyMTU changes the MTU of the TUN interface after a config reload
+func applyMTU(ifname string, mtu int) {
+	if ifname == "" {
+		return
+	}
+	logTransport.Infof("[MTU] Setting %s mtu => %d", ifname, mtu)
+	if err := setMTU(ifname, mtu); err != nil {
+		logTransport.Warningf("[MTU] Failed to set mtu of %s: %v", ifname, err)
+	}
+}
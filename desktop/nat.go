@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// `nat` lets the containers reach the devices of a LAN of the desktop, e.g.
+// printers or other dev machines, through the tunnel:
+//
+//	nat auto
+//	nat 10.10.0.0/16
+//
+// `auto` is the network of the interface of the default route. The docker
+// side routes the networks through the tunnel, pushed as `nat <subnet>` in
+// the controls, masquerading the containers to its address of the virtual
+// network, and the desktop forwards their packets to the LAN with the source
+// rewritten to its address there by the NAT of the system, which
+// tracks the replies and recomputes the checksums: pf on macOS, iptables
+// MASQUERADE on linux and WinNAT on windows.
+var (
+	// natSubnets are the networks reached through the NAT
+	natSubnets []string
+	natIface   = ""
+)
+
+// lanNetwork returns the interface of the default route and its network
+func lanNetwork() (string, *net.IPNet, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53})
+	if err != nil {
+		return "", nil, err
+	}
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, ifi := range ifaces {
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return ifi.Name, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("no interface with %s", local)
+}
+
+// applyNAT sets up the NAT of the `nat` directives when they changed
+func applyNAT(vals []string) {
+	var lans []string
+	ifname := ""
+	if len(vals) > 0 {
+		name, lan, err := lanNetwork()
+		if err != nil {
+			logRoutes.Warningf("[NAT] No LAN found: %v", err)
+			return
+		}
+		ifname = name
+		for _, val := range vals {
+			if val == "auto" {
+				lans = append(lans, lan.String())
+			} else if _, ipnet, err := net.ParseCIDR(val); err == nil && ipnet.IP.To4() != nil {
+				lans = append(lans, ipnet.String())
+			} else {
+				logger.Warningf("invalid nat => %s\n", val)
+			}
+		}
+		sort.Strings(lans)
+	}
+	if ifname == natIface && strings.Join(lans, ",") == strings.Join(natSubnets, ",") {
+		return
+	}
+	if len(natSubnets) > 0 {
+		if err := clearNAT(); err != nil {
+			logRoutes.Warningf("[NAT] Failed to clear the NAT: %v", err)
+		}
+	}
+	natSubnets, natIface = lans, ifname
+	if len(lans) == 0 || subnet == nil {
+		return
+	}
+	logRoutes.Infof("[NAT] %s => %s via %s", subnet, strings.Join(lans, ", "), ifname)
+	if err := setNAT(ifname, subnet, lans); err != nil {
+		logRoutes.Warningf("[NAT] Failed to set up the NAT: %v", err)
+	}
+}
+
+// stopNAT removes the NAT when stopping
+func stopNAT() {
+	if len(natSubnets) == 0 {
+		return
+	}
+	if err := clearNAT(); err != nil {
+		logRoutes.Warningf("[NAT] Failed to clear the NAT: %v", err)
+	}
+	natSubnets = nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// `nat-keepalive <interval>` keeps the NAT mappings of the tunnel open across
+// quiet periods, e.g. to a remote docker host, where long-lived but idle TCP
+// sessions would die with the mapping of the router:
+//
+//	nat-keepalive 20s
+//
+// Every interval each outer path, the data socket to the client unless it
+// carried a datagram since the previous one, and the control socket to its
+// client, gets a one byte keepalive the docker side drops. The interval,
+// below the 30s after which many routers forget an idle UDP mapping, goes to
+// the docker side with the controls, which keeps its sockets open the same
+// way. It is independent of `heartbeat`, which may be longer, and only docker
+// sides advertising the keepalives get them.
+const (
+	keepaliveType    = connector.Keepalive
+	featureKeepalive = connector.FeatureKeepalive
+)
+
+var (
+	natKeepalive time.Duration
+	// dataWrites counts the datagrams written to the client
+	dataWrites uint64
+	// keepalivesSent counts the keepalives, for the status
+	keepalivesSent uint64
+)
+
+// parseNATKeepalive parses the value of `nat-keepalive`, 0 for off
+func parseNATKeepalive(val string) (time.Duration, error) {
+	if val == "off" || val == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("expected an interval of at least 1s or off")
+	}
+	if d >= 30*time.Second {
+		logTransport.Warningf("[KEEPALIVE] nat-keepalive %v, many routers forget an idle mapping after 30s", d)
+	}
+	return d, nil
+}
+
+// watchNATKeepalive sends the keepalives of `nat-keepalive`, a reload
+// changing the interval taking effect at the next tick
+func (c *Connector) watchNATKeepalive() {
+	var writes uint64
+	for {
+		d := natKeepalive
+		if d <= 0 {
+			d = time.Second
+		}
+		select {
+		case <-time.After(d):
+		case <-c.ctx.Done():
+			return
+		}
+		w := atomic.LoadUint64(&dataWrites)
+		idle := w == writes
+		writes = w
+		client := shared.Client()
+		if natKeepalive <= 0 || client == nil || atomic.LoadInt32(&peerFeatures)&featureKeepalive == 0 {
+			continue
+		}
+		if idle {
+			sendKeepalive(conn, client)
+		}
+		ctlLock.Lock()
+		ctl, ctlClient := ctlConn, ctlCli
+		ctlLock.Unlock()
+		if ctlClient != nil {
+			sendKeepalive(ctl, ctlClient)
+		}
+	}
+}
+
+func sendKeepalive(c *net.UDPConn, addr *net.UDPAddr) {
+	if _, err := c.WriteToUDP([]byte{keepaliveType}, addr); err != nil {
+		logTransport.Debugf("[KEEPALIVE] Failed to send to %v: %v", addr, err)
+		return
+	}
+	atomic.AddUint64(&keepalivesSent, 1)
+	logTransport.Debugf("[KEEPALIVE] Sent to %v from %v", addr, c.LocalAddr())
+}
+
+// KeepaliveStatus is the NAT keepalive in the status
+type KeepaliveStatus struct {
+	Interval string `json:"interval"`
+	Sent     uint64 `json:"sent"`
+}
+
+func keepaliveStatus() *KeepaliveStatus {
+	if natKeepalive <= 0 {
+		return nil
+	}
+	return &KeepaliveStatus{Interval: natKeepalive.String(), Sent: atomic.LoadUint64(&keepalivesSent)}
+}
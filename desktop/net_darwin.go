@@ -1,38 +1,442 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	sysroutes "docker-connector/pkg/routes"
 
 	"github.com/songgao/water"
 )
 
-func setup(local, peer net.IP, subnet *net.IPNet) *water.Interface {
-	config := water.Config{
-		DeviceType: water.TUN,
+// tunnelProvider configures the utun handed over by the packet tunnel
+// provider instead of running ifconfig and route, see netext_darwin.go
+type tunnelProvider interface {
+	setup(local, peer net.IP, subnet *net.IPNet) tunDevice
+	addRoute(key string)
+	delRoute(key string)
+	setMTU(mtu int)
+	setDNS(domain, server string)
+}
+
+// extension is set when built as the data plane of the network extension
+var extension tunnelProvider
+
+func setup(local, peer net.IP, subnet *net.IPNet) (tunDevice, error) {
+	if extension != nil {
+		return extension.setup(local, peer, subnet), nil
 	}
-	iface, err := water.New(config)
-	if err != nil {
-		logger.Fatal(err)
+	var iface tunDevice
+	if tapMode {
+		// utun has no tap, it needs the tuntaposx driver
+		config := water.Config{DeviceType: water.TAP}
+		config.PlatformSpecificParams = water.PlatformSpecificParams{Name: "tap0", Driver: water.MacOSDriverTunTapOSX}
+		if strings.HasPrefix(ifName, "tap") {
+			config.Name = ifName
+		}
+		dev, err := water.New(config)
+		if err != nil {
+			return nil, err
+		}
+		iface = newTAP(dev)
+	} else {
+		// the unit of the utun can be pinned, not its name
+		dev, err := openUTUN(ifName)
+		if err != nil && ifName != "" {
+			logTransport.Warningf("[TUN] Failed to create %s, letting macOS choose the unit: %v", ifName, err)
+			dev, err = openUTUN("")
+		}
+		if err != nil {
+			return nil, err
+		}
+		iface = dev
 	}
 	logger.Infof("interface => %s\n", iface.Name())
-	if out, err := runOutCmd("%s %s inet %s %s netmask 255.255.255.255 up", "ifconfig", iface.Name(), local, peer); err != nil {
-		logger.Warningf("%s\n", out)
-		logger.Fatal(err)
+	if err := sysroutes.AddAddress(iface.Name(), local, peer); err != nil {
+		iface.Close()
+		return nil, err
+	}
+	if err := sysroutes.SetLink(iface.Name(), MTU, 0); err != nil {
+		logger.Warning(err)
 	}
-	runCmd("ifconfig %s mtu %d", iface.Name(), MTU)
-	if err := runCmd("route -n add -host %s -interface %s", local, iface.Name()); err != nil {
+	if err := sysroutes.Add(hostRoute(local, iface.Name())); err != nil && !errors.Is(err, sysroutes.ErrExists) {
 		logger.Warning(err)
 	}
 	logger.Info("drawin setup done.")
-	return iface
+	return iface, nil
 }
 
 func addRoute(key string, peer net.IP) {
-	if err := runCmd("route -n add -net %s %s", key, peer); err != nil {
-		logger.Warning(err)
+	if extension != nil {
+		extension.addRoute(key)
+		return
+	}
+	opt := routeOptions[key]
+	if opt != (routeOption{}) {
+		logger.Warningf("route %s:%s ignored on macOS, a longer prefix wins instead\n", key, opt)
+	}
+	_, dst, err := net.ParseCIDR(key)
+	if err != nil {
+		return
 	}
+	r := sysroutes.Route{Dst: dst, Gateway: peer}
+	if name := routeTUNs.Open(key); name != "" {
+		r.Gateway, r.Dev = nil, name
+	}
+	logger.Infof("route => add %s\n", r)
+	if err := sysroutes.Add(r); err != nil && !errors.Is(err, sysroutes.ErrExists) {
+		routeErrors.Fail(key, "add", err)
+		return
+	}
+	routeErrors.Clear(key)
+	installedOptions[key] = opt
+	journal.Add(key, peer)
 }
 
 func delRoute(key string) {
-	runCmd("route -n delete -net %s", key)
+	if extension != nil {
+		extension.delRoute(key)
+		return
+	}
+	routeErrors.Clear(key)
+	if _, dst, err := net.ParseCIDR(key); err == nil {
+		if err := sysroutes.Delete(sysroutes.Route{Dst: dst}); err != nil && !errors.Is(err, sysroutes.ErrNotFound) {
+			logger.Warning(err)
+		}
+	}
+	routeTUNs.Close(key)
+	delete(installedOptions, key)
+	journal.Remove(key)
+}
+
+// setupRouteTUN creates the utun of a route, point to point like the main
+// one
+func setupRouteTUN(index, mtu int) (tunDevice, error) {
+	if extension != nil {
+		return nil, fmt.Errorf("the network extension has a single utun")
+	}
+	dev, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		return nil, err
+	}
+	if err := sysroutes.AddAddress(dev.Name(), localIP, peer); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := sysroutes.SetLink(dev.Name(), mtu, 0); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// hostRoute is the route of an address to the interface
+func hostRoute(ip net.IP, dev string) sysroutes.Route {
+	return sysroutes.Route{Dst: &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, Dev: dev}
+}
+
+// delRouteVia removes a route only through the gateway
+func delRouteVia(key string, gw net.IP) {
+	if _, dst, err := net.ParseCIDR(key); err == nil {
+		if err := sysroutes.Delete(sysroutes.Route{Dst: dst, Gateway: gw}); err != nil && !errors.Is(err, sysroutes.ErrNotFound) {
+			logger.Warning(err)
+		}
+	}
+}
+
+// hostGateway returns the default gateway and the local address of the
+// interface facing it.
+func hostGateway() (net.IP, net.IP, error) {
+	out, err := runOutCmd("route -n get default")
+	if err != nil {
+		return nil, nil, err
+	}
+	var gw, local net.IP
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "gateway:":
+			gw = net.ParseIP(fields[1]).To4()
+		case "interface:":
+			local = interfaceIP(fields[1])
+		}
+	}
+	if gw == nil {
+		return nil, nil, fmt.Errorf("no default gateway")
+	}
+	return gw, local, nil
+}
+
+// processAlive tells whether the process runs
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	return err == nil && p.Signal(syscall.Signal(0)) == nil
+}
+
+// setRecovery does nothing, the service manager restarts the service already
+func setRecovery(name string, delays []time.Duration, reset time.Duration) error {
+	return nil
+}
+
+// pingPeer pings the ip once with the ping of the system
+func pingPeer(ip net.IP) error {
+	_, err := runOutCmd("ping -c 1 -t 2 %v", ip)
+	return err
+}
+
+// systemRoutes reads the IPv4 routes of the system but the default one
+func systemRoutes() []systemRoute {
+	out, err := runOutCmd("netstat -rn -f inet")
+	if err != nil {
+		return nil
+	}
+	var list []systemRoute
+	for _, line := range strings.Split(out, "\n") {
+		// Destination Gateway Flags Netif Expire, e.g. 192.168.1 or 10.8/16
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] == "default" {
+			continue
+		}
+		dst, bits := fields[0], -1
+		if i := strings.Index(dst, "/"); i > 0 {
+			fmt.Sscanf(dst[i+1:], "%d", &bits)
+			dst = dst[:i]
+		}
+		octets := strings.Split(dst, ".")
+		if len(octets) > 4 {
+			continue
+		}
+		if bits < 0 {
+			bits = 8 * len(octets)
+			if strings.Contains(fields[2], "H") {
+				bits = 32
+			}
+		}
+		for len(octets) < 4 {
+			octets = append(octets, "0")
+		}
+		ip := net.ParseIP(strings.Join(octets, ".")).To4()
+		if ip == nil || bits > 32 {
+			continue
+		}
+		mask := net.CIDRMask(bits, 32)
+		list = append(list, systemRoute{net: &net.IPNet{IP: ip.Mask(mask), Mask: mask}, dev: fields[3]})
+	}
+	return list
+}
+
+func setMTU(name string, mtu int) error {
+	if extension != nil {
+		extension.setMTU(mtu)
+		return nil
+	}
+	return sysroutes.SetLink(name, mtu, 0)
+}
+
+// knockAnchor is below `com.apple/*` so the default pf.conf evaluates it
+const knockAnchor = "com.apple/docker-connector"
+
+// firewallInit loads a pf anchor blocking the port except for the sources
+// in the `knock` table
+func firewallInit(port int) error {
+	rules := fmt.Sprintf("table <knock> persist\nblock in quick proto udp from ! <knock> to any port %d\n", port)
+	cmd := exec.Command("pfctl", "-a", knockAnchor, "-f", "-")
+	cmd.Stdin = strings.NewReader(rules)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	runCmd("pfctl -E")
+	return nil
+}
+
+func firewallAllow(ip net.IP, port int) error {
+	return runCmd("pfctl -a %s -t knock -T add %s", knockAnchor, ip)
+}
+
+func firewallRevoke(ip net.IP, port int) error {
+	return runCmd("pfctl -a %s -t knock -T delete %s", knockAnchor, ip)
+}
+
+func firewallReset(port int) error {
+	return runCmd("pfctl -a %s -F all", knockAnchor)
+}
+
+// setTOS marks the datagrams of the socket with the type of service
+func setTOS(conn *net.UDPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// bindDevice makes the socket send through the interface only
+func bindDevice(conn *net.UDPConn, ifi *net.Interface) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// resolverDir holds the resolvers of the domains, marked to remove ours only
+const (
+	resolverDir  = "/etc/resolver"
+	resolverMark = "# docker-connector\n"
+)
+
+func setSplitDNS(domain, server string) error {
+	if extension != nil {
+		extension.setDNS(domain, server)
+		return nil
+	}
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return err
+	}
+	path := resolverDir + "/" + domain
+	if data, err := ioutil.ReadFile(path); err == nil && !strings.HasPrefix(string(data), resolverMark) {
+		return fmt.Errorf("%s not created by the connector", path)
+	}
+	return ioutil.WriteFile(path, []byte(resolverMark+"nameserver "+server+"\n"), 0644)
+}
+
+func clearSplitDNS(domain string) error {
+	if extension != nil {
+		extension.setDNS(domain, "")
+		return nil
+	}
+	path := resolverDir + "/" + domain
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !strings.HasPrefix(string(data), resolverMark) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// readdress replaces the addresses of the utun
+func readdress(name string, old, local, peer net.IP, subnet *net.IPNet) error {
+	if extension != nil {
+		return fmt.Errorf("the network extension needs a restart")
+	}
+	if err := sysroutes.FlushAddresses(name); err != nil {
+		return err
+	}
+	if err := sysroutes.AddAddress(name, local, peer); err != nil {
+		return err
+	}
+	sysroutes.Delete(sysroutes.Route{Dst: hostRoute(old, name).Dst})
+	if err := sysroutes.Add(hostRoute(local, name)); err != nil && !errors.Is(err, sysroutes.ErrExists) {
+		logger.Warning(err)
+	}
+	return nil
+}
+
+// natAnchor is below `com.apple/*`, which the default pf.conf evaluates for
+// the nat rules too
+const natAnchor = "com.apple/docker-connector-nat"
+
+// setNAT forwards the packets of the virtual network to the LANs, with the
+// source rewritten by pf
+func setNAT(ifname string, virtual *net.IPNet, lans []string) error {
+	var rules strings.Builder
+	for _, lan := range lans {
+		fmt.Fprintf(&rules, "nat on %s inet from %s to %s -> (%s)\n", ifname, virtual, lan, ifname)
+	}
+	cmd := exec.Command("pfctl", "-a", natAnchor, "-f", "-")
+	cmd.Stdin = strings.NewReader(rules.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	runCmd("pfctl -E")
+	return runCmd("sysctl -w net.inet.ip.forwarding=1")
+}
+
+func clearNAT() error {
+	return runCmd("pfctl -a %s -F all", natAnchor)
+}
+
+// mdnsCommand registers a service with mDNSResponder while running
+func mdnsCommand(name, typ string, port int) *exec.Cmd {
+	return exec.Command("dns-sd", "-R", name, typ, "local", strconv.Itoa(port))
+}
+
+// readKeychain reads a generic password of the login keychain
+func readKeychain(service, account string) (string, error) {
+	args := []string{"find-generic-password", "-s", service, "-w"}
+	if account != "" {
+		args = append(args, "-a", account)
+	}
+	out, err := exec.Command("security", args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+const hostsNewline = "\n"
+
+var hostsFile = "/etc/hosts"
+
+// addLoopbackAlias adds an address of `publish` to lo0, which only holds
+// 127.0.0.1
+func addLoopbackAlias(ip net.IP) error {
+	return runCmd("ifconfig lo0 alias %s up", ip)
+}
+
+func delLoopbackAlias(ip net.IP) error {
+	return runCmd("ifconfig lo0 -alias %s", ip)
+}
+
+// watchRouteChanges signals the changes of the addresses, interfaces and
+// routes read from a route socket
+func watchRouteChanges(ctx context.Context, changed chan<- struct{}) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		logTransport.Warningf("[NETWORK] No route socket, only the wakes are followed: %v", err)
+		return
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 2048)
+	for ctx.Err() == nil {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logTransport.Warningf("[NETWORK] Failed to read the route socket: %v", err)
+			return
+		}
+		// rt_msghdr: msglen(2), version(1), type(1)
+		if n < 4 {
+			continue
+		}
+		switch buf[3] {
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_IFINFO, syscall.RTM_ADD, syscall.RTM_DELETE, syscall.RTM_CHANGE:
+			signalChange(changed)
+		}
+	}
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	sysroutes "docker-connector/pkg/routes"
+
+	"github.com/songgao/water"
+)
+
+func setup(local, peer net.IP, subnet *net.IPNet) (tunDevice, error) {
+	config := water.Config{
+		DeviceType: water.TUN,
+	}
+	if tapMode {
+		config.DeviceType = water.TAP
+	}
+	config.Name = ifName
+	dev, err := water.New(config)
+	if err != nil && ifName != "" {
+		logTransport.Warningf("[TUN] Failed to create %s, letting the kernel name it: %v", ifName, err)
+		config.Name = ""
+		dev, err = water.New(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var iface tunDevice = dev
+	if tapMode {
+		iface = newTAP(dev)
+	}
+	logger.Infof("interface => %s\n", iface.Name())
+	if err := sysroutes.AddAddress(iface.Name(), local, peer); err != nil {
+		iface.Close()
+		return nil, err
+	}
+	if err := sysroutes.SetLink(iface.Name(), MTU, 100); err != nil {
+		iface.Close()
+		return nil, err
+	}
+	if gw, _, err := hostGateway(); err == nil {
+		logger.Infof("[GUEST] host gateway => %s\n", gw)
+		if subnet.Contains(gw) {
+			logger.Warningf("[GUEST] virtual network %s overlaps the host gateway %s\n", subnet, gw)
+		}
+	}
+	logger.Info("linux setup done.")
+	return iface, nil
+}
+
+func addRoute(key string, peer net.IP) {
+	if gw, _, err := hostGateway(); err == nil {
+		if _, ipnet, err := net.ParseCIDR(key); err == nil && ipnet.Contains(gw) {
+			logger.Warningf("[GUEST] route %s covers the host gateway %s, skipped\n", key, gw)
+			return
+		}
+	}
+	_, dst, err := net.ParseCIDR(key)
+	if err != nil {
+		return
+	}
+	opt := routeOptions[key]
+	r := sysroutes.Route{Dst: dst, Gateway: peer, Metric: opt.metric, Table: opt.table}
+	if name := routeTUNs.Open(key); name != "" {
+		r.Gateway, r.Dev = nil, name
+	}
+	logger.Infof("route => add %s\n", r)
+	if err := sysroutes.Add(r); err != nil && !errors.Is(err, sysroutes.ErrExists) {
+		routeErrors.Fail(key, "add", err)
+		return
+	}
+	routeErrors.Clear(key)
+	installedOptions[key] = opt
+	journal.Add(key, peer)
+}
+
+func delRoute(key string) {
+	routeErrors.Clear(key)
+	if _, dst, err := net.ParseCIDR(key); err == nil {
+		r := sysroutes.Route{Dst: dst, Table: installedOptions[key].table}
+		if err := sysroutes.Delete(r); err != nil && !errors.Is(err, sysroutes.ErrNotFound) {
+			logger.Warning(err)
+		}
+	}
+	routeTUNs.Close(key)
+	delete(installedOptions, key)
+	journal.Remove(key)
+}
+
+// setupRouteTUN creates the TUN of a route with the local address, the peer
+// staying on the main TUN
+func setupRouteTUN(index, mtu int) (tunDevice, error) {
+	dev, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		return nil, err
+	}
+	if err := sysroutes.AddAddress(dev.Name(), localIP, nil); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := sysroutes.SetLink(dev.Name(), mtu, 100); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// delRouteVia removes a route only through the gateway
+func delRouteVia(key string, gw net.IP) {
+	if _, dst, err := net.ParseCIDR(key); err == nil {
+		if err := sysroutes.Delete(sysroutes.Route{Dst: dst, Gateway: gw}); err != nil && !errors.Is(err, sysroutes.ErrNotFound) {
+			logger.Warning(err)
+		}
+	}
+}
+
+// hostGateway returns the default gateway of a linux guest, which is the
+// address of the host (e.g. the Mac running Docker Desktop) in most VM setups,
+// and the local address of the interface facing it.
+func hostGateway() (net.IP, net.IP, error) {
+	fi, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gw := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(gw, binary.BigEndian.Uint32(raw))
+		return gw, interfaceIP(fields[0]), nil
+	}
+	return nil, nil, fmt.Errorf("no default route")
+}
+
+// processAlive tells whether the process runs
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	return err == nil && p.Signal(syscall.Signal(0)) == nil
+}
+
+// setRecovery does nothing, the service manager restarts the service already
+func setRecovery(name string, delays []time.Duration, reset time.Duration) error {
+	return nil
+}
+
+// pingPeer pings the ip once with the ping of the system
+func pingPeer(ip net.IP) error {
+	_, err := runOutCmd("ping -c 1 -W 2 %v", ip)
+	return err
+}
+
+// systemRoutes reads the IPv4 routes of the system but the default one
+func systemRoutes() []systemRoute {
+	fi, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer fi.Close()
+	var list []systemRoute
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[7] == "00000000" {
+			continue
+		}
+		dst, err1 := hex.DecodeString(fields[1])
+		mask, err2 := hex.DecodeString(fields[7])
+		if err1 != nil || err2 != nil || len(dst) != 4 || len(mask) != 4 {
+			continue
+		}
+		ip, m := make(net.IP, 4), make(net.IPMask, 4)
+		binary.LittleEndian.PutUint32(ip, binary.BigEndian.Uint32(dst))
+		binary.LittleEndian.PutUint32(m, binary.BigEndian.Uint32(mask))
+		list = append(list, systemRoute{net: &net.IPNet{IP: ip, Mask: m}, dev: fields[0]})
+	}
+	return list
+}
+
+func setMTU(name string, mtu int) error {
+	return sysroutes.SetLink(name, mtu, 0)
+}
+
+// firewallInit drops the datagrams to the port unless a knock opened it
+func firewallInit(port int) error {
+	return runCmd("iptables -I INPUT -p udp --dport %d -j DROP", port)
+}
+
+func firewallAllow(ip net.IP, port int) error {
+	return runCmd("iptables -I INPUT -p udp --dport %d -s %s -j ACCEPT", port, ip)
+}
+
+func firewallRevoke(ip net.IP, port int) error {
+	return runCmd("iptables -D INPUT -p udp --dport %d -s %s -j ACCEPT", port, ip)
+}
+
+func firewallReset(port int) error {
+	return runCmd("iptables -D INPUT -p udp --dport %d -j DROP", port)
+}
+
+// setTOS marks the datagrams of the socket with the type of service
+func setTOS(conn *net.UDPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// bindDevice makes the socket send through the interface only
+func bindDevice(conn *net.UDPConn, ifi *net.Interface) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifi.Name)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setSplitDNS gives the pushed and configured domains and their servers to
+// the TUN link of systemd-resolved, a link has one set of servers for all its
+// domains
+func setSplitDNS(domain, server string) error {
+	if tunIfName == "" {
+		return fmt.Errorf("no interface")
+	}
+	active := activeDNS()
+	var names []string
+	for d := range active {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+	var servers, domains []string
+	seen := make(map[string]bool)
+	for _, d := range names {
+		domains = append(domains, "~"+d)
+		if s := active[d]; !seen[s] {
+			seen[s] = true
+			servers = append(servers, s)
+		}
+	}
+	if err := runCmd("resolvectl dns %s %s", tunIfName, strings.Join(servers, " ")); err != nil {
+		return err
+	}
+	return runCmd("resolvectl domain %s %s", tunIfName, strings.Join(domains, " "))
+}
+
+func clearSplitDNS(domain string) error {
+	if tunIfName == "" {
+		return nil
+	}
+	if len(activeDNS()) == 0 {
+		return runCmd("resolvectl revert %s", tunIfName)
+	}
+	return setSplitDNS("", "")
+}
+
+// readdress replaces the addresses of the TUN
+func readdress(name string, old, local, peer net.IP, subnet *net.IPNet) error {
+	if err := sysroutes.FlushAddresses(name); err != nil {
+		return err
+	}
+	return sysroutes.AddAddress(name, local, peer)
+}
+
+// setNAT forwards the packets of the virtual network to the LANs, with the
+// source rewritten by iptables
+func setNAT(ifname string, virtual *net.IPNet, lans []string) error {
+	if err := runCmd("sysctl -w net.ipv4.ip_forward=1"); err != nil {
+		return err
+	}
+	for _, lan := range lans {
+		if err := runCmd("iptables -t nat -A POSTROUTING -s %s -d %s -o %s -j MASQUERADE -m comment --comment docker-connector", virtual, lan, ifname); err != nil {
+			return err
+		}
+		runCmd("iptables -I FORWARD -s %s -d %s -j ACCEPT -m comment --comment docker-connector", virtual, lan)
+		runCmd("iptables -I FORWARD -s %s -d %s -m state --state ESTABLISHED,RELATED -j ACCEPT -m comment --comment docker-connector", lan, virtual)
+	}
+	return nil
+}
+
+func clearNAT() error {
+	for _, lan := range natSubnets {
+		runCmd("iptables -t nat -D POSTROUTING -s %s -d %s -o %s -j MASQUERADE -m comment --comment docker-connector", subnet, lan, natIface)
+		runCmd("iptables -D FORWARD -s %s -d %s -j ACCEPT -m comment --comment docker-connector", subnet, lan)
+		runCmd("iptables -D FORWARD -s %s -d %s -m state --state ESTABLISHED,RELATED -j ACCEPT -m comment --comment docker-connector", lan, subnet)
+	}
+	return nil
+}
+
+// mdnsCommand publishes a service with avahi while running
+func mdnsCommand(name, typ string, port int) *exec.Cmd {
+	return exec.Command("avahi-publish", "-s", name, typ, strconv.Itoa(port))
+}
+
+// readKeychain looks up a secret of the secret service, stored with
+// `secret-tool store --label=... service <service> [account <account>]`
+func readKeychain(service, account string) (string, error) {
+	args := []string{"lookup", "service", service}
+	if account != "" {
+		args = append(args, "account", account)
+	}
+	out, err := exec.Command("secret-tool", args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+const hostsNewline = "\n"
+
+var hostsFile = "/etc/hosts"
+
+// addLoopbackAlias does nothing, lo holds 127.0.0.0/8
+func addLoopbackAlias(ip net.IP) error {
+	return nil
+}
+
+func delLoopbackAlias(ip net.IP) error {
+	return nil
+}
+
+// the netlink groups of the links, IPv4 addresses and routes, missing from
+// syscall
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+)
+
+// watchRouteChanges signals the changes of the links, addresses and routes
+// told by netlink
+func watchRouteChanges(ctx context.Context, changed chan<- struct{}) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route})
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}
+	if err != nil {
+		logTransport.Warningf("[NETWORK] No netlink socket, only the wakes are followed: %v", err)
+		return
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 8192)
+	for ctx.Err() == nil {
+		_, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR || err == syscall.ENOBUFS {
+			// an overrun drops messages, a change anyway
+			signalChange(changed)
+			continue
+		}
+		if err != nil {
+			logTransport.Warningf("[NETWORK] Failed to read the netlink socket: %v", err)
+			return
+		}
+		signalChange(changed)
+	}
+}
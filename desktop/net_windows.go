@@ -1,32 +1,60 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/songgao/water"
 )
 
-func setup(local, peer net.IP, subnet *net.IPNet) *water.Interface {
+func setup(local, peer net.IP, subnet *net.IPNet) (tunDevice, error) {
 	ones, _ := subnet.Mask.Size()
 	mask := net.IP(subnet.Mask).String()
-	addr := fmt.Sprintf("%s/%d", local, ones)
-	config := water.Config{
-		DeviceType: water.TUN,
-		PlatformSpecificParams: water.PlatformSpecificParams{
-			ComponentID: "tap0901",
-			Network:     addr,
-		},
-	}
-	iface, err := water.New(config)
-	if err != nil {
-		logger.Fatal(err)
+	var iface tunDevice
+	if tunDriver == "wintun" && !tapMode {
+		name := wintunName
+		if ifName != "" {
+			name = ifName
+		}
+		if w, err := openWintun(name); err == nil {
+			logTransport.Infof("[TUN] wintun adapter => %s", w.Name())
+			iface = w
+		} else {
+			logTransport.Warningf("[TUN] wintun unavailable, falling back to tap: %v", err)
+		}
+	}
+	if iface == nil {
+		config := water.Config{
+			DeviceType: water.TUN,
+			PlatformSpecificParams: water.PlatformSpecificParams{
+				ComponentID: "tap0901",
+				Network:     fmt.Sprintf("%s/%d", local, ones),
+			},
+		}
+		if tapMode {
+			config.DeviceType = water.TAP
+		}
+		tap, err := water.New(config)
+		if err != nil {
+			return nil, err
+		}
+		iface = tap
+		if tapMode {
+			iface = newTAP(tap)
+		}
 	}
 	if out, err := runOutCmd("netsh interface ip set address \"%s\" static %s %s %s", iface.Name(), local, mask, peer); err != nil {
 		logger.Warningf("%s\n", out)
-		logger.Fatal(err)
+		iface.Close()
+		return nil, err
 	}
 	ipStr := local.String()
 	for {
@@ -45,17 +73,40 @@ func setup(local, peer net.IP, subnet *net.IPNet) *water.Interface {
 	runCmd("netsh interface ipv4 set subinterface \"%s\" mtu=%d store=persistent", iface.Name(), MTU)
 	runCmd("netsh interface ip delete dns \"%s\" all", iface.Name())
 	runCmd("netsh interface ip delete wins \"%s\" all", iface.Name())
-	return iface
+	return iface, nil
 }
 
+// wintunName is the name of the wintun adapter
+const wintunName = "DockerConnector"
+
 func addRoute(key string, peer net.IP) {
 	ip, subnet, err := net.ParseCIDR(key)
 	if err != nil {
 		return
 	}
-	if err := runCmd("route add %s mask %s %s", ip, net.IP(subnet.Mask).String(), peer); err != nil {
-		logger.Warning(err)
+	opt := routeOptions[key]
+	if opt.table > 0 {
+		logger.Warningf("route %s table %d ignored on windows\n", key, opt.table)
+	}
+	metric := ""
+	if opt.metric > 0 {
+		metric = fmt.Sprintf(" metric %d", opt.metric)
+	}
+	if name := routeTUNs.Open(key); name != "" {
+		if opt.metric > 0 {
+			metric = fmt.Sprintf(" metric=%d", opt.metric)
+		}
+		err = runCmd("netsh interface ipv4 add route %s \"%s\"%s store=active", key, name, metric)
+	} else {
+		err = runCmd("route add %s mask %s %s%s", ip, net.IP(subnet.Mask).String(), peer, metric)
+	}
+	if err != nil {
+		routeErrors.Fail(key, "add", err)
+		return
 	}
+	routeErrors.Clear(key)
+	installedOptions[key] = opt
+	journal.Add(key, peer)
 }
 
 func delRoute(key string) {
@@ -63,5 +114,306 @@ func delRoute(key string) {
 	if err != nil {
 		return
 	}
-	runCmd("route delete %s mask %s %s", ip, net.IP(subnet.Mask).String(), peer)
+	// without the gateway, which may be unknown while stopping
+	runCmd("route delete %s mask %s", ip, net.IP(subnet.Mask).String())
+	routeErrors.Clear(key)
+	routeTUNs.Close(key)
+	delete(installedOptions, key)
+	journal.Remove(key)
+}
+
+// setupRouteTUN creates the wintun adapter of a route, numbered after the
+// main one
+func setupRouteTUN(index, mtu int) (tunDevice, error) {
+	if tunDriver != "wintun" {
+		return nil, fmt.Errorf("a TUN per route needs wintun")
+	}
+	w, err := openWintun(fmt.Sprintf("%s %d", wintunName, index+2))
+	if err != nil {
+		return nil, err
+	}
+	if out, err := runOutCmd("netsh interface ip set address \"%s\" static %s 255.255.255.255", w.Name(), localIP); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("%v: %s", err, out)
+	}
+	runCmd("netsh interface ipv4 set subinterface \"%s\" mtu=%d store=active", w.Name(), mtu)
+	return w, nil
+}
+
+// delRouteVia removes a route only through the gateway
+func delRouteVia(key string, gw net.IP) {
+	ip, subnet, err := net.ParseCIDR(key)
+	if err != nil {
+		return
+	}
+	runCmd("route delete %s mask %s %s", ip, net.IP(subnet.Mask).String(), gw)
+}
+
+// hostGateway is only meaningful for guests, which are not windows.
+func hostGateway() (net.IP, net.IP, error) {
+	return nil, nil, fmt.Errorf("host gateway detection not supported")
+}
+
+// processAlive tells whether the process runs, finding it fails otherwise
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		p.Release()
+	}
+	return err == nil
+}
+
+// setRecovery restarts the service after a crash or an exit with an error,
+// after each delay in turn
+func setRecovery(name string, delays []time.Duration, reset time.Duration) error {
+	if len(delays) == 0 {
+		return nil
+	}
+	var actions []string
+	for _, d := range delays {
+		actions = append(actions, fmt.Sprintf("restart/%d", d.Milliseconds()))
+	}
+	out, err := exec.Command("sc.exe", "failure", name, fmt.Sprintf("reset= %d", int(reset.Seconds())), "actions= "+strings.Join(actions, "/")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("sc.exe", "failureflag", name, "1").CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	logger.Infof("Recovery of the service => restart after %s, reset after %v", strings.Join(actions, " "), reset)
+	return nil
+}
+
+// pingPeer pings the ip once with the ping of the system, which succeeds
+// on an unreachable host too
+func pingPeer(ip net.IP) error {
+	out, err := runOutCmd("ping -n 1 -w 2000 %v", ip)
+	if err == nil && !strings.Contains(out, "TTL=") {
+		err = fmt.Errorf("no reply")
+	}
+	return err
+}
+
+// systemRoutes reads the IPv4 routes of the system but the default one, their
+// device is the address of their interface
+func systemRoutes() []systemRoute {
+	out, err := runOutCmd("route print -4")
+	if err != nil {
+		return nil
+	}
+	var list []systemRoute
+	for _, line := range strings.Split(out, "\n") {
+		// Network Destination, Netmask, Gateway, Interface, Metric
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			continue
+		}
+		ip, mask := net.ParseIP(fields[0]).To4(), net.ParseIP(fields[1]).To4()
+		if ip == nil || mask == nil || mask.Equal(net.IPv4zero) {
+			continue
+		}
+		list = append(list, systemRoute{net: &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}, dev: fields[3]})
+	}
+	return list
+}
+
+func setMTU(name string, mtu int) error {
+	return runCmd("netsh interface ipv4 set subinterface \"%s\" mtu=%d store=persistent", name, mtu)
+}
+
+// firewallInit relies on the windows firewall blocking inbound by default
+func firewallInit(port int) error {
+	return nil
+}
+
+func firewallAllow(ip net.IP, port int) error {
+	return runCmd("netsh advfirewall firewall add rule name=docker-connector-knock-%s dir=in action=allow protocol=UDP localport=%d remoteip=%s", ip, port, ip)
+}
+
+func firewallRevoke(ip net.IP, port int) error {
+	return runCmd("netsh advfirewall firewall delete rule name=docker-connector-knock-%s", ip)
+}
+
+func firewallReset(port int) error {
+	return nil
+}
+
+// setTOS marks the datagrams of the socket with the type of service, which
+// windows only honors with a QoS policy allowing it
+func setTOS(conn *net.UDPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// ipUnicastIf is IP_UNICAST_IF, missing from syscall
+const ipUnicastIf = 31
+
+// bindDevice makes the socket send through the interface only, the index
+// goes in network byte order
+func bindDevice(conn *net.UDPConn, ifi *net.Interface) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	index := ifi.Index
+	be := int(uint32(index)>>24 | uint32(index)>>8&0xff00 | uint32(index)<<8&0xff0000 | uint32(index)<<24)
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipUnicastIf, be)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// nrptComment marks the NRPT rules of the connector
+const nrptComment = "docker-connector"
+
+func powershell(script string) error {
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func setSplitDNS(domain, server string) error {
+	clearSplitDNS(domain)
+	return powershell(fmt.Sprintf("Add-DnsClientNrptRule -Namespace '.%s' -NameServers '%s' -Comment '%s'", domain, server, nrptComment))
+}
+
+func clearSplitDNS(domain string) error {
+	return powershell(fmt.Sprintf("Get-DnsClientNrptRule | Where-Object { $_.Namespace -eq '.%s' -and $_.Comment -eq '%s' } | Remove-DnsClientNrptRule -Force", domain, nrptComment))
+}
+
+// readdress replaces the address of the adapter
+func readdress(name string, old, local, peer net.IP, subnet *net.IPNet) error {
+	if out, err := runOutCmd("netsh interface ip set address \"%s\" static %s %s %s", name, local, net.IP(subnet.Mask).String(), peer); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// natName names the WinNAT of the connector
+const natName = "DockerConnector"
+
+// setNAT forwards the packets of the virtual network with the source
+// rewritten by WinNAT, which doesn't filter on the destination
+func setNAT(ifname string, virtual *net.IPNet, lans []string) error {
+	if tunIfName != "" {
+		if err := powershell(fmt.Sprintf("Set-NetIPInterface -InterfaceAlias '%s' -Forwarding Enabled", tunIfName)); err != nil {
+			return err
+		}
+	}
+	return powershell(fmt.Sprintf("New-NetNat -Name '%s' -InternalIPInterfaceAddressPrefix '%s'", natName, virtual))
+}
+
+func clearNAT() error {
+	return powershell(fmt.Sprintf("Remove-NetNat -Name '%s' -Confirm:$false", natName))
+}
+
+// mdnsCommand registers a service with Bonjour for Windows while running
+func mdnsCommand(name, typ string, port int) *exec.Cmd {
+	return exec.Command("dns-sd", "-R", name, typ, "local", strconv.Itoa(port))
+}
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+// credential is the CREDENTIALW of wincred.h
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// readKeychain reads the generic credential named service of the Credential
+// Manager, e.g. stored with `cmdkey /generic:<service> /user:<account> /pass`
+func readKeychain(service, account string) (string, error) {
+	const credTypeGeneric = 1
+	target, err := syscall.UTF16PtrFromString(service)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	r, _, e := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return "", e
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	if account != "" && (cred.UserName == nil || syscall.UTF16ToString((*[1 << 16]uint16)(unsafe.Pointer(cred.UserName))[:]) != account) {
+		return "", fmt.Errorf("no credential of %s", account)
+	}
+	blob := make([]byte, cred.CredentialBlobSize)
+	copy(blob, (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize])
+	if len(blob)%2 == 0 && len(blob) > 1 && blob[1] == 0 {
+		// the passwords of cmdkey and of the control panel are UTF-16
+		u := make([]uint16, len(blob)/2)
+		for i := range u {
+			u[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+		}
+		return syscall.UTF16ToString(u), nil
+	}
+	return string(blob), nil
+}
+
+const hostsNewline = "\r\n"
+
+var hostsFile = os.Getenv("SystemRoot") + `\System32\drivers\etc\hosts`
+
+// addLoopbackAlias does nothing, the loopback answers 127.0.0.0/8
+func addLoopbackAlias(ip net.IP) error {
+	return nil
+}
+
+func delLoopbackAlias(ip net.IP) error {
+	return nil
+}
+
+var (
+	iphlpapi              = syscall.NewLazyDLL("iphlpapi.dll")
+	procNotifyAddrChange  = iphlpapi.NewProc("NotifyAddrChange")
+	procNotifyRouteChange = iphlpapi.NewProc("NotifyRouteChange")
+)
+
+// watchRouteChanges signals the changes of the addresses and routes told by
+// NotifyAddrChange and NotifyRouteChange
+func watchRouteChanges(ctx context.Context, changed chan<- struct{}) {
+	for _, proc := range []*syscall.LazyProc{procNotifyAddrChange, procNotifyRouteChange} {
+		if err := proc.Find(); err != nil {
+			logTransport.Warningf("[NETWORK] No %s, only the wakes are followed: %v", proc.Name, err)
+			continue
+		}
+		go func(proc *syscall.LazyProc) {
+			for ctx.Err() == nil {
+				// without handle nor overlapped it blocks until a change
+				if r, _, err := proc.Call(0, 0); r != 0 {
+					logTransport.Warningf("[NETWORK] %s failed: %v", proc.Name, err)
+					return
+				}
+				signalChange(changed)
+			}
+		}(proc)
+	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The connector follows the changes of the network, told by the system (a
+// route socket on macOS, NotifyAddrChange and NotifyRouteChange on Windows,
+// netlink on linux) or seen as a jump of the wall clock after a sleep. Once
+// the network settles for networkSettle the routes of the TUN are checked
+// and installed again like by the health check, a configured `-cli` is
+// resolved again and, when the addresses of the host changed, the socket of
+// the tunnel is bound again to the address facing the host with `host guest`
+// or to the new index of `bind-interface`, so a laptop coming back from sleep,
+// another Wi-Fi or a VPN goes on without restarting the service.
+const (
+	networkSettle = 2 * time.Second
+	// sleepCheck is the period of the wall clock check, a gap of sleepGap
+	// between two checks is a sleep
+	sleepCheck = 5 * time.Second
+	sleepGap   = 30 * time.Second
+)
+
+// guestMode is set by `host guest`
+var guestMode = false
+
+// signalChange signals a change of the network without blocking
+func signalChange(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+// hostAddresses describes the IPv4 addresses of the interfaces up but the
+// TUNs of the connector, the temporary IPv6 ones changing on their own
+func hostAddresses(ifname string) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var list []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Name == ifname || routeTUNs.Owns(ifi.Name) {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				list = append(list, ifi.Name+" "+a.String())
+			}
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// watchNetwork reacts to the changes of the network and the wakes from sleep
+func (c *Connector) watchNetwork() {
+	ifname := ""
+	if bind && c.iface != nil {
+		ifname = c.iface.Name()
+	}
+	changed := make(chan struct{}, 1)
+	go watchRouteChanges(c.ctx, changed)
+	addrs := hostAddresses(ifname)
+	ticker := time.NewTicker(sleepCheck)
+	defer ticker.Stop()
+	last := time.Now().Round(0)
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-changed:
+			settle = time.After(networkSettle)
+		case <-ticker.C:
+			// the wall clock, the monotonic one stops while asleep
+			now := time.Now().Round(0)
+			if gap := now.Sub(last); gap >= sleepGap {
+				logTransport.Infof("[NETWORK] Woke up after %v", gap.Round(time.Second))
+				events.Add("network", "woke up after %v", gap.Round(time.Second))
+				settle = time.After(networkSettle)
+			}
+			last = now
+		case <-settle:
+			settle = nil
+			if isIdle() {
+				continue
+			}
+			if current := hostAddresses(ifname); current != addrs {
+				addrs = current
+				logTransport.Infof("[NETWORK] Addresses of the host changed")
+				events.Add("network", "addresses changed")
+				rebindTunnel()
+			}
+			if ifname != "" {
+				verifyRoutes(ifname)
+			}
+			resolveClient()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// rebindTunnel binds the socket of the tunnel again after a change of the
+// addresses of the host
+func rebindTunnel() {
+	configLock.Lock()
+	defer configLock.Unlock()
+	if conn == nil {
+		return
+	}
+	if guestMode {
+		old := host
+		host = "guest"
+		reloadListener(old, port)
+		return
+	}
+	if bindIface != "" {
+		ifi, err := net.InterfaceByName(bindIface)
+		if err == nil {
+			err = bindDevice(conn, ifi)
+		}
+		if err != nil {
+			logTransport.Warningf("[NETWORK] Failed to bind the tunnel to %s again: %v", bindIface, err)
+			return
+		}
+		logTransport.Infof("[NETWORK] Tunnel bound again to %s", bindIface)
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() && !hostHasAddress(ip) {
+		logTransport.Warningf("[NETWORK] %s is no longer an address of the host, the docker side can't reach the tunnel until it's back", ip)
+	}
+}
+
+// hostHasAddress tells whether an address belongs to an interface of the host
+func hostHasAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `-netem` degrades the tunnel in both directions in the manner of tc netem,
+// for testing how the services in the containers behave on bad networks:
+//
+//	-netem "delay 50ms"
+//	-netem "delay 100ms 20ms loss 1%"
+//	-netem "delay 30ms reorder 10% loss 0.5%"
+//
+// `delay <time> [jitter]` delays each packet by the time give or take up to
+// the jitter, `loss <percent>` drops packets at random and `reorder
+// <percent>` sends packets at once, ahead of the delayed ones. The delayed
+// packets are bounded by netemQueueMax, dropped beyond it.
+const netemQueueMax = 10000
+
+type netemSettings struct {
+	delay   time.Duration
+	jitter  time.Duration
+	loss    float64
+	reorder float64
+}
+
+type netemEmulator struct {
+	sync.Mutex
+	// settings holds the *netemSettings, nil when off
+	settings atomic.Value
+	rnd      *rand.Rand
+	queued   int64
+	lost     uint64
+	delayed  uint64
+	reorders uint64
+}
+
+var (
+	netemSpec = ""
+	netem     = &netemEmulator{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+)
+
+// NetemStatus reports the emulated impairments and their effect
+type NetemStatus struct {
+	Spec      string `json:"spec"`
+	Queued    int64  `json:"queued"`
+	Lost      uint64 `json:"lost"`
+	Delayed   uint64 `json:"delayed"`
+	Reordered uint64 `json:"reordered"`
+}
+
+// parsePercent parses `1%` or `1` as 0.01
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percent %q", s)
+	}
+	return v / 100, nil
+}
+
+// parseNetem parses the value of `-netem`, nil when empty
+func parseNetem(spec string) (*netemSettings, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	s := &netemSettings{}
+	for i := 0; i < len(fields); i++ {
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("missing value of %s", fields[i])
+		}
+		var err error
+		switch fields[i] {
+		case "delay":
+			i++
+			if s.delay, err = time.ParseDuration(fields[i]); err != nil || s.delay < 0 {
+				return nil, fmt.Errorf("invalid delay %q", fields[i])
+			}
+			if i+1 < len(fields) {
+				if jitter, err := time.ParseDuration(fields[i+1]); err == nil {
+					if jitter < 0 || jitter > s.delay {
+						return nil, fmt.Errorf("jitter %v out of the delay", jitter)
+					}
+					s.jitter = jitter
+					i++
+				}
+			}
+		case "loss":
+			i++
+			if s.loss, err = parsePercent(fields[i]); err != nil {
+				return nil, err
+			}
+		case "reorder":
+			i++
+			if s.reorder, err = parsePercent(fields[i]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown %q, expecting delay, loss or reorder", fields[i])
+		}
+	}
+	return s, nil
+}
+
+// setNetem applies `-netem`
+func setNetem(spec string) error {
+	s, err := parseNetem(spec)
+	if err != nil {
+		return fmt.Errorf("invalid netem %q: %v", spec, err)
+	}
+	netem.settings.Store(s)
+	if s != nil {
+		logTransport.Warningf("[NETEM] Emulating %s on the tunnel", spec)
+	}
+	return nil
+}
+
+// Active tells whether a network is emulated
+func (e *netemEmulator) Active() bool {
+	return e.current() != nil
+}
+
+func (e *netemEmulator) current() *netemSettings {
+	s, _ := e.settings.Load().(*netemSettings)
+	return s
+}
+
+// Send sends a packet through the emulated network, sending it with send at
+// once, later from another goroutine or never. The packet is copied when
+// delayed.
+func (e *netemEmulator) Send(packet []byte, send func([]byte)) {
+	s := e.current()
+	if s == nil {
+		send(packet)
+		return
+	}
+	e.Lock()
+	if s.loss > 0 && e.rnd.Float64() < s.loss {
+		e.Unlock()
+		atomic.AddUint64(&e.lost, 1)
+		peerStats.Drop("netem")
+		return
+	}
+	delay := s.delay
+	if s.jitter > 0 {
+		delay += time.Duration(e.rnd.Int63n(int64(2*s.jitter)+1)) - s.jitter
+	}
+	reorder := s.reorder > 0 && e.rnd.Float64() < s.reorder
+	e.Unlock()
+	if reorder {
+		atomic.AddUint64(&e.reorders, 1)
+		send(packet)
+		return
+	}
+	if delay <= 0 {
+		send(packet)
+		return
+	}
+	if atomic.AddInt64(&e.queued, 1) > netemQueueMax {
+		atomic.AddInt64(&e.queued, -1)
+		atomic.AddUint64(&e.lost, 1)
+		peerStats.Drop("netem")
+		return
+	}
+	atomic.AddUint64(&e.delayed, 1)
+	b := getBuffer(len(packet))
+	copy(*b, packet)
+	time.AfterFunc(delay, func() {
+		atomic.AddInt64(&e.queued, -1)
+		send((*b)[:len(packet)])
+		putBuffer(b)
+	})
+}
+
+// Status reports the emulation, nil when off
+func (e *netemEmulator) Status() *NetemStatus {
+	if e.current() == nil {
+		return nil
+	}
+	return &NetemStatus{
+		Spec:      netemSpec,
+		Queued:    atomic.LoadInt64(&e.queued),
+		Lost:      atomic.LoadUint64(&e.lost),
+		Delayed:   atomic.LoadUint64(&e.delayed),
+		Reordered: atomic.LoadUint64(&e.reorders),
+	}
+}
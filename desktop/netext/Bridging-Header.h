@@ -0,0 +1,10 @@
+// Bridging header of the packet tunnel extension, libconnector.h is
+// generated by `go build -tags netext -buildmode=c-archive`
+#include <stdlib.h>
+#include <sys/socket.h>
+#include <sys/kern_control.h>
+#include <sys/ioctl.h>
+#include "libconnector.h"
+
+// CTLIOCGINFO is a macro Swift can't import
+static const unsigned long kCTLIOCGINFO = 0xc0644e03UL;
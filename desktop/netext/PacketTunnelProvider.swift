@@ -0,0 +1,137 @@
+import NetworkExtension
+
+// TunnelSettings are the settings of DockerConnectorWaitSettings
+struct TunnelSettings: Decodable {
+    let version: Int32
+    let address: String
+    let peer: String
+    let mtu: Int
+    let routes: [String]?
+    let dns: [TunnelDNS]?
+}
+
+// TunnelDNS is a domain resolved through the tunnel
+struct TunnelDNS: Decodable {
+    let domain: String
+    let server: String
+}
+
+// PacketTunnelProvider runs the connector on the utun of the extension and
+// applies the addresses, routes, MTU and split DNS it hands over
+class PacketTunnelProvider: NEPacketTunnelProvider {
+    private let queue = DispatchQueue(label: "docker-connector.settings")
+
+    override func startTunnel(options: [String: NSObject]?, completionHandler: @escaping (Error?) -> Void) {
+        guard let proto = protocolConfiguration as? NETunnelProviderProtocol,
+              let config = proto.providerConfiguration?["config"] as? String else {
+            completionHandler(failure("no config file in the provider configuration"))
+            return
+        }
+        // the utun gets its file descriptor once settings are applied
+        setTunnelNetworkSettings(NEPacketTunnelNetworkSettings(tunnelRemoteAddress: "127.0.0.1")) { error in
+            if let error = error {
+                completionHandler(error)
+                return
+            }
+            guard let fd = self.utunFileDescriptor() else {
+                completionHandler(self.failure("no utun file descriptor"))
+                return
+            }
+            let err = config.withCString { DockerConnectorStart(UnsafeMutablePointer(mutating: $0), fd) }
+            if let err = err {
+                let message = String(cString: err)
+                free(err)
+                completionHandler(self.failure(message))
+                return
+            }
+            self.queue.async { self.watch(version: 0, started: completionHandler) }
+        }
+    }
+
+    override func stopTunnel(with reason: NEProviderStopReason, completionHandler: @escaping () -> Void) {
+        DockerConnectorStop()
+        completionHandler()
+    }
+
+    // watch applies the settings whenever the connector changes them, the
+    // tunnel is started with the first ones
+    private func watch(version: Int32, started: ((Error?) -> Void)?) {
+        guard let out = DockerConnectorWaitSettings(version) else {
+            return
+        }
+        let json = String(cString: out)
+        free(out)
+        guard let settings = try? JSONDecoder().decode(TunnelSettings.self, from: Data(json.utf8)) else {
+            started?(failure("invalid settings \(json)"))
+            return
+        }
+        setTunnelNetworkSettings(networkSettings(settings)) { error in
+            if let error = error {
+                NSLog("docker-connector: apply settings: \(error)")
+            }
+            started?(error)
+            self.queue.async { self.watch(version: settings.version, started: nil) }
+        }
+    }
+
+    private func networkSettings(_ s: TunnelSettings) -> NEPacketTunnelNetworkSettings {
+        let settings = NEPacketTunnelNetworkSettings(tunnelRemoteAddress: s.peer)
+        let ipv4 = NEIPv4Settings(addresses: [s.address], subnetMasks: ["255.255.255.255"])
+        var routes = [NEIPv4Route(destinationAddress: s.peer, subnetMask: "255.255.255.255")]
+        for route in s.routes ?? [] {
+            let parts = route.split(separator: "/")
+            guard parts.count == 2, let ones = Int(parts[1]), ones <= 32, !parts[0].contains(":") else {
+                continue
+            }
+            let mask = ones == 0 ? 0 : UInt32.max << (32 - UInt32(ones))
+            let octets = [24, 16, 8, 0].map { String((mask >> UInt32($0)) & 0xff) }
+            routes.append(NEIPv4Route(destinationAddress: String(parts[0]), subnetMask: octets.joined(separator: ".")))
+        }
+        ipv4.includedRoutes = routes
+        settings.ipv4Settings = ipv4
+        settings.mtu = NSNumber(value: s.mtu)
+        if let dns = s.dns, !dns.isEmpty {
+            // one set of servers for all the domains, in the order of the domains
+            var servers: [String] = []
+            for entry in dns where !servers.contains(entry.server) {
+                servers.append(entry.server)
+            }
+            let dnsSettings = NEDNSSettings(servers: servers)
+            dnsSettings.matchDomains = dns.map { $0.domain }
+            dnsSettings.matchDomainsNoSearch = true
+            settings.dnsSettings = dnsSettings
+        }
+        return settings
+    }
+
+    // utunFileDescriptor finds the utun control socket of the extension
+    private func utunFileDescriptor() -> Int32? {
+        var info = ctl_info()
+        withUnsafeMutablePointer(to: &info.ctl_name) {
+            $0.withMemoryRebound(to: CChar.self, capacity: MemoryLayout.size(ofValue: $0.pointee)) {
+                _ = strcpy($0, "com.apple.net.utun_control")
+            }
+        }
+        for fd: Int32 in 0...1024 {
+            var addr = sockaddr_ctl()
+            var len = socklen_t(MemoryLayout.size(ofValue: addr))
+            let ret = withUnsafeMutablePointer(to: &addr) {
+                $0.withMemoryRebound(to: sockaddr.self, capacity: 1) { getpeername(fd, $0, &len) }
+            }
+            if ret != 0 || addr.sc_family != AF_SYSTEM {
+                continue
+            }
+            if info.ctl_id == 0 && ioctl(fd, kCTLIOCGINFO, &info) != 0 {
+                continue
+            }
+            if addr.sc_id == info.ctl_id {
+                return fd
+            }
+        }
+        return nil
+    }
+
+    private func failure(_ message: String) -> Error {
+        return NSError(domain: "DockerConnector", code: 1, userInfo: [NSLocalizedDescriptionKey: message])
+    }
+}
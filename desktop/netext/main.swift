@@ -0,0 +1,72 @@
+import Foundation
+import NetworkExtension
+
+// The host app installs the VPN configuration of the packet tunnel provider
+// and starts or stops it, the system VPN settings take over from there.
+//
+//     DockerConnector install <config>
+//     DockerConnector start|stop|uninstall
+
+let providerBundleIdentifier = "com.docker-connector.app.tunnel"
+
+func manager(_ done: @escaping (NETunnelProviderManager) -> Void) {
+    NETunnelProviderManager.loadAllFromPreferences { managers, error in
+        if let error = error {
+            fail("load preferences: \(error)")
+        }
+        done(managers?.first ?? NETunnelProviderManager())
+    }
+}
+
+func fail(_ message: String) -> Never {
+    FileHandle.standardError.write((message + "\n").data(using: .utf8)!)
+    exit(1)
+}
+
+let args = CommandLine.arguments
+guard args.count > 1 else {
+    fail("usage: \(args[0]) install <config> | start | stop | uninstall")
+}
+
+manager { m in
+    switch args[1] {
+    case "install":
+        guard args.count > 2 else {
+            fail("usage: \(args[0]) install <config>")
+        }
+        let proto = NETunnelProviderProtocol()
+        proto.providerBundleIdentifier = providerBundleIdentifier
+        proto.serverAddress = "Docker"
+        proto.providerConfiguration = ["config": args[2]]
+        m.protocolConfiguration = proto
+        m.localizedDescription = "Docker Connector"
+        m.isEnabled = true
+        m.saveToPreferences { error in
+            if let error = error {
+                fail("save preferences: \(error)")
+            }
+            exit(0)
+        }
+    case "start":
+        do {
+            try m.connection.startVPNTunnel()
+        } catch {
+            fail("start: \(error)")
+        }
+        exit(0)
+    case "stop":
+        m.connection.stopVPNTunnel()
+        exit(0)
+    case "uninstall":
+        m.removeFromPreferences { error in
+            if let error = error {
+                fail("remove preferences: \(error)")
+            }
+            exit(0)
+        }
+    default:
+        fail("unknown command \(args[1])")
+    }
+}
+
+dispatchMain()
@@ -0,0 +1,232 @@
+//go:build darwin && netext
+// +build darwin,netext
+
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// TunnelSettings are what the provider applies with setTunnelNetworkSettings
+type TunnelSettings struct {
+	Version int         `json:"version"`
+	Address string      `json:"address"`
+	Peer    string      `json:"peer"`
+	MTU     int         `json:"mtu"`
+	Routes  []string    `json:"routes"`
+	DNS     []TunnelDNS `json:"dns,omitempty"`
+}
+
+// TunnelDNS is a domain resolved by a server through the tunnel, the system
+// matching the domains of the settings to all their servers
+type TunnelDNS struct {
+	Domain string `json:"domain"`
+	Server string `json:"server"`
+}
+
+// packetTunnel is the data plane of the packet tunnel provider, it runs the
+// connector on the utun of the provider and hands the addresses, routes and
+// MTU over to it instead of running ifconfig and route
+type packetTunnel struct {
+	sync.Mutex
+	fd        int
+	connector *Connector
+	settings  TunnelSettings
+	routes    map[string]bool
+	dns       map[string]string
+	// changed is closed and replaced whenever the settings change
+	changed chan struct{}
+}
+
+var tunnel = &packetTunnel{routes: make(map[string]bool), dns: make(map[string]string), changed: make(chan struct{})}
+
+// notify wakes up the waiting DockerConnectorWaitSettings, holding the lock
+func (t *packetTunnel) notify() {
+	t.settings.Version++
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *packetTunnel) setup(local, peer net.IP, subnet *net.IPNet) tunDevice {
+	t.Lock()
+	defer t.Unlock()
+	iface := &utun{file: os.NewFile(uintptr(t.fd), "utun"), name: utunName(t.fd)}
+	logger.Infof("[NETEXT] interface => %s\n", iface.name)
+	t.settings.Address = local.String()
+	t.settings.Peer = peer.String()
+	t.settings.MTU = MTU
+	t.notify()
+	return iface
+}
+
+func (t *packetTunnel) addRoute(key string) {
+	t.Lock()
+	defer t.Unlock()
+	if !t.routes[key] {
+		t.routes[key] = true
+		t.notify()
+	}
+}
+
+func (t *packetTunnel) delRoute(key string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.routes[key] {
+		delete(t.routes, key)
+		t.notify()
+	}
+}
+
+// setDNS resolves the domain through the server, "" to stop
+func (t *packetTunnel) setDNS(domain, server string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.dns[domain] == server {
+		return
+	}
+	if server == "" {
+		delete(t.dns, domain)
+	} else {
+		t.dns[domain] = server
+	}
+	t.notify()
+}
+
+func (t *packetTunnel) setMTU(mtu int) {
+	t.Lock()
+	defer t.Unlock()
+	t.settings.MTU = mtu
+	t.notify()
+}
+
+// utun is the utun of the provider, whose packets start with the address
+// family in 4 bytes
+type utun struct {
+	file *os.File
+	name string
+}
+
+func (u *utun) Name() string {
+	return u.name
+}
+
+func (u *utun) Read(b []byte) (int, error) {
+	buf := getBuffer(len(b) + 4)
+	defer putBuffer(buf)
+	n, err := u.file.Read(*buf)
+	if err != nil {
+		return 0, err
+	}
+	if n < 4 {
+		return 0, nil
+	}
+	return copy(b, (*buf)[4:n]), nil
+}
+
+func (u *utun) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	buf := getBuffer(len(b) + 4)
+	defer putBuffer(buf)
+	family := uint32(syscall.AF_INET)
+	if b[0]>>4 == 6 {
+		family = syscall.AF_INET6
+	}
+	binary.BigEndian.PutUint32(*buf, family)
+	copy((*buf)[4:], b)
+	if _, err := u.file.Write(*buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (u *utun) Close() error {
+	return u.file.Close()
+}
+
+// DockerConnectorStart runs the connector with the config on the utun of the
+// provider, it returns the error to free, or NULL
+//
+//export DockerConnectorStart
+func DockerConnectorStart(config *C.char, fd C.int) *C.char {
+	tunnel.Lock()
+	defer tunnel.Unlock()
+	if tunnel.connector != nil {
+		return C.CString("already started")
+	}
+	configFile = C.GoString(config)
+	if _, err := os.Stat(configFile); err != nil {
+		return C.CString(fmt.Sprintf("config file: %v", err))
+	}
+	bind = true
+	tunnel.fd = int(fd)
+	extension = tunnel
+	tunnel.connector = &Connector{}
+	tunnel.connector.Start(nil)
+	return nil
+}
+
+// DockerConnectorStop stops the connector, the waiting
+// DockerConnectorWaitSettings return NULL
+//
+//export DockerConnectorStop
+func DockerConnectorStop() {
+	tunnel.Lock()
+	c := tunnel.connector
+	tunnel.connector = nil
+	tunnel.Unlock()
+	if c == nil {
+		return
+	}
+	c.Stop(nil)
+	tunnel.Lock()
+	tunnel.routes = make(map[string]bool)
+	tunnel.dns = make(map[string]string)
+	tunnel.notify()
+	tunnel.Unlock()
+}
+
+// DockerConnectorWaitSettings waits for settings newer than the version and
+// returns them in JSON to free, NULL once stopped
+//
+//export DockerConnectorWaitSettings
+func DockerConnectorWaitSettings(version C.int) *C.char {
+	tunnel.Lock()
+	for tunnel.connector != nil && tunnel.settings.Version <= int(version) {
+		changed := tunnel.changed
+		tunnel.Unlock()
+		<-changed
+		tunnel.Lock()
+	}
+	defer tunnel.Unlock()
+	if tunnel.connector == nil {
+		return nil
+	}
+	settings := tunnel.settings
+	for key := range tunnel.routes {
+		settings.Routes = append(settings.Routes, key)
+	}
+	sort.Strings(settings.Routes)
+	for domain, server := range tunnel.dns {
+		settings.DNS = append(settings.DNS, TunnelDNS{Domain: domain, Server: server})
+	}
+	sort.Slice(settings.DNS, func(i, j int) bool { return settings.DNS[i].Domain < settings.DNS[j].Domain })
+	out, err := json.Marshal(settings)
+	if err != nil {
+		return nil
+	}
+	return C.CString(string(out))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// With `on-demand <duration>` the connector idles once nothing came from the
+// docker side for the duration: the routes stay installed, but the TUN isn't
+// read, the periodic checks and the status file pause and the log level drops
+// to warnings. The next datagram of the docker side, usually a heartbeat,
+// resumes it at once. `status` reports `idle`.
+var (
+	onDemand time.Duration
+	// idle is 1 while idling
+	idle     int32
+	idleLock sync.Mutex
+	// idleWake is closed when the connector resumes
+	idleWake = make(chan struct{})
+	// idleLevel is the log level restored on resume, 0 when left alone
+	idleLevel logging.Level
+	// idleSince is the time in unix nanoseconds the connector went idle
+	idleSince int64
+)
+
+func isIdle() bool {
+	return atomic.LoadInt32(&idle) == 1
+}
+
+// sleepIdle goes idle
+func sleepIdle(silent time.Duration) {
+	idleLock.Lock()
+	defer idleLock.Unlock()
+	if !atomic.CompareAndSwapInt32(&idle, 0, 1) {
+		return
+	}
+	idleWake = make(chan struct{})
+	atomic.StoreInt64(&idleSince, time.Now().UnixNano())
+	logger.Infof("[ON-DEMAND] Nothing from the docker side for %v, idling", silent.Round(time.Second))
+	events.Add("idle", "after %v", silent.Round(time.Second))
+	idleLevel = 0
+	if level := logging.GetLevel("vpn"); level > logging.WARNING {
+		idleLevel = level
+		setLogLevel(logging.WARNING, "on-demand")
+	}
+}
+
+// wakeIdle resumes, cheap when not idle as it runs for every datagram
+func wakeIdle() {
+	if !isIdle() {
+		return
+	}
+	idleLock.Lock()
+	defer idleLock.Unlock()
+	if !atomic.CompareAndSwapInt32(&idle, 1, 0) {
+		return
+	}
+	close(idleWake)
+	if idleLevel != 0 && logging.GetLevel("vpn") == logging.WARNING {
+		// unless changed meanwhile
+		setLogLevel(idleLevel, "on-demand")
+	}
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&idleSince))).Round(time.Second)
+	logger.Infof("[ON-DEMAND] Docker side back, resuming after %v idle", since)
+	events.Add("resume", "after %v idle", since)
+}
+
+// awaitWake blocks while idle, until resumed, done closed or the connector
+// stopped
+func awaitWake(ctx context.Context, done chan struct{}) {
+	if !isIdle() {
+		return
+	}
+	idleLock.Lock()
+	wake := idleWake
+	idleLock.Unlock()
+	select {
+	case <-wake:
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// watchIdle idles the connector after `onDemand` without a datagram of the
+// docker side, counted from the start before the first one. A reload turning
+// it off resumes.
+func (c *Connector) watchIdle() {
+	started := time.Now()
+	for {
+		every := onDemand / 4
+		if onDemand <= 0 {
+			every = 30 * time.Second
+		} else if every < time.Second {
+			every = time.Second
+		}
+		select {
+		case <-time.After(every):
+			if onDemand <= 0 {
+				wakeIdle()
+				continue
+			}
+			if isIdle() {
+				continue
+			}
+			last := started
+			if seen := atomic.LoadInt64(&lastSeen); seen != 0 {
+				last = time.Unix(0, seen)
+			}
+			if silent := time.Since(last); silent >= onDemand {
+				sleepIdle(silent)
+				writeStatusFile(c, "idle")
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+// Whatever is left of a datagram once the types of the tunnel are handled is
+// taken for an IP packet, it is checked before any forwarding decision so a
+// malformed or forged datagram is neither indexed past its end nor written
+// into the TUN. The rejected ones are counted in `rejected_packets` of the
+// status.
+const (
+	ipv4Header = 20
+	ipv6Header = 40
+)
+
+var rejectedPackets uint64
+
+// packetLength returns the length of the IP packet data starts with, or why
+// it is invalid
+func packetLength(data []byte) (int, string) {
+	if len(data) == 0 {
+		return 0, "empty"
+	}
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4Header {
+			return 0, "short ipv4 header"
+		}
+		ihl := int(data[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		switch {
+		case ihl < ipv4Header || ihl > len(data):
+			return 0, "bad ipv4 header length"
+		case total < ihl:
+			return 0, "ipv4 total length below the header"
+		case total > len(data):
+			return 0, "ipv4 total length beyond the datagram"
+		}
+		return total, ""
+	case 6:
+		if len(data) < ipv6Header {
+			return 0, "short ipv6 header"
+		}
+		total := ipv6Header + int(binary.BigEndian.Uint16(data[4:6]))
+		if total > len(data) {
+			return 0, "ipv6 payload length beyond the datagram"
+		}
+		return total, ""
+	}
+	return 0, "not an ip packet"
+}
+
+// validPacket returns the IP packet of data without trailing bytes, nil and
+// counted as rejected when invalid
+func validPacket(data []byte, from *net.UDPAddr) []byte {
+	n, reason := packetLength(data)
+	if reason != "" {
+		atomic.AddUint64(&rejectedPackets, 1)
+		if debugEnabled() {
+			logTransport.Debugf("[PACKET] Rejected %d bytes (%s) from %v: %s", len(data), messageType(data), from, reason)
+		}
+		return nil
+	}
+	return data[:n]
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// After the controls, which tell the docker side the address its packets
+// arrive from (`observed`), it reports the addresses of its own view:
+//
+//	8 | local=<addr> remote=<addr>
+//
+// where local is its socket address and remote the desktop address it sends
+// to. Mismatches reveal NATs and asymmetric paths, the most common silent
+// causes of one-way traffic.
+const pathReport = 8
+
+// PathStatus is the last path check, with hints for each finding
+type PathStatus struct {
+	Local    string   `json:"local"`
+	Observed string   `json:"observed"`
+	Remote   string   `json:"remote"`
+	Findings []string `json:"findings,omitempty"`
+	Hints    []string `json:"hints,omitempty"`
+}
+
+type pathChecker struct {
+	sync.Mutex
+	status *PathStatus
+}
+
+var paths = &pathChecker{}
+
+func (p *pathChecker) Status() *PathStatus {
+	p.Lock()
+	defer p.Unlock()
+	return p.status
+}
+
+// Report checks the view of the docker side against ours
+func (p *pathChecker) Report(data []byte, from *net.UDPAddr) {
+	st := &PathStatus{Observed: from.String()}
+	for _, kv := range strings.Fields(string(data)) {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			switch kv[:i] {
+			case "local":
+				st.Local = kv[i+1:]
+			case "remote":
+				st.Remote = kv[i+1:]
+			}
+		}
+	}
+	local, _ := net.ResolveUDPAddr("udp", st.Local)
+	remote, _ := net.ResolveUDPAddr("udp", st.Remote)
+	finding := func(f, hint string) {
+		st.Findings = append(st.Findings, f)
+		if hint != "" {
+			st.Hints = append(st.Hints, hint)
+		}
+	}
+	natted := false
+	switch {
+	case from.IP.IsLoopback():
+		finding("relayed by Docker Desktop", "")
+	case local == nil:
+		finding("docker side did not report its address", "")
+	case !local.IP.Equal(from.IP):
+		natted = true
+		if local.Port != from.Port {
+			finding(fmt.Sprintf("port translating NAT between %v and %v", local, from),
+				fmt.Sprintf("keep `heartbeat` (%dms) below the UDP timeout of the NAT, usually 30s", heartbeat))
+		} else {
+			finding(fmt.Sprintf("NAT between %v and %v", local, from), "")
+		}
+	}
+	if remote != nil && !from.IP.IsLoopback() {
+		if !isLocalIP(remote.IP) {
+			if natted {
+				finding(fmt.Sprintf("double NAT, the docker side sends to %v", remote),
+					fmt.Sprintf("forward %v to udp port %d of this host, or run the connector in the guest with `host guest`", remote, port))
+			} else {
+				finding(fmt.Sprintf("the docker side sends to %v, which is not an address of this host", remote),
+					fmt.Sprintf("forward %v to udp port %d of this host", remote, port))
+			}
+		} else if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			if src := sourceIP(from); src != nil && !src.Equal(remote.IP) {
+				finding(fmt.Sprintf("asymmetric path, replies leave from %v instead of %v", src, remote.IP),
+					fmt.Sprintf("set `host %v` so replies leave from the address the docker side sends to", remote.IP))
+			}
+		}
+	}
+	cli := shared.Client()
+	if ctl, to := controlTarget(nil); ctl != conn && to != nil && cli != nil && !to.IP.Equal(cli.IP) {
+		finding(fmt.Sprintf("asymmetric path, control from %v and data from %v", to.IP, cli.IP),
+			"check the routes of the docker side, both sockets should reach the desktop through the same interface")
+	}
+	for _, f := range st.Findings {
+		logTransport.Infof("[PATH] %s", f)
+	}
+	for _, h := range st.Hints {
+		logTransport.Warningf("[PATH] hint => %s", h)
+	}
+	p.Lock()
+	p.status = st
+	p.Unlock()
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceIP returns the source address the system picks to reach addr
+func sourceIP(addr *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// peerFilter drops the datagrams of sources outside the `peers-allow` CIDRs,
+// so another host on the LAN can't take over the peer slot. All sources are
+// accepted when the list is empty.
+type peerFilter struct {
+	sync.Mutex
+	nets     []*net.IPNet
+	dropped  uint64
+	lastDrop string
+}
+
+var peersAllow = &peerFilter{}
+
+// PeersStatus reports the allowed CIDRs and the dropped datagrams
+type PeersStatus struct {
+	Allow    []string `json:"allow"`
+	Dropped  uint64   `json:"dropped"`
+	LastDrop string   `json:"lastDrop,omitempty"`
+}
+
+// parsePeers parses a list of CIDRs or addresses separated by spaces or commas
+func parsePeers(val string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func (f *peerFilter) Set(nets []*net.IPNet) {
+	f.Lock()
+	defer f.Unlock()
+	if len(nets) != len(f.nets) {
+		logger.Infof("[PEERS] Accepting datagrams from %d networks", len(nets))
+	}
+	f.nets = nets
+}
+
+// Allowed returns whether the source is allowed, counting the drops
+func (f *peerFilter) Allowed(ip net.IP) bool {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.nets) == 0 {
+		return true
+	}
+	for _, ipnet := range f.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	f.dropped++
+	if src := ip.String(); src != f.lastDrop {
+		logger.Warningf("[PEERS] Dropping datagrams from %s, not in peers-allow", src)
+		f.lastDrop = src
+	}
+	return false
+}
+
+func (f *peerFilter) Status() *PeersStatus {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.nets) == 0 {
+		return nil
+	}
+	s := &PeersStatus{Dropped: f.dropped, LastDrop: f.lastDrop}
+	for _, ipnet := range f.nets {
+		s.Allow = append(s.Allow, ipnet.String())
+	}
+	return s
+}
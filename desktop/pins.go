@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Once the replies to the heartbeats flag the desktop knows the identities,
+// the docker side signs its heartbeats with the Ed25519 key of its
+// `-identity-file`:
+//
+//	0 | t1 | echoT1 | t4 | features | session(8) | key(32) | signature(64)
+//
+// With `pin-peers tofu` the first key is pinned on first use and kept in the
+// state directory, with `pin-peer <key> [name]` the keys are given by the
+// config, the docker side printing its key at start. Either way the heartbeats
+// of any other key, unsigned or replayed, are dropped even with the knock and
+// control secrets, like the data from other addresses than the one of the
+// last accepted heartbeat, so another agent knowing the secrets can't take the
+// tunnel over. A heartbeat must be signed within identityWindow of the clock
+// of the desktop, later than the previous one of the socket.
+// `docker-connector pins` lists the pinned keys, `pins revoke <key|name>`
+// forgets one pinned on first use, e.g. after recreating the VM, the next
+// agent being pinned in its place.
+const (
+	pinsFileName    = "desktop-docker-connector.pins"
+	identityLen     = ed25519.PublicKeySize + ed25519.SignatureSize
+	desktopIdentity = 2
+	identityWindow  = 5 * time.Minute
+)
+
+// PinsFile keeps the keys pinned on first use
+var PinsFile = ""
+
+// PinnedPeer is a pinned key of a docker side
+type PinnedPeer struct {
+	Key      string `json:"key"`
+	Name     string `json:"name,omitempty"`
+	Source   string `json:"source"`
+	Pinned   string `json:"pinned,omitempty"`
+	LastSeen string `json:"last_seen,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+}
+
+// PinsStatus lists the pinned keys
+type PinsStatus struct {
+	Mode     string       `json:"mode"`
+	Client   string       `json:"client,omitempty"`
+	Pins     []PinnedPeer `json:"pins"`
+	Rejected uint64       `json:"rejected"`
+}
+
+type peerPins struct {
+	sync.Mutex
+	tofu       bool
+	configured []PinnedPeer
+	learned    []PinnedPeer
+	loaded     bool
+	// last is the t1 of the last accepted heartbeat by socket
+	last     map[string]int64
+	client   string
+	rejected uint64
+	lastWarn time.Time
+	// requested bounds the requests of a signed heartbeat by socket
+	requested map[string]time.Time
+}
+
+var pins = &peerPins{last: make(map[string]int64), requested: make(map[string]time.Time)}
+
+// parsePinnedPeer parses `pin-peer <key> [name]`
+func parsePinnedPeer(val string) (PinnedPeer, error) {
+	vals := strings.Fields(val)
+	if len(vals) == 0 || len(vals) > 2 {
+		return PinnedPeer{}, fmt.Errorf("expected <key> [name]")
+	}
+	if key, err := base64.StdEncoding.DecodeString(vals[0]); err != nil || len(key) != ed25519.PublicKeySize {
+		return PinnedPeer{}, fmt.Errorf("expected the base64 public key printed by the docker side")
+	}
+	p := PinnedPeer{Key: vals[0], Source: "config"}
+	if len(vals) == 2 {
+		p.Name = vals[1]
+	}
+	return p, nil
+}
+
+// Set applies `pin-peers` and the `pin-peer` lines
+func (p *peerPins) Set(tofu bool, configured []PinnedPeer) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.loaded && PinsFile != "" {
+		p.loaded = true
+		if data, err := ioutil.ReadFile(PinsFile); err == nil {
+			if err := json.Unmarshal(data, &p.learned); err != nil {
+				logger.Warningf("[PINS] Invalid %s: %v", PinsFile, err)
+			}
+		}
+	}
+	if tofu != p.tofu || len(configured) != len(p.configured) {
+		switch {
+		case tofu || len(configured) > 0:
+			logger.Infof("[PINS] Pinning the docker side, tofu %v, %d pinned by the config, %d on first use", tofu, len(configured), len(p.learned))
+		default:
+			logger.Infof("[PINS] Pinning off")
+		}
+	}
+	p.tofu, p.configured = tofu, configured
+}
+
+// Active tells whether the docker side is pinned
+func (p *peerPins) Active() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.tofu || len(p.configured) > 0
+}
+
+// find returns the pin of a key, nil without
+func (p *peerPins) find(key string) *PinnedPeer {
+	for i := range p.configured {
+		if p.configured[i].Key == key {
+			return &p.configured[i]
+		}
+	}
+	for i := range p.learned {
+		if p.learned[i].Key == key {
+			return &p.learned[i]
+		}
+	}
+	return nil
+}
+
+// save writes the keys pinned on first use
+func (p *peerPins) save() {
+	if PinsFile == "" {
+		return
+	}
+	data, _ := json.MarshalIndent(p.learned, "", "  ")
+	if err := ioutil.WriteFile(PinsFile, data, 0600); err != nil {
+		logger.Warningf("[PINS] Failed to save %s: %v", PinsFile, err)
+	}
+}
+
+// heartbeatIdentity returns the key and t1 of a signed heartbeat
+func heartbeatIdentity(data []byte) (string, int64, error) {
+	if len(data) != heartbeatLen+1+sessionLen+identityLen {
+		return "", 0, fmt.Errorf("unsigned heartbeat")
+	}
+	signed := len(data) - ed25519.SignatureSize
+	key := data[heartbeatLen+1+sessionLen : signed]
+	if !ed25519.Verify(ed25519.PublicKey(key), data[:signed], data[signed:]) {
+		return "", 0, fmt.Errorf("bad signature")
+	}
+	return base64.StdEncoding.EncodeToString(key), readStamp(data[1:]), nil
+}
+
+// Admit tells whether a heartbeat on a socket carries a pinned identity, asking
+// an unsigned one for a signed heartbeat
+func (p *peerPins) Admit(c *net.UDPConn, sock string, data []byte, from *net.UDPAddr) bool {
+	if !p.Active() {
+		return true
+	}
+	key, t1, err := heartbeatIdentity(data)
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	if err != nil {
+		if at, ok := p.requested[sock]; !ok || now.Sub(at) >= sessionRequestEvery {
+			p.requested[sock] = now
+			c.WriteToUDP([]byte{sessionRequest, desktopSessions | desktopIdentity}, from)
+		}
+		return p.reject(from, err.Error())
+	}
+	if d := time.Duration(now.UnixNano() - t1); d > identityWindow || d < -identityWindow {
+		return p.reject(from, fmt.Sprintf("heartbeat of %s signed %v away", key, d.Round(time.Second)))
+	}
+	if t1 <= p.last[sock] {
+		return p.reject(from, fmt.Sprintf("replayed heartbeat of %s", key))
+	}
+	pin := p.find(key)
+	if pin == nil {
+		if !p.tofu || len(p.configured) > 0 || len(p.learned) > 0 {
+			return p.reject(from, fmt.Sprintf("%s not pinned", key))
+		}
+		p.learned = append(p.learned, PinnedPeer{Key: key, Source: "tofu", Pinned: now.Format(time.RFC3339)})
+		p.save()
+		pin = &p.learned[len(p.learned)-1]
+		logger.Infof("[PINS] Pinned %s of %v on first use", key, from)
+		events.Add("pins", "pinned %s of %v", key, from)
+	}
+	p.last[sock] = t1
+	pin.LastSeen, pin.Addr = now.Format(time.RFC3339), from.String()
+	p.client = key
+	return true
+}
+
+// reject counts a rejected heartbeat, warning once a minute
+func (p *peerPins) reject(from *net.UDPAddr, reason string) bool {
+	p.rejected++
+	if time.Since(p.lastWarn) >= time.Minute {
+		p.lastWarn = time.Now()
+		logger.Warningf("[PINS] Heartbeat from %v rejected: %s", from, reason)
+	}
+	return false
+}
+
+// Revoke forgets a key pinned on first use, by key or name, and ends the
+// sessions of the client holding it
+func (p *peerPins) Revoke(id string) error {
+	p.Lock()
+	var revoked string
+	for i, pin := range p.learned {
+		if pin.Key == id || pin.Name != "" && pin.Name == id {
+			revoked = pin.Key
+			p.learned = append(p.learned[:i], p.learned[i+1:]...)
+			break
+		}
+	}
+	if revoked == "" {
+		p.Unlock()
+		for _, pin := range p.configured {
+			if pin.Key == id || pin.Name != "" && pin.Name == id {
+				return fmt.Errorf("%s is pinned by the config, remove its pin-peer line", id)
+			}
+		}
+		return fmt.Errorf("no pin %s", id)
+	}
+	p.save()
+	client := p.client == revoked
+	if client {
+		p.client = ""
+	}
+	p.Unlock()
+	logger.Infof("[PINS] Revoked %s", revoked)
+	events.Add("pins", "revoked %s", revoked)
+	if client {
+		dataSession.End()
+		ctlSession.End()
+	}
+	return nil
+}
+
+// Status reports the pins, nil without pinning
+func (p *peerPins) Status() *PinsStatus {
+	p.Lock()
+	defer p.Unlock()
+	if !p.tofu && len(p.configured) == 0 {
+		return nil
+	}
+	st := &PinsStatus{Mode: "config", Client: p.client, Rejected: p.rejected, Pins: []PinnedPeer{}}
+	if p.tofu {
+		st.Mode = "tofu"
+	}
+	st.Pins = append(append(st.Pins, p.configured...), p.learned...)
+	return st
+}
+
+func servePins(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := pins.Revoke(r.URL.Query().Get("revoke")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	st := pins.Status()
+	if st == nil {
+		st = &PinsStatus{Mode: "off", Pins: []PinnedPeer{}}
+	}
+	writeJSON(w, st)
+}
+
+// runPinsCommand implements `pins [list]` and `pins revoke <key|name>`
+func runPinsCommand() {
+	fs := flag.NewFlagSet("pins", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s pins [-admin addr] [list | revoke <key|name>]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	var body []byte
+	var err error
+	switch {
+	case fs.NArg() == 0 || fs.NArg() == 1 && fs.Arg(0) == "list":
+		body, err = adminGet("/pins")
+	case fs.NArg() == 2 && fs.Arg(0) == "revoke":
+		body, err = adminPost("/pins?revoke="+url.QueryEscape(fs.Arg(1)), "")
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var st PinsStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		os.Stdout.Write(body)
+		return
+	}
+	fmt.Printf("pinning %s, %d rejected\n", st.Mode, st.Rejected)
+	for _, pin := range st.Pins {
+		mark := " "
+		if pin.Key == st.Client {
+			mark = "*"
+		}
+		fmt.Printf("%s %s %-8s %-12s %s %s\n", mark, pin.Key, pin.Source, pin.Name, pin.LastSeen, pin.Addr)
+	}
+}
@@ -0,0 +1,17 @@
+// Package connector is the wire protocol of the tunnel between the desktop
+// and the docker side, for the tools talking to either end without the
+// binaries, e.g. a GUI reading the controls or a test peer:
+//
+//	if connector.MessageType(datagram) == "control chunk" {
+//		...
+//	}
+//
+// The first byte of a datagram tells its type, tunneled IP packets start with
+// their version instead (0x4X or 0x6X). The controls the desktop sends are
+// framed by ControlHeader, or split by ControlChunks when the docker side
+// advertises FeatureChunks, and the ones the docker side pushes are signed
+// by SignControl and checked by a Verifier when a secret is shared.
+//
+// The binary frames, signs and filters its datagrams with the same
+// definitions. Its TUN, sockets and sessions aren't part of the package.
+package connector
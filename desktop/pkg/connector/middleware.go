@@ -0,0 +1,59 @@
+package connector
+
+import "sync"
+
+// Direction is the way a packet crosses the tunnel
+type Direction int
+
+const (
+	// Outbound packets go from the TUN to the docker side
+	Outbound Direction = iota
+	// Inbound packets come from the docker side to the TUN
+	Inbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// Middleware processes a packet crossing the tunnel. It returns the packet
+// to pass on, the same or another one, or drop to stop it. A middleware
+// keeping the packet for later, as a delay does, copies it and drops it.
+type Middleware func(pkt []byte, dir Direction) (out []byte, drop bool)
+
+// Chain runs middlewares in order
+type Chain []Middleware
+
+// Run passes a packet through the chain, it stops at the first drop
+func (c Chain) Run(pkt []byte, dir Direction) ([]byte, bool) {
+	for _, m := range c {
+		var drop bool
+		if pkt, drop = m(pkt, dir); drop {
+			return nil, true
+		}
+	}
+	return pkt, false
+}
+
+var (
+	registeredLock sync.RWMutex
+	registered     Chain
+)
+
+// Use registers a middleware run by the connector in both directions, after
+// its own filters and before the packets are counted and sent
+func Use(m Middleware) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+	registered = append(registered, m)
+}
+
+// Registered returns the middlewares registered with Use
+func Registered() Chain {
+	registeredLock.RLock()
+	defer registeredLock.RUnlock()
+	return append(Chain(nil), registered...)
+}
@@ -0,0 +1,157 @@
+package connector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// The types of the datagrams
+const (
+	Heartbeat      = 0
+	Control        = 1
+	Expose         = 2
+	DiagResult     = 3
+	DiagCommand    = 4
+	ResyncRequest  = 5
+	Fragment       = 6
+	Compressed     = 7
+	PathReport     = 8
+	Controls       = 9
+	Tap            = 10
+	SocksDial      = 11
+	SocksUDP       = 12
+	SessionRequest = 13
+	Bench          = 14
+	FEC            = 15
+	Sequenced      = 16
+	ControlChunk   = 17
+	Keepalive      = 18
+	ControlsAck    = 19
+)
+
+// The features advertised by the docker side in its heartbeats
+const (
+	FeatureLZ4       = 1
+	FeatureTAP       = 2
+	FeatureFEC       = 4
+	FeatureDedup     = 8
+	FeatureChunks    = 16
+	FeatureKeepalive = 32
+	FeatureDeltas    = 64
+	FeatureControls  = 128
+)
+
+// The controls sent to the docker side start with the header
+//
+//	9 | length(4)
+//
+// in network byte order, followed by the payload in the same datagram or in
+// the next ones, for a docker side advertising FeatureControls. The others,
+// built before it, get the legacy `1 | length(2)` header limited to 64KB.
+//
+// A docker side advertising FeatureChunks gets the payload in self-described
+// chunks instead
+//
+//	17 | id(4) | length(4) | offset(4) | part
+//
+// so a lost chunk doesn't take the next packets for the controls, the docker
+// side requesting them again when they stay incomplete.
+//
+// A docker side advertising FeatureDeltas gets versioned controls, the first
+// item of the payload being `version <v>` for the full state or `delta <base>
+// <v>` followed by `+<item>`, `-<item>` and `=<item>`, which add, remove or
+// replace the items of the same first word of the state of version base. It
+// acknowledges each applied version with
+//
+//	19 | version(8)
+//
+// and sends a ResyncRequest for a delta on another base than its own.
+const (
+	ControlsHeader = 5
+	// ControlsMax bounds the payload a header may announce
+	ControlsMax = 16 << 20
+
+	ControlChunkHeader = 13
+)
+
+// controlsID numbers the chunked payloads
+var controlsID uint32
+
+// ControlHeader returns the header of a controls payload of l bytes
+func ControlHeader(l int) []byte {
+	header := make([]byte, ControlsHeader)
+	header[0] = Controls
+	binary.BigEndian.PutUint32(header[1:], uint32(l))
+	return header
+}
+
+// LegacyControlHeader returns the header of a controls payload of l bytes,
+// at most 64KB, for a docker side without FeatureControls
+func LegacyControlHeader(l int) []byte {
+	header := make([]byte, 3)
+	header[0] = Control
+	binary.BigEndian.PutUint16(header[1:], uint16(l))
+	return header
+}
+
+// ControlChunks splits a payload in chunks of at most size bytes
+func ControlChunks(payload []byte, size int) [][]byte {
+	id := atomic.AddUint32(&controlsID, 1)
+	size -= ControlChunkHeader
+	var chunks [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := make([]byte, ControlChunkHeader, ControlChunkHeader+end-off)
+		chunk[0] = ControlChunk
+		binary.BigEndian.PutUint32(chunk[1:], id)
+		binary.BigEndian.PutUint32(chunk[5:], uint32(len(payload)))
+		binary.BigEndian.PutUint32(chunk[9:], uint32(off))
+		chunks = append(chunks, append(chunk, payload[off:end]...))
+	}
+	return chunks
+}
+
+// messageTypes names the types of the datagrams for the logs
+var messageTypes = map[byte]string{
+	Heartbeat:      "heartbeat",
+	Control:        "control",
+	Expose:         "expose",
+	DiagResult:     "diag result",
+	DiagCommand:    "diag command",
+	ResyncRequest:  "resync request",
+	Fragment:       "fragment",
+	Compressed:     "compressed",
+	PathReport:     "path report",
+	Controls:       "controls",
+	Tap:            "tap",
+	SocksDial:      "socks dial",
+	SocksUDP:       "socks udp",
+	SessionRequest: "session request",
+	Bench:          "bench",
+	FEC:            "fec",
+	Sequenced:      "sequenced",
+	ControlChunk:   "control chunk",
+	Keepalive:      "keepalive",
+	ControlsAck:    "controls ack",
+}
+
+// MessageType names the type of a datagram
+func MessageType(data []byte) string {
+	if len(data) == 0 {
+		return "empty"
+	}
+	if name, ok := messageTypes[data[0]]; ok {
+		return name
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return "ipv4"
+	case 6:
+		return "ipv6"
+	}
+	return fmt.Sprintf("unknown %d", data[0])
+}
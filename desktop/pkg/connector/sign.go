@@ -0,0 +1,87 @@
+package connector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The controls pushed by the docker side, the routes and the domains, are
+// signed when a secret is shared
+//
+//	1 | timestamp(8) | hmac-sha256(secret, timestamp | line) | line
+//
+// and a control older than ControlSkew, or one seen before, is rejected.
+const (
+	ControlSignLen = 8 + sha256.Size
+	ControlSkew    = 60 * time.Second
+)
+
+// The reasons a Verifier rejects a control
+var (
+	ErrUnsigned  = errors.New("unsigned control")
+	ErrSignature = errors.New("invalid control signature")
+	ErrReplayed  = errors.New("replayed control")
+)
+
+// controlMAC signs the timestamp and the line of a control
+func controlMAC(secret string, ts, line []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(ts)
+	mac.Write(line)
+	return mac.Sum(nil)
+}
+
+// SignControl returns the payload of a control line, the line itself
+// without a secret
+func SignControl(secret, line string) []byte {
+	if secret == "" {
+		return []byte(line)
+	}
+	packet := make([]byte, 8, ControlSignLen+len(line))
+	binary.BigEndian.PutUint64(packet, uint64(time.Now().UnixNano()))
+	packet = append(packet, controlMAC(secret, packet, []byte(line))...)
+	return append(packet, line...)
+}
+
+// Verifier checks the signed controls, remembering the ones accepted within
+// the skew
+type Verifier struct {
+	sync.Mutex
+	seen map[int64]time.Time
+}
+
+// Verify returns the line of a signed control payload
+func (v *Verifier) Verify(secret string, data []byte) ([]byte, error) {
+	if len(data) <= ControlSignLen {
+		return nil, ErrUnsigned
+	}
+	ts, line := data[:8], data[ControlSignLen:]
+	if !hmac.Equal(data[8:ControlSignLen], controlMAC(secret, ts, line)) {
+		return nil, ErrSignature
+	}
+	at := int64(binary.BigEndian.Uint64(ts))
+	if d := time.Since(time.Unix(0, at)); d > ControlSkew || d < -ControlSkew {
+		return nil, fmt.Errorf("stale control, skew %v", d)
+	}
+	v.Lock()
+	defer v.Unlock()
+	now := time.Now()
+	if v.seen == nil {
+		v.seen = make(map[int64]time.Time)
+	}
+	for seen, t := range v.seen {
+		if now.Sub(t) > 2*ControlSkew {
+			delete(v.seen, seen)
+		}
+	}
+	if _, ok := v.seen[at]; ok {
+		return nil, ErrReplayed
+	}
+	v.seen[at] = now
+	return line, nil
+}
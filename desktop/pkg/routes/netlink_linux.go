@@ -0,0 +1,277 @@
+package routes
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// iflaTxqlen is IFLA_TXQLEN, missing from syscall
+const iflaTxqlen = 13
+
+var seq uint32
+
+// request sends a netlink request and waits for its acknowledgement
+func request(typ, flags int, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	n := atomic.AddUint32(&seq, 1)
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	msg = append(msg, body...)
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&msg[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  uint16(typ),
+		Flags: uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags),
+		Seq:   n,
+	}
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		nr, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nr])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != n || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return syscall.EINVAL
+			}
+			if errno := int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// attr appends a route attribute
+func attr(b []byte, typ int, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	h := make([]byte, syscall.SizeofRtAttr)
+	*(*syscall.RtAttr)(unsafe.Pointer(&h[0])) = syscall.RtAttr{Len: uint16(l), Type: uint16(typ)}
+	b = append(append(b, h...), data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func u32(v int) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func index(dev string) (int, error) {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return 0, syscall.ENODEV
+	}
+	return ifi.Index, nil
+}
+
+// routeMsg builds the rtmsg and the attributes of a route
+func routeMsg(r Route, add bool) ([]byte, error) {
+	ones, _ := r.Dst.Mask.Size()
+	msg := syscall.RtMsg{
+		Family:   syscall.AF_INET,
+		Dst_len:  uint8(ones),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_NOWHERE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	if !add {
+		// any protocol, the route may come from ip route as well
+		msg.Protocol = 0
+	} else {
+		msg.Scope = syscall.RT_SCOPE_UNIVERSE
+		if r.Gateway == nil {
+			msg.Scope = syscall.RT_SCOPE_LINK
+		}
+	}
+	if r.Table > 0 && r.Table < 256 {
+		msg.Table = uint8(r.Table)
+	}
+	b := make([]byte, syscall.SizeofRtMsg)
+	*(*syscall.RtMsg)(unsafe.Pointer(&b[0])) = msg
+	b = attr(b, syscall.RTA_DST, r.Dst.IP.To4())
+	if r.Table >= 256 {
+		b = attr(b, syscall.RTA_TABLE, u32(r.Table))
+	}
+	if r.Gateway != nil {
+		b = attr(b, syscall.RTA_GATEWAY, r.Gateway.To4())
+	}
+	if !add {
+		return b, nil
+	}
+	if r.Dev != "" {
+		i, err := index(r.Dev)
+		if err != nil {
+			return nil, err
+		}
+		b = attr(b, syscall.RTA_OIF, u32(i))
+	}
+	if r.Metric > 0 {
+		b = attr(b, syscall.RTA_PRIORITY, u32(r.Metric))
+	}
+	return b, nil
+}
+
+// Add installs a route, ErrExists when installed the same way and
+// ErrConflict when through another gateway or interface
+func Add(r Route) error {
+	b, err := routeMsg(r, true)
+	if err == nil {
+		err = request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, b)
+	}
+	err = wrap("add", r.String(), err)
+	if e, ok := err.(*Error); ok && e.Kind == ErrExists && !installed(r) {
+		e.Kind = ErrConflict
+	}
+	return err
+}
+
+// Delete removes a route of the subnet, only through the gateway when set
+func Delete(r Route) error {
+	b, err := routeMsg(r, false)
+	if err == nil {
+		err = request(syscall.RTM_DELROUTE, 0, b)
+	}
+	return wrap("delete", r.String(), err)
+}
+
+// installed tells whether the route of the subnet goes the way of r
+func installed(r Route) bool {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		return false
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return false
+	}
+	ones, _ := r.Dst.Mask.Size()
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rt := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if int(rt.Dst_len) != ones {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		var dst, gw net.IP
+		dev := ""
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_DST:
+				dst = net.IP(a.Value)
+			case syscall.RTA_GATEWAY:
+				gw = net.IP(a.Value)
+			case syscall.RTA_OIF:
+				if ifi, err := net.InterfaceByIndex(int(binary.LittleEndian.Uint32(a.Value))); err == nil {
+					dev = ifi.Name
+				}
+			}
+		}
+		if dst.Equal(r.Dst.IP) {
+			return sameRoute(r, gw, dev)
+		}
+	}
+	return false
+}
+
+// AddAddress gives the interface a local address, point to point with peer
+// unless nil
+func AddAddress(dev string, local, peer net.IP) error {
+	target := dev + " " + local.String()
+	i, err := index(dev)
+	if err != nil {
+		return wrap("address", target, err)
+	}
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	*(*syscall.IfAddrmsg)(unsafe.Pointer(&b[0])) = syscall.IfAddrmsg{
+		Family:    syscall.AF_INET,
+		Prefixlen: 32,
+		Index:     uint32(i),
+	}
+	b = attr(b, syscall.IFA_LOCAL, local.To4())
+	if peer == nil {
+		peer = local
+	}
+	b = attr(b, syscall.IFA_ADDRESS, peer.To4())
+	return wrap("address", target, request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, b))
+}
+
+// FlushAddresses removes the IPv4 addresses of the interface
+func FlushAddresses(dev string) error {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return wrap("address", dev, syscall.ENODEV)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return wrap("address", dev, err)
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		b := make([]byte, syscall.SizeofIfAddrmsg)
+		*(*syscall.IfAddrmsg)(unsafe.Pointer(&b[0])) = syscall.IfAddrmsg{
+			Family:    syscall.AF_INET,
+			Prefixlen: uint8(ones),
+			Index:     uint32(ifi.Index),
+		}
+		b = attr(b, syscall.IFA_LOCAL, ipnet.IP.To4())
+		if err := request(syscall.RTM_DELADDR, 0, b); err != nil {
+			return wrap("address", dev+" "+ipnet.IP.String(), err)
+		}
+	}
+	return nil
+}
+
+// SetLink brings the interface up with the MTU and, unless 0, the length of
+// the transmit queue
+func SetLink(dev string, mtu, qlen int) error {
+	i, err := index(dev)
+	if err != nil {
+		return wrap("link", dev, err)
+	}
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	*(*syscall.IfInfomsg)(unsafe.Pointer(&b[0])) = syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(i),
+		Flags:  syscall.IFF_UP,
+		Change: syscall.IFF_UP,
+	}
+	if mtu > 0 {
+		b = attr(b, syscall.IFLA_MTU, u32(mtu))
+	}
+	if qlen > 0 {
+		b = attr(b, iflaTxqlen, u32(qlen))
+	}
+	return wrap("link", dev, request(syscall.RTM_NEWLINK, 0, b))
+}
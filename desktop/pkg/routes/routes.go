@@ -0,0 +1,134 @@
+// Package routes installs the routes and configures the interfaces of the
+// connector natively, netlink on linux and the routing socket and ioctls on
+// macOS, instead of running ip, route and ifconfig:
+//
+//	err := routes.Add(routes.Route{Dst: subnet, Gateway: peer, Metric: 50})
+//	if errors.Is(err, routes.ErrConflict) {
+//		...
+//	}
+//
+// The errors are an *Error whose Kind tells a missing permission, a route
+// already installed the same way, a conflicting route of the system and a
+// missing route apart, instead of being lost in the output of a command.
+// Other systems return ErrUnsupported and keep the commands.
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	// ErrPermission is a missing privilege, the connector runs as root
+	ErrPermission = errors.New("permission denied")
+	// ErrExists is a route already installed the same way
+	ErrExists = errors.New("route exists")
+	// ErrConflict is a route of the same subnet through another gateway or
+	// interface
+	ErrConflict = errors.New("conflicting route")
+	// ErrNotFound is a missing route or interface
+	ErrNotFound = errors.New("not found")
+	// ErrUnsupported is a system without native implementation
+	ErrUnsupported = errors.New("unsupported")
+)
+
+// Route is a route through a gateway or straight to an interface
+type Route struct {
+	Dst *net.IPNet
+	// Gateway is the next hop, nil for a route to Dev
+	Gateway net.IP
+	// Dev is the interface of a route without gateway
+	Dev string
+	// Metric and Table are 0 for the defaults, Table is linux only
+	Metric, Table int
+}
+
+func (r Route) String() string {
+	s := r.Dst.String()
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	if r.Dev != "" {
+		s += " dev " + r.Dev
+	}
+	if r.Metric > 0 {
+		s += fmt.Sprintf(" metric %d", r.Metric)
+	}
+	if r.Table > 0 {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+// Error is a failed operation, errors.Is matches its Kind
+type Error struct {
+	// Op is add, delete, address or link
+	Op string
+	// Target is the route or interface
+	Target string
+	// Kind is one of the Err values, or nil when unknown
+	Kind error
+	// Err is the error of the system
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Kind != nil && e.Kind != e.Err {
+		return fmt.Sprintf("%s %s: %v (%v)", e.Op, e.Target, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	if e.Kind != nil {
+		return e.Kind
+	}
+	return e.Err
+}
+
+// KindOf names the kind of an error for the status and the hooks:
+// permission, exists, conflict, not-found, unsupported or error
+func KindOf(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrPermission):
+		return "permission"
+	case errors.Is(err, ErrExists):
+		return "exists"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrNotFound):
+		return "not-found"
+	case errors.Is(err, ErrUnsupported):
+		return "unsupported"
+	}
+	return "error"
+}
+
+// wrap classifies the errno of an operation
+func wrap(op, target string, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Op: op, Target: target, Err: err}
+	switch err {
+	case syscall.EPERM, syscall.EACCES:
+		e.Kind = ErrPermission
+	case syscall.EEXIST:
+		e.Kind = ErrExists
+	case syscall.ESRCH, syscall.ENOENT, syscall.ENODEV, syscall.ENXIO:
+		e.Kind = ErrNotFound
+	}
+	return e
+}
+
+// sameRoute tells whether an installed route goes the way of r
+func sameRoute(r Route, gw net.IP, dev string) bool {
+	if r.Gateway != nil {
+		return r.Gateway.Equal(gw)
+	}
+	return r.Dev == dev
+}
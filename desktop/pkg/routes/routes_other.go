@@ -0,0 +1,27 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package routes
+
+import "net"
+
+// Add is unsupported, the caller runs the commands of the system
+func Add(r Route) error {
+	return &Error{Op: "add", Target: r.String(), Kind: ErrUnsupported, Err: ErrUnsupported}
+}
+
+func Delete(r Route) error {
+	return &Error{Op: "delete", Target: r.String(), Kind: ErrUnsupported, Err: ErrUnsupported}
+}
+
+func AddAddress(dev string, local, peer net.IP) error {
+	return &Error{Op: "address", Target: dev, Kind: ErrUnsupported, Err: ErrUnsupported}
+}
+
+func FlushAddresses(dev string) error {
+	return &Error{Op: "address", Target: dev, Kind: ErrUnsupported, Err: ErrUnsupported}
+}
+
+func SetLink(dev string, mtu, qlen int) error {
+	return &Error{Op: "link", Target: dev, Kind: ErrUnsupported, Err: ErrUnsupported}
+}
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/route"
+)
+
+var seq int32
+
+// send writes a message to the routing socket, the kernel answers the
+// failures right away
+func send(typ, flags int, addrs []route.Addr) error {
+	msg := route.RouteMessage{
+		Version: syscall.RTM_VERSION,
+		Type:    typ,
+		Flags:   flags,
+		ID:      uintptr(os.Getpid()),
+		Seq:     int(atomic.AddInt32(&seq, 1)),
+		Addrs:   addrs,
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, err = syscall.Write(fd, b)
+	return err
+}
+
+func inet4(ip net.IP) *route.Inet4Addr {
+	a := &route.Inet4Addr{}
+	copy(a.IP[:], ip.To4())
+	return a
+}
+
+// routeAddrs returns the addresses and the flags of a route, a host route
+// without netmask
+func routeAddrs(r Route) ([]route.Addr, int, error) {
+	addrs := make([]route.Addr, syscall.RTAX_NETMASK+1)
+	addrs[syscall.RTAX_DST] = inet4(r.Dst.IP)
+	flags := syscall.RTF_UP | syscall.RTF_STATIC
+	if ones, bits := r.Dst.Mask.Size(); ones == bits {
+		flags |= syscall.RTF_HOST
+		addrs = addrs[:syscall.RTAX_GATEWAY+1]
+	} else {
+		addrs[syscall.RTAX_NETMASK] = inet4(net.IP(r.Dst.Mask))
+	}
+	if r.Gateway != nil {
+		flags |= syscall.RTF_GATEWAY
+		addrs[syscall.RTAX_GATEWAY] = inet4(r.Gateway)
+	} else {
+		ifi, err := net.InterfaceByName(r.Dev)
+		if err != nil {
+			return nil, 0, syscall.ENXIO
+		}
+		addrs[syscall.RTAX_GATEWAY] = &route.LinkAddr{Index: ifi.Index, Name: ifi.Name}
+	}
+	return addrs, flags, nil
+}
+
+// Add installs a route, ErrExists when installed the same way and
+// ErrConflict when through another gateway or interface. macOS has neither
+// metrics nor tables, the longest prefix wins.
+func Add(r Route) error {
+	addrs, flags, err := routeAddrs(r)
+	if err == nil {
+		err = send(syscall.RTM_ADD, flags, addrs)
+	}
+	err = wrap("add", r.String(), err)
+	if e, ok := err.(*Error); ok && e.Kind == ErrExists && !installed(r) {
+		e.Kind = ErrConflict
+	}
+	return err
+}
+
+// Delete removes a route of the subnet, only through the gateway when set
+func Delete(r Route) error {
+	addrs := make([]route.Addr, syscall.RTAX_NETMASK+1)
+	addrs[syscall.RTAX_DST] = inet4(r.Dst.IP)
+	flags := 0
+	if ones, bits := r.Dst.Mask.Size(); ones == bits {
+		flags |= syscall.RTF_HOST
+		addrs = addrs[:syscall.RTAX_GATEWAY+1]
+	} else {
+		addrs[syscall.RTAX_NETMASK] = inet4(net.IP(r.Dst.Mask))
+	}
+	if r.Gateway != nil {
+		addrs[syscall.RTAX_GATEWAY] = inet4(r.Gateway)
+	}
+	return wrap("delete", r.String(), send(syscall.RTM_DELETE, flags, addrs))
+}
+
+// installed tells whether the route of the subnet goes the way of r
+func installed(r Route) bool {
+	rib, err := route.FetchRIB(syscall.AF_INET, route.RIBTypeRoute, 0)
+	if err != nil {
+		return false
+	}
+	msgs, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		rm, ok := m.(*route.RouteMessage)
+		if !ok || len(rm.Addrs) <= syscall.RTAX_GATEWAY {
+			continue
+		}
+		dst, ok := rm.Addrs[syscall.RTAX_DST].(*route.Inet4Addr)
+		if !ok || !net.IP(dst.IP[:]).Equal(r.Dst.IP) {
+			continue
+		}
+		mask := r.Dst.Mask
+		if len(rm.Addrs) > syscall.RTAX_NETMASK {
+			if m, ok := rm.Addrs[syscall.RTAX_NETMASK].(*route.Inet4Addr); ok && net.IPMask(m.IP[:]).String() != mask.String() {
+				continue
+			}
+		}
+		var gw net.IP
+		dev := ""
+		switch a := rm.Addrs[syscall.RTAX_GATEWAY].(type) {
+		case *route.Inet4Addr:
+			gw = net.IP(a.IP[:])
+		case *route.LinkAddr:
+			dev = a.Name
+			if ifi, err := net.InterfaceByIndex(a.Index); err == nil {
+				dev = ifi.Name
+			}
+		}
+		return sameRoute(r, gw, dev)
+	}
+	return false
+}
+
+// sockaddr4 is a struct sockaddr_in
+func sockaddr4(b []byte, ip net.IP) {
+	b[0], b[1] = syscall.SizeofSockaddrInet4, syscall.AF_INET
+	copy(b[4:8], ip.To4())
+}
+
+func ioctl(req uintptr, b []byte) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&b[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// AddAddress gives the interface a local address, point to point with peer
+// unless nil
+func AddAddress(dev string, local, peer net.IP) error {
+	if peer == nil {
+		peer = local
+	}
+	// struct ifaliasreq: name, addr, dstaddr, mask
+	b := make([]byte, syscall.IFNAMSIZ+3*syscall.SizeofSockaddrInet4)
+	copy(b, dev)
+	sockaddr4(b[syscall.IFNAMSIZ:], local)
+	sockaddr4(b[syscall.IFNAMSIZ+syscall.SizeofSockaddrInet4:], peer)
+	sockaddr4(b[syscall.IFNAMSIZ+2*syscall.SizeofSockaddrInet4:], net.IPv4bcast)
+	return wrap("address", dev+" "+local.String(), ioctl(syscall.SIOCAIFADDR, b))
+}
+
+// FlushAddresses removes the IPv4 addresses of the interface
+func FlushAddresses(dev string) error {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return wrap("address", dev, syscall.ENXIO)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return wrap("address", dev, err)
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		// struct ifreq with the address
+		b := make([]byte, syscall.IFNAMSIZ+16)
+		copy(b, dev)
+		sockaddr4(b[syscall.IFNAMSIZ:], ipnet.IP)
+		if err := ioctl(syscall.SIOCDIFADDR, b); err != nil {
+			return wrap("address", dev+" "+ipnet.IP.String(), err)
+		}
+	}
+	return nil
+}
+
+// SetLink brings the interface up with the MTU, the transmit queue of a utun
+// isn't configurable
+func SetLink(dev string, mtu, qlen int) error {
+	// struct ifreq: name and a union of 16 bytes
+	b := make([]byte, syscall.IFNAMSIZ+16)
+	copy(b, dev)
+	if mtu > 0 {
+		*(*int32)(unsafe.Pointer(&b[syscall.IFNAMSIZ])) = int32(mtu)
+		if err := ioctl(syscall.SIOCSIFMTU, b); err != nil {
+			return wrap("link", dev, err)
+		}
+	}
+	if err := ioctl(syscall.SIOCGIFFLAGS, b); err != nil {
+		return wrap("link", dev, err)
+	}
+	*(*int16)(unsafe.Pointer(&b[syscall.IFNAMSIZ])) |= syscall.IFF_UP
+	return wrap("link", dev, ioctl(syscall.SIOCSIFFLAGS, b))
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `expose ... portmap` and `expose-tcp <listen> <target> portmap` also ask
+// the router for a port mapping to the listener, so remote peers reach it
+// without configuring the router: NAT-PMP of the default gateway first, then
+// UPnP IGD found by SSDP. The mappings last an hour and are renewed halfway,
+// or are permanent for the routers only doing those, and are deleted once
+// removed from the config and on stop. The external address and ports are in
+// `port_mappings` of `status`.
+const (
+	portMapLifetime = time.Hour
+	portMapEvery    = time.Minute
+	portMapTimeout  = 3 * time.Second
+	natPMPPort      = 5351
+	portMapDesc     = "docker-connector"
+)
+
+// portMapRequests returns the ports of the enabled exposes with `portmap`,
+// and of the listen addresses of `expose-tcp ... portmap`
+func portMapRequests(rules []exposeRule, tcpListens []string) []portMapRequest {
+	var reqs []portMapRequest
+	for _, r := range rules {
+		if !r.enabled || !r.portmap {
+			continue
+		}
+		if ip := net.ParseIP(r.host); ip != nil && ip.IsLoopback() {
+			logger.Warningf("expose %s on loopback, no port mapping\n", r)
+			continue
+		}
+		for port := r.first; port <= r.last; port++ {
+			reqs = append(reqs, portMapRequest{proto: "udp", port: port})
+		}
+	}
+	for _, listen := range tcpListens {
+		host, port, err := net.SplitHostPort(listen)
+		p, perr := strconv.Atoi(port)
+		if err != nil || perr != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			logger.Warningf("expose-tcp %s on loopback, no port mapping\n", listen)
+			continue
+		}
+		reqs = append(reqs, portMapRequest{proto: "tcp", port: p})
+	}
+	return reqs
+}
+
+// portMapRequest is a port of a listener to map
+type portMapRequest struct {
+	proto string
+	port  int
+}
+
+func (r portMapRequest) key() string {
+	return r.proto + " " + strconv.Itoa(r.port)
+}
+
+// PortMapStatus describes a port mapping of the router
+type PortMapStatus struct {
+	Proto    string `json:"proto"`
+	Port     int    `json:"port"`
+	External string `json:"external,omitempty"`
+	Via      string `json:"via,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type portMapping struct {
+	portMapRequest
+	external int
+	via      string
+	// expires is zero for a permanent mapping
+	expires time.Time
+	mapped  bool
+	err     string
+}
+
+type portMapTable struct {
+	sync.Mutex
+	entries  map[string]*portMapping
+	removed  []*portMapping
+	external net.IP
+	igd      *upnpIGD
+	watching bool
+	// syncLock runs one sync at a time, outside of the table lock
+	syncLock sync.Mutex
+}
+
+var portMaps = &portMapTable{entries: make(map[string]*portMapping)}
+
+// Set maps the ports of the config and deletes the others, in the background
+func (t *portMapTable) Set(reqs []portMapRequest) {
+	t.Lock()
+	wanted := make(map[string]portMapRequest)
+	for _, r := range reqs {
+		wanted[r.key()] = r
+	}
+	for key, m := range t.entries {
+		if _, ok := wanted[key]; !ok {
+			delete(t.entries, key)
+			if m.mapped {
+				t.removed = append(t.removed, m)
+			}
+		}
+	}
+	for key, r := range wanted {
+		if _, ok := t.entries[key]; !ok {
+			t.entries[key] = &portMapping{portMapRequest: r}
+		}
+	}
+	start := !t.watching && len(t.entries) > 0
+	t.watching = t.watching || start
+	t.Unlock()
+	if start {
+		go t.watch()
+	}
+	go t.sync()
+}
+
+// watch renews the mappings and retries the failed ones
+func (t *portMapTable) watch() {
+	for range time.Tick(portMapEvery) {
+		t.sync()
+	}
+}
+
+// sync deletes the removed mappings and maps the new, failed or half expired
+// ones
+func (t *portMapTable) sync() {
+	t.syncLock.Lock()
+	defer t.syncLock.Unlock()
+	now := time.Now()
+	t.Lock()
+	removed := t.removed
+	t.removed = nil
+	var due []*portMapping
+	for _, m := range t.entries {
+		if !m.mapped || (!m.expires.IsZero() && m.expires.Sub(now) < portMapLifetime/2) {
+			due = append(due, m)
+		}
+	}
+	t.Unlock()
+	for _, m := range removed {
+		if err := t.unmap(m); err != nil {
+			logExpose.Warningf("[PORTMAP] Failed to delete %s %d: %v", m.proto, m.port, err)
+		} else {
+			logExpose.Infof("[PORTMAP] Deleted %s %d", m.proto, m.port)
+		}
+	}
+	for _, m := range due {
+		external, via, lifetime, err := t.mapPort(m.proto, m.port)
+		t.Lock()
+		if err != nil {
+			if m.err != err.Error() {
+				logExpose.Warningf("[PORTMAP] Failed to map %s %d: %v", m.proto, m.port, err)
+			}
+			m.err = err.Error()
+		} else {
+			if !m.mapped || m.external != external {
+				logExpose.Infof("[PORTMAP] Mapped %s %d to %s:%d by %s", m.proto, m.port, t.external, external, via)
+				events.Add("portmap", "%s %d to %d by %s", m.proto, m.port, external, via)
+			}
+			m.mapped, m.external, m.via, m.err = true, external, via, ""
+			m.expires = time.Time{}
+			if lifetime > 0 {
+				m.expires = time.Now().Add(lifetime)
+			}
+			if t.entries[m.key()] != m {
+				// removed while being mapped
+				t.removed = append(t.removed, m)
+			}
+		}
+		t.Unlock()
+	}
+}
+
+// mapPort asks NAT-PMP then UPnP for a mapping of the same port, returning
+// the external port and the lifetime, 0 for a permanent mapping
+func (t *portMapTable) mapPort(proto string, port int) (int, string, time.Duration, error) {
+	gw, local, err := hostGateway()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	external, lifetime, pmpErr := natPMPMap(gw, proto, port, port, portMapLifetime)
+	if pmpErr == nil {
+		if ip, err := natPMPAddress(gw); err == nil {
+			t.setExternal(ip)
+		}
+		return external, "nat-pmp", lifetime, nil
+	}
+	t.Lock()
+	igd := t.igd
+	t.Unlock()
+	if local == nil {
+		return 0, "", 0, fmt.Errorf("nat-pmp: %v, upnp: no local address", pmpErr)
+	}
+	if igd == nil {
+		if igd, err = discoverIGD(local); err != nil {
+			return 0, "", 0, fmt.Errorf("nat-pmp: %v, upnp: %v", pmpErr, err)
+		}
+		t.Lock()
+		t.igd = igd
+		t.Unlock()
+	}
+	lifetime = portMapLifetime
+	err = igd.addMapping(proto, port, local, lifetime)
+	if code, ok := err.(upnpError); ok && code == 725 {
+		// OnlyPermanentLeasesSupported
+		lifetime = 0
+		err = igd.addMapping(proto, port, local, lifetime)
+	}
+	if err != nil {
+		t.Lock()
+		// discovered again next time, the router may have restarted
+		t.igd = nil
+		t.Unlock()
+		return 0, "", 0, fmt.Errorf("nat-pmp: %v, upnp: %v", pmpErr, err)
+	}
+	if ip, err := igd.externalIP(); err == nil {
+		t.setExternal(ip)
+	}
+	return port, "upnp", lifetime, nil
+}
+
+func (t *portMapTable) setExternal(ip net.IP) {
+	t.Lock()
+	t.external = ip
+	t.Unlock()
+}
+
+// unmap deletes a mapping the way it was made
+func (t *portMapTable) unmap(m *portMapping) error {
+	if m.via == "upnp" {
+		t.Lock()
+		igd := t.igd
+		t.Unlock()
+		if igd == nil {
+			return fmt.Errorf("no upnp gateway")
+		}
+		return igd.deleteMapping(m.proto, m.external)
+	}
+	gw, _, err := hostGateway()
+	if err != nil {
+		return err
+	}
+	_, _, err = natPMPMap(gw, m.proto, m.port, 0, 0)
+	return err
+}
+
+// Close deletes the mappings
+func (t *portMapTable) Close() {
+	t.Lock()
+	for _, m := range t.entries {
+		if m.mapped {
+			t.removed = append(t.removed, m)
+		}
+	}
+	t.entries = make(map[string]*portMapping)
+	t.Unlock()
+	t.sync()
+}
+
+// Status lists the mappings by protocol and port
+func (t *portMapTable) Status() []PortMapStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.entries) == 0 {
+		return nil
+	}
+	list := make([]PortMapStatus, 0, len(t.entries))
+	for _, m := range t.entries {
+		st := PortMapStatus{Proto: m.proto, Port: m.port, Via: m.via, Error: m.err}
+		if m.mapped {
+			st.External = strconv.Itoa(m.external)
+			if t.external != nil {
+				st.External = net.JoinHostPort(t.external.String(), st.External)
+			}
+			if !m.expires.IsZero() {
+				st.Expires = m.expires.Format(time.RFC3339)
+			}
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Proto < list[j].Proto || list[i].Proto == list[j].Proto && list[i].Port < list[j].Port
+	})
+	return list
+}
+
+// natPMPRequest sends a NAT-PMP request to the gateway, retransmitted as of
+// RFC 6886, and returns the successful answer
+func natPMPRequest(gw net.IP, req []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gw, Port: natPMPPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	for wait := 250 * time.Millisecond; wait <= 2*time.Second; wait *= 2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || buf[0] != 0 || buf[1] != req[1]|0x80 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+			return nil, fmt.Errorf("nat-pmp result %d", code)
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("no answer from %s", gw)
+}
+
+// natPMPMap maps the internal port, deleted with a zero lifetime
+func natPMPMap(gw net.IP, proto string, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	op := byte(1)
+	if proto == "tcp" {
+		op = 2
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	rsp, err := natPMPRequest(gw, req)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rsp) < 16 {
+		return 0, 0, fmt.Errorf("short nat-pmp answer")
+	}
+	return int(binary.BigEndian.Uint16(rsp[10:])), time.Duration(binary.BigEndian.Uint32(rsp[12:])) * time.Second, nil
+}
+
+// natPMPAddress returns the external address of the gateway
+func natPMPAddress(gw net.IP) (net.IP, error) {
+	rsp, err := natPMPRequest(gw, []byte{0, 0})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) < 12 {
+		return nil, fmt.Errorf("short nat-pmp answer")
+	}
+	return net.IP(append([]byte(nil), rsp[8:12]...)), nil
+}
+
+// upnpIGD is the WAN connection service of an internet gateway device
+type upnpIGD struct {
+	controlURL string
+	service    string
+}
+
+// upnpError is the errorCode of a failed action
+type upnpError int
+
+func (e upnpError) Error() string {
+	return "upnp error " + strconv.Itoa(int(e))
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// wanService returns the WAN connection service of the device or of its
+// embedded devices
+func (d *upnpDevice) wanService() (string, string) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s.ServiceType, s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if typ, control := d.Devices[i].wanService(); typ != "" {
+			return typ, control
+		}
+	}
+	return "", ""
+}
+
+var (
+	upnpClient    = &http.Client{Timeout: portMapTimeout}
+	upnpErrorCode = regexp.MustCompile(`<errorCode>\s*(\d+)\s*</errorCode>`)
+	upnpExternal  = regexp.MustCompile(`<NewExternalIPAddress>\s*([0-9.]+)\s*</NewExternalIPAddress>`)
+)
+
+// discoverIGD searches the gateway by SSDP from the local address and reads
+// its description
+func discoverIGD(local net.IP) (*upnpIGD, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(portMapTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no gateway found")
+		}
+		rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := rsp.Header.Get("Location")
+		rsp.Body.Close()
+		if location == "" {
+			continue
+		}
+		if igd, err := describeIGD(location); err == nil {
+			return igd, nil
+		}
+	}
+}
+
+func describeIGD(location string) (*upnpIGD, error) {
+	rsp, err := upnpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(rsp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	typ, control := root.Device.wanService()
+	if typ == "" {
+		return nil, fmt.Errorf("no wan connection in %s", location)
+	}
+	base, err := url.Parse(location)
+	if root.URLBase != "" {
+		base, err = url.Parse(root.URLBase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, err := base.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	return &upnpIGD{controlURL: u.String(), service: typ}, nil
+}
+
+// call runs a SOAP action of the service
+func (g *upnpIGD) call(action string, args ...string) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, g.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, "<%s>%s</%s>", args[i], args[i+1], args[i])
+	}
+	fmt.Fprintf(&b, "</u:%s></s:Body></s:Envelope>", action)
+	req, err := http.NewRequest(http.MethodPost, g.controlURL, strings.NewReader(b.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+g.service+"#"+action+`"`)
+	rsp, err := upnpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		if m := upnpErrorCode.FindSubmatch(body); m != nil {
+			code, _ := strconv.Atoi(string(m[1]))
+			return nil, upnpError(code)
+		}
+		return nil, fmt.Errorf("%s: %s", action, rsp.Status)
+	}
+	return body, nil
+}
+
+func (g *upnpIGD) addMapping(proto string, port int, local net.IP, lifetime time.Duration) error {
+	_, err := g.call("AddPortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(port),
+		"NewProtocol", strings.ToUpper(proto),
+		"NewInternalPort", strconv.Itoa(port),
+		"NewInternalClient", local.String(),
+		"NewEnabled", "1",
+		"NewPortMappingDescription", portMapDesc,
+		"NewLeaseDuration", strconv.Itoa(int(lifetime/time.Second)))
+	return err
+}
+
+func (g *upnpIGD) deleteMapping(proto string, port int) error {
+	_, err := g.call("DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(port),
+		"NewProtocol", strings.ToUpper(proto))
+	return err
+}
+
+func (g *upnpIGD) externalIP() (net.IP, error) {
+	body, err := g.call("GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	m := upnpExternal.FindSubmatch(body)
+	if m == nil {
+		return nil, fmt.Errorf("no external address")
+	}
+	return net.ParseIP(string(m[1])), nil
+}
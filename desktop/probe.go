@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `probe <url>` sends an HTTP request to a container straight into the
+// tunnel, with a minimal TCP of its own sourced from the TUN address, and
+// takes the replies out of the tunnel before they reach the TUN. So it works
+// whatever the routes of the OS, which may have been changed by other
+// software. Only plain HTTP over IPv4 is supported.
+const (
+	probeTimeout = 10 * time.Second
+	probeRetry   = time.Second
+	probeWindow  = 65535
+	tcpFIN       = 0x01
+	tcpSYN       = 0x02
+	tcpRST       = 0x04
+	tcpPSH       = 0x08
+	tcpACK       = 0x10
+)
+
+// ProbeResult is the outcome of a probe
+type ProbeResult struct {
+	URL     string `json:"url"`
+	Via     string `json:"via,omitempty"`
+	Connect string `json:"connect,omitempty"`
+	Total   string `json:"total,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Bytes   int    `json:"bytes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// tcpProbe is the TCP connection of a probe
+type tcpProbe struct {
+	src, dst         net.IP
+	sport, dport     uint16
+	sndNxt, rcvNxt   uint32
+	established, fin bool
+	acked            uint32
+	data             bytes.Buffer
+	segments         chan []byte
+}
+
+var (
+	probeLock sync.Mutex
+	probing   int32
+	probes    = make(map[uint16]*tcpProbe)
+)
+
+// deliverProbe takes the packets of the running probes out of the tunnel
+func deliverProbe(packet []byte) bool {
+	if atomic.LoadInt32(&probing) == 0 || len(packet) < 40 || packet[0]>>4 != 4 || packet[9] != 6 {
+		return false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if len(packet) < ihl+20 || !net.IP(packet[16:20]).Equal(localIP) {
+		return false
+	}
+	probeLock.Lock()
+	p := probes[binary.BigEndian.Uint16(packet[ihl+2:])]
+	probeLock.Unlock()
+	if p == nil || !net.IP(packet[12:16]).Equal(p.dst) || binary.BigEndian.Uint16(packet[ihl:]) != p.dport {
+		return false
+	}
+	select {
+	case p.segments <- append([]byte(nil), packet...):
+	default:
+	}
+	return true
+}
+
+// send writes a segment of the probe to the client
+func (p *tcpProbe) send(flags byte, payload []byte) error {
+	peer := shared.Client()
+	if peer == nil {
+		return fmt.Errorf("no client connected")
+	}
+	packet := make([]byte, 40+len(payload))
+	ip, tcp := packet[:20], packet[20:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[4:], uint16(rand.Intn(65536)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], p.src.To4())
+	copy(ip[16:20], p.dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], ^ipSum(ip, 0))
+	binary.BigEndian.PutUint16(tcp[0:], p.sport)
+	binary.BigEndian.PutUint16(tcp[2:], p.dport)
+	binary.BigEndian.PutUint32(tcp[4:], p.sndNxt)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], p.rcvNxt)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], probeWindow)
+	copy(tcp[20:], payload)
+	var pseudo [12]byte
+	copy(pseudo[0:4], ip[12:16])
+	copy(pseudo[4:8], ip[16:20])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], ^ipSum(tcp, ipSum(pseudo[:], 0)))
+	return writePacket(packet, peer)
+}
+
+// receive handles a segment, it returns whether the response is complete
+func (p *tcpProbe) receive(packet []byte) (bool, error) {
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if total > len(packet) || total < ihl+20 {
+		return false, nil
+	}
+	tcp := packet[ihl:total]
+	flags := tcp[13]
+	seq := binary.BigEndian.Uint32(tcp[4:])
+	ack := binary.BigEndian.Uint32(tcp[8:])
+	payload := tcp[int(tcp[12]>>4)*4:]
+	if flags&tcpRST != 0 {
+		return false, fmt.Errorf("connection reset")
+	}
+	if !p.established {
+		if flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK && ack == p.sndNxt {
+			p.established = true
+			p.rcvNxt = seq + 1
+			p.acked = ack
+		}
+		return false, nil
+	}
+	if flags&tcpACK != 0 && int32(ack-p.acked) > 0 {
+		p.acked = ack
+	}
+	if seq == p.rcvNxt {
+		p.data.Write(payload)
+		p.rcvNxt += uint32(len(payload))
+		if flags&tcpFIN != 0 {
+			p.rcvNxt++
+			p.fin = true
+		}
+	}
+	if len(payload) > 0 || flags&tcpFIN != 0 {
+		p.send(tcpACK, nil)
+	}
+	return p.fin, nil
+}
+
+// runProbe requests the URL through the tunnel
+func runProbe(rawURL string) *ProbeResult {
+	res := &ProbeResult{URL: rawURL}
+	start := time.Now()
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "http" {
+		res.Error = "only http urls are supported"
+		return res
+	}
+	dst := net.ParseIP(u.Hostname()).To4()
+	if dst == nil {
+		res.Error = "the host must be an IPv4 address"
+		return res
+	}
+	port := 80
+	if u.Port() != "" {
+		port, _ = strconv.Atoi(u.Port())
+	}
+	cli := shared.Client()
+	if cli == nil {
+		res.Error = "no client connected"
+		return res
+	}
+	res.Via = cli.String()
+	p := &tcpProbe{
+		src:      localIP,
+		dst:      dst,
+		dport:    uint16(port),
+		sndNxt:   rand.Uint32(),
+		segments: make(chan []byte, 256),
+	}
+	probeLock.Lock()
+	for p.sport == 0 || probes[p.sport] != nil {
+		p.sport = uint16(40000 + rand.Intn(20000))
+	}
+	probes[p.sport] = p
+	atomic.AddInt32(&probing, 1)
+	probeLock.Unlock()
+	defer func() {
+		probeLock.Lock()
+		delete(probes, p.sport)
+		atomic.AddInt32(&probing, -1)
+		probeLock.Unlock()
+		if p.established && !p.fin {
+			p.send(tcpRST|tcpACK, nil)
+		}
+	}()
+	path := u.RequestURI()
+	request := []byte(fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: docker-connector-probe\r\nConnection: close\r\n\r\n", path, u.Host))
+	deadline := time.After(probeTimeout)
+	retry := time.NewTicker(probeRetry)
+	defer retry.Stop()
+	iss := p.sndNxt
+	if err := p.send(tcpSYN, nil); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	p.sndNxt++
+	sent := false
+	for {
+		select {
+		case packet := <-p.segments:
+			done, err := p.receive(packet)
+			if err != nil {
+				res.Error = err.Error()
+				return res
+			}
+			if p.established && !sent {
+				res.Connect = time.Since(start).String()
+				p.send(tcpACK|tcpPSH, request)
+				p.sndNxt += uint32(len(request))
+				sent = true
+			}
+			if done {
+				p.send(tcpFIN|tcpACK, nil)
+				p.sndNxt++
+				return p.result(res, start)
+			}
+		case <-retry.C:
+			if !p.established {
+				p.sndNxt = iss
+				p.send(tcpSYN, nil)
+				p.sndNxt++
+			} else if p.acked != p.sndNxt {
+				p.sndNxt -= uint32(len(request))
+				p.send(tcpACK|tcpPSH, request)
+				p.sndNxt += uint32(len(request))
+			}
+		case <-deadline:
+			if !p.established {
+				res.Error = "connect timeout"
+				return res
+			}
+			if p.data.Len() > 0 {
+				return p.result(res, start)
+			}
+			res.Error = "response timeout"
+			return res
+		}
+	}
+}
+
+func (p *tcpProbe) result(res *ProbeResult, start time.Time) *ProbeResult {
+	res.Total = time.Since(start).String()
+	res.Bytes = p.data.Len()
+	rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(p.data.Bytes())), nil)
+	if err != nil {
+		res.Error = fmt.Sprintf("invalid response: %v", err)
+		return res
+	}
+	rsp.Body.Close()
+	res.Status = rsp.Status
+	return res
+}
+
+// serveProbe runs `POST /probe?url=...`
+func serveProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runProbe(r.URL.Query().Get("url")))
+}
+
+// runProbeCommand implements `probe <url>`
+func runProbeCommand() {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s probe [-admin addr] http://<container ip>[:port]/path\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	client := &http.Client{Timeout: probeTimeout + 5*time.Second}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/probe?url=%s", adminAddr, url.QueryEscape(fs.Arg(0))), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid url => %v\n", err)
+		os.Exit(2)
+	}
+	req.Header.Set(adminHeader, "1")
+	rsp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	defer rsp.Body.Close()
+	body, _ := ioutil.ReadAll(rsp.Body)
+	os.Stdout.Write(body)
+	var res ProbeResult
+	if json.Unmarshal(body, &res) != nil || res.Error != "" {
+		os.Exit(1)
+	}
+}
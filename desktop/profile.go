@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The config may hold profiles, the lines after `[profile <name>]` up to the
+// next profile belonging to it and the lines before the first one to all of
+// them, e.g. two projects with overlapping subnets:
+//
+//	profile work
+//	[profile work]
+//	route 172.100.0.0/16
+//	expose-tcp 0.0.0.0:5432 172.100.0.5:5432
+//	[profile personal]
+//	route 172.100.0.0/16 expose
+//	forward tcp 127.0.0.1:8080 172.100.0.9:80
+//
+// Only the lines of the active profile apply, `profile <name>` of the shared
+// lines naming the default one. `docker-connector profile use <name>` switches
+// at runtime, the config being reloaded at once so the routes, hosts and
+// exposes of the old profile make way for the new ones. The choice is kept in
+// the state directory across restarts, `profile use default` forgets it.
+const profileFileName = "desktop-docker-connector.profile"
+
+var (
+	// ProfileFile keeps the profile chosen at runtime
+	ProfileFile    = ""
+	profileSection = regexp.MustCompile(`^\s*\[profile\s+([\w.-]+)\]\s*$`)
+	profileLine    = regexp.MustCompile(`^\s*profile\s+([\w.-]+)\s*$`)
+	// reloadConfig reloads the config under configLock once running
+	reloadConfig func()
+)
+
+// ProfileStatus lists the profiles of the config
+type ProfileStatus struct {
+	Active   string   `json:"active,omitempty"`
+	Default  string   `json:"default,omitempty"`
+	Chosen   string   `json:"chosen,omitempty"`
+	Profiles []string `json:"profiles"`
+}
+
+type profileState struct {
+	sync.Mutex
+	ProfileStatus
+}
+
+var profiles = &profileState{}
+
+// chosenProfile returns the profile chosen at runtime
+func chosenProfile() string {
+	data, err := ioutil.ReadFile(ProfileFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// selectProfile returns the shared lines and those of the active profile
+func selectProfile(lines []string) []string {
+	st := ProfileStatus{Chosen: chosenProfile(), Profiles: []string{}}
+	section := ""
+	for _, line := range lines {
+		if m := profileSection.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			st.Profiles = append(st.Profiles, m[1])
+		} else if m := profileLine.FindStringSubmatch(line); m != nil && section == "" {
+			st.Default = m[1]
+		}
+	}
+	st.Active = st.Default
+	for _, name := range st.Profiles {
+		if name == st.Chosen {
+			st.Active = name
+		}
+	}
+	profiles.Lock()
+	if profiles.Active != st.Active && len(st.Profiles) > 0 {
+		logControl.Infof("[PROFILE] Active profile => %s", st.Active)
+		events.Add("profile", "active %s", st.Active)
+	}
+	profiles.ProfileStatus = st
+	profiles.Unlock()
+	if len(st.Profiles) == 0 {
+		return lines
+	}
+	var selected []string
+	section = ""
+	for _, line := range lines {
+		if m := profileSection.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			continue
+		}
+		if section == "" || section == st.Active {
+			selected = append(selected, line)
+		}
+	}
+	return selected
+}
+
+func (p *profileState) Status() *ProfileStatus {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.Profiles) == 0 {
+		return nil
+	}
+	st := p.ProfileStatus
+	return &st
+}
+
+// useProfile makes a profile active and reloads the config, default going
+// back to the one of the config
+func useProfile(name string) error {
+	if reloadConfig == nil {
+		return fmt.Errorf("no config loaded")
+	}
+	if name == "default" {
+		if err := os.Remove(ProfileFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		found := false
+		if st := profiles.Status(); st != nil {
+			for _, p := range st.Profiles {
+				found = found || p == name
+			}
+		}
+		if !found {
+			return fmt.Errorf("no profile %q in the config", name)
+		}
+		if err := ioutil.WriteFile(ProfileFile, []byte(name+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	reloadConfig()
+	return nil
+}
+
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := useProfile(r.URL.Query().Get("use")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	st := profiles.Status()
+	if st == nil {
+		st = &ProfileStatus{Profiles: []string{}}
+	}
+	writeJSON(w, st)
+}
+
+// runProfileCommand implements `profile [list]` and `profile use <name>`
+func runProfileCommand() {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s profile [-admin addr] [list | use <name|default>]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	var body []byte
+	var err error
+	switch {
+	case fs.NArg() == 0 || fs.NArg() == 1 && fs.Arg(0) == "list":
+		body, err = adminGet("/profile")
+	case fs.NArg() == 2 && fs.Arg(0) == "use":
+		body, err = adminPost("/profile?use="+url.QueryEscape(fs.Arg(1)), "")
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to query %s => %v\n", adminAddr, err)
+		os.Exit(1)
+	}
+	var st ProfileStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		os.Stdout.Write(body)
+		return
+	}
+	for _, name := range st.Profiles {
+		mark := " "
+		if name == st.Active {
+			mark = "*"
+		}
+		fmt.Printf("%s %s\n", mark, name)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// proxySignature starts the header of the PROXY protocol v2
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader returns the PROXY protocol v2 header telling a container the
+// client of a connection, or of a datagram, and the address it reached
+func proxyHeader(proto string, src, dst net.Addr) []byte {
+	srcIP, srcPort := addrIPPort(src)
+	dstIP, dstPort := addrIPPort(dst)
+	family, size := byte(0x10), 12
+	if srcIP.To4() == nil || dstIP.To4() == nil {
+		family, size = 0x20, 36
+	}
+	if proto == "udp" {
+		family |= 0x2
+	} else {
+		family |= 0x1
+	}
+	header := make([]byte, 0, 16+size)
+	header = append(header, proxySignature...)
+	// version 2, PROXY command
+	header = append(header, 0x21, family, byte(size>>8), byte(size))
+	if size == 12 {
+		header = append(header, srcIP.To4()...)
+		header = append(header, dstIP.To4()...)
+	} else {
+		header = append(header, srcIP.To16()...)
+		header = append(header, dstIP.To16()...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], uint16(srcPort))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstPort))
+	return append(header, ports[:]...)
+}
+
+// addrIPPort returns the IP and port of a TCP or UDP address, the unspecified
+// IPv4 address for another one
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a.IP != nil {
+			return a.IP, a.Port
+		}
+		return net.IPv4zero, a.Port
+	case *net.UDPAddr:
+		if a.IP != nil {
+			return a.IP, a.Port
+		}
+		return net.IPv4zero, a.Port
+	}
+	return net.IPv4zero, 0
+}
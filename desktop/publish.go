@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The docker side started with `-publish` pushes `publish <name>:<port>
+// <ip:port> [alias]` for the ports of the containers labeled
+// `desktop-connector.publish`, e.g. `publish web.test:80 172.18.0.5:8080`, and
+// `publish <name>:<port>` once they are gone. With `publish <subnet>` of the
+// loopback, e.g. `publish 127.0.2.0/24`, each name gets an address of the
+// subnet, aliased on the loopback on macOS, whose ports are proxied to the
+// container like `expose-tcp`, and the name is written with the address in a
+// block of the hosts file marked for the connector, so `http://web.test`
+// reaches the container as a local service. A name keeps its address while
+// it has ports, the alias asked by the docker side when in the subnet and
+// free. The block is removed with `publish off` and on stop.
+const (
+	hostsBegin = "# BEGIN docker-connector publish"
+	hostsEnd   = "# END docker-connector publish"
+)
+
+var publishName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// PublishStatus describes a published port of a container
+type PublishStatus struct {
+	Name   string `json:"name"`
+	Listen string `json:"listen,omitempty"`
+	Target string `json:"target"`
+	Active int64  `json:"active"`
+	Total  uint64 `json:"total"`
+	Error  string `json:"error,omitempty"`
+}
+
+type publishedPort struct {
+	name   string
+	port   int
+	target string
+	// alias is the address asked by the docker side, nil without
+	alias  net.IP
+	expose *tcpExpose
+}
+
+type publishTable struct {
+	sync.Mutex
+	subnet *net.IPNet
+	ports  map[string]*publishedPort
+	// aliases are the addresses of the published names
+	aliases map[string]net.IP
+	// hosts is the block last written, unknown before the first write
+	hosts  string
+	synced bool
+}
+
+var publishes = &publishTable{ports: make(map[string]*publishedPort), aliases: make(map[string]net.IP)}
+
+// parsePublish parses the value of `publish`, nil for off
+func parsePublish(val string) (*net.IPNet, error) {
+	if val == "off" {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(val)
+	if err != nil || subnet.IP.To4() == nil || !subnet.IP.IsLoopback() {
+		return nil, fmt.Errorf("expected a subnet of 127.0.0.0/8 or off")
+	}
+	return subnet, nil
+}
+
+// pushedPublish handles a pushed publish line, it returns false for the other
+// lines
+func pushedPublish(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "publish" {
+		return false
+	}
+	i := strings.LastIndex(fields[1], ":")
+	if i < 0 {
+		logExpose.Warningf("[PUBLISH] Invalid port => %s", line)
+		return true
+	}
+	name := strings.ToLower(fields[1][:i])
+	port, err := strconv.Atoi(fields[1][i+1:])
+	if err != nil || port <= 0 || port > 65535 || !publishName.MatchString(name) {
+		logExpose.Warningf("[PUBLISH] Invalid port => %s", line)
+		return true
+	}
+	if len(fields) == 2 {
+		publishes.Push(name, port, "", nil)
+		return true
+	}
+	host, _, err := net.SplitHostPort(fields[2])
+	if err != nil || net.ParseIP(host).To4() == nil {
+		logExpose.Warningf("[PUBLISH] Invalid target => %s", line)
+		return true
+	}
+	var alias net.IP
+	if len(fields) > 3 {
+		alias = net.ParseIP(fields[3]).To4()
+	}
+	publishes.Push(name, port, fields[2], alias)
+	return true
+}
+
+// Push records a port of the docker side, withdrawn without target
+func (t *publishTable) Push(name string, port int, target string, alias net.IP) {
+	t.Lock()
+	defer t.Unlock()
+	key := name + ":" + strconv.Itoa(port)
+	p := t.ports[key]
+	if p != nil && p.target == target && p.alias.Equal(alias) {
+		return
+	}
+	if p != nil {
+		t.unpublish(p)
+		delete(t.ports, key)
+		if target == "" {
+			logExpose.Infof("[PUBLISH] Withdrawn %s => %s", key, p.target)
+			events.Add("publish", "withdrawn %s", key)
+		}
+	}
+	if target != "" {
+		p = &publishedPort{name: name, port: port, target: target, alias: alias}
+		t.ports[key] = p
+		if t.subnet != nil {
+			t.publish(p)
+		}
+	}
+	t.syncHosts()
+}
+
+// Set applies `publish <subnet>|off`, publishing the ports on the addresses
+// of the new subnet or withdrawing them
+func (t *publishTable) Set(subnet *net.IPNet) {
+	t.Lock()
+	defer t.Unlock()
+	if subnet.String() != t.subnet.String() {
+		for _, p := range t.ports {
+			t.unpublish(p)
+		}
+		t.subnet = subnet
+		if subnet != nil {
+			logExpose.Infof("[PUBLISH] Publishing the containers on %s", subnet)
+			for _, p := range t.ports {
+				t.publish(p)
+			}
+		}
+	}
+	t.syncHosts()
+}
+
+// publish listens on the ports of a name on its address
+func (t *publishTable) publish(p *publishedPort) {
+	ip := t.aliasOf(p.name, p.alias)
+	if ip == nil {
+		logExpose.Warningf("[PUBLISH] No address left in %s for %s", t.subnet, p.name)
+		return
+	}
+	p.expose = listenTCPExpose("[PUBLISH]", net.JoinHostPort(ip.String(), strconv.Itoa(p.port)), p.target)
+	events.Add("publish", "%s:%d on %s => %s", p.name, p.port, ip, p.target)
+}
+
+// unpublish closes the listener of a port, and releases the address of its
+// name without other ports
+func (t *publishTable) unpublish(p *publishedPort) {
+	if p.expose == nil {
+		return
+	}
+	p.expose.close()
+	p.expose = nil
+	for _, other := range t.ports {
+		if other.name == p.name && other.expose != nil {
+			return
+		}
+	}
+	if ip := t.aliases[p.name]; ip != nil {
+		if err := delLoopbackAlias(ip); err != nil {
+			logExpose.Warningf("[PUBLISH] Failed to remove the alias %s: %v", ip, err)
+		}
+		delete(t.aliases, p.name)
+	}
+}
+
+// aliasOf returns the address of a name, the asked one or else the first free
+// one of the subnet, aliased on the loopback
+func (t *publishTable) aliasOf(name string, want net.IP) net.IP {
+	if ip := t.aliases[name]; ip != nil {
+		return ip
+	}
+	used := make(map[string]bool)
+	for _, ip := range t.aliases {
+		used[ip.String()] = true
+	}
+	var ip net.IP
+	if want != nil && t.subnet.Contains(want) && !used[want.String()] {
+		ip = want
+	}
+	next, last := append(net.IP(nil), t.subnet.IP.To4()...), lastAddr(t.subnet)
+	for ip == nil {
+		for i := 3; i >= 0; i-- {
+			if next[i]++; next[i] != 0 {
+				break
+			}
+		}
+		if !t.subnet.Contains(next) || next.Equal(last) {
+			return nil
+		}
+		if !used[next.String()] && !next.Equal(net.IPv4(127, 0, 0, 1)) {
+			ip = next
+		}
+	}
+	if err := addLoopbackAlias(ip); err != nil {
+		logExpose.Warningf("[PUBLISH] Failed to alias %s on the loopback: %v", ip, err)
+	}
+	t.aliases[name] = ip
+	return ip
+}
+
+// lastAddr returns the broadcast address of a subnet
+func lastAddr(subnet *net.IPNet) net.IP {
+	ip := append(net.IP(nil), subnet.IP.To4()...)
+	for i := range ip {
+		ip[i] |= ^subnet.Mask[len(subnet.Mask)-4+i]
+	}
+	return ip
+}
+
+// syncHosts writes the published names to the block of the hosts file
+func (t *publishTable) syncHosts() {
+	var lines []string
+	for name, ip := range t.aliases {
+		lines = append(lines, ip.String()+" "+name)
+	}
+	sort.Strings(lines)
+	block := strings.Join(lines, "\n")
+	if t.synced && block == t.hosts {
+		return
+	}
+	if err := writeHostsBlock(lines); err != nil {
+		logExpose.Warningf("[PUBLISH] Failed to update %s: %v", hostsFile, err)
+		return
+	}
+	t.hosts, t.synced = block, true
+}
+
+// writeHostsBlock replaces the block of the connector in the hosts file,
+// removed without lines
+func writeHostsBlock(lines []string) error {
+	data, err := ioutil.ReadFile(hostsFile)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	in := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		switch strings.TrimSpace(line) {
+		case hostsBegin:
+			in = true
+		case hostsEnd:
+			in = false
+		default:
+			if !in {
+				kept = append(kept, strings.TrimRight(line, "\r"))
+			}
+		}
+	}
+	if len(lines) > 0 {
+		kept = append(append(append(kept, hostsBegin), lines...), hostsEnd)
+	}
+	out := strings.Join(kept, hostsNewline) + hostsNewline
+	if out == string(data) {
+		return nil
+	}
+	return ioutil.WriteFile(hostsFile, []byte(out), 0644)
+}
+
+// Status lists the published ports by name
+func (t *publishTable) Status() []PublishStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.ports) == 0 {
+		return nil
+	}
+	list := make([]PublishStatus, 0, len(t.ports))
+	for key, p := range t.ports {
+		st := PublishStatus{Name: key, Target: p.target}
+		if e := p.expose; e != nil {
+			st.Listen, st.Error = e.listen, e.err
+			st.Active, st.Total = atomic.LoadInt64(&e.active), atomic.LoadUint64(&e.total)
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Close withdraws the ports and removes the block of the hosts file
+func (t *publishTable) Close() {
+	t.Set(nil)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Without a client, as right after boot before the first heartbeat of the
+// docker side, the outbound TUN packets are queued with `no-client queue
+// [size] [max-age]`, the default, and flushed to the client once it
+// connects, so the first connection attempt to a container succeeds instead
+// of failing fast. The queue holds `size` packets (64 by default), the oldest
+// being dropped when it is full, for `max-age` (5s by default), after which
+// they are stale, the applications having retried meanwhile. `no-client drop`
+// drops them at once with an ICMP unreachable.
+
+// queueAge bounds how long a packet is kept without client
+var queueAge = 5 * time.Second
+
+type queuedPacket struct {
+	at     time.Time
+	packet []byte
+}
+
+// packetQueue is a bounded queue of outbound TUN packets kept while no client
+// is connected, the oldest packets are dropped when it is full.
+type packetQueue struct {
+	sync.Mutex
+	packets []queuedPacket
+	dropped uint64
+}
+
+var pendingQueue = &packetQueue{}
+
+func (q *packetQueue) Push(packet []byte) {
+	q.Lock()
+	defer q.Unlock()
+	if queueSize <= 0 {
+		q.dropped++
+		return
+	}
+	now := time.Now()
+	q.expire(now)
+	for len(q.packets) >= queueSize {
+		q.packets = q.packets[1:]
+		q.dropped++
+	}
+	q.packets = append(q.packets, queuedPacket{at: now, packet: append([]byte(nil), packet...)})
+}
+
+// expire drops the packets older than queueAge
+func (q *packetQueue) expire(now time.Time) {
+	if queueAge <= 0 {
+		return
+	}
+	i := 0
+	for i < len(q.packets) && now.Sub(q.packets[i].at) > queueAge {
+		i++
+	}
+	q.packets = q.packets[i:]
+	q.dropped += uint64(i)
+}
+
+// Flush hands all queued packets to `write` in order
+func (q *packetQueue) Flush(write func([]byte) error) int {
+	q.Lock()
+	q.expire(time.Now())
+	packets := q.packets
+	q.packets = nil
+	q.Unlock()
+	for i, p := range packets {
+		if err := write(p.packet); err != nil {
+			logTransport.Warningf("[QUEUE] Flush error after %d packets: %v", i, err)
+			return i
+		}
+	}
+	return len(packets)
+}
+
+func (q *packetQueue) Stats() (int, uint64) {
+	q.Lock()
+	defer q.Unlock()
+	q.expire(time.Now())
+	return len(q.packets), q.dropped
+}
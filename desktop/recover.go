@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// restartBackoff is the first delay before restarting a loop that
+	// panicked, doubled at each panic up to restartBackoffMax
+	restartBackoff    = 100 * time.Millisecond
+	restartBackoffMax = 30 * time.Second
+	// restartHealthy resets the backoff of a loop that ran that long
+	restartHealthy = time.Minute
+)
+
+// CrashStatus reports the panics of a forwarding loop
+type CrashStatus struct {
+	Panics int       `json:"panics"`
+	Last   string    `json:"last"`
+	At     time.Time `json:"at"`
+}
+
+var (
+	crashes   = make(map[string]*CrashStatus)
+	crashLock sync.Mutex
+)
+
+// supervise runs the loop until it returns, restarting it with backoff when
+// it panics, so a malformed packet or a driver hiccup can't silently stop one
+// direction of the tunnel.
+func supervise(ctx context.Context, name string, loop func()) {
+	backoff := restartBackoff
+	for {
+		start := time.Now()
+		if !runLoop(name, loop) || ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > restartHealthy {
+			backoff = restartBackoff
+		}
+		logger.Warningf("[RECOVER] Restarting %s in %v", name, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > restartBackoffMax {
+			backoff = restartBackoffMax
+		}
+	}
+}
+
+// runLoop runs the loop and returns whether it panicked
+func runLoop(name string, loop func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			crashLock.Lock()
+			s, ok := crashes[name]
+			if !ok {
+				s = &CrashStatus{}
+				crashes[name] = s
+			}
+			s.Panics++
+			s.Last = fmt.Sprint(r)
+			s.At = time.Now()
+			crashLock.Unlock()
+			logger.Errorf("[RECOVER] %s panicked: %v\n%s", name, r, debug.Stack())
+		}
+	}()
+	loop()
+	return false
+}
+
+// crashStatus returns a copy of the panics per loop
+func crashStatus() map[string]CrashStatus {
+	crashLock.Lock()
+	defer crashLock.Unlock()
+	if len(crashes) == 0 {
+		return nil
+	}
+	m := make(map[string]CrashStatus, len(crashes))
+	for name, s := range crashes {
+		m[name] = *s
+	}
+	return m
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kardianos/service"
+)
+
+// Releases ship a manifest of the SHA-256 of their files, as printed by
+// `shasum -a 256`, and its minisign signature next to the binary:
+//
+//	manifest.txt
+//	manifest.txt.minisig
+//
+// The public key of the releases is embedded at build time with
+// `-ldflags "-X main.releaseKey=RW..."`. Only the legacy (non-prehashed)
+// signatures of `minisign -S -l` are supported.
+const manifestName = "manifest.txt"
+
+var (
+	releaseKey = ""
+	// allowUnsigned lets install and update go on without a valid manifest
+	allowUnsigned = false
+	releaseState  atomic.Value
+)
+
+// ReleaseStatus is the verification of the running binary
+type ReleaseStatus struct {
+	Verified bool   `json:"verified"`
+	KeyID    string `json:"key_id,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// releaseStatus returns the verification done at startup
+func releaseStatus() *ReleaseStatus {
+	st, _ := releaseState.Load().(*ReleaseStatus)
+	return st
+}
+
+// checkRelease verifies the running binary for the status
+func checkRelease() {
+	exe, err := os.Executable()
+	if err != nil {
+		releaseState.Store(&ReleaseStatus{Error: err.Error()})
+		return
+	}
+	st := verifyRelease(exe)
+	if st.Verified {
+		logger.Infof("[RELEASE] %s verified by key %s: %s", exe, st.KeyID, st.Comment)
+	} else {
+		logger.Warningf("[RELEASE] %s not verified: %s", exe, st.Error)
+	}
+	releaseState.Store(st)
+}
+
+// parseReleaseKey decodes a minisign public key, the base64 line of the
+// key file
+func parseReleaseKey(s string) (uint64, ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid release key: %v", err)
+	}
+	if len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return 0, nil, fmt.Errorf("invalid release key")
+	}
+	return binary.LittleEndian.Uint64(b[2:10]), ed25519.PublicKey(b[10:]), nil
+}
+
+// verifySignature checks the minisign signature of the data, it returns the
+// trusted comment
+func verifySignature(data, minisig []byte, key string) (uint64, string, error) {
+	id, pub, err := parseReleaseKey(key)
+	if err != nil {
+		return 0, "", err
+	}
+	lines := strings.Split(strings.Replace(string(minisig), "\r\n", "\n", -1), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return id, "", fmt.Errorf("invalid signature file")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return id, "", fmt.Errorf("invalid signature")
+	}
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		return id, "", fmt.Errorf("prehashed signature, sign with `minisign -S -l`")
+	default:
+		return id, "", fmt.Errorf("unknown signature algorithm %q", sig[:2])
+	}
+	if binary.LittleEndian.Uint64(sig[2:10]) != id {
+		return id, "", fmt.Errorf("signed by key %016X, not %016X", binary.LittleEndian.Uint64(sig[2:10]), id)
+	}
+	if !ed25519.Verify(pub, data, sig[10:]) {
+		return id, "", fmt.Errorf("bad signature")
+	}
+	comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || !ed25519.Verify(pub, append(append([]byte(nil), sig[10:]...), comment...), global) {
+		return id, "", fmt.Errorf("bad trusted comment signature")
+	}
+	return id, comment, nil
+}
+
+// manifestSum returns the SHA-256 of the named file in the manifest
+func manifestSum(manifest []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyRelease checks the binary against the signed manifest next to it
+func verifyRelease(path string) *ReleaseStatus {
+	st := &ReleaseStatus{}
+	if releaseKey == "" {
+		st.Error = "no release key in this build"
+		return st
+	}
+	dir := filepath.Dir(path)
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	minisig, err := ioutil.ReadFile(filepath.Join(dir, manifestName+".minisig"))
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	id, comment, err := verifySignature(manifest, minisig, releaseKey)
+	st.KeyID = fmt.Sprintf("%016X", id)
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.Comment = comment
+	want, ok := manifestSum(manifest, filepath.Base(path))
+	if !ok {
+		st.Error = fmt.Sprintf("%s not in the manifest", filepath.Base(path))
+		return st
+	}
+	got, err := fileSum(path)
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	if got != want {
+		st.Error = fmt.Sprintf("sha256 %s of %s differs from the manifest", got, filepath.Base(path))
+		return st
+	}
+	st.Verified = true
+	return st
+}
+
+// requireRelease exits unless the binary is verified or unsigned ones are
+// allowed
+func requireRelease(path string) {
+	st := verifyRelease(path)
+	if st.Verified {
+		logger.Infof("[RELEASE] %s verified by key %s: %s", path, st.KeyID, st.Comment)
+		return
+	}
+	if allowUnsigned {
+		logger.Warningf("[RELEASE] %s not verified, allowed: %s", path, st.Error)
+		return
+	}
+	logger.Fatalf("[RELEASE] %s not verified: %s, use -allow-unsigned to go on", path, st.Error)
+}
+
+// runUpdate replaces the running binary by a verified release and restarts
+// the service
+func runUpdate(s service.Service) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	fs.BoolVar(&allowUnsigned, "allow-unsigned", allowUnsigned, "update without a valid signed manifest")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s update [-allow-unsigned] <extracted release binary>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	installRelease(fs.Arg(0))
+	if status, err := s.Status(); err == nil && status == service.StatusRunning {
+		s.Stop()
+		if err := s.Start(); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("Restart Service Success!")
+	}
+}
+
+// installRelease replaces the running binary by a verified release, keeping
+// the previous one
+func installRelease(src string) {
+	exe, err := os.Executable()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if filepath.Base(src) != filepath.Base(exe) {
+		logger.Fatalf("[RELEASE] %s is not a release of %s", src, filepath.Base(exe))
+	}
+	requireRelease(src)
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	tmp := exe + ".new"
+	if err := ioutil.WriteFile(tmp, data, 0755); err != nil {
+		logger.Fatal(err)
+	}
+	// a running binary can be renamed but not overwritten on windows
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(tmp)
+		logger.Fatal(err)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Rename(old, exe)
+		logger.Fatal(err)
+	}
+	for _, name := range []string{manifestName, manifestName + ".minisig"} {
+		if b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(src), name)); err == nil {
+			ioutil.WriteFile(filepath.Join(filepath.Dir(exe), name), b, 0644)
+		}
+	}
+	logger.Infof("[RELEASE] Updated %s, previous binary kept as %s", exe, old)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// Changing `host`, `port` or `addr` in the config applies on reload, without
+// restarting the service: the UDP socket is bound to the new address and
+// swapped under the loop, which goes on reading from it, and the TUN is given
+// the new addresses with the routes via the new peer. The docker side must
+// follow with the same `-port` or `-addr`. `expose` binds the sockets of the
+// new or enabled mappings and closes the ones removed or turned off.
+
+// portSetting is the configured port, the bound one may be an alternate
+var portSetting int
+
+// reloadListener binds the tunnel to `host` and the port, keeping the current
+// socket when it fails
+func reloadListener(oldHost string, newPort int) {
+	if conn == nil {
+		return
+	}
+	guestMode = host == "guest"
+	if host == "guest" {
+		// the address facing the host, as on start
+		if _, local, err := hostGateway(); err == nil && local != nil {
+			host = local.String()
+		} else {
+			host = oldHost
+		}
+	}
+	if host == hostWSL {
+		if ip := wslAddress(); ip != nil {
+			wslMode = true
+			host = ip.String()
+		} else {
+			host = oldHost
+		}
+	}
+	if host == oldHost && newPort == port {
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, newPort))
+	var c *net.UDPConn
+	if err == nil {
+		c, err = listenUDP(udpAddr)
+	}
+	if err != nil {
+		logControl.Errorf("[RELOAD] Failed to listen %s:%d, keeping %v: %v", host, newPort, conn.LocalAddr(), err)
+		host = oldHost
+		return
+	}
+	old, oldWriter := conn, writer
+	conn, port = c, newPort
+	writer = startWriter(c)
+	if tos := atomic.LoadInt32(&dscpTOS); tos >= 0 {
+		markSocket(c, int(tos))
+	}
+	oldWriter.Close()
+	// the UDP loop switches to the new socket once the old one is closed
+	old.Close()
+	writePidFile()
+	logControl.Warningf("[RELOAD] Listening on %v instead of %v, start the docker side with -host and -port %d", c.LocalAddr(), old.LocalAddr(), newPort)
+}
+
+// reloadAddr gives the TUN the addresses of `addr`, keeping the current ones
+// when it fails
+func reloadAddr(iface tunDevice, oldAddr string) {
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil || ip.To4() == nil {
+		logControl.Errorf("[RELOAD] Invalid addr %s, keeping %s", addr, oldAddr)
+		addr = oldAddr
+		return
+	}
+	local := net.IP(make([]byte, 4))
+	copy(local, ip.To4())
+	local[3]++
+	if bind && iface != nil {
+		if err := readdress(iface.Name(), localIP, local, ip, ipnet); err != nil {
+			logControl.Errorf("[RELOAD] Failed to change the addresses of %s, keeping %s: %v", iface.Name(), oldAddr, err)
+			addr = oldAddr
+			return
+		}
+	}
+	peer, subnet = ip, ipnet
+	copy(localIP, local)
+	if bind {
+		for key := range shared.Routes() {
+			delRoute(key)
+			addRoute(key, peer)
+		}
+	}
+	logControl.Warningf("[RELOAD] Virtual network %s => %s, start the docker side with -addr %s", oldAddr, addr, addr)
+}
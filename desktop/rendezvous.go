@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// When both sides are behind NATs, e.g. the desktop at home and the docker
+// side on a cloud VM, `docker-connector rendezvous` runs on a host both reach
+// and the sides are started with `-rendezvous host:2520`. Each registers its
+// public address under `-rendezvous-session`, the server tells each the address
+// of the other and both punch a hole sending to it. When the punch fails, e.g.
+// behind symmetric NATs, the docker side sends to the server instead and the
+// server relays the datagrams between the registered addresses.
+//
+// `-mode relay` runs the server as the connector, listening on `-host` and
+// `-port`, and with `-relay-only` the sides skip the punch and always go
+// through it. With `-relay-secret` the registrations are signed like the
+// knocks and the server only relays between the addresses registered with
+// the secret.
+//
+//	0xF0 | role | session   register, role 'd' for the desktop, 'k' docker
+//	0xF1 | address          the public address of the other side
+//	0xF2                    punch
+//	0xF3                    punch answered
+//	0xF4 | role | timestamp(8) | hmac-sha256(secret, role | timestamp | session) | session
+//	                        signed register
+const (
+	rendezvousRegister = 0xF0
+	rendezvousPeer     = 0xF1
+	rendezvousPunch    = 0xF2
+	rendezvousAck      = 0xF3
+	rendezvousSigned   = 0xF4
+	rendezvousDesktop  = 'd'
+	rendezvousDocker   = 'k'
+	// rendezvousEvery keeps the registration and the NAT mapping alive
+	rendezvousEvery = 15 * time.Second
+	punchCount      = 10
+	punchEvery      = 200 * time.Millisecond
+	rendezvousIdle  = 5 * time.Minute
+	modeConnector   = "connector"
+	modeRelay       = "relay"
+)
+
+var (
+	rendezvous        = ""
+	rendezvousSession = "default"
+	rendezvousAddr    *net.UDPAddr
+	relayOnly         = false
+	relaySecret       = ""
+	runMode           = modeConnector
+)
+
+// sameUDPAddr compares addresses, IPv4 and IPv4-mapped alike
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// startRendezvous registers the desktop from the tunnel socket
+func startRendezvous(ctx context.Context) {
+	server, err := net.ResolveUDPAddr("udp", rendezvous)
+	if err != nil {
+		logger.Errorf("[RENDEZVOUS] Invalid server %s: %v", rendezvous, err)
+		return
+	}
+	rendezvousAddr = server
+	logger.Infof("[RENDEZVOUS] Registering session %q to %v", rendezvousSession, server)
+	go func() {
+		ticker := time.NewTicker(rendezvousEvery)
+		defer ticker.Stop()
+		for {
+			if _, err := conn.WriteToUDP(rendezvousRegistration(rendezvousDesktop), server); err != nil {
+				logger.Warningf("[RENDEZVOUS] Failed to register to %v: %v", server, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// handleRendezvous handles the datagrams of the rendezvous, telling whether
+// the datagram was one
+func handleRendezvous(data []byte, from *net.UDPAddr) bool {
+	if rendezvousAddr == nil || len(data) == 0 {
+		return false
+	}
+	switch {
+	case data[0] == rendezvousPeer && sameUDPAddr(from, rendezvousAddr):
+		target, err := net.ResolveUDPAddr("udp", string(data[1:]))
+		if err != nil {
+			logger.Warningf("[RENDEZVOUS] Invalid docker side address %q", data[1:])
+			return true
+		}
+		if relayOnly {
+			logger.Debugf("[RENDEZVOUS] Docker side at %v, relayed", target)
+			return true
+		}
+		logger.Debugf("[RENDEZVOUS] Docker side at %v, punching", target)
+		go punchHole(target)
+		return true
+	case data[0] == rendezvousPunch && len(data) == 1:
+		logger.Debugf("[RENDEZVOUS] Punch from %v", from)
+		if _, err := conn.WriteToUDP([]byte{rendezvousAck}, from); err != nil {
+			logger.Warningf("[RENDEZVOUS] Failed to answer the punch of %v: %v", from, err)
+		}
+		return true
+	case data[0] == rendezvousAck && len(data) == 1:
+		logger.Infof("[RENDEZVOUS] Direct path to %v open", from)
+		return true
+	}
+	return false
+}
+
+// punchHole sends punches to the docker side, opening the NAT of the desktop
+// to its datagrams
+func punchHole(target *net.UDPAddr) {
+	for i := 0; i < punchCount; i++ {
+		if _, err := conn.WriteToUDP([]byte{rendezvousPunch}, target); err != nil {
+			logger.Debugf("[RENDEZVOUS] Failed to punch %v: %v", target, err)
+			return
+		}
+		time.Sleep(punchEvery)
+	}
+}
+
+// rendezvousRegistration returns the registration of a side, signed with
+// `relaySecret` if set
+func rendezvousRegistration(role byte) []byte {
+	if relaySecret == "" {
+		return append([]byte{rendezvousRegister, role}, rendezvousSession...)
+	}
+	msg := make([]byte, 10, 10+sha256.Size+len(rendezvousSession))
+	msg[0], msg[1] = rendezvousSigned, role
+	binary.BigEndian.PutUint64(msg[2:], uint64(time.Now().UnixNano()))
+	msg = append(msg, knockMAC(relaySecret, append(msg[1:10:10], rendezvousSession...))...)
+	return append(msg, rendezvousSession...)
+}
+
+// parseRegistration returns the role, the session and the timestamp of a
+// registration, a zero role if the datagram is none
+func parseRegistration(data []byte, secret string) (byte, string, int64, error) {
+	switch {
+	case len(data) > 2 && data[0] == rendezvousRegister:
+		if secret != "" {
+			return data[1], "", 0, errors.New("unsigned")
+		}
+		return data[1], string(data[2:]), 0, nil
+	case len(data) > 10+sha256.Size && data[0] == rendezvousSigned:
+		session := data[10+sha256.Size:]
+		ts := int64(binary.BigEndian.Uint64(data[2:10]))
+		if secret == "" {
+			return data[1], string(session), ts, nil
+		}
+		signed := append(append([]byte(nil), data[1:10]...), session...)
+		if !hmac.Equal(data[10:10+sha256.Size], knockMAC(secret, signed)) {
+			return data[1], "", 0, errors.New("bad signature")
+		}
+		if d := time.Since(time.Unix(0, ts)); d > knockSkew || d < -knockSkew {
+			return data[1], "", 0, fmt.Errorf("stale, skew %v", d)
+		}
+		return data[1], string(session), ts, nil
+	}
+	return 0, "", 0, nil
+}
+
+// rendezvousPair is a session of the server, the addresses of the desktop and
+// the docker side
+type rendezvousPair struct {
+	addrs [2]*net.UDPAddr
+	// stamps are the timestamps of the last signed registrations, replays
+	// are dropped
+	stamps [2]int64
+	seen   time.Time
+}
+
+// serveRendezvous runs the server introducing the sides and relaying their
+// datagrams until the context is done
+func serveRendezvous(ctx context.Context, listen string, idle time.Duration) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	logger.Infof("[RENDEZVOUS] Listening on %v, signed registrations %v", pc.LocalAddr(), relaySecret != "")
+	pairs := make(map[string]*rendezvousPair)
+	byAddr := make(map[string]*rendezvousPair)
+	swept := time.Now()
+	data := make([]byte, 65536)
+	for {
+		n, from, err := pc.ReadFromUDP(data)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.Warningf("[RENDEZVOUS] Failed to read: %v", err)
+			continue
+		}
+		now := time.Now()
+		if now.Sub(swept) > time.Minute {
+			swept = now
+			for name, p := range pairs {
+				if now.Sub(p.seen) > idle {
+					logger.Infof("[RENDEZVOUS] Session %q expired", name)
+					for _, a := range p.addrs {
+						if a != nil {
+							delete(byAddr, a.String())
+						}
+					}
+					delete(pairs, name)
+				}
+			}
+		}
+		if r, name, ts, err := parseRegistration(data[:n], relaySecret); err != nil {
+			logger.Warningf("[RENDEZVOUS] Rejected registration from %v: %v", from, err)
+			continue
+		} else if r != 0 {
+			role := 0
+			switch r {
+			case rendezvousDesktop:
+			case rendezvousDocker:
+				role = 1
+			default:
+				continue
+			}
+			p := pairs[name]
+			if p == nil {
+				p = &rendezvousPair{}
+				pairs[name] = p
+			}
+			if relaySecret != "" {
+				if ts <= p.stamps[role] {
+					logger.Warningf("[RENDEZVOUS] Rejected registration from %v: replayed", from)
+					continue
+				}
+				p.stamps[role] = ts
+			}
+			p.seen = now
+			changed := !sameUDPAddr(p.addrs[role], from)
+			if changed {
+				if old := p.addrs[role]; old != nil {
+					delete(byAddr, old.String())
+				}
+				logger.Infof("[RENDEZVOUS] Session %q %c => %v", name, r, from)
+				p.addrs[role] = from
+				byAddr[from.String()] = p
+			}
+			other := p.addrs[1-role]
+			if other == nil {
+				continue
+			}
+			pc.WriteToUDP(append([]byte{rendezvousPeer}, other.String()...), from)
+			if changed {
+				pc.WriteToUDP(append([]byte{rendezvousPeer}, from.String()...), other)
+			}
+			continue
+		}
+		// relay between the registered addresses
+		p := byAddr[from.String()]
+		if p == nil {
+			logger.Debugf("[RENDEZVOUS] Dropped %d bytes from unregistered %v", n, from)
+			continue
+		}
+		p.seen = now
+		to := p.addrs[0]
+		if sameUDPAddr(to, from) {
+			to = p.addrs[1]
+		}
+		if to == nil {
+			continue
+		}
+		if _, err := pc.WriteToUDP(data[:n], to); err != nil {
+			logger.Debugf("[RENDEZVOUS] Failed to relay to %v: %v", to, err)
+		}
+	}
+}
+
+// runRendezvous implements `rendezvous`, the server without the service
+func runRendezvous() {
+	fs := flag.NewFlagSet("rendezvous", flag.ExitOnError)
+	listen := fs.String("listen", ":2520", "udp listen address")
+	idle := fs.Duration("idle", rendezvousIdle, "idle time expiring the sessions")
+	level := fs.String("log-level", logLevel, "log level")
+	fs.StringVar(&relaySecret, "relay-secret", relaySecret, "shared secret signing the registrations")
+	fs.Parse(os.Args[2:])
+	setLogLevels(*level, "", true)
+	setSecret("-relay-secret", &relaySecret, relaySecret, true)
+	if err := serveRendezvous(context.Background(), *listen, *idle); err != nil {
+		logger.Fatalf("[RENDEZVOUS] Failed to listen %s: %v", *listen, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A `-cli` given as a name, e.g. of a dynamic DNS, is resolved on start, then
+// again every `-resolve-every`, on a change of the network and after a failed
+// send, at most once per resolveMin. The client moves to the new address once
+// the name resolves to another one, a datagram of the docker side from
+// another source still taking it over as before.
+const resolveMin = 5 * time.Second
+
+var (
+	resolveEvery = time.Minute
+	// resolveNow asks for a resolution
+	resolveNow = make(chan struct{}, 1)
+	// resolvedCli is the last address of the name of `-cli`
+	resolvedCli  *net.UDPAddr
+	resolvedLock sync.Mutex
+)
+
+// resolveSoon asks for a resolution of `-cli` after a failed send
+func resolveSoon() {
+	if cliAddr != "" && net.ParseIP(cliHost()) == nil {
+		signalChange(resolveNow)
+	}
+}
+
+// cliHost returns the host of `-cli`
+func cliHost() string {
+	h, _, err := net.SplitHostPort(cliAddr)
+	if err != nil {
+		return cliAddr
+	}
+	return h
+}
+
+// resolveClient resolves the name of `-cli`, moving the client when it points
+// to another address
+func resolveClient() {
+	if cliAddr == "" || net.ParseIP(cliHost()) != nil {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", cliAddr)
+	if err != nil {
+		logTransport.Warningf("[CLIENT] Failed to resolve the configured peer %s: %v", cliAddr, err)
+		return
+	}
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+	if resolvedCli == nil && sameUDPAddr(addr, shared.Client()) || sameUDPAddr(addr, resolvedCli) {
+		resolvedCli = addr
+		return
+	}
+	resolvedCli = addr
+	logTransport.Infof("[CLIENT] Configured peer %s now at %v", cliAddr, addr)
+	events.Add("client", "%s resolved to %v", cliAddr, addr)
+	shared.SetClient(addr)
+}
+
+// watchResolve resolves `-cli` again every `-resolve-every` and when asked
+func watchResolve(ctx context.Context) {
+	var last time.Time
+	for {
+		var every <-chan time.Time
+		if resolveEvery > 0 {
+			every = time.After(resolveEvery)
+		}
+		select {
+		case <-every:
+		case <-resolveNow:
+			if wait := resolveMin - time.Since(last); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+		last = time.Now()
+		resolveClient()
+	}
+}
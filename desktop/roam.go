@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// The heartbeats of a docker side knowing the sessions carry its id:
+//
+//	0 | t1 | echoT1 | t4 | features | session(8)
+//
+// which it sends once the replies tell the desktop knows them. While the
+// session is alive, a heartbeat with its id from another address moves the
+// client there without a change of client, and a heartbeat of another
+// session or data from an unknown address is dropped instead of taking the
+// client over, the unknown address being asked for a heartbeat with its
+// session. A session ends with the client dead. Docker sides without sessions
+// keep the last source.
+const (
+	sessionLen     = 8
+	sessionRequest = connector.SessionRequest
+	// desktopSessions flags the replies to the heartbeats
+	desktopSessions = 1
+	// sessionRequestEvery bounds the requests to an unknown address
+	sessionRequestEvery = time.Second
+)
+
+type clientSession struct {
+	sync.Mutex
+	name string
+	id   uint64
+	// addr is the address of the session, empty without session
+	addr      string
+	roams     uint64
+	rejected  uint64
+	lastWarn  time.Time
+	requested map[string]time.Time
+}
+
+// ClientSessionStatus is the session of the client
+type ClientSessionStatus struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	Roams    uint64 `json:"roams"`
+	Rejected uint64 `json:"rejected"`
+}
+
+var (
+	dataSession = &clientSession{name: "data", requested: make(map[string]time.Time)}
+	ctlSession  = &clientSession{name: "control", requested: make(map[string]time.Time)}
+)
+
+// heartbeatSession returns the session of a heartbeat, 0 without
+func heartbeatSession(data []byte) uint64 {
+	if len(data) < heartbeatLen+1+sessionLen {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data[heartbeatLen+1:])
+}
+
+// isHeartbeat tells whether a datagram of type 0 and length n is a heartbeat
+func isHeartbeat(n int) bool {
+	switch n {
+	case 1, heartbeatLen, heartbeatLen + 1, heartbeatLen + 1 + sessionLen, heartbeatLen + 1 + sessionLen + identityLen:
+		return true
+	}
+	return false
+}
+
+// Heartbeat tells whether the heartbeat of a session from an address is
+// accepted, and whether the session moved to it. alive is false once the
+// client is dead, when another session may take over.
+func (s *clientSession) Heartbeat(id uint64, from *net.UDPAddr, alive bool) (bool, bool) {
+	s.Lock()
+	defer s.Unlock()
+	addr := from.String()
+	if id == 0 && s.addr != "" && s.addr != addr && alive {
+		// maybe the client, not knowing yet the desktop knows the sessions
+		return false, false
+	}
+	if id == 0 {
+		s.id, s.addr = 0, ""
+		return true, false
+	}
+	if s.id != 0 && s.id != id && alive {
+		s.rejected++
+		if time.Since(s.lastWarn) >= time.Minute {
+			s.lastWarn = time.Now()
+			logTransport.Warningf("[SESSION] Heartbeat of session %016x from %v rejected, session %016x of %s is alive", id, from, s.id, s.addr)
+		}
+		return false, false
+	}
+	roamed := s.id == id && s.addr != "" && s.addr != addr
+	if roamed {
+		s.roams++
+		logTransport.Infof("[SESSION] Session %016x moved from %s to %s (%s)", id, s.addr, addr, s.name)
+	} else if s.id != id {
+		logTransport.Infof("[SESSION] Session %016x => %s (%s)", id, addr, s.name)
+	}
+	s.id, s.addr = id, addr
+	delete(s.requested, addr)
+	return true, roamed
+}
+
+// Data tells whether a datagram other than a heartbeat is accepted from an
+// address, it is without session or from its address. With the docker side
+// pinned it takes the address of a session.
+func (s *clientSession) Data(from *net.UDPAddr) bool {
+	pinned := pins.Active()
+	s.Lock()
+	defer s.Unlock()
+	return s.addr == "" && !pinned || s.addr == from.String()
+}
+
+// Request asks an unknown address for a heartbeat, once a second at most
+func (s *clientSession) Request(c *net.UDPConn, from *net.UDPAddr) {
+	s.Lock()
+	addr := from.String()
+	now := time.Now()
+	if at, ok := s.requested[addr]; ok && now.Sub(at) < sessionRequestEvery {
+		s.Unlock()
+		return
+	}
+	if len(s.requested) >= 64 {
+		s.requested = make(map[string]time.Time)
+	}
+	s.requested[addr] = now
+	s.Unlock()
+	logTransport.Debugf("[SESSION] Data from unknown %v, asking for a heartbeat", from)
+	c.WriteToUDP([]byte{sessionRequest}, from)
+}
+
+// End ends the session with the client dead
+func (s *clientSession) End() {
+	s.Lock()
+	defer s.Unlock()
+	if s.id != 0 {
+		logTransport.Infof("[SESSION] Session %016x ended (%s)", s.id, s.name)
+	}
+	s.id, s.addr = 0, ""
+}
+
+// Status reports the session, nil without
+func (s *clientSession) Status() *ClientSessionStatus {
+	s.Lock()
+	defer s.Unlock()
+	if s.id == 0 {
+		return nil
+	}
+	return &ClientSessionStatus{ID: fmt.Sprintf("%016x", s.id), Addr: s.addr, Roams: s.roams, Rejected: s.rejected}
+}
+
+// sessionStatus reports the session of the data socket, or of the control
+// socket with `control-port`
+func sessionStatus() *ClientSessionStatus {
+	if s := dataSession.Status(); s != nil {
+		return s
+	}
+	return ctlSession.Status()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// `route add 172.30.0.0/16 [expose]` and `route del 172.30.0.0/16` change the
+// routes of the running service through `POST /route?op=add&route=...` of
+// the admin API: the route is installed or removed right away and written to
+// the config, which the watcher then reloads without further change.
+func serveRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	_, ipnet, err := net.ParseCIDR(q.Get("route"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid route %q", q.Get("route")), http.StatusBadRequest)
+		return
+	}
+	key, expose := ipnet.String(), q.Get("expose") == "true"
+	var res *BatchResult
+	switch q.Get("op") {
+	case "add":
+		if ex := excluded(key, routeExcludes); ex != nil {
+			http.Error(w, fmt.Sprintf("route %s overlaps exclude %s", key, ex), http.StatusBadRequest)
+			return
+		}
+		res = applyBatch([]BatchOp{{Op: "add_route", Route: key, Expose: expose}})
+	case "del":
+		res = applyBatch([]BatchOp{{Op: "remove_route", Route: key}})
+	default:
+		http.Error(w, fmt.Sprintf("invalid op %q, expecting add or del", q.Get("op")), http.StatusBadRequest)
+		return
+	}
+	if !res.Applied {
+		http.Error(w, res.Error, http.StatusBadRequest)
+		return
+	}
+	add := q.Get("op") == "add"
+	configLock.Lock()
+	if add && bind && !conflicts.Allow(scanConflicts(), key) {
+		add = false
+	} else {
+		installRoute(key, expose, add)
+	}
+	configLock.Unlock()
+	logger.Infof("[ADMIN] Route %s %s => installed %v", q.Get("op"), key, add)
+	res.Routes, _ = configRoutes()
+	writeJSON(w, res)
+}
+
+// runRouteCommand implements `route add|del <subnet> [expose]`
+func runRouteCommand() {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	fs.StringVar(&adminAddr, "admin", adminAddr, "admin api listen address")
+	fs.Parse(os.Args[2:])
+	op, route := fs.Arg(0), fs.Arg(1)
+	if (op != "add" && op != "del") || route == "" {
+		fmt.Fprintln(os.Stderr, "usage: docker-connector route add|del <subnet> [expose]")
+		os.Exit(2)
+	}
+	q := url.Values{"op": {op}, "route": {route}}
+	if fs.Arg(2) == "expose" {
+		q.Set("expose", "true")
+	}
+	body, err := adminPost("/route?"+q.Encode(), "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to %s route %s => %v\n", op, route, err)
+		os.Exit(1)
+	}
+	var res BatchResult
+	if err := json.Unmarshal(body, &res); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid response => %v\n", err)
+		os.Exit(1)
+	}
+	for _, r := range res.Routes {
+		state := "enabled"
+		if !r.Enabled {
+			state = "disabled"
+		}
+		if r.Expose {
+			state += ", expose"
+		}
+		fmt.Printf("%-20s %s\n", r.Route, state)
+	}
+}
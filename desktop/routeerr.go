@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	sysroutes "docker-connector/pkg/routes"
+)
+
+// A route the system refused stays in the `route_errors` of `status` with the
+// kind of the error, permission, conflict, not-found or error, until it is
+// installed or removed from the config, and fires `on-route-error` once per
+// kind.
+
+// RouteError is a route the system refused
+type RouteError struct {
+	Op     string `json:"op"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Since  string `json:"since"`
+}
+
+type routeErrorTable struct {
+	sync.Mutex
+	errors map[string]RouteError
+}
+
+var routeErrors = &routeErrorTable{errors: make(map[string]RouteError)}
+
+// Fail records the error of an operation on a route
+func (t *routeErrorTable) Fail(key, op string, err error) {
+	kind := sysroutes.KindOf(err)
+	logRoutes.Warningf("[ROUTE] %s %s failed (%s): %v", op, key, kind, err)
+	t.Lock()
+	old, seen := t.errors[key]
+	e := RouteError{Op: op, Kind: kind, Detail: err.Error(), Since: old.Since}
+	if !seen || old.Kind != kind {
+		e.Since = time.Now().Format(time.RFC3339)
+	}
+	t.errors[key] = e
+	t.Unlock()
+	if !seen || old.Kind != kind {
+		hooks.Fire(hookRouteError, "CONNECTOR_ROUTE="+key, "CONNECTOR_ERROR="+kind, "CONNECTOR_ERROR_DETAIL="+err.Error())
+	}
+}
+
+// Clear forgets the error of a route installed or removed
+func (t *routeErrorTable) Clear(key string) {
+	t.Lock()
+	delete(t.errors, key)
+	t.Unlock()
+}
+
+// Failed describes the routes among the keys the system refused to add
+func (t *routeErrorTable) Failed(keys []string) []string {
+	t.Lock()
+	defer t.Unlock()
+	var failed []string
+	for _, key := range keys {
+		if e, ok := t.errors[key]; ok && e.Op == "add" {
+			failed = append(failed, fmt.Sprintf("route %s: %s", key, e.Detail))
+		}
+	}
+	return failed
+}
+
+func (t *routeErrorTable) Status() map[string]RouteError {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.errors) == 0 {
+		return nil
+	}
+	list := make(map[string]RouteError, len(t.errors))
+	for key, e := range t.errors {
+		list[key] = e
+	}
+	return list
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every health check of 30s the routes installed through the TUN are looked
+// up in the routes of the system, and the ones removed, or taken over by
+// another interface, e.g. by a VPN client or a change of network, are
+// installed again. Each repair is logged as a warning, so kept in the events,
+// and counted in the `route_repairs` of `status`. The routes of another table
+// than the main one are left to the `ip rule` of the system.
+
+// RouteRepairStatus counts the routes installed again
+type RouteRepairStatus struct {
+	Total  uint64            `json:"total"`
+	Routes map[string]uint64 `json:"routes"`
+	Last   string            `json:"last,omitempty"`
+}
+
+type routeRepairTable struct {
+	sync.Mutex
+	total  uint64
+	routes map[string]uint64
+	last   time.Time
+}
+
+var routeRepairs = &routeRepairTable{routes: make(map[string]uint64)}
+
+// Add counts a repair of a route
+func (t *routeRepairTable) Add(key string) {
+	t.Lock()
+	defer t.Unlock()
+	t.total++
+	t.routes[key]++
+	t.last = time.Now()
+}
+
+// Status reports the repairs, nil before the first one
+func (t *routeRepairTable) Status() *RouteRepairStatus {
+	t.Lock()
+	defer t.Unlock()
+	if t.total == 0 {
+		return nil
+	}
+	st := &RouteRepairStatus{Total: t.total, Routes: make(map[string]uint64, len(t.routes)), Last: t.last.Format(time.RFC3339)}
+	for key, n := range t.routes {
+		st.Routes[key] = n
+	}
+	return st
+}
+
+// ownRoute tells whether a route of the system goes through the TUN, or the
+// TUN of a route
+func ownRoute(r systemRoute, ifname string) bool {
+	return r.dev == ifname || r.dev == localIP.String() || routeTUNs.Owns(r.dev)
+}
+
+// verifyRoutes installs again the routes of the TUN missing from the system
+// or going through another interface
+func verifyRoutes(ifname string) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	if !bind || len(installedOptions) == 0 {
+		return
+	}
+	own, other := make(map[string]bool), make(map[string]string)
+	for _, r := range systemRoutes() {
+		if ownRoute(r, ifname) {
+			own[r.net.String()] = true
+		} else {
+			other[r.net.String()] = r.dev
+		}
+	}
+	var keys []string
+	for key, opt := range installedOptions {
+		if shared.HasRoute(key) && opt.table == 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, ipnet, err := net.ParseCIDR(key)
+		if err != nil || own[ipnet.String()] {
+			continue
+		}
+		if dev, ok := other[ipnet.String()]; ok {
+			logRoutes.Warningf("[ROUTE] Route %s taken over by %s, installing it again", key, dev)
+		} else {
+			logRoutes.Warningf("[ROUTE] Route %s removed by the system, installing it again", key)
+		}
+		delRoute(key)
+		addRoute(key, peer)
+		routeRepairs.Add(key)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A route may carry a metric and, on linux, a routing table after its
+// subnet, so it deliberately wins or loses against the routes of a VPN
+// covering the same subnet:
+//
+//	route 172.18.0.0/16 metric 50
+//	route 10.0.0.0/8 expose metric 900 table 100
+//
+// The lower metric wins on linux and windows, macOS only goes by the
+// longest prefix and ignores it. A route of another table is only used
+// through an `ip rule` of the system. A route whose options change on reload
+// is installed again.
+type routeOption struct {
+	metric, table int
+}
+
+func (o routeOption) String() string {
+	s := ""
+	if o.metric > 0 {
+		s += fmt.Sprintf(" metric %d", o.metric)
+	}
+	if o.table > 0 {
+		s += fmt.Sprintf(" table %d", o.table)
+	}
+	return s
+}
+
+var (
+	// routeOptions are the options of the routes of the config
+	routeOptions = make(map[string]routeOption)
+	// installedOptions are the options the routes were installed with
+	installedOptions = make(map[string]routeOption)
+)
+
+// parseRouteOptions parses what follows the subnet of a `route` line, the
+// protocols apart since they don't need the route installed again
+func parseRouteOptions(fields []string) (opt routeOption, protos protoSet, expose bool, ok bool) {
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "expose":
+			expose = true
+		case "proto":
+			if i+1 >= len(fields) {
+				return routeOption{}, protoSet{}, false, false
+			}
+			s, err := parseProtos(fields[i+1])
+			if err != nil {
+				return routeOption{}, protoSet{}, false, false
+			}
+			protos = s
+			i++
+		case "metric", "table":
+			if i+1 >= len(fields) {
+				return routeOption{}, protoSet{}, false, false
+			}
+			v, err := strconv.Atoi(fields[i+1])
+			if err != nil || v <= 0 {
+				return routeOption{}, protoSet{}, false, false
+			}
+			if fields[i] == "metric" {
+				opt.metric = v
+			} else {
+				opt.table = v
+			}
+			i++
+		default:
+			return routeOption{}, protoSet{}, false, false
+		}
+	}
+	return opt, protos, expose, true
+}
+
+// routeOptionsStatus lists the routes with options
+func routeOptionsStatus() map[string]string {
+	if len(installedOptions) == 0 {
+		return nil
+	}
+	list := make(map[string]string)
+	for key, opt := range installedOptions {
+		list[key] = opt.String()[1:]
+	}
+	return list
+}
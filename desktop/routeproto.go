@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A route may restrict the protocols forwarded to and from its subnet, e.g.
+//
+//	route 172.19.0.0/16 proto tcp,icmp
+//
+// so only what the containers need reaches them. The packets of another
+// protocol are dropped in both directions, the most specific route of the
+// address deciding, and the outbound ones answered with an ICMP
+// administratively prohibited. The routes without `proto` forward everything.
+type protoSet [4]uint64
+
+func (s *protoSet) add(p int)      { s[p/64] |= 1 << uint(p%64) }
+func (s protoSet) Has(p byte) bool { return s[p/64]&(1<<uint(p%64)) != 0 }
+func (s protoSet) Empty() bool     { return s == protoSet{} }
+func (s protoSet) String() string {
+	var names []string
+	for p := 0; p < 256; p++ {
+		if s.Has(byte(p)) {
+			names = append(names, protoName(byte(p)))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseProtos parses a comma separated list of protocols, names or numbers
+func parseProtos(val string) (protoSet, error) {
+	var s protoSet
+	for _, name := range strings.Split(val, ",") {
+		switch name {
+		case "icmp":
+			s.add(1)
+		case "tcp":
+			s.add(6)
+		case "udp":
+			s.add(17)
+		default:
+			v, err := strconv.Atoi(name)
+			if err != nil || v < 0 || v > 255 {
+				return protoSet{}, fmt.Errorf("invalid protocol %q", name)
+			}
+			s.add(v)
+		}
+	}
+	return s, nil
+}
+
+type protoRule struct {
+	subnet *net.IPNet
+	protos protoSet
+}
+
+type protoTable struct {
+	sync.Mutex
+	// rules are sorted by decreasing prefix length
+	rules   []protoRule
+	dropped map[string]*uint64
+}
+
+var routeProtos = &protoTable{}
+
+// Set replaces the protocols of the routes
+func (t *protoTable) Set(protos map[string]protoSet) {
+	var rules []protoRule
+	for key, s := range protos {
+		if _, subnet, err := net.ParseCIDR(key); err == nil {
+			rules = append(rules, protoRule{subnet: subnet, protos: s})
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, _ := rules[i].subnet.Mask.Size()
+		b, _ := rules[j].subnet.Mask.Size()
+		return a > b
+	})
+	t.Lock()
+	defer t.Unlock()
+	dropped := make(map[string]*uint64, len(rules))
+	for _, r := range rules {
+		key := r.subnet.String()
+		if n := t.dropped[key]; n != nil {
+			dropped[key] = n
+		} else {
+			dropped[key] = new(uint64)
+		}
+	}
+	t.rules, t.dropped = rules, dropped
+}
+
+// Allow tells whether a packet to or from an address may be forwarded
+func (t *protoTable) Allow(ip net.IP, proto byte) bool {
+	t.Lock()
+	defer t.Unlock()
+	for _, r := range t.rules {
+		if !r.subnet.Contains(ip) {
+			continue
+		}
+		if r.protos.Has(proto) {
+			return true
+		}
+		atomic.AddUint64(t.dropped[r.subnet.String()], 1)
+		return false
+	}
+	return true
+}
+
+// RouteProtoStatus describes the protocols of a route
+type RouteProtoStatus struct {
+	Protocols string `json:"protocols"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// Status lists the routes restricting the protocols
+func (t *protoTable) Status() map[string]RouteProtoStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.rules) == 0 {
+		return nil
+	}
+	list := make(map[string]RouteProtoStatus, len(t.rules))
+	for _, r := range t.rules {
+		key := r.subnet.String()
+		list[key] = RouteProtoStatus{Protocols: r.protos.String(), Dropped: atomic.LoadUint64(t.dropped[key])}
+	}
+	return list
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// With `tun-per-route on` every route gets a TUN of its own instead of
+// sharing the one of the virtual network, so the firewall rules, the tcpdump
+// filters and the MTUs may differ by docker network:
+//
+//	tun-per-route on
+//	tun-mtu 172.18.0.0/16 9000
+//
+// The TUN of a route carries the local address and the route goes straight
+// to the interface. Its packets take the same way as those of the main TUN,
+// and the packets of the docker side are written to the TUN of the route
+// covering their source. TAP mode and the network extension keep the single
+// TUN, as does a route whose TUN can't be created.
+type routeTUN struct {
+	dev    tunDevice
+	subnet *net.IPNet
+	mtu    int
+	done   chan struct{}
+}
+
+type routeTUNTable struct {
+	sync.RWMutex
+	tuns map[string]*routeTUN
+	// start reads the packets of a TUN until done is closed
+	start func(dev tunDevice, done chan struct{})
+}
+
+var (
+	tunPerRoute = false
+	// tunMTUs are the MTUs of the TUNs of the routes, MTU otherwise
+	tunMTUs   = make(map[string]int)
+	routeTUNs = &routeTUNTable{tuns: make(map[string]*routeTUN)}
+)
+
+// parseTunMTU parses `tun-mtu <subnet> <mtu>`
+func parseTunMTU(fields []string) (string, int, bool) {
+	if len(fields) != 2 {
+		return "", 0, false
+	}
+	_, subnet, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		return "", 0, false
+	}
+	mtu, err := strconv.Atoi(fields[1])
+	if err != nil || mtu < 576 || mtu > 65535 {
+		return "", 0, false
+	}
+	return subnet.String(), mtu, true
+}
+
+// closed tells whether done is closed, never for nil
+func closed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Start reads the TUNs opened so far and those to come
+func (t *routeTUNTable) Start(start func(dev tunDevice, done chan struct{})) {
+	t.Lock()
+	defer t.Unlock()
+	t.start = start
+	for _, r := range t.tuns {
+		start(r.dev, r.done)
+	}
+}
+
+// Open returns the name of the TUN of the route, created on the first call,
+// or "" when the route goes through the main TUN
+func (t *routeTUNTable) Open(key string) string {
+	if !tunPerRoute || tapMode {
+		return ""
+	}
+	_, subnet, err := net.ParseCIDR(key)
+	if err != nil {
+		return ""
+	}
+	t.Lock()
+	defer t.Unlock()
+	if r, ok := t.tuns[key]; ok {
+		return r.dev.Name()
+	}
+	mtu := tunMTUs[key]
+	if mtu == 0 {
+		mtu = MTU
+	}
+	dev, err := setupRouteTUN(len(t.tuns), mtu)
+	if err != nil {
+		logTransport.Warningf("[TUN] No TUN for %s, using the main one: %v", key, err)
+		return ""
+	}
+	r := &routeTUN{dev: dev, subnet: subnet, mtu: mtu, done: make(chan struct{})}
+	t.tuns[key] = r
+	logTransport.Infof("[TUN] %s => %s mtu %d", key, dev.Name(), mtu)
+	if t.start != nil {
+		t.start(r.dev, r.done)
+	}
+	return dev.Name()
+}
+
+// Close removes the TUN of the route
+func (t *routeTUNTable) Close(key string) {
+	t.Lock()
+	defer t.Unlock()
+	r, ok := t.tuns[key]
+	if !ok {
+		return
+	}
+	delete(t.tuns, key)
+	close(r.done)
+	if err := r.dev.Close(); err != nil {
+		logTransport.Warningf("[TUN] Failed to close %s of %s: %v", r.dev.Name(), key, err)
+	}
+	logTransport.Infof("[TUN] %s closed", key)
+}
+
+// For returns the TUN a packet of the docker side is written to, the TUN of
+// the route covering its source or the main one
+func (t *routeTUNTable) For(packet []byte, main tunDevice) tunDevice {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return main
+	}
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.tuns) == 0 {
+		return main
+	}
+	src := net.IP(packet[12:16])
+	var best *routeTUN
+	bits := -1
+	for _, r := range t.tuns {
+		// the longest prefix wins, as with the routes
+		if ones, _ := r.subnet.Mask.Size(); ones > bits && r.subnet.Contains(src) {
+			best, bits = r, ones
+		}
+	}
+	if best == nil {
+		return main
+	}
+	return best.dev
+}
+
+// Owns tells whether the interface is the TUN of a route
+func (t *routeTUNTable) Owns(name string) bool {
+	t.RLock()
+	defer t.RUnlock()
+	for _, r := range t.tuns {
+		if r.dev.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh applies the MTUs changed by a reload
+func (t *routeTUNTable) Refresh() {
+	t.Lock()
+	defer t.Unlock()
+	for key, r := range t.tuns {
+		mtu := tunMTUs[key]
+		if mtu == 0 {
+			mtu = MTU
+		}
+		if mtu == r.mtu {
+			continue
+		}
+		if err := setMTU(r.dev.Name(), mtu); err != nil {
+			logTransport.Warningf("[TUN] Failed to set the MTU of %s to %d: %v", r.dev.Name(), mtu, err)
+			continue
+		}
+		logTransport.Infof("[TUN] %s => %s mtu %d", key, r.dev.Name(), mtu)
+		r.mtu = mtu
+	}
+}
+
+// RouteTUNStatus is a TUN of a route in the status
+type RouteTUNStatus struct {
+	Route     string `json:"route"`
+	Interface string `json:"interface"`
+	MTU       int    `json:"mtu"`
+}
+
+func (t *routeTUNTable) Status() []RouteTUNStatus {
+	t.RLock()
+	defer t.RUnlock()
+	var list []RouteTUNStatus
+	for key, r := range t.tuns {
+		list = append(list, RouteTUNStatus{Route: key, Interface: r.dev.Name(), MTU: r.mtu})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Route < list[j].Route })
+	return list
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The connector was made for Docker Desktop, whose VM reaches the loopback of
+// the desktop as `host.docker.internal`. Other runtimes run the containers in
+// a VM of their own, with another name of the desktop and other default
+// networks:
+//
+//	docker-desktop   host.docker.internal      docker   172.17.0.0/16
+//	colima           host.lima.internal        docker   172.17.0.0/16
+//	rancher-desktop  host.lima.internal        docker   172.17.0.0/16
+//	podman           192.168.127.254           podman   10.88.0.0/16
+//
+// `-runtime auto` detects the runtime through the docker or podman CLI and,
+// without config file, routes its default network. `docker-connector runtime`
+// prints the runtime and the command starting the agent in its VM, `-deploy`
+// runs it. In a Podman machine the agent is a systemd unit of the VM, pushing
+// the networks of netavark or CNI, 192.168.127.254 being the loopback of the
+// desktop in the network of gvproxy.
+const (
+	runtimeAuto           = "auto"
+	runtimeDockerDesktop  = "docker-desktop"
+	runtimeColima         = "colima"
+	runtimeRancherDesktop = "rancher-desktop"
+	runtimePodman         = "podman"
+	agentImage            = "wenjunxiao/desktop-docker-connector"
+	agentName             = "desktop-connector"
+)
+
+// containerRuntime is how to reach the VM of a runtime and the agent in it
+type containerRuntime struct {
+	name string
+	// desktop is the name of the desktop in the VM
+	desktop string
+	// cli runs the containers of the runtime
+	cli string
+	// subnet is the default network of the containers
+	subnet string
+}
+
+var (
+	runtimeName = ""
+
+	runtimes = map[string]*containerRuntime{
+		runtimeDockerDesktop:  {runtimeDockerDesktop, "host.docker.internal", "docker", "172.17.0.0/16"},
+		runtimeColima:         {runtimeColima, "host.lima.internal", "docker", "172.17.0.0/16"},
+		runtimeRancherDesktop: {runtimeRancherDesktop, "host.lima.internal", "docker", "172.17.0.0/16"},
+		runtimePodman:         {runtimePodman, "192.168.127.254", "podman", "10.88.0.0/16"},
+	}
+)
+
+// cliOutput runs a command of a runtime CLI and returns its trimmed output
+func cliOutput(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// detectRuntime finds the runtime serving the docker or podman CLI
+func detectRuntime() (*containerRuntime, error) {
+	if info, err := cliOutput("docker", "info", "--format", "{{.OperatingSystem}}|{{.Name}}"); err == nil {
+		endpoint, _ := cliOutput("docker", "context", "inspect", "--format", "{{.Endpoints.docker.Host}}")
+		if host := os.Getenv("DOCKER_HOST"); host != "" {
+			endpoint = host
+		}
+		lower := strings.ToLower(info + "|" + endpoint)
+		switch {
+		case strings.Contains(lower, "docker desktop"):
+			return runtimes[runtimeDockerDesktop], nil
+		case strings.Contains(lower, "colima"):
+			return runtimes[runtimeColima], nil
+		case strings.Contains(lower, "rancher-desktop") || strings.Contains(lower, ".rd/"):
+			return runtimes[runtimeRancherDesktop], nil
+		case strings.Contains(lower, "podman"):
+			return runtimes[runtimePodman], nil
+		}
+		return nil, fmt.Errorf("unknown runtime of docker => %s", info)
+	}
+	if _, err := cliOutput("podman", "machine", "inspect"); err == nil {
+		return runtimes[runtimePodman], nil
+	}
+	return nil, fmt.Errorf("neither docker nor a podman machine answers")
+}
+
+// resolveRuntime returns the runtime of `-runtime`, nil without
+func resolveRuntime(name string) (*containerRuntime, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case runtimeAuto:
+		return detectRuntime()
+	}
+	if rt := runtimes[name]; rt != nil {
+		return rt, nil
+	}
+	return nil, fmt.Errorf("unknown runtime %q", name)
+}
+
+// agentArgs returns the arguments of the agent
+func (rt *containerRuntime) agentArgs() []string {
+	args := []string{"-host", rt.desktop}
+	if port != 2511 {
+		args = append(args, "-port", fmt.Sprint(port))
+	}
+	if addr != "192.168.251.1/24" {
+		args = append(args, "-addr", addr)
+	}
+	return args
+}
+
+// agentCommand returns the command starting the agent in the VM
+func (rt *containerRuntime) agentCommand() []string {
+	args := []string{rt.cli, "run", "-d", "--restart", "always", "--net", "host", "--cap-add", "NET_ADMIN"}
+	return append(append(args, "--name", agentName, agentImage), rt.agentArgs()...)
+}
+
+// podmanUnit returns the systemd unit of the agent in a Podman machine
+func (rt *containerRuntime) podmanUnit() string {
+	return fmt.Sprintf(`[Unit]
+Description=Desktop Docker Connector agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Restart=always
+RestartSec=5
+ExecStartPre=/usr/bin/mkdir -p /etc/containers/networks /etc/cni/net.d
+ExecStartPre=-/usr/bin/podman rm -f %s
+ExecStart=/usr/bin/podman run --rm --name %s --net host --cap-add NET_ADMIN --device /dev/net/tun \
+    -v /etc/containers/networks:/etc/containers/networks:ro -v /etc/cni/net.d:/etc/cni/net.d:ro \
+    docker.io/%s %s -chain FORWARD -push-routes
+ExecStop=/usr/bin/podman stop -t 10 %s
+
+[Install]
+WantedBy=multi-user.target
+`, agentName, agentName, agentImage, strings.Join(rt.agentArgs(), " "), agentName)
+}
+
+// deployPodman installs and starts the unit of the agent in the machine
+func (rt *containerRuntime) deployPodman() error {
+	cmd := exec.Command("podman", "machine", "ssh", "sudo tee /etc/systemd/system/"+agentName+".service")
+	cmd.Stdin = strings.NewReader(rt.podmanUnit())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	cmd = exec.Command("podman", "machine", "ssh", "sudo systemctl daemon-reload && sudo systemctl enable --now "+agentName)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// runtimeDefaults routes the default network of `-runtime` without config
+func runtimeDefaults() {
+	rt, err := resolveRuntime(runtimeName)
+	if err != nil {
+		logger.Warningf("[RUNTIME] %v", err)
+		return
+	}
+	if rt == nil {
+		return
+	}
+	logger.Infof("[RUNTIME] %s, start the agent with -host %s", rt.name, rt.desktop)
+	if len(shared.Routes()) == 0 {
+		configLock.Lock()
+		installRoute(rt.subnet, false, true)
+		configLock.Unlock()
+	}
+}
+
+// runRuntimeCommand implements `runtime [-deploy]`
+func runRuntimeCommand() {
+	fs := flag.NewFlagSet("runtime", flag.ExitOnError)
+	name := fs.String("runtime", runtimeAuto, "runtime: auto, docker-desktop, colima, rancher-desktop or podman")
+	deploy := fs.Bool("deploy", false, "start the agent in the VM, replacing a running one")
+	fs.IntVar(&port, "port", port, "udp listen port")
+	fs.StringVar(&addr, "addr", addr, "virtual network address")
+	fs.Parse(os.Args[2:])
+	rt, err := resolveRuntime(*name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	args := rt.agentCommand()
+	fmt.Printf("runtime => %s\n", rt.name)
+	fmt.Printf("route   => %s\n", rt.subnet)
+	if rt.name == runtimePodman {
+		fmt.Printf("agent   => systemd unit %s of the machine\n", agentName)
+		fmt.Println("note    => the agent needs a rootful machine: podman machine set --rootful")
+		if !*deploy {
+			fmt.Print(rt.podmanUnit())
+		} else if err := rt.deployPodman(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start the agent => %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Printf("agent   => %s\n", strings.Join(args, " "))
+	if !*deploy {
+		return
+	}
+	exec.Command(rt.cli, "rm", "-f", agentName).Run()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start the agent => %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Schedules enable or disable routes, or pause the tunnel, at the minutes
+// matching a cron expression:
+//
+//	schedule <minute> <hour> <day> <month> <weekday> enable|disable <route>
+//	schedule <minute> <hour> <day> <month> <weekday> pause|resume
+//
+// The state of a target is given by its latest event within a week, so it
+// is enforced right away after a restart or a reload.
+const scheduleLookback = 7 * 24 * 60
+
+type cronSpec struct {
+	text                     string
+	min, hour, dom, mon, dow uint64
+	domAny, dowAny           bool
+}
+
+type scheduleEntry struct {
+	spec   *cronSpec
+	action string
+	target string
+}
+
+type scheduler struct {
+	sync.Mutex
+	entries  []scheduleEntry
+	disabled map[string]bool
+	paused   int32
+}
+
+var schedules = &scheduler{disabled: make(map[string]bool)}
+
+// ScheduleEvent is an upcoming scheduled change
+type ScheduleEvent struct {
+	At     time.Time `json:"at"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Cron   string    `json:"cron"`
+}
+
+// ScheduleStatus reports the scheduled state and the next changes
+type ScheduleStatus struct {
+	Paused   bool            `json:"paused"`
+	Disabled []string        `json:"disabled,omitempty"`
+	Upcoming []ScheduleEvent `json:"upcoming,omitempty"`
+}
+
+// parseCronField parses a field of comma separated `*`, `n`, `a-b`, each with
+// an optional `/step`, into a bit mask
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			v, err := strconv.Atoi(part[i+1:])
+			if err != nil || v <= 0 {
+				return 0, fmt.Errorf("invalid step %s", part)
+			}
+			step = v
+			part = part[:i]
+		}
+		from, to := lo, hi
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			v, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %s", part)
+			}
+			from, to = v, v
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %s", part)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%s out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func parseCron(fields []string) (*cronSpec, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 cron fields")
+	}
+	s := &cronSpec{text: strings.Join(fields, " "), domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	if s.min, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.mon, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// Match returns whether the minute of t matches, the day matches either the
+// day of month or the weekday when both are restricted, as cron does.
+func (s *cronSpec) Match(t time.Time) bool {
+	if s.min&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.mon&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// parseSchedule parses the value of a `schedule` directive
+func parseSchedule(val string) (scheduleEntry, error) {
+	var e scheduleEntry
+	fields := strings.Fields(val)
+	if len(fields) < 6 {
+		return e, fmt.Errorf("expected cron expression and action")
+	}
+	spec, err := parseCron(fields[:5])
+	if err != nil {
+		return e, err
+	}
+	e.spec = spec
+	e.action = fields[5]
+	switch e.action {
+	case "enable", "disable":
+		if len(fields) != 7 {
+			return e, fmt.Errorf("%s needs a route", e.action)
+		}
+		e.target = fields[6]
+	case "pause", "resume":
+		if len(fields) != 6 {
+			return e, fmt.Errorf("%s takes no target", e.action)
+		}
+	default:
+		return e, fmt.Errorf("invalid action %s", e.action)
+	}
+	return e, nil
+}
+
+// Set replaces the entries and applies the state they give at this minute
+func (s *scheduler) Set(entries []scheduleEntry) {
+	s.Lock()
+	s.entries = entries
+	s.Unlock()
+	s.apply(time.Now())
+}
+
+// state returns the action of the latest event of the target, or "" if none
+// happened within the lookback.
+func (s *scheduler) state(target string, now time.Time) string {
+	t := now.Truncate(time.Minute)
+	for i := 0; i < scheduleLookback; i++ {
+		for _, e := range s.entries {
+			if e.target == target && e.spec.Match(t) {
+				return e.action
+			}
+		}
+		t = t.Add(-time.Minute)
+	}
+	return ""
+}
+
+// apply computes the scheduled state, and returns whether the routes changed
+func (s *scheduler) apply(now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	disabled := make(map[string]bool)
+	paused := false
+	seen := make(map[string]bool)
+	for _, e := range s.entries {
+		if seen[e.target] {
+			continue
+		}
+		seen[e.target] = true
+		switch s.state(e.target, now) {
+		case "disable":
+			disabled[e.target] = true
+		case "pause":
+			paused = true
+		}
+	}
+	if paused != s.Paused() {
+		logger.Infof("[SCHEDULE] Tunnel %s", map[bool]string{true: "paused", false: "resumed"}[paused])
+		if paused {
+			atomic.StoreInt32(&s.paused, 1)
+		} else {
+			atomic.StoreInt32(&s.paused, 0)
+		}
+	}
+	changed := len(disabled) != len(s.disabled)
+	for route := range disabled {
+		if !s.disabled[route] {
+			logger.Infof("[SCHEDULE] Route %s disabled", route)
+			changed = true
+		}
+	}
+	for route := range s.disabled {
+		if !disabled[route] {
+			logger.Infof("[SCHEDULE] Route %s enabled", route)
+		}
+	}
+	s.disabled = disabled
+	return changed
+}
+
+// Disabled returns whether the route is disabled by the schedule
+func (s *scheduler) Disabled(route string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.disabled[route]
+}
+
+// Paused returns whether the tunnel is paused by the schedule
+func (s *scheduler) Paused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+// Run applies the schedule every minute and calls reload when the routes
+// changed
+func (s *scheduler) Run(ctx context.Context, reload func()) {
+	for {
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+		if s.apply(time.Now()) {
+			reload()
+		}
+	}
+}
+
+func (s *scheduler) Status() *ScheduleStatus {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.entries) == 0 {
+		return nil
+	}
+	st := &ScheduleStatus{Paused: s.Paused()}
+	for route := range s.disabled {
+		st.Disabled = append(st.Disabled, route)
+	}
+	sort.Strings(st.Disabled)
+	start := time.Now().Truncate(time.Minute).Add(time.Minute)
+	for _, e := range s.entries {
+		t := start
+		for i := 0; i < scheduleLookback; i++ {
+			if e.spec.Match(t) {
+				st.Upcoming = append(st.Upcoming, ScheduleEvent{At: t, Action: e.action, Target: e.target, Cron: e.spec.text})
+				break
+			}
+			t = t.Add(time.Minute)
+		}
+	}
+	sort.Slice(st.Upcoming, func(i, j int) bool { return st.Upcoming[i].At.Before(st.Upcoming[j].At) })
+	return st
+}
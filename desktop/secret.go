@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// The secrets, `wireguard`, `control-secret`, the secret of `knock` and
+// `-relay-secret`, can be kept out of the config: `file:<path>` reads the
+// secret from a file, `keychain:<service>[/<account>]` from the keychain of
+// the system, the login keychain on macOS, the Credential Manager on windows,
+// the generic credential named service, and the secret service with
+// secret-tool on linux, e.g.
+//
+//	control-secret file:/etc/docker-connector/control.secret
+//	wireguard keychain:docker-connector/wireguard
+//
+// The secrets of the config but the wireguard key are read again as it is
+// reloaded, so a rotated one applies without restarting, the old one being
+// kept when it can't be read.
+
+// resolveSecret returns the secret of a value, the value itself without
+// prefix
+func resolveSecret(val string) (string, error) {
+	switch {
+	case strings.HasPrefix(val, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(val, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(val, "keychain:"):
+		ref := strings.TrimPrefix(val, "keychain:")
+		service, account := ref, ""
+		if i := strings.Index(ref, "/"); i >= 0 {
+			service, account = ref[:i], ref[i+1:]
+		}
+		if service == "" {
+			return "", fmt.Errorf("expected keychain:<service>[/<account>]")
+		}
+		secret, err := readKeychain(service, account)
+		if err != nil {
+			return "", fmt.Errorf("keychain %s: %v", ref, err)
+		}
+		return strings.TrimSpace(secret), nil
+	}
+	return val, nil
+}
+
+// setSecret sets a secret of the config or the flags, keeping the old one
+// when it can't be read, and fatal at startup rather than running without it
+func setSecret(name string, secret *string, val string, init bool) {
+	s, err := resolveSecret(val)
+	if err == nil {
+		*secret = s
+		return
+	}
+	if init {
+		logger.Fatalf("failed to read %s => %v", name, err)
+	}
+	logger.Warningf("failed to read %s => %v, keeping the old one\n", name, err)
+}
+
+// resolveFlagSecrets reads the secrets given as flags
+func resolveFlagSecrets() {
+	setSecret("-knock-secret", &knockSecret, knockSecret, true)
+	setSecret("-control-secret", &controlSecret, controlSecret, true)
+	setSecret("-relay-secret", &relaySecret, relaySecret, true)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+)
+
+// `-selftest` checks the machine before involving docker: the connector
+// creates its TUN as usual, without the config file, and an agent emulated in
+// the process connects to it on the loopback. The agent gets the controls, a
+// datagram sent by the OS to the virtual peer must come out of the tunnel to
+// it, and its reply, with the addresses swapped, must come back through the
+// TUN to the sender. The connector then stops, exiting 1 when a step failed.
+// It needs the privileges of the service and refuses to run next to it.
+const (
+	selftestTimeout = 10 * time.Second
+	selftestRetry   = 500 * time.Millisecond
+	selftestPort    = 2519
+)
+
+var selftest = false
+
+// prepareSelftest isolates the connector of the self test from the installed
+// one, its state going to a temporary directory
+func prepareSelftest() {
+	if !selftest {
+		return
+	}
+	statePaths()
+	if pid := runningPid(); pid != 0 {
+		logger.Fatalf("[SELFTEST] The connector is running (pid %d), stop it before the self test", pid)
+	}
+	if !bind {
+		logger.Fatalf("[SELFTEST] The self test needs the TUN, drop -bind=false")
+	}
+	dir, err := ioutil.TempDir("", "docker-connector-selftest")
+	if err != nil {
+		logger.Fatalf("[SELFTEST] %v", err)
+	}
+	stateDir = dir
+	configFile = ""
+	host, port, cliAddr = "127.0.0.1", 0, ""
+	rendezvous, transport = "", transportUDP
+	logger.Infof("[SELFTEST] Testing the TUN of %s with an emulated agent", addr)
+}
+
+// runSelftest runs the self test against the started connector, then stops
+// it and exits
+func (c *Connector) runSelftest(iface tunDevice) {
+	code := 0
+	if err := selftestRoundTrip(iface); err != nil {
+		logger.Errorf("[SELFTEST] FAIL => %v", err)
+		code = 1
+	} else {
+		logger.Infof("[SELFTEST] PASS => TUN->UDP->control->TUN round trip through %s", iface.Name())
+	}
+	c.Stop(nil)
+	os.RemoveAll(stateDir)
+	os.Exit(code)
+}
+
+// selftestRoundTrip runs the steps of the self test
+func selftestRoundTrip(iface tunDevice) error {
+	if iface == nil {
+		return fmt.Errorf("no TUN interface")
+	}
+	target := conn.LocalAddr().(*net.UDPAddr)
+	agent, err := net.ListenUDP("udp", &net.UDPAddr{IP: target.IP})
+	if err != nil {
+		return fmt.Errorf("emulated agent => %v", err)
+	}
+	defer agent.Close()
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(selftestTimeout)
+
+	// the agent announces itself with a heartbeat and gets the controls
+	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no controls received by the emulated agent within %v", selftestTimeout)
+		}
+		agent.WriteToUDP([]byte{0}, target)
+		agent.SetReadDeadline(time.Now().Add(selftestRetry))
+		n, _, err := agent.ReadFromUDP(buf)
+		if err == nil && n > 0 && (buf[0] == controlsType || buf[0] == 1) {
+			break
+		}
+	}
+	logger.Infof("[SELFTEST] control => controls received by the emulated agent %v", agent.LocalAddr())
+
+	// a datagram of the OS to the virtual peer comes out of the tunnel
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return fmt.Errorf("listen on %s => %v", localIP, err)
+	}
+	defer local.Close()
+	dst := &net.UDPAddr{IP: peer, Port: selftestPort}
+	payload := []byte(fmt.Sprintf("docker-connector selftest %d", time.Now().UnixNano()))
+	var packet []byte
+	for packet == nil {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the datagram to %v never came out of %s, check the TUN driver and the routes", dst, iface.Name())
+		}
+		if _, err := local.WriteToUDP(payload, dst); err != nil {
+			return fmt.Errorf("send to %v => %v", dst, err)
+		}
+		agent.SetReadDeadline(time.Now().Add(selftestRetry))
+		for {
+			n, _, err := agent.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if selftestMatch(buf[:n], payload) {
+				packet = append([]byte(nil), buf[:n]...)
+				break
+			}
+		}
+	}
+	logger.Infof("[SELFTEST] TUN->UDP => %d bytes from %v reached the emulated agent", len(packet), local.LocalAddr())
+
+	// the reply of the agent comes back through the TUN, swapping the
+	// addresses and the ports keeps the checksums
+	ihl := int(packet[0]&0x0f) * 4
+	var ip [4]byte
+	copy(ip[:], packet[12:16])
+	copy(packet[12:16], packet[16:20])
+	copy(packet[16:20], ip[:])
+	sport := binary.BigEndian.Uint16(packet[ihl:])
+	copy(packet[ihl:ihl+2], packet[ihl+2:ihl+4])
+	binary.BigEndian.PutUint16(packet[ihl+2:], sport)
+	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the reply of the emulated agent never came out of %s", iface.Name())
+		}
+		agent.WriteToUDP(packet, target)
+		local.SetReadDeadline(time.Now().Add(selftestRetry))
+		n, from, err := local.ReadFromUDP(buf)
+		if err == nil && from.IP.Equal(peer) && bytes.Equal(buf[:n], payload) {
+			break
+		}
+	}
+	logger.Infof("[SELFTEST] UDP->TUN => the reply of %v reached %v", dst, local.LocalAddr())
+	return nil
+}
+
+// selftestMatch tells whether a datagram is the IPv4 packet of the self test
+func selftestMatch(data, payload []byte) bool {
+	if len(data) < 28 || data[0]>>4 != 4 || data[9] != 17 {
+		return false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl+8 || binary.BigEndian.Uint16(data[ihl+2:]) != selftestPort {
+		return false
+	}
+	return bytes.Equal(data[ihl+8:], payload)
+}
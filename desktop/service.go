@@ -2,50 +2,112 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"docker-connector/pkg/connector"
 	"github.com/fsnotify/fsnotify"
 	"github.com/kardianos/service"
 	"github.com/op/go-logging"
-	"github.com/songgao/water"
 )
 
 type Connector struct {
-	iface *water.Interface
-	stop  bool
+	iface  tunDevice
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	wg     sync.WaitGroup
+	// peerDead is set by watchPeer once the client stops sending heartbeats
+	peerDead int32
 }
 
 func (c *Connector) Start(s service.Service) error {
-	c.stop = false
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = make(chan struct{})
 	go c.run()
 	return nil
 }
 
+// Stop closes the UDP loop, waits for in-flight writes to drain and removes
+// the installed routes before returning, bounded by stopTimeout.
 func (c *Connector) Stop(s service.Service) error {
-	c.stop = true
-	go func() {
-		clearRoutes()
-		if conn != nil {
-			conn.Close()
-		}
-		if c.iface != nil {
-			c.iface.Close()
+	logger.Infof("[SHUTDOWN] Stopping connector")
+	sdNotify("STOPPING=1")
+	if c.cancel != nil {
+		c.cancel()
+	}
+	stopAdmin()
+	stopHandover()
+	knocks.Close()
+	tcpExposes.Close()
+	forwards.Close()
+	mdnsAds.Close()
+	publishes.Close()
+	activations.Close()
+	exposes.Close()
+	portMaps.Close()
+	mirrors.Close()
+	stopSocks()
+	stopControl()
+	if conn != nil {
+		conn.Close()
+	}
+	// both waits share the timeout, each given what is left of it
+	deadline := time.Now().Add(time.Duration(stopTimeout) * time.Second)
+	if c.done != nil {
+		select {
+		case <-c.done:
+			logger.Debugf("[SHUTDOWN] UDP loop exited")
+		case <-time.After(time.Until(deadline)):
+			logger.Warningf("[SHUTDOWN] UDP loop did not exit within %ds", stopTimeout)
 		}
+	}
+	// the connector taking over keeps the TUN, the routes and the DNS
+	if c.iface != nil && !handingOver {
+		runScript(downScript, "down", c.iface.Name())
+	}
+	if !handingOver {
+		clearRoutes()
+		clearPushedDNS()
+		clearResolvers()
+	}
+	stopNAT()
+	peerStats.End("stopped")
+	metrics.Close()
+	writeStatusFile(c, "stopped")
+	if c.iface != nil {
+		c.iface.Close()
+	}
+	drained := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(drained)
 	}()
+	select {
+	case <-drained:
+		logger.Debugf("[SHUTDOWN] In-flight writes drained")
+	case <-time.After(time.Until(deadline)):
+		logger.Warningf("[SHUTDOWN] Forwarding goroutines did not exit within %ds", stopTimeout)
+	}
+	logger.Infof("[SHUTDOWN] Connector stopped")
 	return nil
 }
 
 func (c *Connector) run() {
+	defer close(c.done)
 	flag.Parse()
-	if level, err := logging.LogLevel(logLevel); err == nil {
-		logging.SetLevel(level, "vpn")
+	applyEnv(flag.CommandLine)
+	if err := setLogLevels(logLevel, "", true); err != nil {
+		logger.Warningf("invalid log-level => %s: %v\n", logLevel, err)
 	}
 
 	// 输出网络调试信息
@@ -56,6 +118,11 @@ func (c *Connector) run() {
 	logger.Infof("[NETWORK DEBUG] Bind to interface: %v", bind)
 	logger.Infof("[NETWORK DEBUG] Config file: %s", configFile)
 	logger.Infof("[NETWORK DEBUG] Log level: %s", logLevel)
+	if logFormat != logFormatText && logFormat != logFormatJSON {
+		logger.Warningf("unknown log format => %s\n", logFormat)
+		logFormat = logFormatText
+	}
+	backend := newLogBackend(os.Stderr)
 	if logfile != "" {
 		if !filepath.IsAbs(logfile) {
 			path, err := filepath.Abs(os.Args[0])
@@ -63,13 +130,26 @@ func (c *Connector) run() {
 				logfile = filepath.Join(path, "..", logfile)
 			}
 		}
-		file, err := os.OpenFile(logfile, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0660)
+		file, err := openRotatingFile(logfile)
 		if err == nil {
-			backend := logging.NewLogBackend(file, "", log.LstdFlags)
-			leveledBackend = logging.AddModuleLevel(backend)
-			logger.SetBackend(leveledBackend)
+			backend = newLogBackend(file)
 		}
 	}
+	// keep recent logs for the `logs` subcommand
+	setLogBackend(logging.MultiLogger(backend, logs))
+	resolveFlagSecrets()
+	switch runMode {
+	case modeConnector:
+	case modeRelay:
+		listen := fmt.Sprintf("%s:%d", host, port)
+		if err := serveRendezvous(c.ctx, listen, rendezvousIdle); err != nil {
+			logger.Fatalf("[RENDEZVOUS] Failed to listen %s: %v", listen, err)
+		}
+		return
+	default:
+		logger.Fatalf("unknown mode => %s", runMode)
+	}
+	prepareSelftest()
 	if configFile != "" && !filepath.IsAbs(configFile) {
 		path, err := filepath.Abs(os.Args[0])
 		if err == nil {
@@ -77,10 +157,29 @@ func (c *Connector) run() {
 		}
 		logger.Infof("config file => %v\n", configFile)
 	}
-	var iface *water.Interface
+	go checkRelease()
+	go watchLogSignals(c.ctx)
+	go sessions.Run(c.ctx)
+	prepareStateDir()
+	takeOver()
+	if !waitForDocker(c.ctx) {
+		return
+	}
+	applyStack()
+	// the routes of the connector taken over are ours
+	if bind && handedUDP == nil {
+		cleanStaleRoutes()
+	}
+	var iface tunDevice
 	if _, err := os.Stat(configFile); err == nil {
 		logger.Infof("load config(%v) => %s\n", watch, configFile)
 		iface = loadConfig(iface, true)
+		reloadConfig = func() {
+			configLock.Lock()
+			defer configLock.Unlock()
+			loadConfig(iface, false)
+		}
+		go schedules.Run(c.ctx, reloadConfig)
 		if watch {
 			watcher, err := fsnotify.NewWatcher()
 			if err != nil {
@@ -88,9 +187,34 @@ func (c *Connector) run() {
 			}
 			var timer *time.Timer
 			defer watcher.Close()
+			var watchLock sync.Mutex
+			watched := make(map[string]bool)
+			watchAll := func() {
+				watchLock.Lock()
+				defer watchLock.Unlock()
+				for _, path := range configWatchPaths() {
+					if watched[path] {
+						continue
+					}
+					if err := watcher.Add(path); err != nil {
+						logger.Warningf("watch error => %v\n", err)
+						continue
+					}
+					watched[path] = true
+					if full, err := filepath.Abs(path); err == nil {
+						logger.Debugf("watch config => %s\n", full)
+					} else {
+						logger.Debugf("watch config => %s\n", path)
+					}
+				}
+			}
 			loader := func() {
 				timer = nil
+				configLock.Lock()
+				defer configLock.Unlock()
 				loadConfig(iface, false)
+				// includes may have been added
+				watchAll()
 			}
 			go func() {
 				for {
@@ -99,8 +223,15 @@ func (c *Connector) run() {
 						if !ok {
 							return
 						}
-						if event.Op&fsnotify.Write == fsnotify.Write {
-							logger.Debugf("config file changed => %s\n", configFile)
+						// in a watched directory only the config files count
+						watchLock.Lock()
+						own := watched[event.Name]
+						watchLock.Unlock()
+						if !own && filepath.Ext(event.Name) != configExt {
+							continue
+						}
+						if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove) != 0 {
+							logger.Debugf("config file changed => %s\n", event.Name)
 							if timer != nil {
 								timer.Stop()
 							}
@@ -111,11 +242,13 @@ func (c *Connector) run() {
 								timer.Stop()
 							}
 							timer = time.AfterFunc(time.Duration(2)*time.Second, loader)
-							if err = watcher.Remove(configFile); err != nil {
-								logger.Warningf("remove watch error => %v\n", err)
-							}
-							if err = watcher.Add(event.Name); err != nil {
-								logger.Warningf("watch error => %v\n", err)
+							if event.Name == configFile {
+								if err = watcher.Remove(configFile); err != nil {
+									logger.Warningf("remove watch error => %v\n", err)
+								}
+								if err = watcher.Add(event.Name); err != nil {
+									logger.Warningf("watch error => %v\n", err)
+								}
 							}
 						}
 					case err, ok := <-watcher.Errors:
@@ -126,15 +259,7 @@ func (c *Connector) run() {
 					}
 				}
 			}()
-			if err = watcher.Add(configFile); err == nil {
-				if full, err := filepath.Abs(configFile); err != nil {
-					logger.Debugf("watch config => %s\n", full)
-				} else {
-					logger.Debugf("watch config => %s\n", configFile)
-				}
-			} else {
-				logger.Warningf("watch error => %v\n", err)
-			}
+			watchAll()
 		}
 	} else {
 		if peer, subnet, err = net.ParseCIDR(addr); err != nil {
@@ -143,66 +268,144 @@ func (c *Connector) run() {
 		copy([]byte(localIP), []byte(peer.To4()))
 		localIP[3]++
 		if bind {
-			iface = setup(localIP, peer, subnet)
+			iface = setupTUN(localIP, peer, subnet)
 		}
+		runtimeDefaults()
 	}
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		logger.Fatalf("invalid address => %s:%d", host, port)
+	guestMode = host == "guest"
+	if host == "guest" {
+		// running inside a linux guest, listen on the address facing the host
+		gw, local, err := hostGateway()
+		if err != nil || local == nil {
+			logger.Fatalf("failed to detect host gateway => %v", err)
+		}
+		logger.Infof("[GUEST] host gateway => %s, listen => %s", gw, local)
+		logger.Infof("[GUEST] start the docker side with -host %s -port %d", local, port)
+		host = local.String()
+	}
+	if host == hostWSL {
+		if host = waitWSL(c.ctx); host == "" {
+			return
+		}
+		go watchWSL(c.ctx)
+	}
+	if bind && iface != nil {
+		runScript(upScript, "up", iface.Name())
+	}
+	if wgKey != "" {
+		c.iface = iface
+		c.runWireGuard(iface)
+		return
+	}
+	if encapMode != "" {
+		c.iface = iface
+		c.runEncap(iface)
+		return
 	}
 	// 监听
-	conn, err = net.ListenUDP("udp", udpAddr)
+	var err error
+	portSetting = port
+	if activated := activatedUDP(); activated != nil {
+		conn, port = activated, activated.LocalAddr().(*net.UDPAddr).Port
+		logger.Infof("[SYSTEMD] Using the passed socket %v", conn.LocalAddr())
+	} else if handedUDP != nil {
+		conn, port, handedUDP = handedUDP, handedUDP.LocalAddr().(*net.UDPAddr).Port, nil
+		logger.Infof("[HANDOVER] Using the socket taken over %v", conn.LocalAddr())
+	} else {
+		conn, port, err = listenTunnel(c.ctx, host, port)
+	}
 	if err != nil {
+		if c.ctx.Err() != nil {
+			return
+		}
 		logger.Fatalf("failed to listen %s:%d => %s", host, port, err.Error())
 		return
 	}
-	defer conn.Close()
-	logger.Infof("[UDP LISTENER] Successfully listening on %v", conn.LocalAddr())
+	defer func() { conn.Close() }()
+	writePidFile()
+	defer removePidFile()
+	logTransport.Infof("[UDP LISTENER] Successfully listening on %v", conn.LocalAddr())
+	writer = startWriter(conn)
+	defer func() { writer.Close() }()
+	if rendezvous != "" {
+		startRendezvous(c.ctx)
+	}
+	if err := startTransport(c.ctx); err != nil {
+		logger.Fatalf("[SSH] %v", err)
+	}
+	if err := setTrace(traceExpr); err != nil {
+		logger.Fatalf("[TRACE] %v", err)
+	}
+	if err := setNetem(netemSpec); err != nil {
+		logTransport.Fatalf("[NETEM] %v", err)
+	}
+	setDSCP(dscpSpec)
 
 	// 输出网络接口状态
 	if iface != nil {
-		logger.Infof("[TUN INTERFACE] TUN interface created: %s", iface.Name())
-		logger.Infof("[TUN INTERFACE] Local IP: %d.%d.%d.%d", localIP[0], localIP[1], localIP[2], localIP[3])
+		logTransport.Infof("[TUN INTERFACE] TUN interface created: %s", iface.Name())
+		logTransport.Infof("[TUN INTERFACE] Local IP: %d.%d.%d.%d", localIP[0], localIP[1], localIP[2], localIP[3])
 		if peer != nil {
-			logger.Infof("[TUN INTERFACE] Peer IP: %s", peer.String())
+			logTransport.Infof("[TUN INTERFACE] Peer IP: %s", peer.String())
 		}
 		if subnet != nil {
-			logger.Infof("[TUN INTERFACE] Subnet: %s", subnet.String())
+			logTransport.Infof("[TUN INTERFACE] Subnet: %s", subnet.String())
 		}
 	} else {
-		logger.Warningf("[TUN INTERFACE] No TUN interface bound - running in proxy mode only")
+		logTransport.Warningf("[TUN INTERFACE] No TUN interface bound - running in proxy mode only")
 	}
 
 	// 客户端连接信息
-	if cliAddr == "" {
-		logger.Infof("[CLIENT] Looking for saved peer info in %s", TmpPeer)
+	if handedClient != nil {
+		shared.SetClient(handedClient)
+		logTransport.Infof("[CLIENT] Client taken over: %v", handedClient)
+	} else if wslMode {
+		logTransport.Infof("[CLIENT] Waiting for the agent of WSL")
+	} else if cliAddr == "" && !persistPeer {
+		logTransport.Infof("[CLIENT] Saved peer disabled, waiting for client connection")
+	} else if cliAddr == "" {
+		logTransport.Infof("[CLIENT] Looking for saved peer info in %s", TmpPeer)
 		if tmp, err := ioutil.ReadFile(TmpPeer); err == nil {
-			if cli, err = net.ResolveUDPAddr("udp", string(tmp)); err == nil {
-				logger.Infof("[CLIENT] Loaded saved peer: %v", cli)
+			if cli, err := net.ResolveUDPAddr("udp", string(tmp)); err == nil {
+				shared.SetClient(cli)
+				logTransport.Infof("[CLIENT] Loaded saved peer: %v", cli)
 			} else {
-				logger.Warningf("[CLIENT] Failed to parse saved peer address '%s': %v", string(tmp), err)
+				logTransport.Warningf("[CLIENT] Failed to parse saved peer address '%s': %v", string(tmp), err)
 			}
 		} else {
-			logger.Infof("[CLIENT] No saved peer info found, waiting for client connection")
+			logTransport.Infof("[CLIENT] No saved peer info found, waiting for client connection")
 		}
 	} else {
-		if cli, err = net.ResolveUDPAddr("udp", cliAddr); err == nil {
-			logger.Infof("[CLIENT] Using configured peer: %v", cli)
+		if cli, err := net.ResolveUDPAddr("udp", cliAddr); err == nil {
+			shared.SetClient(cli)
+			logTransport.Infof("[CLIENT] Using configured peer: %v", cli)
+			resolvedCli = cli
 		} else {
-			logger.Warningf("[CLIENT] Failed to parse configured peer address '%s': %v", cliAddr, err)
+			logTransport.Warningf("[CLIENT] Failed to parse configured peer address '%s': %v", cliAddr, err)
+			resolveSoon()
 		}
 	}
 
 	// 输出当前配置状态
-	logger.Infof("[CONFIG] IPTables rules count: %d", len(iptables))
-	for rule, enabled := range iptables {
-		logger.Debugf("[CONFIG] IPTables rule '%s': %v", rule, enabled)
+	tables, hosts := shared.Controls()
+	logControl.Infof("[CONFIG] IPTables rules count: %d", len(tables))
+	for rule, enabled := range tables {
+		logControl.Debugf("[CONFIG] IPTables rule '%s': %v", rule, enabled)
 	}
-	logger.Debugf("[CONFIG] Hosts config: %s", hosts)
+	logControl.Debugf("[CONFIG] Hosts config: %s", hosts)
 	c.iface = iface
 
 	// 输出网络诊断信息
 	logNetworkDiagnostics(iface)
+	startAdmin(c)
+	startHandover(c)
+	startKnock()
+	startControl(c)
+	userspaceSocksAddr()
+	startSocks()
+	if learnFor > 0 {
+		learning.Start(learnFor)
+	}
 
 	// 启动定期网络状态检查
 	go func() {
@@ -212,145 +415,429 @@ func (c *Connector) run() {
 		for {
 			select {
 			case <-ticker.C:
-				if !c.stop {
-					logger.Debugf("[HEALTH CHECK] Periodic network status check")
-					if cli == nil {
-						logger.Warningf("[HEALTH CHECK] No client connected - waiting for connection")
-					} else {
-						logger.Debugf("[HEALTH CHECK] Client connected: %v", cli)
-					}
-					if iface == nil {
-						logger.Warningf("[HEALTH CHECK] TUN interface not available")
-					}
+				if isIdle() {
+					continue
 				}
-			}
-			if c.stop {
-				break
+				logHealth.Debugf("[HEALTH CHECK] Periodic network status check")
+				if cli := shared.Client(); cli == nil {
+					logHealth.Warningf("[HEALTH CHECK] No client connected - waiting for connection")
+				} else {
+					logHealth.Debugf("[HEALTH CHECK] Client connected: %v", cli)
+				}
+				if iface == nil {
+					logHealth.Warningf("[HEALTH CHECK] TUN interface not available")
+				} else {
+					verifyRoutes(iface.Name())
+				}
+			case <-c.ctx.Done():
+				return
 			}
 		}
 	}()
 
+	if shared.Client() != nil {
+		touchPeer()
+	}
+	go c.watchPeer()
+	go c.watchNATKeepalive()
+	go c.watchIdle()
+	go c.watchNetwork()
+	go watchResolve(c.ctx)
+	go c.watchConntrack()
+	go c.watchHealth()
+	go c.watchdog()
+	go c.watchStatusFile()
+	go c.watchMetrics()
+	go c.watchDocker()
+	go c.watchAlarms()
+	sdNotify("READY=1")
+	if selftest {
+		go c.runSelftest(iface)
+	}
+
+	unreachableTUN = iface
+	buildChains(func(p []byte) {
+		if to := shared.Client(); to != nil {
+			sendClient(p, to)
+		}
+	}, func(p []byte) { writeTUN(routeTUNs.For(p, iface), p) })
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		if iface == nil {
 			logger.Info("not bind to interface")
 			return
 		}
-		buf := make([]byte, 2000)
+		c.readTUN(iface, nil)
+	}()
+	routeTUNs.Start(func(dev tunDevice, done chan struct{}) {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.readTUN(dev, done)
+		}()
+	})
+	var lastCli string
+	var n int
+	var from *net.UDPAddr
+	db, pb := getBuffer(bufferSize()), getBuffer(bufferSize())
+	defer putBuffer(db)
+	defer putBuffer(pb)
+	data, plain := *db, *pb
+	pool := startWorkers(workers, func(packet []byte) {
+		forward(iface, packet)
+	})
+	defer pool.Close()
+	readConn := conn
+	reader := newBatchReader(readConn, bufferSize())
+	logTransport.Infof("[UDP LISTENER] Starting UDP packet processing loop, listening on %v", conn.LocalAddr())
+
+	supervise(c.ctx, "UDP->TUN", func() {
 		for {
-			n, err := iface.Read(buf)
+			if size := bufferSize(); size > len(data) {
+				data, plain = make([]byte, size), make([]byte, size)
+				reader.Grow(size)
+			}
+			n, from, err = reader.ReadFromUDP(data)
 			if err != nil {
-				if c.stop {
+				if c.ctx.Err() != nil {
 					break
 				}
-				logger.Warningf("tap read error: %v\n", err)
+				if cur := conn; cur != readConn {
+					// rebound by a reload
+					readConn, reader = cur, newBatchReader(cur, bufferSize())
+					logTransport.Infof("[UDP LISTENER] Reading from %v", cur.LocalAddr())
+					continue
+				}
+				logger.Warning("failed read udp msg, error: " + err.Error())
+				continue
+			}
+			if n > 0 && (data[0]>>4 == 4 || data[0]>>4 == 6) && truncated(n, len(data), "UDP") {
+				continue
+			}
+			if !peersAllow.Allowed(from.IP) {
+				continue
+			}
+			if handleRendezvous(data[:n], from) {
+				continue
+			}
+			if n == 1 && data[0] == keepaliveType {
+				continue
+			}
+			if !knocks.Allowed(from.IP) {
+				logger.Debugf("[KNOCK] Dropped %d bytes from %v without knock", n, from)
+				continue
+			}
+			if !failover.Admit(from, data[0] == 0, conn) {
 				continue
 			}
+			roamed := false
+			if data[0] == 0 && isHeartbeat(n) {
+				if !pins.Admit(conn, dataSession.name, data[:n], from) {
+					peerStats.Drop("identity")
+					continue
+				}
+				var ok bool
+				if ok, roamed = dataSession.Heartbeat(heartbeatSession(data[:n]), from, atomic.LoadInt32(&c.peerDead) == 0); !ok {
+					peerStats.Drop("session")
+					dataSession.Request(conn, from)
+					continue
+				}
+			} else if !dataSession.Data(from) {
+				peerStats.Drop("session")
+				dataSession.Request(conn, from)
+				continue
+			}
+			cli := from
+			shared.SetClient(cli)
 
-			// 记录详细的数据包信息
-			logPacketDetails(buf, n, "TUN->UDP")
+			logTransport.Debugf("[UDP->TUN] Received %d bytes from client %v", n, cli)
+			touchPeer()
+			if atomic.CompareAndSwapInt32(&c.peerDead, 1, 0) {
+				// resend the controls once the client is back
+				lastCli = ""
+			}
 
-			if localIP[0] == buf[16] && localIP[1] == buf[17] && localIP[2] == buf[18] && localIP[3] == buf[19] {
-				logger.Debugf("[LOCAL LOOPBACK] Packet to local IP: %d.%d.%d.%d", localIP[0], localIP[1], localIP[2], localIP[3])
-				if _, err := iface.Write(buf[:n]); err != nil {
-					logger.Warningf("local write error: %v\n", err)
+			// 处理心跳包
+			if data[0] == 0 && isHeartbeat(n) {
+				if n > 1 {
+					setPeerFeatures(data[:n])
+				}
+				if reply := clock.handleHeartbeat(data[:n], time.Now().UnixNano()); reply != nil {
+					if _, err := conn.WriteToUDP(reply, cli); err != nil {
+						logHealth.Warningf("[HEARTBEAT] Failed to reply to %v: %v", cli, err)
+					}
+				}
+				if lastCli == cli.String() {
+					logHealth.Debugf("[HEARTBEAT] Client heartbeat => %v", cli)
+				} else if roamed {
+					// the same client behind another address
+					logTransport.Infof("[CLIENT] Client moved from %s to %v", lastCli, cli)
+					lastCli = cli.String()
+					savePeer(lastCli)
+					refreshControls(cli)
+				} else {
+					if lastCli == "" {
+						logTransport.Infof("[CLIENT] Client init => %v", cli)
+					} else {
+						logTransport.Infof("[CLIENT] Client change from %s to %v", lastCli, cli)
+						hooks.Fire(hookClientDisconnect, "CONNECTOR_CLIENT="+lastCli, "CONNECTOR_REASON=changed")
+					}
+					hooks.Fire(hookClientConnect, "CONNECTOR_CLIENT="+cli.String(), "CONNECTOR_PREVIOUS="+lastCli)
+					metrics.Connected()
+					lastCli = cli.String()
+					clock.Reset()
+					peerStats.Begin(lastCli)
+					savePeer(lastCli)
+					logControl.Infof("[CONFIG] Sending controls to new client %v", cli)
+					refreshControls(cli)
+					if n := pendingQueue.Flush(func(packet []byte) error {
+						return writePacket(packet, cli)
+					}); n > 0 {
+						logTransport.Infof("[QUEUE] Flushed %d queued packets to %v", n, cli)
+					}
 				}
 				continue
 			}
 
-			// 检查客户端连接状态
-			if cli == nil {
-				logger.Warningf("[TUN->UDP] No client connected, dropping packet to %d.%d.%d.%d", buf[16], buf[17], buf[18], buf[19])
+			// 处理重新同步请求
+			if data[0] == resyncRequest && n == 1 {
+				logTransport.Infof("[CLIENT] Resync requested by %v", cli)
+				resendControls(cli)
 				continue
 			}
 
-			if _, err := conn.WriteToUDP(buf[:n], cli); err != nil {
-				logger.Warningf("[TUN->UDP] UDP write error to client %v: %v\n", cli, err)
+			if data[0] == controlsAck {
+				ctlVersions.Ack(data[:n], cli)
 				continue
 			}
-			logger.Debugf("[TUN->UDP] Successfully forwarded packet to client %v", cli)
-		}
-	}()
-	var lastCli string
-	var n int
-	data := make([]byte, 2000)
-	logger.Infof("[UDP LISTENER] Starting UDP packet processing loop, listening on %v", conn.LocalAddr())
 
-	for {
-		n, cli, err = conn.ReadFromUDP(data)
-		if err != nil {
-			if c.stop {
-				break
+			// 处理路径报告
+			if data[0] == pathReport && n > 1 {
+				paths.Report(data[1:n], cli)
+				continue
 			}
-			logger.Warning("failed read udp msg, error: " + err.Error())
-			continue
-		}
 
-		logger.Debugf("[UDP->TUN] Received %d bytes from client %v", n, cli)
+			// 处理诊断结果
+			if data[0] == diagResult && n > 1 {
+				diag.Add(data[:n])
+				continue
+			}
 
-		// 处理心跳包
-		if data[0] == 0 && n == 1 {
-			if lastCli == cli.String() {
-				logger.Debugf("[HEARTBEAT] Client heartbeat => %v", cli)
-			} else {
-				if lastCli == "" {
-					logger.Infof("[CLIENT] Client init => %v", cli)
-				} else {
-					logger.Infof("[CLIENT] Client change from %s to %v", lastCli, cli)
+			if data[0] == socksUDP && n > 1 {
+				deliverSocksUDP(data[:n])
+				continue
+			}
+
+			if data[0] == benchType && n > 1 {
+				bench.Receive(data[:n])
+				continue
+			}
+
+			// 处理控制包
+			if data[0] == 1 && n > 1 {
+				logControl.Debugf("[CONTROL] Received control packet from %v, size: %d", cli, n-1)
+				if line := verifyControl(data[1:n], cli); line != nil {
+					audits.Control(line, cli.String())
+					appendConfig(line)
 				}
-				lastCli = cli.String()
-				if cliAddr == "" {
-					if err := ioutil.WriteFile(TmpPeer, []byte(lastCli), 0644); err != nil {
-						logger.Warningf("[CLIENT] Failed to save peer info: %v", err)
-					} else {
-						logger.Debugf("[CLIENT] Saved peer info to %s", TmpPeer)
-					}
+				continue
+			}
+
+			// 去重
+			if data[0] == seqType {
+				datagram := unframe(data[:n])
+				if datagram == nil {
+					peerStats.Drop("duplicate")
+					continue
 				}
-				logger.Infof("[CONFIG] Sending controls to new client %v", cli)
-				sendControls(cli, iptables, hosts)
+				n = copy(data, datagram)
 			}
-			continue
-		}
 
-		// 处理控制包
-		if data[0] == 1 && n > 1 {
-			logger.Debugf("[CONTROL] Received control packet from %v, size: %d", cli, n-1)
-			appendConfig(data[1:n])
-			continue
-		}
+			// 前向纠错
+			if data[0] == fecType {
+				datagram := fecIn.Receive(data[:n])
+				if datagram == nil {
+					continue
+				}
+				n = copy(data, datagram)
+			}
 
-		// 记录详细的数据包信息
-		if n > 1 { // 排除心跳包和控制包
-			logPacketDetails(data, n, "UDP->TUN")
+			// 重组分片
+			if data[0] == fragType {
+				packet := fragments.Add(data[:n])
+				if packet == nil {
+					continue
+				}
+				if len(packet) > len(data) {
+					logTransport.Warningf("[FRAGMENT] Reassembled packet of %d bytes exceeds buffer, dropped", len(packet))
+					continue
+				}
+				n = copy(data, packet)
+			}
+
+			// 解压
+			if data[0] == compressType && n > 1 {
+				m, err := decompressPacket(data[:n], plain)
+				if err != nil {
+					logTransport.Warningf("[COMPRESS] Failed to decompress %d bytes from %v: %v", n, cli, err)
+					continue
+				}
+				n = copy(data, plain[:m])
+			}
+
+			// 二层帧
+			if data[0] == tapType && n > 1 {
+				if t, ok := iface.(*tapDevice); ok {
+					if err := t.WriteFrame(data[1:n]); err != nil {
+						logTransport.Warningf("[TAP] Failed to write %d bytes frame: %v", n-1, err)
+					}
+				}
+				continue
+			}
+
+			packet := validPacket(data[:n], cli)
+			if packet == nil {
+				peerStats.Drop("invalid")
+				continue
+			}
+			if pool.Dispatch(packet) {
+				continue
+			}
+			forward(iface, packet)
 		}
+	})
+}
 
-		dest := toIntIP(data, 16, 17, 18, 19)
-		if sess, ok := sessions[dest]; ok && n > 1 {
-			logger.Debugf("[SESSION] Forwarding packet to session %v (dest IP: %d.%d.%d.%d)", sess,
-				(dest>>24)&0xFF, (dest>>16)&0xFF, (dest>>8)&0xFF, dest&0xFF)
-			if _, err := expose.WriteToUDP(data[:n], sess); err != nil {
-				logger.Warningf("[SESSION] Session write error: %d bytes, dest: %v, error: %v", n, sess, err)
+// readTUN sends the packets of a TUN to the docker side until done is closed
+// or the connector stops
+func (c *Connector) readTUN(iface tunDevice, done chan struct{}) {
+	b := getBuffer(bufferSize())
+	defer putBuffer(b)
+	buf := *b
+	name := "TUN->UDP"
+	if done != nil {
+		name += " " + iface.Name()
+	}
+	supervise(c.ctx, name, func() {
+		for {
+			awaitWake(c.ctx, done)
+			buf = grownBuffer(buf)
+			n, err := iface.Read(buf)
+			if err != nil {
+				if c.ctx.Err() != nil || closed(done) {
+					break
+				}
+				logger.Warningf("tap read error: %v\n", err)
+				continue
 			}
-		} else if bind {
-			if iface == nil {
-				logger.Warningf("[TUN] Interface not available, dropping packet")
+			if truncated(n, len(buf), "TUN") {
+				continue
+			}
+
+			// 记录详细的数据包信息
+			logPacketDetails(buf, n, "TUN->UDP")
+
+			if handleLoopback(iface, buf[:n]) {
+				logTransport.Debugf("[LOCAL LOOPBACK] Packet to local IP: %d.%d.%d.%d", localIP[0], localIP[1], localIP[2], localIP[3])
 				continue
 			}
 
-			logger.Debugf("[UDP->TUN] Writing %d bytes to TUN interface", n)
-			if _, err := iface.Write(data[:n]); err != nil {
-				logger.Warningf("[UDP->TUN] TUN write error: %d bytes, error: %v", n, err)
+			hostSvc.Outbound(buf[:n])
 
-				// 提供更详细的错误信息
-				if n > 20 {
-					dstIP := fmt.Sprintf("%d.%d.%d.%d", data[16], data[17], data[18], data[19])
-					logger.Warningf("[UDP->TUN] Failed packet destination: %s", dstIP)
+			// 检查客户端连接状态
+			cli := shared.Client()
+			if cli == nil {
+				if noClient == "queue" {
+					logTransport.Debugf("[TUN->UDP] No client connected, queueing packet to %d.%d.%d.%d", buf[16], buf[17], buf[18], buf[19])
+					pendingQueue.Push(buf[:n])
+				} else {
+					logTransport.Warningf("[TUN->UDP] No client connected, dropping packet to %d.%d.%d.%d", buf[16], buf[17], buf[18], buf[19])
+					sendUnreachable(buf[:n], icmpHostUnreach)
 				}
-			} else {
-				logger.Debugf("[UDP->TUN] Successfully wrote packet to TUN interface")
+				continue
+			}
+
+			to := cli
+			packet, drop := outboundChain.Run(buf[:n], connector.Outbound)
+			if drop {
+				continue
 			}
+			sendClient(packet, to)
+		}
+	})
+}
+
+// forward writes a packet from the docker side to its session or the TUN
+func forward(iface tunDevice, data []byte) {
+	n := len(data)
+	// 记录详细的数据包信息
+	if n > 1 { // 排除心跳包和控制包
+		logPacketDetails(data, n, "UDP->TUN")
+	}
+
+	if deliverProbe(data) || answerPing(data) {
+		return
+	}
+	// the sessions are keyed by IPv4, an IPv6 packet goes to the TUN
+	var dest uint64
+	var sess *exposeSession
+	if data[0]>>4 == 4 {
+		dest = toIntIP(data, 16, 17, 18, 19)
+		sess = sessions.Lookup(dest)
+	}
+	if sess != nil && n > 1 {
+		logTransport.Debugf("[SESSION] Forwarding packet to session %v (dest IP: %d.%d.%d.%d)", sess.peer,
+			(dest>>24)&0xFF, (dest>>16)&0xFF, (dest>>8)&0xFF, dest&0xFF)
+		if _, err := sess.listener.conn.WriteToUDP(data, sess.peer); err != nil {
+			logTransport.Warningf("[SESSION] Session write error: %d bytes, dest: %v, error: %v", n, sess.peer, err)
 		} else {
-			logger.Debugf("[UDP->TUN] Not bound to interface, skipping packet write")
+			atomic.AddUint64(&sess.txBytes, uint64(n))
+		}
+	} else if bind {
+		if iface == nil {
+			logTransport.Warningf("[TUN] Interface not available, dropping packet")
+			return
+		}
+
+		packet, drop := inboundChain.Run(data, connector.Inbound)
+		if drop {
+			return
+		}
+		if debugEnabled() {
+			logTransport.Debugf("[UDP->TUN] Writing %d bytes to TUN interface", len(packet))
+		}
+		writeTUN(iface, packet)
+	} else {
+		logTransport.Debugf("[UDP->TUN] Not bound to interface, skipping packet write")
+	}
+}
+
+// sendClient sends a packet of the TUN to the docker side
+func sendClient(packet []byte, cli *net.UDPAddr) {
+	if err := writePacket(packet, cli); err != nil {
+		logTransport.Warningf("[TUN->UDP] UDP write error to client %v: %v\n", cli, err)
+		peerStats.Drop("udp_error")
+		resolveSoon()
+		return
+	}
+	logTransport.Debugf("[TUN->UDP] Successfully forwarded packet to client %v", cli)
+}
+
+// writeTUN writes a packet of the docker side to the TUN
+func writeTUN(iface tunDevice, data []byte) {
+	n := len(data)
+	if _, err := iface.Write(data); err != nil {
+		logTransport.Warningf("[UDP->TUN] TUN write error: %d bytes, error: %v", n, err)
+		peerStats.Drop("tun_error")
+
+		// 提供更详细的错误信息
+		if n > 20 {
+			dstIP := fmt.Sprintf("%d.%d.%d.%d", data[16], data[17], data[18], data[19])
+			logTransport.Warningf("[UDP->TUN] Failed packet destination: %s", dstIP)
 		}
+	} else {
+		logTransport.Debugf("[UDP->TUN] Successfully wrote packet to TUN interface")
 	}
 }
 
@@ -371,48 +858,52 @@ func toIntIP(packet []byte, offset0 int, offset1 int, offset2 int, offset3 int)
 }
 
 // 网络诊断辅助函数
-func logNetworkDiagnostics(iface *water.Interface) {
-	logger.Infof("[DIAGNOSTICS] =========================")
-	logger.Infof("[DIAGNOSTICS] Network Connectivity Check")
-	logger.Infof("[DIAGNOSTICS] =========================")
+func logNetworkDiagnostics(iface tunDevice) {
+	logHealth.Infof("[DIAGNOSTICS] =========================")
+	logHealth.Infof("[DIAGNOSTICS] Network Connectivity Check")
+	logHealth.Infof("[DIAGNOSTICS] =========================")
 
 	// 检查TUN接口状态
 	if iface != nil {
-		logger.Infof("[DIAGNOSTICS] ✓ TUN interface is active: %s", iface.Name())
+		logHealth.Infof("[DIAGNOSTICS] ✓ TUN interface is active: %s", iface.Name())
 	} else {
-		logger.Warningf("[DIAGNOSTICS] ✗ TUN interface is not available")
+		logHealth.Warningf("[DIAGNOSTICS] ✗ TUN interface is not available")
 	}
 
 	// 检查UDP连接状态
 	if conn != nil {
-		logger.Infof("[DIAGNOSTICS] ✓ UDP listener is active on: %v", conn.LocalAddr())
+		logHealth.Infof("[DIAGNOSTICS] ✓ UDP listener is active on: %v", conn.LocalAddr())
 	} else {
-		logger.Warningf("[DIAGNOSTICS] ✗ UDP listener is not available")
+		logHealth.Warningf("[DIAGNOSTICS] ✗ UDP listener is not available")
 	}
 
 	// 检查客户端连接状态
-	if cli != nil {
-		logger.Infof("[DIAGNOSTICS] ✓ Client connected: %v", cli)
+	if cli := shared.Client(); cli != nil {
+		logHealth.Infof("[DIAGNOSTICS] ✓ Client connected: %v", cli)
 	} else {
-		logger.Warningf("[DIAGNOSTICS] ✗ No client connected")
+		logHealth.Warningf("[DIAGNOSTICS] ✗ No client connected")
 	}
 
 	// 检查网络配置
-	logger.Infof("[DIAGNOSTICS] Local IP: %d.%d.%d.%d", localIP[0], localIP[1], localIP[2], localIP[3])
+	logHealth.Infof("[DIAGNOSTICS] Local IP: %d.%d.%d.%d", localIP[0], localIP[1], localIP[2], localIP[3])
 	if peer != nil {
-		logger.Infof("[DIAGNOSTICS] Peer IP: %s", peer.String())
+		logHealth.Infof("[DIAGNOSTICS] Peer IP: %s", peer.String())
 	}
 	if subnet != nil {
-		logger.Infof("[DIAGNOSTICS] Subnet: %s", subnet.String())
+		logHealth.Infof("[DIAGNOSTICS] Subnet: %s", subnet.String())
 	}
 
-	logger.Infof("[DIAGNOSTICS] =========================")
+	logHealth.Infof("[DIAGNOSTICS] =========================")
 }
 
 // 解析并记录数据包详细信息
 func logPacketDetails(data []byte, n int, direction string) {
+	logf, ok := traced(data[:n])
+	if !ok {
+		return
+	}
 	if n < 20 {
-		logger.Debugf("[PACKET %s] Packet too small: %d bytes", direction, n)
+		logf("[PACKET %s] Packet too small: %d bytes", direction, n)
 		return
 	}
 
@@ -441,14 +932,22 @@ func logPacketDetails(data []byte, n int, direction string) {
 		protocolName = fmt.Sprintf("Protocol-%d", protocol)
 	}
 
-	logger.Debugf("[PACKET %s] IP v%d, Len:%d, ID:%d, TTL:%d, Proto:%s, %s->%s",
-		direction, version, totalLen, id, ttl, protocolName, srcIP, dstIP)
+	logf("[PACKET %s] %v", direction, &packetInfo{
+		Direction: direction,
+		Version:   int(version),
+		Src:       srcIP,
+		Dst:       dstIP,
+		Proto:     protocolName,
+		Bytes:     int(totalLen),
+		ID:        int(id),
+		TTL:       int(ttl),
+	})
 
 	if flags&0x02 != 0 {
-		logger.Debugf("[PACKET %s] Don't Fragment flag set", direction)
+		logf("[PACKET %s] Don't Fragment flag set", direction)
 	}
 	if fragOffset != 0 {
-		logger.Debugf("[PACKET %s] Fragment offset: %d", direction, fragOffset)
+		logf("[PACKET %s] Fragment offset: %d", direction, fragOffset)
 	}
 
 	// 协议特定信息
@@ -456,27 +955,71 @@ func logPacketDetails(data []byte, n int, direction string) {
 		icmpType := data[20]
 		icmpCode := data[21]
 		icmpChecksum := (uint16(data[22]) << 8) | uint16(data[23])
-		logger.Debugf("[PACKET %s] ICMP Type:%d, Code:%d, Checksum:0x%04x", direction, icmpType, icmpCode, icmpChecksum)
+		logf("[PACKET %s] ICMP Type:%d, Code:%d, Checksum:0x%04x", direction, icmpType, icmpCode, icmpChecksum)
 
 		switch icmpType {
 		case 8:
-			logger.Debugf("[PACKET %s] ICMP Echo Request (ping)", direction)
+			logf("[PACKET %s] ICMP Echo Request (ping)", direction)
 		case 0:
-			logger.Debugf("[PACKET %s] ICMP Echo Reply (pong)", direction)
+			logf("[PACKET %s] ICMP Echo Reply (pong)", direction)
 		case 3:
-			logger.Debugf("[PACKET %s] ICMP Destination Unreachable", direction)
+			logf("[PACKET %s] ICMP Destination Unreachable", direction)
 		case 11:
-			logger.Debugf("[PACKET %s] ICMP Time Exceeded", direction)
+			logf("[PACKET %s] ICMP Time Exceeded", direction)
 		}
 	}
+	traceDump(data[:n], direction)
+}
+
+// savePeer saves the address of the client for the docker side commands
+func savePeer(addr string) {
+	if cliAddr != "" {
+		return
+	}
+	if !persistPeer {
+		// a peer saved before persist-peer off would be reused on restart
+		os.Remove(TmpPeer)
+		return
+	}
+	if err := ioutil.WriteFile(TmpPeer, []byte(addr), 0644); err != nil {
+		logTransport.Warningf("[CLIENT] Failed to save peer info: %v", err)
+	} else {
+		logTransport.Debugf("[CLIENT] Saved peer info to %s", TmpPeer)
+	}
 }
 
-func sendControls(cli *net.UDPAddr, tables map[string]bool, hosts string) {
-	logger.Infof("[CONTROL] Sending controls to client %v", cli)
-	logger.Debugf("[CONTROL] IPTables rules: %v", tables)
-	logger.Debugf("[CONTROL] Hosts config: %s", hosts)
+// sendControls sends the controls of the rules and the hosts to the docker
+// side, the delta of the last ones unless full when it takes versions
+func sendControls(cli *net.UDPAddr, tables map[string]bool, hosts string, full bool) {
+	logControl.Infof("[CONTROL] Sending controls to client %v", cli)
+	logControl.Debugf("[CONTROL] IPTables rules: %v", tables)
+	logControl.Debugf("[CONTROL] Hosts config: %s", hosts)
 
+	ctl, cli := controlTarget(cli)
 	var reply bytes.Buffer
+	// both sides agree on the MTU of the desktop
+	reply.WriteString(fmt.Sprintf("mtu %d", MTU))
+	// tell the docker side the address its controls arrive from
+	reply.WriteString(fmt.Sprintf(",observed %v", cli))
+	if tapMode {
+		reply.WriteString(",mode tap")
+	}
+	if compress {
+		reply.WriteString(",compress lz4")
+	}
+	if fecCount > 0 {
+		reply.WriteString(fmt.Sprintf(",fec %d", fecCount))
+	}
+	if dedup {
+		reply.WriteString(",dedup")
+	}
+	if pushHeartbeat && heartbeat > 0 {
+		// the docker side probes at our pace, for NATs expiring the mappings early
+		reply.WriteString(fmt.Sprintf(",heartbeat %d %d", heartbeat, deadAfter))
+	}
+	if natKeepalive > 0 {
+		reply.WriteString(fmt.Sprintf(",nat-keepalive %d", natKeepalive.Milliseconds()))
+	}
 	controlCount := 0
 	for k, v := range tables {
 		if reply.Len() > 0 {
@@ -484,52 +1027,88 @@ func sendControls(cli *net.UDPAddr, tables map[string]bool, hosts string) {
 		}
 		if v {
 			reply.WriteString("connect ")
-			logger.Debugf("[CONTROL] Adding connect rule: %s", k)
+			logControl.Debugf("[CONTROL] Adding connect rule: %s", k)
 		} else {
 			reply.WriteString("disconnect ")
-			logger.Debugf("[CONTROL] Adding disconnect rule: %s", k)
+			logControl.Debugf("[CONTROL] Adding disconnect rule: %s", k)
 		}
 		reply.WriteString(k)
 		controlCount++
 	}
 
 	loadHosts(&reply, hosts)
+	for _, t := range hostsTemplates {
+		reply.WriteString(",hosts-template " + t)
+	}
+	reply.WriteString(dnsControls())
+	if ip := hostSvc.IP(); ip != nil {
+		reply.WriteString(fmt.Sprintf(",host %s %s", ip, hostServicesName))
+	}
+	for _, lan := range natSubnets {
+		reply.WriteString(",nat " + lan)
+	}
+	if takesDeltas() {
+		payload := ctlVersions.Next(cli, strings.Split(reply.String(), ","), full)
+		if payload == nil {
+			logControl.Infof("[CONTROL] Controls of %v unchanged", cli)
+			return
+		}
+		reply.Reset()
+		reply.WriteString(strings.Join(payload, ","))
+	}
 	l := reply.Len()
+	events.Add("controls", "%d bytes to %v", l, cli)
 
-	logger.Infof("[CONTROL] Prepared %d control rules, total payload size: %d bytes", controlCount, l)
+	logControl.Infof("[CONTROL] Prepared %d control rules, total payload size: %d bytes", controlCount, l)
 
 	if l < 50 {
-		logger.Infof("[CONTROL] Sending to client %s: %d bytes - %s", cli, l, reply.String())
+		logControl.Infof("[CONTROL] Sending to client %s: %d bytes - %s", cli, l, reply.String())
 	} else {
-		logger.Infof("[CONTROL] Sending to client %s: %d bytes (payload too large to display)", cli, l)
+		logControl.Infof("[CONTROL] Sending to client %s: %d bytes (payload too large to display)", cli, l)
 	}
 
 	if l > 0 {
-		l16 := uint16(l)
-		header := make([]byte, 3)
-		header[0] = 1
-		header[1] = byte(l16 >> 8)
-		header[2] = byte(l16 & 0x00ff)
-
-		logger.Debugf("[CONTROL] Sending header: [%d, %d, %d] (length: %d)", header[0], header[1], header[2], l16)
-		if _, err := conn.WriteToUDP(header, cli); err != nil {
-			logger.Warningf("[CONTROL] Failed to send header to %v: %v", cli, err)
+		if l > controlsMax {
+			logControl.Warningf("[CONTROL] Payload of %d bytes exceeds %d bytes, not sent to %v", l, controlsMax, cli)
 			return
 		}
-
 		tmp := reply.Bytes()
+		if atomic.LoadInt32(&peerFeatures)&featureChunks != 0 {
+			chunks := controlChunks(tmp, MTU)
+			for i, chunk := range chunks {
+				if _, err := ctl.WriteToUDP(chunk, cli); err != nil {
+					logControl.Warningf("[CONTROL] Failed to send chunk %d to %v: %v", i+1, cli, err)
+					return
+				}
+			}
+			logControl.Infof("[CONTROL] Successfully sent %d framed chunks to client %v", len(chunks), cli)
+			return
+		}
+		features := atomic.LoadInt32(&peerFeatures)
+		if features&featureControls == 0 && l > 0xffff {
+			logControl.Warningf("[CONTROL] Payload of %d bytes exceeds 64KB, not sent to %v whose agent doesn't read longer ones", l, cli)
+			return
+		}
+		header := controlHeader(l, features)
+
+		logControl.Debugf("[CONTROL] Sending header: %v (length: %d)", header, l)
+		if _, err := ctl.WriteToUDP(header, cli); err != nil {
+			logControl.Warningf("[CONTROL] Failed to send header to %v: %v", cli, err)
+			return
+		}
+
 		chunks := 0
 		for i := 0; i < l; i += MTU {
 			chunkSize := min(i+MTU, l) - i
-			logger.Debugf("[CONTROL] Sending chunk %d: %d bytes (offset %d-%d)", chunks+1, chunkSize, i, i+chunkSize-1)
-			if _, err := conn.WriteToUDP(tmp[i:min(i+MTU, l)], cli); err != nil {
-				logger.Warningf("[CONTROL] Failed to send chunk %d to %v: %v", chunks+1, cli, err)
+			logControl.Debugf("[CONTROL] Sending chunk %d: %d bytes (offset %d-%d)", chunks+1, chunkSize, i, i+chunkSize-1)
+			if _, err := ctl.WriteToUDP(tmp[i:min(i+MTU, l)], cli); err != nil {
+				logControl.Warningf("[CONTROL] Failed to send chunk %d to %v: %v", chunks+1, cli, err)
 				return
 			}
 			chunks++
 		}
-		logger.Infof("[CONTROL] Successfully sent %d chunks to client %v", chunks, cli)
+		logControl.Infof("[CONTROL] Successfully sent %d chunks to client %v", chunks, cli)
 	} else {
-		logger.Infof("[CONTROL] No controls to send to client %v", cli)
+		logControl.Infof("[CONTROL] No controls to send to client %v", cli)
 	}
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// sessionIdle is how long a session lives without packets from its peer
+	sessionIdle = 10 * time.Minute
+	// sessionMax caps the sessions, the logins beyond are refused
+	sessionMax = 256
+)
+
+// exposeSession is a peer of the expose server logged in with a token
+type exposeSession struct {
+	// first for 64-bit alignment of the atomic counters
+	rxBytes, txBytes uint64
+	token            string
+	peer             *net.UDPAddr
+	ip               net.IP
+	lastSeen         time.Time
+	// listener is the expose socket the peer logged in on
+	listener *exposeListener
+}
+
+// SessionStatus describes an expose session
+type SessionStatus struct {
+	Token    string `json:"token"`
+	Peer     string `json:"peer"`
+	IP       string `json:"ip"`
+	LastSeen string `json:"last_seen"`
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+}
+
+// sessionTable keys the expose sessions by peer, and by virtual IP for the
+// packets coming back from the docker side. Peers sharing a token, or tokens
+// sharing an IP, get distinct IPs so their services don't collide.
+type sessionTable struct {
+	sync.RWMutex
+	byPeer map[string]*exposeSession
+	byIP   map[uint64]*exposeSession
+}
+
+var sessions = &sessionTable{
+	byPeer: make(map[string]*exposeSession),
+	byIP:   make(map[uint64]*exposeSession),
+}
+
+func ipKey(ip net.IP) uint64 {
+	return uint64(binary.BigEndian.Uint32(ip.To4()))
+}
+
+// Login returns the session of the peer for the token, with the IP of the
+// token unless another live peer holds it, nil if the subnet is exhausted or
+// the table full
+func (t *sessionTable) Login(token string, addr *net.UDPAddr, ip net.IP, l *exposeListener) *exposeSession {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if s, ok := t.byPeer[addr.String()]; ok {
+		if s.token == token {
+			s.lastSeen = now
+			s.listener = l
+			return s
+		}
+		t.remove(s)
+	}
+	if len(t.byPeer) >= sessionMax {
+		t.expire(now)
+		if len(t.byPeer) >= sessionMax {
+			return nil
+		}
+	}
+	if holder, ok := t.byIP[ipKey(ip)]; ok {
+		if now.Sub(holder.lastSeen) > sessionIdle {
+			t.remove(holder)
+		} else if ip = t.allocate(); ip == nil {
+			return nil
+		}
+	}
+	s := &exposeSession{token: token, peer: addr, ip: ip, lastSeen: now, listener: l}
+	t.byPeer[addr.String()] = s
+	t.byIP[ipKey(ip)] = s
+	return s
+}
+
+func (t *sessionTable) remove(s *exposeSession) {
+	delete(t.byPeer, s.peer.String())
+	if t.byIP[ipKey(s.ip)] == s {
+		delete(t.byIP, ipKey(s.ip))
+	}
+}
+
+// allocate returns a free IP of the subnet, from the top so it stays clear
+// of the IPs given to the tokens
+func (t *sessionTable) allocate() net.IP {
+	if subnet == nil {
+		return nil
+	}
+	reserved := make(map[uint64]bool)
+	for _, ip := range shared.Tokens() {
+		if v := net.ParseIP(ip); v != nil && v.To4() != nil {
+			reserved[ipKey(v)] = true
+		}
+	}
+	base := ipKey(subnet.IP)
+	ones, bits := subnet.Mask.Size()
+	for i := uint64(1)<<uint(bits-ones) - 2; i > 0; i-- {
+		key := base + i
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(key))
+		if ip.Equal(localIP) || ip.Equal(peer) || reserved[key] || t.byIP[key] != nil {
+			continue
+		}
+		return ip
+	}
+	return nil
+}
+
+// Peer returns the session of a peer, nil if it didn't log in
+func (t *sessionTable) Peer(addr *net.UDPAddr) *exposeSession {
+	t.Lock()
+	defer t.Unlock()
+	s := t.byPeer[addr.String()]
+	if s != nil {
+		s.lastSeen = time.Now()
+	}
+	return s
+}
+
+// Lookup returns the session with the IP
+func (t *sessionTable) Lookup(ip uint64) *exposeSession {
+	t.RLock()
+	defer t.RUnlock()
+	return t.byIP[ip]
+}
+
+// expire removes the sessions idle for sessionIdle, holding the lock
+func (t *sessionTable) expire(now time.Time) {
+	for _, s := range t.byPeer {
+		if now.Sub(s.lastSeen) > sessionIdle {
+			logTransport.Infof("[SESSION] Session %s of %v expired after %v idle", s.ip, s.peer, now.Sub(s.lastSeen).Round(time.Second))
+			t.remove(s)
+		}
+	}
+}
+
+// Run expires the idle sessions until the context is done
+func (t *sessionTable) Run(ctx context.Context) {
+	interval := sessionIdle / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.Lock()
+			t.expire(now)
+			t.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Drop ends the sessions of a closed expose socket
+func (t *sessionTable) Drop(l *exposeListener) {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.byPeer {
+		if s.listener == l {
+			t.remove(s)
+		}
+	}
+}
+
+// Counts returns the number of sessions of each expose socket
+func (t *sessionTable) Counts() map[*exposeListener]int {
+	t.RLock()
+	defer t.RUnlock()
+	counts := make(map[*exposeListener]int)
+	for _, s := range t.byPeer {
+		counts[s.listener]++
+	}
+	return counts
+}
+
+// Status lists the sessions by IP
+func (t *sessionTable) Status() []SessionStatus {
+	t.RLock()
+	defer t.RUnlock()
+	list := make([]SessionStatus, 0, len(t.byPeer))
+	for _, s := range t.byPeer {
+		list = append(list, SessionStatus{
+			Token:    s.token,
+			Peer:     s.peer.String(),
+			IP:       s.ip.String(),
+			LastSeen: s.lastSeen.Format(time.RFC3339),
+			RxBytes:  atomic.LoadUint64(&s.rxBytes),
+			TxBytes:  atomic.LoadUint64(&s.txBytes),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// The client and the controls pushed to it, the `iptables` rules and the
+// `hosts`, the `token`s of the expose clients and the installed routes are
+// shared by the UDP loop, the TUN reader, the control and expose sockets, the
+// reloads of the config, the pushed routes, the admin API and the watchers.
+// The client is kept in an atomic value, read on each packet without a lock,
+// the rest under a RWMutex, replaced by the reloads and read as a copy. The
+// routes are still installed and removed under configLock, which orders the
+// changes of the system.
+type sharedState struct {
+	client atomic.Value
+	sync.RWMutex
+	iptables map[string]bool
+	hosts    string
+	tokens   map[string]string
+	// routes are the installed routes, true for those given to expose
+	routes map[string]bool
+}
+
+var shared = newSharedState()
+
+func newSharedState() *sharedState {
+	s := &sharedState{iptables: make(map[string]bool), tokens: make(map[string]string), routes: make(map[string]bool)}
+	s.client.Store((*net.UDPAddr)(nil))
+	return s
+}
+
+// Client returns the address of the docker side, nil without
+func (s *sharedState) Client() *net.UDPAddr {
+	return s.client.Load().(*net.UDPAddr)
+}
+
+// SetClient records the address of the docker side, nil once gone
+func (s *sharedState) SetClient(addr *net.UDPAddr) {
+	s.client.Store(addr)
+}
+
+// ClearClient forgets the docker side at an address, unless another one took
+// its place meanwhile
+func (s *sharedState) ClearClient(addr *net.UDPAddr) {
+	if s.Client() == addr {
+		s.client.Store((*net.UDPAddr)(nil))
+	}
+}
+
+// Controls returns a copy of the `iptables` rules and the `hosts`
+func (s *sharedState) Controls() (map[string]bool, string) {
+	s.RLock()
+	defer s.RUnlock()
+	tables := make(map[string]bool, len(s.iptables))
+	for k, v := range s.iptables {
+		tables[k] = v
+	}
+	return tables, s.hosts
+}
+
+// Hosts returns the `hosts` of the config
+func (s *sharedState) Hosts() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hosts
+}
+
+// SetHosts records the `hosts` of the config
+func (s *sharedState) SetHosts(hosts string) {
+	s.Lock()
+	s.hosts = hosts
+	s.Unlock()
+}
+
+// UpdateIPTables replaces the `iptables` rules, it returns the changes to
+// push, the removed rules turned off
+func (s *sharedState) UpdateIPTables(next map[string]bool) map[string]bool {
+	s.Lock()
+	defer s.Unlock()
+	changes := make(map[string]bool)
+	for key, v := range next {
+		if old, ok := s.iptables[key]; !ok || old != v {
+			changes[key] = v
+		}
+	}
+	for key := range s.iptables {
+		if _, ok := next[key]; !ok {
+			changes[key] = false
+		}
+	}
+	s.iptables = make(map[string]bool, len(next))
+	for key, v := range next {
+		s.iptables[key] = v
+	}
+	return changes
+}
+
+// Tokens returns the IPs of the tokens of the expose clients
+func (s *sharedState) Tokens() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tokens
+}
+
+// SetTokens replaces the tokens, the map is not changed afterwards
+func (s *sharedState) SetTokens(tokens map[string]string) {
+	s.Lock()
+	s.tokens = tokens
+	s.Unlock()
+}
+
+// Routes returns a copy of the installed routes
+func (s *sharedState) Routes() map[string]bool {
+	s.RLock()
+	defer s.RUnlock()
+	routes := make(map[string]bool, len(s.routes))
+	for key, expose := range s.routes {
+		routes[key] = expose
+	}
+	return routes
+}
+
+// HasRoute tells whether a route is installed
+func (s *sharedState) HasRoute(key string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.routes[key]
+	return ok
+}
+
+// SetRoute records an installed route
+func (s *sharedState) SetRoute(key string, expose bool) {
+	s.Lock()
+	s.routes[key] = expose
+	s.Unlock()
+}
+
+// DeleteRoute forgets a removed route
+func (s *sharedState) DeleteRoute(key string) {
+	s.Lock()
+	delete(s.routes, key)
+	s.Unlock()
+}
+
+// SetRoutes replaces the installed routes with a copy of routes
+func (s *sharedState) SetRoutes(routes map[string]bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.routes = make(map[string]bool, len(routes))
+	for key, expose := range routes {
+		s.routes[key] = expose
+	}
+}
+
+// resendControls sends the full controls to the docker side at an address
+func resendControls(to *net.UDPAddr) {
+	tables, hosts := shared.Controls()
+	sendControls(to, tables, hosts, true)
+}
+
+// refreshControls sends the controls changed since the last ones to the docker
+// side at an address, in full unless it takes versions
+func refreshControls(to *net.UDPAddr) {
+	tables, hosts := shared.Controls()
+	sendControls(to, tables, hosts, false)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// TestSharedStateReload reloads the config, with lines pushed by the docker
+// side, while the client comes and goes and the controls are read, as the
+// UDP loop, the control socket and the watcher do. Run it with -race.
+func TestSharedStateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-connector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldConfig, oldState, oldBind, oldConn, oldShared := configFile, stateDir, bind, conn, shared
+	defer func() {
+		configFile, stateDir, bind, conn, shared = oldConfig, oldState, oldBind, oldConn, oldShared
+		statePaths()
+		applyLogLevels(logging.INFO)
+	}()
+	configFile, stateDir, bind, shared = filepath.Join(dir, "docker-connector.conf"), dir, false, newSharedState()
+	statePaths()
+	applyLogLevels(logging.ERROR)
+	const config = "hosts 172.17.0.2 web\niptables 172.17.0.0+172.18.0.0\n"
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadConfig(nil, true)
+
+	// the docker side the controls are sent to
+	cli, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := cli.LocalAddr().(*net.UDPAddr)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tables, hosts := shared.Controls()
+			if hosts == "" {
+				t.Errorf("no hosts while reloading")
+				return
+			}
+			// a copy, changed freely
+			tables["172.30.0.0 172.31.0.0"] = true
+			shared.Client()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				shared.SetClient(addr)
+			} else {
+				shared.ClearClient(shared.Client())
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 65536)
+		for {
+			cli.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, _, err := cli.ReadFromUDP(buf); err != nil {
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		rule := fmt.Sprintf("iptables 172.17.0.0+172.%d.0.0", 20+i%5)
+		for _, line := range []string{rule, "-" + rule} {
+			appendConfig([]byte(line))
+			configLock.Lock()
+			loadConfig(nil, false)
+			configLock.Unlock()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	tables, hosts := shared.Controls()
+	if len(tables) != 1 || !tables["172.17.0.0 172.18.0.0"] || hosts != "172.17.0.2 web" {
+		t.Errorf("controls %v and hosts %q after the reloads", tables, hosts)
+	}
+	if st := configApply.Status(); st == nil || st.Result != "applied" {
+		t.Errorf("last reload %+v", st)
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil || string(data) != config {
+		t.Errorf("config %q after the pushed lines were withdrawn: %v", data, err)
+	}
+}
+
+// TestSharedStateRoutes serves `/status` while the docker side pushes routes,
+// installed and removed under configLock. Run it with -race.
+func TestSharedStateRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-connector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldConfig, oldState, oldBind, oldAdmin, oldShared := configFile, stateDir, bind, adminAddr, shared
+	defer func() {
+		configFile, stateDir, bind, adminAddr, shared = oldConfig, oldState, oldBind, oldAdmin, oldShared
+		statePaths()
+		applyLogLevels(logging.INFO)
+	}()
+	configFile, stateDir, bind, shared = filepath.Join(dir, "docker-connector.conf"), dir, false, newSharedState()
+	statePaths()
+	applyLogLevels(logging.ERROR)
+	if err := ioutil.WriteFile(configFile, []byte("route 172.17.0.0/16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadConfig(nil, true)
+
+	// a free port of the admin API
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminAddr = ln.Addr().String()
+	ln.Close()
+	startAdmin(&Connector{})
+	defer stopAdmin()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			pushRoute(fmt.Sprintf("172.%d.0.0/16", 20+i%5), i%2 == 0)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		rsp, err := http.Get("http://" + adminAddr + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st Status
+		err = json.NewDecoder(rsp.Body).Decode(&st)
+		rsp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := st.Routes["172.17.0.0/16"]; !ok {
+			t.Errorf("routes %v without the one of the config while pushing", st.Routes)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if !shared.HasRoute("172.17.0.0/16") {
+		t.Errorf("routes %v after the pushes", shared.Routes())
+	}
+}
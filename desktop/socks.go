@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"docker-connector/pkg/connector"
+)
+
+// With `socks <listen>` (or `-socks`) the desktop runs a SOCKS5 server whose
+// connections are dialed by the docker side, so the containers are reached
+// without a TUN nor routes: with `-bind=false` it runs without root.
+//
+// For a CONNECT the desktop sends `11 | id(4) | host:port` to the docker side,
+// which dials the target and connects back to the TCP port of the same
+// number as the UDP one, starting with `id(4) | reply code(1)`, the SOCKS
+// reply code of its dial. The datagrams of an UDP ASSOCIATE go both ways as
+// `12 | id(4) | length(1) | host:port | payload`.
+const (
+	socksDial        = connector.SocksDial
+	socksUDP         = connector.SocksUDP
+	socksDialTimeout = 10 * time.Second
+)
+
+var (
+	socksAddr = ""
+	socks     = &socksServer{
+		pending: make(map[uint32]chan net.Conn),
+		assocs:  make(map[uint32]*socksAssoc),
+	}
+)
+
+// SocksStatus describes the SOCKS5 server
+type SocksStatus struct {
+	Listen string `json:"listen"`
+	Stream string `json:"stream"`
+	Active int64  `json:"active"`
+	Total  uint64 `json:"total"`
+	Failed uint64 `json:"failed"`
+	UDP    int    `json:"udp_associations"`
+}
+
+type socksServer struct {
+	// first for 64-bit alignment of the atomic counters
+	total, failed uint64
+	active        int64
+	sync.Mutex
+	ln, stream net.Listener
+	pending    map[uint32]chan net.Conn
+	assocs     map[uint32]*socksAssoc
+}
+
+// socksAssoc is an UDP ASSOCIATE
+type socksAssoc struct {
+	pc     *net.UDPConn
+	client *net.UDPAddr
+	lock   sync.Mutex
+}
+
+// startSocks listens for the SOCKS clients and the connections of the
+// docker side
+func startSocks() {
+	if socksAddr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", socksAddr)
+	if err != nil {
+		logExpose.Warningf("[SOCKS] Failed to listen on %s: %v", socksAddr, err)
+		return
+	}
+	stream, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		ln.Close()
+		logExpose.Warningf("[SOCKS] Failed to listen for the docker side on %s:%d: %v", host, port, err)
+		return
+	}
+	socks.Lock()
+	socks.ln, socks.stream = ln, stream
+	socks.Unlock()
+	logExpose.Infof("[SOCKS] Listening on %v, docker side connecting back to %v", ln.Addr(), stream.Addr())
+	go socks.acceptStreams()
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go socks.serve(client)
+		}
+	}()
+}
+
+// stopSocks closes the listeners
+func stopSocks() {
+	socks.Lock()
+	defer socks.Unlock()
+	if socks.ln != nil {
+		socks.ln.Close()
+		socks.stream.Close()
+	}
+	for id, a := range socks.assocs {
+		a.pc.Close()
+		delete(socks.assocs, id)
+	}
+}
+
+// acceptStreams hands the connections of the docker side to the pending
+// CONNECTs
+func (s *socksServer) acceptStreams() {
+	for {
+		c, err := s.stream.Accept()
+		if err != nil {
+			return
+		}
+		ip := c.RemoteAddr().(*net.TCPAddr).IP
+		if !peersAllow.Allowed(ip) || !knocks.Allowed(ip) {
+			c.Close()
+			continue
+		}
+		go func() {
+			var header [4]byte
+			c.SetReadDeadline(time.Now().Add(socksDialTimeout))
+			if _, err := io.ReadFull(c, header[:]); err != nil {
+				c.Close()
+				return
+			}
+			c.SetReadDeadline(time.Time{})
+			s.Lock()
+			ch := s.pending[binary.BigEndian.Uint32(header[:])]
+			s.Unlock()
+			if ch == nil {
+				c.Close()
+				return
+			}
+			select {
+			case ch <- c:
+			default:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// newID registers a request to the docker side
+func (s *socksServer) newID(ch chan net.Conn) uint32 {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		id := rand.Uint32()
+		if _, ok := s.pending[id]; !ok && id != 0 && s.assocs[id] == nil {
+			if ch != nil {
+				s.pending[id] = ch
+			}
+			return id
+		}
+	}
+}
+
+// socksMessage builds a message of the type to the docker side
+func socksMessage(typ byte, id uint32, target string, payload []byte) []byte {
+	msg := make([]byte, 6+len(target)+len(payload))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], id)
+	if typ == socksDial {
+		copy(msg[5:], target)
+		return msg[:5+len(target)]
+	}
+	msg[5] = byte(len(target))
+	copy(msg[6:], target)
+	copy(msg[6+len(target):], payload)
+	return msg
+}
+
+// readSocksAddr reads the address of a request, as host:port
+func readSocksAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if atyp == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("address type %d not supported", atyp)
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:])))), nil
+}
+
+// socksReply builds a reply with the code and bound address
+func socksReply(code byte, addr net.Addr) []byte {
+	reply := []byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0}
+	if a, ok := addr.(*net.UDPAddr); ok && a.IP.To4() != nil {
+		copy(reply[4:8], a.IP.To4())
+		binary.BigEndian.PutUint16(reply[8:], uint16(a.Port))
+	}
+	return reply
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(socksDialTimeout))
+	var hello [2]byte
+	if _, err := io.ReadFull(c, hello[:]); err != nil || hello[0] != 5 {
+		return
+	}
+	methods := make([]byte, hello[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	// no authentication, the server should only listen on the loopback
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil || req[0] != 5 {
+		return
+	}
+	target, err := readSocksAddr(c, req[3])
+	if err != nil {
+		c.Write(socksReply(8, nil))
+		return
+	}
+	c.SetDeadline(time.Time{})
+	peer := shared.Client()
+	if peer == nil {
+		logExpose.Warningf("[SOCKS] No client connected, refusing %s", target)
+		atomic.AddUint64(&s.failed, 1)
+		c.Write(socksReply(1, nil))
+		return
+	}
+	switch req[1] {
+	case 1:
+		s.connect(c, peer, target)
+	case 3:
+		s.associate(c, peer)
+	default:
+		c.Write(socksReply(7, nil))
+	}
+}
+
+// dial asks the docker side to dial the target, it returns the connection
+// or the SOCKS reply code of the failure
+func (s *socksServer) dial(peer *net.UDPAddr, target string) (net.Conn, byte) {
+	ch := make(chan net.Conn, 1)
+	id := s.newID(ch)
+	defer func() {
+		s.Lock()
+		delete(s.pending, id)
+		s.Unlock()
+	}()
+	if _, err := conn.WriteToUDP(socksMessage(socksDial, id, target, nil), peer); err != nil {
+		return nil, 1
+	}
+	var remote net.Conn
+	select {
+	case remote = <-ch:
+	case <-time.After(socksDialTimeout + 2*time.Second):
+		logExpose.Warningf("[SOCKS] %s: no answer from the docker side %v", target, peer)
+		return nil, 1
+	}
+	code := []byte{1}
+	if _, err := io.ReadFull(remote, code); err != nil || code[0] != 0 {
+		remote.Close()
+		return nil, code[0]
+	}
+	return remote, 0
+}
+
+// connect runs a CONNECT through the docker side
+func (s *socksServer) connect(c net.Conn, peer *net.UDPAddr, target string) {
+	remote, code := s.dial(peer, target)
+	if remote == nil {
+		logExpose.Debugf("[SOCKS] %v => %s failed with code %d", c.RemoteAddr(), target, code)
+		atomic.AddUint64(&s.failed, 1)
+		c.Write(socksReply(code, nil))
+		return
+	}
+	defer remote.Close()
+	if _, err := c.Write(socksReply(0, nil)); err != nil {
+		return
+	}
+	atomic.AddUint64(&s.total, 1)
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+	logExpose.Debugf("[SOCKS] %v => %s connected", c.RemoteAddr(), target)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, c)
+		if t, ok := remote.(*net.TCPConn); ok {
+			t.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(c, remote)
+	if t, ok := c.(*net.TCPConn); ok {
+		t.CloseWrite()
+	}
+	<-done
+}
+
+// associate runs an UDP ASSOCIATE until its TCP connection is closed
+func (s *socksServer) associate(c net.Conn, peer *net.UDPAddr) {
+	local := c.LocalAddr().(*net.TCPAddr)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		c.Write(socksReply(1, nil))
+		return
+	}
+	a := &socksAssoc{pc: pc}
+	id := s.newID(nil)
+	s.Lock()
+	s.assocs[id] = a
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.assocs, id)
+		s.Unlock()
+		pc.Close()
+	}()
+	if _, err := c.Write(socksReply(0, pc.LocalAddr())); err != nil {
+		return
+	}
+	atomic.AddUint64(&s.total, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		clientIP := c.RemoteAddr().(*net.TCPAddr).IP
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// RSV(2) FRAG(1) ATYP(1), fragments are not supported
+			if !from.IP.Equal(clientIP) || n < 4 || buf[2] != 0 {
+				continue
+			}
+			r := bytes.NewReader(buf[4:n])
+			target, err := readSocksAddr(r, buf[3])
+			if err != nil || len(target) > 255 {
+				continue
+			}
+			a.lock.Lock()
+			a.client = from
+			a.lock.Unlock()
+			conn.WriteToUDP(socksMessage(socksUDP, id, target, buf[n-r.Len():n]), peer)
+		}
+	}()
+	io.Copy(ioutil.Discard, c)
+}
+
+// deliverSocksUDP sends a datagram of the docker side to the client of its
+// association
+func deliverSocksUDP(data []byte) {
+	if len(data) < 6 || len(data) < 6+int(data[5]) {
+		return
+	}
+	id := binary.BigEndian.Uint32(data[1:])
+	socks.Lock()
+	a := socks.assocs[id]
+	socks.Unlock()
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	client := a.client
+	a.lock.Unlock()
+	from, err := net.ResolveUDPAddr("udp", string(data[6:6+data[5]]))
+	if client == nil || err != nil {
+		return
+	}
+	header := []byte{0, 0, 0, 1}
+	ip := from.IP.To4()
+	if ip == nil {
+		header[3] = 4
+		ip = from.IP.To16()
+	}
+	packet := append(append(header, ip...), byte(from.Port>>8), byte(from.Port))
+	a.pc.WriteToUDP(append(packet, data[6+data[5]:]...), client)
+}
+
+// Status describes the SOCKS5 server, nil when disabled
+func (s *socksServer) Status() *SocksStatus {
+	s.Lock()
+	defer s.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return &SocksStatus{
+		Listen: s.ln.Addr().String(),
+		Stream: s.stream.Addr().String(),
+		Active: atomic.LoadInt64(&s.active),
+		Total:  atomic.LoadUint64(&s.total),
+		Failed: atomic.LoadUint64(&s.failed),
+		UDP:    len(s.assocs),
+	}
+}
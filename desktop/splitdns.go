@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The docker side started with `-kube` or `-compose` pushes
+// `dns <domain> <server>` for the local clusters or the compose projects, e.g.
+// `dns cluster.local 10.96.0.10`, and `dns <domain>` once they are gone. The names under the domain are then resolved by the
+// server through the tunnel: a file of /etc/resolver on macOS, the domain of
+// the TUN link with systemd-resolved on linux, an NRPT rule on windows. The
+// pushed domains aren't written to the config, they are pushed again
+// periodically and cleared on stop.
+//
+// `resolver <domain> [server]` of the config registers a domain the same way,
+// resolved by default by the dns server of the docker side at the tunnel
+// address, so the names of the containers resolve system-wide:
+//
+//	resolver docker.internal
+//	resolver corp.example 10.10.0.53
+//
+// The configured domains are set when the config is loaded, take precedence
+// over the pushed ones and are removed on stop.
+var (
+	splitDNS     = make(map[string]string)
+	resolvers    = make(map[string]string)
+	splitDNSLock sync.Mutex
+	domainName   = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+)
+
+// pushedDNS handles a pushed dns line, it returns false for the other lines
+func pushedDNS(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || fields[0] != "dns" {
+		return false
+	}
+	domain := strings.Trim(strings.ToLower(fields[1]), ".")
+	if !domainName.MatchString(domain) {
+		logDNS.Warningf("[DNS PUSH] Invalid domain => %s", line)
+		return true
+	}
+	splitDNSLock.Lock()
+	defer splitDNSLock.Unlock()
+	if len(fields) == 2 {
+		if _, ok := splitDNS[domain]; !ok {
+			return true
+		}
+		delete(splitDNS, domain)
+		if resolvers[domain] != "" {
+			return true
+		}
+		logDNS.Infof("[DNS PUSH] Removing %s", domain)
+		events.Add("dns", "removed %s", domain)
+		if err := clearSplitDNS(domain); err != nil {
+			logDNS.Warningf("[DNS PUSH] Failed to remove %s: %v", domain, err)
+		}
+		return true
+	}
+	server := net.ParseIP(fields[2])
+	if server == nil {
+		logDNS.Warningf("[DNS PUSH] Invalid server => %s", line)
+		return true
+	}
+	if splitDNS[domain] == server.String() {
+		return true
+	}
+	splitDNS[domain] = server.String()
+	if resolvers[domain] != "" {
+		logDNS.Infof("[DNS PUSH] %s configured with %s, ignoring %s", domain, resolvers[domain], server)
+		return true
+	}
+	logDNS.Infof("[DNS PUSH] Resolving *.%s with %s", domain, server)
+	events.Add("dns", "*.%s with %s", domain, server)
+	if err := setSplitDNS(domain, server.String()); err != nil {
+		logDNS.Warningf("[DNS PUSH] Failed to set %s: %v", domain, err)
+	}
+	return true
+}
+
+// splitDNSDomains returns the pushed domains in order
+func splitDNSDomains() []string {
+	var domains []string
+	for domain := range splitDNS {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// activeDNS returns the domains in effect and their servers, the configured
+// ones over the pushed ones
+func activeDNS() map[string]string {
+	active := make(map[string]string)
+	for domain, server := range splitDNS {
+		active[domain] = server
+	}
+	for domain, server := range resolvers {
+		active[domain] = server
+	}
+	return active
+}
+
+// clearPushedDNS removes the pushed domains on stop
+func clearPushedDNS() {
+	splitDNSLock.Lock()
+	defer splitDNSLock.Unlock()
+	for _, domain := range splitDNSDomains() {
+		delete(splitDNS, domain)
+		if resolvers[domain] != "" {
+			continue
+		}
+		if err := clearSplitDNS(domain); err != nil {
+			logDNS.Warningf("[DNS PUSH] Failed to remove %s: %v", domain, err)
+		}
+	}
+}
+
+// parseResolver parses the value of `resolver`, the server being empty for
+// the tunnel address
+func parseResolver(val string) (string, string, error) {
+	vals := strings.Fields(val)
+	if len(vals) == 0 || len(vals) > 2 {
+		return "", "", fmt.Errorf("expected <domain> [server]")
+	}
+	domain := strings.Trim(strings.ToLower(vals[0]), ".")
+	if !domainName.MatchString(domain) {
+		return "", "", fmt.Errorf("invalid domain %s", vals[0])
+	}
+	if len(vals) == 1 {
+		return domain, "", nil
+	}
+	server := net.ParseIP(vals[1])
+	if server == nil {
+		return "", "", fmt.Errorf("invalid server %s", vals[1])
+	}
+	return domain, server.String(), nil
+}
+
+// setResolvers applies the configured domains, restoring the pushed server of
+// a removed one
+func setResolvers(entries map[string]string) {
+	splitDNSLock.Lock()
+	defer splitDNSLock.Unlock()
+	for domain := range resolvers {
+		if _, ok := entries[domain]; ok {
+			continue
+		}
+		delete(resolvers, domain)
+		if server, ok := splitDNS[domain]; ok {
+			logDNS.Infof("[DNS] Resolving *.%s with the pushed %s", domain, server)
+			if err := setSplitDNS(domain, server); err != nil {
+				logDNS.Warningf("[DNS] Failed to set %s: %v", domain, err)
+			}
+			continue
+		}
+		logDNS.Infof("[DNS] Removing %s", domain)
+		if err := clearSplitDNS(domain); err != nil {
+			logDNS.Warningf("[DNS] Failed to remove %s: %v", domain, err)
+		}
+	}
+	for domain, server := range entries {
+		if resolvers[domain] == server {
+			continue
+		}
+		resolvers[domain] = server
+		logDNS.Infof("[DNS] Resolving *.%s with %s", domain, server)
+		if err := setSplitDNS(domain, server); err != nil {
+			logDNS.Warningf("[DNS] Failed to set %s: %v", domain, err)
+		}
+	}
+}
+
+// clearResolvers removes the configured domains on stop
+func clearResolvers() {
+	splitDNSLock.Lock()
+	defer splitDNSLock.Unlock()
+	for domain := range resolvers {
+		delete(resolvers, domain)
+		if err := clearSplitDNS(domain); err != nil {
+			logDNS.Warningf("[DNS] Failed to remove %s: %v", domain, err)
+		}
+	}
+}
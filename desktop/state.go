@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// `-state-dir` holds the runtime state of the connector, the saved peer, the
+// pid file, the journal of the routes, the metrics and the audit log, instead of the temporary directory shared by the users, for
+// sandboxed installs and machines with several users. It is created at start
+// readable by all and writable by its owner only, and the peer saved in the
+// temporary directory by a previous version is moved to it. An `-instance`
+// keeps its state in a directory of its own in it.
+const (
+	peerFileName = "desktop-docker-connector.peer"
+	pidFileName  = "desktop-docker-connector.pid"
+)
+
+var stateDir = ""
+
+// statePaths places the state files in `-state-dir`
+func statePaths() {
+	dir := stateDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir = instanceDir(dir)
+	TmpPeer = filepath.Join(dir, peerFileName)
+	PidFile = filepath.Join(dir, pidFileName)
+	RoutesFile = filepath.Join(dir, routesFileName)
+	ProfileFile = filepath.Join(dir, profileFileName)
+	PinsFile = filepath.Join(dir, pinsFileName)
+	MetricsFile = filepath.Join(dir, metricsFileName)
+	AuditFile = filepath.Join(dir, auditFileName)
+	AdminFile = filepath.Join(dir, adminFileName)
+	HandoverFile = filepath.Join(dir, handoverFileName)
+	ConfigRejectedFile = filepath.Join(dir, configRejectedFileName)
+}
+
+// prepareStateDir creates `-state-dir` and moves the state of the temporary
+// directory to it
+func prepareStateDir() {
+	statePaths()
+	if stateDir == "" && instanceName == "" {
+		return
+	}
+	dir := filepath.Dir(PidFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Warningf("[STATE] Failed to create %s: %v", dir, err)
+		return
+	}
+	if info, err := os.Stat(dir); err == nil && info.Mode().Perm()&0022 != 0 {
+		if err := os.Chmod(dir, 0755); err != nil {
+			logger.Warningf("[STATE] %s is writable by others: %v", dir, err)
+		}
+	}
+	old := filepath.Join(os.TempDir(), peerFileName)
+	if _, err := os.Stat(TmpPeer); os.IsNotExist(err) && old != TmpPeer && !selftest && instanceName == "" {
+		if err := os.Rename(old, TmpPeer); err == nil {
+			logger.Infof("[STATE] Moved %s to %s", old, TmpPeer)
+		}
+	}
+	logger.Infof("[STATE] State in %s", dir)
+}
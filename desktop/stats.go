@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// SubnetTraffic is the traffic carried for one routed subnet, `tx` is desktop
+// to docker and `rx` is docker to desktop.
+type SubnetTraffic struct {
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+}
+
+type subnetCounter struct {
+	SubnetTraffic // first for 64-bit alignment of the atomic counters
+	key           string
+	ipnet         *net.IPNet
+}
+
+type trafficStats struct {
+	sync.RWMutex
+	subnets []*subnetCounter
+	other   subnetCounter
+}
+
+var traffic = &trafficStats{}
+
+// Update rebuilds the subnet list from the routes, keeping the counters of the
+// subnets that are still routed. More specific subnets are matched first.
+func (t *trafficStats) Update(keys map[string]bool) {
+	t.Lock()
+	defer t.Unlock()
+	old := make(map[string]*subnetCounter)
+	for _, c := range t.subnets {
+		old[c.key] = c
+	}
+	subnets := make([]*subnetCounter, 0, len(keys))
+	for key := range keys {
+		if c, ok := old[key]; ok {
+			subnets = append(subnets, c)
+		} else if _, ipnet, err := net.ParseCIDR(key); err == nil {
+			subnets = append(subnets, &subnetCounter{key: key, ipnet: ipnet})
+		}
+	}
+	sort.Slice(subnets, func(i, j int) bool {
+		oi, _ := subnets[i].ipnet.Mask.Size()
+		oj, _ := subnets[j].ipnet.Mask.Size()
+		return oi > oj
+	})
+	t.subnets = subnets
+}
+
+func (t *trafficStats) find(ip net.IP) *subnetCounter {
+	for _, c := range t.subnets {
+		if c.ipnet.Contains(ip) {
+			return c
+		}
+	}
+	return &t.other
+}
+
+// Count adds a packet of `n` bytes addressed to or from `ip`
+func (t *trafficStats) Count(ip net.IP, n int, tx bool) {
+	t.RLock()
+	c := t.find(ip)
+	t.RUnlock()
+	if tx {
+		atomic.AddUint64(&c.TxBytes, uint64(n))
+		atomic.AddUint64(&c.TxPackets, 1)
+	} else {
+		atomic.AddUint64(&c.RxBytes, uint64(n))
+		atomic.AddUint64(&c.RxPackets, 1)
+	}
+}
+
+func (c *subnetCounter) snapshot() SubnetTraffic {
+	return SubnetTraffic{
+		TxBytes:   atomic.LoadUint64(&c.TxBytes),
+		TxPackets: atomic.LoadUint64(&c.TxPackets),
+		RxBytes:   atomic.LoadUint64(&c.RxBytes),
+		RxPackets: atomic.LoadUint64(&c.RxPackets),
+	}
+}
+
+// Snapshot returns the counters by subnet, unrouted traffic is under `other`
+func (t *trafficStats) Snapshot() map[string]SubnetTraffic {
+	t.RLock()
+	defer t.RUnlock()
+	m := make(map[string]SubnetTraffic, len(t.subnets)+1)
+	for _, c := range t.subnets {
+		m[c.key] = c.snapshot()
+	}
+	m["other"] = t.other.snapshot()
+	return m
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// `-status-file` writes the status of the admin API every `-status-interval`
+// to a file, for the menubar apps, scripts and monitoring agents reading the
+// state without the API. The file is replaced atomically, with the time it
+// was written, the pid, the state, `running` or `stopped` once stopped, and
+// the last warnings and errors of the log.
+const statusErrors = 10
+
+var (
+	statusFile     = ""
+	statusInterval = 10 * time.Second
+
+	statusFileLock sync.Mutex
+	statusStopped  bool
+)
+
+// statusSnapshot is the content of `-status-file`
+type statusSnapshot struct {
+	Written string `json:"written"`
+	Pid     int    `json:"pid"`
+	State   string `json:"state"`
+	*Status
+	Errors []string `json:"last_errors,omitempty"`
+}
+
+// lastErrors returns the last warnings and errors kept by the log
+func lastErrors(n int) []string {
+	var errs []string
+	recent := logs.Recent()
+	for i := len(recent) - 1; i >= 0 && len(errs) < n; i-- {
+		if recent[i].Level <= logging.WARNING {
+			errs = append(errs, recent[i].String())
+		}
+	}
+	return errs
+}
+
+// writeStatusFile replaces `-status-file` with the current status
+func writeStatusFile(c *Connector, state string) {
+	if statusFile == "" {
+		return
+	}
+	statusFileLock.Lock()
+	defer statusFileLock.Unlock()
+	if statusStopped {
+		return
+	}
+	statusStopped = state == "stopped"
+	snap := &statusSnapshot{
+		Written: time.Now().Format(time.RFC3339),
+		Pid:     os.Getpid(),
+		State:   state,
+		Errors:  lastErrors(statusErrors),
+	}
+	// the routes of the status change with the reloads
+	configLock.Lock()
+	snap.Status = collectStatus(c)
+	data, err := json.MarshalIndent(snap, "", "  ")
+	configLock.Unlock()
+	if err != nil {
+		logger.Debugf("[STATUS] Failed to encode the status: %v", err)
+		return
+	}
+	tmp := statusFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		logger.Debugf("[STATUS] Failed to write %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, statusFile); err != nil {
+		logger.Debugf("[STATUS] Failed to write %s: %v", statusFile, err)
+	}
+}
+
+// watchStatusFile writes `-status-file` periodically until stopped
+func (c *Connector) watchStatusFile() {
+	if statusFile == "" || statusInterval <= 0 {
+		return
+	}
+	logger.Infof("[STATUS] Writing %s every %v", statusFile, statusInterval)
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		if !isIdle() {
+			writeStatusFile(c, "running")
+		}
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
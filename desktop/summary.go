@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// summaryDestinations bounds the destinations tracked by a session
+	summaryDestinations = 4096
+	// summaryTop is the number of destinations reported by a summary
+	summaryTop = 5
+	// summaryKeep is the number of summaries kept for the status
+	summaryKeep = 10
+)
+
+// PeerSummary sums up the session of a client, from its first heartbeat
+// until it is declared dead or replaced
+type PeerSummary struct {
+	Client       string            `json:"client"`
+	Start        string            `json:"start"`
+	End          string            `json:"end"`
+	Duration     string            `json:"duration"`
+	Reason       string            `json:"reason"`
+	TxBytes      uint64            `json:"tx_bytes"`
+	TxPackets    uint64            `json:"tx_packets"`
+	RxBytes      uint64            `json:"rx_bytes"`
+	RxPackets    uint64            `json:"rx_packets"`
+	Destinations []DestTraffic     `json:"top_destinations,omitempty"`
+	Drops        map[string]uint64 `json:"drops,omitempty"`
+}
+
+// DestTraffic is the traffic sent to a destination
+type DestTraffic struct {
+	IP    string `json:"ip"`
+	Bytes uint64 `json:"bytes"`
+}
+
+type peerSession struct {
+	// first for 64-bit alignment of the atomic counters
+	txBytes, txPackets uint64
+	rxBytes, rxPackets uint64
+	sync.Mutex
+	client  string
+	start   time.Time
+	dests   map[uint32]uint64
+	drops   map[string]uint64
+	history []PeerSummary
+}
+
+var peerStats = &peerSession{}
+
+// Begin starts the session of a client, ending the previous one
+func (s *peerSession) Begin(client string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.client != "" {
+		s.end("replaced by " + client)
+	}
+	s.client = client
+	s.start = time.Now()
+	atomic.StoreUint64(&s.txBytes, 0)
+	atomic.StoreUint64(&s.txPackets, 0)
+	atomic.StoreUint64(&s.rxBytes, 0)
+	atomic.StoreUint64(&s.rxPackets, 0)
+	s.dests = make(map[uint32]uint64)
+	s.drops = make(map[string]uint64)
+}
+
+// End logs the summary of the session of the client
+func (s *peerSession) End(reason string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.client != "" {
+		s.end(reason)
+	}
+}
+
+func (s *peerSession) end(reason string) {
+	now := time.Now()
+	sum := PeerSummary{
+		Client:    s.client,
+		Start:     s.start.Format(time.RFC3339),
+		End:       now.Format(time.RFC3339),
+		Duration:  now.Sub(s.start).Round(time.Second).String(),
+		Reason:    reason,
+		TxBytes:   atomic.LoadUint64(&s.txBytes),
+		TxPackets: atomic.LoadUint64(&s.txPackets),
+		RxBytes:   atomic.LoadUint64(&s.rxBytes),
+		RxPackets: atomic.LoadUint64(&s.rxPackets),
+	}
+	for ip, n := range s.dests {
+		dst := net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String()
+		sum.Destinations = append(sum.Destinations, DestTraffic{IP: dst, Bytes: n})
+	}
+	sort.Slice(sum.Destinations, func(i, j int) bool { return sum.Destinations[i].Bytes > sum.Destinations[j].Bytes })
+	if len(sum.Destinations) > summaryTop {
+		sum.Destinations = sum.Destinations[:summaryTop]
+	}
+	if len(s.drops) > 0 {
+		sum.Drops = s.drops
+	}
+	s.client = ""
+	s.dests = nil
+	s.drops = nil
+	s.history = append(s.history, sum)
+	if len(s.history) > summaryKeep {
+		s.history = s.history[len(s.history)-summaryKeep:]
+	}
+	var top, drops []string
+	for _, d := range sum.Destinations {
+		top = append(top, fmt.Sprintf("%s %d", d.IP, d.Bytes))
+	}
+	for reason, n := range sum.Drops {
+		drops = append(drops, fmt.Sprintf("%s %d", reason, n))
+	}
+	sort.Strings(drops)
+	logHealth.Infof("[SUMMARY] Client %s %s after %s: tx %d bytes/%d packets, rx %d bytes/%d packets, top [%s], drops [%s]",
+		sum.Client, reason, sum.Duration, sum.TxBytes, sum.TxPackets, sum.RxBytes, sum.RxPackets,
+		strings.Join(top, ", "), strings.Join(drops, ", "))
+}
+
+// Sent counts a packet sent to the client
+func (s *peerSession) Sent(packet []byte) {
+	atomic.AddUint64(&s.txBytes, uint64(len(packet)))
+	atomic.AddUint64(&s.txPackets, 1)
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	dst := uint32(packet[16])<<24 | uint32(packet[17])<<16 | uint32(packet[18])<<8 | uint32(packet[19])
+	s.Lock()
+	if s.dests != nil {
+		if _, ok := s.dests[dst]; ok || len(s.dests) < summaryDestinations {
+			s.dests[dst] += uint64(len(packet))
+		}
+	}
+	s.Unlock()
+}
+
+// Received counts a packet received from the client
+func (s *peerSession) Received(n int) {
+	atomic.AddUint64(&s.rxBytes, uint64(n))
+	atomic.AddUint64(&s.rxPackets, 1)
+}
+
+// Drop counts a packet dropped for the reason
+func (s *peerSession) Drop(reason string) {
+	s.Lock()
+	if s.drops != nil {
+		s.drops[reason]++
+	}
+	s.Unlock()
+}
+
+// Dropped returns the packets dropped in the session
+func (s *peerSession) Dropped() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	var n uint64
+	for _, c := range s.drops {
+		n += c
+	}
+	return n
+}
+
+// History returns the latest summaries
+func (s *peerSession) History() []PeerSummary {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.history) == 0 {
+		return nil
+	}
+	return append([]PeerSummary(nil), s.history...)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Under systemd the UDP socket of the tunnel may come from a socket unit,
+// `ListenDatagram=2511`, passed as the first descriptor of LISTEN_FDS, so the
+// port is held across restarts and the connector needs no privilege to bind
+// it. With `Type=notify` the connector tells systemd it is ready once the TUN
+// and the socket are up, and with `WatchdogSec=` it pings the watchdog as long
+// as the TUN and the socket exist and a reload doesn't hang, systemd
+// restarting it otherwise. Elsewhere none of the variables is set and nothing
+// changes.
+const listenFdsStart = 3
+
+// activatedUDP returns the UDP socket passed by systemd, nil without one
+func activatedUDP() *net.UDPConn {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil
+	}
+	// the children, the hooks and scripts, don't inherit them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds > 1 {
+		logger.Warningf("[SYSTEMD] %d sockets passed, using the first one", fds)
+	}
+	f := os.NewFile(listenFdsStart, "systemd")
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		logger.Warningf("[SYSTEMD] Passed socket unusable: %v", err)
+		return nil
+	}
+	c, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		logger.Warningf("[SYSTEMD] Passed socket is not UDP: %v", pc.LocalAddr())
+		return nil
+	}
+	if bindIface != "" {
+		logger.Warningf("[SYSTEMD] bind-interface %s not applied to the passed socket", bindIface)
+	}
+	return c
+}
+
+// sdNotify sends a state to systemd, it does nothing when not supervised
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		logger.Debugf("[SYSTEMD] Failed to notify %s: %v", state, err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		logger.Debugf("[SYSTEMD] Failed to notify %s: %v", state, err)
+	}
+}
+
+// watchdog pings the watchdog of systemd at half its timeout while alive
+func (c *Connector) watchdog() {
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if pid := os.Getenv("WATCHDOG_PID"); usec <= 0 || pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logger.Infof("[SYSTEMD] Watchdog every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h := checkHealth(c)
+			if !h.Socket || bind && !h.Interface {
+				logger.Warningf("[SYSTEMD] Watchdog not pinged: %v", h.Problems)
+				continue
+			}
+			// a reload stuck with the lock stops the pings too
+			configLock.Lock()
+			configLock.Unlock()
+			sdNotify("WATCHDOG=1")
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
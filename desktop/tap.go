@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"docker-connector/pkg/connector"
+)
+
+// With `tap on` the desktop creates a tap device and offers `mode tap` in
+// the controls. Once the docker side accepts with its features byte, the
+// ethernet frames are sent as is in datagrams of
+//
+//	10 | ethernet frame
+//
+// so ARP, DHCP and non-IP protocols cross the tunnel. Until then, the tap
+// device acts as a TUN: IP packets are unwrapped, IPv4 ARP requests answered
+// with the MAC of a virtual gateway and the other frames dropped.
+const (
+	tapType      = connector.Tap
+	featureTAP   = connector.FeatureTAP
+	etherHeader  = 14
+	etherIPv4    = 0x0800
+	etherARP     = 0x0806
+	etherIPv6    = 0x86dd
+	arpPacketLen = 28
+)
+
+var (
+	tapMode = false
+	// gatewayMAC is the locally administered MAC answering ARP requests
+	gatewayMAC = net.HardwareAddr{0x02, 0x64, 0x63, 0x00, 0x00, 0x01}
+)
+
+// TapStatus reports the negotiated layer of the tunnel
+type TapStatus struct {
+	Enabled bool   `json:"enabled"`
+	Peer    bool   `json:"peer"`
+	MAC     string `json:"mac,omitempty"`
+}
+
+// tapDevice is a tap device seen as a TUN by the forwarding loops
+type tapDevice struct {
+	dev tunDevice
+	// mac of the device, learned from its frames
+	mac atomic.Value
+}
+
+func newTAP(dev tunDevice) *tapDevice {
+	return &tapDevice{dev: dev}
+}
+
+func tapStatus(iface tunDevice) *TapStatus {
+	s := &TapStatus{Enabled: tapMode, Peer: bridged()}
+	if t, ok := iface.(*tapDevice); ok {
+		if mac, ok := t.mac.Load().(net.HardwareAddr); ok {
+			s.MAC = mac.String()
+		}
+	}
+	return s
+}
+
+// bridged reports whether the frames are sent as is
+func bridged() bool {
+	return tapMode && atomic.LoadInt32(&peerFeatures)&featureTAP != 0
+}
+
+func (t *tapDevice) Name() string {
+	return t.dev.Name()
+}
+
+func (t *tapDevice) Close() error {
+	return t.dev.Close()
+}
+
+// Read returns the next IP packet of the device, the frames read meanwhile
+// are sent to the docker side when bridged
+func (t *tapDevice) Read(b []byte) (int, error) {
+	fb := getBuffer(1 + len(b) + etherHeader)
+	defer putBuffer(fb)
+	buf := *fb
+	buf[0] = tapType
+	for {
+		n, err := t.dev.Read(buf[1:])
+		if err != nil {
+			return 0, err
+		}
+		if n < etherHeader {
+			continue
+		}
+		frame := buf[1 : 1+n]
+		if old, _ := t.mac.Load().(net.HardwareAddr); !bytes.Equal(frame[6:12], old) {
+			t.mac.Store(append(net.HardwareAddr(nil), frame[6:12]...))
+		}
+		if bridged() {
+			if peer := shared.Client(); peer != nil {
+				if err := writePacket(buf[:1+n], peer); err != nil {
+					logTransport.Warningf("[TAP] Failed to send %d bytes frame to %v: %v", n, peer, err)
+				}
+			}
+			continue
+		}
+		switch binary.BigEndian.Uint16(frame[12:14]) {
+		case etherIPv4, etherIPv6:
+			return copy(b, frame[etherHeader:]), nil
+		case etherARP:
+			if reply := arpReply(frame); reply != nil {
+				t.dev.Write(reply)
+			}
+		}
+	}
+}
+
+// Write sends an IP packet to the device from the virtual gateway
+func (t *tapDevice) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	fb := getBuffer(etherHeader + len(b))
+	defer putBuffer(fb)
+	frame := *fb
+	if mac, ok := t.mac.Load().(net.HardwareAddr); ok {
+		copy(frame[0:6], mac)
+	} else {
+		copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+	copy(frame[6:12], gatewayMAC)
+	typ := uint16(etherIPv4)
+	if b[0]>>4 == 6 {
+		typ = etherIPv6
+	}
+	binary.BigEndian.PutUint16(frame[12:14], typ)
+	copy(frame[etherHeader:], b)
+	if _, err := t.dev.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteFrame writes a frame of the docker side to the device
+func (t *tapDevice) WriteFrame(frame []byte) error {
+	if len(frame) < etherHeader {
+		return nil
+	}
+	_, err := t.dev.Write(frame)
+	return err
+}
+
+// arpReply answers an IPv4 ARP request with the MAC of the gateway, except
+// the probes of the address of the device itself
+func arpReply(frame []byte) []byte {
+	arp := frame[etherHeader:]
+	if len(arp) < arpPacketLen || binary.BigEndian.Uint16(arp[0:2]) != 1 ||
+		binary.BigEndian.Uint16(arp[2:4]) != etherIPv4 || arp[4] != 6 || arp[5] != 4 ||
+		binary.BigEndian.Uint16(arp[6:8]) != 1 {
+		return nil
+	}
+	sha, spa, tpa := arp[8:14], arp[14:18], arp[24:28]
+	if net.IP(spa).Equal(net.IPv4zero) || net.IP(spa).Equal(net.IP(tpa)) {
+		return nil
+	}
+	reply := make([]byte, etherHeader+arpPacketLen)
+	copy(reply[0:6], sha)
+	copy(reply[6:12], gatewayMAC)
+	binary.BigEndian.PutUint16(reply[12:14], etherARP)
+	r := reply[etherHeader:]
+	copy(r[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(r[6:8], 2)
+	copy(r[8:14], gatewayMAC)
+	copy(r[14:18], tpa)
+	copy(r[18:24], sha)
+	copy(r[24:28], spa)
+	return reply
+}
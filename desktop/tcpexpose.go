@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `expose-tcp <listen> <container ip:port>` listens on a host port and
+// proxies each accepted connection to the container through the tunnel. The
+// connection to the container is sourced from the TUN address, so every
+// exposed connection is a TCP stream of its own inside the tunnel, framed
+// and retransmitted by TCP end to end, e.g. to share the Postgres of a
+// container with the LAN:
+//
+//	expose-tcp 0.0.0.0:5432 172.100.0.5:5432
+//
+// `limit=<rate>` caps each direction of the mapping, shared by its
+// connections, and `max-conns=<n>` closes the connections accepted beyond n
+// at once, so a port shared with the team can't overwhelm the laptop or the
+// tunnel.
+const tcpExposeDial = 10 * time.Second
+
+// TCPExposeStatus describes an exposed container port
+type TCPExposeStatus struct {
+	Listen  string `json:"listen"`
+	Target  string `json:"target"`
+	Active  int64  `json:"active"`
+	Total   uint64 `json:"total"`
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBytes uint64 `json:"rx_bytes"`
+	// Limit is the rate of each direction in bits per second
+	Limit    uint64 `json:"limit,omitempty"`
+	MaxConns int64  `json:"max_conns,omitempty"`
+	Refused  uint64 `json:"refused,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// tcpExposeRule is an `expose-tcp` line by listen address
+type tcpExposeRule struct {
+	target string
+	// rate is in bytes per second, 0 for unlimited
+	rate     float64
+	maxConns int64
+}
+
+type tcpExpose struct {
+	// first for 64-bit alignment of the atomic counters
+	total, tx, rx, refused uint64
+	active, maxConns       int64
+	// tag prefixes the log lines of the connections
+	tag    string
+	listen string
+	target string
+	// proxy starts the connections with a PROXY protocol v2 header
+	proxy bool
+	// up limits client->container, down container->client, nil for the forwards
+	up, down *tokenBucket
+	// rate is the one of the buckets, set under the lock of the table
+	rate float64
+	ln   net.Listener
+	err  string
+}
+
+type tcpExposeTable struct {
+	sync.Mutex
+	entries map[string]*tcpExpose
+}
+
+var tcpExposes = &tcpExposeTable{entries: make(map[string]*tcpExpose)}
+
+// parseTCPExpose parses `expose-tcp <listen> <container ip:port> [portmap]
+// [limit=<rate>] [max-conns=<n>]`, and returns whether portmap is set
+func parseTCPExpose(val string) (string, tcpExposeRule, bool, error) {
+	fields := strings.Fields(val)
+	if len(fields) < 2 {
+		return "", tcpExposeRule{}, false, fmt.Errorf("expected <listen> <container ip:port>")
+	}
+	rule := tcpExposeRule{target: fields[1]}
+	portmap := false
+	for _, opt := range fields[2:] {
+		switch {
+		case opt == "portmap":
+			portmap = true
+		case strings.HasPrefix(opt, "limit="):
+			rate, err := parseRate(strings.TrimPrefix(opt, "limit="))
+			if err != nil {
+				return "", tcpExposeRule{}, false, err
+			}
+			rule.rate = rate
+		case strings.HasPrefix(opt, "max-conns="):
+			n, err := strconv.ParseInt(strings.TrimPrefix(opt, "max-conns="), 10, 64)
+			if err != nil || n < 0 {
+				return "", tcpExposeRule{}, false, fmt.Errorf("invalid %s", opt)
+			}
+			rule.maxConns = n
+		default:
+			return "", tcpExposeRule{}, false, fmt.Errorf("unknown option %s", opt)
+		}
+	}
+	return fields[0], rule, portmap, nil
+}
+
+// Set starts the listeners of the config and closes the removed ones, the
+// accepted connections are kept. The limits of the kept ones change in place.
+func (t *tcpExposeTable) Set(rules map[string]tcpExposeRule) {
+	t.Lock()
+	defer t.Unlock()
+	for listen, e := range t.entries {
+		if rule, ok := rules[listen]; !ok || rule.target != e.target {
+			e.close()
+			delete(t.entries, listen)
+		}
+	}
+	for listen, rule := range rules {
+		e, ok := t.entries[listen]
+		if !ok {
+			e = listenTCPExpose("[EXPOSE TCP]", listen, rule.target)
+			t.entries[listen] = e
+		}
+		e.setLimits(rule.rate, rule.maxConns)
+	}
+}
+
+// setLimits changes the rate and the connection cap of a listener
+func (e *tcpExpose) setLimits(rate float64, maxConns int64) {
+	if rate == e.rate && maxConns == atomic.LoadInt64(&e.maxConns) {
+		return
+	}
+	if rate > 0 || maxConns > 0 {
+		logExpose.Infof("%s Limiting %s => %s to %.1f Mbit/s per direction, %d connections (0 unlimited)", e.tag, e.listen, e.target, rate*8/1e6, maxConns)
+	}
+	e.rate = rate
+	e.up.SetRate(rate)
+	e.down.SetRate(rate)
+	atomic.StoreInt64(&e.maxConns, maxConns)
+}
+
+// listenTCPExpose listens on an address proxied to a container, the error
+// being kept for the status
+func listenTCPExpose(tag, listen, target string) *tcpExpose {
+	e := &tcpExpose{tag: tag, listen: listen, target: target, up: &tokenBucket{}, down: &tokenBucket{}}
+	if host, _, err := net.SplitHostPort(target); stack != stackUserspace && (err != nil || net.ParseIP(host) == nil || !routed(net.ParseIP(host))) {
+		logExpose.Warningf("%s %s is not in a route, %s won't go through the tunnel", tag, target, listen)
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		logExpose.Warningf("%s Failed to listen on %s: %v", tag, listen, err)
+		e.err = err.Error()
+		return e
+	}
+	logExpose.Infof("%s Listening on %s => %s", tag, listen, target)
+	e.ln = ln
+	go e.accept()
+	return e
+}
+
+// close stops listening, the accepted connections are kept
+func (e *tcpExpose) close() {
+	logExpose.Infof("%s Closing %s => %s", e.tag, e.listen, e.target)
+	if e.ln != nil {
+		e.ln.Close()
+	}
+}
+
+func (e *tcpExpose) accept() {
+	for {
+		client, err := e.ln.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return
+			}
+			logExpose.Warningf("%s Accept error on %s: %v", e.tag, e.listen, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		n := atomic.AddInt64(&e.active, 1)
+		if max := atomic.LoadInt64(&e.maxConns); max > 0 && n > max {
+			atomic.AddInt64(&e.active, -1)
+			atomic.AddUint64(&e.refused, 1)
+			logExpose.Debugf("%s %v => %s refused, %d connections", e.tag, client.RemoteAddr(), e.target, n-1)
+			client.Close()
+			continue
+		}
+		go e.serve(client)
+	}
+}
+
+// serve proxies an accepted connection, counted as active by accept
+func (e *tcpExpose) serve(client net.Conn) {
+	defer atomic.AddInt64(&e.active, -1)
+	defer client.Close()
+	remote, err := dialContainer(e.target)
+	if err != nil {
+		logExpose.Warningf("%s %v => %s: %v", e.tag, client.RemoteAddr(), e.target, err)
+		return
+	}
+	defer remote.Close()
+	if e.proxy {
+		if _, err := remote.Write(proxyHeader("tcp", client.RemoteAddr(), client.LocalAddr())); err != nil {
+			logExpose.Warningf("%s %v => %s: %v", e.tag, client.RemoteAddr(), e.target, err)
+			return
+		}
+	}
+	atomic.AddUint64(&e.total, 1)
+	var up, down io.Reader = client, remote
+	if e.up != nil {
+		up, down = throttledReader{client, e.up}, throttledReader{remote, e.down}
+	}
+	logExpose.Debugf("%s %v => %s connected", e.tag, client.RemoteAddr(), e.target)
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(remote, up)
+		atomic.AddUint64(&e.tx, uint64(n))
+		if c, ok := remote.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		close(done)
+	}()
+	n, _ := io.Copy(client, down)
+	atomic.AddUint64(&e.rx, uint64(n))
+	if c, ok := client.(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
+	<-done
+}
+
+// Status lists the exposed ports by listen address
+func (t *tcpExposeTable) Status() []TCPExposeStatus {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.entries) == 0 {
+		return nil
+	}
+	list := make([]TCPExposeStatus, 0, len(t.entries))
+	for _, e := range t.entries {
+		st := TCPExposeStatus{
+			Listen:   e.listen,
+			Target:   e.target,
+			Active:   atomic.LoadInt64(&e.active),
+			Total:    atomic.LoadUint64(&e.total),
+			TxBytes:  atomic.LoadUint64(&e.tx),
+			RxBytes:  atomic.LoadUint64(&e.rx),
+			MaxConns: atomic.LoadInt64(&e.maxConns),
+			Refused:  atomic.LoadUint64(&e.refused),
+			Error:    e.err,
+		}
+		if limit := e.up.Status(); limit != nil {
+			st.Limit = limit.Rate
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Listen < list[j].Listen })
+	return list
+}
+
+// Close stops the listeners
+func (t *tcpExposeTable) Close() {
+	t.Set(nil)
+}
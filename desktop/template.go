@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Config lines may use `${NAME}` variables, resolved from the environment
+// first, then from the `var NAME value` lines of the config, so a team can
+// share one template and override it per machine:
+//
+//	var PROJECT_SUBNET 172.18.0.0/16
+//	route ${PROJECT_SUBNET}
+var (
+	varLine = regexp.MustCompile(`^\s*var\s+(\w+)\s+(.*?)\s*$`)
+	varRef  = regexp.MustCompile(`\$\{(\w+)\}`)
+)
+
+// configVars collects the `var` lines, whose values may use the variables
+// defined before them
+func configVars(lines []string) map[string]string {
+	vars := make(map[string]string)
+	for _, line := range lines {
+		if match := varLine.FindStringSubmatch(line); match != nil {
+			vars[match[1]] = expandConfig(match[2], vars)
+		}
+	}
+	return vars
+}
+
+// expandConfig substitutes the variables of a line, unknown ones are kept
+// as is
+func expandConfig(line string, vars map[string]string) string {
+	if !strings.Contains(line, "${") {
+		return line
+	}
+	return varRef.ReplaceAllStringFunc(line, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		logger.Warningf("undefined config variable => %s\n", name)
+		return ref
+	})
+}
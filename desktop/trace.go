@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// `-trace` decodes and logs only the tunneled packets matching a filter in
+// the manner of tcpdump, instead of every packet at debug level:
+//
+//	-trace "host 172.18.0.5 and tcp port 443"
+//	-trace "src net 172.18.0.0/16 and not icmp"
+//	-trace "udp and (dst port 53 or dst port 5353)"
+//
+// The primitives are `[src|dst] host <ip>`, `[src|dst] net <cidr>`,
+// `[src|dst] port <port>`, `tcp`, `udp`, `icmp` and `proto <number>`, joined by
+// `and`, `or`, `not` (or `&&`, `||`, `!`) and parentheses, a protocol followed
+// by a primitive being joined by `and`. The matching packets are logged at info
+// level, with `-trace-hex` bytes of them dumped in hex.
+var (
+	traceExpr = ""
+	traceHex  = 0
+	// traceFilter is the compiled `-trace`, nil to log every packet at debug
+	// level
+	traceFilter traceMatch
+)
+
+// traceMatch tells whether an IPv4 packet matches
+type traceMatch func(p []byte) bool
+
+type traceParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseTrace compiles a filter
+func parseTrace(expr string) (traceMatch, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	p := &traceParser{tokens: strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+func (p *traceParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *traceParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *traceParser) or() (traceMatch, error) {
+	left, err := p.and()
+	for err == nil && (p.peek() == "or" || p.peek() == "||") {
+		p.next()
+		var right traceMatch
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(b []byte) bool { return l(b) || right(b) }
+		}
+	}
+	return left, err
+}
+
+func (p *traceParser) and() (traceMatch, error) {
+	left, err := p.not()
+	for err == nil && (p.peek() == "and" || p.peek() == "&&") {
+		p.next()
+		var right traceMatch
+		if right, err = p.not(); err == nil {
+			l := left
+			left = func(b []byte) bool { return l(b) && right(b) }
+		}
+	}
+	return left, err
+}
+
+func (p *traceParser) not() (traceMatch, error) {
+	if t := p.peek(); t == "not" || t == "!" {
+		p.next()
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) bool { return !m(b) }, nil
+	}
+	return p.primitive()
+}
+
+func (p *traceParser) primitive() (traceMatch, error) {
+	t := p.next()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "(":
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	case "tcp", "udp", "icmp":
+		proto := map[string]byte{"tcp": 6, "udp": 17, "icmp": 1}[t]
+		m := func(b []byte) bool { return b[9] == proto }
+		// tcp port 443 is tcp and port 443
+		switch p.peek() {
+		case "host", "net", "port", "src", "dst":
+			rest, err := p.primitive()
+			if err != nil {
+				return nil, err
+			}
+			return func(b []byte) bool { return m(b) && rest(b) }, nil
+		}
+		return m, nil
+	case "proto":
+		v, err := strconv.Atoi(p.next())
+		if err != nil || v < 0 || v > 255 {
+			return nil, fmt.Errorf("invalid protocol")
+		}
+		return func(b []byte) bool { return int(b[9]) == v }, nil
+	}
+	src, dst := true, true
+	switch t {
+	case "src":
+		dst = false
+		t = p.next()
+	case "dst":
+		src = false
+		t = p.next()
+	}
+	arg := p.next()
+	switch t {
+	case "host":
+		ip := net.ParseIP(arg).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q", arg)
+		}
+		return func(b []byte) bool {
+			return src && ip.Equal(b[12:16]) || dst && ip.Equal(b[16:20])
+		}, nil
+	case "net":
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", arg)
+		}
+		return func(b []byte) bool {
+			return src && ipnet.Contains(b[12:16]) || dst && ipnet.Contains(b[16:20])
+		}, nil
+	case "port":
+		v, err := strconv.Atoi(arg)
+		if err != nil || v <= 0 || v > 65535 {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		return func(b []byte) bool {
+			sport, dport, ok := tracePorts(b)
+			return ok && (src && sport == v || dst && dport == v)
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+// tracePorts returns the ports of a TCP or UDP packet, which only the first
+// fragment has
+func tracePorts(b []byte) (int, int, bool) {
+	ihl := int(b[0]&0x0F) * 4
+	if (b[9] != 6 && b[9] != 17) || binary.BigEndian.Uint16(b[6:8])&0x1FFF != 0 || len(b) < ihl+4 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(b[ihl:])), int(binary.BigEndian.Uint16(b[ihl+2:])), true
+}
+
+// setTrace compiles `-trace`
+func setTrace(expr string) error {
+	if expr == "" {
+		traceFilter = nil
+		return nil
+	}
+	m, err := parseTrace(expr)
+	if err != nil {
+		return fmt.Errorf("invalid trace %q: %v", expr, err)
+	}
+	traceFilter = m
+	return nil
+}
+
+// traced tells whether a packet is logged, and how
+func traced(data []byte) (func(string, ...interface{}), bool) {
+	if traceFilter == nil {
+		return logTransport.Debugf, debugEnabled()
+	}
+	if len(data) < 20 || data[0]>>4 != 4 || !traceFilter(data) {
+		return nil, false
+	}
+	return logTransport.Infof, true
+}
+
+// traceDump logs the first `-trace-hex` bytes of a matching packet
+func traceDump(data []byte, direction string) {
+	if traceFilter == nil || traceHex <= 0 {
+		return
+	}
+	if len(data) > traceHex {
+		data = data[:traceHex]
+	}
+	logTransport.Infof("[PACKET %s] %d bytes\n%s", direction, len(data), strings.TrimRight(hex.Dump(data), "\n"))
+}
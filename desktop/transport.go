@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// With `-transport "ssh user@host"` the tunnel to a remote docker host goes
+// over an SSH connection made by the ssh client, with the agent and keys of
+// the user, instead of an open UDP port. The remote command, `-ssh-command`,
+// runs `desktop-connector bridge` in the agent container, which listens on
+// 127.0.0.1 of the remote host for the agent started with `-host 127.0.0.1`.
+// The datagrams cross the SSH channel as
+//
+//	length(2) | datagram
+//
+// and are exchanged locally with the UDP socket of the tunnel, so the rest of
+// the connector sees a client on the loopback. The session is restarted with
+// a doubling backoff when it ends.
+const (
+	transportUDP = ""
+	transportSSH = "ssh"
+	frameHeader  = 2
+)
+
+var (
+	transport  = transportUDP
+	sshCommand = "docker exec -i desktop-connector desktop-connector bridge"
+)
+
+// startTransport starts the transport of `-transport`
+func startTransport(ctx context.Context) error {
+	args := strings.Fields(transport)
+	if len(args) == 0 {
+		return nil
+	}
+	if args[0] != transportSSH || len(args) < 2 {
+		return fmt.Errorf("invalid transport %q, expecting \"ssh user@host\"", transport)
+	}
+	go func() {
+		backoff := time.Second
+		for ctx.Err() == nil {
+			begin := time.Now()
+			err := sshSession(ctx, args[1:])
+			if ctx.Err() != nil {
+				return
+			}
+			if time.Since(begin) > time.Minute {
+				backoff = time.Second
+			}
+			logger.Warningf("[SSH] Session ended: %v, restart in %v", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > listenBackoffMax {
+				backoff = listenBackoffMax
+			}
+		}
+	}()
+	return nil
+}
+
+// sshSession runs the ssh client until it exits, exchanging the datagrams of
+// the channel with the tunnel socket
+func sshSession(ctx context.Context, args []string) error {
+	target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; ip != nil && !ip.IsUnspecified() {
+		target.IP = ip
+	}
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: target.IP})
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	argv := append([]string{"-T", "-o", "BatchMode=yes", "-o", "ServerAliveInterval=15"}, args...)
+	cmd := exec.CommandContext(ctx, "ssh", append(argv, sshCommand)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	logger.Infof("[SSH] Connecting => ssh %s %s", strings.Join(argv, " "), sshCommand)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			logger.Infof("[SSH] %s", lines.Text())
+		}
+	}()
+	go func() {
+		buf := make([]byte, frameHeader+65536)
+		for {
+			n, _, err := local.ReadFromUDP(buf[frameHeader:])
+			if err != nil {
+				stdin.Close()
+				return
+			}
+			binary.BigEndian.PutUint16(buf, uint16(n))
+			if _, err := stdin.Write(buf[:frameHeader+n]); err != nil {
+				return
+			}
+		}
+	}()
+	r := bufio.NewReader(stdout)
+	buf := make([]byte, 65536)
+	for {
+		n, err := readFrame(r, buf)
+		if err != nil {
+			local.Close()
+			if werr := cmd.Wait(); werr != nil {
+				return werr
+			}
+			return err
+		}
+		if _, err := local.WriteToUDP(buf[:n], target); err != nil {
+			logger.Debugf("[SSH] Failed to deliver %d bytes: %v", n, err)
+		}
+	}
+}
+
+// readFrame reads a datagram of the channel
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var header [frameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("frame of %d bytes", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
@@ -0,0 +1,10 @@
+package main
+
+import "io"
+
+// tunDevice is the TUN of the desktop, a water interface or, on windows, a
+// wintun adapter
+type tunDevice interface {
+	io.ReadWriteCloser
+	Name() string
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// With `unreachable on` a packet of the TUN dropped because no docker side
+// is connected gets an ICMP host unreachable back, and one denied by the ACL
+// or the schedule an ICMP administratively prohibited, so the connections fail at once
+// instead of hanging until their timeouts. The errors come from the address
+// of the docker side, at most `unreachableRate` a second, and never answer an
+// ICMP error, a fragment past the first or a broadcast.
+const (
+	unreachableRate = 100
+
+	icmpUnreachable    = 3
+	icmpHostUnreach    = 1
+	icmpAdminProhibits = 13
+)
+
+var (
+	unreachable = false
+	// unreachableTUN is the TUN the errors are written to
+	unreachableTUN tunDevice
+
+	unreachableLock  sync.Mutex
+	unreachableSec   int64
+	unreachableCount int
+)
+
+// sendUnreachable writes an ICMP destination unreachable answering an IPv4
+// packet of the TUN to the TUN
+func sendUnreachable(packet []byte, code byte) {
+	iface := unreachableTUN
+	if !unreachable || iface == nil || len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < 20 || len(packet) < ihl || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return
+	}
+	if packet[9] == protoICMP && (len(packet) < ihl+1 || packet[ihl] != 8) {
+		// only the echo requests among the ICMP
+		return
+	}
+	if packet[16] >= 224 || packet[16] == 255 && packet[19] == 255 {
+		return
+	}
+	now := time.Now().Unix()
+	unreachableLock.Lock()
+	if now != unreachableSec {
+		unreachableSec, unreachableCount = now, 0
+	}
+	unreachableCount++
+	over := unreachableCount > unreachableRate
+	unreachableLock.Unlock()
+	if over {
+		return
+	}
+	// the header and the first 8 bytes of the packet, RFC 792
+	quoted := packet[:min(len(packet), ihl+8)]
+	reply := make([]byte, 28+len(quoted))
+	reply[0] = 0x45
+	binary.BigEndian.PutUint16(reply[2:], uint16(len(reply)))
+	reply[8] = 64
+	reply[9] = protoICMP
+	src := packet[16:20]
+	if peer != nil {
+		src = peer.To4()
+	}
+	copy(reply[12:16], src)
+	copy(reply[16:20], packet[12:16])
+	reply[20] = icmpUnreachable
+	reply[21] = code
+	copy(reply[28:], quoted)
+	fixChecksums(reply)
+	if _, err := iface.Write(reply); err != nil {
+		logTransport.Debugf("[UNREACHABLE] Failed to answer %d.%d.%d.%d: %v", packet[16], packet[17], packet[18], packet[19], err)
+	}
+}
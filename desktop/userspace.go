@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// `-stack userspace` runs the connector without a TUN, without routes and
+// without root: the TCP connections are terminated on the desktop, by the
+// SOCKS5 server, `127.0.0.1:1080` unless `socks` says otherwise, and by the
+// `expose-tcp` and `forward tcp` listeners, and the docker side dials the
+// containers for them as for the SOCKS CONNECTs. The UDP forwards need the
+// TUN and are not served. `-stack tun`, the default, keeps the TUN and the
+// routes.
+const (
+	stackTUN       = "tun"
+	stackUserspace = "userspace"
+	userspaceSocks = "127.0.0.1:1080"
+)
+
+var stack = stackTUN
+
+// applyStack checks `-stack`, turning the TUN off in userspace
+func applyStack() {
+	switch stack {
+	case stackTUN:
+	case stackUserspace:
+		bind = false
+		logTransport.Infof("[STACK] Userspace stack, no TUN nor routes")
+	default:
+		logger.Fatalf("invalid stack => %s, tun or userspace", stack)
+	}
+}
+
+// userspaceSocksAddr gives the SOCKS5 server of the userspace stack its
+// default address
+func userspaceSocksAddr() {
+	if stack == stackUserspace && socksAddr == "" {
+		socksAddr = userspaceSocks
+	}
+}
+
+// dialContainer dials a container for the TCP listeners, through the docker
+// side in userspace
+func dialContainer(target string) (net.Conn, error) {
+	if stack == stackUserspace {
+		peer := shared.Client()
+		if peer == nil {
+			return nil, fmt.Errorf("no client connected")
+		}
+		remote, code := socks.dial(peer, target)
+		if remote == nil {
+			return nil, fmt.Errorf("dial failed with code %d", code)
+		}
+		return remote, nil
+	}
+	dialer := net.Dialer{Timeout: tcpExposeDial, LocalAddr: &net.TCPAddr{IP: localIP}}
+	if !bind {
+		dialer.LocalAddr = nil
+	}
+	return dialer.Dial("tcp", target)
+}
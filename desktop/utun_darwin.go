@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// The utun of the connector is opened here rather than by water, which hides
+// its file, so that it can be handed over by `upgrade`, see handover.go.
+const (
+	utunControlName = "com.apple.net.utun_control"
+	// sysprotoControl and afSysControl are the kernel control protocol and
+	// address, see <sys/sys_domain.h>
+	sysprotoControl = 2
+	afSysControl    = 2
+	// utunOptIfname gets the name of the utun, see <net/if_utun.h>
+	utunOptIfname = 2
+	// ctliocginfo is _IOWR('N', 3, struct ctl_info), see <sys/kern_control.h>
+	ctliocginfo = 0xc0000000 | 100<<16 | 'N'<<8 | 3
+)
+
+type ctlInfo struct {
+	id   uint32
+	name [96]byte
+}
+
+type sockaddrCtl struct {
+	len      uint8
+	family   uint8
+	sysaddr  uint16
+	id       uint32
+	unit     uint32
+	reserved [5]uint32
+}
+
+// openUTUN opens the utun of name, utun<unit>, or of the first free unit
+// without one
+func openUTUN(name string) (*fileTUN, error) {
+	unit := uint32(0)
+	if name != "" {
+		n, err := strconv.ParseUint(strings.TrimPrefix(name, "utun"), 10, 31)
+		if err != nil || !strings.HasPrefix(name, "utun") {
+			return nil, fmt.Errorf("invalid utun %s: expected utun<unit>", name)
+		}
+		unit = uint32(n) + 1
+	}
+	fd, err := syscall.Socket(syscall.AF_SYSTEM, syscall.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, fmt.Errorf("utun socket: %v", err)
+	}
+	info := &ctlInfo{}
+	copy(info.name[:], utunControlName)
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ctliocginfo, uintptr(unsafe.Pointer(info))); e != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("utun control: %v", e)
+	}
+	sa := &sockaddrCtl{
+		len:     uint8(unsafe.Sizeof(sockaddrCtl{})),
+		family:  syscall.AF_SYSTEM,
+		sysaddr: afSysControl,
+		id:      info.id,
+		unit:    unit,
+	}
+	if _, _, e := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa)); e != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("utun connect: %v", e)
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	name = utunName(fd)
+	return &fileTUN{File: os.NewFile(uintptr(fd), name), name: name, utun: true}, nil
+}
+
+func utunName(fd int) string {
+	name := make([]byte, 16)
+	l := uint32(len(name))
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), sysprotoControl, utunOptIfname,
+		uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&l)), 0)
+	if e != 0 {
+		return "utun"
+	}
+	return strings.TrimRight(string(name[:l]), "\x00")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The dashboard of `-web-ui` is served on the admin address to loopback
+// clients only, whatever `-admin` listens on. It shows the tunnel, the
+// routes with toggles writing the config file, the traffic of the subnets,
+// the hosts entries, the expose sessions and the recent logs. Requests naming
+// another host, or posted by a page of another origin, are refused so other
+// sites opened in the browser can't drive it.
+var webUI = true
+
+// localOnly serves the requests of loopback clients to a local host name
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !loopbackHost(r.RemoteAddr) || !loopbackHost(r.Host) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && r.Method != http.MethodGet {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// adminHeader marks the changes posted by the command line, a header a page
+// can't send to another origin without a preflight the admin API doesn't
+// answer
+const adminHeader = "X-Docker-Connector"
+
+// localWrite serves the requests of localOnly, the changes only with a JSON
+// body or adminHeader, which a form or a simple request of another site
+// can't carry
+func localWrite(h http.HandlerFunc) http.HandlerFunc {
+	return localOnly(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !jsonRequest(r) && r.Header.Get(adminHeader) == "" {
+			http.Error(w, "changes need a JSON body or the "+adminHeader+" header", http.StatusUnsupportedMediaType)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// jsonRequest tells whether the body of a request is JSON
+func jsonRequest(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// loopbackHost tells whether a host, with or without port, is local
+func loopbackHost(hostport string) bool {
+	h := hostport
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		h = host
+	}
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
+
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(indexHTML))
+}
+
+// serveRoutes lists the routes of the config file, or toggles one with
+// `POST /routes?route=172.18.0.0/16&enabled=false`
+func serveRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		route := r.URL.Query().Get("route")
+		enabled := r.URL.Query().Get("enabled") != "false"
+		if err := setConfigRoute(route, enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Infof("[ADMIN] Route %s enabled => %v", route, enabled)
+	}
+	list, err := configRoutes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// serveHosts lists the hosts entries pushed to the docker side
+func serveHosts(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	loadHosts(&buf, shared.Hosts())
+	entries := []string{}
+	for _, entry := range strings.Split(buf.String(), ",") {
+		if strings.HasPrefix(entry, "host ") {
+			entries = append(entries, strings.TrimPrefix(entry, "host "))
+		}
+	}
+	writeJSON(w, entries)
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Docker Connector</title>
+<style>
+body { font-family: -apple-system, sans-serif; margin: 2em; color: #222; }
+h2 { border-bottom: 1px solid #ddd; padding-bottom: .2em; }
+table { border-collapse: collapse; }
+td, th { padding: .3em 1em .3em 0; text-align: left; }
+.ok { color: #2a2; } .bad { color: #c22; }
+canvas { border: 1px solid #eee; vertical-align: middle; }
+pre { background: #f6f6f6; padding: .5em; max-height: 25em; overflow: auto; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>Docker Connector</h1>
+<h2>Tunnel</h2>
+<table id="tunnel"></table>
+<h2>Routes</h2>
+<table id="routes"></table>
+<h2>Traffic</h2>
+<table id="traffic"></table>
+<h2>Hosts</h2>
+<table id="hosts"></table>
+<h2>Expose sessions</h2>
+<table id="sessions"></table>
+<h2>Logs</h2>
+<pre id="logs"></pre>
+<script>
+var last = {}, history = {};
+function row(cells) {
+  return '<tr>' + cells.map(function (c) { return '<td>' + c + '</td>'; }).join('') + '</tr>';
+}
+function rate(v) {
+  if (v > 1048576) return (v / 1048576).toFixed(1) + ' MB/s';
+  if (v > 1024) return (v / 1024).toFixed(1) + ' KB/s';
+  return v.toFixed(0) + ' B/s';
+}
+function draw(id, values) {
+  var c = document.getElementById(id);
+  if (!c) return;
+  var ctx = c.getContext('2d'), max = Math.max.apply(null, values.concat([1]));
+  ctx.clearRect(0, 0, c.width, c.height);
+  ctx.beginPath();
+  values.forEach(function (v, i) {
+    var x = i * c.width / 60, y = c.height - v * c.height / max;
+    if (i) ctx.lineTo(x, y); else ctx.moveTo(x, y);
+  });
+  ctx.stroke();
+}
+function status() {
+  fetch('/status').then(function (r) { return r.json(); }).then(function (s) {
+    var alive = s.client ? '<span class="ok">' + s.client + '</span>' : '<span class="bad">not connected</span>';
+    document.getElementById('tunnel').innerHTML =
+      row(['Client', alive]) + row(['Interface', s.interface || '-']) + row(['Listen', s.listen || '-']) +
+      row(['Local IP', s.local_ip]) + row(['Peer IP', s.peer_ip || '-']) + row(['Uptime', s.uptime]) +
+      row(['RTT', s.clock ? s.clock.rtt_ms.toFixed(2) + ' ms' : '-']) +
+      row(['Session', s.session ? s.session.id + ' (' + s.session.roams + ' moves)' : '-']);
+    document.getElementById('sessions').innerHTML = (s.sessions || []).map(function (e) {
+      return row([e.token, e.peer, e.ip, e.last_seen, 'tx ' + e.tx_bytes + ' B / rx ' + e.rx_bytes + ' B']);
+    }).join('') || row(['no expose sessions']);
+    var html = '';
+    Object.keys(s.traffic).sort().forEach(function (k, i) {
+      var t = s.traffic[k], total = t.tx_bytes + t.rx_bytes;
+      var r = last[k] === undefined ? 0 : (total - last[k]) / 2;
+      last[k] = total;
+      history[k] = (history[k] || []).concat([r]).slice(-60);
+      html += row([k, rate(r), '<canvas id="g' + i + '" width="240" height="30"></canvas>',
+        'tx ' + t.tx_bytes + ' B / rx ' + t.rx_bytes + ' B']);
+    });
+    document.getElementById('traffic').innerHTML = html;
+    Object.keys(s.traffic).sort().forEach(function (k, i) { draw('g' + i, history[k]); });
+  });
+}
+function routes() {
+  fetch('/routes').then(function (r) { return r.ok ? r.json() : []; }).then(function (list) {
+    document.getElementById('routes').innerHTML = (list || []).map(function (r) {
+      return row(['<input type="checkbox" ' + (r.enabled ? 'checked ' : '') +
+        'onchange="toggle(\'' + r.route + '\', this.checked)">', r.route, r.expose ? 'expose' : '']);
+    }).join('') || row(['no routes in config file']);
+  });
+}
+function toggle(route, enabled) {
+  fetch('/routes?route=' + encodeURIComponent(route) + '&enabled=' + enabled, {method: 'POST'}).then(routes);
+}
+function hosts() {
+  fetch('/hosts').then(function (r) { return r.json(); }).then(function (list) {
+    document.getElementById('hosts').innerHTML = list.map(function (h) {
+      var i = h.indexOf(' ');
+      return row([h.substring(0, i), h.substring(i + 1)]);
+    }).join('') || row(['no hosts entries']);
+  });
+}
+function text(s) {
+  return s.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+}
+function logs() {
+  fetch('/logs?level=info').then(function (r) { return r.text(); }).then(function (t) {
+    var pre = document.getElementById('logs'), end = pre.scrollTop + pre.clientHeight >= pre.scrollHeight - 5;
+    pre.innerHTML = text(t.trim().split('\n').slice(-100).join('\n'));
+    if (end) pre.scrollTop = pre.scrollHeight;
+  });
+}
+status(); routes(); hosts(); logs();
+setInterval(status, 2000);
+setInterval(logs, 5000);
+</script>
+</body>
+</html>
+`
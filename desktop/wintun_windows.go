@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// wintun.dll is looked up next to the executable, see https://www.wintun.net
+const (
+	wintunTunnelType = "DockerConnector"
+	// wintunRing is the capacity of the rings shared with the driver
+	wintunRing = 0x400000
+	// wintunWait is how long a read waits for packets before checking the
+	// session is still open, in milliseconds
+	wintunWait = 250
+
+	errorNoMoreItems  = 259
+	errorHandleEOF    = 38
+	errorBufferExceed = 111
+)
+
+var (
+	wintunDLL            = syscall.NewLazyDLL("wintun.dll")
+	wintunCreateAdapter  = wintunDLL.NewProc("WintunCreateAdapter")
+	wintunCloseAdapter   = wintunDLL.NewProc("WintunCloseAdapter")
+	wintunStartSession   = wintunDLL.NewProc("WintunStartSession")
+	wintunEndSession     = wintunDLL.NewProc("WintunEndSession")
+	wintunReadWaitEvent  = wintunDLL.NewProc("WintunGetReadWaitEvent")
+	wintunReceivePacket  = wintunDLL.NewProc("WintunReceivePacket")
+	wintunReleasePacket  = wintunDLL.NewProc("WintunReleaseReceivePacket")
+	wintunAllocatePacket = wintunDLL.NewProc("WintunAllocateSendPacket")
+	wintunSendPacket     = wintunDLL.NewProc("WintunSendPacket")
+)
+
+// wintun is a TUN adapter of the wintun driver
+type wintun struct {
+	name    string
+	adapter uintptr
+	session uintptr
+	event   syscall.Handle
+	closed  int32
+	// the session is ended once no read or write uses it anymore
+	using sync.RWMutex
+}
+
+// openWintun creates the adapter and starts its session
+func openWintun(name string) (*wintun, error) {
+	if err := wintunDLL.Load(); err != nil {
+		return nil, err
+	}
+	wname, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	wtype, err := syscall.UTF16PtrFromString(wintunTunnelType)
+	if err != nil {
+		return nil, err
+	}
+	adapter, _, e := wintunCreateAdapter.Call(uintptr(unsafe.Pointer(wname)), uintptr(unsafe.Pointer(wtype)), 0)
+	if adapter == 0 {
+		return nil, fmt.Errorf("create adapter %s: %v", name, e)
+	}
+	session, _, e := wintunStartSession.Call(adapter, wintunRing)
+	if session == 0 {
+		wintunCloseAdapter.Call(adapter)
+		return nil, fmt.Errorf("start session of %s: %v", name, e)
+	}
+	event, _, _ := wintunReadWaitEvent.Call(session)
+	return &wintun{name: name, adapter: adapter, session: session, event: syscall.Handle(event)}, nil
+}
+
+func (w *wintun) Name() string {
+	return w.name
+}
+
+// packet returns the bytes of a packet of the rings
+func packet(ptr uintptr, size int) []byte {
+	var b []byte
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	h.Data, h.Len, h.Cap = ptr, size, size
+	return b
+}
+
+func (w *wintun) Read(b []byte) (int, error) {
+	w.using.RLock()
+	defer w.using.RUnlock()
+	for atomic.LoadInt32(&w.closed) == 0 {
+		var size uint32
+		ptr, _, e := wintunReceivePacket.Call(w.session, uintptr(unsafe.Pointer(&size)))
+		if ptr != 0 {
+			n := copy(b, packet(ptr, int(size)))
+			wintunReleasePacket.Call(w.session, ptr)
+			return n, nil
+		}
+		errno, _ := e.(syscall.Errno)
+		switch errno {
+		case errorNoMoreItems:
+			syscall.WaitForSingleObject(w.event, wintunWait)
+		case errorHandleEOF:
+			return 0, fmt.Errorf("wintun session of %s ended", w.name)
+		default:
+			return 0, fmt.Errorf("wintun receive: %v", e)
+		}
+	}
+	return 0, fmt.Errorf("wintun adapter %s closed", w.name)
+}
+
+func (w *wintun) Write(b []byte) (int, error) {
+	w.using.RLock()
+	defer w.using.RUnlock()
+	if atomic.LoadInt32(&w.closed) != 0 {
+		return 0, fmt.Errorf("wintun adapter %s closed", w.name)
+	}
+	ptr, _, e := wintunAllocatePacket.Call(w.session, uintptr(len(b)))
+	if ptr == 0 {
+		if errno, _ := e.(syscall.Errno); errno == errorBufferExceed {
+			// the ring is full, drop the packet as a NIC would
+			return 0, fmt.Errorf("wintun ring of %s full", w.name)
+		}
+		return 0, fmt.Errorf("wintun allocate: %v", e)
+	}
+	copy(packet(ptr, len(b)), b)
+	wintunSendPacket.Call(w.session, ptr)
+	return len(b), nil
+}
+
+// Close ends the session and removes the adapter
+func (w *wintun) Close() error {
+	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		return nil
+	}
+	w.using.Lock()
+	defer w.using.Unlock()
+	wintunEndSession.Call(w.session)
+	wintunCloseAdapter.Call(w.adapter)
+	return nil
+}
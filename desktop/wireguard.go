@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// With `wireguard <private key>` the desktop speaks WireGuard on `port`
+// instead of the protocol of the agent, through wireguard-go on the TUN, so
+// the docker side runs the standard `wireguard` image with the peer of
+// `wireguard-peer <public key> [endpoint]`:
+//
+//	wireguard yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+//	wireguard-peer xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+//
+// The peer is allowed the address of the docker side and the routes, which
+// follow the config as it is reloaded, with the hosts and the DNS of the
+// desktop. The controls, the pushed routes and the expose sessions need the
+// agent. `docker-connector wg-keys` makes a pair of keys. The wireguard-go
+// of the module doesn't build for windows on arm64, which goes without.
+const wgKeepalive = 25
+
+var (
+	wgKey      = ""
+	wgPeer     = ""
+	wgEndpoint = ""
+)
+
+// WireGuardStatus describes the WireGuard peer
+type WireGuardStatus struct {
+	Listen        int      `json:"listen"`
+	Peer          string   `json:"peer"`
+	Endpoint      string   `json:"endpoint,omitempty"`
+	LastHandshake string   `json:"last_handshake,omitempty"`
+	RxBytes       uint64   `json:"rx_bytes"`
+	TxBytes       uint64   `json:"tx_bytes"`
+	AllowedIPs    []string `json:"allowed_ips"`
+}
+
+// wgHex converts a base64 key to the hex of the UAPI
+func wgHex(key string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// wgPeerConfig returns the UAPI lines of the peer, allowed the docker side
+// and the routes
+func wgPeerConfig() (string, error) {
+	pub, err := wgHex(wgPeer)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "replace_peers=true\npublic_key=%s\n", pub)
+	if wgEndpoint != "" {
+		addr, err := net.ResolveUDPAddr("udp", wgEndpoint)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "endpoint=%s\npersistent_keepalive_interval=%d\n", addr, wgKeepalive)
+	}
+	b.WriteString("replace_allowed_ips=true\n")
+	if peer != nil {
+		fmt.Fprintf(&b, "allowed_ip=%s/32\n", peer)
+	}
+	var keys []string
+	for key := range shared.Routes() {
+		if _, ipnet, err := net.ParseCIDR(key); err == nil && ipnet.IP.To4() != nil {
+			keys = append(keys, ipnet.String())
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "allowed_ip=%s\n", key)
+	}
+	return b.String(), nil
+}
+
+// runWgKeys implements `wg-keys`, printing a new pair of keys
+func runWgKeys() {
+	var private [32]byte
+	if _, err := rand.Read(private[:]); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to make a key => %v\n", err)
+		os.Exit(1)
+	}
+	private[0] &= 248
+	private[31] = private[31]&127 | 64
+	public, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to make a key => %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("private => %s\npublic => %s\n", base64.StdEncoding.EncodeToString(private[:]), base64.StdEncoding.EncodeToString(public))
+}
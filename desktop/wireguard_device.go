@@ -0,0 +1,180 @@
+//go:build !windows || !arm64
+// +build !windows !arm64
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+var (
+	wgLock   sync.Mutex
+	wgDevice *device.Device
+	wgPeers  string
+)
+
+// wgTUN is the TUN of the connector as a device of wireguard-go, which
+// doesn't own it
+type wgTUN struct {
+	iface  tunDevice
+	events chan tun.Event
+	once   sync.Once
+}
+
+func newWgTUN(iface tunDevice) *wgTUN {
+	t := &wgTUN{iface: iface, events: make(chan tun.Event, 1)}
+	t.events <- tun.EventUp
+	return t
+}
+
+func (t *wgTUN) File() *os.File { return nil }
+
+func (t *wgTUN) Read(buf []byte, offset int) (int, error) {
+	return t.iface.Read(buf[offset:])
+}
+
+func (t *wgTUN) Write(buf []byte, offset int) (int, error) {
+	return t.iface.Write(buf[offset:])
+}
+
+func (t *wgTUN) Flush() error { return nil }
+
+func (t *wgTUN) MTU() (int, error) { return MTU, nil }
+
+func (t *wgTUN) Name() (string, error) { return t.iface.Name(), nil }
+
+func (t *wgTUN) Events() chan tun.Event { return t.events }
+
+func (t *wgTUN) Close() error {
+	t.once.Do(func() { close(t.events) })
+	return nil
+}
+
+// wgLog writes the logs of wireguard-go to the log of the connector
+type wgLog struct {
+	warn bool
+}
+
+func (w wgLog) Write(p []byte) (int, error) {
+	if w.warn {
+		logger.Warningf("[WIREGUARD] %s", strings.TrimSpace(string(p)))
+	} else {
+		logger.Debugf("[WIREGUARD] %s", strings.TrimSpace(string(p)))
+	}
+	return len(p), nil
+}
+
+// updateWireGuard gives the peer the routes of the reloaded config
+func updateWireGuard() {
+	wgLock.Lock()
+	defer wgLock.Unlock()
+	if wgDevice == nil {
+		return
+	}
+	config, err := wgPeerConfig()
+	if err != nil {
+		logger.Warningf("[WIREGUARD] %v", err)
+		return
+	}
+	if config == wgPeers {
+		return
+	}
+	if err := wgDevice.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+		logger.Warningf("[WIREGUARD] Failed to update the peer: %v", err)
+		return
+	}
+	wgPeers = config
+	logger.Infof("[WIREGUARD] Peer updated")
+}
+
+// runWireGuard runs the tunnel as a WireGuard peer until stopped
+func (c *Connector) runWireGuard(iface tunDevice) {
+	if iface == nil {
+		logger.Fatalf("[WIREGUARD] WireGuard needs the TUN, drop -bind=false")
+	}
+	key, err := wgHex(wgKey)
+	if err != nil {
+		logger.Fatalf("[WIREGUARD] %v", err)
+	}
+	if wgPeer == "" {
+		logger.Fatalf("[WIREGUARD] wireguard-peer is missing")
+	}
+	config, err := wgPeerConfig()
+	if err != nil {
+		logger.Fatalf("[WIREGUARD] %v", err)
+	}
+	wgLogger := &device.Logger{
+		Debug: log.New(wgLog{}, "", 0),
+		Info:  log.New(wgLog{}, "", 0),
+		Error: log.New(wgLog{warn: true}, "", 0),
+	}
+	wgLock.Lock()
+	wgDevice = device.NewDevice(newWgTUN(iface), wgLogger)
+	uapi := fmt.Sprintf("private_key=%s\nlisten_port=%d\n%s", key, port, config)
+	if err := wgDevice.IpcSetOperation(bufio.NewReader(strings.NewReader(uapi))); err != nil {
+		wgLock.Unlock()
+		logger.Fatalf("[WIREGUARD] Failed to configure the device: %v", err)
+	}
+	wgPeers = config
+	wgDevice.Up()
+	wgLock.Unlock()
+	logger.Infof("[WIREGUARD] Listening on port %d for the peer %s", port, wgPeer)
+	writePidFile()
+	defer removePidFile()
+	startAdmin(c)
+	go c.watchStatusFile()
+	sdNotify("READY=1")
+	<-c.ctx.Done()
+	wgLock.Lock()
+	wgDevice.Close()
+	wgDevice = nil
+	wgLock.Unlock()
+}
+
+// wireGuardStatus reads the peer from the device
+func wireGuardStatus() *WireGuardStatus {
+	wgLock.Lock()
+	defer wgLock.Unlock()
+	if wgDevice == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := wgDevice.IpcGetOperation(w); err != nil {
+		return nil
+	}
+	w.Flush()
+	st := &WireGuardStatus{Listen: port, Peer: wgPeer, AllowedIPs: []string{}}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "endpoint":
+			st.Endpoint = kv[1]
+		case "last_handshake_time_sec":
+			if sec, _ := strconv.ParseInt(kv[1], 10, 64); sec > 0 {
+				st.LastHandshake = time.Unix(sec, 0).Format(time.RFC3339)
+			}
+		case "rx_bytes":
+			st.RxBytes, _ = strconv.ParseUint(kv[1], 10, 64)
+		case "tx_bytes":
+			st.TxBytes, _ = strconv.ParseUint(kv[1], 10, 64)
+		case "allowed_ip":
+			st.AllowedIPs = append(st.AllowedIPs, kv[1])
+		}
+	}
+	return st
+}
@@ -0,0 +1,14 @@
+package main
+
+// updateWireGuard has no device to update on windows/arm64
+func updateWireGuard() {}
+
+// runWireGuard refuses the WireGuard transport, wireguard-go being missing
+func (c *Connector) runWireGuard(iface tunDevice) {
+	logger.Fatalf("[WIREGUARD] WireGuard isn't available on windows/arm64, drop wireguard from the config")
+}
+
+// wireGuardStatus has no peer on windows/arm64
+func wireGuardStatus() *WireGuardStatus {
+	return nil
+}
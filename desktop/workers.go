@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// workerQueue is the number of packets waiting for each worker
+const workerQueue = 256
+
+// workerPool hands the packets read from the docker side to `workers`
+// goroutines, the packets of a flow always go to the same worker so they keep
+// their order.
+type workerPool struct {
+	queues []chan *[]byte
+	wg     sync.WaitGroup
+}
+
+// startWorkers returns nil with less than two workers, the packets are then
+// handled by the UDP loop itself
+func startWorkers(n int, handle func([]byte)) *workerPool {
+	if n < 2 {
+		return nil
+	}
+	p := &workerPool{queues: make([]chan *[]byte, n)}
+	for i := range p.queues {
+		q := make(chan *[]byte, workerQueue)
+		p.queues[i] = q
+		p.wg.Add(1)
+		name := fmt.Sprintf("worker %d", i)
+		go func() {
+			defer p.wg.Done()
+			supervise(context.Background(), name, func() {
+				for b := range q {
+					handle(*b)
+					putBuffer(b)
+				}
+			})
+		}()
+	}
+	logTransport.Infof("[WORKERS] %d workers forwarding packets to the TUN", n)
+	return p
+}
+
+// Dispatch queues a copy of the packet to the worker of its flow, it returns
+// false without workers
+func (p *workerPool) Dispatch(packet []byte) bool {
+	if p == nil {
+		return false
+	}
+	b := getBuffer(len(packet))
+	copy(*b, packet)
+	p.queues[flowHash(packet)%uint32(len(p.queues))] <- b
+	return true
+}
+
+// Close stops the workers once they handled the queued packets
+func (p *workerPool) Close() {
+	if p == nil {
+		return
+	}
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+// flowHash hashes the addresses and protocol of an IPv4 packet, not its
+// ports, which only the first fragment of a datagram carries, so the
+// fragments go to the worker of the unfragmented packets of their flow
+func flowHash(packet []byte) uint32 {
+	h := fnv.New32a()
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		h.Write(packet[:min(len(packet), 8)])
+		return h.Sum32()
+	}
+	h.Write(packet[9:10])
+	h.Write(packet[12:20])
+	return h.Sum32()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// With `host wsl` the docker side is an agent in a WSL2 distro, started with
+// `-host wsl`, and the tunnel listens on the address of Windows in the network
+// of WSL, the `vEthernet (WSL)` interface. The interface only exists once WSL
+// runs and gets another address on each boot, so the connector waits for it
+// and rebinds when it changes, and doesn't reuse the saved peer: the agent is
+// found again by its first heartbeat. The docker networks of the distro are
+// pushed by the agent with `-push-routes`.
+const (
+	hostWSL        = "wsl"
+	wslCheckPeriod = 10 * time.Second
+)
+
+// wslMode is set by `host wsl`
+var wslMode = false
+
+// wslAddress returns the address of Windows in the network of WSL
+func wslAddress() net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, ifi := range ifaces {
+		if !strings.Contains(strings.ToUpper(ifi.Name), "WSL") || ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP.To4()
+			}
+		}
+	}
+	return nil
+}
+
+// waitWSL returns the address of Windows in the network of WSL once it
+// exists, "" when stopped meanwhile
+func waitWSL(ctx context.Context) string {
+	wslMode = true
+	for i := 0; ; i++ {
+		if ip := wslAddress(); ip != nil {
+			logger.Infof("[WSL] Listening on %s, start the agent in WSL with -host wsl -port %d", ip, port)
+			return ip.String()
+		}
+		if i == 0 {
+			logger.Warningf("[WSL] No WSL interface yet, waiting for WSL to start")
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ""
+		}
+	}
+}
+
+// watchWSL rebinds the tunnel when the address of Windows in the network of
+// WSL changes, after a restart of WSL
+func watchWSL(ctx context.Context) {
+	ticker := time.NewTicker(wslCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ip := wslAddress()
+			if !wslMode || ip == nil || ip.String() == host {
+				continue
+			}
+			configLock.Lock()
+			old := host
+			host = ip.String()
+			logger.Infof("[WSL] Address of WSL changed from %s to %s", old, host)
+			reloadListener(old, port)
+			configLock.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
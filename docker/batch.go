@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// batch is the max number of datagrams read from or written to the desktop
+// per syscall (recvmmsg/sendmmsg), only linux batches them.
+var batch = 32
+
+// batchSize returns the size of the batches, 1 without batching
+func batchSize() int {
+	if !batchSupported || batch < 2 {
+		return 1
+	}
+	return batch
+}
+
+// batchReader reads a batch of datagrams per syscall and hands them out one by
+// one, like Read
+type batchReader struct {
+	conn  *net.UDPConn
+	msgs  *mmsgs
+	bufs  [][]byte
+	sizes []int
+	count int
+	next  int
+}
+
+func newBatchReader(conn *net.UDPConn, size int) *batchReader {
+	r := &batchReader{conn: conn}
+	if n := batchSize(); n > 1 {
+		r.msgs = newMmsgs(n)
+		r.bufs = make([][]byte, n)
+		for i := range r.bufs {
+			r.bufs[i] = make([]byte, size)
+		}
+		r.sizes = make([]int, n)
+	}
+	return r
+}
+
+func (r *batchReader) Read(b []byte) (int, error) {
+	if r.msgs == nil {
+		return r.conn.Read(b)
+	}
+	if r.next >= r.count {
+		n, err := r.msgs.recv(r.conn, r.bufs, r.sizes)
+		if err != nil {
+			return 0, err
+		}
+		r.count, r.next = n, 0
+	}
+	i := r.next
+	r.next++
+	return copy(b, r.bufs[i][:r.sizes[i]]), nil
+}
+
+// Grow enlarges the buffers to size once the read ones are handed out
+func (r *batchReader) Grow(size int) {
+	if r.Buffered() > 0 {
+		return
+	}
+	for i := range r.bufs {
+		if len(r.bufs[i]) < size {
+			r.bufs[i] = make([]byte, size)
+		}
+	}
+}
+
+// Buffered returns the number of datagrams read and not handed out yet
+func (r *batchReader) Buffered() int {
+	return r.count - r.next
+}
+
+// batchWriter queues the datagrams to the desktop and writes the queued ones
+// per syscall from its own goroutine
+type batchWriter struct {
+	conn  *net.UDPConn
+	msgs  *mmsgs
+	queue chan []byte
+}
+
+// writer is nil without batching, the datagrams are then written right away
+var writer *batchWriter
+
+// startWriter returns nil without batching
+func startWriter(conn *net.UDPConn) *batchWriter {
+	n := batchSize()
+	if n < 2 {
+		return nil
+	}
+	w := &batchWriter{conn: conn, msgs: newMmsgs(n), queue: make(chan []byte, n*4)}
+	go supervise("batch writer", func() { w.run(n) })
+	fmt.Printf("batch => %d\n", n)
+	return w
+}
+
+// send writes a datagram to the desktop, through the writer if any
+func send(conn *net.UDPConn, b []byte) error {
+	atomic.AddUint64(&dataWrites, 1)
+	if writer == nil {
+		_, err := writeUDP(conn, b)
+		return err
+	}
+	d := make([]byte, len(b))
+	copy(d, b)
+	writer.queue <- d
+	return nil
+}
+
+func (w *batchWriter) run(n int) {
+	bufs := make([][]byte, 0, n)
+	for d := range w.queue {
+		bufs = append(bufs, d)
+	collect:
+		for len(bufs) < n {
+			select {
+			case d := <-w.queue:
+				bufs = append(bufs, d)
+			default:
+				break collect
+			}
+		}
+		if err := w.msgs.send(w.conn, bufs); err != nil {
+			fmt.Printf("udp write error: %v\n", err)
+			resolveSoon()
+		}
+		bufs = bufs[:0]
+	}
+}
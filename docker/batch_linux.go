@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// batchSupported tells whether several datagrams are exchanged per syscall
+const batchSupported = true
+
+// mmsghdr is the struct mmsghdr of recvmmsg(2) and sendmmsg(2)
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgs holds the headers of a batch of datagrams of a connected socket
+type mmsgs struct {
+	hdrs []mmsghdr
+	iovs []syscall.Iovec
+}
+
+func newMmsgs(n int) *mmsgs {
+	return &mmsgs{hdrs: make([]mmsghdr, n), iovs: make([]syscall.Iovec, n)}
+}
+
+// prepare points the headers to the buffers
+func (m *mmsgs) prepare(bufs [][]byte) {
+	for i, b := range bufs {
+		m.iovs[i].Base = &b[0]
+		m.iovs[i].SetLen(len(b))
+		m.hdrs[i] = mmsghdr{}
+		m.hdrs[i].hdr.Iov = &m.iovs[i]
+		m.hdrs[i].hdr.Iovlen = 1
+	}
+}
+
+// recv reads up to len(bufs) datagrams with a single recvmmsg, blocking
+// until at least one is available
+func (m *mmsgs) recv(conn *net.UDPConn, bufs [][]byte, sizes []int) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	m.prepare(bufs)
+	var n int
+	var errno syscall.Errno
+	if err := raw.Read(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&m.hdrs[0])),
+				uintptr(len(bufs)), syscall.MSG_DONTWAIT, 0, 0)
+			if e == syscall.EINTR {
+				continue
+			}
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	}); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("recvmmsg", errno)
+	}
+	for i := 0; i < n; i++ {
+		sizes[i] = int(m.hdrs[i].len)
+	}
+	return n, nil
+}
+
+// send writes the datagrams with as few sendmmsg as possible, a datagram
+// failing is skipped and the error of the last one failing is returned
+func (m *mmsgs) send(conn *net.UDPConn, bufs [][]byte) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	m.prepare(bufs)
+	if conn.RemoteAddr() == nil {
+		// a socket of the group sends with the address of the desktop
+		sa, err := rawSockaddr4(remoteAddr(conn))
+		if err != nil {
+			return err
+		}
+		for i := range bufs {
+			m.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(sa))
+			m.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		}
+	}
+	var errno syscall.Errno
+	sent := 0
+	if err := raw.Write(func(fd uintptr) bool {
+		for sent < len(bufs) {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&m.hdrs[sent])),
+				uintptr(len(bufs)-sent), syscall.MSG_DONTWAIT, 0, 0)
+			switch e {
+			case 0:
+				sent += int(r)
+			case syscall.EINTR:
+			case syscall.EAGAIN:
+				return false
+			default:
+				errno = e
+				sent++
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return os.NewSyscallError("sendmmsg", errno)
+	}
+	return nil
+}
+
+// rawSockaddr4 returns the sockaddr of an IPv4 address
+func rawSockaddr4(addr *net.UDPAddr) (*syscall.RawSockaddrInet4, error) {
+	if addr == nil || addr.IP.To4() == nil {
+		return nil, fmt.Errorf("no IPv4 address of the desktop")
+	}
+	sa := &syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], uint16(addr.Port))
+	copy(sa.Addr[:], addr.IP.To4())
+	return sa, nil
+}
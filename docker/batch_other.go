@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// batchSupported tells whether several datagrams are exchanged per syscall
+const batchSupported = false
+
+type mmsgs struct{}
+
+func newMmsgs(n int) *mmsgs {
+	return nil
+}
+
+func (m *mmsgs) recv(conn *net.UDPConn, bufs [][]byte, sizes []int) (int, error) {
+	return 0, fmt.Errorf("batched reads not supported")
+}
+
+func (m *mmsgs) send(conn *net.UDPConn, bufs [][]byte) error {
+	return fmt.Errorf("batched writes not supported")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The benchmark of the desktop sends `14 | op | run(4) | ...`: the pings are
+// echoed as pongs, the up datagrams counted until `up end` answered with a
+// report, and `down` starts sending data for a while, followed by `down end`.
+const (
+	benchType    = 14
+	benchPing    = 1
+	benchPong    = 2
+	benchUp      = 3
+	benchUpEnd   = 4
+	benchReport  = 5
+	benchDown    = 6
+	benchData    = 7
+	benchDownEnd = 8
+	benchHeader  = 6
+	// benchMax bounds the duration of a download
+	benchMax = time.Minute
+)
+
+var (
+	benchLock    sync.Mutex
+	benchRun     uint32
+	benchPackets uint64
+	benchBytes   uint64
+	benchFirst   time.Time
+	benchLast    time.Time
+	benchSending int32
+)
+
+// handleBench answers a datagram of the benchmark
+func handleBench(conn *net.UDPConn, data []byte) {
+	if len(data) < benchHeader {
+		return
+	}
+	run := binary.BigEndian.Uint32(data[2:])
+	switch data[1] {
+	case benchPing:
+		pong := append([]byte(nil), data...)
+		pong[1] = benchPong
+		send(conn, pong)
+	case benchUp:
+		now := time.Now()
+		benchLock.Lock()
+		if run != benchRun {
+			fmt.Printf("bench => run %d from the desktop\n", run)
+			benchRun, benchPackets, benchBytes, benchFirst = run, 0, 0, now
+		}
+		benchPackets++
+		benchBytes += uint64(len(data))
+		benchLast = now
+		benchLock.Unlock()
+	case benchUpEnd:
+		report := make([]byte, benchHeader+24)
+		copy(report, data[:benchHeader])
+		report[1] = benchReport
+		benchLock.Lock()
+		if run == benchRun {
+			binary.BigEndian.PutUint64(report[benchHeader:], benchPackets)
+			binary.BigEndian.PutUint64(report[benchHeader+8:], benchBytes)
+			binary.BigEndian.PutUint64(report[benchHeader+16:], uint64(benchLast.Sub(benchFirst)))
+		}
+		benchLock.Unlock()
+		send(conn, report)
+	case benchDown:
+		if len(data) < benchHeader+8 {
+			return
+		}
+		d := time.Duration(binary.BigEndian.Uint32(data[benchHeader:])) * time.Millisecond
+		size := int(binary.BigEndian.Uint32(data[benchHeader+4:]))
+		if d > benchMax || size < benchHeader+4 || size > 65000 {
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&benchSending, 0, 1) {
+			return
+		}
+		go benchSend(conn, run, d, size)
+	}
+}
+
+// benchSend sends the data of a download for d, then its end
+func benchSend(conn *net.UDPConn, run uint32, d time.Duration, size int) {
+	defer atomic.StoreInt32(&benchSending, 0)
+	packet := make([]byte, size)
+	packet[0], packet[1] = benchType, benchData
+	binary.BigEndian.PutUint32(packet[2:], run)
+	var packets, bytes uint64
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		binary.BigEndian.PutUint32(packet[benchHeader:], uint32(packets))
+		if err := send(conn, packet); err != nil {
+			continue
+		}
+		packets++
+		bytes += uint64(size)
+	}
+	fmt.Printf("bench => sent %d datagrams %d bytes in %v\n", packets, bytes, d)
+	end := make([]byte, benchHeader+16)
+	end[0], end[1] = benchType, benchDownEnd
+	binary.BigEndian.PutUint32(end[2:], run)
+	binary.BigEndian.PutUint64(end[benchHeader:], packets)
+	binary.BigEndian.PutUint64(end[benchHeader+8:], bytes)
+	// the end of the data is delayed behind them
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		send(conn, end)
+	}
+}
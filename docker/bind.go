@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// bindIface is the interface the sockets to the desktop send through,
+// whatever the routes, e.g. eth1 past a full-tunnel VPN
+var bindIface = ""
+
+// dialUDP connects a socket to the desktop, from laddr if not nil, bound to
+// `bindIface` if set
+func dialUDP(laddr, udpAddr *net.UDPAddr) (*net.UDPConn, error) {
+	if bindIface == "" {
+		return net.DialUDP("udp", laddr, udpAddr)
+	}
+	d := net.Dialer{Control: bindControl(bindIface)}
+	if laddr != nil {
+		d.LocalAddr = laddr
+	}
+	c, err := d.Dial("udp", udpAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// listenUDP opens an unconnected socket on a random port, bound to
+// `bindIface` if set
+func listenUDP() (*net.UDPConn, error) {
+	if bindIface == "" {
+		return net.ListenUDP("udp", nil)
+	}
+	lc := net.ListenConfig{Control: bindControl(bindIface)}
+	c, err := lc.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
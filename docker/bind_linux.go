@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindControl binds the socket to the interface before it connects
+func bindControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// connectUDP connects the socket to another address in place, the datagrams
+// leaving from the same port
+func connectUDP(conn *net.UDPConn, addr *net.UDPAddr) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sa syscall.Sockaddr
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() == nil {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	} else if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		return fmt.Errorf("%s from an IPv4 socket", addr)
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.Connect(int(fd), sa)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func bindControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("binding to an interface only supported on linux")
+	}
+}
+
+func connectUDP(conn *net.UDPConn, addr *net.UDPAddr) error {
+	return fmt.Errorf("reconnecting in place only supported on linux")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// `desktop-connector bridge` is the remote end of the ssh transport of the
+// desktop: run by the ssh session in the agent container, it listens on
+// 127.0.0.1:`-port` for the agent started with `-host 127.0.0.1` and carries
+// its datagrams over stdin and stdout as `length(2) | datagram`. Stdout is
+// the channel, the messages go to stderr.
+const frameHeader = 2
+
+func runBridge() {
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	fs.IntVar(&port, "port", port, "udp port the agent connects to on 127.0.0.1")
+	fs.Parse(os.Args[2:])
+	applyEnv(fs)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bridge listen error => %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "bridge => %v\n", pc.LocalAddr())
+	var agent atomic.Value
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		buf := make([]byte, 65536)
+		for {
+			n, err := readFrame(r, buf)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "bridge closed => %v\n", err)
+				os.Exit(0)
+			}
+			to, _ := agent.Load().(*net.UDPAddr)
+			if to == nil {
+				continue
+			}
+			pc.WriteToUDP(buf[:n], to)
+		}
+	}()
+	buf := make([]byte, frameHeader+65536)
+	for {
+		n, from, err := pc.ReadFromUDP(buf[frameHeader:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bridge read error => %v\n", err)
+			continue
+		}
+		if to, _ := agent.Load().(*net.UDPAddr); to == nil || to.String() != from.String() {
+			fmt.Fprintf(os.Stderr, "bridge agent => %v\n", from)
+			agent.Store(from)
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		if _, err := os.Stdout.Write(buf[:frameHeader+n]); err != nil {
+			os.Exit(0)
+		}
+	}
+}
+
+// readFrame reads a datagram of the channel
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var header [frameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("frame of %d bytes", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With `-compose myapp` the agent follows the containers of the compose
+// project through the docker socket: their networks are pushed to the desktop
+// as `connect <subnet>`, and `<service>.myapp`, `<service>-<n>.myapp` for each
+// replica, are answered by the dns server of the agent, which the desktop asks
+// for `*.myapp` once pushed `dns myapp <agent ip>`. They are updated on
+// `docker compose up` and `down`.
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+)
+
+var compose = ""
+
+// composeState is what is pushed for a project
+type composeState struct {
+	hosts   map[string]net.IP
+	subnets map[string]bool
+}
+
+type composeContainer struct {
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress   string `json:"IPAddress"`
+			IPPrefixLen int    `json:"IPPrefixLen"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// composeProject returns the hosts and the subnets of the running containers
+// of a project
+func composeProject(project string) (*composeState, error) {
+	filters := fmt.Sprintf(`{"label":["%s=%s"]}`, composeProjectLabel, project)
+	body, err := dockerGet("/containers/json?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return nil, err
+	}
+	var containers []composeContainer
+	err = json.NewDecoder(body).Decode(&containers)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	state := &composeState{hosts: make(map[string]net.IP), subnets: make(map[string]bool)}
+	// replicas in order, the first one answering for the service
+	sort.Slice(containers, func(i, j int) bool {
+		a, _ := strconv.Atoi(containers[i].Labels[composeNumberLabel])
+		b, _ := strconv.Atoi(containers[j].Labels[composeNumberLabel])
+		return a < b
+	})
+	for _, c := range containers {
+		service := c.Labels[composeServiceLabel]
+		if service == "" {
+			continue
+		}
+		// the network named after the project first, then by name
+		var names []string
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return names[i] == project+"_default" || (names[j] != project+"_default" && names[i] < names[j])
+		})
+		for _, name := range names {
+			n := c.NetworkSettings.Networks[name]
+			ip := net.ParseIP(n.IPAddress).To4()
+			if ip == nil || n.IPPrefixLen == 0 {
+				continue
+			}
+			mask := net.CIDRMask(n.IPPrefixLen, 32)
+			state.subnets[(&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()] = true
+			if state.hosts[service+"."+project] == nil {
+				state.hosts[service+"."+project] = ip
+			}
+			if num := c.Labels[composeNumberLabel]; num != "" && state.hosts[service+"-"+num+"."+project] == nil {
+				state.hosts[service+"-"+num+"."+project] = ip
+			}
+		}
+	}
+	return state, nil
+}
+
+// composeHosts are the names of the projects answered by the dns server
+var (
+	composeHosts     = make(map[string][4]byte)
+	composeHostsLock sync.RWMutex
+)
+
+// composeHost returns the address of a name of the projects
+func composeHost(name string) ([4]byte, bool) {
+	composeHostsLock.RLock()
+	defer composeHostsLock.RUnlock()
+	a, ok := composeHosts[strings.ToLower(name)]
+	return a, ok
+}
+
+// watchCompose pushes the networks and the names of the projects to the
+// desktop
+func watchCompose(conn *net.UDPConn, ip net.IP) {
+	known := make(map[string]*composeState)
+	pushed := make(map[string]bool)
+	for i := 0; ; i++ {
+		var projects []string
+		wanted := make(map[string]bool)
+		for _, p := range strings.Split(compose, ",") {
+			if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+				projects = append(projects, p)
+				wanted[p] = true
+			}
+		}
+		if len(projects) > 0 {
+			if dnsSvr == nil {
+				dnsSvr = NewDnsServer()
+			}
+			dnsSvr.Start(ip)
+		}
+		for project, state := range known {
+			if !wanted[project] {
+				if len(state.hosts) > 0 {
+					sendRoute(conn, "dns "+project)
+				}
+				delete(known, project)
+			}
+		}
+		subnets := make(map[string]bool)
+		hosts := make(map[string][4]byte)
+		for _, project := range projects {
+			state, err := composeProject(project)
+			if err != nil {
+				fmt.Printf("compose %s error => %v\n", project, err)
+				if state = known[project]; state == nil {
+					continue
+				}
+			}
+			old := known[project]
+			if old == nil || fmt.Sprint(old.hosts) != fmt.Sprint(state.hosts) {
+				fmt.Printf("compose %s => %v\n", project, state.hosts)
+			}
+			for name, a := range state.hosts {
+				hosts[name+"."] = [4]byte{a[0], a[1], a[2], a[3]}
+			}
+			for subnet := range state.subnets {
+				subnets[subnet] = true
+			}
+			switch {
+			case len(state.hosts) > 0 && (old == nil || len(old.hosts) == 0 || i%pushRepeat == 0):
+				sendRoute(conn, fmt.Sprintf("dns %s %s", project, ip))
+			case len(state.hosts) == 0 && old != nil && len(old.hosts) > 0:
+				sendRoute(conn, "dns "+project)
+			}
+			known[project] = state
+		}
+		for subnet := range subnets {
+			if !pushed[subnet] || i%pushRepeat == 0 {
+				sendRoute(conn, "connect "+subnet)
+			}
+		}
+		for subnet := range pushed {
+			if !subnets[subnet] {
+				sendRoute(conn, "disconnect "+subnet)
+			}
+		}
+		pushed = subnets
+		composeHostsLock.Lock()
+		composeHosts = hosts
+		composeHostsLock.Unlock()
+		time.Sleep(pushInterval)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// When both sides enable it, packets are sent as datagrams of
+//
+//	7 | lz4 block
+//
+// The desktop offers `compress lz4` in the controls, and we accept by
+// appending a features byte to the heartbeats. Decompression is always
+// supported.
+const (
+	compressType = 7
+	featureLZ4   = 1
+)
+
+var (
+	compress = false
+	// offered is set when the desktop offered lz4 in its controls
+	offered    int32
+	compressor lz4.Compressor
+)
+
+// setOffered records whether the last controls offered compression
+func setOffered(lz4 bool) {
+	var v int32
+	if lz4 && compress {
+		v = 1
+	}
+	if atomic.SwapInt32(&offered, v) != v {
+		fmt.Printf("compress => %v\n", v == 1)
+	}
+}
+
+// features is the byte advertised in the heartbeats, with featureChunks,
+// featureKeepalive, featureDeltas and featureControls always set
+func features() byte {
+	f := byte(featureChunks | featureKeepalive | featureDeltas | featureControls)
+	if atomic.LoadInt32(&offered) == 1 {
+		f |= featureLZ4
+	}
+	if bridged() {
+		f |= featureTAP
+	}
+	if atomic.LoadInt32(&fecOffered) > 0 {
+		f |= featureFEC
+	}
+	if atomic.LoadInt32(&dedupOffered) == 1 {
+		f |= featureDedup
+	}
+	return f
+}
+
+// compressPacket returns the compressed datagram of the packet if it is
+// smaller, it is only called by the TUN reader
+func compressPacket(packet []byte) []byte {
+	if atomic.LoadInt32(&offered) == 0 {
+		return packet
+	}
+	buf := make([]byte, 1+lz4.CompressBlockBound(len(packet)))
+	n, err := compressor.CompressBlock(packet, buf[1:])
+	if err != nil || n == 0 || n+1 >= len(packet) {
+		return packet
+	}
+	buf[0] = compressType
+	return buf[:n+1]
+}
+
+// decompressPacket expands a compressed datagram into buf
+func decompressPacket(data, buf []byte) (int, error) {
+	return lz4.UncompressBlock(data[1:], buf)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With `-config <file>`, e.g. a file mounted into the container, the flags are
+// read from a file as well, a flag per line as `<flag> <value>` or
+// `DDC_<FLAG>=<value>` like an env file, `#` for comments. The command line
+// wins over the file, which wins over the environment. The file is checked
+// every few seconds and its changes applied without restarting the container:
+// a new `host`, `port` or `knock-port` connects the sockets to the desktop
+// there in place, `push-routes`, `kube`, `compose`, `join-networks`, `mdns`,
+// `publish` and `proxy-arp` are picked up by their watchers, `heartbeat` and `lost-after`
+// apply unless the desktop pushes its own. The other flags need a restart,
+// which is logged.
+const configEvery = 2 * time.Second
+
+var (
+	configFile = ""
+	// cmdlineFlags are the flags given on the command line, kept on reload
+	cmdlineFlags map[string]bool
+	// baseFlags are the values before the file, restored when a flag is
+	// removed from it
+	baseFlags map[string]string
+	// configStamp tells whether the file changed since it was read
+	configStamp string
+)
+
+// liveFlags are the flags a reload applies
+var liveFlags = map[string]bool{
+	"host":           true,
+	"port":           true,
+	"knock-port":     true,
+	"knock-secret":   true,
+	"control-secret": true,
+	"heartbeat":      true,
+	"lost-after":     true,
+	"reconnect-max":  true,
+	"push-routes":    true,
+	"kube":           true,
+	"compose":        true,
+	"join-networks":  true,
+	"proxy-arp":      true,
+	"mdns":           true,
+	"publish":        true,
+	"debug":          true,
+}
+
+func configFileStamp() string {
+	st, err := os.Stat(configFile)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", st.ModTime().UnixNano(), st.Size())
+}
+
+// readConfigFile returns the values of the file by flag
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vals := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, val := line, "true"
+		if i := strings.IndexAny(line, "= \t"); i > 0 {
+			key = line[:i]
+			val = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[i:]), "="))
+			val = strings.Trim(val, `"'`)
+		}
+		key = strings.ToLower(strings.Replace(strings.TrimPrefix(key, envPrefix), "_", "-", -1))
+		vals[key] = val
+	}
+	return vals, nil
+}
+
+// applyConfigFile sets the flags of the file, the others back to their values
+// before it, and returns the changed ones. On reload only the live flags
+// change.
+func applyConfigFile(fs *flag.FlagSet, vals map[string]string, reload bool) []string {
+	for key := range vals {
+		if fs.Lookup(key) == nil || key == "config" {
+			fmt.Printf("config => unknown flag %s\n", key)
+		}
+	}
+	var changed []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if cmdlineFlags[f.Name] || f.Name == "config" {
+			return
+		}
+		val, ok := vals[f.Name]
+		if !ok {
+			val = baseFlags[f.Name]
+		}
+		if val == f.Value.String() {
+			return
+		}
+		if reload && !liveFlags[f.Name] {
+			fmt.Printf("config %s => restart to apply\n", f.Name)
+			return
+		}
+		if err := fs.Set(f.Name, val); err != nil {
+			fmt.Printf("invalid %s => %v\n", f.Name, err)
+			return
+		}
+		changed = append(changed, f.Name)
+	})
+	sort.Strings(changed)
+	return changed
+}
+
+// loadConfigFile applies `-config` at startup
+func loadConfigFile(fs *flag.FlagSet) {
+	if configFile == "" {
+		return
+	}
+	baseFlags = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		baseFlags[f.Name] = f.Value.String()
+	})
+	configStamp = configFileStamp()
+	vals, err := readConfigFile(configFile)
+	if err != nil {
+		fmt.Printf("config error => %v\n", err)
+		return
+	}
+	applyConfigFile(fs, vals, false)
+	fmt.Printf("config => %s\n", configFile)
+}
+
+// watchConfig applies the changes of `-config`
+func watchConfig(conn, ctl *net.UDPConn) {
+	if configFile == "" {
+		return
+	}
+	for {
+		time.Sleep(configEvery)
+		stamp := configFileStamp()
+		if stamp == configStamp {
+			continue
+		}
+		configStamp = stamp
+		vals, err := readConfigFile(configFile)
+		if err != nil {
+			// e.g. a config map being swapped, the next one is applied
+			fmt.Printf("config error => %v\n", err)
+			continue
+		}
+		oldHost, oldPort, oldKnock := host, port, knockPort
+		changed := applyConfigFile(flag.CommandLine, vals, true)
+		if len(changed) == 0 {
+			continue
+		}
+		fmt.Printf("config reloaded => %s\n", strings.Join(changed, " "))
+		readSecrets(false)
+		setHeartbeatFlags(heartbeat, lostAfter)
+		refreshFastPath()
+		if host != oldHost || port != oldPort || knockPort != oldKnock {
+			redialDesktop(conn, ctl)
+		}
+	}
+}
+
+// redialDesktop connects the sockets to the new address of the desktop, which
+// gets the session, the routes and asks for the controls once it answers
+func redialDesktop(conn, ctl *net.UDPConn) {
+	if rendezvous != "" {
+		fmt.Println("config host => restart to apply, the desktop is reached through the rendezvous")
+		return
+	}
+	resolveWSL()
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		fmt.Printf("invalid address => %s:%d\n", host, port)
+		return
+	}
+	if conn.RemoteAddr() == nil {
+		err = setDesktopAddr(udpAddr)
+	} else {
+		err = connectUDP(conn, udpAddr)
+	}
+	if err != nil {
+		fmt.Printf("failed to dial %s => %v\n", udpAddr, err)
+		return
+	}
+	fmt.Printf("remote => %s\n", udpAddr)
+	refreshFastPath()
+	if ctl != conn {
+		if ctlAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, controlPort)); err != nil {
+			fmt.Printf("invalid control address => %s:%d\n", host, controlPort)
+		} else if err := connectUDP(ctl, ctlAddr); err != nil {
+			fmt.Printf("failed to dial control port %d => %v\n", controlPort, err)
+		} else {
+			fmt.Printf("control => %s\n", ctlAddr)
+		}
+	}
+	switch {
+	case knockPort <= 0 || knockSecret == "":
+		knockConn = nil
+	case knockConn == nil:
+		dialKnock()
+	default:
+		if knockAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, knockPort)); err == nil {
+			if err := connectUDP(knockConn, knockAddr); err != nil {
+				fmt.Printf("failed to dial knock port %d => %v\n", knockPort, err)
+			}
+		}
+	}
+	// probe until the desktop answers, which resyncs the controls
+	atomic.StoreInt32(&lost, 1)
+	knock()
+	sendHeartbeat(ctl)
+}
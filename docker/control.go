@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// With `-control-port`, heartbeats, controls, resync requests and diag
+// results use a second socket marked with DSCP CS6, so they stay responsive
+// while the data socket is saturated.
+const controlTOS = 0xc0
+
+var (
+	controlPort = 0
+	// dataConn is set when the control traffic has its own socket
+	dataConn *net.UDPConn
+)
+
+// dialControl returns the socket of the control traffic, the data socket
+// itself without `-control-port`
+func dialControl(conn *net.UDPConn) *net.UDPConn {
+	if controlPort <= 0 {
+		return conn
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, controlPort))
+	if err != nil {
+		fmt.Printf("invalid control address => %s:%d\n", host, controlPort)
+		return conn
+	}
+	ctl, err := dialUDP(nil, udpAddr)
+	if err != nil {
+		fmt.Printf("failed to dial control port %d => %s\n", controlPort, err.Error())
+		return conn
+	}
+	if err := setTOS(ctl, controlTOS); err != nil {
+		fmt.Printf("failed to set control dscp => %v\n", err)
+	}
+	fmt.Printf("control => %s\n", ctl.RemoteAddr())
+	dataConn = conn
+	return ctl
+}
+
+// helloData keeps the address of the data socket known to the desktop when
+// heartbeats go to the control socket
+func helloData(conn *net.UDPConn) {
+	if dataConn != nil && conn != dataConn {
+		writeUDP(dataConn, []byte{0})
+	}
+}
+
+func readControl(ctl *net.UDPConn, ip net.IP) {
+	data := make([]byte, bufferSize())
+	supervise("control reader", func() {
+		for {
+			n, err := ctl.Read(data)
+			if err != nil {
+				if strings.Contains(err.Error(), "closed") {
+					return
+				}
+				fmt.Println("failed read control msg, error: " + err.Error())
+				markLost(err.Error())
+				continue
+			}
+			if n == 0 {
+				continue
+			}
+			received(ctl)
+			switch data[0] {
+			case 0:
+				handleHeartbeat(data[:n])
+			case sessionRequest:
+				requestedSession(ctl, data[1:n])
+			case diagCommand:
+				go handleDiag(ctl, string(data[1:n]))
+			case 1, controlsType:
+				readControls(ctl, ctl, data, n, ip)
+			case controlChunk:
+				readControlChunk(ctl, data[:n], ip)
+			}
+		}
+	})
+}
@@ -0,0 +1,9 @@
+package main
+
+import "net"
+
+// setTOS leaves the type of service to the QoS policies of windows, which
+// ignores IP_TOS
+func setTOS(conn *net.UDPConn, tos int) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// With `-control-secret` the controls pushed to the desktop, the routes and
+// the domains, are signed with the secret of its `control-secret`, as
+// `timestamp(8) | hmac-sha256(secret, timestamp | line) | line`, so it
+// rejects the forged and replayed ones.
+var controlSecret = ""
+
+// signControl returns the payload of a pushed control
+func signControl(line string) []byte {
+	if controlSecret == "" {
+		return []byte(line)
+	}
+	packet := make([]byte, 8, 8+sha256.Size+len(line))
+	binary.BigEndian.PutUint64(packet, uint64(time.Now().UnixNano()))
+	mac := hmac.New(sha256.New, []byte(controlSecret))
+	mac.Write(packet)
+	mac.Write([]byte(line))
+	packet = mac.Sum(packet)
+	return append(packet, line...)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Advertising featureDeltas, the agent gets versioned controls from the
+// desktop, the first item telling the full state or the changes from a
+// version:
+//
+//	version <v>,<item>,...
+//	delta <base> <v>,+<item>,-<item>,=<item>,...
+//
+// `=` replacing the items of the same first word. The state is applied as a
+// whole, the removed `connect` rules disconnected and the removed `dns`
+// domains no longer redirected. Each applied version is acknowledged with
+//
+//	19 | version(8)
+//
+// and a delta on another base than the current version asks a resync.
+const (
+	featureDeltas = 64
+	controlsAck   = 19
+)
+
+var controlState = struct {
+	sync.Mutex
+	version uint64
+	items   []string
+}{}
+
+// versionedControls returns the controls to apply of a payload and its
+// version, 0 for the unversioned ones of older desktops, or false for a delta
+// on another base
+func versionedControls(conn *net.UDPConn, cmds []string) ([]string, uint64, bool) {
+	head := strings.Fields(cmds[0])
+	if len(head) == 0 || head[0] != "version" && head[0] != "delta" {
+		controlState.Lock()
+		controlState.version, controlState.items = 0, nil
+		controlState.Unlock()
+		return cmds, 0, true
+	}
+	controlState.Lock()
+	defer controlState.Unlock()
+	var items []string
+	var version uint64
+	var err error
+	switch {
+	case head[0] == "version" && len(head) == 2:
+		version, err = strconv.ParseUint(head[1], 10, 64)
+		items = append(items, cmds[1:]...)
+	case head[0] == "delta" && len(head) == 3:
+		var base uint64
+		if base, err = strconv.ParseUint(head[1], 10, 64); err == nil && base != controlState.version {
+			fmt.Printf("controls => delta on %d at version %d, resync\n", base, controlState.version)
+			writeUDP(conn, []byte{resyncRequest})
+			return nil, 0, false
+		}
+		if err == nil {
+			version, err = strconv.ParseUint(head[2], 10, 64)
+			items = applyDelta(controlState.items, cmds[1:])
+		}
+	default:
+		err = fmt.Errorf("invalid head")
+	}
+	if err != nil {
+		fmt.Printf("controls => invalid %q, resync\n", cmds[0])
+		writeUDP(conn, []byte{resyncRequest})
+		return nil, 0, false
+	}
+	applied := append([]string(nil), items...)
+	current := make(map[string]bool, len(items))
+	for _, item := range items {
+		current[item] = true
+	}
+	for _, item := range controlState.items {
+		if current[item] {
+			continue
+		}
+		vals := strings.Fields(item)
+		switch {
+		case len(vals) == 3 && vals[0] == "connect":
+			applied = append(applied, "disconnect "+vals[1]+" "+vals[2])
+		case len(vals) > 1 && vals[0] == "dns":
+			applied = append(applied, "dns -"+strings.Join(vals[1:], " -"))
+		}
+	}
+	controlState.version, controlState.items = version, items
+	return applied, version, true
+}
+
+// applyDelta returns the items changed by the operations of a delta
+func applyDelta(items, ops []string) []string {
+	next := append([]string(nil), items...)
+	for _, op := range ops {
+		if op == "" {
+			continue
+		}
+		item := op[1:]
+		switch op[0] {
+		case '+':
+			next = append(next, item)
+		case '-':
+			for i := 0; i < len(next); i++ {
+				if next[i] == item {
+					next = append(next[:i], next[i+1:]...)
+					i--
+				}
+			}
+		case '=':
+			word := strings.SplitN(item, " ", 2)[0]
+			replaced := false
+			for i := 0; i < len(next); i++ {
+				if strings.SplitN(next[i], " ", 2)[0] != word {
+					continue
+				}
+				if !replaced {
+					next[i], replaced = item, true
+					continue
+				}
+				next = append(next[:i], next[i+1:]...)
+				i--
+			}
+			if !replaced {
+				next = append(next, item)
+			}
+		}
+	}
+	return next
+}
+
+// ackControls acknowledges an applied version to the desktop
+func ackControls(conn *net.UDPConn, version uint64) {
+	if version == 0 {
+		return
+	}
+	ack := make([]byte, 9)
+	ack[0] = controlsAck
+	binary.BigEndian.PutUint64(ack[1:], version)
+	writeUDP(conn, ack)
+}
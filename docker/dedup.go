@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// When the desktop offers `dedup` in the controls we accept with a feature
+// bit of the heartbeats and frame the datagrams of the tunneled packets with
+// a sequence number
+//
+//	16 | seq(4) | datagram
+//
+// so the duplicates made by middleboxes are dropped by the receiving side,
+// within a window of dedupWindow sequence numbers. Unframing is always
+// supported.
+const (
+	seqType      = 16
+	seqHeader    = 5
+	featureDedup = 8
+	dedupWindow  = 1024
+)
+
+var (
+	dedupOffered int32
+	seqOut       = rand.Uint32()
+	seqIn        = &seqWindow{}
+)
+
+type seqWindow struct {
+	sync.Mutex
+	started    bool
+	top        uint32
+	seen       [dedupWindow / 64]uint64
+	duplicates uint64
+}
+
+// setDedupOffered records whether the last controls offered dedup
+func setDedupOffered(offer bool) {
+	var v int32
+	if offer {
+		v = 1
+	}
+	if atomic.SwapInt32(&dedupOffered, v) != v {
+		fmt.Printf("dedup => %v\n", offer)
+	}
+}
+
+// sendFramed sends a datagram to the desktop, framed with its sequence
+// number if negotiated
+func sendFramed(conn *net.UDPConn, datagram []byte) error {
+	if atomic.LoadInt32(&dedupOffered) == 0 {
+		return send(conn, datagram)
+	}
+	buf := make([]byte, seqHeader+len(datagram))
+	buf[0] = seqType
+	binary.BigEndian.PutUint32(buf[1:], atomic.AddUint32(&seqOut, 1))
+	copy(buf[seqHeader:], datagram)
+	return send(conn, buf)
+}
+
+func (w *seqWindow) bit(seq uint32) (*uint64, uint64) {
+	i := seq % dedupWindow
+	return &w.seen[i/64], 1 << (i % 64)
+}
+
+// Accept tells whether a sequence number is new, recording it
+func (w *seqWindow) Accept(seq uint32) bool {
+	w.Lock()
+	defer w.Unlock()
+	ahead := int32(seq - w.top)
+	switch {
+	case !w.started || ahead <= -dedupWindow*4 || ahead >= dedupWindow:
+		// first datagram, restart of the desktop or a jump
+		w.started, w.top = true, seq
+		w.seen = [dedupWindow / 64]uint64{}
+	case ahead > 0:
+		for s := w.top + 1; s != seq; s++ {
+			word, mask := w.bit(s)
+			*word &^= mask
+		}
+		w.top = seq
+	case ahead <= -dedupWindow:
+		return true
+	default:
+		if word, mask := w.bit(seq); *word&mask != 0 {
+			w.duplicates++
+			if debug.On() {
+				fmt.Printf("dedup => duplicate %d, %d so far\n", seq, w.duplicates)
+			}
+			return false
+		}
+	}
+	word, mask := w.bit(seq)
+	*word |= mask
+	return true
+}
+
+// unframe returns the datagram of a framed one, nil for a duplicate
+func unframe(data []byte) []byte {
+	if len(data) <= seqHeader || !seqIn.Accept(binary.BigEndian.Uint32(data[1:])) {
+		return nil
+	}
+	return data[seqHeader:]
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagnostic commands are sent by the desktop as `4 | command`, results are
+// shipped back in chunks of `3 | kind | index(2) | count(2) | data`.
+const (
+	diagCommand = 4
+	diagResult  = 3
+	diagText    = 1
+	diagPcap    = 2
+	// maxCapture limits the size of a capture shipped back to the desktop
+	maxCapture = 1 << 20
+)
+
+var (
+	captureLock sync.Mutex
+	captureBuf  *bytes.Buffer
+	captureMax  int
+	captureNum  int
+)
+
+func handleDiag(conn *net.UDPConn, cmd string) {
+	argv := strings.Fields(cmd)
+	if len(argv) == 0 {
+		return
+	}
+	fmt.Printf("diag => %s\n", cmd)
+	switch argv[0] {
+	case "loglevel":
+		if len(argv) > 1 {
+			debug.SetOn(strings.EqualFold(argv[1], "debug"))
+		}
+		sendDiag(conn, diagText, []byte(fmt.Sprintf("debug %v", debug.On())))
+	case "capture":
+		seconds := 10
+		if len(argv) > 1 {
+			if v, err := strconv.Atoi(argv[1]); err == nil && v > 0 {
+				seconds = v
+			}
+		}
+		packets := 1000
+		if len(argv) > 2 {
+			if v, err := strconv.Atoi(argv[2]); err == nil && v > 0 {
+				packets = v
+			}
+		}
+		startCapture(conn, time.Duration(seconds)*time.Second, packets)
+		refreshFastPath()
+	default:
+		sendDiag(conn, diagText, []byte("unknown diag => "+argv[0]))
+	}
+}
+
+func startCapture(conn *net.UDPConn, d time.Duration, packets int) {
+	captureLock.Lock()
+	defer captureLock.Unlock()
+	if captureBuf != nil {
+		return
+	}
+	captureBuf = &bytes.Buffer{}
+	captureMax = packets
+	captureNum = 0
+	// pcap global header with LINKTYPE_RAW
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], 101)
+	captureBuf.Write(header)
+	sendDiag(conn, diagText, []byte(fmt.Sprintf("capture started for %v", d)))
+	time.AfterFunc(d, func() {
+		captureLock.Lock()
+		data := captureBuf.Bytes()
+		num := captureNum
+		captureBuf = nil
+		captureLock.Unlock()
+		refreshFastPath()
+		fmt.Printf("capture done => %d packets %d bytes\n", num, len(data))
+		sendDiag(conn, diagPcap, data)
+	})
+}
+
+// capturePacket records the packet if a capture is running
+func capturePacket(packet []byte) {
+	if len(packet) == 0 || (packet[0]>>4 != 4 && packet[0]>>4 != 6) {
+		return
+	}
+	captureLock.Lock()
+	defer captureLock.Unlock()
+	if captureBuf == nil || captureNum >= captureMax || captureBuf.Len()+len(packet)+16 > maxCapture {
+		return
+	}
+	now := time.Now()
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	captureBuf.Write(record)
+	captureBuf.Write(packet)
+	captureNum++
+}
+
+func sendDiag(conn *net.UDPConn, kind byte, data []byte) {
+	size := currentMTU() - 6
+	count := (len(data) + size - 1) / size
+	if count == 0 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 6, 6+end-i*size)
+		chunk[0] = diagResult
+		chunk[1] = kind
+		binary.BigEndian.PutUint16(chunk[2:], uint16(i))
+		binary.BigEndian.PutUint16(chunk[4:], uint16(count))
+		chunk = append(chunk, data[i*size:end]...)
+		if _, err := writeUDP(conn, chunk); err != nil {
+			fmt.Printf("diag write error: %v\n", err)
+			return
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -18,7 +19,14 @@ type DNSServer struct {
 	ptr     map[string]string
 	tmp     map[string]byte
 	up      *net.UDPConn
-	pending map[string][]*net.UDPAddr
+	pending map[string][]pendingQuery
+	started bool
+}
+
+// pendingQuery is a query forwarded to the system resolver
+type pendingQuery struct {
+	addr  *net.UDPAddr
+	start time.Time
 }
 
 func NewDnsServer() *DNSServer {
@@ -29,9 +37,10 @@ func NewDnsServer() *DNSServer {
 }
 
 func (s *DNSServer) Start(ip net.IP) error {
-	if s.udp != nil {
+	if s.udp != nil || s.started {
 		return nil
 	}
+	s.started = true
 	go s.run(ip)
 	return nil
 }
@@ -62,18 +71,47 @@ func (s *DNSServer) Add(record string) {
 		return
 	}
 	ipv4 := net.ParseIP(argv[0]).To4()
+	ptr := ""
 	for i := 1; i < len(argv); i++ {
 		s.a[argv[i]+"."] = [4]byte{ipv4[0], ipv4[1], ipv4[2], ipv4[3]}
 		if s.tmp != nil {
 			s.tmp[argv[i]+"."] = 1
 		}
+		// a wildcard `*.test` answers the names under test, not the reverse
+		if ptr == "" && !strings.HasPrefix(argv[i], "*.") {
+			ptr = argv[i]
+		}
 	}
-	s.ptr[argv[0]+".in-addr.arpa."] = argv[1] + "."
+	if ptr == "" {
+		return
+	}
+	s.ptr[argv[0]+".in-addr.arpa."] = ptr + "."
 	if s.tmp != nil {
 		s.tmp[argv[0]+".in-addr.arpa."] = 1
 	}
 }
 
+// lookup returns the address of a name, of the hosts entries, the compose
+// projects, the templates, then of the closest wildcard entry
+func (s *DNSServer) lookup(name string) ([4]byte, bool) {
+	if a, ok := s.a[name]; ok {
+		return a, true
+	}
+	if a, ok := composeHost(name); ok {
+		return a, true
+	}
+	if a, ok := templateHost(name); ok {
+		return a, true
+	}
+	for rest := name; strings.Contains(rest, "."); {
+		rest = rest[strings.Index(rest, ".")+1:]
+		if a, ok := s.a["*."+rest]; ok && rest != "" {
+			return a, true
+		}
+	}
+	return [4]byte{}, false
+}
+
 func (s *DNSServer) StartClear() {
 	s.tmp = make(map[string]byte)
 	for k := range s.a {
@@ -108,33 +146,51 @@ func (s *DNSServer) serve(addr *net.UDPAddr, conn *net.UDPConn, msg dnsmessage.M
 		queryType    = question.Type
 		queryName, _ = dnsmessage.NewName(queryNameStr)
 	)
+	start := time.Now()
+	path := dnsPath(queryNameStr)
 	var resource dnsmessage.Resource
+	found := false
 	switch queryType {
 	case dnsmessage.TypeAAAA:
 		fallthrough
 	case dnsmessage.TypeA:
-		if rst, ok := s.a[queryNameStr]; ok {
-			resource = newAResource(queryName, rst)
-		} else {
+		if path != "system" {
+			var rst [4]byte
+			if rst, found = s.lookup(queryNameStr); found {
+				resource = newAResource(queryName, rst)
+			}
+		}
+		if !found && path == "" {
 			fmt.Printf("not fount A record queryName: [%s] \n", queryNameStr)
-			s.redirect(addr, queryName.String(), msg)
-			return
 		}
 	case dnsmessage.TypePTR:
-		if rst, ok := s.ptr[queryName.String()]; ok {
-			resource = newPTRResource(queryName, rst)
-		} else {
+		if path != "system" {
+			var rst string
+			if rst, found = s.ptr[queryName.String()]; found {
+				resource = newPTRResource(queryName, rst)
+			}
+		}
+		if !found && path == "" {
 			fmt.Printf("not fount PTR record queryName: [%s] \n", queryNameStr)
-			s.redirect(addr, queryName.String(), msg)
-			return
 		}
 	default:
 		fmt.Printf("not support dns queryType: [%s] \n", queryTypeStr)
 		return
 	}
 	msg.Response = true
-	msg.Answers = append(msg.Answers, resource)
+	switch {
+	case found:
+		msg.Answers = append(msg.Answers, resource)
+	case path == "tunnel":
+		// no leak of the names of the tunnel to the system resolver
+		msg.RCode = dnsmessage.RCodeNameError
+	default:
+		msg.Response = false
+		s.redirect(addr, queryName.String(), msg, start)
+		return
+	}
 	s.response(addr, msg)
+	logQuery(queryNameStr, queryTypeStr, "tunnel", start, dnsAnswer(msg))
 }
 
 func readNameServer() string {
@@ -159,7 +215,7 @@ func readNameServer() string {
 	return ""
 }
 
-func (s *DNSServer) redirect(addr *net.UDPAddr, name string, msg dnsmessage.Message) {
+func (s *DNSServer) redirect(addr *net.UDPAddr, name string, msg dnsmessage.Message, start time.Time) {
 	packed, err := msg.Pack()
 	if err != nil {
 		fmt.Println(err)
@@ -177,10 +233,10 @@ func (s *DNSServer) redirect(addr *net.UDPAddr, name string, msg dnsmessage.Mess
 			s.response(addr, msg)
 			return
 		}
-		s.pending = make(map[string][]*net.UDPAddr)
+		s.pending = make(map[string][]pendingQuery)
 		go s.upstream(s.up)
 	}
-	s.pending[name] = append(s.pending[name], addr)
+	s.pending[name] = append(s.pending[name], pendingQuery{addr: addr, start: start})
 	if _, err := s.up.Write(packed); err != nil {
 		fmt.Println(err)
 		s.up = nil
@@ -206,10 +262,11 @@ func (s *DNSServer) upstream(up *net.UDPConn) {
 		}
 		question := rsp.Questions[0]
 		name := question.Name.String()
-		addrs := s.pending[name]
+		queries := s.pending[name]
 		delete(s.pending, name)
-		for _, addr := range addrs {
-			s.response(addr, rsp)
+		for _, q := range queries {
+			s.response(q.addr, rsp)
+			logQuery(name, question.Type.String(), "system", q.start, dnsAnswer(rsp))
 		}
 	}
 }
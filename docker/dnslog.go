@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The dns server resolves a name through the tunnel, from the entries the
+// desktop pushed, or forwards it to the system resolver of /etc/resolv.conf.
+// The desktop sends `dns-route <pattern> tunnel|system` to override the path
+// of the names of a pattern, `*.<domain>` for the names under the domain or a
+// name, the longest pattern winning: tunnel answers NXDOMAIN without an entry
+// instead of asking the system resolver, system skips the entries. With
+// `dns-log` each query is printed with its path, answer and latency, and
+// pushed to the desktop as `dnslog <name> <type> <path> <latency> <answer>`.
+var (
+	dnsLogQueries bool
+	dnsRoutes     = make(map[string]string)
+	dnsRouteLock  sync.Mutex
+	// dnsLogConn is the control socket the queries are pushed on
+	dnsLogConn *net.UDPConn
+)
+
+// setDNSRoutes applies the dns controls of the desktop
+func setDNSRoutes(log bool, routes []string) {
+	dnsRouteLock.Lock()
+	defer dnsRouteLock.Unlock()
+	dnsLogQueries = log
+	dnsRoutes = make(map[string]string)
+	for _, route := range routes {
+		vals := strings.Fields(route)
+		if len(vals) != 2 || vals[1] != "tunnel" && vals[1] != "system" {
+			fmt.Printf("invalid dns route => %s\n", route)
+			continue
+		}
+		dnsRoutes[strings.TrimSuffix(strings.ToLower(vals[0]), ".")+"."] = vals[1]
+	}
+}
+
+// dnsPath returns the path of a name, empty for the entries then the system
+// resolver
+func dnsPath(name string) string {
+	dnsRouteLock.Lock()
+	defer dnsRouteLock.Unlock()
+	name = strings.ToLower(name)
+	if path, ok := dnsRoutes[name]; ok {
+		return path
+	}
+	for rest := name; strings.Contains(rest, "."); {
+		rest = rest[strings.Index(rest, ".")+1:]
+		if path, ok := dnsRoutes["*."+rest]; ok && rest != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// logQuery reports a query answered through path with `dns-log`
+func logQuery(name, typ, path string, start time.Time, answer string) {
+	dnsRouteLock.Lock()
+	on := dnsLogQueries
+	dnsRouteLock.Unlock()
+	if !on {
+		return
+	}
+	name = strings.TrimSuffix(name, ".")
+	typ = strings.TrimPrefix(typ, "Type")
+	latency := time.Since(start).Round(10 * time.Microsecond)
+	fmt.Printf("dns query => %s %s via %s => %s in %v\n", name, typ, path, answer, latency)
+	if conn := dnsLogConn; conn != nil {
+		line := fmt.Sprintf("dnslog %s %s %s %v %s", name, typ, path, latency, answer)
+		if _, err := writeUDP(conn, append([]byte{1}, signControl(line)...)); err != nil {
+			fmt.Printf("push dns log error => %v\n", err)
+		}
+	}
+}
+
+// dnsAnswer describes the answer of a response for the log
+func dnsAnswer(msg dnsmessage.Message) string {
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	default:
+		return strings.ToUpper(strings.TrimPrefix(msg.RCode.String(), "RCode"))
+	}
+	var answers []string
+	for _, a := range msg.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			answers = append(answers, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			answers = append(answers, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.CNAMEResource:
+			answers = append(answers, strings.TrimSuffix(body.CNAME.String(), "."))
+		case *dnsmessage.PTRResource:
+			answers = append(answers, strings.TrimSuffix(body.PTR.String(), "."))
+		}
+	}
+	if len(answers) == 0 {
+		return "NODATA"
+	}
+	return strings.Join(answers, ",")
+}
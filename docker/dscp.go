@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// `-dscp` marks the datagrams to the desktop, with a value from 0 to 63, a
+// class as ef, af11 to af43, cs0 to cs7 or le, or `inherit` to copy the DSCP
+// of each tunneled IPv4 packet, the mark of the socket changing with the
+// class.
+var (
+	dscp = ""
+	// dscpTOS is the type of service of the socket, -1 unmarked
+	dscpTOS int32 = -1
+)
+
+// parseDSCP parses a DSCP value or class name
+func parseDSCP(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case s == "ef":
+		return 46, nil
+	case s == "le":
+		return 1, nil
+	case len(s) == 3 && strings.HasPrefix(s, "cs") && s[2] >= '0' && s[2] <= '7':
+		return int(s[2]-'0') * 8, nil
+	case len(s) == 4 && strings.HasPrefix(s, "af") && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return int(s[2]-'0')*8 + int(s[3]-'0')*2, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("invalid dscp %q", s)
+	}
+	return v, nil
+}
+
+// markConn applies `-dscp` to the socket of the tunnel
+func markConn(conn *net.UDPConn) {
+	if dscp == "" || dscp == "inherit" {
+		return
+	}
+	v, err := parseDSCP(dscp)
+	if err != nil {
+		fmt.Printf("dscp => %v\n", err)
+		return
+	}
+	if err := setTOS(conn, v<<2); err != nil {
+		fmt.Printf("dscp %d => %v\n", v, err)
+		return
+	}
+	atomic.StoreInt32(&dscpTOS, int32(v<<2))
+	fmt.Printf("dscp => %d\n", v)
+}
+
+// inheritDSCP marks the socket with the DSCP of a packet about to be sent,
+// with `-dscp inherit`
+func inheritDSCP(conn *net.UDPConn, packet []byte) {
+	if dscp != "inherit" || len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	tos := int32(packet[1] &^ 3)
+	if atomic.LoadInt32(&dscpTOS) == tos {
+		return
+	}
+	if err := setTOS(conn, int(tos)); err != nil {
+		fmt.Printf("dscp %d => %v\n", tos>>2, err)
+	}
+	atomic.StoreInt32(&dscpTOS, tos)
+}
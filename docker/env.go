@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Every flag can be given as a `DDC_` environment variable, e.g. `DDC_HOST`,
+// `DDC_PORT` or `DDC_KNOCK_SECRET`, so the container is configured with
+// `docker run -e`. A flag given on the command line wins over the environment.
+const envPrefix = "DDC_"
+
+// envName returns the environment variable of a flag
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// givenFlags returns the flags given on the command line
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// applyEnv sets the flags not given on the command line from the environment
+func applyEnv(fs *flag.FlagSet) {
+	given := givenFlags(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			return
+		}
+		val, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, val); err != nil {
+			fmt.Printf("invalid %s => %v\n", envName(f.Name), err)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// With `-ebpf` two tc BPF programs forward the plain IPv4 packets in the
+// kernel, sparing the copies and syscalls of the loops on bulk transfers: the
+// one on the ingress of the interface to the desktop strips the IP and UDP
+// headers of its datagrams and hands the packets to the TUN, the one on the
+// egress of the TUN prepends them to the packets of the containers and sends
+// them through the neighbor of the route to the desktop. XDP can neither
+// inject into a TUN nor see its egress, hence tc. The other datagrams, the
+// heartbeats, the controls and the compressed, FEC or framed ones, still go
+// through the loops, like the packets to the desktop larger than `-fragment`
+// or while compression, FEC, dedup, `-dscp inherit` or a capture is on. It
+// takes linux 5.10 on amd64 or arm64 and CAP_BPF or CAP_SYS_ADMIN, and the
+// loops keep forwarding otherwise, as with a tap, `-offload`, the rendezvous
+// or an IPv6 desktop.
+var (
+	ebpf = false
+	// fastPath holds the loaded programs, nil on the loops
+	fastPath     *fastPathProgs
+	fastPathConn *net.UDPConn
+	fastPathLock sync.Mutex
+)
+
+// fastPathConfig is what the programs are told of the tunnel
+type fastPathConfig struct {
+	// in and out enable the directions, from and to the desktop
+	in, out        bool
+	desktop, local *net.UDPAddr
+	tun, uplink    int
+	// maxLen is the largest packet sent to the desktop by the kernel
+	maxLen int
+	tos    int
+}
+
+// fastPathCounter counts the packets forwarded by a program
+type fastPathCounter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// fastPathStatus is reported in the health file
+type fastPathStatus struct {
+	Uplink string          `json:"uplink"`
+	In     fastPathCounter `json:"in"`
+	Out    fastPathCounter `json:"out"`
+}
+
+// startFastPath loads the programs of `-ebpf` for the data socket
+func startFastPath(conn *net.UDPConn, iface tunDevice) {
+	if !ebpf {
+		return
+	}
+	switch iface.(type) {
+	case *tapDevice:
+		fmt.Println("ebpf => off in tap mode")
+		return
+	case *offloadTUN:
+		fmt.Println("ebpf => off with offload, the packets are segmented by the loops")
+		return
+	}
+	if rendezvous != "" {
+		fmt.Println("ebpf => off with the rendezvous")
+		return
+	}
+	if addr := remoteAddr(conn); addr == nil || addr.IP.To4() == nil {
+		fmt.Println("ebpf => off to an IPv6 desktop")
+		return
+	}
+	progs, err := loadFastPath(iface.Name())
+	if err != nil {
+		fmt.Printf("ebpf unavailable => %v\n", err)
+		return
+	}
+	fastPathLock.Lock()
+	fastPath, fastPathConn = progs, conn
+	fastPathLock.Unlock()
+	refreshFastPath()
+}
+
+// refreshFastPath tells the programs the address of the desktop and which
+// directions the loops must handle, after the controls, a capture or a reload
+// changed them
+func refreshFastPath() {
+	fastPathLock.Lock()
+	defer fastPathLock.Unlock()
+	if fastPath == nil {
+		return
+	}
+	cfg, err := currentFastPath()
+	if err == nil {
+		err = fastPath.Update(cfg)
+	}
+	if err != nil {
+		fmt.Printf("ebpf error => %v, back to the loops\n", err)
+		fastPath.Update(fastPathConfig{})
+		return
+	}
+	fmt.Printf("ebpf => in %v out %v via %s up to %d bytes\n", cfg.in, cfg.out, fastPath.uplinkName, cfg.maxLen)
+}
+
+// currentFastPath builds the config of the programs from the state of the
+// tunnel
+func currentFastPath() (fastPathConfig, error) {
+	desktop := remoteAddr(fastPathConn)
+	if desktop == nil || desktop.IP.To4() == nil {
+		return fastPathConfig{}, fmt.Errorf("no IPv4 desktop")
+	}
+	// the source and the interface of the route to the desktop
+	probe, err := net.DialUDP("udp4", nil, desktop)
+	if err != nil {
+		return fastPathConfig{}, err
+	}
+	local := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+	local.Port = fastPathConn.LocalAddr().(*net.UDPAddr).Port
+	uplink, err := addrInterface(local.IP)
+	if err != nil {
+		return fastPathConfig{}, err
+	}
+	tun, err := net.InterfaceByName(tunName)
+	if err != nil {
+		return fastPathConfig{}, err
+	}
+	captureLock.Lock()
+	capturing := captureBuf != nil
+	captureLock.Unlock()
+	cfg := fastPathConfig{
+		in:      !capturing,
+		desktop: desktop,
+		local:   local,
+		tun:     tun.Index,
+		uplink:  uplink.Index,
+		maxLen:  currentMTU(),
+		tos:     int(atomic.LoadInt32(&dscpTOS)),
+	}
+	cfg.out = !capturing && dscp != "inherit" && atomic.LoadInt32(&offered) == 0 &&
+		atomic.LoadInt32(&fecOffered) == 0 && atomic.LoadInt32(&dedupOffered) == 0
+	if l := uplink.MTU - 28; l < cfg.maxLen {
+		cfg.maxLen = l
+	}
+	if fragSize > fragHeader && fragSize < cfg.maxLen {
+		cfg.maxLen = fragSize
+	}
+	if cfg.tos < 0 {
+		cfg.tos = 0
+	}
+	return cfg, nil
+}
+
+// addrInterface returns the interface holding an address
+func addrInterface(ip net.IP) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, _ := ifaces[i].Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface holds %s", ip)
+}
+
+// fastPathHealth returns the counters of the programs, nil on the loops
+func fastPathHealth() *fastPathStatus {
+	fastPathLock.Lock()
+	defer fastPathLock.Unlock()
+	if fastPath == nil {
+		return nil
+	}
+	in, out := fastPath.Counters()
+	return &fastPathStatus{Uplink: fastPath.uplinkName, In: in, Out: out}
+}
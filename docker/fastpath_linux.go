@@ -0,0 +1,614 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// The programs are assembled here rather than compiled by clang, there being
+// only two of them, and the config and packet fields are compared as loaded,
+// in the little endian order of amd64 and arm64. The tests load them through
+// the verifier and run them on datagrams where bpf(2) is allowed.
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+
+	bpfMapTypeArray     = 2
+	bpfProgTypeSchedCls = 3
+
+	// helpers
+	bpfMapLookup     = 1
+	bpfStoreBytes    = 9
+	bpfRedirect      = 23
+	bpfLoadBytes     = 26
+	bpfCsumDiff      = 28
+	bpfChangeHead    = 43
+	bpfAdjustRoom    = 50
+	bpfCsumLevel     = 135
+	bpfRedirectNeigh = 152
+
+	// fields of struct __sk_buff
+	skbLen      = 0
+	skbProtocol = 16
+
+	// offsets of the config value
+	cfgFlags       = 0
+	cfgDesktopIP   = 4
+	cfgLocalIP     = 8
+	cfgDesktopPort = 12
+	cfgLocalPort   = 14
+	cfgTun         = 16
+	cfgUplink      = 20
+	cfgMaxLen      = 24
+	cfgHeader      = 32
+	cfgSize        = cfgHeader + 48
+
+	fastIn  = 1
+	fastOut = 2
+	// ethIP is ETH_P_IP in network order as loaded
+	ethIP = 0x0008
+	// encapLen is the length of the IP and UDP headers of the tunnel
+	encapLen = 28
+
+	tcActOK   = 0
+	tcActShot = 2
+
+	// TC_H_CLSACT and its minors, TCA_BPF_FLAG_ACT_DIRECT
+	tcClsact       = 0xfffffff1
+	tcIngress      = 0xfffffff2
+	tcEgress       = 0xfffffff3
+	tcBPFActDirect = 1
+	// tcPrio is the priority of the filters of the agent
+	tcPrio = 0xd0c
+)
+
+// sysBPF calls bpf(2) with attr
+func sysBPF(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, e := syscall.Syscall(sysBPFNum, uintptr(cmd), uintptr(attr), size)
+	if e != 0 {
+		return int(r), e
+	}
+	return int(r), nil
+}
+
+// bpfMapCreateAttr and bpfMapElemAttr are the bpf_attr of the map commands
+type bpfMapCreateAttr struct {
+	mapType, keySize, valueSize, maxEntries, flags uint32
+}
+
+type bpfMapElemAttr struct {
+	fd    uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpfProgLoadAttr is the bpf_attr of BPF_PROG_LOAD
+type bpfProgLoadAttr struct {
+	progType, insnCnt uint32
+	insns, license    uint64
+	logLevel, logSize uint32
+	logBuf            uint64
+	kernVersion       uint32
+	progFlags         uint32
+	name              [16]byte
+}
+
+func createArray(valueSize, entries int) (int, error) {
+	attr := bpfMapCreateAttr{mapType: bpfMapTypeArray, keySize: 4, valueSize: uint32(valueSize), maxEntries: uint32(entries)}
+	return sysBPF(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func mapElem(cmd, fd int, key uint32, value []byte) error {
+	attr := bpfMapElemAttr{
+		fd:    uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, err := sysBPF(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// bpfInsn is an eBPF instruction, target naming the label of a jump
+type bpfInsn struct {
+	op       uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	target   string
+}
+
+// bpfAsm assembles a program with labeled jumps
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+const (
+	r0, r1, r2, r3, r4, r5, r6, r7, r8 = 0, 1, 2, 3, 4, 5, 6, 7, 8
+	fp                                 = 10
+
+	bpfW, bpfH, bpfB, bpfDW = 0x00, 0x08, 0x10, 0x18
+
+	opAdd, opRsh, opAnd, opXor, opMov = 0x00, 0x70, 0x50, 0xa0, 0xb0
+	opJeq, opJgt, opJne               = 0x10, 0x20, 0x50
+)
+
+func (a *bpfAsm) emit(op uint8, dst, src uint8, off int16, imm int32, target string) {
+	a.insns = append(a.insns, bpfInsn{op: op, dst: dst, src: src, off: off, imm: imm, target: target})
+}
+
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) aluImm(op uint8, dst uint8, imm int32) { a.emit(0x07|op, dst, 0, 0, imm, "") }
+func (a *bpfAsm) aluReg(op uint8, dst, src uint8)       { a.emit(0x0f|op, dst, src, 0, 0, "") }
+func (a *bpfAsm) ldx(size uint8, dst, src uint8, off int16) {
+	a.emit(0x61|size, dst, src, off, 0, "")
+}
+func (a *bpfAsm) stx(size uint8, dst, src uint8, off int16) {
+	a.emit(0x63|size, dst, src, off, 0, "")
+}
+func (a *bpfAsm) st(size uint8, dst uint8, off int16, imm int32) {
+	a.emit(0x62|size, dst, 0, off, imm, "")
+}
+
+// xadd adds src to the u64 at dst+off atomically
+func (a *bpfAsm) xadd(dst, src uint8, off int16) { a.emit(0xdb, dst, src, off, 0, "") }
+
+// be16 converts the low 16 bits of dst to network order
+func (a *bpfAsm) be16(dst uint8) { a.emit(0xdc, dst, 0, 0, 16, "") }
+
+func (a *bpfAsm) jmpImm(op uint8, dst uint8, imm int32, target string) {
+	a.emit(0x05|op, dst, 0, 0, imm, target)
+}
+func (a *bpfAsm) jmpReg(op uint8, dst, src uint8, target string) {
+	a.emit(0x0d|op, dst, src, 0, 0, target)
+}
+func (a *bpfAsm) call(helper int32) { a.emit(0x85, 0, 0, 0, helper, "") }
+func (a *bpfAsm) exit()             { a.emit(0x95, 0, 0, 0, 0, "") }
+
+// ldMap loads the address of a map into dst, two instructions
+func (a *bpfAsm) ldMap(dst uint8, fd int) {
+	a.emit(0x18, dst, 1, 0, int32(fd), "")
+	a.emit(0, 0, 0, 0, 0, "")
+}
+
+// lookup sets r0 to the value of key in a map, jumping to miss without
+func (a *bpfAsm) lookup(fd int, key int32, miss string) {
+	a.st(bpfW, fp, -4, key)
+	a.ldMap(r1, fd)
+	a.aluReg(opMov, r2, fp)
+	a.aluImm(opAdd, r2, -4)
+	a.call(bpfMapLookup)
+	a.jmpImm(opJeq, r0, 0, miss)
+}
+
+// count adds a packet of the length in reg to a counter
+func (a *bpfAsm) count(fd int, key int32, reg uint8) {
+	done := fmt.Sprintf("counted%d", key)
+	a.lookup(fd, key, done)
+	a.aluImm(opMov, r1, 1)
+	a.xadd(r0, r1, 0)
+	a.xadd(r0, reg, 8)
+	a.label(done)
+}
+
+// bytes encodes the program, resolving the jumps
+func (a *bpfAsm) bytes() ([]byte, error) {
+	b := make([]byte, 8*len(a.insns))
+	for i, in := range a.insns {
+		if in.target != "" {
+			at, ok := a.labels[in.target]
+			if !ok {
+				return nil, fmt.Errorf("unknown label %s", in.target)
+			}
+			in.off = int16(at - i - 1)
+		}
+		b[8*i] = in.op
+		b[8*i+1] = in.dst | in.src<<4
+		binary.LittleEndian.PutUint16(b[8*i+2:], uint16(in.off))
+		binary.LittleEndian.PutUint32(b[8*i+4:], uint32(in.imm))
+	}
+	return b, nil
+}
+
+// ingressProgram hands the plain IPv4 packets of the desktop to the TUN,
+// from the ingress of the uplink
+func ingressProgram(config, counters int) *bpfAsm {
+	a := &bpfAsm{}
+	a.aluReg(opMov, r6, r1)
+	a.ldx(bpfW, r2, r6, skbProtocol)
+	a.jmpImm(opJne, r2, ethIP, "pass")
+	a.lookup(config, 0, "pass")
+	a.aluReg(opMov, r7, r0)
+	a.ldx(bpfW, r2, r7, cfgFlags)
+	a.aluImm(opAnd, r2, fastIn)
+	a.jmpImm(opJeq, r2, 0, "pass")
+	// the ethernet, IP and UDP headers and the first byte of the payload,
+	// the IP header aligned on 4 bytes
+	const ip, udp = -36, -16
+	a.aluReg(opMov, r1, r6)
+	a.aluImm(opMov, r2, 0)
+	a.aluReg(opMov, r3, fp)
+	a.aluImm(opAdd, r3, ip-14)
+	a.aluImm(opMov, r4, 14+encapLen+1)
+	a.call(bpfLoadBytes)
+	a.jmpImm(opJne, r0, 0, "pass")
+	// no options nor fragments
+	a.ldx(bpfB, r2, fp, ip)
+	a.jmpImm(opJne, r2, 0x45, "pass")
+	a.ldx(bpfH, r2, fp, ip+6)
+	a.aluImm(opAnd, r2, 0xff3f)
+	a.jmpImm(opJne, r2, 0, "pass")
+	a.ldx(bpfB, r2, fp, ip+9)
+	a.jmpImm(opJne, r2, syscall.IPPROTO_UDP, "pass")
+	for _, f := range []struct {
+		size     uint8
+		pkt, cfg int16
+	}{
+		{bpfW, ip + 12, cfgDesktopIP},
+		{bpfW, ip + 16, cfgLocalIP},
+		{bpfH, udp, cfgDesktopPort},
+		{bpfH, udp + 2, cfgLocalPort},
+	} {
+		a.ldx(f.size, r2, fp, f.pkt)
+		a.ldx(f.size, r3, r7, f.cfg)
+		a.jmpReg(opJne, r2, r3, "pass")
+	}
+	a.ldx(bpfB, r2, fp, udp+8)
+	a.aluImm(opAnd, r2, 0xf0)
+	a.jmpImm(opJne, r2, 0x40, "pass")
+	// strip the IP and UDP headers after the ethernet one, BPF_ADJ_ROOM_MAC
+	a.aluReg(opMov, r1, r6)
+	a.aluImm(opMov, r2, -encapLen)
+	a.aluImm(opMov, r3, 1)
+	a.aluImm(opMov, r4, 0)
+	a.call(bpfAdjustRoom)
+	a.jmpImm(opJne, r0, 0, "pass")
+	// the checksum of the UDP datagram isn't the one of the packet,
+	// BPF_CSUM_LEVEL_RESET
+	a.aluReg(opMov, r1, r6)
+	a.aluImm(opMov, r2, 3)
+	a.call(bpfCsumLevel)
+	a.ldx(bpfW, r8, r6, skbLen)
+	a.aluImm(opAdd, r8, -14)
+	a.count(counters, 0, r8)
+	// into the TUN as if written to it, BPF_F_INGRESS
+	a.ldx(bpfW, r1, r7, cfgTun)
+	a.aluImm(opMov, r2, 1)
+	a.call(bpfRedirect)
+	a.exit()
+	a.label("pass")
+	a.aluImm(opMov, r0, tcActOK)
+	a.exit()
+	return a
+}
+
+// egressProgram sends the IPv4 packets of the containers to the desktop,
+// from the egress of the TUN
+func egressProgram(config, counters int) *bpfAsm {
+	a := &bpfAsm{}
+	a.aluReg(opMov, r6, r1)
+	a.ldx(bpfW, r2, r6, skbProtocol)
+	a.jmpImm(opJne, r2, ethIP, "pass")
+	a.lookup(config, 0, "pass")
+	a.aluReg(opMov, r7, r0)
+	a.ldx(bpfW, r2, r7, cfgFlags)
+	a.aluImm(opAnd, r2, fastOut)
+	a.jmpImm(opJeq, r2, 0, "pass")
+	a.ldx(bpfW, r8, r6, skbLen)
+	a.ldx(bpfW, r2, r7, cfgMaxLen)
+	a.jmpReg(opJgt, r8, r2, "pass")
+	// the headers of the config, an ethernet header without addresses
+	// that bpf_redirect_neigh replaces, the IP and UDP ones
+	const head, ip = -56, -42
+	for off := int16(0); off < 48; off += 8 {
+		a.ldx(bpfDW, r2, r7, cfgHeader+off)
+		a.stx(bpfDW, fp, r2, head+off)
+	}
+	a.aluReg(opMov, r2, r8)
+	a.aluImm(opAdd, r2, encapLen)
+	a.be16(r2)
+	a.stx(bpfH, fp, r2, ip+2)
+	a.aluReg(opMov, r2, r8)
+	a.aluImm(opAdd, r2, 8)
+	a.be16(r2)
+	a.stx(bpfH, fp, r2, ip+20+4)
+	// the checksum of the IP header
+	a.aluImm(opMov, r1, 0)
+	a.aluImm(opMov, r2, 0)
+	a.aluReg(opMov, r3, fp)
+	a.aluImm(opAdd, r3, ip)
+	a.aluImm(opMov, r4, 20)
+	a.aluImm(opMov, r5, 0)
+	a.call(bpfCsumDiff)
+	for i := 0; i < 2; i++ {
+		a.aluReg(opMov, r2, r0)
+		a.aluImm(opRsh, r2, 16)
+		a.aluImm(opAnd, r0, 0xffff)
+		a.aluReg(opAdd, r0, r2)
+	}
+	a.aluImm(opXor, r0, 0xffff)
+	a.stx(bpfH, fp, r0, ip+10)
+	a.aluReg(opMov, r1, r6)
+	a.aluImm(opMov, r2, 14+encapLen)
+	a.aluImm(opMov, r3, 0)
+	a.call(bpfChangeHead)
+	a.jmpImm(opJne, r0, 0, "pass")
+	a.aluReg(opMov, r1, r6)
+	a.aluImm(opMov, r2, 0)
+	a.aluReg(opMov, r3, fp)
+	a.aluImm(opAdd, r3, head)
+	a.aluImm(opMov, r4, 14+encapLen)
+	a.aluImm(opMov, r5, 0)
+	a.call(bpfStoreBytes)
+	a.jmpImm(opJne, r0, 0, "drop")
+	a.count(counters, 1, r8)
+	a.ldx(bpfW, r1, r7, cfgUplink)
+	a.aluImm(opMov, r2, 0)
+	a.aluImm(opMov, r3, 0)
+	a.aluImm(opMov, r4, 0)
+	a.call(bpfRedirectNeigh)
+	a.exit()
+	a.label("drop")
+	a.aluImm(opMov, r0, tcActShot)
+	a.exit()
+	a.label("pass")
+	a.aluImm(opMov, r0, tcActOK)
+	a.exit()
+	return a
+}
+
+// loadProgram loads a program, with the log of the verifier on failure
+func loadProgram(name string, a *bpfAsm) (int, error) {
+	insns, err := a.bytes()
+	if err != nil {
+		return -1, err
+	}
+	license := []byte("Dual MIT/GPL\x00")
+	log := make([]byte, 64*1024)
+	attr := bpfProgLoadAttr{
+		progType: bpfProgTypeSchedCls,
+		insnCnt:  uint32(len(a.insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	copy(attr.name[:15], name)
+	fd, err := sysBPF(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+	// once more for the log
+	attr.logLevel, attr.logSize = 1, uint32(len(log))
+	attr.logBuf = uint64(uintptr(unsafe.Pointer(&log[0])))
+	if _, lerr := sysBPF(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); lerr != nil && debug.On() {
+		fmt.Printf("ebpf %s verifier => %s\n", name, log[:clen(log)])
+	}
+	return -1, fmt.Errorf("load %s: %v", name, err)
+}
+
+// clen is the length of a NUL terminated string
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// fastPathProgs holds the maps and programs of `-ebpf`
+type fastPathProgs struct {
+	config, counters int
+	ingress, egress  int
+	uplink           int
+	uplinkName       string
+}
+
+// loadFastPath loads the programs and attaches the egress one to the TUN,
+// the ingress one follows the route to the desktop
+func loadFastPath(tun string) (*fastPathProgs, error) {
+	raiseMemlock()
+	tunIface, err := net.InterfaceByName(tun)
+	if err != nil {
+		return nil, err
+	}
+	p := &fastPathProgs{config: -1, counters: -1, ingress: -1, egress: -1}
+	if p.config, err = createArray(cfgSize, 1); err == nil {
+		p.counters, err = createArray(16, 2)
+	}
+	if err == nil {
+		p.ingress, err = loadProgram("ddc_ingress", ingressProgram(p.config, p.counters))
+	}
+	if err == nil {
+		p.egress, err = loadProgram("ddc_egress", egressProgram(p.config, p.counters))
+	}
+	if err == nil {
+		err = attachFilter(tunIface.Index, tcEgress, p.egress, "ddc_egress")
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Update writes the config of the programs, moving the ingress one to the
+// new uplink
+func (p *fastPathProgs) Update(cfg fastPathConfig) error {
+	if cfg.uplink != 0 && cfg.uplink != p.uplink {
+		if err := attachFilter(cfg.uplink, tcIngress, p.ingress, "ddc_ingress"); err != nil {
+			return err
+		}
+		if p.uplink != 0 {
+			detachFilter(p.uplink, tcIngress)
+		}
+		p.uplink = cfg.uplink
+		if iface, err := net.InterfaceByIndex(cfg.uplink); err == nil {
+			p.uplinkName = iface.Name
+		}
+	}
+	v := make([]byte, cfgSize)
+	if cfg.desktop != nil && cfg.local != nil {
+		var flags uint32
+		if cfg.in {
+			flags |= fastIn
+		}
+		if cfg.out {
+			flags |= fastOut
+		}
+		binary.LittleEndian.PutUint32(v[cfgFlags:], flags)
+		copy(v[cfgDesktopIP:], cfg.desktop.IP.To4())
+		copy(v[cfgLocalIP:], cfg.local.IP.To4())
+		binary.BigEndian.PutUint16(v[cfgDesktopPort:], uint16(cfg.desktop.Port))
+		binary.BigEndian.PutUint16(v[cfgLocalPort:], uint16(cfg.local.Port))
+		binary.LittleEndian.PutUint32(v[cfgTun:], uint32(cfg.tun))
+		binary.LittleEndian.PutUint32(v[cfgUplink:], uint32(cfg.uplink))
+		binary.LittleEndian.PutUint32(v[cfgMaxLen:], uint32(cfg.maxLen))
+		// ethernet type, then the IP header but the lengths and checksum,
+		// with DF like the socket, and the UDP header but its length
+		h := v[cfgHeader:]
+		h[12], h[13] = 0x08, 0x00
+		ip := h[14:]
+		ip[0], ip[1] = 0x45, byte(cfg.tos)
+		ip[6], ip[8], ip[9] = 0x40, 64, syscall.IPPROTO_UDP
+		copy(ip[12:], cfg.local.IP.To4())
+		copy(ip[16:], cfg.desktop.IP.To4())
+		binary.BigEndian.PutUint16(ip[20:], uint16(cfg.local.Port))
+		binary.BigEndian.PutUint16(ip[22:], uint16(cfg.desktop.Port))
+	}
+	return mapElem(bpfMapUpdateElem, p.config, 0, v)
+}
+
+// Counters returns the packets forwarded from and to the desktop
+func (p *fastPathProgs) Counters() (in, out fastPathCounter) {
+	v := make([]byte, 16)
+	if mapElem(bpfMapLookupElem, p.counters, 0, v) == nil {
+		in = fastPathCounter{Packets: binary.LittleEndian.Uint64(v), Bytes: binary.LittleEndian.Uint64(v[8:])}
+	}
+	if mapElem(bpfMapLookupElem, p.counters, 1, v) == nil {
+		out = fastPathCounter{Packets: binary.LittleEndian.Uint64(v), Bytes: binary.LittleEndian.Uint64(v[8:])}
+	}
+	return
+}
+
+func (p *fastPathProgs) close() {
+	for _, fd := range []int{p.ingress, p.egress, p.config, p.counters} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// raiseMemlock lifts RLIMIT_MEMLOCK, which the maps and programs are charged
+// to before linux 5.11
+func raiseMemlock() {
+	const rlimitMemlock = 8
+	lim := &syscall.Rlimit{Cur: ^uint64(0), Max: ^uint64(0)}
+	syscall.Setrlimit(rlimitMemlock, lim)
+}
+
+// attachFilter attaches a program in direct action to the clsact qdisc of an
+// interface, replacing the one of a previous run
+func attachFilter(ifindex int, parent uint32, prog int, name string) error {
+	// the clsact qdisc, kept if already there
+	err := tcRequest(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifindex,
+		tcClsact&0xffff0000, tcClsact, 0, rtAttr(1, []byte("clsact\x00")))
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("clsact: %v", err)
+	}
+	fd := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fd, uint32(prog))
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, tcBPFActDirect)
+	// TCA_BPF_FD, TCA_BPF_NAME and TCA_BPF_FLAGS in TCA_OPTIONS
+	opts := append(append(rtAttr(6, fd), rtAttr(7, []byte(name+"\x00"))...), rtAttr(8, flags)...)
+	attrs := append(rtAttr(1, []byte("bpf\x00")), rtAttr(2, opts)...)
+	if err := tcRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, ifindex,
+		1, parent, tcInfo(), attrs); err != nil {
+		return fmt.Errorf("filter: %v", err)
+	}
+	return nil
+}
+
+// detachFilter removes the filter of the agent
+func detachFilter(ifindex int, parent uint32) {
+	if err := tcRequest(syscall.RTM_DELTFILTER, 0, ifindex, 0, parent, tcInfo(), nil); err != nil {
+		fmt.Printf("ebpf detach => %v\n", err)
+	}
+}
+
+// tcInfo is the priority and protocol, ETH_P_ALL, of the filters
+func tcInfo() uint32 {
+	return tcPrio<<16 | 0x0300
+}
+
+// rtAttr encodes a netlink attribute, padded
+func rtAttr(typ uint16, data []byte) []byte {
+	b := make([]byte, syscall.SizeofRtAttr+(len(data)+3)&^3)
+	binary.LittleEndian.PutUint16(b, uint16(syscall.SizeofRtAttr+len(data)))
+	binary.LittleEndian.PutUint16(b[2:], typ)
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
+
+// tcRequest sends a tcmsg over rtnetlink and waits for its ack
+func tcRequest(typ, flags uint16, ifindex int, handle, parent, info uint32, attrs []byte) error {
+	s, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(s)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(s, sa); err != nil {
+		return err
+	}
+	// struct nlmsghdr and struct tcmsg
+	msg := make([]byte, syscall.SizeofNlMsghdr+20, syscall.SizeofNlMsghdr+20+len(attrs))
+	msg = append(msg, attrs...)
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], typ)
+	binary.LittleEndian.PutUint16(msg[6:], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	tc := msg[syscall.SizeofNlMsghdr:]
+	binary.LittleEndian.PutUint32(tc[4:], uint32(ifindex))
+	binary.LittleEndian.PutUint32(tc[8:], handle)
+	binary.LittleEndian.PutUint32(tc[12:], parent)
+	binary.LittleEndian.PutUint32(tc[16:], info)
+	if err := syscall.Sendto(s, msg, 0, sa); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(s, buf, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_ERROR && len(m.Data) >= 4 {
+			if code := int32(binary.LittleEndian.Uint32(m.Data)); code != 0 {
+				return syscall.Errno(-code)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no ack")
+}
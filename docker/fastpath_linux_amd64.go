@@ -0,0 +1,4 @@
+package main
+
+// sysBPFNum is missing from the syscall package of amd64
+const sysBPFNum = 321
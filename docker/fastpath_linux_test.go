@@ -0,0 +1,197 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+const (
+	bpfProgTestRun = 10
+	tcActRedirect  = 7
+)
+
+// bpfTestRunAttr is the bpf_attr of BPF_PROG_TEST_RUN
+type bpfTestRunAttr struct {
+	progFd, retval           uint32
+	dataSizeIn, dataSizeOut  uint32
+	dataIn, dataOut          uint64
+	repeat, duration         uint32
+	ctxSizeIn, ctxSizeOut    uint32
+	ctxIn, ctxOut            uint64
+	flags, cpu, batchSize, _ uint32
+}
+
+// testRun runs a program on a frame, returning its verdict and the frame it
+// left
+func testRun(t *testing.T, prog int, frame []byte) (uint32, []byte) {
+	t.Helper()
+	out := make([]byte, len(frame)+256)
+	attr := bpfTestRunAttr{
+		progFd:      uint32(prog),
+		dataSizeIn:  uint32(len(frame)),
+		dataSizeOut: uint32(len(out)),
+		dataIn:      uint64(uintptr(unsafe.Pointer(&frame[0]))),
+		dataOut:     uint64(uintptr(unsafe.Pointer(&out[0]))),
+		repeat:      1,
+	}
+	if _, err := sysBPF(bpfProgTestRun, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		t.Fatalf("test run: %v", err)
+	}
+	return attr.retval, out[:attr.dataSizeOut]
+}
+
+// ipv4 builds an IPv4 header with its checksum and the payload
+func ipv4(proto byte, src, dst net.IP, payload []byte) []byte {
+	p := make([]byte, 20, 20+len(payload))
+	p[0], p[8], p[9] = 0x45, 64, proto
+	binary.BigEndian.PutUint16(p[2:], uint16(20+len(payload)))
+	copy(p[12:], src.To4())
+	copy(p[16:], dst.To4())
+	binary.BigEndian.PutUint16(p[10:], ^fold(checksum(p, 0)))
+	return append(p, payload...)
+}
+
+func TestFastPathAssemble(t *testing.T) {
+	for name, a := range map[string]*bpfAsm{"ingress": ingressProgram(3, 4), "egress": egressProgram(3, 4)} {
+		b, err := a.bytes()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(b) != 8*len(a.insns) {
+			t.Fatalf("%s: %d bytes for %d instructions", name, len(b), len(a.insns))
+		}
+		if last := a.insns[len(a.insns)-1]; last.op != 0x95 {
+			t.Errorf("%s: ends with %#x, not an exit", name, last.op)
+		}
+		for i, in := range a.insns {
+			if in.dst > fp || in.src > fp {
+				t.Errorf("%s: instruction %d uses register %d or %d", name, i, in.dst, in.src)
+			}
+			if in.op == 0x18 && (i+1 == len(a.insns) || a.insns[i+1] != bpfInsn{}) {
+				t.Errorf("%s: map load %d without its second half", name, i)
+			}
+			if in.target == "" {
+				continue
+			}
+			off := int16(binary.LittleEndian.Uint16(b[8*i+2:]))
+			if to := i + 1 + int(off); to <= i || to >= len(a.insns) {
+				t.Errorf("%s: jump %d to %s lands on %d", name, i, in.target, to)
+			}
+		}
+	}
+}
+
+// TestFastPathLoad loads the programs through the verifier of the kernel and
+// runs them on packets, where bpf(2) is allowed
+func TestFastPathLoad(t *testing.T) {
+	raiseMemlock()
+	p := &fastPathProgs{config: -1, counters: -1, ingress: -1, egress: -1}
+	defer p.close()
+	var err error
+	if p.config, err = createArray(cfgSize, 1); err != nil {
+		if err == syscall.EPERM || err == syscall.EACCES || err == syscall.ENOSYS {
+			t.Skipf("bpf unavailable: %v", err)
+		}
+		t.Fatal(err)
+	}
+	if p.counters, err = createArray(16, 2); err != nil {
+		t.Fatal(err)
+	}
+	// the log of the verifier on failure
+	defer debug.SetOn(debug.On())
+	debug.SetOn(true)
+	if p.ingress, err = loadProgram("ddc_ingress", ingressProgram(p.config, p.counters)); err != nil {
+		t.Fatal(err)
+	}
+	if p.egress, err = loadProgram("ddc_egress", egressProgram(p.config, p.counters)); err != nil {
+		t.Fatal(err)
+	}
+
+	desktop := &net.UDPAddr{IP: net.IPv4(192, 168, 65, 2), Port: 2511}
+	local := &net.UDPAddr{IP: net.IPv4(192, 168, 65, 3), Port: 40000}
+	cfg := fastPathConfig{in: true, out: true, desktop: desktop, local: local, tun: 1, maxLen: 1400, tos: 0x10}
+	if err := p.Update(cfg); err != nil {
+		t.Fatal(err)
+	}
+	eth := []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00}
+	inner := ipv4(syscall.IPPROTO_ICMP, net.IPv4(192, 168, 251, 1), net.IPv4(172, 17, 0, 2), []byte{8, 0, 0xf7, 0xfe, 0, 1, 0, 0})
+	udp := make([]byte, 8, 8+len(inner))
+	binary.BigEndian.PutUint16(udp, uint16(desktop.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(local.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(inner)))
+	datagram := append(append([]byte{}, eth...), ipv4(syscall.IPPROTO_UDP, desktop.IP, local.IP, append(udp, inner...))...)
+
+	// the datagram of the desktop is stripped to its packet
+	verdict, out := testRun(t, p.ingress, datagram)
+	if verdict != tcActRedirect || !bytes.Equal(out, append(append([]byte{}, eth...), inner...)) {
+		t.Errorf("ingress = %d\n%x, expected %d\n%x%x", verdict, out, tcActRedirect, eth, inner)
+	}
+	// another port, a fragment and a control are left to the loops
+	for name, change := range map[string]func([]byte){
+		"port":     func(d []byte) { d[14+20+1]++ },
+		"fragment": func(d []byte) { d[14+6] = 0x20 },
+		"control":  func(d []byte) { d[14+28] = 1 },
+	} {
+		d := append([]byte{}, datagram...)
+		change(d)
+		if verdict, out := testRun(t, p.ingress, d); verdict != tcActOK || !bytes.Equal(out, d) {
+			t.Errorf("ingress of a changed %s = %d\n%x", name, verdict, out)
+		}
+	}
+
+	// the packet of a container is sent in a datagram to the desktop, the
+	// frame of the test run taken for the packet
+	frame := append(append([]byte{}, eth...), inner...)
+	verdict, out = testRun(t, p.egress, frame)
+	if verdict != tcActRedirect || len(out) != 14+encapLen+len(frame) {
+		t.Fatalf("egress = %d\n%x", verdict, out)
+	}
+	ip := out[14 : 14+20]
+	switch {
+	case out[12] != 0x08 || out[13] != 0x00:
+		t.Errorf("ethernet type %x", out[12:14])
+	case ip[0] != 0x45 || ip[1] != 0x10 || ip[9] != syscall.IPPROTO_UDP:
+		t.Errorf("IP header %x", ip)
+	case int(binary.BigEndian.Uint16(ip[2:])) != 20+8+len(frame):
+		t.Errorf("IP length %d of %d bytes", binary.BigEndian.Uint16(ip[2:]), len(frame))
+	case fold(checksum(ip, 0)) != 0xffff:
+		t.Errorf("invalid IP checksum of %x", ip)
+	case !net.IP(ip[12:16]).Equal(local.IP) || !net.IP(ip[16:20]).Equal(desktop.IP):
+		t.Errorf("addresses %v => %v", net.IP(ip[12:16]), net.IP(ip[16:20]))
+	case binary.BigEndian.Uint16(out[34:]) != uint16(local.Port) || binary.BigEndian.Uint16(out[36:]) != uint16(desktop.Port):
+		t.Errorf("ports %x", out[34:38])
+	case int(binary.BigEndian.Uint16(out[38:])) != 8+len(frame):
+		t.Errorf("UDP length %d of %d bytes", binary.BigEndian.Uint16(out[38:]), len(frame))
+	case !bytes.Equal(out[14+encapLen:], frame):
+		t.Errorf("payload %x, expected %x", out[14+encapLen:], frame)
+	}
+	// larger than maxLen, left to the loops
+	big := append(append([]byte{}, frame...), make([]byte, 1400)...)
+	if verdict, _ := testRun(t, p.egress, big); verdict != tcActOK {
+		t.Errorf("egress of %d bytes = %d", len(big), verdict)
+	}
+
+	in, outCount := p.Counters()
+	if in.Packets != 1 || in.Bytes != uint64(len(inner)) || outCount.Packets != 1 || outCount.Bytes != uint64(len(frame)) {
+		t.Errorf("counters in %+v out %+v", in, outCount)
+	}
+
+	// both off, everything goes through the loops
+	if err := p.Update(fastPathConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if verdict, _ := testRun(t, p.ingress, datagram); verdict != tcActOK {
+		t.Errorf("ingress off = %d", verdict)
+	}
+	if verdict, _ := testRun(t, p.egress, frame); verdict != tcActOK {
+		t.Errorf("egress off = %d", verdict)
+	}
+}
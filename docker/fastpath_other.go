@@ -0,0 +1,22 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import "fmt"
+
+type fastPathProgs struct {
+	uplinkName string
+}
+
+func loadFastPath(tun string) (*fastPathProgs, error) {
+	return nil, fmt.Errorf("needs linux on amd64 or arm64")
+}
+
+func (p *fastPathProgs) Update(cfg fastPathConfig) error {
+	return nil
+}
+
+func (p *fastPathProgs) Counters() (in, out fastPathCounter) {
+	return
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With `-fec` we accept the forward error correction offered by the desktop
+// as `fec <count>` in the controls, with a feature bit of the heartbeats. The
+// datagrams are then sent in groups as
+//
+//	15 | group(2) | index | datagram
+//
+// each group closed by a parity datagram
+//
+//	15 | group(2) | 0x80 + count | length xor(2) | xor of the datagrams
+//
+// after count datagrams or fecFlush. A single datagram lost in a group is
+// rebuilt from the others. Decoding is always supported.
+const (
+	fecType    = 15
+	fecHeader  = 4
+	fecParity  = 0x80
+	featureFEC = 4
+	fecMax     = 64
+	fecFlush   = 5 * time.Millisecond
+	fecGroups  = 256
+	fecTimeout = time.Second
+)
+
+var (
+	fec = false
+	// fecOffered is the count offered by the desktop, 0 when not accepted
+	fecOffered int32
+)
+
+type fecEncoder struct {
+	sync.Mutex
+	group  uint16
+	count  int
+	parity []byte
+	length uint16
+	timer  *time.Timer
+	conn   *net.UDPConn
+}
+
+type fecGroup struct {
+	data    [][]byte
+	created time.Time
+}
+
+type fecDecoder struct {
+	sync.Mutex
+	groups map[uint16]*fecGroup
+}
+
+var (
+	fecOut = &fecEncoder{}
+	fecIn  = &fecDecoder{groups: make(map[uint16]*fecGroup)}
+)
+
+// setFECOffered records the count offered by the last controls
+func setFECOffered(offer string) {
+	var v int32
+	if n, err := strconv.Atoi(offer); err == nil && n > 0 && n <= fecMax && fec {
+		v = int32(n)
+	}
+	if atomic.SwapInt32(&fecOffered, v) != v {
+		fmt.Printf("fec => %d\n", v)
+	}
+}
+
+// sendDatagram sends a datagram to the desktop, protected if negotiated
+func sendDatagram(conn *net.UDPConn, datagram []byte) error {
+	count := int(atomic.LoadInt32(&fecOffered))
+	if count == 0 {
+		return sendFramed(conn, datagram)
+	}
+	buf := make([]byte, fecHeader+len(datagram))
+	e := fecOut
+	e.Lock()
+	defer e.Unlock()
+	if e.count == 0 {
+		e.group++
+		e.parity = e.parity[:0]
+		e.length = 0
+	}
+	buf[0] = fecType
+	binary.BigEndian.PutUint16(buf[1:], e.group)
+	buf[3] = byte(e.count)
+	copy(buf[fecHeader:], datagram)
+	err := sendFramed(conn, buf)
+	if len(datagram) > len(e.parity) {
+		e.parity = append(e.parity, make([]byte, len(datagram)-len(e.parity))...)
+	}
+	for i, c := range datagram {
+		e.parity[i] ^= c
+	}
+	e.length ^= uint16(len(datagram))
+	e.count++
+	e.conn = conn
+	if e.count >= count {
+		e.close()
+	} else if e.count == 1 {
+		group := e.group
+		e.timer = time.AfterFunc(fecFlush, func() {
+			e.Lock()
+			defer e.Unlock()
+			if e.group == group && e.count > 0 {
+				e.close()
+			}
+		})
+	}
+	return err
+}
+
+// close sends the parity of the open group
+func (e *fecEncoder) close() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	parity := make([]byte, fecHeader+2+len(e.parity))
+	parity[0] = fecType
+	binary.BigEndian.PutUint16(parity[1:], e.group)
+	parity[3] = fecParity | byte(e.count)
+	binary.BigEndian.PutUint16(parity[fecHeader:], e.length)
+	copy(parity[fecHeader+2:], e.parity)
+	e.count = 0
+	sendFramed(e.conn, parity)
+}
+
+// Receive returns the datagram carried by a protected one, or the datagram
+// rebuilt from a parity, nil if none
+func (d *fecDecoder) Receive(data []byte) []byte {
+	if len(data) < fecHeader {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(data[1:])
+	index := data[3]
+	d.Lock()
+	defer d.Unlock()
+	g := d.groups[id]
+	if index&fecParity == 0 {
+		if int(index) >= fecMax {
+			return nil
+		}
+		if g == nil {
+			now := time.Now()
+			if len(d.groups) >= fecGroups {
+				for k, v := range d.groups {
+					if now.Sub(v.created) > fecTimeout || len(d.groups) >= fecGroups {
+						delete(d.groups, k)
+					}
+				}
+			}
+			g = &fecGroup{data: make([][]byte, fecMax), created: now}
+			d.groups[id] = g
+		}
+		g.data[index] = append([]byte(nil), data[fecHeader:]...)
+		return data[fecHeader:]
+	}
+	delete(d.groups, id)
+	count := int(index &^ fecParity)
+	if len(data) < fecHeader+2 || count > fecMax {
+		return nil
+	}
+	missing := -1
+	for i := 0; i < count; i++ {
+		if g != nil && g.data[i] != nil {
+			continue
+		}
+		if missing >= 0 {
+			return nil
+		}
+		missing = i
+	}
+	if missing < 0 {
+		return nil
+	}
+	length := binary.BigEndian.Uint16(data[fecHeader:])
+	rebuilt := append([]byte(nil), data[fecHeader+2:]...)
+	for i := 0; i < count; i++ {
+		if i == missing {
+			continue
+		}
+		length ^= uint16(len(g.data[i]))
+		for j, c := range g.data[i] {
+			rebuilt[j] ^= c
+		}
+	}
+	if int(length) > len(rebuilt) {
+		return nil
+	}
+	if debug.On() {
+		fmt.Printf("fec => rebuilt datagram %d of group %d, %d bytes\n", missing, id, length)
+	}
+	return rebuilt[:length]
+}
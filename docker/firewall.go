@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// The forwarding rules between the networks, the redirections of the dns and
+// the masquerading of the joined networks are made with iptables or, on
+// hosts shipping only the nftables userspace, with nft. `-firewall auto`
+// picks iptables when it works and nft otherwise. With nft the forwarding
+// rules go to the `-chain` of the `ip filter` table of docker when it exists,
+// the others to the `ip desktop-connector` table of the agent, each rule being
+// found again by its comment. nft has no string match, so a domain is only
+// redirected when it is the whole name asked, not for `.example.com`.
+const (
+	firewallAuto     = "auto"
+	firewallIptables = "iptables"
+	firewallNft      = "nft"
+	nftTable         = "desktop-connector"
+	// dnsNameBits is the offset of the name of a query in the UDP header and
+	// the dns header, in bits
+	dnsNameBits = (8 + 12) * 8
+)
+
+var (
+	firewall = firewallAuto
+	// backend is the firewall in use once detected
+	backend = ""
+
+	nftHandle = regexp.MustCompile(`# handle (\d+)`)
+)
+
+// firewallBackend returns the firewall of `-firewall`, detecting it once
+func firewallBackend() string {
+	if backend != "" {
+		return backend
+	}
+	backend = firewall
+	if backend == firewallAuto {
+		backend = firewallNft
+		if exec.Command("iptables", "-S", "FORWARD").Run() == nil {
+			backend = firewallIptables
+		} else if _, err := exec.LookPath("nft"); err != nil {
+			backend = firewallIptables
+		}
+	}
+	fmt.Printf("firewall => %s\n", backend)
+	if backend == firewallNft {
+		nftSetup()
+	}
+	return backend
+}
+
+// nft runs nft with the arguments
+func nft(args ...string) (string, error) {
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("nft %s => %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// nftSetup creates the table of the agent and its chains
+func nftSetup() {
+	cmds := [][]string{
+		{"add", "table", "ip", nftTable},
+		{"add", "chain", "ip", nftTable, "forward", "{", "type", "filter", "hook", "forward", "priority", "-1", ";", "}"},
+		{"add", "chain", "ip", nftTable, "prerouting", "{", "type", "nat", "hook", "prerouting", "priority", "-101", ";", "}"},
+		{"add", "chain", "ip", nftTable, "postrouting", "{", "type", "nat", "hook", "postrouting", "priority", "99", ";", "}"},
+	}
+	for _, args := range cmds {
+		if _, err := nft(args...); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// nftRule checks (-C), inserts (-I), appends (-A) or deletes (-D) the rule of
+// a chain with the comment
+func nftRule(act string, chain []string, comment string, expr ...string) error {
+	out, err := nft(append([]string{"-a", "list", "chain"}, chain...)...)
+	if err != nil {
+		return err
+	}
+	handle := ""
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, fmt.Sprintf("comment %q", comment)) {
+			if m := nftHandle.FindStringSubmatch(line); m != nil {
+				handle = m[1]
+				break
+			}
+		}
+	}
+	switch act {
+	case "-C":
+		if handle == "" {
+			return fmt.Errorf("no rule %q", comment)
+		}
+		return nil
+	case "-D":
+		if handle == "" {
+			return nil
+		}
+		fmt.Printf("nft delete rule %s => %s\n", strings.Join(chain, " "), comment)
+		_, err = nft(append(append([]string{"delete", "rule"}, chain...), "handle", handle)...)
+		return err
+	}
+	if handle != "" {
+		return nil
+	}
+	verb := "add"
+	if act == "-I" {
+		verb = "insert"
+	}
+	fmt.Printf("nft %s rule %s => %s\n", verb, strings.Join(chain, " "), strings.Join(expr, " "))
+	args := append(append([]string{verb, "rule"}, chain...), expr...)
+	_, err = nft(append(args, "comment", fmt.Sprintf("%q", comment))...)
+	return err
+}
+
+// forwardChain returns the chain of the forwarding rules, the one of docker
+// if it exists
+func forwardChain() []string {
+	if _, err := nft("list", "chain", "ip", "filter", chain); err == nil {
+		return []string{"ip", "filter", chain}
+	}
+	return []string{"ip", nftTable, "forward"}
+}
+
+// forwardRule checks, inserts or deletes the acceptance of the packets from
+// an interface to another
+func forwardRule(a, i, o string) error {
+	if firewallBackend() != firewallNft {
+		return iptables(a, i, o)
+	}
+	return nftRule(a, forwardChain(), fmt.Sprintf("ddc forward %s %s", i, o),
+		"iifname", fmt.Sprintf("%q", i), "oifname", fmt.Sprintf("%q", o), "accept")
+}
+
+// dnsRule inserts or deletes the redirection of the queries of a domain
+func dnsRule(act, domain string, ip net.IP) error {
+	if firewallBackend() != firewallNft {
+		argv := []string{"iptables", "-t", "nat", act, "PREROUTING", "-p", "udp", "--dport", "53",
+			"-m", "string", "--algo", "bm", "--hex-string", hexDomain(domain), "-j", "DNAT", "--to-destination", ip.String(),
+		}
+		err := exec.Command(argv[0], argv[1:]...).Run()
+		fmt.Printf("dns command => %s %v\n", strings.Join(argv, " "), err)
+		return err
+	}
+	if strings.HasPrefix(domain, ".") {
+		return fmt.Errorf("nft only redirects whole names, not %s", domain)
+	}
+	expr := []string{"udp", "dport", "53"}
+	name := dnsName(domain)
+	for off := 0; off < len(name); off += 16 {
+		chunk := name[off:]
+		if len(chunk) > 16 {
+			chunk = chunk[:16]
+		}
+		expr = append(expr, fmt.Sprintf("@th,%d,%d", dnsNameBits+off*8, len(chunk)*8), "0x"+hex.EncodeToString(chunk))
+	}
+	expr = append(expr, "dnat", "to", ip.String())
+	return nftRule(act, []string{"ip", nftTable, "prerouting"}, "ddc dns "+domain, expr...)
+}
+
+// dnsName encodes a domain as in a query, `www.example.com` as
+// `\x03www\x07example\x03com\x00`
+func dnsName(domain string) []byte {
+	var name []byte
+	for _, label := range strings.Split(strings.Trim(domain, "."), ".") {
+		name = append(append(name, byte(len(label))), label...)
+	}
+	return append(name, 0)
+}
+
+// masqueradeRule appends or deletes the masquerading from a source network to
+// a destination one
+func masqueradeRule(act, src, dst string) error {
+	if firewallBackend() != firewallNft {
+		rule := func(a string) *exec.Cmd {
+			return exec.Command("iptables", "-t", "nat", a, "POSTROUTING", "-s", src, "-d", dst, "-j", "MASQUERADE")
+		}
+		if act == "-A" && rule("-C").Run() == nil {
+			return nil
+		}
+		fmt.Printf("iptables -t nat %s POSTROUTING -s %s -d %s -j MASQUERADE\n", act, src, dst)
+		if out, err := rule(act).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v %s", err, out)
+		}
+		return nil
+	}
+	return nftRule(act, []string{"ip", nftTable, "postrouting"}, fmt.Sprintf("ddc masquerade %s %s", src, dst),
+		"ip", "saddr", src, "ip", "daddr", dst, "masquerade")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packets larger than `fragSize` are split into datagrams of
+//
+//	6 | id(2) | index | count | data
+//
+// and reassembled by the receiving side, so jumbo frames can cross a path
+// with a smaller MTU. Reassembly is always supported.
+const (
+	fragType    = 6
+	fragHeader  = 5
+	fragTimeout = 5 * time.Second
+	fragMax     = 64
+)
+
+var (
+	fragSize = 0
+	fragID   uint16
+)
+
+// writePacket sends a packet to the desktop, fragmented if it is too large,
+// it is only called by the TUN reader
+func writePacket(conn *net.UDPConn, packet []byte) error {
+	inheritDSCP(conn, packet)
+	packet = compressPacket(packet)
+	if fragSize <= fragHeader || len(packet) <= fragSize {
+		return sendDatagram(conn, packet)
+	}
+	size := fragSize - fragHeader
+	count := (len(packet) + size - 1) / size
+	if count > 255 {
+		return sendDatagram(conn, packet)
+	}
+	fragID++
+	chunk := make([]byte, fragSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(packet) {
+			end = len(packet)
+		}
+		chunk[0] = fragType
+		binary.BigEndian.PutUint16(chunk[1:], fragID)
+		chunk[3] = byte(i)
+		chunk[4] = byte(count)
+		l := copy(chunk[fragHeader:], packet[i*size:end])
+		if err := sendDatagram(conn, chunk[:fragHeader+l]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fragEntry struct {
+	chunks  [][]byte
+	missing int
+	created time.Time
+}
+
+var (
+	fragLock    sync.Mutex
+	fragEntries = make(map[uint16]*fragEntry)
+)
+
+// reassemble collects a fragment and returns the packet once complete
+func reassemble(data []byte) []byte {
+	if len(data) <= fragHeader {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(data[1:])
+	index, count := int(data[3]), int(data[4])
+	if count == 0 || index >= count {
+		return nil
+	}
+	fragLock.Lock()
+	defer fragLock.Unlock()
+	now := time.Now()
+	e, ok := fragEntries[id]
+	if !ok || len(e.chunks) != count {
+		if len(fragEntries) >= fragMax {
+			for k, v := range fragEntries {
+				if now.Sub(v.created) > fragTimeout || len(fragEntries) >= fragMax {
+					delete(fragEntries, k)
+				}
+			}
+		}
+		e = &fragEntry{chunks: make([][]byte, count), missing: count, created: now}
+		fragEntries[id] = e
+	}
+	if e.chunks[index] == nil {
+		e.chunks[index] = append([]byte(nil), data[fragHeader:]...)
+		e.missing--
+	}
+	if e.missing > 0 {
+		return nil
+	}
+	delete(fragEntries, id)
+	var packet []byte
+	for _, chunk := range e.chunks {
+		packet = append(packet, chunk...)
+	}
+	return packet
+}
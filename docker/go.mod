@@ -3,6 +3,7 @@ module desktop-connector
 go 1.13
 
 require (
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
 )
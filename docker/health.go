@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// The agent writes its health to `-health-file` every few seconds, and
+// `desktop-connector healthcheck` (the HEALTHCHECK of the image) exits 1 when
+// the file is stale, the TUN is gone or nothing came from the desktop within
+// `-health-within`, counted from the start until the first packet. With
+// `-exit-unhealthy` the agent exits once unhealthy for that long, so the
+// restart policy of the container brings it back.
+const healthEvery = 5 * time.Second
+
+var (
+	healthFile    = filepath.Join(os.TempDir(), "desktop-connector.health")
+	healthWithin  = time.Minute
+	exitUnhealthy time.Duration
+	startedAt     = time.Now()
+)
+
+// health is the content of the health file
+type health struct {
+	Updated int64  `json:"updated"`
+	Started int64  `json:"started"`
+	LastRx  int64  `json:"last_rx"`
+	Tun     string `json:"tun"`
+	// Truncated counts the packets dropped for filling their buffer
+	Truncated uint64 `json:"truncated_reads"`
+	// EBPF counts the packets forwarded by the programs of `-ebpf`
+	EBPF *fastPathStatus `json:"ebpf,omitempty"`
+}
+
+// problems lists why the agent is unhealthy
+func (h *health) problems(now time.Time) []string {
+	var list []string
+	if now.Sub(time.Unix(0, h.Updated)) > 3*healthEvery {
+		list = append(list, "agent not running")
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/net", h.Tun)); h.Tun == "" || err != nil {
+		list = append(list, fmt.Sprintf("interface %q missing", h.Tun))
+	}
+	since := h.Started
+	if h.LastRx != 0 {
+		since = h.LastRx
+	}
+	if silent := now.Sub(time.Unix(0, since)); healthWithin > 0 && silent > healthWithin {
+		list = append(list, fmt.Sprintf("desktop silent for %v", silent.Round(time.Second)))
+	}
+	return list
+}
+
+func currentHealth() *health {
+	return &health{
+		Updated:   time.Now().UnixNano(),
+		Started:   startedAt.UnixNano(),
+		LastRx:    atomic.LoadInt64(&lastRx),
+		Tun:       tunName,
+		Truncated: atomic.LoadUint64(&truncatedReads),
+		EBPF:      fastPathHealth(),
+	}
+}
+
+// reportHealth writes the health file, exiting once unhealthy for
+// `exitUnhealthy`
+func reportHealth() {
+	var since time.Time
+	for {
+		h := currentHealth()
+		if data, err := json.Marshal(h); err == nil {
+			tmp := healthFile + ".tmp"
+			if err := ioutil.WriteFile(tmp, data, 0644); err == nil {
+				os.Rename(tmp, healthFile)
+			}
+		}
+		if problems := h.problems(time.Now()); len(problems) == 0 {
+			since = time.Time{}
+		} else if since.IsZero() {
+			since = time.Now()
+			fmt.Printf("unhealthy => %v\n", problems)
+		} else if exitUnhealthy > 0 && time.Since(since) >= exitUnhealthy {
+			fmt.Printf("unhealthy for %v, exiting => %v\n", exitUnhealthy, problems)
+			os.Exit(1)
+		}
+		time.Sleep(healthEvery)
+	}
+}
+
+// runHealthcheck implements `healthcheck`, exiting 1 when unhealthy
+func runHealthcheck() {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	fs.StringVar(&healthFile, "health-file", healthFile, "health file of the agent")
+	fs.DurationVar(&healthWithin, "health-within", healthWithin, "max silence of the desktop before unhealthy, 0 to ignore")
+	fs.Parse(os.Args[2:])
+	applyEnv(fs)
+	data, err := ioutil.ReadFile(healthFile)
+	if err != nil {
+		fmt.Printf("unhealthy => %v\n", err)
+		os.Exit(1)
+	}
+	var h health
+	if err := json.Unmarshal(data, &h); err != nil {
+		fmt.Printf("unhealthy => %v\n", err)
+		os.Exit(1)
+	}
+	if problems := h.problems(time.Now()); len(problems) > 0 {
+		fmt.Printf("unhealthy => %v\n", problems)
+		os.Exit(1)
+	}
+	fmt.Printf("healthy => %s\n", data)
+}
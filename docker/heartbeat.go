@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// heartbeatLen is the size of a timestamped heartbeat:
+//
+//	0 | t1 | echoT1 | t4
+//
+// t1 is the send time, echoT1/t4 report when the reply to a previous
+// heartbeat arrived, so the desktop can estimate skew and one-way delays.
+const heartbeatLen = 1 + 8*3
+
+var (
+	hbLock sync.Mutex
+	echoT1 int64
+	echoT4 int64
+)
+
+func sendHeartbeat(conn *net.UDPConn) {
+	packet := make([]byte, heartbeatLen, heartbeatLen+1+sessionLen+identityLen)
+	hbLock.Lock()
+	binary.BigEndian.PutUint64(packet[9:], uint64(echoT1))
+	binary.BigEndian.PutUint64(packet[17:], uint64(echoT4))
+	hbLock.Unlock()
+	binary.BigEndian.PutUint64(packet[1:], uint64(time.Now().UnixNano()))
+	writeUDP(conn, withIdentity(withSession(packet, features())))
+	helloData(conn)
+}
+
+// handleHeartbeat records the reply `0 | t1 | t2 | t3` of the desktop
+func handleHeartbeat(data []byte) {
+	if len(data) < heartbeatLen {
+		return
+	}
+	sessionFlags(data)
+	t4 := time.Now().UnixNano()
+	t1 := int64(binary.BigEndian.Uint64(data[1:]))
+	t2 := int64(binary.BigEndian.Uint64(data[9:]))
+	t3 := int64(binary.BigEndian.Uint64(data[17:]))
+	hbLock.Lock()
+	echoT1 = t1
+	echoT4 = t4
+	hbLock.Unlock()
+	if debug.On() {
+		rtt := time.Duration((t4 - t1) - (t3 - t2))
+		offset := time.Duration(((t2 - t1) + (t3 - t4)) / 2)
+		fmt.Printf("heartbeat => rtt %v offset %v\n", rtt, offset)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// `hosts-template <template>` of the desktop names every running container
+// with a template of its name, image and labels, e.g. `{{.Name}}.docker` or
+// `{{.Service}}.{{.Project}}.test`. The agent follows the containers through
+// the docker socket, answers the names with their addresses from its dns
+// server, and pushes `dns <suffix> <agent ip>` for the fixed end of the
+// template so the desktop resolves them. A name left empty or invalid, as a
+// missing label makes it, is skipped.
+var (
+	hostTemplates     []string
+	hostTemplatesLock sync.Mutex
+	templateHosts     = make(map[string][4]byte)
+	templateHostsLock sync.RWMutex
+
+	hostLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9_-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9_-]*[a-z0-9])?)*$`)
+)
+
+// templateContainer is what a template sees of a container
+type templateContainer struct {
+	ID      string
+	Name    string
+	Image   string
+	Service string
+	Project string
+	Number  string
+	Labels  map[string]string
+}
+
+// setHostTemplates replaces the templates sent by the desktop
+func setHostTemplates(templates []string) {
+	hostTemplatesLock.Lock()
+	defer hostTemplatesLock.Unlock()
+	if strings.Join(templates, "\n") != strings.Join(hostTemplates, "\n") {
+		fmt.Printf("hosts templates => %q\n", templates)
+	}
+	hostTemplates = templates
+}
+
+// templateHost returns the address of a name given by the templates
+func templateHost(name string) ([4]byte, bool) {
+	templateHostsLock.RLock()
+	defer templateHostsLock.RUnlock()
+	a, ok := templateHosts[strings.ToLower(name)]
+	return a, ok
+}
+
+// templateSuffix returns the fixed end of a template, `docker` for
+// `{{.Name}}.docker`
+func templateSuffix(text string) string {
+	if i := strings.LastIndex(text, "}}"); i >= 0 {
+		text = text[i+2:]
+	}
+	text = strings.ToLower(strings.Trim(text, "."))
+	if !hostLabel.MatchString(text) {
+		return ""
+	}
+	return text
+}
+
+// resolveTemplates returns the names of the running containers
+func resolveTemplates(templates []*template.Template) (map[string][4]byte, error) {
+	body, err := dockerGet("/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	var containers []dockerContainer
+	err = json.NewDecoder(body).Decode(&containers)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string][4]byte)
+	for _, c := range containers {
+		var names []string
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var ip net.IP
+		for _, name := range names {
+			if ip = net.ParseIP(c.NetworkSettings.Networks[name].IPAddress).To4(); ip != nil {
+				break
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		data := templateContainer{
+			ID:      c.ID,
+			Image:   c.Image,
+			Service: c.Labels[composeServiceLabel],
+			Project: c.Labels[composeProjectLabel],
+			Number:  c.Labels[composeNumberLabel],
+			Labels:  c.Labels,
+		}
+		if len(c.Names) > 0 {
+			data.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		for _, t := range templates {
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				continue
+			}
+			name := strings.ToLower(strings.Trim(buf.String(), "."))
+			if !hostLabel.MatchString(name) {
+				continue
+			}
+			if _, ok := hosts[name+"."]; !ok {
+				hosts[name+"."] = [4]byte{ip[0], ip[1], ip[2], ip[3]}
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// watchTemplates follows the containers named by the templates and pushes
+// their suffixes to the desktop
+func watchTemplates(conn *net.UDPConn, ip net.IP) {
+	pushed := make(map[string]bool)
+	last := ""
+	for i := 0; ; i++ {
+		hostTemplatesLock.Lock()
+		texts := hostTemplates
+		hostTemplatesLock.Unlock()
+		joined := strings.Join(texts, "\n")
+		var templates []*template.Template
+		suffixes := make(map[string]bool)
+		for _, text := range texts {
+			t, err := template.New("host").Option("missingkey=zero").Parse(text)
+			if err != nil {
+				if joined != last {
+					fmt.Printf("hosts template %q error => %v\n", text, err)
+				}
+				continue
+			}
+			templates = append(templates, t)
+			if suffix := templateSuffix(text); suffix != "" {
+				suffixes[suffix] = true
+			}
+		}
+		last = joined
+		hosts := make(map[string][4]byte)
+		if len(templates) > 0 {
+			var err error
+			if hosts, err = resolveTemplates(templates); err != nil {
+				fmt.Printf("hosts template error => %v\n", err)
+				time.Sleep(pushInterval)
+				continue
+			}
+		}
+		templateHostsLock.Lock()
+		if fmt.Sprint(hosts) != fmt.Sprint(templateHosts) {
+			fmt.Printf("hosts template => %d names\n", len(hosts))
+		}
+		templateHosts = hosts
+		templateHostsLock.Unlock()
+		for suffix := range suffixes {
+			if !pushed[suffix] || i%pushRepeat == 0 {
+				sendRoute(conn, fmt.Sprintf("dns %s %s", suffix, ip))
+			}
+		}
+		for suffix := range pushed {
+			if !suffixes[suffix] {
+				sendRoute(conn, "dns "+suffix)
+			}
+		}
+		pushed = suffixes
+		time.Sleep(pushInterval)
+	}
+}
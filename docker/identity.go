@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Once the desktop tells it knows the identities, by a flag of its replies or
+// of a session request, the heartbeats carrying the session are signed with
+// the Ed25519 key of the agent:
+//
+//	0 | t1 | echoT1 | t4 | features | session(8) | key(32) | signature(64)
+//
+// so a desktop pinning the key refuses another agent knowing the secrets. The
+// key is kept in `-identity-file` to survive the restarts of the container,
+// its public half printed at start for the `pin-peer` of the desktop.
+const (
+	identityLen = ed25519.PublicKeySize + ed25519.SignatureSize
+	// desktopIdentity is the flag of the desktop knowing the identities
+	desktopIdentity = 2
+)
+
+var (
+	identityFile = filepath.Join(os.TempDir(), "desktop-connector.identity")
+	identityKey  ed25519.PrivateKey
+	// identityOK is set once the desktop knows the identities
+	identityOK int32
+)
+
+// loadIdentity reads the key of `-identity-file` or creates it
+func loadIdentity() {
+	if identityFile != "" {
+		if data, err := ioutil.ReadFile(identityFile); err == nil {
+			if seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil && len(seed) == ed25519.SeedSize {
+				identityKey = ed25519.NewKeyFromSeed(seed)
+			}
+		}
+	}
+	if identityKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Printf("identity error => %v\n", err)
+			return
+		}
+		identityKey = key
+		if identityFile != "" {
+			if err := ioutil.WriteFile(identityFile, []byte(base64.StdEncoding.EncodeToString(key.Seed())), 0600); err != nil {
+				fmt.Printf("identity file error => %v\n", err)
+			}
+		}
+	}
+	fmt.Printf("identity => %s\n", base64.StdEncoding.EncodeToString(identityKey.Public().(ed25519.PublicKey)))
+}
+
+// identityFlags records whether the flags of the desktop tell it knows the
+// identities
+func identityFlags(flags byte) {
+	if flags&desktopIdentity != 0 && atomic.CompareAndSwapInt32(&identityOK, 0, 1) {
+		fmt.Println("identity => signing the heartbeats")
+	}
+}
+
+// withIdentity signs a heartbeat carrying the session when the desktop knows
+// the identities
+func withIdentity(packet []byte) []byte {
+	if atomic.LoadInt32(&identityOK) == 0 || identityKey == nil || len(packet) != heartbeatLen+1+sessionLen {
+		return packet
+	}
+	packet = append(packet, identityKey.Public().(ed25519.PublicKey)...)
+	return append(packet, ed25519.Sign(identityKey, packet)...)
+}
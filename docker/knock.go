@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	knockPort   = 0
+	knockSecret = ""
+	// knockEvery is the interval of the knocks keeping the port open
+	knockEvery = 30 * time.Second
+	knockConn  *net.UDPConn
+	// knockTicker starts the knocks once, the socket dialed again on reload
+	knockTicker sync.Once
+)
+
+// dialKnock opens the socket for the knocks, which leaves through the same
+// interface as the tunnel so the desktop opens the port for the right source
+func dialKnock() {
+	if knockPort <= 0 || knockSecret == "" {
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, knockPort))
+	if err != nil {
+		fmt.Printf("invalid knock address => %s:%d\n", host, knockPort)
+		return
+	}
+	knockConn, err = dialUDP(nil, udpAddr)
+	if err != nil {
+		fmt.Printf("failed to dial knock port %d => %s\n", knockPort, err.Error())
+		return
+	}
+	knockTicker.Do(func() {
+		go func() {
+			for range time.Tick(knockEvery) {
+				knock()
+			}
+		}()
+	})
+}
+
+// knock sends `timestamp | hmac-sha256(secret, timestamp)` to the knock port
+func knock() {
+	if knockConn == nil {
+		return
+	}
+	packet := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(packet, uint64(time.Now().UnixNano()))
+	mac := hmac.New(sha256.New, []byte(knockSecret))
+	mac.Write(packet)
+	packet = mac.Sum(packet)
+	if _, err := knockConn.Write(packet); err != nil && debug.On() {
+		fmt.Printf("knock error => %v\n", err)
+	}
+}
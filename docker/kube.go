@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// With `-kube` the agent finds the kind and minikube clusters running on the
+// docker host through the docker socket, mounted with
+// `-v /var/run/docker.sock:/var/run/docker.sock`. For each cluster it routes
+// the pod and service CIDRs to the control plane node, pushes them to the
+// desktop as `connect <subnet>` and pushes `dns <domain> <cluster dns>` so the
+// desktop resolves `*.svc.cluster.local` through the cluster, then
+// `disconnect <subnet>` and `dns <domain>` once the cluster is deleted. The
+// CIDRs come from the manifest of the controller manager, the domain and the
+// DNS server from the kubelet config, falling back to the kubeadm defaults.
+const (
+	kubeControllerManifest = "/etc/kubernetes/manifests/kube-controller-manager.yaml"
+	kubeletConfig          = "/var/lib/kubelet/config.yaml"
+	kindRoleLabel          = "io.x-k8s.kind.role"
+	kindClusterLabel       = "io.x-k8s.kind.cluster"
+	minikubeLabel          = "name.minikube.sigs.k8s.io"
+)
+
+var (
+	kube         = false
+	dockerSocket = "/var/run/docker.sock"
+
+	clusterCIDR  = regexp.MustCompile(`--cluster-cidr=(\S+)`)
+	serviceCIDR  = regexp.MustCompile(`--service-cluster-ip-range=(\S+)`)
+	clusterDom   = regexp.MustCompile(`(?m)^clusterDomain:\s*"?([^\s"]+)`)
+	clusterDNSIP = regexp.MustCompile(`(?m)^clusterDNS:\s*\n\s*-\s*"?([^\s"]+)`)
+)
+
+// kubeCluster is a local cluster and what is pushed for it
+type kubeCluster struct {
+	name     string
+	node     string
+	pods     string
+	services string
+	domain   string
+	dns      string
+}
+
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+var dockerClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", dockerSocket)
+		},
+	},
+}
+
+// dockerGet calls the docker API on the socket
+func dockerGet(path string) (io.ReadCloser, error) {
+	rsp, err := dockerClient.Get("http://docker" + path)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%s => %s", path, rsp.Status)
+	}
+	return rsp.Body, nil
+}
+
+// containerFile reads a file of a container through its archive
+func containerFile(id, path string) (string, error) {
+	body, err := dockerGet("/containers/" + id + "/archive?path=" + url.QueryEscape(path))
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	r := tar.NewReader(body)
+	for {
+		h, err := r.Next()
+		if err != nil {
+			return "", err
+		}
+		if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+			data, err := ioutil.ReadAll(r)
+			return string(data), err
+		}
+	}
+}
+
+// firstIPv4 returns the IPv4 CIDR of a dual-stack list
+func firstIPv4(list string) string {
+	for _, s := range strings.Split(list, ",") {
+		if _, ipnet, err := net.ParseCIDR(s); err == nil && ipnet.IP.To4() != nil {
+			return ipnet.String()
+		}
+	}
+	return ""
+}
+
+// kubeClusters returns the clusters found on the docker host
+func kubeClusters() ([]*kubeCluster, error) {
+	body, err := dockerGet("/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	var containers []dockerContainer
+	err = json.NewDecoder(body).Decode(&containers)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var clusters []*kubeCluster
+	for _, c := range containers {
+		name := ""
+		switch {
+		case c.Labels[kindRoleLabel] == "control-plane":
+			name = "kind-" + c.Labels[kindClusterLabel]
+		case c.Labels[minikubeLabel] != "" && len(c.Names) > 0 && c.Names[0] == "/"+c.Labels[minikubeLabel]:
+			name = "minikube-" + c.Labels[minikubeLabel]
+		default:
+			continue
+		}
+		k := &kubeCluster{name: name, pods: "10.244.0.0/16", services: "10.96.0.0/12", domain: "cluster.local"}
+		for _, n := range c.NetworkSettings.Networks {
+			if ip := net.ParseIP(n.IPAddress).To4(); ip != nil {
+				k.node = ip.String()
+				break
+			}
+		}
+		if k.node == "" {
+			continue
+		}
+		if manifest, err := containerFile(c.ID, kubeControllerManifest); err != nil {
+			fmt.Printf("kube %s manifest => %v, using the defaults\n", name, err)
+		} else {
+			if m := clusterCIDR.FindStringSubmatch(manifest); m != nil && firstIPv4(m[1]) != "" {
+				k.pods = firstIPv4(m[1])
+			}
+			if m := serviceCIDR.FindStringSubmatch(manifest); m != nil && firstIPv4(m[1]) != "" {
+				k.services = firstIPv4(m[1])
+			}
+		}
+		// kubeadm gives the 10th address of the services to the cluster DNS
+		_, svc, _ := net.ParseCIDR(k.services)
+		dns := append(net.IP(nil), svc.IP.To4()...)
+		dns[3] += 10
+		k.dns = dns.String()
+		if config, err := containerFile(c.ID, kubeletConfig); err == nil {
+			if m := clusterDom.FindStringSubmatch(config); m != nil {
+				k.domain = m[1]
+			}
+			if m := clusterDNSIP.FindStringSubmatch(config); m != nil && net.ParseIP(m[1]).To4() != nil {
+				k.dns = m[1]
+			}
+		}
+		clusters = append(clusters, k)
+	}
+	return clusters, nil
+}
+
+// watchKube pushes the networks of the local clusters to the desktop
+func watchKube(conn *net.UDPConn) {
+	known := make(map[string]*kubeCluster)
+	for i := 0; ; i++ {
+		var clusters []*kubeCluster
+		var err error
+		if kube {
+			clusters, err = kubeClusters()
+		}
+		if err != nil {
+			fmt.Printf("kube discovery error => %v\n", err)
+			time.Sleep(pushInterval)
+			continue
+		}
+		current := make(map[string]*kubeCluster)
+		claimed := make(map[string]string)
+		for _, k := range clusters {
+			if other := claimed[k.pods]; other != "" {
+				fmt.Printf("kube %s => pod cidr %s already routed to %s\n", k.name, k.pods, other)
+				continue
+			}
+			claimed[k.pods], claimed[k.services] = k.name, k.name
+			current[k.name] = k
+			old := known[k.name]
+			if old != nil && *old == *k && i%pushRepeat != 0 {
+				continue
+			}
+			if old == nil || *old != *k {
+				fmt.Printf("kube %s => node %s pods %s services %s dns %s %s\n", k.name, k.node, k.pods, k.services, k.domain, k.dns)
+				runCmd(fmt.Sprintf("ip route replace %s via %s", k.pods, k.node))
+				runCmd(fmt.Sprintf("ip route replace %s via %s", k.services, k.node))
+			}
+			sendRoute(conn, "connect "+k.pods)
+			sendRoute(conn, "connect "+k.services)
+			sendRoute(conn, fmt.Sprintf("dns %s %s", k.domain, k.dns))
+		}
+		for name, k := range known {
+			if current[name] != nil {
+				continue
+			}
+			fmt.Printf("kube %s => removed\n", name)
+			runCmd(fmt.Sprintf("ip route del %s via %s", k.pods, k.node))
+			runCmd(fmt.Sprintf("ip route del %s via %s", k.services, k.node))
+			sendRoute(conn, "disconnect "+k.pods)
+			sendRoute(conn, "disconnect "+k.services)
+			sendRoute(conn, "dns "+k.domain)
+		}
+		known = current
+		time.Sleep(pushInterval)
+	}
+}
@@ -4,35 +4,165 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-
-	"github.com/songgao/water"
 )
 
 var (
 	// MTU maximum transmission unit
 	MTU       = 1400
-	debug     = false
+	debug     debugFlag
 	host      = "host.docker.internal"
 	port      = 2511
 	addr      = "192.168.251.1/24"
 	heartbeat = 5000
 	chain     = "DOCKER-USER"
 	dnsSvr    *DNSServer
+	tunName   = ""
 )
 
+// debugFlag is -debug, switched by the diag commands and the reloads while
+// the loops read it
+type debugFlag int32
+
+func (d *debugFlag) On() bool {
+	return atomic.LoadInt32((*int32)(d)) != 0
+}
+
+func (d *debugFlag) SetOn(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32((*int32)(d), v)
+}
+
+func (d *debugFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	d.SetOn(on)
+	return nil
+}
+
+func (d *debugFlag) String() string {
+	return strconv.FormatBool(d.On())
+}
+
+func (d *debugFlag) IsBoolFlag() bool {
+	return true
+}
+
 func init() {
-	flag.BoolVar(&debug, "debug", debug, "Provide debug info")
+	flag.Var(&debug, "debug", "Provide debug info")
 	flag.IntVar(&MTU, "mtu", MTU, "network MTU")
-	flag.StringVar(&host, "host", host, "host to connect")
+	flag.IntVar(&bufferLen, "buffer-size", bufferLen, "bytes of the packet buffers up to 65535, 0 to follow the MTU")
+	flag.StringVar(&host, "host", host, "host to connect, wsl for the Windows host of a WSL2 distro, a name being resolved again")
+	flag.DurationVar(&resolveEvery, "resolve-every", resolveEvery, "interval resolving again the name of -host, 0 to only resolve on failures")
 	flag.IntVar(&port, "port", port, "port to connect")
 	flag.StringVar(&addr, "addr", addr, "virtual network address")
 	flag.StringVar(&chain, "chain", chain, "iptables chain name")
+	flag.StringVar(&firewall, "firewall", firewall, "firewall of the rules: iptables, nft or auto")
+	flag.StringVar(&proxyARP, "proxy-arp", proxyARP, "addresses answered for on the bridges by proxy arp and ndp, desktop for its tunnel ip, separated by commas")
 	flag.IntVar(&heartbeat, "heartbeat", heartbeat, "heartbeat")
+	flag.IntVar(&fragSize, "fragment", fragSize, "fragment tunneled packets larger than this size, 0 to disable")
+	flag.BoolVar(&pingResponder, "ping-responder", pingResponder, "answer the pings of the desktop to the tunnel address in the agent instead of the stack")
+	flag.BoolVar(&offload, "offload", offload, "enable tcp segmentation and coalescing offloads of the tun")
+	flag.IntVar(&batch, "batch", batch, "max datagrams read or written per syscall, 1 to disable")
+	flag.BoolVar(&ebpf, "ebpf", ebpf, "forward the plain packets in the kernel with tc bpf programs when available, linux only")
+	flag.IntVar(&sockets, "sockets", sockets, "udp sockets sharing the port with SO_REUSEPORT, the packets of the desktop spread across them by flow, linux only")
+	flag.IntVar(&controlPort, "control-port", controlPort, "desktop port of the control traffic, 0 to share the data port")
+	flag.BoolVar(&compress, "compress", compress, "accept lz4 compression offered by the desktop")
+	flag.StringVar(&dscp, "dscp", dscp, "DSCP of the datagrams to the desktop, e.g. ef, af41, cs1, 10 or inherit")
+	flag.BoolVar(&fec, "fec", fec, "accept the forward error correction offered by the desktop")
+	flag.IntVar(&knockPort, "knock-port", knockPort, "desktop port accepting knocks, 0 to disable")
+	flag.StringVar(&knockSecret, "knock-secret", knockSecret, "shared secret of the knocks")
+	flag.StringVar(&controlSecret, "control-secret", controlSecret, "shared secret signing the controls pushed to the desktop")
+	flag.BoolVar(&tapMode, "tap", tapMode, "create a tap device and carry ethernet frames if the desktop offers")
+	flag.StringVar(&bridge, "bridge", bridge, "bridge the tap device joins, e.g. the bridge of a docker network")
+	flag.BoolVar(&pushRoutes, "push-routes", pushRoutes, "push the subnets of the docker networks to the desktop as routes")
+	flag.BoolVar(&kube, "kube", kube, "push the pod and service networks and the dns of the kind and minikube clusters to the desktop")
+	flag.StringVar(&compose, "compose", compose, "compose projects whose networks and <service>.<project> names are pushed to the desktop, separated by commas")
+	flag.StringVar(&joinNetworks, "join-networks", joinNetworks, "user-defined bridge networks joined through the docker socket and pushed to the desktop, separated by commas, or all")
+	flag.StringVar(&podmanNetworks, "podman-networks", podmanNetworks, "network configs of netavark whose subnets are pushed with -push-routes")
+	flag.StringVar(&cniConfig, "cni-config", cniConfig, "network configs of CNI whose subnets are pushed with -push-routes")
+	flag.StringVar(&dockerSocket, "docker-socket", dockerSocket, "docker socket of -kube, -compose and -join-networks")
+	flag.IntVar(&lostAfter, "lost-after", lostAfter, "silent heartbeat intervals before the desktop is considered lost")
+	flag.IntVar(&reconnectMax, "reconnect-max", reconnectMax, "max reconnect backoff in milliseconds")
+	flag.StringVar(&rendezvous, "rendezvous", rendezvous, "rendezvous server reaching the desktop behind a NAT, e.g. vps.example.com:2520")
+	flag.StringVar(&rendezvousSession, "rendezvous-session", rendezvousSession, "session name shared with the desktop on the rendezvous server")
+	flag.BoolVar(&relayOnly, "relay-only", relayOnly, "skip the punch, the rendezvous server relays the tunnel")
+	flag.StringVar(&relaySecret, "relay-secret", relaySecret, "shared secret signing the registration to the rendezvous server")
+	flag.StringVar(&bindIface, "bind-interface", bindIface, "network interface the sockets to the desktop send through, e.g. eth1")
+	flag.StringVar(&sessionFile, "session-file", sessionFile, "file keeping the session id across restarts, empty for a new one each start")
+	flag.StringVar(&identityFile, "identity-file", identityFile, "file keeping the key signing the heartbeats, empty for a new one each start")
+	flag.StringVar(&healthFile, "health-file", healthFile, "file the health is written to for healthcheck")
+	flag.DurationVar(&healthWithin, "health-within", healthWithin, "max silence of the desktop before unhealthy, 0 to ignore")
+	flag.DurationVar(&exitUnhealthy, "exit-unhealthy", exitUnhealthy, "exit once unhealthy for the duration, 0 to disable")
+	flag.BoolVar(&mdns, "mdns", mdns, "push the services of the containers labeled desktop-connector.mdns=<type>:<port> to the desktop to advertise")
+	flag.BoolVar(&publish, "publish", publish, "push the ports of the containers labeled desktop-connector.publish=<name>:<port> to the desktop to publish as local services")
+	flag.StringVar(&configFile, "config", configFile, "file of flags reloaded on change, <flag> <value> or DDC_<FLAG>=<value> lines")
+}
+
+// maxBufferSize bounds `-buffer-size`, the size of a UDP datagram
+const maxBufferSize = 65535
+
+var (
+	// bufferLen is `-buffer-size`, 0 to follow the MTU
+	bufferLen = 0
+	// linkMTU is the MTU in use, `-mtu` until the desktop pushes its own
+	linkMTU        int32
+	truncatedReads uint64
+	truncatedAt    int64
+)
+
+// currentMTU is the MTU agreed on with the desktop
+func currentMTU() int {
+	return int(atomic.LoadInt32(&linkMTU))
+}
+
+// bufferSize is the size of the packet buffers, large enough for the MTU
+func bufferSize() int {
+	if bufferLen > 0 {
+		if bufferLen > maxBufferSize {
+			return maxBufferSize
+		}
+		return bufferLen
+	}
+	if mtu := currentMTU(); mtu+100 > 2000 {
+		return mtu + 100
+	}
+	return 2000
+}
+
+// grownBuffer returns buf, or a larger one once the MTU of the desktop was
+// agreed on
+func grownBuffer(buf []byte) []byte {
+	if size := bufferSize(); size > len(buf) {
+		return make([]byte, size)
+	}
+	return buf
+}
+
+// truncated tells whether a packet of n bytes filled its buffer and may have
+// been cut, counting it and warning at most once a minute
+func truncated(n, size int, where string) bool {
+	if n < size {
+		return false
+	}
+	count := atomic.AddUint64(&truncatedReads, 1)
+	now := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&truncatedAt); now-last > int64(time.Minute) && atomic.CompareAndSwapInt64(&truncatedAt, last, now) {
+		fmt.Printf("%s read of %d bytes fills the buffer => dropped, %d so far, raise -mtu or -buffer-size\n", where, n, count)
+	}
+	return true
 }
 
 func runCmd(args string) string {
@@ -97,15 +227,11 @@ func rediectDns(domains []string, ip net.IP) error {
 			domain = domain[1:]
 			act = "-D"
 		} else {
-			argv := []string{"iptables", "-t", "nat", "-D", "PREROUTING", "-p", "udp", "--dport", "53",
-				"-m", "string", "--algo", "bm", "--hex-string", hexDomain(domain), "-j", "DNAT", "--to-destination", ip.String(),
-			}
-			fmt.Printf("clear dns => %v %v\n", strings.Join(argv, " "), exec.Command(argv[0], argv[1:]...).Run())
+			fmt.Printf("clear dns => %s %v\n", domain, dnsRule("-D", domain, ip))
 		}
-		argv := []string{"iptables", "-t", "nat", act, "PREROUTING", "-p", "udp", "--dport", "53",
-			"-m", "string", "--algo", "bm", "--hex-string", hexDomain(domain), "-j", "DNAT", "--to-destination", ip.String(),
+		if err := dnsRule(act, domain, ip); err != nil {
+			fmt.Printf("dns %s error => %v\n", domain, err)
 		}
-		fmt.Printf("dns command => %s %v\n", strings.Join(argv, " "), exec.Command(argv[0], argv[1:]...).Run())
 	}
 	return nil
 }
@@ -115,6 +241,17 @@ func applyControls(cmds []string, ip net.IP) {
 	if dnsSvr != nil {
 		dnsSvr.StartClear()
 	}
+	lz4 := false
+	tap := false
+	fecCount := ""
+	dedup := false
+	var beat []string
+	keepaliveVal := ""
+	var templates []string
+	dnsLog := false
+	var dnsRouteVals []string
+	nats := make(map[string]bool)
+	observed = ""
 	for _, val := range cmds {
 		vals := strings.Split(val, " ")
 		fmt.Printf("control => %s\n", val)
@@ -123,35 +260,150 @@ func applyControls(cmds []string, ip net.IP) {
 			i1 := routes[vals[1]]
 			i2 := routes[vals[2]]
 			if len(i1) > 0 && len(i2) > 0 {
-				if iptables("-C", i1, i2) != nil {
-					iptables("-I", i1, i2)
-					iptables("-I", i2, i1)
+				if forwardRule("-C", i1, i2) != nil {
+					forwardRule("-I", i1, i2)
+					forwardRule("-I", i2, i1)
 				}
 			}
 		case "disconnect":
 			i1 := routes[vals[1]]
 			i2 := routes[vals[2]]
 			if len(i1) > 0 && len(i2) > 0 {
-				iptables("-D", i1, i2)
-				iptables("-D", i2, i1)
+				forwardRule("-D", i1, i2)
+				forwardRule("-D", i2, i1)
 			}
 		case "dns":
 			rediectDns(vals[1:], ip)
+		case "mtu":
+			if len(vals) < 2 {
+				continue
+			}
+			if v, err := strconv.Atoi(vals[1]); err == nil && v != currentMTU() && tunName != "" {
+				// agree on the MTU of the desktop, the readers growing
+				// their own buffers to it
+				atomic.StoreInt32(&linkMTU, int32(v))
+				runCmd(fmt.Sprintf("ip link set dev %s mtu %d", tunName, v))
+			}
+		case "compress":
+			lz4 = len(vals) > 1 && vals[1] == "lz4"
+		case "dedup":
+			dedup = true
+		case "fec":
+			if len(vals) > 1 {
+				fecCount = vals[1]
+			}
+		case "heartbeat":
+			beat = vals[1:]
+		case "nat-keepalive":
+			if len(vals) > 1 {
+				keepaliveVal = vals[1]
+			}
+		case "mode":
+			tap = len(vals) > 1 && vals[1] == "tap"
+		case "observed":
+			if len(vals) > 1 {
+				observed = vals[1]
+			}
 		case "host":
 			if dnsSvr == nil {
 				dnsSvr = NewDnsServer()
 			}
 			dnsSvr.Add(strings.Join(vals[1:], " "))
+		case "hosts-template":
+			if len(vals) > 1 {
+				if dnsSvr == nil {
+					dnsSvr = NewDnsServer()
+				}
+				templates = append(templates, strings.Join(vals[1:], " "))
+			}
+		case "dns-log":
+			dnsLog = true
+		case "dns-route":
+			dnsRouteVals = append(dnsRouteVals, strings.Join(vals[1:], " "))
+		case "nat":
+			if _, lan, err := net.ParseCIDR(vals[len(vals)-1]); err == nil && len(vals) > 1 {
+				nats[lan.String()] = true
+			}
 		}
 	}
+	applyNAT(nats, ip)
+	setOffered(lz4)
+	setFECOffered(fecCount)
+	setDedupOffered(dedup)
+	setTAPOffered(tap)
+	setHeartbeat(beat)
+	setNATKeepalive(keepaliveVal)
+	setHostTemplates(templates)
+	setDNSRoutes(dnsLog, dnsRouteVals)
 	if dnsSvr != nil {
 		dnsSvr.EndClear()
 		dnsSvr.Start(ip)
 	}
+	refreshFastPath()
+}
+
+// readControls reads the chunks of the controls following the header in data
+// and applies them
+func readControls(conn *net.UDPConn, r io.Reader, data []byte, n int, ip net.IP) {
+	l, h := controlLength(data[:n])
+	if l < 0 {
+		fmt.Printf("invalid control header => %d bytes of type %d\n", n, data[0])
+		return
+	}
+	var buf = make([]byte, l)
+	var pos = copy(buf, data[h:n])
+	var err error
+	for pos < l {
+		if n, err = r.Read(data); err != nil {
+			fmt.Println("failed read udp msg, error: " + err.Error())
+			break
+		}
+		copy(buf[pos:], data[:n])
+		pos += n
+	}
+	if l > 0 {
+		appliedControls(conn, buf, ip)
+	}
+}
+
+// readControlChunk reassembles the chunks of the controls and applies them
+// once complete
+func readControlChunk(conn *net.UDPConn, data []byte, ip net.IP) {
+	if buf := controlChunks.Add(conn, data); len(buf) > 0 {
+		appliedControls(conn, buf, ip)
+	}
+}
+
+// appliedControls applies the controls payload and advertises the accepted
+// features right away
+func appliedControls(conn *net.UDPConn, buf []byte, ip net.IP) {
+	cmds, version, ok := versionedControls(conn, strings.Split(string(buf), ","))
+	if !ok {
+		return
+	}
+	applyControls(cmds, ip)
+	ackControls(conn, version)
+	sendHeartbeat(conn)
+	reportPath(conn)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		runHealthcheck()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bridge" {
+		runBridge()
+		return
+	}
 	flag.Parse()
+	cmdlineFlags = givenFlags(flag.CommandLine)
+	applyEnv(flag.CommandLine)
+	loadConfigFile(flag.CommandLine)
+	readSecrets(true)
+	flagHeartbeat, flagLostAfter = heartbeat, lostAfter
+	beatInterval, beatLostAfter = int32(heartbeat), int32(lostAfter)
+	linkMTU = int32(MTU)
 	if _, err := os.Stat("/dev/net"); err != nil {
 		os.Mkdir("/dev/net", os.ModePerm)
 		cmd := exec.Command("mknod", "/dev/net/tun", "c", "10", "200")
@@ -168,15 +420,13 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	config := water.Config{
-		DeviceType: water.TUN,
-	}
-	iface, err := water.New(config)
+	iface, err := openTUN()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 	fmt.Printf("interface => %v\n", iface.Name())
+	tunName = iface.Name()
 	args := fmt.Sprintf("%s link set dev %s up mtu %d qlen 100", "ip", iface.Name(), MTU)
 	argv := strings.Split(args, " ")
 	cmd := exec.Command(argv[0], argv[1:]...)
@@ -185,7 +435,16 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if bridge != "" && tapMode {
+		args = fmt.Sprintf("ip link set dev %s master %s", iface.Name(), bridge)
+		fmt.Printf("command => %s\n", args)
+		argv = strings.Split(args, " ")
+		if err := exec.Command(argv[0], argv[1:]...).Run(); err != nil {
+			fmt.Printf("failed to join bridge %s => %v\n", bridge, err)
+		}
+	}
 	ip, subnet, _ := net.ParseCIDR(addr)
+	tunnelIP = ip.To4()
 	peer := net.IP(make([]byte, 4))
 	copy([]byte(peer), []byte(ip.To4()))
 	peer[3]++
@@ -207,75 +466,200 @@ func main() {
 		fmt.Printf("invalid command => %s\n", args)
 		os.Exit(1)
 	}
+	go watchProxyARP(peer)
+	resolveWSL()
 	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
 	if err != nil {
 		fmt.Printf("invalid address => %s:%d\n", host, port)
 		os.Exit(1)
 	}
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		fmt.Printf("failed to dial %s:%d => %s\n", host, port, err.Error())
-		os.Exit(1)
+	var laddr *net.UDPAddr
+	if rendezvous != "" {
+		if udpAddr, laddr, err = rendezvousTunnel(); err != nil {
+			fmt.Printf("rendezvous %s => %v\n", rendezvous, err)
+			os.Exit(1)
+		}
+	}
+	conn := openGroup(laddr, udpAddr, iface)
+	if conn == nil {
+		if conn, err = dialUDP(laddr, udpAddr); err != nil {
+			fmt.Printf("failed to dial %s:%d => %s\n", host, port, err.Error())
+			os.Exit(1)
+		}
 	}
 	defer conn.Close()
 	fmt.Printf("local => %s\n", conn.LocalAddr())
-	fmt.Printf("remote => %s\n", conn.RemoteAddr())
-	conn.Write([]byte{0})
+	fmt.Printf("remote => %s\n", remoteAddr(conn))
+	markConn(conn)
+	writer = startWriter(conn)
+	startFastPath(conn, iface)
+	if t, ok := iface.(*tapDevice); ok {
+		t.conn = conn
+	}
+	ctl := dialControl(conn)
+	dnsLogConn = ctl
+	if ctl != conn {
+		defer ctl.Close()
+		go readControl(ctl, ip)
+	}
+	loadSession()
+	loadIdentity()
+	dialKnock()
+	knock()
+	sendHeartbeat(ctl)
+	go watchRoutes(ctl)
+	go watchKube(ctl)
+	go watchNetworks(ctl)
+	go watchTemplates(ctl, ip)
+	go watchCompose(ctl, ip)
+	go watchMDNS(ctl)
+	go watchPublish(ctl)
+	go watchConfig(conn, ctl)
+	go watchResolve(conn, ctl)
+	go reportHealth()
 	requested := make(chan bool, 1)
+	for i := 1; i < len(group); i++ {
+		go readGroup(i, iface, requested)
+	}
 	go func() {
-		buf := make([]byte, 2000)
+		buf := make([]byte, bufferSize())
+		supervise("tun reader", func() {
+			for {
+				buf = grownBuffer(buf)
+				n, err := iface.Read(buf)
+				if err != nil {
+					fmt.Printf("tun read error: %v\n", err)
+					continue
+				}
+				if truncated(n, len(buf), "tun") {
+					continue
+				}
+				capturePacket(buf[:n])
+				if err := writePacket(conn, buf[:n]); err != nil {
+					fmt.Printf("udp write error: %v\n", err)
+					resolveSoon()
+				}
+				requested <- true
+			}
+		})
+	}()
+	go keepalive(ctl, requested)
+	go watchNATKeepalive(conn, ctl)
+	data := make([]byte, bufferSize())
+	plain := make([]byte, bufferSize())
+	reader := newBatchReader(conn, bufferSize())
+	supervise("udp reader", func() {
 		for {
-			n, err := iface.Read(buf)
+			if reader.Buffered() == 0 {
+				flushTUN(iface)
+			}
+			if size := bufferSize(); size > len(data) {
+				data, plain = make([]byte, size), make([]byte, size)
+				reader.Grow(size)
+			}
+			n, err := reader.Read(data)
 			if err != nil {
-				fmt.Printf("tun read error: %v\n", err)
+				fmt.Println("failed read udp msg, error: " + err.Error())
+				markLost(err.Error())
 				continue
 			}
-			if _, err := conn.Write(buf[:n]); err != nil {
-				fmt.Printf("udp write error: %v\n", err)
+			if n > 0 && (data[0]>>4 == 4 || data[0]>>4 == 6) && truncated(n, len(data), "udp") {
+				continue
 			}
-			requested <- true
-		}
-	}()
-	go func() {
-		duration := time.Duration(time.Millisecond * time.Duration(heartbeat))
-		for {
-			select {
-			case <-requested:
+			if n > 0 && data[0] >= rendezvousRegister || n == 1 && data[0] == keepaliveType {
+				// punches and addresses of the rendezvous once connected,
+				// keepalives of the NAT
 				continue
-			case <-time.After(duration):
-				conn.Write([]byte{0})
 			}
-		}
-	}()
-	data := make([]byte, 2000)
-	for {
-		n, err := conn.Read(data)
-		if err != nil {
-			fmt.Println("failed read udp msg, error: " + err.Error())
-		}
-		if _, err := iface.Write(data[:n]); err != nil {
-			if data[0] == 1 {
-				var l int = 0
-				l += int(data[1]) << 8
-				l += int(data[2])
-				var buf = make([]byte, l)
-				var pos = n - 3
-				copy(buf, data[3:n])
-				for pos < l {
-					if n, err = conn.Read(data); err != nil {
-						fmt.Println("failed read udp msg, error: " + err.Error())
-						break
+			received(conn)
+			if n > 0 && data[0] == 0 {
+				handleHeartbeat(data[:n])
+				requested <- true
+				continue
+			}
+			if (n == 1 || n == 2) && data[0] == sessionRequest {
+				// the desktop sees us from an unknown address
+				requestedSession(conn, data[1:n])
+				requested <- true
+				continue
+			}
+			if n > 0 && data[0] == diagCommand {
+				go handleDiag(conn, string(data[1:n]))
+				requested <- true
+				continue
+			}
+			if n > 1 && data[0] == benchType {
+				handleBench(conn, data[:n])
+				requested <- true
+				continue
+			}
+			if n > 1 && data[0] == socksDial {
+				go handleSocksDial(append([]byte(nil), data[:n]...))
+				requested <- true
+				continue
+			}
+			if n > 1 && data[0] == socksUDP {
+				go handleSocksUDP(conn, append([]byte(nil), data[:n]...))
+				requested <- true
+				continue
+			}
+			if data[0] == controlChunk {
+				readControlChunk(conn, data[:n], ip)
+				requested <- true
+				continue
+			}
+			if data[0] == seqType {
+				datagram := unframe(data[:n])
+				if datagram == nil {
+					continue
+				}
+				n = copy(data, datagram)
+			}
+			if data[0] == fecType {
+				datagram := fecIn.Receive(data[:n])
+				if datagram == nil {
+					continue
+				}
+				n = copy(data, datagram)
+			}
+			if data[0] == fragType {
+				packet := reassemble(data[:n])
+				if packet == nil || len(packet) > len(data) {
+					continue
+				}
+				n = copy(data, packet)
+			}
+			if data[0] == compressType && n > 1 {
+				m, err := decompressPacket(data[:n], plain)
+				if err != nil {
+					fmt.Printf("decompress error: %v\n", err)
+					continue
+				}
+				n = copy(data, plain[:m])
+			}
+			if data[0] == tapType && n > 1 {
+				if t, ok := iface.(*tapDevice); ok {
+					if err := t.WriteFrame(data[1:n]); err != nil {
+						fmt.Printf("tap write error: %v\n", err)
 					}
-					copy(buf[pos:], data[:n])
-					pos += n
 				}
-				if l > 0 {
-					applyControls(strings.Split(string(buf), ","), ip)
+				requested <- true
+				continue
+			}
+			if reply := pingReply(data[:n]); reply != nil {
+				sendDatagram(conn, reply)
+				requested <- true
+				continue
+			}
+			capturePacket(data[:n])
+			if _, err := iface.Write(data[:n]); err != nil {
+				if data[0] == 1 || data[0] == controlsType {
+					readControls(conn, reader, data, n, ip)
+				} else {
+					fmt.Printf("tun write error: %v\n", err)
 				}
-			} else {
-				fmt.Printf("tun write error: %v\n", err)
 			}
+			requested <- true
 		}
-		requested <- true
-	}
+	})
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With `-mdns` the agent pushes the services of the containers labeled
+// `desktop-connector.mdns=<type>:<port>[,...]`, e.g. `_http._tcp:8080`, named
+// after `desktop-connector.mdns.name` or else the container, to the desktop as
+// `mdns <type> <ip:port> <name>`, and `mdns <type> <ip:port>` once gone. The
+// desktop with `mdns on` advertises them on its LAN.
+const (
+	mdnsLabel     = "desktop-connector.mdns"
+	mdnsNameLabel = "desktop-connector.mdns.name"
+)
+
+var mdns = false
+
+type mdnsContainer struct {
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// address returns the address of a container on its first network by name
+// with one
+func (c *mdnsContainer) address() net.IP {
+	var networks []string
+	for n := range c.NetworkSettings.Networks {
+		networks = append(networks, n)
+	}
+	sort.Strings(networks)
+	for _, n := range networks {
+		if ip := net.ParseIP(c.NetworkSettings.Networks[n].IPAddress).To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// mdnsServices returns the names of the services of the labeled containers by
+// `<type> <ip:port>`
+func mdnsServices() (map[string]string, error) {
+	filters := fmt.Sprintf(`{"label":["%s"]}`, mdnsLabel)
+	body, err := dockerGet("/containers/json?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return nil, err
+	}
+	var containers []mdnsContainer
+	err = json.NewDecoder(body).Decode(&containers)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]string)
+	for _, c := range containers {
+		name := c.Labels[mdnsNameLabel]
+		if name == "" && len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		ip := c.address()
+		if ip == nil || name == "" {
+			continue
+		}
+		for _, svc := range strings.Split(c.Labels[mdnsLabel], ",") {
+			i := strings.LastIndex(svc, ":")
+			if i < 0 {
+				fmt.Printf("mdns %s => invalid service %s\n", name, svc)
+				continue
+			}
+			typ := strings.TrimSpace(svc[:i])
+			port, err := strconv.Atoi(strings.TrimSpace(svc[i+1:]))
+			if err != nil || port <= 0 || port > 65535 || !strings.HasPrefix(typ, "_") ||
+				!(strings.HasSuffix(typ, "._tcp") || strings.HasSuffix(typ, "._udp")) {
+				fmt.Printf("mdns %s => invalid service %s\n", name, svc)
+				continue
+			}
+			services[typ+" "+net.JoinHostPort(ip.String(), strconv.Itoa(port))] = name
+		}
+	}
+	return services, nil
+}
+
+// watchMDNS pushes the labeled services to the desktop
+func watchMDNS(conn *net.UDPConn) {
+	known := make(map[string]string)
+	for i := 0; ; i++ {
+		current := make(map[string]string)
+		var err error
+		if mdns {
+			current, err = mdnsServices()
+		}
+		if err != nil {
+			fmt.Printf("mdns error => %v\n", err)
+			time.Sleep(pushInterval)
+			continue
+		}
+		for key, name := range current {
+			if known[key] != name || i%pushRepeat == 0 {
+				sendRoute(conn, "mdns "+key+" "+name)
+			}
+		}
+		for key := range known {
+			if _, ok := current[key]; !ok {
+				sendRoute(conn, "mdns "+key)
+			}
+		}
+		known = current
+		time.Sleep(pushInterval)
+	}
+}
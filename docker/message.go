@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The controls sent by the desktop start with the header
+//
+//	9 | length(4)
+//
+// in network byte order, followed by the payload in the same datagram or in
+// the next ones, once featureControls is advertised. Older desktops, and the
+// desktops talking to agents built before it, send the legacy
+// `1 | length(2)` header.
+//
+// Those unframed continuations are taken for the controls whatever they are,
+// so a lost one mixes the next packets in. Advertising featureChunks, the
+// agent gets the controls in self-described chunks instead
+//
+//	17 | id(4) | length(4) | offset(4) | part
+//
+// reassembled in any order, those of another id dropping an incomplete
+// payload. A payload still incomplete after controlChunkTimeout is requested
+// again.
+const (
+	controlsType   = 9
+	controlsHeader = 5
+	// controlsMax bounds the payload a header may announce
+	controlsMax = 16 << 20
+
+	controlChunk        = 17
+	controlChunkHeader  = 13
+	featureChunks       = 16
+	featureControls     = 128
+	controlChunkTimeout = 2 * time.Second
+)
+
+// chunkAssembly is the payload of the controls being reassembled
+type chunkAssembly struct {
+	sync.Mutex
+	id    uint32
+	buf   []byte
+	parts map[uint32]bool
+	got   int
+}
+
+var controlChunks = &chunkAssembly{}
+
+// controlLength returns the length of the controls payload and the size of
+// the header starting data, or -1 for a truncated or oversized header
+func controlLength(data []byte) (int, int) {
+	switch {
+	case data[0] == controlsType && len(data) >= controlsHeader:
+		l := binary.BigEndian.Uint32(data[1:])
+		if l > controlsMax {
+			return -1, 0
+		}
+		return int(l), controlsHeader
+	case data[0] == 1 && len(data) >= 3:
+		return int(binary.BigEndian.Uint16(data[1:])), 3
+	}
+	return -1, 0
+}
+
+// Add records a chunk, it returns the payload once complete
+func (a *chunkAssembly) Add(conn *net.UDPConn, data []byte) []byte {
+	if len(data) < controlChunkHeader {
+		return nil
+	}
+	id := binary.BigEndian.Uint32(data[1:])
+	l := binary.BigEndian.Uint32(data[5:])
+	off := binary.BigEndian.Uint32(data[9:])
+	part := data[controlChunkHeader:]
+	if l > controlsMax || uint64(off)+uint64(len(part)) > uint64(l) {
+		fmt.Printf("invalid control chunk => id %d length %d offset %d\n", id, l, off)
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.buf == nil || a.id != id || len(a.buf) != int(l) {
+		if a.buf != nil && a.got < len(a.buf) {
+			fmt.Printf("controls %d dropped => %d of %d bytes\n", a.id, a.got, len(a.buf))
+		}
+		a.id, a.buf, a.parts, a.got = id, make([]byte, l), make(map[uint32]bool), 0
+		time.AfterFunc(controlChunkTimeout, func() {
+			a.Lock()
+			defer a.Unlock()
+			if a.id == id && a.buf != nil && a.got < len(a.buf) {
+				fmt.Printf("controls %d incomplete => %d of %d bytes, resync\n", id, a.got, len(a.buf))
+				a.buf = nil
+				writeUDP(conn, []byte{resyncRequest})
+			}
+		})
+	}
+	if a.got == len(a.buf) || a.parts[off] {
+		return nil
+	}
+	a.parts[off] = true
+	a.got += copy(a.buf[off:], part)
+	if a.got < len(a.buf) {
+		return nil
+	}
+	return a.buf
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// natRoutes are the LANs of the desktop reached through its NAT, pushed as
+// `nat <subnet>` in the controls. They are routed to the desktop through the
+// tunnel and masqueraded to the address of the agent there, so the desktop
+// only has to NAT its virtual network whatever the network of the container.
+var natRoutes = make(map[string]bool)
+
+// applyNAT routes the LANs of the controls and removes the others
+func applyNAT(lans map[string]bool, ip net.IP) {
+	if tunName == "" {
+		return
+	}
+	peer := append(net.IP(nil), ip.To4()...)
+	peer[3]++
+	for lan := range lans {
+		if natRoutes[lan] {
+			continue
+		}
+		fmt.Printf("nat => %s via %s\n", lan, peer)
+		runCmd(fmt.Sprintf("ip route replace %s via %s dev %s", lan, peer, tunName))
+		if err := masqueradeRule("-A", "0.0.0.0/0", lan); err != nil {
+			fmt.Printf("nat %s error => %v\n", lan, err)
+		}
+	}
+	for lan := range natRoutes {
+		if lans[lan] {
+			continue
+		}
+		fmt.Printf("nat removed => %s\n", lan)
+		runCmd(fmt.Sprintf("ip route del %s via %s dev %s", lan, peer, tunName))
+		masqueradeRule("-D", "0.0.0.0/0", lan)
+	}
+	natRoutes = lans
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The desktop pushes `nat-keepalive <ms>` with its `nat-keepalive`: every
+// interval each socket to it, the data one unless it carried a datagram
+// meanwhile and the control one, sends a one byte keepalive, so the NATs on
+// the way keep the mappings of quiet tunnels, independently of the heartbeats.
+// The keepalives of the desktop are dropped, which featureKeepalive tells it.
+const (
+	keepaliveType    = 18
+	featureKeepalive = 32
+)
+
+var (
+	// natKeepalive is the interval in milliseconds, 0 without
+	natKeepalive int64
+	// dataWrites counts the datagrams written to the data socket
+	dataWrites uint64
+)
+
+// setNATKeepalive applies the interval pushed by the desktop
+func setNATKeepalive(val string) {
+	ms, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || ms < 1000 {
+		ms = 0
+	}
+	if atomic.SwapInt64(&natKeepalive, ms) != ms {
+		fmt.Printf("nat keepalive => %dms\n", ms)
+	}
+}
+
+// watchNATKeepalive sends the keepalives on the sockets to the desktop
+func watchNATKeepalive(conn, ctl *net.UDPConn) {
+	var writes uint64
+	for {
+		d := time.Duration(atomic.LoadInt64(&natKeepalive)) * time.Millisecond
+		if d <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(d)
+		w := atomic.LoadUint64(&dataWrites)
+		if w == writes {
+			writeUDP(conn, []byte{keepaliveType})
+		}
+		writes = w
+		if ctl != conn {
+			writeUDP(ctl, []byte{keepaliveType})
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// With `-join-networks` the agent, attached to the default bridge rather than
+// to the host network, joins the user-defined bridge networks itself through
+// the docker socket, `all` of them or the ones named, e.g.
+// `-join-networks app,db`, instead of `docker network connect` for each. The
+// subnet of a joined network is pushed to the desktop as `connect <subnet>`
+// and masqueraded from the virtual network, so its containers answer through
+// the agent, then `disconnect <subnet>` is pushed once the network is removed.
+const joinAll = "all"
+
+var joinNetworks = ""
+
+type dockerNetwork struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Driver string `json:"Driver"`
+	IPAM   struct {
+		Config []struct {
+			Subnet string `json:"Subnet"`
+		} `json:"Config"`
+	} `json:"IPAM"`
+}
+
+type selfContainer struct {
+	ID         string `json:"Id"`
+	HostConfig struct {
+		NetworkMode string `json:"NetworkMode"`
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			NetworkID string `json:"NetworkID"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// errHostNetwork tells the agent shares the network of the host, which sees
+// every network already
+var errHostNetwork = errors.New("running with --net host, every network is reachable already")
+
+// dockerPost calls the docker API on the socket with a JSON body
+func dockerPost(path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	rsp, err := dockerClient.Post("http://docker"+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s => %s", path, rsp.Status)
+	}
+	return nil
+}
+
+// joinedNetworks joins the wanted networks and returns their subnets with
+// their names
+func joinedNetworks(id string, wanted map[string]bool) (map[string]string, error) {
+	body, err := dockerGet("/containers/" + id + "/json")
+	if err != nil {
+		return nil, err
+	}
+	var self selfContainer
+	err = json.NewDecoder(body).Decode(&self)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if self.HostConfig.NetworkMode == "host" {
+		return nil, errHostNetwork
+	}
+	joined := make(map[string]bool)
+	for _, n := range self.NetworkSettings.Networks {
+		joined[n.NetworkID] = true
+	}
+	if body, err = dockerGet("/networks"); err != nil {
+		return nil, err
+	}
+	var networks []dockerNetwork
+	err = json.NewDecoder(body).Decode(&networks)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	subnets := make(map[string]string)
+	for _, n := range networks {
+		if n.Driver != "bridge" || n.Name == "bridge" || !(wanted[joinAll] || wanted[n.Name]) {
+			continue
+		}
+		subnet := ""
+		for _, c := range n.IPAM.Config {
+			if subnet = firstIPv4(c.Subnet); subnet != "" {
+				break
+			}
+		}
+		if subnet == "" {
+			continue
+		}
+		if !joined[n.ID] {
+			fmt.Printf("join network %s => %s\n", n.Name, subnet)
+			if err := dockerPost("/networks/"+n.ID+"/connect", map[string]string{"Container": self.ID}); err != nil {
+				fmt.Printf("join network %s error => %v\n", n.Name, err)
+				continue
+			}
+		}
+		subnets[subnet] = n.Name
+	}
+	return subnets, nil
+}
+
+// masquerade adds or deletes the masquerading of the virtual network towards
+// a joined network
+func masquerade(act, subnet string) {
+	_, local, err := net.ParseCIDR(addr)
+	if err != nil {
+		return
+	}
+	if err := masqueradeRule(act, local.String(), subnet); err != nil {
+		fmt.Printf("masquerade %s error => %v\n", subnet, err)
+	}
+}
+
+// watchNetworks joins the networks of `-join-networks` and pushes them to the
+// desktop
+func watchNetworks(conn *net.UDPConn) {
+	id, err := os.Hostname()
+	if err != nil {
+		fmt.Printf("join networks error => %v\n", err)
+		return
+	}
+	known := make(map[string]string)
+	for i := 0; ; i++ {
+		wanted := make(map[string]bool)
+		for _, name := range strings.Split(joinNetworks, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				wanted[name] = true
+			}
+		}
+		current := make(map[string]string)
+		var err error
+		if len(wanted) > 0 {
+			current, err = joinedNetworks(id, wanted)
+		}
+		if err == errHostNetwork {
+			fmt.Printf("join networks => %v\n", err)
+			return
+		}
+		if err != nil {
+			fmt.Printf("join networks error => %v\n", err)
+			time.Sleep(pushInterval)
+			continue
+		}
+		for subnet := range current {
+			if _, ok := known[subnet]; !ok {
+				masquerade("-A", subnet)
+			} else if i%pushRepeat != 0 {
+				continue
+			}
+			sendRoute(conn, "connect "+subnet)
+		}
+		for subnet, name := range known {
+			if _, ok := current[subnet]; !ok {
+				fmt.Printf("network %s removed => %s\n", name, subnet)
+				masquerade("-D", subnet)
+				sendRoute(conn, "disconnect "+subnet)
+			}
+		}
+		known = current
+		time.Sleep(pushInterval)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/songgao/water"
+)
+
+// With `-offload`, the TUN of the container exchanges packets prefixed with a
+// virtio_net_hdr: the kernel hands out TCP segments of up to 64KB (TSO) that
+// are split into packets of the MTU before the tunnel, and the consecutive TCP
+// segments from the desktop are coalesced before being written (GRO). A bulk
+// transfer then costs a TUN syscall per 64KB rather than per packet.
+const (
+	virtioHdrLen    = 10
+	virtioNeedsCsum = 1
+	gsoNone         = 0
+	gsoTCPv4        = 1
+	gsoTCPv6        = 4
+	gsoECN          = 0x80
+	// groFlows bounds the flows being coalesced at once
+	groFlows = 16
+	maxIPLen = 65535
+)
+
+var offload = false
+
+// tunDevice is the TUN of the container
+type tunDevice interface {
+	io.ReadWriter
+	Name() string
+}
+
+// openTUN creates the TUN, with offloads if enabled and supported
+func openTUN() (tunDevice, error) {
+	if tapMode {
+		iface, err := water.New(water.Config{DeviceType: water.TAP})
+		if err != nil {
+			return nil, err
+		}
+		return &tapDevice{dev: iface}, nil
+	}
+	if offload {
+		t, err := openOffload()
+		if err == nil {
+			fmt.Printf("offload => tso, gro\n")
+			return t, nil
+		}
+		fmt.Printf("offload unavailable => %v\n", err)
+	}
+	iface, err := water.New(water.Config{DeviceType: water.TUN})
+	if err != nil {
+		return nil, err
+	}
+	return iface, nil
+}
+
+// flushTUN writes the segments being coalesced, it is called by the UDP loop
+// once no datagram is pending
+func flushTUN(iface tunDevice) {
+	if t, ok := iface.(*offloadTUN); ok {
+		t.Flush()
+	}
+}
+
+// virtioHdr is the struct virtio_net_hdr, in native (little endian) order
+type virtioHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+func (h *virtioHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// groFlow is a TCP segment being coalesced, prefixed with its virtio header
+type groFlow struct {
+	buf      []byte
+	iphLen   int
+	tcphLen  int
+	gsoSize  int
+	segments int
+	nextSeq  uint32
+	closed   bool
+}
+
+// offloadTUN is a TUN with a virtio header. Read is called by the TUN reader
+// only, Write and Flush by the UDP loop only.
+type offloadTUN struct {
+	file *os.File
+	name string
+	// read side: the last packet read and its segments
+	rbuf []byte
+	segs []byte
+	offs []int
+	next int
+	// write side: the flows being coalesced
+	wbuf  []byte
+	flows []*groFlow
+	free  []*groFlow
+}
+
+func newOffloadTUN(file *os.File, name string) *offloadTUN {
+	return &offloadTUN{
+		file: file,
+		name: name,
+		rbuf: make([]byte, virtioHdrLen+maxIPLen),
+		segs: make([]byte, 0, 2*maxIPLen),
+		wbuf: make([]byte, virtioHdrLen+maxIPLen),
+	}
+}
+
+func (t *offloadTUN) Name() string {
+	return t.name
+}
+
+// Read returns the next packet, splitting the TCP segments read from the TUN
+func (t *offloadTUN) Read(b []byte) (int, error) {
+	for t.next >= len(t.offs)-1 {
+		n, err := t.file.Read(t.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		if n <= virtioHdrLen {
+			continue
+		}
+		if err := t.split(t.rbuf[:n]); err != nil {
+			fmt.Printf("offload read error => %v\n", err)
+		}
+	}
+	i := t.next
+	t.next++
+	return copy(b, t.segs[t.offs[i]:t.offs[i+1]]), nil
+}
+
+// split turns a packet read from the TUN into packets with their checksums
+func (t *offloadTUN) split(raw []byte) error {
+	var h virtioHdr
+	h.decode(raw)
+	pkt := raw[virtioHdrLen:]
+	t.segs, t.offs, t.next = t.segs[:0], append(t.offs[:0], 0), 0
+	switch h.gsoType &^ gsoECN {
+	case gsoNone:
+		if h.flags&virtioNeedsCsum != 0 {
+			start, field := int(h.csumStart), int(h.csumStart)+int(h.csumOffset)
+			if field+2 > len(pkt) {
+				return fmt.Errorf("checksum at %d beyond %d bytes", field, len(pkt))
+			}
+			binary.BigEndian.PutUint16(pkt[field:], ^fold(checksum(pkt[start:], 0)))
+		}
+		t.segs = append(t.segs, pkt...)
+		t.offs = append(t.offs, len(t.segs))
+		return nil
+	case gsoTCPv4, gsoTCPv6:
+		return t.segment(pkt, int(h.csumStart), int(h.gsoSize))
+	}
+	return fmt.Errorf("unsupported gso type %d", h.gsoType)
+}
+
+// segment splits a TCP segment into segments of gsoSize bytes of payload
+func (t *offloadTUN) segment(pkt []byte, iphLen int, gsoSize int) error {
+	if iphLen < 20 || len(pkt) < iphLen+20 || gsoSize == 0 {
+		return fmt.Errorf("invalid tcp segment of %d bytes", len(pkt))
+	}
+	tcphLen := int(pkt[iphLen+12]>>4) * 4
+	hdrLen := iphLen + tcphLen
+	if tcphLen < 20 || len(pkt) < hdrLen {
+		return fmt.Errorf("invalid tcp header of %d bytes", tcphLen)
+	}
+	v4 := pkt[0]>>4 == 4
+	id := binary.BigEndian.Uint16(pkt[4:])
+	seq := binary.BigEndian.Uint32(pkt[iphLen+4:])
+	flags := pkt[iphLen+13]
+	for at := hdrLen; at < len(pkt); {
+		end := at + gsoSize
+		if end > len(pkt) {
+			end = len(pkt)
+		}
+		start := len(t.segs)
+		t.segs = append(t.segs, pkt[:hdrLen]...)
+		t.segs = append(t.segs, pkt[at:end]...)
+		seg := t.segs[start:]
+		if v4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], id)
+			id++
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:], ^fold(checksum(seg[:iphLen], 0)))
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-40))
+		}
+		tcp := seg[iphLen:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(at-hdrLen))
+		if end < len(pkt) {
+			// FIN and PSH only on the last segment
+			tcp[13] = flags &^ 0x09
+		}
+		tcp[16], tcp[17] = 0, 0
+		binary.BigEndian.PutUint16(tcp[16:], ^fold(checksum(tcp, pseudoSum(seg, len(tcp)))))
+		t.offs = append(t.offs, len(t.segs))
+		at = end
+	}
+	return nil
+}
+
+// Write coalesces the TCP segments following each other, the other packets
+// are written right away after the coalesced ones
+func (t *offloadTUN) Write(b []byte) (int, error) {
+	if t.coalesce(b) {
+		return len(b), nil
+	}
+	t.Flush()
+	return t.write(b)
+}
+
+// write writes a packet without offload
+func (t *offloadTUN) write(b []byte) (int, error) {
+	if len(b) > maxIPLen {
+		return 0, fmt.Errorf("packet of %d bytes too large", len(b))
+	}
+	var h virtioHdr
+	h.encode(t.wbuf)
+	n := copy(t.wbuf[virtioHdrLen:], b)
+	if _, err := t.file.Write(t.wbuf[:virtioHdrLen+n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// tcpSegment returns the header lengths of a TCP segment that can be
+// coalesced: no IP options nor fragments, only ACK and PSH set, and a payload
+func tcpSegment(b []byte) (int, int, bool) {
+	var iphLen int
+	switch {
+	case len(b) >= 40 && b[0] == 0x45 && b[9] == 6:
+		if int(binary.BigEndian.Uint16(b[2:])) != len(b) || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return 0, 0, false
+		}
+		iphLen = 20
+	case len(b) >= 60 && b[0]>>4 == 6 && b[6] == 6:
+		if int(binary.BigEndian.Uint16(b[4:]))+40 != len(b) {
+			return 0, 0, false
+		}
+		iphLen = 40
+	default:
+		return 0, 0, false
+	}
+	tcphLen := int(b[iphLen+12]>>4) * 4
+	if tcphLen < 20 || len(b) <= iphLen+tcphLen || b[iphLen+13]&^0x08 != 0x10 {
+		return 0, 0, false
+	}
+	return iphLen, tcphLen, true
+}
+
+// sameConn tells whether the segments have the same addresses and ports
+func sameConn(a []byte, b []byte, iphLen int) bool {
+	if iphLen == 20 {
+		return string(a[12:20]) == string(b[12:20]) && string(a[20:24]) == string(b[20:24])
+	}
+	return string(a[8:44]) == string(b[8:44])
+}
+
+// sameHeaders tells whether the segments of a connection can be coalesced:
+// same ACK, window, TCP options and IP fields
+func sameHeaders(a []byte, b []byte, iphLen int, tcphLen int) bool {
+	if iphLen == 20 {
+		if a[1] != b[1] || a[6]&0x40 != b[6]&0x40 || a[8] != b[8] {
+			return false
+		}
+	} else if string(a[:4]) != string(b[:4]) || a[7] != b[7] {
+		return false
+	}
+	ta, tb := a[iphLen:], b[iphLen:]
+	return int(ta[12]>>4)*4 == tcphLen && string(ta[8:12]) == string(tb[8:12]) &&
+		string(ta[14:16]) == string(tb[14:16]) && string(ta[20:tcphLen]) == string(tb[20:tcphLen])
+}
+
+func (t *offloadTUN) coalesce(b []byte) bool {
+	iphLen, tcphLen, ok := tcpSegment(b)
+	if !ok {
+		return false
+	}
+	hdrLen := iphLen + tcphLen
+	payload := len(b) - hdrLen
+	seq := binary.BigEndian.Uint32(b[iphLen+4:])
+	psh := b[iphLen+13]&0x08 != 0
+	for i, f := range t.flows {
+		pkt := f.buf[virtioHdrLen:]
+		if f.iphLen != iphLen || !sameConn(pkt, b, iphLen) {
+			continue
+		}
+		if !f.closed && seq == f.nextSeq && payload <= f.gsoSize && len(pkt)+payload <= maxIPLen &&
+			sameHeaders(pkt, b, iphLen, tcphLen) {
+			f.buf = append(f.buf, b[hdrLen:]...)
+			f.nextSeq += uint32(payload)
+			f.segments++
+			if psh {
+				f.buf[virtioHdrLen+iphLen+13] |= 0x08
+			}
+			f.closed = psh || payload < f.gsoSize
+			return true
+		}
+		// keep the order of the connection
+		t.flush(f)
+		t.flows = append(t.flows[:i], t.flows[i+1:]...)
+		break
+	}
+	if len(t.flows) >= groFlows {
+		t.Flush()
+	}
+	var f *groFlow
+	if n := len(t.free); n > 0 {
+		f, t.free = t.free[n-1], t.free[:n-1]
+	} else {
+		f = &groFlow{buf: make([]byte, 0, virtioHdrLen+maxIPLen)}
+	}
+	f.buf = f.buf[:virtioHdrLen]
+	for i := range f.buf {
+		f.buf[i] = 0
+	}
+	f.buf = append(f.buf, b...)
+	f.iphLen, f.tcphLen, f.gsoSize, f.segments = iphLen, tcphLen, payload, 1
+	f.nextSeq = seq + uint32(payload)
+	f.closed = psh
+	t.flows = append(t.flows, f)
+	return true
+}
+
+// Flush writes the coalesced segments
+func (t *offloadTUN) Flush() {
+	for _, f := range t.flows {
+		t.flush(f)
+	}
+	t.flows = t.flows[:0]
+}
+
+func (t *offloadTUN) flush(f *groFlow) {
+	defer func() { t.free = append(t.free, f) }()
+	pkt := f.buf[virtioHdrLen:]
+	var h virtioHdr
+	if f.segments > 1 {
+		tcp := pkt[f.iphLen:]
+		if f.iphLen == 20 {
+			binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+			pkt[10], pkt[11] = 0, 0
+			binary.BigEndian.PutUint16(pkt[10:], ^fold(checksum(pkt[:20], 0)))
+			h.gsoType = gsoTCPv4
+		} else {
+			binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+			h.gsoType = gsoTCPv6
+		}
+		// the kernel completes the checksum from the pseudo header one
+		binary.BigEndian.PutUint16(tcp[16:], fold(pseudoSum(pkt, len(tcp))))
+		h.flags = virtioNeedsCsum
+		h.hdrLen = uint16(f.iphLen + f.tcphLen)
+		h.gsoSize = uint16(f.gsoSize)
+		h.csumStart = uint16(f.iphLen)
+		h.csumOffset = 16
+	}
+	h.encode(f.buf)
+	if _, err := t.file.Write(f.buf); err != nil {
+		fmt.Printf("tun write error: %v\n", err)
+	}
+}
+
+// checksum adds the 16 bits words of b to sum
+func checksum(b []byte, sum uint32) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// pseudoSum is the sum of the pseudo header of a TCP segment of l bytes
+func pseudoSum(pkt []byte, l int) uint32 {
+	if pkt[0]>>4 == 4 {
+		return checksum(pkt[12:20], 6+uint32(l))
+	}
+	return checksum(pkt[8:40], 6+uint32(l))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+)
+
+// openOffload creates a TUN with a virtio header and TCP offloads
+func openOffload() (*offloadTUN, error) {
+	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	req.flags = syscall.IFF_TUN | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR
+	if err := ioctl(fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := ioctl(fd, syscall.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	name := strings.Trim(string(req.name[:]), "\x00")
+	return newOffloadTUN(os.NewFile(uintptr(fd), "tun"), name), nil
+}
+
+func ioctl(fd int, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, arg); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func openOffload() (*offloadTUN, error) {
+	return nil, fmt.Errorf("tun offloads only supported on linux")
+}
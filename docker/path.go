@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// pathReport tells the desktop the addresses of our view of the path, after
+// it told us the address our packets arrive from, so it can spot NATs and
+// asymmetric paths. Desktops without the check don't send `observed`.
+const pathReport = 8
+
+var observed string
+
+func reportPath(conn *net.UDPConn) {
+	if observed == "" {
+		return
+	}
+	local := conn.LocalAddr().String()
+	if observed != local {
+		fmt.Printf("path => local %s, observed by the desktop as %s\n", local, observed)
+	}
+	writeUDP(conn, []byte(fmt.Sprintf("%clocal=%s remote=%s", pathReport, local, remoteAddr(conn))))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// The pings of the desktop to the tunnel address of the agent are answered
+// right in the UDP reader, not written to the TUN, so a ping from the desktop
+// checks the tunnel even when the firewall of the container or the host
+// filters the traffic of the TUN. `-ping-responder=false` leaves them to the
+// stack.
+var (
+	pingResponder = true
+	// tunnelIP is the address of the TUN
+	tunnelIP net.IP
+)
+
+// pingReply returns the echo reply of a ping to the tunnel address, nil for
+// the other packets
+func pingReply(packet []byte) []byte {
+	if !pingResponder || tunnelIP == nil || len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 1 {
+		return nil
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if ihl < 20 || total > len(packet) || total < ihl+8 || packet[ihl] != 8 || !net.IP(packet[16:20]).Equal(tunnelIP) {
+		return nil
+	}
+	// fragments but the first can't be answered
+	if binary.BigEndian.Uint16(packet[6:])&0x1fff != 0 {
+		return nil
+	}
+	reply := make([]byte, 20+total-ihl)
+	ip := reply[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(reply)))
+	ip[8] = 64
+	ip[9] = 1
+	copy(ip[12:16], packet[16:20])
+	copy(ip[16:20], packet[12:16])
+	binary.BigEndian.PutUint16(ip[10:], ^fold(checksum(ip, 0)))
+	body := reply[20:]
+	copy(body, packet[ihl:total])
+	body[0], body[2], body[3] = 0, 0, 0
+	binary.BigEndian.PutUint16(body[2:], ^fold(checksum(body, 0)))
+	return reply
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// In a Podman machine the agent runs as a systemd unit of the VM, see
+// podman/desktop-connector.service, the same protocol reaching the desktop
+// through 192.168.127.254, the address of its loopback in the network of
+// gvproxy. The containers are on the bridges of netavark, podman0 and
+// podman1..., or of CNI, cni-podman0..., and the networks are also read from
+// their configs, `-podman-networks` and `-cni-config` mounted from the VM, so
+// the networks without containers yet, whose bridge doesn't exist, are pushed
+// too. The default network of netavark, 10.88.0.0/16, has no config.
+const podmanDefaultSubnet = "10.88.0.0/16"
+
+var (
+	podmanNetworks = "/etc/containers/networks"
+	cniConfig      = "/etc/cni/net.d"
+)
+
+// bridgeInterface tells whether an interface is a bridge of docker or podman
+func bridgeInterface(name string) bool {
+	return name == "docker0" || strings.HasPrefix(name, "br-") ||
+		strings.HasPrefix(name, "podman") || strings.HasPrefix(name, "cni-podman")
+}
+
+// netavarkNetwork is the part of a network config of netavark in use
+type netavarkNetwork struct {
+	Driver  string `json:"driver"`
+	Subnets []struct {
+		Subnet string `json:"subnet"`
+	} `json:"subnets"`
+}
+
+// cniNetwork is the part of a network config list of CNI in use
+type cniNetwork struct {
+	Plugins []struct {
+		Type string `json:"type"`
+		IPAM struct {
+			Ranges [][]struct {
+				Subnet string `json:"subnet"`
+			} `json:"ranges"`
+		} `json:"ipam"`
+	} `json:"plugins"`
+}
+
+// podmanSubnets returns the IPv4 subnets of the bridge networks of podman
+// found in the configs of netavark or CNI
+func podmanSubnets() map[string]bool {
+	subnets := make(map[string]bool)
+	add := func(s string) {
+		if _, ipnet, err := net.ParseCIDR(s); err == nil && ipnet.IP.To4() != nil {
+			subnets[ipnet.String()] = true
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(podmanNetworks, "*.json"))
+	for _, file := range files {
+		var n netavarkNetwork
+		if data, err := ioutil.ReadFile(file); err == nil && json.Unmarshal(data, &n) == nil && n.Driver == "bridge" {
+			for _, s := range n.Subnets {
+				add(s.Subnet)
+			}
+		}
+	}
+	if _, err := os.Stat(podmanNetworks); err == nil {
+		add(podmanDefaultSubnet)
+	}
+	files, _ = filepath.Glob(filepath.Join(cniConfig, "*.conflist"))
+	for _, file := range files {
+		var n cniNetwork
+		if data, err := ioutil.ReadFile(file); err != nil || json.Unmarshal(data, &n) != nil {
+			continue
+		}
+		for _, p := range n.Plugins {
+			if p.Type != "bridge" {
+				continue
+			}
+			for _, r := range p.IPAM.Ranges {
+				for _, s := range r {
+					add(s.Subnet)
+				}
+			}
+		}
+	}
+	return subnets
+}
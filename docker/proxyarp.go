@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// With `-proxy-arp desktop` the agent answers the ARP requests for the tunnel
+// IP of the desktop on the docker bridges, and the neighbor solicitations
+// (NDP) for IPv6 addresses, with the kernel proxy entries, so the containers
+// seeing the virtual network on-link, e.g. on a network whose subnet includes
+// it or through the bridges the agent joined, reach the desktop without a
+// route through a gateway of their own. Other addresses behind the tunnel are
+// published the same way, `-proxy-arp desktop,192.168.251.3,fd00::2`. The
+// bridges are those of docker or podman on the host network, the interfaces
+// of the agent otherwise, checked every 10 seconds for new networks.
+var proxyARP = ""
+
+// proxyInterfaces returns the interfaces the addresses are published on
+func proxyInterfaces() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var bridges, others []string
+	for _, ifi := range ifaces {
+		switch {
+		case ifi.Name == tunName || ifi.Flags&net.FlagLoopback != 0 || ifi.Flags&net.FlagUp == 0:
+		case bridgeInterface(ifi.Name):
+			bridges = append(bridges, ifi.Name)
+		case strings.HasPrefix(ifi.Name, "eth"):
+			others = append(others, ifi.Name)
+		}
+	}
+	if len(bridges) > 0 {
+		return bridges
+	}
+	return others
+}
+
+// proxyAddrs returns the addresses of `-proxy-arp`
+func proxyAddrs(desktop net.IP) []net.IP {
+	var ips []net.IP
+	for _, s := range strings.Split(proxyARP, ",") {
+		s = strings.TrimSpace(s)
+		if s == "desktop" {
+			ips = append(ips, desktop)
+		} else if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		} else if s != "" {
+			fmt.Printf("proxy arp => invalid address %s\n", s)
+		}
+	}
+	return ips
+}
+
+// sysctl writes a kernel setting
+func sysctl(key, val string) {
+	path := "/proc/sys/" + strings.Replace(key, ".", "/", -1)
+	if err := ioutil.WriteFile(path, []byte(val), 0644); err != nil {
+		fmt.Printf("sysctl %s=%s error => %v\n", key, val, err)
+	}
+}
+
+// watchProxyARP publishes the addresses on the bridges as they appear
+func watchProxyARP(desktop net.IP) {
+	var ips []net.IP
+	seen, forwarding := "", false
+	published := make(map[string]bool)
+	for {
+		if proxyARP != seen {
+			// `-proxy-arp` changed by a reload of `-config`
+			seen, ips = proxyARP, proxyAddrs(desktop)
+		}
+		if len(ips) > 0 && !forwarding {
+			sysctl("net.ipv4.ip_forward", "1")
+			forwarding = true
+		}
+		current := make(map[string]bool)
+		for _, dev := range proxyInterfaces() {
+			for _, ip := range ips {
+				key := ip.String() + " dev " + dev
+				current[key] = true
+				if published[key] {
+					continue
+				}
+				family := "-4"
+				if ip.To4() == nil {
+					family = "-6"
+					sysctl("net.ipv6.conf."+dev+".proxy_ndp", "1")
+				}
+				fmt.Printf("proxy arp => %s\n", key)
+				if out, err := exec.Command("ip", family, "neigh", "replace", "proxy", ip.String(), "dev", dev).CombinedOutput(); err != nil {
+					fmt.Printf("proxy arp %s error => %v %s\n", key, err, out)
+					delete(current, key)
+				}
+			}
+		}
+		for key := range published {
+			if !current[key] {
+				// an address no longer in `-proxy-arp` or a bridge removed
+				args := append([]string{"neigh", "del", "proxy"}, strings.Fields(key)...)
+				if strings.Contains(key, ":") {
+					args = append([]string{"-6"}, args...)
+				}
+				if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil && debug.On() {
+					fmt.Printf("proxy arp %s error => %v %s\n", key, err, out)
+				}
+			}
+		}
+		published = current
+		time.Sleep(pushInterval)
+	}
+}
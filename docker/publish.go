@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With `-publish` the agent pushes the ports of the containers labeled
+// `desktop-connector.publish=<name>:<port>[:<container port>][,...]`, e.g.
+// `web.test:80:8080`, to the desktop as `publish <name>:<port> <ip:port>
+// [alias]`, and `publish <name>:<port>` once gone, the alias being the
+// loopback address of `desktop-connector.publish.alias`. The desktop with
+// `publish <subnet>` listens on them and names them in its hosts file.
+const (
+	publishLabel      = "desktop-connector.publish"
+	publishAliasLabel = "desktop-connector.publish.alias"
+)
+
+var publish = false
+
+// publishedPorts returns the pushed values of the ports of the labeled
+// containers by `<name>:<port>`
+func publishedPorts() (map[string]string, error) {
+	filters := fmt.Sprintf(`{"label":["%s"]}`, publishLabel)
+	body, err := dockerGet("/containers/json?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return nil, err
+	}
+	var containers []mdnsContainer
+	err = json.NewDecoder(body).Decode(&containers)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	ports := make(map[string]string)
+	for _, c := range containers {
+		ip := c.address()
+		if ip == nil {
+			continue
+		}
+		alias := ""
+		if a := net.ParseIP(c.Labels[publishAliasLabel]).To4(); a != nil && a.IsLoopback() {
+			alias = " " + a.String()
+		}
+		for _, p := range strings.Split(c.Labels[publishLabel], ",") {
+			vals := strings.Split(strings.TrimSpace(p), ":")
+			if len(vals) == 2 {
+				vals = append(vals, vals[1])
+			}
+			port, err := strconv.Atoi(vals[len(vals)-2])
+			target, err2 := strconv.Atoi(vals[len(vals)-1])
+			if len(vals) != 3 || vals[0] == "" || err != nil || err2 != nil || port <= 0 || port > 65535 || target <= 0 || target > 65535 {
+				fmt.Printf("publish => invalid port %s\n", p)
+				continue
+			}
+			key := strings.ToLower(vals[0]) + ":" + strconv.Itoa(port)
+			ports[key] = net.JoinHostPort(ip.String(), strconv.Itoa(target)) + alias
+		}
+	}
+	return ports, nil
+}
+
+// watchPublish pushes the labeled ports to the desktop
+func watchPublish(conn *net.UDPConn) {
+	known := make(map[string]string)
+	for i := 0; ; i++ {
+		current := make(map[string]string)
+		var err error
+		if publish {
+			current, err = publishedPorts()
+		}
+		if err != nil {
+			fmt.Printf("publish error => %v\n", err)
+			time.Sleep(pushInterval)
+			continue
+		}
+		for key, target := range current {
+			if known[key] != target || i%pushRepeat == 0 {
+				sendRoute(conn, "publish "+key+" "+target)
+			}
+		}
+		for key := range known {
+			if _, ok := current[key]; !ok {
+				sendRoute(conn, "publish "+key)
+			}
+		}
+		known = current
+		time.Sleep(pushInterval)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// resyncRequest asks the desktop to send the controls again
+	resyncRequest = 5
+	// heartbeatMin is the shortest interval accepted from the desktop
+	heartbeatMin = 500
+)
+
+var (
+	reconnectMax = 30000
+	// lostAfter is the number of silent heartbeat intervals before the
+	// desktop is considered lost
+	lostAfter = 3
+	// heartbeatLock guards the flags and the pushed heartbeat, set by the
+	// controls and by the reloads of `-config`
+	heartbeatLock sync.Mutex
+	// flagHeartbeat and flagLostAfter are restored when the desktop stops
+	// pushing `heartbeat <ms> <lost-after>` in the controls
+	flagHeartbeat, flagLostAfter int
+	// pushedHeartbeat is the last `heartbeat` of the controls, kept across
+	// the reloads of `-config`
+	pushedHeartbeat []string
+	// beatInterval in milliseconds and beatLostAfter are the values in use,
+	// read by keepalive
+	beatInterval, beatLostAfter int32
+	// lastRx is the time in unix nanoseconds of the last packet from the desktop
+	lastRx int64
+	// lost is set when the desktop is unreachable or silent
+	lost int32
+)
+
+// received marks the link alive, and requests a resync of the controls if it
+// was lost before, since the desktop may have restarted meanwhile.
+func received(conn *net.UDPConn) {
+	atomic.StoreInt64(&lastRx, time.Now().UnixNano())
+	if atomic.CompareAndSwapInt32(&lost, 1, 0) {
+		fmt.Println("reconnected => resync controls")
+		writeUDP(conn, []byte{resyncRequest})
+	}
+}
+
+func markLost(reason string) {
+	if atomic.CompareAndSwapInt32(&lost, 0, 1) {
+		fmt.Printf("connection lost => %s\n", reason)
+		resolveSoon()
+	}
+}
+
+// setHeartbeat applies the interval and lost-after pushed by the desktop, or
+// the flags when the controls carry none
+func setHeartbeat(vals []string) {
+	heartbeatLock.Lock()
+	defer heartbeatLock.Unlock()
+	pushedHeartbeat = vals
+	ms, after := flagHeartbeat, flagLostAfter
+	if len(vals) > 0 {
+		if v, err := strconv.Atoi(vals[0]); err == nil && v >= heartbeatMin {
+			ms = v
+		}
+	}
+	if len(vals) > 1 {
+		if v, err := strconv.Atoi(vals[1]); err == nil && v > 0 {
+			after = v
+		}
+	}
+	if int32(ms) != atomic.LoadInt32(&beatInterval) || int32(after) != atomic.LoadInt32(&beatLostAfter) {
+		fmt.Printf("heartbeat => %dms, lost after %d\n", ms, after)
+		atomic.StoreInt32(&beatInterval, int32(ms))
+		atomic.StoreInt32(&beatLostAfter, int32(after))
+	}
+}
+
+// setHeartbeatFlags takes the `-heartbeat` and `-lost-after` of a reload,
+// which apply unless the desktop pushes its own
+func setHeartbeatFlags(ms, after int) {
+	heartbeatLock.Lock()
+	flagHeartbeat, flagLostAfter = ms, after
+	vals := pushedHeartbeat
+	heartbeatLock.Unlock()
+	setHeartbeat(vals)
+}
+
+// keepalive sends a heartbeat after `heartbeat` milliseconds without traffic.
+// Once the desktop is lost it keeps probing with exponential backoff and
+// jitter, regardless of outgoing traffic, until the desktop answers again.
+func keepalive(conn *net.UDPConn, requested chan bool) {
+	backoff := time.Duration(0)
+	for {
+		duration := time.Millisecond * time.Duration(atomic.LoadInt32(&beatInterval))
+		if atomic.LoadInt32(&lost) == 0 {
+			rx := atomic.LoadInt64(&lastRx)
+			if rx != 0 && time.Since(time.Unix(0, rx)) > time.Duration(atomic.LoadInt32(&beatLostAfter))*duration {
+				markLost("no reply from desktop")
+			}
+		}
+		if atomic.LoadInt32(&lost) == 0 {
+			backoff = 0
+			select {
+			case <-requested:
+				continue
+			case <-time.After(duration):
+				sendHeartbeat(conn)
+			}
+			continue
+		}
+		if backoff == 0 {
+			backoff = 200 * time.Millisecond
+		} else if backoff *= 2; backoff > time.Duration(reconnectMax)*time.Millisecond {
+			backoff = time.Duration(reconnectMax) * time.Millisecond
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		fmt.Printf("reconnect in %v\n", wait)
+		timer := time.After(wait)
+	drain:
+		for {
+			select {
+			case <-requested:
+			case <-timer:
+				break drain
+			}
+		}
+		knock()
+		sendHeartbeat(conn)
+	}
+}
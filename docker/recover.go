@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	// restartBackoff is the first delay before restarting a loop that
+	// panicked, doubled at each panic up to restartBackoffMax
+	restartBackoff    = 100 * time.Millisecond
+	restartBackoffMax = 30 * time.Second
+	// restartHealthy resets the backoff of a loop that ran that long
+	restartHealthy = time.Minute
+)
+
+// supervise runs the loop until it returns, restarting it with backoff when
+// it panics, so a malformed packet can't silently stop one direction of the
+// tunnel.
+func supervise(name string, loop func()) {
+	backoff := restartBackoff
+	panics := 0
+	for {
+		start := time.Now()
+		if !runLoop(name, loop) {
+			return
+		}
+		panics++
+		if time.Since(start) > restartHealthy {
+			backoff = restartBackoff
+		}
+		fmt.Printf("restart %s => in %v, %d panics\n", name, backoff, panics)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > restartBackoffMax {
+			backoff = restartBackoffMax
+		}
+	}
+}
+
+// runLoop runs the loop and returns whether it panicked
+func runLoop(name string, loop func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			fmt.Printf("panic %s => %v\n%s", name, r, stack())
+		}
+	}()
+	loop()
+	return false
+}
+
+// stack returns the trace of the panicking goroutine
+func stack() []byte {
+	buf := make([]byte, 16<<10)
+	return buf[:runtime.Stack(buf, false)]
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// With `-rendezvous host:2520` the desktop is reached through the rendezvous
+// server run by `docker-connector rendezvous`: the docker side registers under
+// `-rendezvous-session`, learns the public address of the desktop and punches
+// a hole to it from the port the tunnel then uses. When no punch comes through
+// the tunnel goes to the server, relaying to the desktop. `-relay-only` skips
+// the punch and `-relay-secret` signs the registration for a server run with
+// the same secret.
+const (
+	rendezvousRegister = 0xF0
+	rendezvousPeer     = 0xF1
+	rendezvousPunch    = 0xF2
+	rendezvousAck      = 0xF3
+	rendezvousSigned   = 0xF4
+	rendezvousDocker   = 'k'
+	punchEvery         = 200 * time.Millisecond
+)
+
+var (
+	rendezvous        = ""
+	rendezvousSession = "default"
+	punchTimeout      = 5 * time.Second
+	relayOnly         = false
+	relaySecret       = ""
+)
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// rendezvousRegistration returns the registration, signed with `relaySecret`
+// if set as `0xF4 | role | timestamp(8) | hmac-sha256(secret, role | timestamp | session) | session`
+func rendezvousRegistration() []byte {
+	if relaySecret == "" {
+		return append([]byte{rendezvousRegister, rendezvousDocker}, rendezvousSession...)
+	}
+	msg := make([]byte, 10, 10+sha256.Size+len(rendezvousSession))
+	msg[0], msg[1] = rendezvousSigned, rendezvousDocker
+	binary.BigEndian.PutUint64(msg[2:], uint64(time.Now().UnixNano()))
+	mac := hmac.New(sha256.New, []byte(relaySecret))
+	mac.Write(msg[1:10])
+	mac.Write([]byte(rendezvousSession))
+	msg = mac.Sum(msg)
+	return append(msg, rendezvousSession...)
+}
+
+// rendezvousTunnel returns the address the tunnel connects to, the desktop
+// once punched or the server relaying, and the local address to connect from
+func rendezvousTunnel() (*net.UDPAddr, *net.UDPAddr, error) {
+	server, err := net.ResolveUDPAddr("udp", rendezvous)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := listenUDP()
+	if err != nil {
+		return nil, nil, err
+	}
+	local := &net.UDPAddr{Port: pc.LocalAddr().(*net.UDPAddr).Port}
+	buf := make([]byte, 1500)
+	var desktop *net.UDPAddr
+	waiting := time.Now()
+	fmt.Printf("rendezvous => %v session %s\n", server, rendezvousSession)
+	for desktop == nil {
+		if _, err := pc.WriteToUDP(rendezvousRegistration(), server); err != nil {
+			fmt.Printf("rendezvous register error => %v\n", err)
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if time.Since(waiting) > 10*time.Second {
+				fmt.Println("rendezvous => waiting for the desktop")
+				waiting = time.Now()
+			}
+			continue
+		}
+		if n > 1 && buf[0] == rendezvousPeer && sameUDPAddr(from, server) {
+			if desktop, err = net.ResolveUDPAddr("udp", string(buf[1:n])); err != nil {
+				fmt.Printf("invalid desktop address => %s\n", buf[1:n])
+			}
+		}
+	}
+	fmt.Printf("rendezvous desktop => %v\n", desktop)
+	direct := false
+	for deadline := time.Now().Add(punchTimeout); !relayOnly && !direct && time.Now().Before(deadline); {
+		pc.WriteToUDP([]byte{rendezvousPunch}, desktop)
+		pc.SetReadDeadline(time.Now().Add(punchEvery))
+		n, from, err := pc.ReadFromUDP(buf)
+		direct = err == nil && n == 1 && (buf[0] == rendezvousPunch || buf[0] == rendezvousAck) && sameUDPAddr(from, desktop)
+	}
+	pc.Close()
+	if direct {
+		fmt.Printf("rendezvous => direct to %v\n", desktop)
+		return desktop, local, nil
+	}
+	if relayOnly {
+		fmt.Printf("rendezvous => relayed by %v\n", server)
+	} else {
+		fmt.Printf("rendezvous => punch failed, relayed by %v\n", server)
+	}
+	return server, local, nil
+}
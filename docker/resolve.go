@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// A `-host` given as a name, e.g. of a dynamic DNS or a cloud instance, is
+// resolved again every `-resolve-every`, once the desktop is lost and after a
+// failed send, at most once per resolveMin, and the sockets are connected to
+// the new address once it resolves to another one, like on a change of
+// `host` in `-config`.
+const resolveMin = 5 * time.Second
+
+var (
+	resolveEvery = time.Minute
+	// resolveNow asks for a resolution
+	resolveNow = make(chan struct{}, 1)
+)
+
+// hostIsName tells whether `-host` is a name to resolve
+func hostIsName() bool {
+	return rendezvous == "" && host != "wsl" && net.ParseIP(host) == nil
+}
+
+// resolveSoon asks for a resolution of `-host` after a failure
+func resolveSoon() {
+	if !hostIsName() {
+		return
+	}
+	select {
+	case resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// watchResolve connects the sockets to the new address of the name of `-host`
+func watchResolve(conn, ctl *net.UDPConn) {
+	var last time.Time
+	for {
+		var every <-chan time.Time
+		if resolveEvery > 0 {
+			every = time.After(resolveEvery)
+		}
+		select {
+		case <-every:
+		case <-resolveNow:
+			if wait := resolveMin - time.Since(last); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		last = time.Now()
+		if !hostIsName() {
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			fmt.Printf("resolve error => %s: %v\n", host, err)
+			continue
+		}
+		if current := remoteAddr(conn); current != nil && current.IP.Equal(udpAddr.IP) {
+			continue
+		}
+		fmt.Printf("resolve => %s now at %s\n", host, udpAddr.IP)
+		redialDesktop(conn, ctl)
+	}
+}
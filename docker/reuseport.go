@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// With `-sockets <n>` on linux the datagrams of the desktop are read from n
+// sockets sharing the local port with SO_REUSEPORT, each by its own reader,
+// instead of a single one, the bottleneck past a Gbps. A classic BPF program
+// of the group hands each plain IPv4 packet to the socket of the hash of its
+// 5-tuple, so the packets of a flow keep their order while the reads scale
+// across the cores. The other datagrams, the heartbeats, the controls and the
+// compressed, FEC or framed packets, go to the first socket, read by the main
+// loop. A connected socket taking all the datagrams of its address, the
+// sockets of the group aren't connected: a socket filter only lets in those of
+// the desktop, and the datagrams to it are sent with its address. `-offload`,
+// the rendezvous and an IPv6 desktop keep a single socket.
+var (
+	sockets = 1
+	// group holds the sockets of `-sockets`, the first being the data socket
+	group []*net.UDPConn
+	// desktopAddr is the address of the desktop of the unconnected sockets
+	desktopAddr atomic.Value
+)
+
+// openGroup returns the first socket of the group, nil for a single
+// connected socket
+func openGroup(laddr, udpAddr *net.UDPAddr, iface tunDevice) *net.UDPConn {
+	switch {
+	case sockets < 2:
+		return nil
+	case laddr != nil:
+		fmt.Println("sockets => 1 with the rendezvous")
+		return nil
+	case udpAddr.IP.To4() == nil:
+		fmt.Println("sockets => 1 to an IPv6 desktop")
+		return nil
+	}
+	if _, ok := iface.(*offloadTUN); ok {
+		fmt.Println("sockets => 1 with offload, the packets are coalesced by a single reader")
+		return nil
+	}
+	conns, err := listenGroup(sockets, udpAddr)
+	if err != nil {
+		fmt.Printf("sockets error => %v\n", err)
+		return nil
+	}
+	desktopAddr.Store(udpAddr)
+	group = conns
+	fmt.Printf("sockets => %d on %s\n", len(conns), conns[0].LocalAddr())
+	return conns[0]
+}
+
+// setDesktopAddr points the group to the new address of the desktop
+func setDesktopAddr(addr *net.UDPAddr) error {
+	if addr.IP.To4() == nil {
+		return fmt.Errorf("%s from an IPv4 socket", addr)
+	}
+	if err := filterDesktop(group, addr); err != nil {
+		return err
+	}
+	desktopAddr.Store(addr)
+	return nil
+}
+
+// writeUDP writes a datagram to the desktop, with its address from a socket
+// of the group
+func writeUDP(conn *net.UDPConn, b []byte) (int, error) {
+	if conn.RemoteAddr() != nil {
+		return conn.Write(b)
+	}
+	return conn.WriteToUDP(b, remoteAddr(conn))
+}
+
+// remoteAddr returns the address of the desktop of a socket
+func remoteAddr(conn *net.UDPConn) *net.UDPAddr {
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		return addr
+	}
+	addr, _ := desktopAddr.Load().(*net.UDPAddr)
+	return addr
+}
+
+// readGroup writes the packets handed to the i-th socket of the group, but
+// the first, to the TUN
+func readGroup(i int, iface tunDevice, requested chan bool) {
+	conn := group[i]
+	data := make([]byte, bufferSize())
+	reader := newBatchReader(conn, bufferSize())
+	supervise(fmt.Sprintf("udp reader %d", i), func() {
+		for {
+			if size := bufferSize(); size > len(data) {
+				data = make([]byte, size)
+				reader.Grow(size)
+			}
+			n, err := reader.Read(data)
+			if err != nil {
+				fmt.Println("failed read udp msg, error: " + err.Error())
+				continue
+			}
+			if n == 0 || data[0]>>4 != 4 || truncated(n, len(data), "udp") {
+				continue
+			}
+			received(conn)
+			if reply := pingReply(data[:n]); reply != nil {
+				sendDatagram(conn, reply)
+				requested <- true
+				continue
+			}
+			capturePacket(data[:n])
+			if _, err := iface.Write(data[:n]); err != nil {
+				fmt.Printf("tun write error: %v\n", err)
+			}
+			requested <- true
+		}
+	})
+}
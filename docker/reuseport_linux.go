@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+)
+
+const (
+	// soReusePort is SO_REUSEPORT but on mips and sparc, which syscall
+	// doesn't define on every arch
+	soReusePort = 0xf
+	// soAttachReusePortCBPF is SO_ATTACH_REUSEPORT_CBPF
+	soAttachReusePortCBPF = 51
+	// skfNetOff is SKF_NET_OFF, loading from the IP header
+	skfNetOff = 0xfff00000
+)
+
+// listenGroup opens n sockets on the same port with SO_REUSEPORT, the
+// packets of the desktop at addr spread across them by flow
+func listenGroup(n int, addr *net.UDPAddr) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			if serr == nil && bindIface != "" {
+				serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, bindIface)
+			}
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+	var conns []*net.UDPConn
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	local := "0.0.0.0:0"
+	for i := 0; i < n; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp4", local)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+		if err := filterDesktop([]*net.UDPConn{conn}, addr); err != nil {
+			closeAll()
+			return nil, err
+		}
+		local = conn.LocalAddr().String()
+	}
+	prog, err := bpf.Assemble(steerProgram(n))
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	if err := setFilter(conns[0], soAttachReusePortCBPF, prog); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return conns, nil
+}
+
+// steerProgram returns the index of the socket of a datagram, the hash of
+// the addresses, the protocol and the ports of a plain IPv4 packet, the
+// first socket for the other datagrams. The reuseport programs see the UDP
+// payload from offset 0.
+func steerProgram(n int) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x40, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		// M[0] = src ^ dst ^ proto
+		bpf.LoadAbsolute{Off: 16, Size: 4},
+		bpf.TAX{},
+		bpf.LoadAbsolute{Off: 12, Size: 4},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.TAX{},
+		bpf.LoadAbsolute{Off: 9, Size: 1},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		// ^ ports of TCP and UDP, but in the later fragments
+		bpf.LoadAbsolute{Off: 9, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 7},
+		bpf.LoadAbsolute{Off: 6, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 5},
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Off: 0, Size: 4},
+		bpf.LoadScratch{Dst: bpf.RegX, N: 0},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		// the high bits of a multiplicative hash modulo the sockets
+		bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 0x9e3779b1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 16},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: uint32(n)},
+		bpf.RetA{},
+	}
+}
+
+// filterDesktop lets in the sockets only the datagrams of the desktop, as
+// connected sockets do
+func filterDesktop(conns []*net.UDPConn, addr *net.UDPAddr) error {
+	ip := addr.IP.To4()
+	prog, err := bpf.Assemble([]bpf.Instruction{
+		bpf.LoadAbsolute{Off: skfNetOff + 12, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: binary.BigEndian.Uint32(ip), SkipFalse: 6},
+		bpf.LoadAbsolute{Off: skfNetOff, Size: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+		bpf.TAX{},
+		bpf.LoadIndirect{Off: skfNetOff, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(addr.Port), SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 0xffffffff},
+	})
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if err := setFilter(conn, syscall.SO_ATTACH_FILTER, prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFilter attaches a classic BPF program to the socket
+func setFilter(conn *net.UDPConn, opt int, prog []bpf.RawInstruction) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: (*syscall.SockFilter)(unsafe.Pointer(&prog[0]))}
+	// the bytes of the struct sock_fprog, SYS_SETSOCKOPT being missing on
+	// 386 where the socket calls go through socketcall
+	b := (*[unsafe.Sizeof(fprog)]byte)(unsafe.Pointer(&fprog))[:]
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, opt, string(b))
+	}); err != nil {
+		return err
+	}
+	runtime.KeepAlive(prog)
+	return serr
+}
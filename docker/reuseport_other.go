@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenGroup(n int, addr *net.UDPAddr) ([]*net.UDPConn, error) {
+	return nil, fmt.Errorf("several sockets need linux")
+}
+
+func filterDesktop(conns []*net.UDPConn, addr *net.UDPAddr) error {
+	return nil
+}
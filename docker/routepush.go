@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// With `-push-routes` the subnets of the docker or podman networks, routed to
+// their bridges, are pushed to the desktop as `connect <subnet>` when they appear
+// and `disconnect <subnet>` when they are removed, so the desktop routes them
+// without editing its config. The current ones are pushed again every
+// minute in case a datagram was lost.
+const (
+	pushInterval = 10 * time.Second
+	pushRepeat   = 6
+)
+
+var pushRoutes = false
+
+// bridgeSubnets returns the subnets routed to the bridges and those of the
+// podman configs
+func bridgeSubnets() map[string]bool {
+	subnets := make(map[string]bool)
+	for _, line := range strings.Split(runCmd("route -n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if !bridgeInterface(fields[7]) {
+			continue
+		}
+		ip, mask := net.ParseIP(fields[0]).To4(), net.ParseIP(fields[2]).To4()
+		if ip == nil || mask == nil {
+			continue
+		}
+		ones, _ := net.IPMask(mask).Size()
+		subnets[fmt.Sprintf("%s/%d", ip.Mask(net.IPMask(mask)), ones)] = true
+	}
+	for subnet := range podmanSubnets() {
+		subnets[subnet] = true
+	}
+	return subnets
+}
+
+func sendRoute(conn *net.UDPConn, line string) {
+	fmt.Printf("push route => %s\n", line)
+	if _, err := writeUDP(conn, append([]byte{1}, signControl(line)...)); err != nil {
+		fmt.Printf("push route error => %v\n", err)
+	}
+}
+
+// watchRoutes pushes the changes of the docker networks to the desktop
+func watchRoutes(conn *net.UDPConn) {
+	known := make(map[string]bool)
+	for i := 0; ; i++ {
+		current := make(map[string]bool)
+		if pushRoutes {
+			current = bridgeSubnets()
+		}
+		for subnet := range current {
+			if !known[subnet] || i%pushRepeat == 0 {
+				sendRoute(conn, "connect "+subnet)
+			}
+		}
+		for subnet := range known {
+			if !current[subnet] {
+				sendRoute(conn, "disconnect "+subnet)
+			}
+		}
+		known = current
+		time.Sleep(pushInterval)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The secrets, `-knock-secret`, `-control-secret` and `-relay-secret`, may be
+// given as `file:<path>`, e.g. a docker secret mounted at /run/secrets, to
+// keep them out of the command line and the environment. They are read at
+// startup and as `-config` is reloaded, so a rotated one applies in place.
+
+// readSecrets replaces the `file:` secrets by the content of their file, the
+// agent exiting at startup when one can't be read
+func readSecrets(init bool) {
+	secrets := map[string]*string{
+		"knock-secret":   &knockSecret,
+		"control-secret": &controlSecret,
+		"relay-secret":   &relaySecret,
+	}
+	for name, secret := range secrets {
+		if !strings.HasPrefix(*secret, "file:") {
+			continue
+		}
+		data, err := ioutil.ReadFile(strings.TrimPrefix(*secret, "file:"))
+		if err != nil {
+			fmt.Printf("failed to read %s => %v\n", name, err)
+			if init {
+				os.Exit(1)
+			}
+			continue
+		}
+		*secret = strings.TrimSpace(string(data))
+	}
+}
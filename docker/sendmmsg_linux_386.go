@@ -0,0 +1,4 @@
+package main
+
+// sysSendmmsg is missing from the syscall package of 386
+const sysSendmmsg = 345
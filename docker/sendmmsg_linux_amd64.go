@@ -0,0 +1,4 @@
+package main
+
+// sysSendmmsg is missing from the syscall package of amd64
+const sysSendmmsg = 307
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// The heartbeats carry the id of the session of the agent once the desktop
+// tells it knows them, by a flag byte after its reply:
+//
+//	0 | t1 | echoT1 | t4 | features | session(8)
+//
+// so the desktop resumes the session when the agent comes from another
+// address, after a NAT rebinding or a restart of the VM, and keeps away another
+// agent while the session is alive. The id is kept in `-session-file` to
+// survive the restarts of the container. A desktop receiving data from an
+// unknown address asks for a heartbeat with a session request, which tells it
+// knows the sessions too.
+const (
+	sessionLen     = 8
+	sessionRequest = 13
+	// desktopSessions is the flag of the desktop knowing the sessions
+	desktopSessions = 1
+)
+
+var (
+	sessionFile = filepath.Join(os.TempDir(), "desktop-connector.session")
+	sessionID   []byte
+	// sessionsOK is set once the desktop knows the sessions
+	sessionsOK int32
+)
+
+// loadSession reads the id of `-session-file` or creates it
+func loadSession() {
+	if sessionFile != "" {
+		if data, err := ioutil.ReadFile(sessionFile); err == nil {
+			if id, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(id) == sessionLen {
+				sessionID = id
+			}
+		}
+	}
+	if sessionID == nil {
+		sessionID = make([]byte, sessionLen)
+		if _, err := rand.Read(sessionID); err != nil {
+			fmt.Printf("session error => %v\n", err)
+		}
+		if sessionFile != "" {
+			if err := ioutil.WriteFile(sessionFile, []byte(hex.EncodeToString(sessionID)), 0644); err != nil {
+				fmt.Printf("session file error => %v\n", err)
+			}
+		}
+	}
+	fmt.Printf("session => %016x\n", binary.BigEndian.Uint64(sessionID))
+}
+
+// sessionFlags records whether the reply to a heartbeat tells the desktop
+// knows the sessions
+func sessionFlags(reply []byte) {
+	if len(reply) > heartbeatLen && reply[heartbeatLen]&desktopSessions != 0 {
+		if atomic.CompareAndSwapInt32(&sessionsOK, 0, 1) {
+			fmt.Println("session => resumable")
+		}
+		identityFlags(reply[heartbeatLen])
+	}
+}
+
+// withSession appends the features byte and the session to a heartbeat when
+// the desktop knows the sessions
+func withSession(packet []byte, f byte) []byte {
+	if atomic.LoadInt32(&sessionsOK) == 0 || sessionID == nil {
+		if f != 0 {
+			packet = append(packet, f)
+		}
+		return packet
+	}
+	return append(append(packet, f), sessionID...)
+}
+
+// requestedSession answers a session request of the desktop with a heartbeat
+// carrying the session, the request being followed by the flags of the
+// desktop when it asks for a signed one
+func requestedSession(conn *net.UDPConn, flags []byte) {
+	if atomic.CompareAndSwapInt32(&sessionsOK, 0, 1) {
+		fmt.Println("session => resumable")
+	}
+	if len(flags) > 0 {
+		identityFlags(flags[0])
+	}
+	sendHeartbeat(conn)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SOCKS5 server of the desktop asks for a CONNECT with
+// `11 | id(4) | host:port`: the target is dialed from here and the result
+// sent back on a TCP connection to the desktop port, starting with
+// `id(4) | reply code(1)`. The datagrams of an UDP ASSOCIATE go both ways as
+// `12 | id(4) | length(1) | host:port | payload`.
+const (
+	socksDial        = 11
+	socksUDP         = 12
+	socksDialTimeout = 10 * time.Second
+	socksUDPIdle     = 2 * time.Minute
+)
+
+var (
+	socksLock  sync.Mutex
+	socksFlows = make(map[uint32]*net.UDPConn)
+)
+
+// socksCode maps a dial error to a SOCKS reply code
+func socksCode(err error) byte {
+	switch {
+	case err == nil:
+		return 0
+	case strings.Contains(err.Error(), "refused"):
+		return 5
+	case strings.Contains(err.Error(), "network is unreachable"):
+		return 3
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return 4
+	}
+	if strings.Contains(err.Error(), "unreachable") || strings.Contains(err.Error(), "no such host") {
+		return 4
+	}
+	return 1
+}
+
+// handleSocksDial dials the target of a CONNECT and connects back to the
+// desktop
+func handleSocksDial(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	id := data[1:5]
+	target := string(data[5:])
+	remote, err := net.DialTimeout("tcp", target, socksDialTimeout)
+	if err != nil {
+		fmt.Printf("socks dial %s => %v\n", target, err)
+	}
+	stream, serr := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), socksDialTimeout)
+	if serr != nil {
+		fmt.Printf("socks connect back to %s:%d => %v\n", host, port, serr)
+		if remote != nil {
+			remote.Close()
+		}
+		return
+	}
+	defer stream.Close()
+	if _, werr := stream.Write(append(append([]byte(nil), id...), socksCode(err))); werr != nil || err != nil {
+		if remote != nil {
+			remote.Close()
+		}
+		return
+	}
+	defer remote.Close()
+	if debug.On() {
+		fmt.Printf("socks connect => %s\n", target)
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, stream)
+		remote.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(stream, remote)
+	stream.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// handleSocksUDP sends a datagram of an UDP ASSOCIATE to its target, with a
+// socket per association relaying the replies until it is idle
+func handleSocksUDP(conn *net.UDPConn, data []byte) {
+	if len(data) < 6 || len(data) < 6+int(data[5]) {
+		return
+	}
+	id := binary.BigEndian.Uint32(data[1:])
+	target, err := net.ResolveUDPAddr("udp", string(data[6:6+data[5]]))
+	if err != nil {
+		fmt.Printf("socks udp %s => %v\n", data[6:6+data[5]], err)
+		return
+	}
+	socksLock.Lock()
+	pc := socksFlows[id]
+	if pc == nil {
+		if pc, err = net.ListenUDP("udp", nil); err != nil {
+			socksLock.Unlock()
+			fmt.Printf("socks udp listen => %v\n", err)
+			return
+		}
+		socksFlows[id] = pc
+		go relaySocksUDP(conn, id, pc)
+	}
+	socksLock.Unlock()
+	pc.WriteToUDP(data[6+data[5]:], target)
+}
+
+func relaySocksUDP(conn *net.UDPConn, id uint32, pc *net.UDPConn) {
+	defer func() {
+		socksLock.Lock()
+		delete(socksFlows, id)
+		socksLock.Unlock()
+		pc.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		pc.SetReadDeadline(time.Now().Add(socksUDPIdle))
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		source := from.String()
+		msg := make([]byte, 6, 6+len(source)+n)
+		msg[0] = socksUDP
+		binary.BigEndian.PutUint32(msg[1:], id)
+		msg[5] = byte(len(source))
+		msg = append(append(msg, source...), buf[:n]...)
+		if _, err := writeUDP(conn, msg); err != nil {
+			fmt.Printf("socks udp write error: %v\n", err)
+		}
+	}
+}
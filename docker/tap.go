@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// With `-tap` we create a tap device, and accept the `mode tap` offered by
+// the desktop by appending the features byte to the heartbeats. Then the
+// ethernet frames are sent as is in datagrams of
+//
+//	10 | ethernet frame
+//
+// Until then, the tap device acts as a TUN: IP packets are unwrapped, IPv4
+// ARP requests answered with the MAC of a virtual gateway and the other
+// frames dropped.
+const (
+	tapType      = 10
+	featureTAP   = 2
+	etherHeader  = 14
+	etherIPv4    = 0x0800
+	etherARP     = 0x0806
+	etherIPv6    = 0x86dd
+	arpPacketLen = 28
+)
+
+var (
+	tapMode = false
+	bridge  = ""
+	// tapOffered is set when the desktop offered the tap mode in its controls
+	tapOffered int32
+	// gatewayMAC is the locally administered MAC answering ARP requests
+	gatewayMAC = net.HardwareAddr{0x02, 0x64, 0x63, 0x00, 0x00, 0x02}
+)
+
+// setTAPOffered records whether the last controls offered the tap mode
+func setTAPOffered(tap bool) {
+	var v int32
+	if tap && tapMode {
+		v = 1
+	}
+	if atomic.SwapInt32(&tapOffered, v) != v {
+		fmt.Printf("tap => %v\n", v == 1)
+	}
+}
+
+// bridged reports whether the frames are sent as is
+func bridged() bool {
+	return atomic.LoadInt32(&tapOffered) == 1
+}
+
+// tapDevice is a tap device seen as a TUN by the forwarding loops
+type tapDevice struct {
+	dev  tunDevice
+	conn *net.UDPConn
+	// mac of the device, learned from its frames
+	mac atomic.Value
+}
+
+func (t *tapDevice) Name() string {
+	return t.dev.Name()
+}
+
+// Read returns the next IP packet of the device, the frames read meanwhile
+// are sent to the desktop when bridged
+func (t *tapDevice) Read(b []byte) (int, error) {
+	buf := make([]byte, 1+len(b)+etherHeader)
+	buf[0] = tapType
+	for {
+		n, err := t.dev.Read(buf[1:])
+		if err != nil {
+			return 0, err
+		}
+		if n < etherHeader {
+			continue
+		}
+		frame := buf[1 : 1+n]
+		if old, _ := t.mac.Load().(net.HardwareAddr); !bytes.Equal(frame[6:12], old) {
+			t.mac.Store(append(net.HardwareAddr(nil), frame[6:12]...))
+		}
+		if bridged() {
+			if t.conn != nil {
+				if err := writePacket(t.conn, buf[:1+n]); err != nil {
+					fmt.Printf("udp write error: %v\n", err)
+				}
+			}
+			continue
+		}
+		switch binary.BigEndian.Uint16(frame[12:14]) {
+		case etherIPv4, etherIPv6:
+			return copy(b, frame[etherHeader:]), nil
+		case etherARP:
+			if reply := arpReply(frame); reply != nil {
+				t.dev.Write(reply)
+			}
+		}
+	}
+}
+
+// Write sends an IP packet to the device from the virtual gateway
+func (t *tapDevice) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	frame := make([]byte, etherHeader+len(b))
+	if mac, ok := t.mac.Load().(net.HardwareAddr); ok {
+		copy(frame[0:6], mac)
+	} else {
+		copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+	copy(frame[6:12], gatewayMAC)
+	typ := uint16(etherIPv4)
+	if b[0]>>4 == 6 {
+		typ = etherIPv6
+	}
+	binary.BigEndian.PutUint16(frame[12:14], typ)
+	copy(frame[etherHeader:], b)
+	if _, err := t.dev.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteFrame writes a frame of the desktop to the device
+func (t *tapDevice) WriteFrame(frame []byte) error {
+	if len(frame) < etherHeader {
+		return nil
+	}
+	_, err := t.dev.Write(frame)
+	return err
+}
+
+// arpReply answers an IPv4 ARP request with the MAC of the gateway, except
+// the probes of the address of the device itself
+func arpReply(frame []byte) []byte {
+	arp := frame[etherHeader:]
+	if len(arp) < arpPacketLen || binary.BigEndian.Uint16(arp[0:2]) != 1 ||
+		binary.BigEndian.Uint16(arp[2:4]) != etherIPv4 || arp[4] != 6 || arp[5] != 4 ||
+		binary.BigEndian.Uint16(arp[6:8]) != 1 {
+		return nil
+	}
+	sha, spa, tpa := arp[8:14], arp[14:18], arp[24:28]
+	if net.IP(spa).Equal(net.IPv4zero) || net.IP(spa).Equal(net.IP(tpa)) {
+		return nil
+	}
+	reply := make([]byte, etherHeader+arpPacketLen)
+	copy(reply[0:6], sha)
+	copy(reply[6:12], gatewayMAC)
+	binary.BigEndian.PutUint16(reply[12:14], etherARP)
+	r := reply[etherHeader:]
+	copy(r[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(r[6:8], 2)
+	copy(r[8:14], gatewayMAC)
+	copy(r[14:18], tpa)
+	copy(r[18:24], sha)
+	copy(r[24:28], spa)
+	return reply
+}
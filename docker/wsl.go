@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The agent runs in a WSL2 distro too, as a plain binary rather than in a
+// container, started with `-host wsl` next to a docker engine of the distro.
+// WSL2 gives the distro and the Windows host new addresses on each boot, the
+// host being the default gateway of the distro, so `wsl` is resolved at start,
+// waiting for the network of the distro. With the mirrored networking of WSL
+// the desktop is reached on `-host 127.0.0.1` instead.
+const hostWSL = "wsl"
+
+// wslHost returns the address of the Windows host, the default gateway
+func wslHost() (net.IP, error) {
+	fi, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gw := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(gw, binary.BigEndian.Uint32(raw))
+		return gw, nil
+	}
+	return nil, fmt.Errorf("no default route")
+}
+
+// resolveWSL replaces `-host wsl` by the address of the Windows host
+func resolveWSL() {
+	if host != hostWSL {
+		return
+	}
+	for i := 0; ; i++ {
+		gw, err := wslHost()
+		if err == nil {
+			fmt.Printf("wsl host => %s\n", gw)
+			host = gw.String()
+			return
+		}
+		if i == 0 {
+			fmt.Printf("wsl host error => %v, waiting\n", err)
+		}
+		time.Sleep(time.Second)
+	}
+}